@@ -0,0 +1,341 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// DefaultPollInterval is how often WaitJob checks a job by default.
+const DefaultPollInterval = 2 * time.Second
+
+// maxExportLine bounds a single export line, as the server's import does.
+const maxExportLine = 64 << 20
+
+// Upload stores an image on the server under name, for a later Analyze.
+func (c *Client) Upload(ctx context.Context, name string, image io.Reader) (*Upload, error) {
+	req, err := uploadRequest("/api/upload", name, image)
+	if err != nil {
+		return nil, err
+	}
+	var upload Upload
+	if err := c.doJSON(ctx, req, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// UploadAndAnalyze stores an image and queues its analysis in one call,
+// returning the upload and the queued job; follow it with WaitJob. When
+// the server's queue is full, the call is retried after the wait the
+// server asks for.
+func (c *Client) UploadAndAnalyze(ctx context.Context, name string, image io.Reader, opts AnalyzeOptions) (*Upload, *Job, error) {
+	q := url.Values{}
+	if opts.DocumentType != "" {
+		q.Set("document_type", opts.DocumentType)
+	}
+	if opts.Model != "" {
+		q.Set("model", opts.Model)
+	}
+	path := "/api/upload-and-analyze"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	req, err := uploadRequest(path, name, image)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var resp struct {
+		Upload
+		JobID  string `json:"job_id"`
+		Status string `json:"status"`
+	}
+	if err := c.doJSON(ctx, req, &resp); err != nil {
+		return nil, nil, err
+	}
+	job := &Job{ID: resp.JobID, Status: resp.Status, FileName: resp.FileName, FilePath: resp.FilePath, Size: resp.Size}
+	return &resp.Upload, job, nil
+}
+
+// Job returns the status of a job queued by UploadAndAnalyze.
+func (c *Client) Job(ctx context.Context, id string) (*Job, error) {
+	var job Job
+	if err := c.doJSON(ctx, request{method: http.MethodGet, path: "/api/jobs/" + url.PathEscape(id)}, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// WaitJob polls a job every interval (DefaultPollInterval if zero) until
+// it is done or failed, calling progress, if given, each time its status
+// changes. A failed job is returned with its Error set, not as an error;
+// the error is for the job being unreadable or ctx ending.
+func (c *Client) WaitJob(ctx context.Context, id string, interval time.Duration, progress func(*Job)) (*Job, error) {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := ""
+	for {
+		job, err := c.Job(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if job.Status != last && progress != nil {
+			progress(job)
+		}
+		last = job.Status
+		if job.Finished() {
+			return job, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Analyze runs the full pipeline on an image and stores the result. A
+// result some stage failed on the way to is returned with Partial set.
+// Analyses aren't retried after a failure the server may have acted on,
+// since each one is stored.
+func (c *Client) Analyze(ctx context.Context, req AnalyzeRequest) (*Analysis, error) {
+	r, err := jsonRequest(http.MethodPost, "/api/analyze", req)
+	if err != nil {
+		return nil, err
+	}
+	var analysis Analysis
+	if err := c.doJSON(ctx, r, &analysis); err != nil {
+		return nil, err
+	}
+	return &analysis, nil
+}
+
+// AnalyzeText analyzes a receipt or invoice given as plain text, such as
+// an order confirmation email, without OCR.
+func (c *Client) AnalyzeText(ctx context.Context, text string, opts AnalyzeOptions) (*Analysis, error) {
+	r, err := jsonRequest(http.MethodPost, "/api/analyze-text", map[string]string{
+		"text":          text,
+		"document_type": opts.DocumentType,
+		"model":         opts.Model,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var analysis Analysis
+	if err := c.doJSON(ctx, r, &analysis); err != nil {
+		return nil, err
+	}
+	return &analysis, nil
+}
+
+// GetReceipt returns a stored receipt. Use IsNotFound to tell an unknown
+// ID from other errors.
+func (c *Client) GetReceipt(ctx context.Context, id string) (*Receipt, error) {
+	return c.receipt(ctx, request{method: http.MethodGet, path: "/api/receipts/" + url.PathEscape(id)})
+}
+
+// CorrectReceipt replaces a receipt's parsed output, storing it as the
+// receipt's next version. With etag, from GetReceipt, the correction is
+// refused when the receipt was reanalyzed or edited since; IsConflict
+// tells that from other errors and returns the receipt as it is now.
+func (c *Client) CorrectReceipt(ctx context.Context, id string, data map[string]any, etag string) (*Receipt, error) {
+	r, err := jsonRequest(http.MethodPut, "/api/receipts/"+url.PathEscape(id)+"/data", map[string]any{"data": data})
+	if err != nil {
+		return nil, err
+	}
+	r.ifMatch = etag
+	return c.receipt(ctx, r)
+}
+
+// receipt sends req and decodes the receipt it answers with, and its ETag.
+func (c *Client) receipt(ctx context.Context, req request) (*Receipt, error) {
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var rec Receipt
+	if err := json.NewDecoder(resp.Body).Decode(&rec); err != nil {
+		return nil, fmt.Errorf("myprice: failed to decode response: %w", err)
+	}
+	rec.ETag = resp.Header.Get("ETag")
+	return &rec, nil
+}
+
+// AddTags adds tags to a receipt, such as "reimbursable". Tags are
+// lowercased with words joined by hyphens. Only the receipt's owner or an
+// admin can change them.
+func (c *Client) AddTags(ctx context.Context, id string, tags ...string) (*Labels, error) {
+	return c.setLabels(ctx, http.MethodPost, "/api/receipts/"+url.PathEscape(id)+"/tags", map[string][]string{"tags": tags})
+}
+
+// SetTags replaces a receipt's tags; no tags removes them all.
+func (c *Client) SetTags(ctx context.Context, id string, tags ...string) (*Labels, error) {
+	if tags == nil {
+		tags = []string{}
+	}
+	return c.setLabels(ctx, http.MethodPut, "/api/receipts/"+url.PathEscape(id)+"/tags", map[string][]string{"tags": tags})
+}
+
+// RemoveTag removes one tag from a receipt.
+func (c *Client) RemoveTag(ctx context.Context, id, tag string) (*Labels, error) {
+	var labels Labels
+	path := "/api/receipts/" + url.PathEscape(id) + "/tags/" + url.PathEscape(tag)
+	if err := c.doJSON(ctx, request{method: http.MethodDelete, path: path}, &labels); err != nil {
+		return nil, err
+	}
+	return &labels, nil
+}
+
+// SetNotes replaces a receipt's free-text notes; "" clears them.
+func (c *Client) SetNotes(ctx context.Context, id, notes string) (*Labels, error) {
+	return c.setLabels(ctx, http.MethodPut, "/api/receipts/"+url.PathEscape(id)+"/notes", map[string]string{"notes": notes})
+}
+
+// setLabels sends a tags or notes change.
+func (c *Client) setLabels(ctx context.Context, method, path string, body any) (*Labels, error) {
+	r, err := jsonRequest(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	var labels Labels
+	if err := c.doJSON(ctx, r, &labels); err != nil {
+		return nil, err
+	}
+	return &labels, nil
+}
+
+// Search finds receipts whose OCR text matches query, best first, such as
+// a promo code or cashier name the parsers didn't extract. limit is the
+// most results to return; 0 is the server's default.
+func (c *Client) Search(ctx context.Context, query string, limit int) (*SearchResults, error) {
+	q := url.Values{"q": {query}}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var results SearchResults
+	if err := c.doJSON(ctx, request{method: http.MethodGet, path: "/api/receipts/search?" + q.Encode()}, &results); err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+// SemanticSearch finds receipts by meaning rather than printed words, best
+// first, such as "that dinner with sushi in March". It needs the server to
+// have an embedding provider. limit is the most results to return; 0 is
+// the server's default.
+func (c *Client) SemanticSearch(ctx context.Context, query string, limit int) (*SemanticSearchResults, error) {
+	q := url.Values{"q": {query}}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var results SemanticSearchResults
+	if err := c.doJSON(ctx, request{method: http.MethodGet, path: "/api/receipts/search/semantic?" + q.Encode()}, &results); err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+// Ask answers a question about the stored receipts, such as "how much did
+// we spend on team lunches in Q3?", citing the receipts the answer relies
+// on. It needs the server to have the Claude API.
+func (c *Client) Ask(ctx context.Context, q Question) (*Answer, error) {
+	r, err := jsonRequest(http.MethodPost, "/api/ask", q)
+	if err != nil {
+		return nil, err
+	}
+	var answer Answer
+	if err := c.doJSON(ctx, r, &answer); err != nil {
+		return nil, err
+	}
+	return &answer, nil
+}
+
+// ExportOptions controls what Export includes.
+type ExportOptions struct {
+	Images bool // Embed each receipt's original image
+}
+
+// Export streams every stored receipt, calling fn for each as it arrives,
+// so a large store needn't fit in memory. image is nil unless
+// opts.Images is set. Returning an error from fn stops the export with
+// that error. Exports need an admin key.
+func (c *Client) Export(ctx context.Context, opts ExportOptions, fn func(rec *Receipt, image *ExportedImage) error) error {
+	path := "/api/export"
+	if opts.Images {
+		path += "?images=embed"
+	}
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: path})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	// Lines with embedded images are as large as the images
+	scanner.Buffer(make([]byte, 64<<10), maxExportLine)
+	header := false
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var line struct {
+			Type    string         `json:"type"`
+			Version int            `json:"version"`
+			Record  *Receipt       `json:"record"`
+			Image   *ExportedImage `json:"image"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return fmt.Errorf("myprice: invalid export line: %w", err)
+		}
+		switch line.Type {
+		case "header":
+			header = true
+		case "record":
+			if line.Record == nil {
+				continue
+			}
+			if err := fn(line.Record, line.Image); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("myprice: export interrupted: %w", err)
+	}
+	if !header {
+		return fmt.Errorf("myprice: export has no header line")
+	}
+	return nil
+}
+
+// uploadRequest builds a multipart request with image in the image field.
+func uploadRequest(path, name string, image io.Reader) (request, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("image", name)
+	if err != nil {
+		return request{}, fmt.Errorf("myprice: %w", err)
+	}
+	if _, err := io.Copy(part, image); err != nil {
+		return request{}, fmt.Errorf("myprice: failed to read image: %w", err)
+	}
+	if err := mw.Close(); err != nil {
+		return request{}, fmt.Errorf("myprice: %w", err)
+	}
+	return request{method: http.MethodPost, path: path, body: body.Bytes(), contentType: mw.FormDataContentType()}, nil
+}
@@ -0,0 +1,246 @@
+// Package client is a Go client for the myprice HTTP API. It wraps the
+// endpoints other services use most, uploading and analyzing receipts and
+// reading them back, with typed requests and responses, context support,
+// and retries when the server is busy.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRetries is how often a request is retried by default.
+	DefaultRetries = 3
+
+	// DefaultRetryWait is the wait before the first retry when the server
+	// doesn't say how long to wait. It doubles with each retry.
+	DefaultRetryWait = time.Second
+
+	// maxRetryWait caps the wait between retries, including Retry-After.
+	maxRetryWait = time.Minute
+)
+
+// Client calls one myprice server. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+	retries    int
+	retryWait  time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithAPIKey authenticates every request with an API key from API_KEYS.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithHTTPClient sends requests with hc instead of http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetries sets how often a request is retried and the wait before the
+// first retry. Zero retries disables them.
+func WithRetries(n int, wait time.Duration) Option {
+	return func(c *Client) { c.retries, c.retryWait = n, wait }
+}
+
+// New creates a client for the server at baseURL, e.g.
+// "http://localhost:8080".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		retries:    DefaultRetries,
+		retryWait:  DefaultRetryWait,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Error is a response the server answered with an error status.
+type Error struct {
+	StatusCode  int
+	Message     string
+	Code        string        // Machine-readable cause, such as "not_a_receipt"
+	ContentType string        // What a rejected upload appears to be, with "not_a_receipt"
+	RetryAfter  time.Duration // From the Retry-After header, if any
+	Conflict    *Conflict     // The receipt as it is now, with "conflict"
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("myprice: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the server.
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsNotReceipt reports whether err is the server refusing an upload that
+// isn't a receipt or invoice, and what the upload appears to be, such as
+// "photo" or "chat_screenshot".
+func IsNotReceipt(err error) (string, bool) {
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.Code == "not_a_receipt" {
+		return apiErr.ContentType, true
+	}
+	return "", false
+}
+
+// IsConflict reports whether err is the server refusing an edit because
+// the receipt changed since it was read, and the receipt as it is now.
+func IsConflict(err error) (*Conflict, bool) {
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.Conflict != nil {
+		return apiErr.Conflict, true
+	}
+	return nil, false
+}
+
+// request is one API call. The body is kept in memory so it can be sent
+// again on a retry.
+type request struct {
+	method      string
+	path        string // With the query string, if any
+	body        []byte
+	contentType string
+	ifMatch     string // ETag the change is conditional on, if any
+}
+
+// jsonRequest builds a request with v encoded as its JSON body.
+func jsonRequest(method, path string, v any) (request, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return request{}, fmt.Errorf("myprice: failed to encode request: %w", err)
+	}
+	return request{method: method, path: path, body: body, contentType: "application/json"}, nil
+}
+
+// doJSON sends req and decodes a successful response into out.
+func (c *Client) doJSON(ctx context.Context, req request, out any) error {
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("myprice: failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// do sends req, retrying when the server is overloaded or, for GET, when
+// the request failed on the way. Other requests aren't retried after a
+// failure the server may have acted on, since analyses are stored. The
+// caller closes the body of the response, which has a 2xx status.
+func (c *Client) do(ctx context.Context, req request) (*http.Response, error) {
+	wait := c.retryWait
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, req)
+		if err == nil && resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		retryAfter := wait
+		if err == nil {
+			apiErr := readError(resp)
+			if apiErr.RetryAfter > 0 {
+				retryAfter = apiErr.RetryAfter
+			}
+			err = apiErr
+		}
+		if attempt >= c.retries || !retryable(req.method, err) || ctx.Err() != nil {
+			return nil, err
+		}
+
+		timer := time.NewTimer(min(retryAfter, maxRetryWait))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		wait *= 2
+	}
+}
+
+// send makes one attempt at req.
+func (c *Client) send(ctx context.Context, req request) (*http.Response, error) {
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, c.baseURL+req.path, body)
+	if err != nil {
+		return nil, fmt.Errorf("myprice: %w", err)
+	}
+	if req.contentType != "" {
+		httpReq.Header.Set("Content-Type", req.contentType)
+	}
+	if req.ifMatch != "" {
+		httpReq.Header.Set("If-Match", req.ifMatch)
+	}
+	if c.apiKey != "" {
+		httpReq.Header.Set("X-API-Key", c.apiKey)
+	}
+	return c.httpClient.Do(httpReq)
+}
+
+// readError reads an error response and closes its body.
+func readError(resp *http.Response) *Error {
+	defer resp.Body.Close()
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		apiErr.RetryAfter = time.Duration(secs) * time.Second
+	}
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var body struct {
+		Message     string `json:"message"`
+		Code        string `json:"code"`
+		ContentType string `json:"content_type"`
+		Conflict
+	}
+	if json.Unmarshal(data, &body) == nil && body.Message != "" {
+		apiErr.Message, apiErr.Code, apiErr.ContentType = body.Message, body.Code, body.ContentType
+		if body.Code == "conflict" && body.Receipt != nil {
+			body.Receipt.ETag = body.ETag
+			apiErr.Conflict = &body.Conflict
+		}
+	} else {
+		apiErr.Message = strings.TrimSpace(string(data))
+	}
+	return apiErr
+}
+
+// retryable reports whether a failed request may be sent again. 429 and
+// 503 mean the server turned the request away without acting on it.
+func retryable(method string, err error) bool {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		return method == http.MethodGet
+	}
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return method == http.MethodGet
+	}
+	return false
+}
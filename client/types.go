@@ -0,0 +1,255 @@
+package client
+
+import "time"
+
+// Upload is an image stored in the server's upload directory.
+type Upload struct {
+	FilePath string `json:"file_path"` // Pass as AnalyzeRequest.ImagePath
+	FileName string `json:"file_name"`
+	Size     int64  `json:"size"`
+	MimeType string `json:"mime_type"`
+}
+
+// Job states reported in Job.Status.
+const (
+	JobQueued    = "queued"
+	JobAnalyzing = "analyzing"
+	JobDone      = "done"
+	JobFailed    = "failed"
+)
+
+// Job is an analysis queued by UploadAndAnalyze.
+type Job struct {
+	ID          string    `json:"id"`
+	Status      string    `json:"status"`
+	FileName    string    `json:"file_name,omitempty"`
+	FilePath    string    `json:"file_path,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	ReceiptID   string    `json:"receipt_id,omitempty"`   // Once done
+	Error       string    `json:"error,omitempty"`        // Once failed
+	ContentType string    `json:"content_type,omitempty"` // What it appears to be, if it failed for not being a receipt
+	ExpiresAt   time.Time `json:"expires_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Finished reports whether the job is done or failed.
+func (j *Job) Finished() bool {
+	return j.Status == JobDone || j.Status == JobFailed
+}
+
+// AnalyzeOptions are the optional settings of an analysis.
+type AnalyzeOptions struct {
+	DocumentType string // "auto" (default), "receipt", or "invoice"
+	Model        string // One of the server's LLM_MODELS; its default when empty
+}
+
+// AnalyzeRequest names the image to analyze: exactly one of ImagePath,
+// ImageURL, and ImageBase64.
+type AnalyzeRequest struct {
+	ImagePath    string `json:"image_path,omitempty"`   // From Upload, or a path on the server
+	ImageURL     string `json:"image_url,omitempty"`    // Downloaded by the server
+	ImageBase64  string `json:"image_base64,omitempty"` // The image itself
+	MimeType     string `json:"mime_type,omitempty"`    // Type of ImageBase64, checked against the content
+	DocumentType string `json:"document_type,omitempty"`
+	Model        string `json:"model,omitempty"`
+}
+
+// Stage is how one pipeline stage went.
+type Stage struct {
+	Stage      string `json:"stage"`  // "ocr" or "parse"
+	Status     string `json:"status"` // "ok", "failed", or "fallback"
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms,omitempty"`
+}
+
+// Analysis is the result of analyzing one document. The receipt it was
+// stored as can be read back with GetReceipt.
+type Analysis struct {
+	ReceiptID    string         `json:"receipt_id,omitempty"` // Empty if the server couldn't store it
+	ImagePath    string         `json:"image_path"`
+	DocumentType string         `json:"document_type"` // "receipt" or "invoice"
+	Source       string         `json:"source"`        // Where the OCR text came from
+	Model        string         `json:"model,omitempty"`
+	Data         map[string]any `json:"llm_output"` // The parsed receipt or invoice
+	Location     *Location      `json:"location,omitempty"`
+	PurchaseTime *PurchaseTime  `json:"purchase_time,omitempty"`
+	Anomalies    []Anomaly      `json:"anomalies,omitempty"`
+	CaptureHints []CaptureHint  `json:"capture_hints,omitempty"` // How to retake a photo read poorly
+	HookErrors   []HookError    `json:"hook_errors,omitempty"`   // Server hooks whose changes were discarded
+	Partial      bool           `json:"partial,omitempty"`       // Some stage failed; see Stages
+	Stages       []Stage        `json:"stages"`
+}
+
+// Anomaly is a problem the server's checks found on a parsed receipt.
+type Anomaly struct {
+	Detector string `json:"detector"`        // e.g. "arithmetic" or "price_outlier"
+	Severity string `json:"severity"`        // "info", "warning", or "error"
+	Field    string `json:"field,omitempty"` // e.g. "items[2].price"
+	Message  string `json:"message"`
+}
+
+// HookError is a server hook that failed on a result, which was stored
+// without its changes.
+type HookError struct {
+	Hook  string `json:"hook"`
+	Error string `json:"error"`
+}
+
+// CaptureHint is advice for retaking a photo the server read poorly.
+type CaptureHint struct {
+	Code    string  `json:"code"`             // e.g. "cut_off_bottom" or "glare"
+	Region  string  `json:"region"`           // "top", "bottom", "left", "page", or a block such as "totals"
+	Top     float64 `json:"top,omitempty"`    // Where on the photo the region starts, as a fraction of its height
+	Bottom  float64 `json:"bottom,omitempty"` // And where it ends; both zero when unknown
+	Message string  `json:"message"`
+}
+
+// Location is where a receipt's vendor is.
+type Location struct {
+	FormattedAddress string  `json:"formatted_address,omitempty"`
+	Lat              float64 `json:"lat,omitempty"`
+	Lon              float64 `json:"lon,omitempty"`
+	City             string  `json:"city,omitempty"`
+	State            string  `json:"state,omitempty"`
+	PostalCode       string  `json:"postal_code,omitempty"`
+	Country          string  `json:"country,omitempty"`
+	Chain            string  `json:"chain,omitempty"`
+	StoreNumber      string  `json:"store_number,omitempty"`
+	Address          string  `json:"address,omitempty"` // Store address as printed
+	Phone            string  `json:"phone,omitempty"`   // Store phone number as printed
+}
+
+// PurchaseTime is when a purchase was made, in the vendor's time zone.
+type PurchaseTime struct {
+	LocalDate string `json:"local_date,omitempty"` // YYYY-MM-DD
+	Timestamp string `json:"timestamp,omitempty"`  // RFC 3339 with the vendor's UTC offset
+	TimeZone  string `json:"time_zone,omitempty"`
+	DateOnly  bool   `json:"date_only,omitempty"` // The receipt printed no time
+}
+
+// Receipt is a stored analysis result.
+type Receipt struct {
+	ID             string         `json:"id"`
+	ImagePath      string         `json:"image_path"`
+	ImageSHA256    string         `json:"image_sha256,omitempty"`
+	DocumentType   string         `json:"document_type"`
+	Source         string         `json:"source"`
+	Owner          string         `json:"owner,omitempty"`
+	Parser         string         `json:"parser,omitempty"` // "llm" or "heuristic"
+	Model          string         `json:"model,omitempty"`
+	PromptVersion  string         `json:"prompt_version,omitempty"`
+	Version        int            `json:"version,omitempty"`
+	PreviousID     string         `json:"previous_id,omitempty"`
+	SupersededBy   string         `json:"superseded_by,omitempty"` // Set on older versions
+	Revision       int            `json:"revision,omitempty"`      // Counts in-place edits
+	Location       *Location      `json:"location,omitempty"`
+	PurchaseTime   *PurchaseTime  `json:"purchase_time,omitempty"`
+	VendorCategory string         `json:"vendor_category,omitempty"` // Merchant category code, e.g. "5411"
+	Anomalies      []Anomaly      `json:"anomalies,omitempty"`
+	HookErrors     []HookError    `json:"hook_errors,omitempty"`
+	Tags           []string       `json:"tags,omitempty"`
+	Notes          string         `json:"notes,omitempty"`
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+	Data           map[string]any `json:"data"`
+
+	// ETag names the version and revision read, from GetReceipt and
+	// CorrectReceipt, for CorrectReceipt to send back
+	ETag string `json:"-"`
+}
+
+// Change is one field that differs between two versions of a receipt.
+// Path uses dots for object keys and brackets for array indexes, e.g.
+// "data.items[2].price".
+type Change struct {
+	Path string `json:"path"`
+	Old  any    `json:"old"`
+	New  any    `json:"new"`
+}
+
+// Conflict is a receipt that changed since the version an edit was made
+// against.
+type Conflict struct {
+	ETag    string   `json:"etag"`
+	Receipt *Receipt `json:"receipt"` // The current version
+	Changes []Change `json:"changes"` // What the edit would change on it
+}
+
+// Labels are a receipt's tags and notes after a change.
+type Labels struct {
+	ReceiptID string   `json:"receipt_id"` // The receipt's current version
+	Tags      []string `json:"tags"`
+	Notes     string   `json:"notes"`
+}
+
+// SearchMatch is an OCR line that matched a search.
+type SearchMatch struct {
+	Line    int    `json:"line"` // 1-based, in OCR order
+	Text    string `json:"text"`
+	Snippet string `json:"snippet"` // Text with each match wrapped in [brackets]
+}
+
+// SearchResult is a receipt whose OCR text matched a search.
+type SearchResult struct {
+	Receipt *Receipt      `json:"receipt"`
+	Score   int           `json:"score"`
+	Matches []SearchMatch `json:"matches"`
+}
+
+// SearchResults lists the receipts matching a search, best first.
+type SearchResults struct {
+	Query   string         `json:"query"`
+	Results []SearchResult `json:"results"`
+	Count   int            `json:"count"`
+	Total   int            `json:"total"` // Matches before the limit
+}
+
+// SemanticSearchResult is a receipt close in meaning to a search.
+type SemanticSearchResult struct {
+	Receipt *Receipt `json:"receipt"`
+	Score   float64  `json:"score"` // Cosine similarity, up to 1
+}
+
+// SemanticSearchResults lists the receipts closest to a search, best first.
+type SemanticSearchResults struct {
+	Query   string                 `json:"query"`
+	Results []SemanticSearchResult `json:"results"`
+	Count   int                    `json:"count"`
+	Total   int                    `json:"total"` // Receipts scoring at least min_score, before the limit
+}
+
+// Question is a question for Ask. The filters are optional and combined
+// with AND.
+type Question struct {
+	Question     string   `json:"question"`
+	Vendor       string   `json:"vendor,omitempty"` // Case-insensitive substring of the vendor or chain
+	From         string   `json:"from,omitempty"`   // Earliest purchase date, YYYY-MM-DD
+	To           string   `json:"to,omitempty"`     // Latest purchase date, inclusive
+	DocumentType string   `json:"document_type,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Limit        int      `json:"limit,omitempty"` // Most receipts to answer from; 0 is the server's default
+}
+
+// Citation is a receipt an answer relies on.
+type Citation struct {
+	ID     string   `json:"id"`
+	Vendor string   `json:"vendor"`
+	Date   string   `json:"date"`
+	Total  *float64 `json:"total"`
+}
+
+// Answer is the answer to a Question and the receipts it cites.
+type Answer struct {
+	Question  string     `json:"question"`
+	Answer    string     `json:"answer"`
+	Citations []Citation `json:"citations"`
+	Retrieval string     `json:"retrieval"` // "all", "semantic", or "recent"
+	Receipts  int        `json:"receipts"`  // Receipts the answer was drawn from
+	Matched   int        `json:"matched"`   // Receipts passing the filters
+}
+
+// ExportedImage is an original image embedded in an export.
+type ExportedImage struct {
+	Name string `json:"name"`
+	Data []byte `json:"data"`
+}
@@ -2,6 +2,8 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"net/http"
 	"os"
@@ -11,6 +13,14 @@ import (
 )
 
 func main() {
+	// -fake swaps in the fixtures of FAKE_FIXTURES_DIR for Textract and
+	// the Claude API, as FAKE_PROVIDERS=true does
+	fake := flag.Bool("fake", false, "use deterministic fake OCR and LLM providers instead of AWS Textract and the Claude API")
+	flag.Parse()
+	if *fake {
+		os.Setenv("FAKE_PROVIDERS", "true")
+	}
+
 	// Get port from environment or default to 8080
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -27,21 +37,88 @@ func main() {
 
 	// Create server
 	srv := server.NewServer(uploadDir)
+	srv.StartJanitor(context.Background())
+	srv.ResumeBatches(context.Background())
+	srv.StartSinks(context.Background())
+	srv.StartReports(context.Background())
+	srv.StartIngest(context.Background())
+	srv.StartRevalidation(context.Background())
+	srv.StartTextIndex(context.Background())
+	srv.StartEmbeddings(context.Background())
+	srv.StartAnalysisQueue(context.Background())
 
 	// Create mux and register routes
 	mux := http.NewServeMux()
 	srv.RegisterRoutes(mux)
 
-	// Add CORS middleware
-	handler := corsMiddleware(mux)
+	// Log every request, behind the CORS middleware
+	handler := corsMiddleware(srv.LogRequests(mux))
 
 	log.Printf("Starting MyPrice API server on :%s", port)
 	log.Printf("Upload directory: %s", uploadDir)
 	log.Printf("Endpoints:")
 	log.Printf("  GET  /api/health       - Health check")
+	log.Printf("  GET  /api/schema/{type} - JSON Schema of receipt or invoice output")
 	log.Printf("  POST /api/upload       - Upload image")
+	log.Printf("  POST /api/upload-and-analyze - Upload an image and queue its analysis (GET /api/jobs/{id} for status)")
 	log.Printf("  POST /api/load-textract - Load Textract JSON")
-	log.Printf("  POST /api/analyze      - Run full analysis")
+	log.Printf("  POST /api/analyze      - Run full analysis (image_path, image_url, or image_base64)")
+	log.Printf("  POST /api/analyze-pdf  - Split a scanned PDF of several receipts and analyze each")
+	log.Printf("  GET  /api/quota        - Your upload storage and quota")
+	log.Printf("  GET  /api/usage        - Tokens and estimated cost of your analyses")
+	log.Printf("  POST /api/uploads/signed - Issue a signed upload URL for a mobile app")
+	log.Printf("  PUT  /api/uploads/signed/{token} - Upload through a signed URL (GET for status)")
+	log.Printf("  GET  /api/receipts     - List stored receipts")
+	log.Printf("  GET  /api/receipts/search?q= - Search the OCR text of stored receipts")
+	log.Printf("  GET  /api/receipts/search/semantic?q= - Search stored receipts by meaning")
+	log.Printf("  POST /api/ask         - Answer a question about stored receipts")
+	log.Printf("  GET  /api/receipts/compare?a=&b= - Compare two receipts item by item")
+	log.Printf("  GET  /api/review-queue - Receipts waiting for review, lowest quality first")
+	log.Printf("  GET  /api/review-queue/stats - Review queue depth and resolutions")
+	log.Printf("  POST /api/review-queue/{id}/claim - Claim a receipt to review (DELETE to release)")
+	log.Printf("  POST /api/review-queue/{id}/resolve - Accept or reject a reviewed receipt")
+	log.Printf("  GET  /api/receipts/{id} - Get a stored receipt")
+	log.Printf("  DELETE /api/receipts/{id} - Erase a receipt, its versions, and its files")
+	log.Printf("  DELETE /api/users/{name}/receipts - Erase every receipt a user submitted")
+	log.Printf("  GET  /api/receipts/{id}/versions - List all results for the receipt's image")
+	log.Printf("  GET  /api/receipts/{id}/ocr - OCR lines with positions and the fields read from each")
+	log.Printf("  POST /api/receipts/{id}/reocr - Read a region of the image again, enlarged, and patch a field from it")
+	log.Printf("  GET  /api/receipts/{id}/diff - Diff against the previous (or ?against=) version")
+	log.Printf("  GET  /api/audit/duplicates - Flag duplicate or edited-looking receipts")
+	log.Printf("  GET  /api/reports      - Monthly or quarterly spending report (HTML, PDF, JSON)")
+	log.Printf("  GET  /api/analytics/forecast - Next month's projected spending by category")
+	log.Printf("  GET  /api/reports/files - List scheduled reports")
+	log.Printf("  GET  /api/reports/files/{name} - Download a scheduled report")
+	log.Printf("  GET  /api/vendors      - List merged vendors and their aliases")
+	log.Printf("  GET  /api/vendors/variants - Printed vendor names and what they resolve to")
+	log.Printf("  POST /api/vendors/merge - Merge vendor spelling variants")
+	log.Printf("  DELETE /api/vendors/{name} - Remove a merged vendor (or /aliases/{alias})")
+	log.Printf("  GET  /api/workspaces   - List or create (POST) shared workspaces")
+	log.Printf("  GET  /api/workspaces/{id} - Get or delete a workspace")
+	log.Printf("  POST /api/workspaces/{id}/invitations - Invite a user to a workspace")
+	log.Printf("  DELETE /api/workspaces/{id}/members/{name} - Remove a member or leave")
+	log.Printf("  GET  /api/workspaces/{id}/analytics - Workspace spending with per-member attribution")
+	log.Printf("  GET  /api/invitations  - List your pending invitations")
+	log.Printf("  POST /api/invitations/{id}/accept - Join a workspace (or /decline)")
+	log.Printf("  GET  /api/integrations - Your Splitwise and YNAB settings and exports")
+	log.Printf("  PUT  /api/integrations/{provider} - Configure (or DELETE) splitwise or ynab")
+	log.Printf("  POST /api/receipts/{id}/export/{provider} - Push a receipt to Splitwise or YNAB")
+	log.Printf("  GET  /api/export       - Export store as JSONL")
+	log.Printf("  POST /api/import       - Import a JSONL export")
+	log.Printf("  POST /api/admin/cleanup - Apply retention policies now")
+	log.Printf("  POST /api/admin/reprocess - Re-run stored receipts through the current pipeline")
+	log.Printf("  GET  /api/admin/batches - List batch reprocessing jobs")
+	log.Printf("  GET  /api/admin/batches/{id} - Get a batch job and its results")
+	log.Printf("  GET  /api/admin/workers - Provider concurrency limits and queues")
+	log.Printf("  GET  /api/admin/ingest - Dropbox and Google Drive ingestion progress")
+	log.Printf("  GET  /api/admin/revalidation - Background revalidation of low-confidence receipts")
+	log.Printf("  GET  /api/admin/sinks - Deliveries to webhook, file, S3, and Sheets sinks")
+	log.Printf("  POST /api/admin/sinks/{name}/retry - Retry a sink's failed deliveries")
+	log.Printf("  GET  /api/admin/quotas - Upload storage and quota for every user")
+	log.Printf("  GET  /api/admin/usage  - Tokens and estimated cost of analyses by API key")
+	log.Printf("  GET  /api/admin/analyses - Audit log of every analysis attempt")
+	log.Printf("  GET  /api/admin/experiments - Paired results of model experiments")
+	log.Printf("  GET  /api/stats - Processing volume, failure rates, and cost per receipt")
 
 	if err := http.ListenAndServe(":"+port, handler); err != nil {
 		log.Fatalf("Server error: %v", err)
@@ -52,8 +129,8 @@ func main() {
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -63,4 +140,3 @@ func corsMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
-
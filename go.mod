@@ -4,10 +4,13 @@ go 1.23.0
 
 toolchain go1.24.3
 
-require github.com/modelcontextprotocol/go-sdk v1.1.0
+require (
+	github.com/google/jsonschema-go v0.3.0
+	github.com/lib/pq v1.10.9
+	github.com/modelcontextprotocol/go-sdk v1.1.0
+)
 
 require (
-	github.com/google/jsonschema-go v0.3.0 // indirect
 	github.com/yosida95/uritemplate/v3 v3.0.2 // indirect
 	golang.org/x/oauth2 v0.30.0 // indirect
 )
@@ -0,0 +1,142 @@
+// Package accesslog keeps a structured log of every HTTP request: who made
+// it, with which role, what it reached, how it ended, and which files it
+// uploaded or named. It is written as JSON Lines to a file rotated by size
+// and age, for auditing long-running deployments. In privacy mode, file
+// names are replaced by keyed hashes, which still tell the same file apart
+// across entries without revealing it, and request paths, query strings,
+// and client addresses are left out, leaving only the route matched.
+package accesslog
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"myprice/internal/redact"
+)
+
+// Entry is one HTTP request.
+type Entry struct {
+	Time       time.Time `json:"time"` // When the request arrived
+	Method     string    `json:"method"`
+	Route      string    `json:"route,omitempty"` // The pattern matched, e.g. "GET /api/receipts/{id}"
+	Path       string    `json:"path,omitempty"`  // Left out in privacy mode
+	Query      string    `json:"query,omitempty"` // Left out in privacy mode
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"` // Of the response body
+	DurationMS int64     `json:"duration_ms"`
+	Actor      string    `json:"actor,omitempty"`       // Name of the API key
+	Role       string    `json:"role,omitempty"`        // Of the API key
+	RemoteAddr string    `json:"remote_addr,omitempty"` // Hashed in privacy mode
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Files      []string  `json:"files,omitempty"` // Uploaded or named; hashed in privacy mode
+}
+
+// Logger writes entries to a writer, one JSON object per line.
+type Logger struct {
+	w       io.Writer
+	privacy bool
+	key     []byte
+	mu      sync.Mutex
+}
+
+// New returns a logger writing to w, such as a RotatingFile, or only
+// hashing and scrubbing names when w is nil. In privacy mode, names are
+// hashed with key.
+func New(w io.Writer, privacy bool, key []byte) *Logger {
+	return &Logger{w: w, privacy: privacy, key: key}
+}
+
+// Privacy reports whether the logger is in privacy mode.
+func (l *Logger) Privacy() bool {
+	return l.privacy
+}
+
+// Log writes e, after privacy mode has hashed or left out what it hides.
+func (l *Logger) Log(e Entry) error {
+	if l.w == nil {
+		return nil
+	}
+	// Signed URLs carry their token in the path or query string
+	e.Path, e.Query, e.UserAgent = redact.String(e.Path), redact.String(e.Query), redact.String(e.UserAgent)
+	if l.privacy {
+		e.Path, e.Query = "", ""
+		if e.RemoteAddr != "" {
+			e.RemoteAddr = l.Hash(e.RemoteAddr)
+		}
+		files := make([]string, len(e.Files))
+		for i, f := range e.Files {
+			files[i] = l.HashName(f)
+		}
+		e.Files = files
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(append(data, '\n'))
+	return err
+}
+
+// Hash returns a keyed hash of s, 16 hex digits long. The same s always
+// hashes the same with the same key, so entries about it can be found
+// together, while the key keeps guessable values such as IMG_0042.jpg from
+// being recovered by hashing candidates.
+func (l *Logger) Hash(s string) string {
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// HashName hashes a file name or path for privacy mode, keeping its
+// extension: "uploads/IMG_0042.jpg" becomes "9f86d081884c7d65.jpg". Only
+// the base name is hashed, so a file hashes the same wherever it is named
+// from.
+func (l *Logger) HashName(name string) string {
+	base := filepath.Base(name)
+	ext := strings.ToLower(filepath.Ext(base))
+	if len(ext) > 6 || strings.ContainsAny(ext, " \t") {
+		ext = ""
+	}
+	return l.Hash(base) + ext
+}
+
+// fileNamePattern matches a file name, or a path ending in one, with an
+// extension of a file the server reads or writes.
+var fileNamePattern = regexp.MustCompile(`(?i)[\w\-.@+~/\\]*[\w\-@+~]\.(?:jpe?g|png|gif|webp|heic|tiff?|bmp|pdf|txt|json|jsonl|csv|html)\b`)
+
+// Scrub returns line with every file name and path to a file in it hashed
+// as HashName does, for logs written in privacy mode.
+func (l *Logger) Scrub(line string) string {
+	return fileNamePattern.ReplaceAllStringFunc(line, l.HashName)
+}
+
+// ScrubWriter returns a writer that scrubs what is written to it, a line
+// at a time as the log package writes, before writing it to w.
+func (l *Logger) ScrubWriter(w io.Writer) io.Writer {
+	return scrubWriter{l: l, w: w}
+}
+
+// scrubWriter scrubs file names from lines written to w.
+type scrubWriter struct {
+	l *Logger
+	w io.Writer
+}
+
+// Write scrubs p and writes it, reporting all of p as written.
+func (s scrubWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(s.w, s.l.Scrub(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
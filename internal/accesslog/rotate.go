@@ -0,0 +1,156 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotatingFile is an append-only file that is moved aside when it grows
+// past a size or when a new period of its age limit starts, keeping a
+// number of the newest rotated files. It is safe for concurrent use.
+type RotatingFile struct {
+	path     string
+	maxBytes int64         // 0 for no size limit
+	maxAge   time.Duration // 0 for no time limit
+	backups  int           // Rotated files kept; 0 keeps every one
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	period time.Time // Start of the period the open file is for
+}
+
+// NewRotatingFile returns the rotating file at path. The file is opened, or
+// created, on the first write. With maxAge, files are rotated when a new
+// period of that length starts in UTC, as time.Truncate counts them, so a
+// maxAge of 24h rotates at midnight UTC and 1h on the hour.
+func NewRotatingFile(path string, maxBytes int64, maxAge time.Duration, backups int) *RotatingFile {
+	return &RotatingFile{path: path, maxBytes: maxBytes, maxAge: maxAge, backups: backups}
+}
+
+// Write appends p, rotating the file first when p would take it past its
+// size limit or its period has ended. p is never split across files.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	full := r.maxBytes > 0 && r.size+int64(len(p)) > r.maxBytes
+	expired := !r.periodOf(now).Equal(r.period)
+	switch {
+	case r.size == 0:
+		// An empty file is kept for the new period rather than rotated
+		r.period = r.periodOf(now)
+	case full || expired:
+		if err := r.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the open file, if any. A later write opens it again.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// open opens the file for appending. A file left from before a restart
+// belongs to the period it was last written in.
+func (r *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return fmt.Errorf("failed to create log dir: %w", err)
+	}
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	r.period = r.periodOf(time.Now())
+	if r.size > 0 {
+		r.period = r.periodOf(info.ModTime())
+	}
+	return nil
+}
+
+// rotate moves the open file aside, named for when it was rotated, opens a
+// new one, and removes the oldest rotated files past the number kept.
+func (r *RotatingFile) rotate(now time.Time) error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+
+	ext := filepath.Ext(r.path)
+	stem := strings.TrimSuffix(r.path, ext)
+	stamp := now.UTC().Format("20060102T150405.000")
+	rotated := stem + "-" + stamp + ext
+	for i := 1; fileExists(rotated); i++ {
+		rotated = fmt.Sprintf("%s-%s.%d%s", stem, stamp, i, ext)
+	}
+	if err := os.Rename(r.path, rotated); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to rotate log: %w", err)
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.period = r.periodOf(now)
+	r.prune()
+	return nil
+}
+
+// prune removes the oldest rotated files past the number kept. Rotated
+// names sort in the order they were rotated.
+func (r *RotatingFile) prune() {
+	if r.backups <= 0 {
+		return
+	}
+	ext := filepath.Ext(r.path)
+	matches, err := filepath.Glob(strings.TrimSuffix(r.path, ext) + "-*" + ext)
+	if err != nil || len(matches) <= r.backups {
+		return
+	}
+	sort.Strings(matches)
+	for _, old := range matches[:len(matches)-r.backups] {
+		os.Remove(old)
+	}
+}
+
+// periodOf returns the start of the period t is in, or the zero time
+// without an age limit.
+func (r *RotatingFile) periodOf(t time.Time) time.Time {
+	if r.maxAge <= 0 {
+		return time.Time{}
+	}
+	return t.UTC().Truncate(r.maxAge)
+}
+
+// fileExists reports whether anything is at path.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,195 @@
+// Package analysislog keeps an append-only log of every analysis attempt:
+// who asked for it, which image, the OCR source, parser, model and prompt
+// version that ran, how long each stage took, the model tokens it used, and
+// how it ended. It answers questions like "why does this receipt parse
+// differently than last week" after the results themselves have changed.
+package analysislog
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"myprice/internal/redact"
+)
+
+// Outcomes of an attempt.
+const (
+	OutcomeOK        = "ok"
+	OutcomePartial   = "partial" // A result, but some stage failed
+	OutcomeFailed    = "failed"
+	OutcomeCancelled = "cancelled"
+)
+
+// Stage is how one pipeline stage went.
+type Stage struct {
+	Stage      string `json:"stage"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// Tokens counts the model calls of an attempt and the tokens they used.
+type Tokens struct {
+	Calls  int `json:"calls"`
+	Input  int `json:"input"`
+	Output int `json:"output"`
+}
+
+// Entry is one analysis attempt.
+type Entry struct {
+	ID            string    `json:"id"`
+	Time          time.Time `json:"time"` // When the attempt started
+	Actor         string    `json:"actor,omitempty"`
+	Via           string    `json:"via"` // Entry point, e.g. "api" or "reprocess"
+	ImagePath     string    `json:"image_path,omitempty"`
+	ImageSHA256   string    `json:"image_sha256,omitempty"`
+	DocumentType  string    `json:"document_type,omitempty"`
+	OCRSource     string    `json:"ocr_source,omitempty"`
+	Parser        string    `json:"parser,omitempty"`
+	Model         string    `json:"model,omitempty"`
+	PromptVersion string    `json:"prompt_version,omitempty"`
+	Stages        []Stage   `json:"stages,omitempty"`
+	Tokens        Tokens    `json:"tokens"`
+	DurationMS    int64     `json:"duration_ms"`
+	Outcome       string    `json:"outcome"`
+	Error         string    `json:"error,omitempty"`
+	ReceiptID     string    `json:"receipt_id,omitempty"`    // The stored result, if any
+	PreviousID    string    `json:"previous_id,omitempty"`   // The receipt reprocessed, if any
+	RawResponses  int       `json:"raw_responses,omitempty"` // Model answers kept under the entry's ID
+}
+
+// Query selects entries. Empty fields match everything.
+type Query struct {
+	Actor         string
+	Via           string
+	Outcome       string
+	Model         string
+	PromptVersion string
+	ImageSHA256   string
+	ReceiptID     string // Matches the stored result or the receipt reprocessed
+	Since, Until  time.Time
+	Limit         int // 0 means no limit
+}
+
+// matches reports whether e satisfies q.
+func (q Query) matches(e *Entry) bool {
+	switch {
+	case q.Actor != "" && e.Actor != q.Actor,
+		q.Via != "" && e.Via != q.Via,
+		q.Outcome != "" && e.Outcome != q.Outcome,
+		q.Model != "" && e.Model != q.Model,
+		q.PromptVersion != "" && e.PromptVersion != q.PromptVersion,
+		q.ImageSHA256 != "" && e.ImageSHA256 != q.ImageSHA256,
+		q.ReceiptID != "" && e.ReceiptID != q.ReceiptID && e.PreviousID != q.ReceiptID,
+		!q.Since.IsZero() && e.Time.Before(q.Since),
+		!q.Until.IsZero() && !e.Time.Before(q.Until):
+		return false
+	}
+	return true
+}
+
+// NewID returns a random entry ID, for callers that need an entry's ID
+// before appending it.
+func NewID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Log appends entries to a JSON Lines file. Entries are never rewritten.
+type Log struct {
+	path string
+	mu   sync.Mutex
+}
+
+// New returns the log at path. The file is created on the first append.
+func New(path string) *Log {
+	return &Log{path: path}
+}
+
+// Append writes an entry and syncs it to disk, assigning its ID if empty.
+func (l *Log) Append(e Entry) error {
+	if e.ID == "" {
+		e.ID = NewID()
+	}
+	// Errors can quote credentials, and image URLs can be signed
+	e.Error, e.ImagePath = redact.String(e.Error), redact.String(e.ImagePath)
+	if len(e.Stages) > 0 {
+		stages := make([]Stage, len(e.Stages))
+		for i, st := range e.Stages {
+			st.Error = redact.String(st.Error)
+			stages[i] = st
+		}
+		e.Stages = stages
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Find returns the entries matching q, newest first, and how many matched
+// before q.Limit was applied. A line cut short by a crash is skipped.
+func (l *Log) Find(q Query) ([]Entry, int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Entry{}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4<<20)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if q.matches(&e) {
+			entries = append(entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+	total := len(entries)
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+	}
+	if entries == nil {
+		entries = []Entry{}
+	}
+	return entries, total, nil
+}
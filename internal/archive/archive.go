@@ -0,0 +1,82 @@
+// Package archive keeps the original files receipts were analyzed from,
+// exactly as received, for audits, disputes, and reprocessing after the
+// working copy in the upload directory has been cleaned up.
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"myprice/internal/crypt"
+)
+
+// ErrNotFound is returned for an original that isn't archived.
+var ErrNotFound = errors.New("original not archived")
+
+// Archive stores files by the SHA-256 of their contents, so a file
+// received twice is kept once. Files are encrypted with the cipher, if any.
+type Archive struct {
+	dir    string
+	cipher *crypt.Cipher
+}
+
+// New opens the archive in dir, creating it if needed.
+func New(dir string, cipher *crypt.Cipher) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create archive dir: %w", err)
+	}
+	return &Archive{dir: dir, cipher: cipher}, nil
+}
+
+// Put archives data and returns its hex SHA-256. Data already archived is
+// not written again.
+func (a *Archive) Put(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	path := a.Path(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+	if err := a.cipher.WriteFile(path, data, 0600); err != nil {
+		return "", fmt.Errorf("failed to archive original: %w", err)
+	}
+	return hash, nil
+}
+
+// Get returns the archived file with the given SHA-256.
+func (a *Archive) Get(hash string) ([]byte, error) {
+	if !validHash(hash) {
+		return nil, ErrNotFound
+	}
+	data, err := a.cipher.ReadFile(a.Path(hash))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read original: %w", err)
+	}
+	return data, nil
+}
+
+// Path returns where the file with the given SHA-256 is archived, or "" for
+// a malformed hash.
+func (a *Archive) Path(hash string) string {
+	if !validHash(hash) {
+		return ""
+	}
+	return filepath.Join(a.dir, hash)
+}
+
+// validHash reports whether hash is a hex SHA-256, so it can't name a path
+// outside the archive.
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
@@ -0,0 +1,296 @@
+// Package budget keeps users' monthly budgets, each for one spending
+// category or vendor, and the alerts sent as spending against them crosses
+// a threshold.
+package budget
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"myprice/internal/crypt"
+	"myprice/internal/store"
+)
+
+// ErrNotFound is returned for an unknown budget ID.
+var ErrNotFound = errors.New("budget not found")
+
+// Thresholds are the percentages of a budget whose crossing is alerted.
+var Thresholds = []int{80, 100}
+
+// maxAlerts bounds the alerts kept per budget.
+const maxAlerts = 50
+
+// Budget is a monthly amount to spend on one category or at one vendor.
+type Budget struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Category  string    `json:"category,omitempty"` // Spending category, as in reports; lowercase
+	Vendor    string    `json:"vendor,omitempty"`   // Vendor or chain, as in reports
+	Amount    float64   `json:"amount"`             // Per calendar month
+	Owner     string    `json:"owner,omitempty"`    // Name of the API key that created it
+	Alerts    []Alert   `json:"alerts,omitempty"`   // Newest first
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Alert records spending in a month crossing a threshold of a budget.
+type Alert struct {
+	BudgetID  string    `json:"budget_id"`
+	Name      string    `json:"name,omitempty"`
+	Category  string    `json:"category,omitempty"`
+	Vendor    string    `json:"vendor,omitempty"`
+	Owner     string    `json:"owner,omitempty"`
+	Period    string    `json:"period"`    // The month, "2025-11"
+	Threshold int       `json:"threshold"` // Percent of the budget, e.g. 80
+	Amount    float64   `json:"amount"`    // The budget
+	Spent     float64   `json:"spent"`
+	ReceiptID string    `json:"receipt_id"` // The receipt whose spending crossed it
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Validate checks that b is scoped to exactly one category or vendor and
+// has a positive amount, normalizing the category.
+func (b *Budget) Validate() error {
+	b.Name = strings.TrimSpace(b.Name)
+	b.Category = strings.ToLower(strings.TrimSpace(b.Category))
+	b.Vendor = strings.TrimSpace(b.Vendor)
+	if (b.Category == "") == (b.Vendor == "") {
+		return errors.New("give either a category or a vendor, not both")
+	}
+	if b.Amount <= 0 {
+		return errors.New("amount must be positive")
+	}
+	return nil
+}
+
+// Alerted returns the highest threshold already alerted for period, or 0.
+func (b *Budget) Alerted(period string) int {
+	highest := 0
+	for _, a := range b.Alerts {
+		if a.Period == period {
+			highest = max(highest, a.Threshold)
+		}
+	}
+	return highest
+}
+
+// FileStore keeps one JSON file per budget in a directory, with an
+// in-memory index loaded at startup.
+type FileStore struct {
+	dir     string
+	cipher  *crypt.Cipher
+	mu      sync.RWMutex
+	budgets map[string]*Budget
+}
+
+// NewFileStore opens (creating if needed) a budget store rooted at dir.
+// Budgets are encrypted on disk when c is non-nil.
+func NewFileStore(dir string, c *crypt.Cipher) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create budget dir: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read budget dir: %w", err)
+	}
+
+	s := &FileStore{dir: dir, cipher: c, budgets: make(map[string]*Budget)}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		data, err := c.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read budget %s: %w", name, err)
+		}
+		var b Budget
+		if err := json.Unmarshal(data, &b); err != nil {
+			return nil, fmt.Errorf("failed to parse budget %s: %w", name, err)
+		}
+		s.budgets[b.ID] = &b
+	}
+
+	return s, nil
+}
+
+// Create saves b under a new ID and returns a copy of it.
+func (s *FileStore) Create(b Budget) (*Budget, error) {
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+	b.ID = store.NewID()
+	b.CreatedAt = time.Now().UTC()
+	b.UpdatedAt = b.CreatedAt
+	b.Alerts = nil
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.save(&b); err != nil {
+		return nil, err
+	}
+	return clone(&b), nil
+}
+
+// Get returns a copy of the budget with the given ID.
+func (s *FileStore) Get(id string) (*Budget, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, ok := s.budgets[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return clone(b), nil
+}
+
+// List returns copies of all budgets, oldest first.
+func (s *FileStore) List() []*Budget {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*Budget, 0, len(s.budgets))
+	for _, b := range s.budgets {
+		list = append(list, clone(b))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// Update replaces the name, scope, and amount of budget id with those of
+// b, keeping its alerts.
+func (s *FileStore) Update(id string, b Budget) (*Budget, error) {
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.budgets[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	updated := clone(current)
+	updated.Name, updated.Category, updated.Vendor, updated.Amount = b.Name, b.Category, b.Vendor, b.Amount
+	updated.UpdatedAt = time.Now().UTC()
+	if err := s.save(updated); err != nil {
+		return nil, err
+	}
+	return clone(updated), nil
+}
+
+// Delete removes a budget.
+func (s *FileStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.budgets[id]; !ok {
+		return ErrNotFound
+	}
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete budget: %w", err)
+	}
+	delete(s.budgets, id)
+	return nil
+}
+
+// Check records an alert when spent in period, which receiptID brought
+// it to, crosses a threshold of budget id not yet alerted for period. When
+// several are crossed at once, only the highest is alerted. It returns
+// the alert, or nil when there is none.
+func (s *FileStore) Check(id, period string, spent float64, receiptID string) (*Alert, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.budgets[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	crossed := 0
+	for _, t := range Thresholds {
+		if spent >= b.Amount*float64(t)/100 {
+			crossed = t
+		}
+	}
+	if crossed == 0 || crossed <= b.Alerted(period) {
+		return nil, nil
+	}
+
+	alert := Alert{
+		BudgetID:  b.ID,
+		Name:      b.Name,
+		Category:  b.Category,
+		Vendor:    b.Vendor,
+		Owner:     b.Owner,
+		Period:    period,
+		Threshold: crossed,
+		Amount:    b.Amount,
+		Spent:     spent,
+		ReceiptID: receiptID,
+		CreatedAt: time.Now().UTC(),
+	}
+	updated := clone(b)
+	updated.Alerts = append([]Alert{alert}, updated.Alerts...)
+	if len(updated.Alerts) > maxAlerts {
+		updated.Alerts = updated.Alerts[:maxAlerts]
+	}
+	if err := s.save(updated); err != nil {
+		return nil, err
+	}
+	return &alert, nil
+}
+
+// AlertsFor returns the alerts receiptID set off, across every budget.
+func (s *FileStore) AlertsFor(receiptID string) []Alert {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var alerts []Alert
+	for _, b := range s.budgets {
+		for _, a := range b.Alerts {
+			if a.ReceiptID == receiptID {
+				alerts = append(alerts, a)
+			}
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].CreatedAt.Before(alerts[j].CreatedAt)
+	})
+	return alerts
+}
+
+// save writes b and updates the index. The caller holds s.mu.
+func (s *FileStore) save(b *Budget) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize budget: %w", err)
+	}
+	if err := s.cipher.WriteFile(s.path(b.ID), data, 0644); err != nil {
+		return fmt.Errorf("failed to write budget: %w", err)
+	}
+	s.budgets[b.ID] = clone(b)
+	return nil
+}
+
+// path returns the file path for a budget ID.
+func (s *FileStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// clone copies a budget so callers can't mutate the index.
+func clone(b *Budget) *Budget {
+	c := *b
+	c.Alerts = append([]Alert(nil), b.Alerts...)
+	return &c
+}
@@ -0,0 +1,114 @@
+// Package crypt encrypts receipt images, OCR output, and stored results at
+// rest with AES-256-GCM.
+//
+// Sealed data starts with a short magic header, so files written before
+// encryption was enabled are still readable: Open passes unsealed data
+// through unchanged, and they are sealed the next time they are written.
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+
+	"myprice/internal/fsutil"
+)
+
+// KeySize is the required key length in bytes (AES-256).
+const KeySize = 32
+
+// magic prefixes every sealed blob; the last byte is the format version.
+var magic = []byte("MPE\x01")
+
+// ErrNoKey is returned when sealed data is read without a key configured.
+var ErrNoKey = errors.New("data is encrypted but no encryption key is configured")
+
+// Cipher seals and opens data. A nil *Cipher is valid and means encryption
+// is disabled: Seal returns data unchanged and Open only accepts plaintext.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// New creates a Cipher from a 32-byte key.
+func New(key []byte) (*Cipher, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Enabled reports whether c encrypts data.
+func (c *Cipher) Enabled() bool {
+	return c != nil
+}
+
+// IsSealed reports whether data was produced by Seal.
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+// Seal encrypts plaintext with a fresh random nonce.
+func (c *Cipher) Seal(plaintext []byte) []byte {
+	if c == nil {
+		return plaintext
+	}
+
+	nonce := make([]byte, c.aead.NonceSize(), len(magic)+c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic("crypt: failed to read random nonce: " + err.Error())
+	}
+
+	out := append(append([]byte{}, magic...), nonce...)
+	return c.aead.Seal(out, nonce, plaintext, magic)
+}
+
+// Open decrypts data produced by Seal. Unsealed data is returned as is.
+func (c *Cipher) Open(data []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return data, nil
+	}
+	if c == nil {
+		return nil, ErrNoKey
+	}
+
+	rest := data[len(magic):]
+	nonceSize := c.aead.NonceSize()
+	if len(rest) < nonceSize {
+		return nil, fmt.Errorf("encrypted data is truncated")
+	}
+	plaintext, err := c.aead.Open(nil, rest[:nonceSize], rest[nonceSize:], magic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: wrong key or corrupted data")
+	}
+	return plaintext, nil
+}
+
+// ReadFile reads and decrypts the file at path.
+func (c *Cipher) ReadFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := c.Open(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return plaintext, nil
+}
+
+// WriteFile encrypts data and writes it atomically to path.
+func (c *Cipher) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return fsutil.WriteFile(path, c.Seal(data), perm)
+}
@@ -0,0 +1,64 @@
+// Package crypt provides loading of the at-rest encryption key from the environment.
+package crypt
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"myprice/internal/redact"
+)
+
+// FromEnv builds the at-rest cipher from the environment. It returns nil
+// when no key is configured. The key is taken from, in order:
+//
+//   - ENCRYPTION_KEY: a base64-encoded 32-byte key
+//   - ENCRYPTION_KEY_FILE: a file containing such a key
+//   - ENCRYPTION_KMS_KEY_BLOB: a data key encrypted with AWS KMS, decrypted
+//     at startup through the AWS CLI
+func FromEnv() (*Cipher, error) {
+	var encoded string
+	switch {
+	case os.Getenv("ENCRYPTION_KEY") != "":
+		encoded = os.Getenv("ENCRYPTION_KEY")
+	case os.Getenv("ENCRYPTION_KEY_FILE") != "":
+		data, err := os.ReadFile(os.Getenv("ENCRYPTION_KEY_FILE"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ENCRYPTION_KEY_FILE: %w", err)
+		}
+		encoded = string(data)
+	case os.Getenv("ENCRYPTION_KMS_KEY_BLOB") != "":
+		plaintext, err := kmsDecrypt(os.Getenv("ENCRYPTION_KMS_KEY_BLOB"))
+		if err != nil {
+			return nil, err
+		}
+		encoded = plaintext
+	default:
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("encryption key is not valid base64: %w", err)
+	}
+	return New(key)
+}
+
+// kmsDecrypt decrypts a KMS-encrypted data key and returns it base64-encoded.
+func kmsDecrypt(blobPath string) (string, error) {
+	cmd := exec.Command("aws", "kms", "decrypt",
+		"--ciphertext-blob", "fileb://"+blobPath,
+		"--query", "Plaintext",
+		"--output", "text",
+	)
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("kms decrypt failed: %s", redact.String(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("kms decrypt command failed: %w", err)
+	}
+	return string(output), nil
+}
@@ -0,0 +1,47 @@
+// Package embed turns receipt descriptions into vectors through a
+// pluggable embedding provider, and keeps them in an index searched by
+// meaning rather than by words, so "that dinner with sushi in March" finds
+// a receipt that never prints the word dinner.
+package embed
+
+import (
+	"context"
+	"math"
+)
+
+// Embedder computes embedding vectors for texts.
+type Embedder interface {
+	// Model names the provider and model, as in "openai:text-embedding-3-small".
+	// Vectors from different models can't be compared.
+	Model() string
+	// Embed returns one vector per text, in order.
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// normalize scales v to unit length in place, so the dot product of two
+// normalized vectors is their cosine similarity. A zero vector is left as is.
+func normalize(v []float32) {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return
+	}
+	norm := float32(math.Sqrt(sum))
+	for i := range v {
+		v[i] /= norm
+	}
+}
+
+// dot returns the dot product of a and b, or 0 if their lengths differ.
+func dot(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
@@ -0,0 +1,202 @@
+package embed
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+
+	"myprice/internal/crypt"
+)
+
+// Vector is the embedding of one receipt.
+type Vector struct {
+	ID     string
+	Sum    string // Identifies the text embedded, so changed text is re-embedded
+	Values []float32
+}
+
+// Hit is a receipt close in meaning to a query.
+type Hit struct {
+	ID    string  `json:"id"`
+	Score float64 `json:"score"` // Cosine similarity, up to 1; higher is closer
+}
+
+// Index holds the embedding of every receipt, persisted as one JSON file
+// and searched by brute force, which is fast enough for the receipts of a
+// household or small business.
+type Index struct {
+	path    string
+	model   string
+	cipher  *crypt.Cipher
+	mu      sync.RWMutex
+	entries map[string]entry
+}
+
+// entry is a stored vector, normalized to unit length.
+type entry struct {
+	sum    string
+	values []float32
+}
+
+// indexFile is the file format. Vectors are little-endian float32s, which
+// JSON holds as base64.
+type indexFile struct {
+	Model   string               `json:"model"`
+	Entries map[string]fileEntry `json:"entries"`
+}
+
+type fileEntry struct {
+	Sum    string `json:"sum"`
+	Vector []byte `json:"vector"`
+}
+
+// Open loads the index at path for vectors of model, starting empty if the
+// file doesn't exist or holds another model's vectors, which can't be
+// compared with the new model's. The file is encrypted when c is non-nil.
+func Open(path, model string, c *crypt.Cipher) (*Index, error) {
+	x := &Index{path: path, model: model, cipher: c, entries: make(map[string]entry)}
+
+	data, err := c.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return x, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embedding index: %w", err)
+	}
+	var file indexFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse embedding index: %w", err)
+	}
+	if file.Model != model {
+		return x, nil
+	}
+	for id, fe := range file.Entries {
+		if len(fe.Vector)%4 != 0 {
+			return nil, fmt.Errorf("embedding of %s in the index is corrupt", id)
+		}
+		values := make([]float32, len(fe.Vector)/4)
+		for i := range values {
+			values[i] = math.Float32frombits(binary.LittleEndian.Uint32(fe.Vector[i*4:]))
+		}
+		x.entries[id] = entry{sum: fe.Sum, values: values}
+	}
+	return x, nil
+}
+
+// Put stores vectors, replacing any earlier ones for the same IDs.
+func (x *Index) Put(vectors ...Vector) error {
+	if len(vectors) == 0 {
+		return nil
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	next := make(map[string]entry, len(x.entries)+len(vectors))
+	for id, e := range x.entries {
+		next[id] = e
+	}
+	for _, v := range vectors {
+		values := append([]float32(nil), v.Values...)
+		normalize(values)
+		next[v.ID] = entry{sum: v.Sum, values: values}
+	}
+	if err := x.save(next); err != nil {
+		return err
+	}
+	x.entries = next
+	return nil
+}
+
+// Delete removes receipts from the index. Unknown IDs are ignored.
+func (x *Index) Delete(ids ...string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	next := make(map[string]entry, len(x.entries))
+	for id, e := range x.entries {
+		next[id] = e
+	}
+	removed := false
+	for _, id := range ids {
+		if _, ok := next[id]; ok {
+			delete(next, id)
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+	if err := x.save(next); err != nil {
+		return err
+	}
+	x.entries = next
+	return nil
+}
+
+// Current reports whether a receipt is indexed with the text identified
+// by sum.
+func (x *Index) Current(id, sum string) bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	e, ok := x.entries[id]
+	return ok && e.sum == sum
+}
+
+// Len returns the number of indexed receipts.
+func (x *Index) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.entries)
+}
+
+// Search returns every indexed receipt scoring at least minScore against
+// query, closest first. keep, if non-nil, restricts the results to the IDs
+// it accepts.
+func (x *Index) Search(query []float32, minScore float64, keep func(id string) bool) []Hit {
+	q := append([]float32(nil), query...)
+	normalize(q)
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	var hits []Hit
+	for id, e := range x.entries {
+		if keep != nil && !keep(id) {
+			continue
+		}
+		if score := dot(q, e.values); score >= minScore {
+			hits = append(hits, Hit{ID: id, Score: score})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	return hits
+}
+
+func (x *Index) save(entries map[string]entry) error {
+	file := indexFile{Model: x.model, Entries: make(map[string]fileEntry, len(entries))}
+	for id, e := range entries {
+		buf := make([]byte, 4*len(e.values))
+		for i, f := range e.values {
+			binary.LittleEndian.PutUint32(buf[i*4:], math.Float32bits(f))
+		}
+		file.Entries[id] = fileEntry{Sum: e.sum, Vector: buf}
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return fmt.Errorf("failed to serialize embedding index: %w", err)
+	}
+	if err := x.cipher.WriteFile(x.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write embedding index: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+// Package eval keeps the paired results of model experiments: the same
+// image parsed by the production model and prompt and by a candidate, so
+// an upgrade can be judged on real traffic before it serves anyone.
+package eval
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"myprice/internal/analysislog"
+	"myprice/internal/crypt"
+	"myprice/internal/store"
+)
+
+// Run is one side of a pair: what a model and prompt made of the image.
+type Run struct {
+	Model         string             `json:"model"`
+	PromptVersion string             `json:"prompt_version"`
+	Output        map[string]any     `json:"output,omitempty"` // Parsed output, before enrichment
+	Issues        []string           `json:"issues,omitempty"` // Validation problems left in the answer
+	Error         string             `json:"error,omitempty"`
+	DurationMS    int64              `json:"duration_ms"`
+	Tokens        analysislog.Tokens `json:"tokens"`
+}
+
+// Failed reports whether the run produced no output.
+func (r *Run) Failed() bool {
+	return r.Error != "" || r.Output == nil
+}
+
+// Pair is one image parsed by both sides of an experiment.
+type Pair struct {
+	ID           string         `json:"id"`
+	Time         time.Time      `json:"time"`
+	Experiment   string         `json:"experiment"`
+	ImageSHA256  string         `json:"image_sha256,omitempty"`
+	DocumentType string         `json:"document_type"`
+	ReceiptID    string         `json:"receipt_id,omitempty"` // The stored control result, if any
+	Control      Run            `json:"control"`
+	Candidate    Run            `json:"candidate"`
+	Changes      []store.Change `json:"changes"` // Fields where the candidate differs, control as old
+}
+
+// Agree reports whether both sides succeeded with the same output.
+func (p *Pair) Agree() bool {
+	return !p.Control.Failed() && !p.Candidate.Failed() && len(p.Changes) == 0
+}
+
+// Compare fills in Changes from the two outputs. A failed side has no
+// changes to report.
+func (p *Pair) Compare() {
+	p.Changes = []store.Change{}
+	if !p.Control.Failed() && !p.Candidate.Failed() {
+		p.Changes = store.Diff(p.Control.Output, p.Candidate.Output)
+	}
+}
+
+// Query selects pairs. Empty fields match everything.
+type Query struct {
+	Experiment   string
+	Model        string // Either side's model
+	DocumentType string
+	ReceiptID    string
+	Since, Until time.Time
+	Limit        int // 0 means no limit
+}
+
+// matches reports whether p satisfies q.
+func (q Query) matches(p *Pair) bool {
+	switch {
+	case q.Experiment != "" && p.Experiment != q.Experiment,
+		q.Model != "" && p.Control.Model != q.Model && p.Candidate.Model != q.Model,
+		q.DocumentType != "" && p.DocumentType != q.DocumentType,
+		q.ReceiptID != "" && p.ReceiptID != q.ReceiptID,
+		!q.Since.IsZero() && p.Time.Before(q.Since),
+		!q.Until.IsZero() && !p.Time.Before(q.Until):
+		return false
+	}
+	return true
+}
+
+// Store keeps one JSON file per pair in a directory. Pairs hold parsed
+// receipts, so they are encrypted like the receipt store.
+type Store struct {
+	dir    string
+	cipher *crypt.Cipher
+	mu     sync.Mutex
+}
+
+// Open opens (creating if needed) the store in dir. Pairs are encrypted on
+// disk when c is non-nil.
+func Open(dir string, c *crypt.Cipher) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create eval dir: %w", err)
+	}
+	return &Store{dir: dir, cipher: c}, nil
+}
+
+// Put saves a pair, assigning its ID and time if empty.
+func (s *Store) Put(p *Pair) error {
+	if p.ID == "" {
+		p.ID = store.NewID()
+	}
+	if p.Time.IsZero() {
+		p.Time = time.Now().UTC()
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize pair: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.cipher.WriteFile(filepath.Join(s.dir, p.ID+".json"), data, 0644); err != nil {
+		return fmt.Errorf("failed to write pair: %w", err)
+	}
+	return nil
+}
+
+// Find returns the pairs matching q, newest first, and how many matched
+// before q.Limit was applied.
+func (s *Store) Find(q Query) ([]*Pair, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all, err := s.load()
+	if err != nil {
+		return nil, 0, err
+	}
+	pairs := make([]*Pair, 0)
+	for _, p := range all {
+		if q.matches(p) {
+			pairs = append(pairs, p)
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].Time.After(pairs[j].Time) })
+	total := len(pairs)
+	if q.Limit > 0 && len(pairs) > q.Limit {
+		pairs = pairs[:q.Limit]
+	}
+	return pairs, total, nil
+}
+
+// DeleteReceipts removes the pairs of erased receipts and returns how many
+// were removed.
+func (s *Store) DeleteReceipts(ids []string) (int, error) {
+	doomed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		doomed[id] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all, err := s.load()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, p := range all {
+		if p.ReceiptID == "" || !doomed[p.ReceiptID] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, p.ID+".json")); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("failed to delete pair %s: %w", p.ID, err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// load reads every pair in the directory.
+func (s *Store) load() ([]*Pair, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read eval dir: %w", err)
+	}
+	var pairs []*Pair
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		data, err := s.cipher.ReadFile(filepath.Join(s.dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pair %s: %w", name, err)
+		}
+		var p Pair
+		if err := json.Unmarshal(data, &p); err != nil {
+			return nil, fmt.Errorf("failed to parse pair %s: %w", name, err)
+		}
+		pairs = append(pairs, &p)
+	}
+	return pairs, nil
+}
+
+// SideSummary totals one side of an experiment.
+type SideSummary struct {
+	Failed        int                `json:"failed"`      // Runs with no output
+	WithIssues    int                `json:"with_issues"` // Runs whose answer kept validation problems
+	MeanDuration  int64              `json:"mean_duration_ms"`
+	Tokens        analysislog.Tokens `json:"tokens"`
+	durationTotal int64
+}
+
+// Summary compares the two sides over a set of pairs.
+type Summary struct {
+	Pairs     int         `json:"pairs"`
+	Agreed    int         `json:"agreed"` // Pairs with identical output
+	Control   SideSummary `json:"control"`
+	Candidate SideSummary `json:"candidate"`
+
+	// How many pairs differed in each field, with array indexes dropped,
+	// e.g. "items[].price"
+	FieldChanges map[string]int `json:"field_changes"`
+}
+
+// indexPattern matches array indexes in change paths.
+var indexPattern = regexp.MustCompile(`\[\d+\]`)
+
+// Summarize totals pairs.
+func Summarize(pairs []*Pair) Summary {
+	sum := Summary{Pairs: len(pairs), FieldChanges: make(map[string]int)}
+	for _, p := range pairs {
+		if p.Agree() {
+			sum.Agreed++
+		}
+		sum.Control.add(&p.Control)
+		sum.Candidate.add(&p.Candidate)
+
+		fields := make(map[string]bool)
+		for _, c := range p.Changes {
+			fields[indexPattern.ReplaceAllString(c.Path, "[]")] = true
+		}
+		for f := range fields {
+			sum.FieldChanges[f]++
+		}
+	}
+	if sum.Pairs > 0 {
+		sum.Control.MeanDuration = sum.Control.durationTotal / int64(sum.Pairs)
+		sum.Candidate.MeanDuration = sum.Candidate.durationTotal / int64(sum.Pairs)
+	}
+	return sum
+}
+
+// add counts one run.
+func (s *SideSummary) add(r *Run) {
+	if r.Failed() {
+		s.Failed++
+	} else if len(r.Issues) > 0 {
+		s.WithIssues++
+	}
+	s.durationTotal += r.DurationMS
+	s.Tokens.Calls += r.Tokens.Calls
+	s.Tokens.Input += r.Tokens.Input
+	s.Tokens.Output += r.Tokens.Output
+}
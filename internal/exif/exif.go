@@ -0,0 +1,234 @@
+// Package exif reads the capture time and GPS position that phones and
+// cameras record in a photo's EXIF block.
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Metadata is what a photo records about when and where it was taken.
+type Metadata struct {
+	// CapturedAt is the camera's local time, "2006-01-02T15:04:05"
+	CapturedAt string `json:"captured_at,omitempty"`
+	// Offset is the camera's UTC offset, e.g. "-08:00", when recorded
+	Offset string `json:"offset,omitempty"`
+	GPS    *GPS   `json:"gps,omitempty"`
+}
+
+// GPS is a position in decimal degrees.
+type GPS struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// EXIF tags used here.
+const (
+	tagDateTime           = 0x0132
+	tagExifIFD            = 0x8769
+	tagGPSIFD             = 0x8825
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTime         = 0x9010
+	tagOffsetTimeOriginal = 0x9011
+	tagGPSLatitudeRef     = 0x0001
+	tagGPSLatitude        = 0x0002
+	tagGPSLongitudeRef    = 0x0003
+	tagGPSLongitude       = 0x0004
+)
+
+var (
+	// exifDateRegex matches EXIF's "2006:01:02 15:04:05" timestamps
+	exifDateRegex = regexp.MustCompile(`^(\d{4}):(\d{2}):(\d{2}) (\d{2}):(\d{2}):(\d{2})`)
+	// offsetRegex matches a UTC offset such as "+05:30"
+	offsetRegex = regexp.MustCompile(`^[+-]\d{2}:\d{2}$`)
+)
+
+// ReadFile reads metadata from a JPEG, TIFF, or HEIC file. It returns nil
+// and no error when the file has no EXIF block or it records neither a
+// time nor a position.
+func ReadFile(path string) (*Metadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(data)
+}
+
+// Decode reads metadata from an image file's bytes. TIFF files are EXIF
+// structures themselves; JPEG and HEIC embed one after an "Exif\0\0" marker.
+func Decode(data []byte) (*Metadata, error) {
+	if isTIFFHeader(data) {
+		return parse(data)
+	}
+	for rest := data; ; {
+		i := bytes.Index(rest, []byte("Exif\x00\x00"))
+		if i < 0 {
+			return nil, nil
+		}
+		rest = rest[i+6:]
+		if isTIFFHeader(rest) {
+			return parse(rest)
+		}
+	}
+}
+
+func isTIFFHeader(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("II*\x00")) || bytes.HasPrefix(b, []byte("MM\x00*"))
+}
+
+// reader reads IFD entries from a TIFF-structured EXIF block.
+type reader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// entry is one raw IFD entry.
+type entry struct {
+	typ   uint16
+	count uint32
+	value []byte // count values of typ
+}
+
+var typeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+func parse(data []byte) (*Metadata, error) {
+	if len(data) < 8 {
+		return nil, errors.New("exif: block too short")
+	}
+	r := &reader{data: data, order: binary.LittleEndian}
+	if data[0] == 'M' {
+		r.order = binary.BigEndian
+	}
+
+	ifd0, err := r.ifd(r.order.Uint32(data[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	md := &Metadata{}
+	dateTime := r.ascii(ifd0[tagDateTime])
+	offset := ""
+	if e, ok := ifd0[tagExifIFD]; ok {
+		if exifIFD, err := r.ifd(r.long(e)); err == nil {
+			if original := r.ascii(exifIFD[tagDateTimeOriginal]); original != "" {
+				dateTime = original
+				offset = r.ascii(exifIFD[tagOffsetTimeOriginal])
+			}
+			if offset == "" {
+				offset = r.ascii(exifIFD[tagOffsetTime])
+			}
+		}
+	}
+	if m := exifDateRegex.FindStringSubmatch(dateTime); m != nil && m[1] != "0000" {
+		md.CapturedAt = fmt.Sprintf("%s-%s-%sT%s:%s:%s", m[1], m[2], m[3], m[4], m[5], m[6])
+		if offsetRegex.MatchString(offset) {
+			md.Offset = offset
+		}
+	}
+
+	if e, ok := ifd0[tagGPSIFD]; ok {
+		if gpsIFD, err := r.ifd(r.long(e)); err == nil {
+			md.GPS = r.gps(gpsIFD)
+		}
+	}
+
+	if md.CapturedAt == "" && md.GPS == nil {
+		return nil, nil
+	}
+	return md, nil
+}
+
+// ifd reads the image file directory at offset.
+func (r *reader) ifd(offset uint32) (map[uint16]entry, error) {
+	start := int(offset)
+	if start <= 0 || start+2 > len(r.data) {
+		return nil, errors.New("exif: directory out of range")
+	}
+	n := int(r.order.Uint16(r.data[start:]))
+	if start+2+12*n > len(r.data) {
+		return nil, errors.New("exif: directory out of range")
+	}
+
+	entries := make(map[uint16]entry, n)
+	for i := 0; i < n; i++ {
+		raw := r.data[start+2+12*i:]
+		e := entry{typ: r.order.Uint16(raw[2:]), count: r.order.Uint32(raw[4:])}
+		size, ok := typeSizes[e.typ]
+		if !ok || e.count == 0 || e.count > uint32(len(r.data)) {
+			continue
+		}
+		total := size * int(e.count)
+		if total <= 4 {
+			e.value = raw[8 : 8+total]
+		} else {
+			off := int(r.order.Uint32(raw[8:]))
+			if off < 0 || off+total > len(r.data) {
+				continue
+			}
+			e.value = r.data[off : off+total]
+		}
+		entries[r.order.Uint16(raw)] = e
+	}
+	return entries, nil
+}
+
+// ascii returns a string value without its NUL terminator.
+func (r *reader) ascii(e entry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+// long returns the first value of a SHORT or LONG entry.
+func (r *reader) long(e entry) uint32 {
+	switch e.typ {
+	case 3:
+		return uint32(r.order.Uint16(e.value))
+	case 4:
+		return r.order.Uint32(e.value)
+	}
+	return 0
+}
+
+// degrees converts a degrees/minutes/seconds RATIONAL triple.
+func (r *reader) degrees(e entry) (float64, bool) {
+	if e.typ != 5 || e.count != 3 {
+		return 0, false
+	}
+	var parts [3]float64
+	for i := range parts {
+		num := r.order.Uint32(e.value[8*i:])
+		den := r.order.Uint32(e.value[8*i+4:])
+		if den == 0 {
+			return 0, false
+		}
+		parts[i] = float64(num) / float64(den)
+	}
+	return parts[0] + parts[1]/60 + parts[2]/3600, true
+}
+
+// gps reads the position from a GPS IFD, or returns nil if it has none.
+func (r *reader) gps(ifd map[uint16]entry) *GPS {
+	lat, ok1 := r.degrees(ifd[tagGPSLatitude])
+	lon, ok2 := r.degrees(ifd[tagGPSLongitude])
+	if !ok1 || !ok2 || lat > 90 || lon > 180 {
+		return nil
+	}
+	if lat == 0 && lon == 0 {
+		// Phones write zeros when location was off
+		return nil
+	}
+	if strings.EqualFold(r.ascii(ifd[tagGPSLatitudeRef]), "S") {
+		lat = -lat
+	}
+	if strings.EqualFold(r.ascii(ifd[tagGPSLongitudeRef]), "W") {
+		lon = -lon
+	}
+	return &GPS{Lat: lat, Lon: lon}
+}
@@ -0,0 +1,219 @@
+package expense
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"myprice/internal/store"
+)
+
+// ErrEntryNotFound is returned for an unknown entry ID.
+var ErrEntryNotFound = errors.New("expense entry not found")
+
+// EntryKind is what an expense entry claims in place of a receipt.
+type EntryKind string
+
+const (
+	// KindMileage is driving a personal vehicle, paid per mile.
+	KindMileage EntryKind = "mileage"
+
+	// KindPerDiem is a daily allowance for meals and incidentals while
+	// traveling, paid per day.
+	KindPerDiem EntryKind = "per_diem"
+)
+
+// maxEntryDays bounds a per diem entry's span.
+const maxEntryDays = 366
+
+// Entry is an expense without a receipt. Its amount is worked out from the
+// distance or days and the rate, and is fixed when the entry is created.
+type Entry struct {
+	ID          string    `json:"id"`
+	Kind        EntryKind `json:"kind"`
+	Date        string    `json:"date"`               // "2006-01-02"; the first day for per diem
+	EndDate     string    `json:"end_date,omitempty"` // Last day for per diem, inclusive
+	Description string    `json:"description,omitempty"`
+	Miles       float64   `json:"miles,omitempty"` // Mileage only
+	Days        float64   `json:"days,omitempty"`  // Per diem only
+	Rate        float64   `json:"rate"`            // Dollars per mile or per day
+	Amount      float64   `json:"amount"`
+	Owner       string    `json:"owner,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Complete validates e and works out its amount: miles times the rate for
+// mileage, and days times the rate for per diem. A per diem entry without
+// days counts every day from Date to EndDate; days may be given to claim
+// partial days, such as 75% on travel days, but not more days than that.
+func (e *Entry) Complete() error {
+	e.Description = strings.TrimSpace(e.Description)
+	start, err := time.Parse("2006-01-02", e.Date)
+	if err != nil {
+		return fmt.Errorf("date must be a date like 2025-11-03")
+	}
+	if e.Rate <= 0 || math.IsInf(e.Rate, 0) || math.IsNaN(e.Rate) {
+		return fmt.Errorf("rate must be positive")
+	}
+
+	switch e.Kind {
+	case KindMileage:
+		if e.EndDate != "" || e.Days != 0 {
+			return fmt.Errorf("mileage takes a single date and no days")
+		}
+		if e.Miles <= 0 || e.Miles > 100_000 || math.IsNaN(e.Miles) {
+			return fmt.Errorf("miles must be between 0 and 100000")
+		}
+		e.Amount = roundCents(e.Miles * e.Rate)
+
+	case KindPerDiem:
+		if e.Miles != 0 {
+			return fmt.Errorf("per diem takes no miles")
+		}
+		if e.EndDate == "" {
+			e.EndDate = e.Date
+		}
+		end, err := time.Parse("2006-01-02", e.EndDate)
+		if err != nil {
+			return fmt.Errorf("end_date must be a date like 2025-11-03")
+		}
+		span := end.Sub(start).Hours()/24 + 1
+		if span < 1 || span > maxEntryDays {
+			return fmt.Errorf("end_date must be on or after date, and within %d days of it", maxEntryDays)
+		}
+		if e.Days == 0 {
+			e.Days = span
+		}
+		if e.Days < 0 || e.Days > span || math.IsNaN(e.Days) {
+			return fmt.Errorf("days must be positive and at most the %g days from date to end_date", span)
+		}
+		e.Amount = roundCents(e.Days * e.Rate)
+
+	default:
+		return fmt.Errorf("kind must be %q or %q", KindMileage, KindPerDiem)
+	}
+	return nil
+}
+
+// LastDate returns the last day e covers.
+func (e *Entry) LastDate() string {
+	if e.EndDate != "" {
+		return e.EndDate
+	}
+	return e.Date
+}
+
+// CreateEntry validates e, saves it under a new ID, and returns a copy of it.
+func (s *FileStore) CreateEntry(e Entry) (*Entry, error) {
+	if err := e.Complete(); err != nil {
+		return nil, err
+	}
+	e.ID = store.NewID()
+	e.CreatedAt = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(&e, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize expense entry: %w", err)
+	}
+	if err := s.cipher.WriteFile(s.entryPath(e.ID), data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write expense entry: %w", err)
+	}
+	saved := e
+	s.entries[e.ID] = &saved
+	return &e, nil
+}
+
+// GetEntry returns a copy of the entry with the given ID.
+func (s *FileStore) GetEntry(id string) (*Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.entries[id]
+	if !ok {
+		return nil, ErrEntryNotFound
+	}
+	c := *e
+	return &c, nil
+}
+
+// ListEntries returns copies of all entries, latest date first.
+func (s *FileStore) ListEntries() []*Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		c := *e
+		list = append(list, &c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Date != list[j].Date {
+			return list[i].Date > list[j].Date
+		}
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list
+}
+
+// DeleteEntry removes an entry. Expense reports listing it report it as
+// missing.
+func (s *FileStore) DeleteEntry(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[id]; !ok {
+		return ErrEntryNotFound
+	}
+	if err := os.Remove(s.entryPath(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete expense entry: %w", err)
+	}
+	delete(s.entries, id)
+	return nil
+}
+
+// entryPath returns the file path for an entry ID.
+func (s *FileStore) entryPath(id string) string {
+	return filepath.Join(s.dir, entriesDir, id+".json")
+}
+
+// loadEntries reads the entries saved under dir.
+func (s *FileStore) loadEntries() error {
+	dir := filepath.Join(s.dir, entriesDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create expense entry dir: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read expense entry dir: %w", err)
+	}
+	for _, de := range entries {
+		name := de.Name()
+		if de.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		data, err := s.cipher.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("failed to read expense entry %s: %w", name, err)
+		}
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return fmt.Errorf("failed to parse expense entry %s: %w", name, err)
+		}
+		s.entries[e.ID] = &e
+	}
+	return nil
+}
+
+// roundCents rounds v to whole cents.
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,159 @@
+// Package expense keeps expense reports: named bundles of receipts, such as
+// one business trip's, that are totaled and exported together. Reports may
+// also bundle mileage and per diem entries, claimed without a receipt.
+package expense
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"myprice/internal/crypt"
+	"myprice/internal/store"
+)
+
+// ErrNotFound is returned for an unknown expense report ID.
+var ErrNotFound = errors.New("expense report not found")
+
+// entriesDir is the subdirectory holding mileage and per diem entries.
+const entriesDir = "entries"
+
+// Report is a bundle of receipts with what they were for.
+type Report struct {
+	ID         string    `json:"id"`
+	Title      string    `json:"title"`
+	Purpose    string    `json:"purpose,omitempty"`
+	From       string    `json:"from"` // First purchase date, "2006-01-02"
+	To         string    `json:"to"`   // Last purchase date, inclusive
+	ReceiptIDs []string  `json:"receipt_ids"`
+	EntryIDs   []string  `json:"entry_ids,omitempty"` // Mileage and per diem entries
+	Owner      string    `json:"owner,omitempty"`     // Name of the API key that created it
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// FileStore keeps one JSON file per expense report in a directory, and one
+// per entry in its entries subdirectory, with an in-memory index loaded at
+// startup.
+type FileStore struct {
+	dir     string
+	cipher  *crypt.Cipher
+	mu      sync.RWMutex
+	reports map[string]*Report
+	entries map[string]*Entry
+}
+
+// NewFileStore opens (creating if needed) an expense report store rooted
+// at dir. Reports are encrypted on disk when c is non-nil.
+func NewFileStore(dir string, c *crypt.Cipher) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create expense report dir: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read expense report dir: %w", err)
+	}
+
+	s := &FileStore{dir: dir, cipher: c, reports: make(map[string]*Report), entries: make(map[string]*Entry)}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		data, err := c.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read expense report %s: %w", name, err)
+		}
+		var rep Report
+		if err := json.Unmarshal(data, &rep); err != nil {
+			return nil, fmt.Errorf("failed to parse expense report %s: %w", name, err)
+		}
+		s.reports[rep.ID] = &rep
+	}
+	if err := s.loadEntries(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Create saves rep under a new ID and returns a copy of it.
+func (s *FileStore) Create(rep Report) (*Report, error) {
+	rep.ID = store.NewID()
+	rep.CreatedAt = time.Now().UTC()
+	rep.ReceiptIDs = append(make([]string, 0, len(rep.ReceiptIDs)), rep.ReceiptIDs...)
+	rep.EntryIDs = append([]string(nil), rep.EntryIDs...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(&rep, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize expense report: %w", err)
+	}
+	if err := s.cipher.WriteFile(s.path(rep.ID), data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write expense report: %w", err)
+	}
+	s.reports[rep.ID] = clone(&rep)
+	return clone(&rep), nil
+}
+
+// Get returns a copy of the expense report with the given ID.
+func (s *FileStore) Get(id string) (*Report, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rep, ok := s.reports[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return clone(rep), nil
+}
+
+// List returns copies of all expense reports, newest first.
+func (s *FileStore) List() []*Report {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*Report, 0, len(s.reports))
+	for _, rep := range s.reports {
+		list = append(list, clone(rep))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list
+}
+
+// Delete removes an expense report. Its receipts are unaffected.
+func (s *FileStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.reports[id]; !ok {
+		return ErrNotFound
+	}
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete expense report: %w", err)
+	}
+	delete(s.reports, id)
+	return nil
+}
+
+// path returns the file path for an expense report ID.
+func (s *FileStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func clone(rep *Report) *Report {
+	c := *rep
+	c.ReceiptIDs = append([]string(nil), rep.ReceiptIDs...)
+	c.EntryIDs = append([]string(nil), rep.EntryIDs...)
+	return &c
+}
@@ -0,0 +1,119 @@
+// Package fsutil provides crash- and race-safe file writing helpers.
+package fsutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// AtomicFile is a temp file that replaces its target path when committed.
+// Readers of the target never observe a partially written file.
+type AtomicFile struct {
+	*os.File
+	path string
+	done bool
+}
+
+// Create opens a temp file in the same directory as path, so the final
+// rename stays on one filesystem.
+func Create(path string) (*AtomicFile, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	return &AtomicFile{File: f, path: path}, nil
+}
+
+// Commit flushes the temp file to disk and renames it over the target path.
+func (f *AtomicFile) Commit(perm os.FileMode) error {
+	if f.done {
+		return fmt.Errorf("atomic file already closed")
+	}
+	f.done = true
+
+	if err := f.Sync(); err != nil {
+		f.File.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to sync temp file: %w", err)
+	}
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to set permissions: %w", err)
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+	return nil
+}
+
+// CommitNew is Commit for a target that must not exist yet: it fails with
+// an error matching os.ErrExist instead of replacing the target. The check
+// and the write are one step, so concurrent writers can't both succeed.
+func (f *AtomicFile) CommitNew(perm os.FileMode) error {
+	if f.done {
+		return fmt.Errorf("atomic file already closed")
+	}
+	f.done = true
+	defer os.Remove(f.Name())
+
+	if err := f.Sync(); err != nil {
+		f.File.Close()
+		return fmt.Errorf("failed to sync temp file: %w", err)
+	}
+	if err := f.File.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return fmt.Errorf("failed to set permissions: %w", err)
+	}
+	// A hard link, unlike a rename, never replaces its target
+	if err := os.Link(f.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to link temp file: %w", err)
+	}
+	return nil
+}
+
+// Abort discards the temp file. It is a no-op after Commit, so it is safe to defer.
+func (f *AtomicFile) Abort() {
+	if f.done {
+		return
+	}
+	f.done = true
+	f.File.Close()
+	os.Remove(f.Name())
+}
+
+// WriteFile atomically replaces path with data.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	f, err := Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	return f.Commit(perm)
+}
+
+// WriteNew atomically creates path with data, failing with an error
+// matching os.ErrExist if path already exists.
+func WriteNew(path string, data []byte, perm os.FileMode) error {
+	f, err := Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	return f.CommitNew(perm)
+}
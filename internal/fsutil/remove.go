@@ -0,0 +1,77 @@
+// Package fsutil provides crash- and race-safe file writing helpers.
+package fsutil
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Removal deletes a group of files all-or-nothing. Files are first renamed
+// aside to hidden names in their own directory; Commit deletes them and
+// Rollback puts them back. Staged files left behind by a crash are ordinary
+// dotfiles, which the retention janitor removes once they are stale.
+type Removal struct {
+	staged []stagedFile
+	done   bool
+}
+
+type stagedFile struct {
+	path, tmp string
+}
+
+// Stage moves path aside. It reports false if the file does not exist.
+func (r *Removal) Stage(path string) (bool, error) {
+	if r.done {
+		return false, fmt.Errorf("removal already finished")
+	}
+
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".deleted-"+hex.EncodeToString(suffix))
+
+	if err := os.Rename(path, tmp); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to stage %s for removal: %w", path, err)
+	}
+	r.staged = append(r.staged, stagedFile{path: path, tmp: tmp})
+	return true, nil
+}
+
+// Commit deletes every staged file.
+func (r *Removal) Commit() error {
+	if r.done {
+		return nil
+	}
+	r.done = true
+
+	var errs []error
+	for _, f := range r.staged {
+		if err := os.Remove(f.tmp); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Rollback restores every staged file to its original path.
+func (r *Removal) Rollback() error {
+	if r.done {
+		return nil
+	}
+	r.done = true
+
+	var errs []error
+	for i := len(r.staged) - 1; i >= 0; i-- {
+		f := r.staged[i]
+		if err := os.Rename(f.tmp, f.path); err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore %s: %w", f.path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,131 @@
+// Package geo resolves receipt addresses to normalized locations through a
+// pluggable geocoder.
+package geo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ErrNoMatch is returned when a geocoder finds no result for an address.
+var ErrNoMatch = errors.New("no geocoding match")
+
+// Location is a normalized vendor location.
+type Location struct {
+	Query            string  `json:"query,omitempty"`
+	FormattedAddress string  `json:"formatted_address,omitempty"`
+	Lat              float64 `json:"lat,omitempty"`
+	Lon              float64 `json:"lon,omitempty"`
+	City             string  `json:"city,omitempty"`
+	State            string  `json:"state,omitempty"`
+	PostalCode       string  `json:"postal_code,omitempty"`
+	Country          string  `json:"country,omitempty"`
+	Chain            string  `json:"chain,omitempty"`
+	StoreNumber      string  `json:"store_number,omitempty"`
+	Address          string  `json:"address,omitempty"` // Store address as printed
+	Phone            string  `json:"phone,omitempty"`   // Store phone number as printed
+	Provider         string  `json:"provider,omitempty"`
+}
+
+// Store names the specific store among its chain's locations: its store
+// number without leading zeros, which receipts print inconsistently, else the street of its printed or geocoded address, else its
+// phone number. It returns "" when none is known.
+func (l *Location) Store() string {
+	if l == nil {
+		return ""
+	}
+	if number := strings.TrimLeft(l.StoreNumber, "0"); number != "" {
+		return "#" + number
+	}
+	for _, address := range []string{l.Address, l.Query, l.FormattedAddress} {
+		street, _, _ := strings.Cut(address, ",")
+		if street = strings.Join(strings.Fields(street), " "); street != "" {
+			return street
+		}
+	}
+	return strings.TrimSpace(l.Phone)
+}
+
+// SetStore copies the store's identifying details, which geocoders don't
+// return, from another location.
+func (l *Location) SetStore(from *Location) {
+	l.Chain, l.StoreNumber = from.Chain, from.StoreNumber
+	l.Address, l.Phone = from.Address, from.Phone
+}
+
+// Geocoder resolves a free-form address to a location.
+type Geocoder interface {
+	Geocode(ctx context.Context, address string) (*Location, error)
+}
+
+// ReverseGeocoder resolves coordinates to a location. Geocoders implement
+// it optionally.
+type ReverseGeocoder interface {
+	Reverse(ctx context.Context, lat, lon float64) (*Location, error)
+}
+
+// CachingGeocoder memoizes results of another geocoder, including misses,
+// so the same store address is only looked up once per process.
+type CachingGeocoder struct {
+	next  Geocoder
+	mu    sync.Mutex
+	cache map[string]*Location
+}
+
+// NewCachingGeocoder wraps next with an in-memory cache.
+func NewCachingGeocoder(next Geocoder) *CachingGeocoder {
+	return &CachingGeocoder{next: next, cache: make(map[string]*Location)}
+}
+
+// Geocode returns a cached location or asks the wrapped geocoder.
+func (c *CachingGeocoder) Geocode(ctx context.Context, address string) (*Location, error) {
+	key := strings.ToLower(strings.Join(strings.Fields(address), " "))
+	return c.lookup(key, func() (*Location, error) {
+		return c.next.Geocode(ctx, address)
+	})
+}
+
+// lookup returns the cached result for key, calling resolve on a miss.
+func (c *CachingGeocoder) lookup(key string, resolve func() (*Location, error)) (*Location, error) {
+	c.mu.Lock()
+	loc, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok {
+		if loc == nil {
+			return nil, ErrNoMatch
+		}
+		copied := *loc
+		return &copied, nil
+	}
+
+	loc, err := resolve()
+	if err != nil && !errors.Is(err, ErrNoMatch) {
+		// Don't cache transient failures
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.cache[key] = loc
+	c.mu.Unlock()
+
+	if loc == nil {
+		return nil, ErrNoMatch
+	}
+	copied := *loc
+	return &copied, nil
+}
+
+// Reverse returns a cached location for the coordinates, rounded to about
+// 10m, or asks the wrapped geocoder if it supports reverse lookups.
+func (c *CachingGeocoder) Reverse(ctx context.Context, lat, lon float64) (*Location, error) {
+	reverser, ok := c.next.(ReverseGeocoder)
+	if !ok {
+		return nil, ErrNoMatch
+	}
+	return c.lookup(fmt.Sprintf("@%.4f,%.4f", lat, lon), func() (*Location, error) {
+		return reverser.Reverse(ctx, lat, lon)
+	})
+}
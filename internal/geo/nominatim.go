@@ -0,0 +1,173 @@
+// Package geo resolves receipt addresses to normalized locations through a
+// pluggable geocoder.
+package geo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultNominatimURL is the public OpenStreetMap Nominatim endpoint.
+const DefaultNominatimURL = "https://nominatim.openstreetmap.org"
+
+// NominatimGeocoder queries an OpenStreetMap Nominatim server. The public
+// server allows at most one request per second, which is enforced here.
+type NominatimGeocoder struct {
+	baseURL   string
+	userAgent string
+	client    *http.Client
+
+	mu       sync.Mutex
+	lastCall time.Time
+}
+
+// NewNominatimGeocoder creates a geocoder for the Nominatim server at baseURL.
+func NewNominatimGeocoder(baseURL, userAgent string) *NominatimGeocoder {
+	if baseURL == "" {
+		baseURL = DefaultNominatimURL
+	}
+	return &NominatimGeocoder{
+		baseURL:   baseURL,
+		userAgent: userAgent,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// nominatimResult is the subset of a Nominatim search result we use.
+type nominatimResult struct {
+	Lat         string `json:"lat"`
+	Lon         string `json:"lon"`
+	DisplayName string `json:"display_name"`
+	Address     struct {
+		City     string `json:"city"`
+		Town     string `json:"town"`
+		Village  string `json:"village"`
+		State    string `json:"state"`
+		Postcode string `json:"postcode"`
+		Country  string `json:"country_code"`
+	} `json:"address"`
+}
+
+// Geocode looks up an address with Nominatim's search API.
+func (g *NominatimGeocoder) Geocode(ctx context.Context, address string) (*Location, error) {
+	g.throttle()
+
+	q := url.Values{}
+	q.Set("q", address)
+	q.Set("format", "jsonv2")
+	q.Set("addressdetails", "1")
+	q.Set("limit", "1")
+
+	req, err := http.NewRequestWithContext(ctx, "GET", g.baseURL+"/search?"+q.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("User-Agent", g.userAgent)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("geocoding request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("nominatim error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var results []nominatimResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, fmt.Errorf("failed to decode geocoding response: %w", err)
+	}
+	if len(results) == 0 {
+		return nil, ErrNoMatch
+	}
+
+	loc := results[0].location()
+	loc.Query = address
+	return loc, nil
+}
+
+// Reverse looks up the address at coordinates with Nominatim's reverse API.
+func (g *NominatimGeocoder) Reverse(ctx context.Context, lat, lon float64) (*Location, error) {
+	g.throttle()
+
+	q := url.Values{}
+	q.Set("lat", strconv.FormatFloat(lat, 'f', 6, 64))
+	q.Set("lon", strconv.FormatFloat(lon, 'f', 6, 64))
+	q.Set("format", "jsonv2")
+	q.Set("addressdetails", "1")
+
+	req, err := http.NewRequestWithContext(ctx, "GET", g.baseURL+"/reverse?"+q.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("User-Agent", g.userAgent)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("reverse geocoding request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("nominatim error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		nominatimResult
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode geocoding response: %w", err)
+	}
+	if result.Error != "" {
+		// Nominatim reports "Unable to geocode" with a 200
+		return nil, ErrNoMatch
+	}
+	return result.location(), nil
+}
+
+// location converts a result to a Location.
+func (r nominatimResult) location() *Location {
+	lat, _ := strconv.ParseFloat(r.Lat, 64)
+	lon, _ := strconv.ParseFloat(r.Lon, 64)
+
+	city := r.Address.City
+	if city == "" {
+		city = r.Address.Town
+	}
+	if city == "" {
+		city = r.Address.Village
+	}
+
+	return &Location{
+		FormattedAddress: r.DisplayName,
+		Lat:              lat,
+		Lon:              lon,
+		City:             city,
+		State:            r.Address.State,
+		PostalCode:       r.Address.Postcode,
+		Country:          r.Address.Country,
+		Provider:         "nominatim",
+	}
+}
+
+// throttle waits until at least one second has passed since the previous call.
+func (g *NominatimGeocoder) throttle() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if wait := time.Second - time.Since(g.lastCall); wait > 0 {
+		time.Sleep(wait)
+	}
+	g.lastCall = time.Now()
+}
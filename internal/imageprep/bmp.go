@@ -0,0 +1,226 @@
+// Package imageprep provides a BMP decoder, so scanner output can be converted.
+package imageprep
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math/bits"
+)
+
+// BMP support covers what scanners and Windows tools write: uncompressed
+// 1, 4, 8, 16, 24, and 32-bit bitmaps, with or without bitfield masks.
+// RLE-compressed bitmaps are rejected.
+
+func init() {
+	image.RegisterFormat("bmp", "BM", decodeBMP, decodeBMPConfig)
+}
+
+// bmpHeader is the parsed file and DIB headers.
+type bmpHeader struct {
+	pixelOffset   uint32
+	width, height int
+	topDown       bool
+	bpp           int
+	masks         [4]uint32 // R, G, B, A bitfields for 16 and 32-bit pixels
+	palette       color.Palette
+}
+
+const (
+	bmpRGB       = 0
+	bmpBitfields = 3
+	bmpAlphaBits = 6
+)
+
+func readBMPHeader(r io.Reader) (*bmpHeader, error) {
+	var fileHeader [14 + 4]byte
+	if _, err := io.ReadFull(r, fileHeader[:]); err != nil {
+		return nil, fmt.Errorf("bmp: %w", err)
+	}
+	if string(fileHeader[:2]) != "BM" {
+		return nil, errors.New("bmp: not a BMP file")
+	}
+
+	h := &bmpHeader{pixelOffset: binary.LittleEndian.Uint32(fileHeader[10:])}
+	dibSize := binary.LittleEndian.Uint32(fileHeader[14:])
+	if dibSize < 12 || dibSize > 1024 {
+		return nil, fmt.Errorf("bmp: unsupported header size %d", dibSize)
+	}
+	dib := make([]byte, dibSize)
+	copy(dib, fileHeader[14:])
+	if _, err := io.ReadFull(r, dib[4:]); err != nil {
+		return nil, fmt.Errorf("bmp: %w", err)
+	}
+	read := 14 + int(dibSize)
+
+	compression := uint32(bmpRGB)
+	paletteEntrySize := 4
+	var colorsUsed int
+	if dibSize == 12 {
+		// OS/2 BITMAPCOREHEADER
+		h.width = int(binary.LittleEndian.Uint16(dib[4:]))
+		h.height = int(binary.LittleEndian.Uint16(dib[6:]))
+		h.bpp = int(binary.LittleEndian.Uint16(dib[10:]))
+		paletteEntrySize = 3
+	} else {
+		if dibSize < 40 {
+			return nil, fmt.Errorf("bmp: unsupported header size %d", dibSize)
+		}
+		h.width = int(int32(binary.LittleEndian.Uint32(dib[4:])))
+		h.height = int(int32(binary.LittleEndian.Uint32(dib[8:])))
+		h.bpp = int(binary.LittleEndian.Uint16(dib[14:]))
+		compression = binary.LittleEndian.Uint32(dib[16:])
+		colorsUsed = int(binary.LittleEndian.Uint32(dib[32:]))
+		if dibSize >= 56 {
+			for i := range h.masks {
+				h.masks[i] = binary.LittleEndian.Uint32(dib[40+4*i:])
+			}
+		}
+	}
+	if h.height < 0 {
+		h.height, h.topDown = -h.height, true
+	}
+	if h.width <= 0 || h.height <= 0 {
+		return nil, errors.New("bmp: invalid dimensions")
+	}
+
+	switch compression {
+	case bmpRGB:
+		// Default 16-bit layout is 5-5-5; 32-bit is BGRx
+		switch h.bpp {
+		case 16:
+			h.masks = [4]uint32{0x7C00, 0x03E0, 0x001F, 0}
+		case 32:
+			h.masks = [4]uint32{0xFF0000, 0xFF00, 0xFF, 0}
+		}
+	case bmpBitfields, bmpAlphaBits:
+		if h.bpp != 16 && h.bpp != 32 {
+			return nil, fmt.Errorf("bmp: bitfields with %d bits per pixel", h.bpp)
+		}
+		if dibSize == 40 {
+			// Masks follow a BITMAPINFOHEADER
+			n := 3
+			if compression == bmpAlphaBits {
+				n = 4
+			}
+			var buf [16]byte
+			if _, err := io.ReadFull(r, buf[:4*n]); err != nil {
+				return nil, fmt.Errorf("bmp: %w", err)
+			}
+			for i := 0; i < n; i++ {
+				h.masks[i] = binary.LittleEndian.Uint32(buf[4*i:])
+			}
+			read += 4 * n
+		}
+	default:
+		return nil, fmt.Errorf("bmp: unsupported compression %d", compression)
+	}
+
+	switch h.bpp {
+	case 1, 4, 8:
+		n := colorsUsed
+		if n == 0 || n > 1<<h.bpp {
+			n = 1 << h.bpp
+		}
+		buf := make([]byte, n*paletteEntrySize)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("bmp: %w", err)
+		}
+		read += len(buf)
+		h.palette = make(color.Palette, n)
+		for i := range h.palette {
+			b := buf[i*paletteEntrySize:]
+			h.palette[i] = color.RGBA{b[2], b[1], b[0], 0xFF}
+		}
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("bmp: unsupported bit depth %d", h.bpp)
+	}
+
+	// Skip any gap between the headers and the pixels
+	if gap := int64(h.pixelOffset) - int64(read); gap > 0 {
+		if _, err := io.CopyN(io.Discard, r, gap); err != nil {
+			return nil, fmt.Errorf("bmp: %w", err)
+		}
+	}
+	return h, nil
+}
+
+func decodeBMPConfig(r io.Reader) (image.Config, error) {
+	h, err := readBMPHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	var model color.Model = color.RGBAModel
+	if h.palette != nil {
+		model = h.palette
+	}
+	return image.Config{ColorModel: model, Width: h.width, Height: h.height}, nil
+}
+
+func decodeBMP(r io.Reader) (image.Image, error) {
+	h, err := readBMPHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, h.width, h.height))
+	stride := (h.width*h.bpp + 31) / 32 * 4
+	row := make([]byte, stride)
+	for i := 0; i < h.height; i++ {
+		if _, err := io.ReadFull(r, row); err != nil {
+			return nil, fmt.Errorf("bmp: %w", err)
+		}
+		y := h.height - 1 - i
+		if h.topDown {
+			y = i
+		}
+		out := img.Pix[img.PixOffset(0, y):]
+		for x := 0; x < h.width; x++ {
+			c := h.pixel(row, x)
+			out[4*x], out[4*x+1], out[4*x+2], out[4*x+3] = c.R, c.G, c.B, c.A
+		}
+	}
+	return img, nil
+}
+
+// pixel returns the color at column x of a row of pixel data.
+func (h *bmpHeader) pixel(row []byte, x int) color.RGBA {
+	switch h.bpp {
+	case 1, 4, 8:
+		bit := x * h.bpp
+		index := int(row[bit/8]>>(8-h.bpp-bit%8)) & (1<<h.bpp - 1)
+		if index >= len(h.palette) {
+			return color.RGBA{A: 0xFF}
+		}
+		return h.palette[index].(color.RGBA)
+	case 24:
+		return color.RGBA{row[3*x+2], row[3*x+1], row[3*x], 0xFF}
+	}
+
+	var v uint32
+	if h.bpp == 16 {
+		v = uint32(binary.LittleEndian.Uint16(row[2*x:]))
+	} else {
+		v = binary.LittleEndian.Uint32(row[4*x:])
+	}
+	// Alpha is ignored: receipts are opaque, and many writers leave it zero
+	return color.RGBA{maskChannel(v, h.masks[0]), maskChannel(v, h.masks[1]), maskChannel(v, h.masks[2]), 0xFF}
+}
+
+// maskChannel extracts a bitfield channel and scales it to 8 bits.
+func maskChannel(v, mask uint32) uint8 {
+	if mask == 0 {
+		return 0
+	}
+	shift := bits.TrailingZeros32(mask)
+	width := bits.OnesCount32(mask)
+	c := (v & mask) >> shift
+	if width >= 8 {
+		return uint8(c >> (width - 8))
+	}
+	return uint8(c * 0xFF / (1<<width - 1))
+}
@@ -0,0 +1,296 @@
+// Package imageprep downscales and re-encodes receipt images before they are
+// sent to OCR and LLM providers, which both limit and charge by image size.
+package imageprep
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"myprice/internal/fsutil"
+
+	// Register decoders for the formats image.Decode should understand;
+	// BMP and TIFF are registered by this package
+	_ "image/gif"
+	_ "image/png"
+)
+
+// Options controls when and how images are downscaled.
+type Options struct {
+	// MaxDimension is the longest allowed edge in pixels.
+	MaxDimension int
+	// MaxBytes is the largest allowed file size. Textract's synchronous
+	// API rejects documents over 5MB.
+	MaxBytes int64
+	// JPEGQuality is the starting quality for re-encoded images.
+	JPEGQuality int
+}
+
+// DefaultOptions returns limits that fit both Textract and Claude.
+func DefaultOptions() Options {
+	return Options{
+		MaxDimension: 2400,
+		MaxBytes:     4_500_000,
+		JPEGQuality:  85,
+	}
+}
+
+// minJPEGQuality is the lowest quality tried before giving up on MaxBytes.
+const minJPEGQuality = 50
+
+// NeedsConversion reports whether images in format (as named by
+// image.DecodeConfig) must be converted before they are sent to providers.
+// Neither Claude nor Textract's synchronous API reads BMP, and Claude does
+// not read TIFF.
+func NeedsConversion(format string) bool {
+	return format == "bmp" || format == "tiff"
+}
+
+// Sniff identifies an image format from the first bytes of a file: "jpeg",
+// "png", "gif", "webp", "heic", "tiff", or "bmp". It returns "" for anything
+// else. Twelve bytes are enough.
+func Sniff(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("\xFF\xD8\xFF")):
+		return "jpeg"
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1A\n")):
+		return "png"
+	case bytes.HasPrefix(header, []byte("GIF8")):
+		return "gif"
+	case len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WEBP":
+		return "webp"
+	case len(header) >= 12 && string(header[4:8]) == "ftyp":
+		switch string(header[8:12]) {
+		case "heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1":
+			return "heic"
+		}
+	case bytes.HasPrefix(header, []byte("II*\x00")), bytes.HasPrefix(header, []byte("MM\x00*")):
+		return "tiff"
+	case bytes.HasPrefix(header, []byte("BM")):
+		return "bmp"
+	}
+	return ""
+}
+
+// Decode decodes an image like image.Decode, except that every page of a
+// multi-page TIFF is decoded and stacked top to bottom.
+func Decode(r io.Reader) (image.Image, string, error) {
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(4)
+	if string(header) == "II*\x00" || string(header) == "MM\x00*" {
+		img, err := decodeTIFFPages(br)
+		return img, "tiff", err
+	}
+	return image.Decode(br)
+}
+
+// ToJPEG converts an image to a JPEG within the limits in opts.
+func ToJPEG(r io.Reader, opts Options) ([]byte, error) {
+	img, _, err := Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return EncodeJPEG(Downscale(img, opts.MaxDimension), opts)
+}
+
+// Prepare returns a path to a version of the image within the limits in opts.
+// Images already within limits, in a format providers accept, are returned
+// unchanged. Otherwise a downscaled JPEG is written to outDir (the original
+// is left untouched) and its path is returned. A previously prepared file
+// newer than the original is reused.
+func Prepare(imagePath, outDir string, opts Options) (string, error) {
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat image: %w", err)
+	}
+
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open image: %w", err)
+	}
+	defer f.Close()
+
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil {
+		// Formats we can't decode (HEIC, WebP) are passed through as-is
+		return imagePath, nil
+	}
+
+	if !NeedsConversion(format) && info.Size() <= opts.MaxBytes && max(cfg.Width, cfg.Height) <= opts.MaxDimension {
+		return imagePath, nil
+	}
+
+	outPath := PreparedPath(imagePath, outDir)
+	if outInfo, err := os.Stat(outPath); err == nil && outInfo.ModTime().After(info.ModTime()) {
+		return outPath, nil
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return "", fmt.Errorf("failed to rewind image: %w", err)
+	}
+	img, _, err := Decode(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	img = Downscale(img, opts.MaxDimension)
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create output dir: %w", err)
+	}
+	if err := writeJPEG(outPath, img, opts); err != nil {
+		return "", err
+	}
+
+	return outPath, nil
+}
+
+// PreparedPath returns where Prepare writes the downscaled copy of imagePath.
+func PreparedPath(imagePath, outDir string) string {
+	baseName := filepath.Base(imagePath)
+	nameWithoutExt := strings.TrimSuffix(baseName, filepath.Ext(baseName))
+	return filepath.Join(outDir, nameWithoutExt+"_prepared.jpg")
+}
+
+// writeJPEG encodes img to path within opts.MaxBytes. The file is replaced
+// atomically so concurrent readers never see a partial image.
+func writeJPEG(path string, img image.Image, opts Options) error {
+	data, err := EncodeJPEG(img, opts)
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteFile(path, data, 0644)
+}
+
+// EncodeJPEG encodes img, lowering quality and then resolution until the
+// output fits within opts.MaxBytes.
+func EncodeJPEG(img image.Image, opts Options) ([]byte, error) {
+	quality := opts.JPEGQuality
+	var buf bytes.Buffer
+	for {
+		buf.Reset()
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, fmt.Errorf("failed to encode jpeg: %w", err)
+		}
+		if int64(buf.Len()) <= opts.MaxBytes {
+			break
+		}
+
+		if quality > minJPEGQuality {
+			quality -= 10
+			continue
+		}
+
+		// Quality floor reached; shrink the image instead
+		bounds := img.Bounds()
+		longest := max(bounds.Dx(), bounds.Dy())
+		if longest <= 256 {
+			return nil, fmt.Errorf("cannot reduce image below %d bytes", opts.MaxBytes)
+		}
+		img = Downscale(img, longest*3/4)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Downscale shrinks img so its longest edge is at most maxDimension, using
+// area averaging. Images already small enough are returned unchanged.
+func Downscale(img image.Image, maxDimension int) image.Image {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	longest := max(srcW, srcH)
+	if maxDimension <= 0 || longest <= maxDimension {
+		return img
+	}
+
+	dstW := max(1, srcW*maxDimension/longest)
+	dstH := max(1, srcH*maxDimension/longest)
+
+	// Work on RGBA pixels directly; draw.Draw has fast paths from YCbCr
+	src := image.NewRGBA(image.Rect(0, 0, srcW, srcH))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0 := y * srcH / dstH
+		y1 := max(y0+1, (y+1)*srcH/dstH)
+		for x := 0; x < dstW; x++ {
+			x0 := x * srcW / dstW
+			x1 := max(x0+1, (x+1)*srcW/dstW)
+
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(src.Pix[i])
+					g += uint32(src.Pix[i+1])
+					b += uint32(src.Pix[i+2])
+					a += uint32(src.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
+
+// Crop returns the part of img within r, which is clipped to img's bounds,
+// as a new image whose bounds start at the origin.
+func Crop(img image.Image, r image.Rectangle) image.Image {
+	r = r.Intersect(img.Bounds())
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
+
+// Upscale enlarges img by factor, using bilinear interpolation so text
+// keeps smooth edges for OCR. A factor of 1 or less returns img unchanged.
+func Upscale(img image.Image, factor int) image.Image {
+	if factor <= 1 {
+		return img
+	}
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	src := image.NewRGBA(image.Rect(0, 0, srcW, srcH))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, srcW*factor, srcH*factor))
+	for y := 0; y < srcH*factor; y++ {
+		// Sample at pixel centers, clamped to the edge pixels
+		fy := max(0, min(float64(srcH-1), (float64(y)+0.5)/float64(factor)-0.5))
+		y0 := int(fy)
+		y1 := min(y0+1, srcH-1)
+		wy := fy - float64(y0)
+		for x := 0; x < srcW*factor; x++ {
+			fx := max(0, min(float64(srcW-1), (float64(x)+0.5)/float64(factor)-0.5))
+			x0 := int(fx)
+			x1 := min(x0+1, srcW-1)
+			wx := fx - float64(x0)
+
+			i00, i01 := src.PixOffset(x0, y0), src.PixOffset(x1, y0)
+			i10, i11 := src.PixOffset(x0, y1), src.PixOffset(x1, y1)
+			j := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				top := float64(src.Pix[i00+c])*(1-wx) + float64(src.Pix[i01+c])*wx
+				bottom := float64(src.Pix[i10+c])*(1-wx) + float64(src.Pix[i11+c])*wx
+				dst.Pix[j+c] = uint8(top*(1-wy) + bottom*wy + 0.5)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,525 @@
+// Package imageprep provides a TIFF decoder, so scanner output can be converted.
+package imageprep
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+)
+
+// TIFF support covers what document scanners write: strip-based images in
+// bilevel, grayscale, palette, RGB, or JPEG-compressed YCbCr, compressed
+// with nothing, PackBits, LZW, Deflate, or JPEG. Tiled images and CCITT fax
+// compression are rejected.
+
+func init() {
+	image.RegisterFormat("tiff", "II*\x00", decodeTIFF, decodeTIFFConfig)
+	image.RegisterFormat("tiff", "MM\x00*", decodeTIFF, decodeTIFFConfig)
+}
+
+// TIFF tags used by the decoder.
+const (
+	tagNewSubfileType  = 254
+	tagImageWidth      = 256
+	tagImageLength     = 257
+	tagBitsPerSample   = 258
+	tagCompression     = 259
+	tagPhotometric     = 262
+	tagStripOffsets    = 273
+	tagSamplesPerPixel = 277
+	tagRowsPerStrip    = 278
+	tagStripByteCounts = 279
+	tagPlanarConfig    = 284
+	tagPredictor       = 317
+	tagColorMap        = 320
+	tagTileWidth       = 322
+	tagJPEGTables      = 347
+)
+
+// TIFF compression schemes.
+const (
+	tiffNone       = 1
+	tiffLZW        = 5
+	tiffJPEG       = 7
+	tiffDeflate    = 8
+	tiffPackBits   = 32773
+	tiffDeflateOld = 32946
+)
+
+// TIFF photometric interpretations.
+const (
+	tiffPhotoWhite   = 0 // WhiteIsZero
+	tiffPhotoBlack   = 1 // BlackIsZero
+	tiffPhotoRGB     = 2
+	tiffPhotoPalette = 3
+)
+
+const (
+	// maxTIFFPages bounds how many pages are stacked into one image.
+	maxTIFFPages = 20
+	// maxTIFFPixels bounds the size of one page, and of stacked pages, to
+	// keep a hostile header from allocating unbounded memory.
+	maxTIFFPixels = 200_000_000
+)
+
+// tiffPage is one image file directory.
+type tiffPage struct {
+	tags map[uint16][]uint32
+	raw  map[uint16][]byte // Undefined/byte-typed values, e.g. JPEG tables
+}
+
+func (p *tiffPage) get(tag uint16, def uint32) uint32 {
+	if v := p.tags[tag]; len(v) > 0 {
+		return v[0]
+	}
+	return def
+}
+
+// tiffFile is a parsed TIFF: its bytes and the pages worth decoding.
+type tiffFile struct {
+	data  []byte
+	order binary.ByteOrder
+	pages []*tiffPage
+}
+
+// parseTIFF reads the image file directories of a TIFF. Reduced-resolution
+// thumbnails are skipped, leaving one entry per page.
+func parseTIFF(r io.Reader) (*tiffFile, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("tiff: %w", err)
+	}
+	if len(data) < 8 {
+		return nil, errors.New("tiff: file too short")
+	}
+
+	f := &tiffFile{data: data}
+	switch string(data[:4]) {
+	case "II*\x00":
+		f.order = binary.LittleEndian
+	case "MM\x00*":
+		f.order = binary.BigEndian
+	default:
+		return nil, errors.New("tiff: not a TIFF file")
+	}
+
+	seen := make(map[uint32]bool)
+	for offset := f.order.Uint32(data[4:]); offset != 0 && len(f.pages) < maxTIFFPages; {
+		if seen[offset] {
+			break // IFD loop
+		}
+		seen[offset] = true
+
+		page, next, err := f.readIFD(offset)
+		if err != nil {
+			return nil, err
+		}
+		if page.get(tagNewSubfileType, 0)&1 == 0 {
+			f.pages = append(f.pages, page)
+		}
+		offset = next
+	}
+	if len(f.pages) == 0 {
+		return nil, errors.New("tiff: no images")
+	}
+	return f, nil
+}
+
+// tiffTypeSizes is the byte size of each TIFF field type.
+var tiffTypeSizes = [...]int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+func (f *tiffFile) readIFD(offset uint32) (*tiffPage, uint32, error) {
+	data := f.data
+	if int(offset)+2 > len(data) {
+		return nil, 0, errors.New("tiff: directory offset out of range")
+	}
+	n := int(f.order.Uint16(data[offset:]))
+	start := int(offset) + 2
+	if start+12*n+4 > len(data) {
+		return nil, 0, errors.New("tiff: directory out of range")
+	}
+
+	page := &tiffPage{tags: make(map[uint16][]uint32), raw: make(map[uint16][]byte)}
+	for i := 0; i < n; i++ {
+		entry := data[start+12*i:]
+		tag := f.order.Uint16(entry)
+		typ := int(f.order.Uint16(entry[2:]))
+		count := int(f.order.Uint32(entry[4:]))
+		if typ <= 0 || typ >= len(tiffTypeSizes) || count <= 0 || count > len(data) {
+			continue
+		}
+		size := tiffTypeSizes[typ] * count
+		value := entry[8:12]
+		if size > 4 {
+			off := int(f.order.Uint32(entry[8:]))
+			if off+size > len(data) || off < 0 {
+				return nil, 0, fmt.Errorf("tiff: tag %d out of range", tag)
+			}
+			value = data[off : off+size]
+		}
+
+		switch typ {
+		case 1, 2, 6, 7: // BYTE, ASCII, SBYTE, UNDEFINED
+			page.raw[tag] = value[:count]
+			values := make([]uint32, count)
+			for j := range values {
+				values[j] = uint32(value[j])
+			}
+			page.tags[tag] = values
+		case 3, 8: // SHORT, SSHORT
+			values := make([]uint32, count)
+			for j := range values {
+				values[j] = uint32(f.order.Uint16(value[2*j:]))
+			}
+			page.tags[tag] = values
+		case 4, 9: // LONG, SLONG
+			values := make([]uint32, count)
+			for j := range values {
+				values[j] = f.order.Uint32(value[4*j:])
+			}
+			page.tags[tag] = values
+		}
+	}
+	return page, f.order.Uint32(data[start+12*n:]), nil
+}
+
+func decodeTIFFConfig(r io.Reader) (image.Config, error) {
+	f, err := parseTIFF(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	p := f.pages[0]
+	model := color.Model(color.RGBAModel)
+	if photometric := p.get(tagPhotometric, tiffPhotoBlack); photometric == tiffPhotoWhite || photometric == tiffPhotoBlack {
+		model = color.GrayModel
+	}
+	return image.Config{
+		ColorModel: model,
+		Width:      int(p.get(tagImageWidth, 0)),
+		Height:     int(p.get(tagImageLength, 0)),
+	}, nil
+}
+
+// decodeTIFF decodes the first page, as image.Decode expects.
+func decodeTIFF(r io.Reader) (image.Image, error) {
+	f, err := parseTIFF(r)
+	if err != nil {
+		return nil, err
+	}
+	return f.decodePage(f.pages[0])
+}
+
+// decodeTIFFPages decodes every page and stacks them top to bottom, so a
+// long receipt scanned across several pages reads as one image.
+func decodeTIFFPages(r io.Reader) (image.Image, error) {
+	f, err := parseTIFF(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.pages) == 1 {
+		return f.decodePage(f.pages[0])
+	}
+
+	pages := make([]image.Image, len(f.pages))
+	var width, height int
+	for i, p := range f.pages {
+		img, err := f.decodePage(p)
+		if err != nil {
+			return nil, fmt.Errorf("page %d: %w", i+1, err)
+		}
+		pages[i] = img
+		width = max(width, img.Bounds().Dx())
+		height += img.Bounds().Dy()
+	}
+	if int64(width)*int64(height) > maxTIFFPixels {
+		return nil, fmt.Errorf("tiff: %d pages too large to combine", len(pages))
+	}
+
+	stacked := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(stacked, stacked.Bounds(), image.White, image.Point{}, draw.Src)
+	y := 0
+	for _, img := range pages {
+		b := img.Bounds()
+		draw.Draw(stacked, image.Rect(0, y, b.Dx(), y+b.Dy()), img, b.Min, draw.Src)
+		y += b.Dy()
+	}
+	return stacked, nil
+}
+
+func (f *tiffFile) decodePage(p *tiffPage) (image.Image, error) {
+	width := int(p.get(tagImageWidth, 0))
+	height := int(p.get(tagImageLength, 0))
+	if width <= 0 || height <= 0 || int64(width)*int64(height) > maxTIFFPixels {
+		return nil, errors.New("tiff: invalid dimensions")
+	}
+	if _, tiled := p.tags[tagTileWidth]; tiled {
+		return nil, errors.New("tiff: tiled images are not supported")
+	}
+	if p.get(tagPlanarConfig, 1) != 1 {
+		return nil, errors.New("tiff: planar images are not supported")
+	}
+
+	offsets, counts := p.tags[tagStripOffsets], p.tags[tagStripByteCounts]
+	if len(offsets) == 0 || len(offsets) != len(counts) {
+		return nil, errors.New("tiff: missing strip offsets")
+	}
+	rowsPerStrip := int(p.get(tagRowsPerStrip, uint32(height)))
+	if rowsPerStrip <= 0 || rowsPerStrip > height {
+		rowsPerStrip = height
+	}
+
+	strips := make([][]byte, len(offsets))
+	for i := range offsets {
+		start, end := int(offsets[i]), int(offsets[i])+int(counts[i])
+		if start < 0 || end > len(f.data) || end < start {
+			return nil, errors.New("tiff: strip out of range")
+		}
+		strips[i] = f.data[start:end]
+	}
+
+	compression := p.get(tagCompression, tiffNone)
+	if compression == tiffJPEG {
+		return decodeTIFFJPEG(p, strips, width, height, rowsPerStrip)
+	}
+
+	// Decompress every strip into one buffer of packed rows
+	var pixels []byte
+	for _, strip := range strips {
+		var decoded []byte
+		var err error
+		switch compression {
+		case tiffNone:
+			decoded = strip
+		case tiffLZW:
+			decoded, err = decodeTIFFLZW(strip)
+		case tiffDeflate, tiffDeflateOld:
+			var zr io.ReadCloser
+			if zr, err = zlib.NewReader(bytes.NewReader(strip)); err == nil {
+				decoded, err = io.ReadAll(zr)
+			}
+		case tiffPackBits:
+			decoded, err = decodePackBits(strip)
+		default:
+			return nil, fmt.Errorf("tiff: unsupported compression %d", compression)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tiff: %w", err)
+		}
+		pixels = append(pixels, decoded...)
+	}
+
+	return f.unpack(p, pixels, width, height)
+}
+
+// unpack converts packed rows of samples into an image.
+func (f *tiffFile) unpack(p *tiffPage, pixels []byte, width, height int) (image.Image, error) {
+	spp := int(p.get(tagSamplesPerPixel, 1))
+	bps := int(p.get(tagBitsPerSample, 1))
+	photometric := p.get(tagPhotometric, tiffPhotoBlack)
+
+	switch {
+	case bps != 1 && bps != 2 && bps != 4 && bps != 8 && bps != 16:
+		return nil, fmt.Errorf("tiff: unsupported bit depth %d", bps)
+	case spp < 1 || (photometric == tiffPhotoRGB && spp < 3):
+		return nil, fmt.Errorf("tiff: unsupported samples per pixel %d", spp)
+	}
+
+	rowBytes := (width*spp*bps + 7) / 8
+	if len(pixels) < rowBytes*height {
+		return nil, errors.New("tiff: not enough pixel data")
+	}
+
+	if p.get(tagPredictor, 1) == 2 {
+		if bps != 8 {
+			return nil, fmt.Errorf("tiff: predictor with %d-bit samples is not supported", bps)
+		}
+		for y := 0; y < height; y++ {
+			row := pixels[y*rowBytes : (y+1)*rowBytes]
+			for i := spp; i < len(row); i++ {
+				row[i] += row[i-spp]
+			}
+		}
+	}
+
+	// sample returns sample s of pixel x in row y, scaled to 8 bits
+	sample := func(y, x, s int) uint8 {
+		row := pixels[y*rowBytes:]
+		i := x*spp + s
+		switch bps {
+		case 8:
+			return row[i]
+		case 16:
+			return uint8(f.order.Uint16(row[2*i:]) >> 8)
+		default:
+			bit := i * bps
+			v := row[bit/8] >> (8 - bps - bit%8) & (1<<bps - 1)
+			return uint8(int(v) * 0xFF / (1<<bps - 1))
+		}
+	}
+
+	switch photometric {
+	case tiffPhotoWhite, tiffPhotoBlack:
+		img := image.NewGray(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				v := sample(y, x, 0)
+				if photometric == tiffPhotoWhite {
+					v = 0xFF - v
+				}
+				img.Pix[y*img.Stride+x] = v
+			}
+		}
+		return img, nil
+
+	case tiffPhotoRGB:
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				i := y*img.Stride + 4*x
+				img.Pix[i] = sample(y, x, 0)
+				img.Pix[i+1] = sample(y, x, 1)
+				img.Pix[i+2] = sample(y, x, 2)
+				img.Pix[i+3] = 0xFF
+			}
+		}
+		return img, nil
+
+	case tiffPhotoPalette:
+		colorMap := p.tags[tagColorMap]
+		n := 1 << bps
+		if bps > 8 || len(colorMap) < 3*n {
+			return nil, errors.New("tiff: invalid color map")
+		}
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			row := pixels[y*rowBytes:]
+			for x := 0; x < width; x++ {
+				bit := x * spp * bps
+				index := int(row[bit/8]>>(8-bps-bit%8)) & (n - 1)
+				i := y*img.Stride + 4*x
+				img.Pix[i] = uint8(colorMap[index] >> 8)
+				img.Pix[i+1] = uint8(colorMap[n+index] >> 8)
+				img.Pix[i+2] = uint8(colorMap[2*n+index] >> 8)
+				img.Pix[i+3] = 0xFF
+			}
+		}
+		return img, nil
+	}
+	return nil, fmt.Errorf("tiff: unsupported photometric interpretation %d", photometric)
+}
+
+// decodeTIFFJPEG decodes a JPEG-compressed TIFF. Each strip is a JPEG
+// stream, possibly sharing quantization and Huffman tables stored once in
+// the JPEGTables tag.
+func decodeTIFFJPEG(p *tiffPage, strips [][]byte, width, height, rowsPerStrip int) (image.Image, error) {
+	tables := p.raw[tagJPEGTables]
+	if len(tables) >= 4 {
+		tables = tables[:len(tables)-2] // Drop the tables' EOI marker
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i, strip := range strips {
+		stream := strip
+		if len(tables) >= 2 && len(strip) >= 2 {
+			stream = append(append([]byte{}, tables...), strip[2:]...) // Drop the strip's SOI marker
+		}
+		part, err := jpeg.Decode(bytes.NewReader(stream))
+		if err != nil {
+			return nil, fmt.Errorf("tiff: strip %d: %w", i, err)
+		}
+		y := i * rowsPerStrip
+		draw.Draw(img, image.Rect(0, y, width, y+part.Bounds().Dy()), part, part.Bounds().Min, draw.Src)
+	}
+	return img, nil
+}
+
+// decodePackBits expands PackBits run-length encoding.
+func decodePackBits(src []byte) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(src); {
+		n := int(int8(src[i]))
+		i++
+		switch {
+		case n >= 0:
+			if i+n+1 > len(src) {
+				return nil, errors.New("packbits: truncated literal run")
+			}
+			out = append(out, src[i:i+n+1]...)
+			i += n + 1
+		case n > -128:
+			if i >= len(src) {
+				return nil, errors.New("packbits: truncated repeat run")
+			}
+			out = append(out, bytes.Repeat(src[i:i+1], 1-n)...)
+			i++
+		}
+	}
+	return out, nil
+}
+
+// decodeTIFFLZW expands TIFF's LZW variant, which compress/lzw can't read:
+// codes grow one entry earlier than in GIF and standard LZW.
+func decodeTIFFLZW(src []byte) ([]byte, error) {
+	const (
+		clearCode = 256
+		eoiCode   = 257
+		maxCodes  = 4096
+	)
+
+	table := make([][]byte, 258, maxCodes)
+	for i := 0; i < 256; i++ {
+		table[i] = []byte{byte(i)}
+	}
+
+	var out, prev []byte
+	var acc uint32
+	var nbits uint
+	width := uint(9)
+	pos := 0
+	for {
+		for nbits < width {
+			if pos >= len(src) {
+				return out, nil // Some writers omit the final EOI
+			}
+			acc = acc<<8 | uint32(src[pos])
+			pos++
+			nbits += 8
+		}
+		code := int(acc>>(nbits-width)) & (1<<width - 1)
+		nbits -= width
+
+		switch {
+		case code == clearCode:
+			table, width, prev = table[:258], 9, nil
+			continue
+		case code == eoiCode:
+			return out, nil
+		}
+
+		var entry []byte
+		switch {
+		case code < len(table) && table[code] != nil:
+			entry = table[code]
+		case code == len(table) && prev != nil:
+			entry = append(append([]byte{}, prev...), prev[0])
+		default:
+			return nil, fmt.Errorf("lzw: invalid code %d", code)
+		}
+		out = append(out, entry...)
+
+		if prev != nil && len(table) < maxCodes {
+			table = append(table, append(append([]byte{}, prev...), entry[0]))
+		}
+		prev = entry
+		if len(table)+1 >= 1<<width && width < 12 {
+			width++
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Package ingest polls cloud storage folders, such as the ones phone
+// camera uploads land in, for new receipt images.
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Dropbox API servers
+const (
+	DefaultDropboxAPIURL     = "https://api.dropboxapi.com"
+	DefaultDropboxContentURL = "https://content.dropboxapi.com"
+	DefaultDropboxTokenURL   = "https://api.dropbox.com/oauth2/token"
+)
+
+// Dropbox watches a Dropbox folder, resuming from Dropbox's own list
+// cursors.
+type Dropbox struct {
+	folder     string
+	apiURL     string
+	contentURL string
+	creds      *Credentials
+	client     *http.Client
+}
+
+// NewDropbox watches folder, e.g. "/Camera Uploads". An empty baseURL uses
+// Dropbox's servers; otherwise every request goes to baseURL.
+func NewDropbox(folder, baseURL string, creds *Credentials) *Dropbox {
+	d := &Dropbox{
+		folder:     folder,
+		apiURL:     DefaultDropboxAPIURL,
+		contentURL: DefaultDropboxContentURL,
+		creds:      creds,
+		client:     &http.Client{Timeout: 60 * time.Second},
+	}
+	if baseURL != "" {
+		baseURL = strings.TrimSuffix(baseURL, "/")
+		d.apiURL, d.contentURL = baseURL, baseURL
+	}
+	if creds.TokenURL == "" {
+		creds.TokenURL = DefaultDropboxTokenURL
+		if baseURL != "" {
+			creds.TokenURL = baseURL + "/oauth2/token"
+		}
+	}
+	return d
+}
+
+// Name identifies the source.
+func (d *Dropbox) Name() string {
+	return "dropbox"
+}
+
+// dropboxEntry is the subset of a list_folder entry we use.
+type dropboxEntry struct {
+	Tag            string    `json:".tag"`
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	Size           int64     `json:"size"`
+	ServerModified time.Time `json:"server_modified"`
+}
+
+// Latest returns a cursor for the folder's current contents.
+func (d *Dropbox) Latest(ctx context.Context) (string, error) {
+	var result struct {
+		Cursor string `json:"cursor"`
+	}
+	err := d.rpc(ctx, "/2/files/list_folder/get_latest_cursor", map[string]any{"path": d.folder}, &result)
+	return result.Cursor, err
+}
+
+// Changes lists image files added or changed since cursor.
+func (d *Dropbox) Changes(ctx context.Context, cursor string) ([]File, string, error) {
+	var files []File
+	for {
+		var page struct {
+			Entries []dropboxEntry `json:"entries"`
+			Cursor  string         `json:"cursor"`
+			HasMore bool           `json:"has_more"`
+		}
+		var err error
+		if cursor == "" {
+			err = d.rpc(ctx, "/2/files/list_folder", map[string]any{"path": d.folder}, &page)
+		} else {
+			err = d.rpc(ctx, "/2/files/list_folder/continue", map[string]any{"cursor": cursor}, &page)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, e := range page.Entries {
+			if e.Tag == "file" && IsImage(e.Name) {
+				files = append(files, File{ID: e.ID, Name: e.Name, Size: e.Size, ModifiedAt: e.ServerModified})
+			}
+		}
+		cursor = page.Cursor
+		if !page.HasMore {
+			break
+		}
+	}
+
+	sort.SliceStable(files, func(i, j int) bool { return files[i].ModifiedAt.Before(files[j].ModifiedAt) })
+	return files, cursor, nil
+}
+
+// Download writes a file's contents to w.
+func (d *Dropbox) Download(ctx context.Context, f File, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", d.contentURL+"/2/files/download", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	arg, _ := json.Marshal(map[string]string{"path": f.ID})
+	req.Header.Set("Dropbox-API-Arg", string(arg))
+	if err := authorize(ctx, req, d.creds, d.client); err != nil {
+		return err
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("dropbox download failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkStatus("dropbox", resp); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// rpc calls a Dropbox RPC endpoint and decodes the response into out.
+func (d *Dropbox) rpc(ctx context.Context, path string, body, out any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", d.apiURL+path, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := authorize(ctx, req, d.creds, d.client); err != nil {
+		return err
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("dropbox request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkStatus("dropbox", resp); err != nil {
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode dropbox response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// Package ingest polls cloud storage folders, such as the ones phone
+// camera uploads land in, for new receipt images.
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Google API servers
+const (
+	DefaultDriveURL      = "https://www.googleapis.com"
+	DefaultDriveTokenURL = "https://oauth2.googleapis.com/token"
+)
+
+// driveTimeFormat matches Drive's modifiedTime, so cursors compare as
+// strings.
+const driveTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// GoogleDrive watches a Google Drive folder. Its cursor is the latest
+// modification time seen, so files are listed again only if they change.
+type GoogleDrive struct {
+	folderID string
+	baseURL  string
+	creds    *Credentials
+	client   *http.Client
+}
+
+// NewGoogleDrive watches the folder with ID folderID. An empty baseURL
+// uses Google's servers; otherwise every request goes to baseURL.
+func NewGoogleDrive(folderID, baseURL string, creds *Credentials) *GoogleDrive {
+	g := &GoogleDrive{
+		folderID: folderID,
+		baseURL:  DefaultDriveURL,
+		creds:    creds,
+		client:   &http.Client{Timeout: 60 * time.Second},
+	}
+	if baseURL != "" {
+		g.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+	if creds.TokenURL == "" {
+		creds.TokenURL = DefaultDriveTokenURL
+		if baseURL != "" {
+			creds.TokenURL = g.baseURL + "/token"
+		}
+	}
+	return g
+}
+
+// Name identifies the source.
+func (g *GoogleDrive) Name() string {
+	return "gdrive"
+}
+
+// Latest returns the current time, so only files added from now are listed.
+func (g *GoogleDrive) Latest(ctx context.Context) (string, error) {
+	return time.Now().UTC().Format(driveTimeFormat), nil
+}
+
+// Changes lists image files in the folder modified after cursor.
+func (g *GoogleDrive) Changes(ctx context.Context, cursor string) ([]File, string, error) {
+	query := fmt.Sprintf("'%s' in parents and trashed = false and mimeType contains 'image/'", escapeQuery(g.folderID))
+	if cursor != "" {
+		query += fmt.Sprintf(" and modifiedTime > '%s'", escapeQuery(cursor))
+	}
+
+	var files []File
+	next := cursor
+	pageToken := ""
+	for {
+		q := url.Values{}
+		q.Set("q", query)
+		q.Set("orderBy", "modifiedTime")
+		q.Set("pageSize", "100")
+		q.Set("fields", "nextPageToken,files(id,name,size,modifiedTime)")
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+
+		var page struct {
+			NextPageToken string `json:"nextPageToken"`
+			Files         []struct {
+				ID           string `json:"id"`
+				Name         string `json:"name"`
+				Size         string `json:"size"` // int64 as a string
+				ModifiedTime string `json:"modifiedTime"`
+			} `json:"files"`
+		}
+		if err := g.get(ctx, "/drive/v3/files?"+q.Encode(), &page); err != nil {
+			return nil, "", err
+		}
+
+		for _, f := range page.Files {
+			modified, _ := time.Parse(time.RFC3339Nano, f.ModifiedTime)
+			size, _ := strconv.ParseInt(f.Size, 10, 64)
+			files = append(files, File{ID: f.ID, Name: f.Name, Size: size, ModifiedAt: modified})
+			if f.ModifiedTime > next {
+				next = f.ModifiedTime
+			}
+		}
+		pageToken = page.NextPageToken
+		if pageToken == "" {
+			break
+		}
+	}
+	return files, next, nil
+}
+
+// Download writes a file's contents to w.
+func (g *GoogleDrive) Download(ctx context.Context, f File, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", g.baseURL+"/drive/v3/files/"+url.PathEscape(f.ID)+"?alt=media", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if err := authorize(ctx, req, g.creds, g.client); err != nil {
+		return err
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("google drive download failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkStatus("google drive", resp); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// get fetches a Drive API path and decodes the response into out.
+func (g *GoogleDrive) get(ctx context.Context, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", g.baseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if err := authorize(ctx, req, g.creds, g.client); err != nil {
+		return err
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("google drive request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkStatus("google drive", resp); err != nil {
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode google drive response: %w", err)
+	}
+	return nil
+}
+
+// escapeQuery escapes a value for a single-quoted Drive query string.
+func escapeQuery(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
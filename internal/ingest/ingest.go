@@ -0,0 +1,154 @@
+// Package ingest polls cloud storage folders, such as the ones phone
+// camera uploads land in, for new receipt images.
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"myprice/internal/crypt"
+)
+
+// maxSeen bounds the IDs of processed files remembered per source.
+const maxSeen = 1000
+
+// ErrUnauthorized is returned when a source rejects its credentials.
+var ErrUnauthorized = errors.New("storage credentials rejected")
+
+// imageExtensions are the file types listed for ingestion. Content is
+// checked again after download.
+var imageExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".heic": true, ".heif": true, ".tif": true, ".tiff": true, ".bmp": true,
+}
+
+// File is a file in a watched folder.
+type File struct {
+	ID         string
+	Name       string
+	Size       int64
+	ModifiedAt time.Time
+}
+
+// Source is a watched cloud storage folder.
+type Source interface {
+	// Name identifies the source, e.g. "dropbox".
+	Name() string
+	// Latest returns a cursor positioned after every file now in the folder.
+	Latest(ctx context.Context) (string, error)
+	// Changes lists image files added since cursor, oldest first, and the
+	// cursor to resume from once they are handled. An empty cursor lists
+	// everything in the folder.
+	Changes(ctx context.Context, cursor string) ([]File, string, error)
+	// Download writes a file's contents to w.
+	Download(ctx context.Context, f File, w io.Writer) error
+}
+
+// IsImage reports whether a file name has an image extension the pipeline
+// reads.
+func IsImage(name string) bool {
+	return imageExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// State is a source's progress.
+type State struct {
+	Cursor    string         `json:"cursor,omitempty"`
+	Seen      []string       `json:"seen,omitempty"`     // Recently processed file IDs, oldest first
+	Failures  map[string]int `json:"failures,omitempty"` // Failed attempts by file ID
+	Processed int            `json:"processed"`
+	Skipped   int            `json:"skipped"`
+	LastPoll  time.Time      `json:"last_poll,omitempty"`
+	LastError string         `json:"last_error,omitempty"`
+}
+
+// HasSeen reports whether a file was already processed.
+func (st *State) HasSeen(id string) bool {
+	for _, seen := range st.Seen {
+		if seen == id {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkSeen records a processed file, forgetting the oldest beyond maxSeen.
+func (st *State) MarkSeen(id string) {
+	st.Seen = append(st.Seen, id)
+	if len(st.Seen) > maxSeen {
+		st.Seen = st.Seen[len(st.Seen)-maxSeen:]
+	}
+	delete(st.Failures, id)
+}
+
+// StateStore persists every source's state in one JSON file.
+type StateStore struct {
+	path   string
+	cipher *crypt.Cipher
+	mu     sync.Mutex
+	states map[string]State
+}
+
+// OpenState loads the state file at path, starting empty if it doesn't
+// exist. The file is encrypted when c is non-nil.
+func OpenState(path string, c *crypt.Cipher) (*StateStore, error) {
+	s := &StateStore{path: path, cipher: c, states: make(map[string]State)}
+
+	data, err := c.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ingest state: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.states); err != nil {
+		return nil, fmt.Errorf("failed to parse ingest state: %w", err)
+	}
+	return s, nil
+}
+
+// Get returns a copy of a source's state.
+func (s *StateStore) Get(name string) State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return cloneState(s.states[name])
+}
+
+// Put saves a source's state.
+func (s *StateStore) Put(name string, st State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := make(map[string]State, len(s.states)+1)
+	for k, v := range s.states {
+		next[k] = v
+	}
+	next[name] = cloneState(st)
+
+	data, err := json.MarshalIndent(next, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize ingest state: %w", err)
+	}
+	if err := s.cipher.WriteFile(s.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write ingest state: %w", err)
+	}
+	s.states = next
+	return nil
+}
+
+func cloneState(st State) State {
+	st.Seen = append([]string(nil), st.Seen...)
+	failures := make(map[string]int, len(st.Failures))
+	for k, v := range st.Failures {
+		failures[k] = v
+	}
+	st.Failures = failures
+	return st
+}
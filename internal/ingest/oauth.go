@@ -0,0 +1,112 @@
+// Package ingest polls cloud storage folders, such as the ones phone
+// camera uploads land in, for new receipt images.
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials authorize requests to a storage API: either a fixed access
+// token, or an OAuth refresh token exchanged for short-lived access
+// tokens as they expire.
+type Credentials struct {
+	AccessToken  string
+	RefreshToken string
+	ClientID     string
+	ClientSecret string
+	TokenURL     string
+
+	mu      sync.Mutex
+	current string
+	expiry  time.Time
+}
+
+// Valid reports whether the credentials can produce a token.
+func (c *Credentials) Valid() bool {
+	return c.AccessToken != "" || (c.RefreshToken != "" && c.ClientID != "" && c.TokenURL != "")
+}
+
+// Token returns an access token, refreshing it when it is about to expire.
+func (c *Credentials) Token(ctx context.Context, client *http.Client) (string, error) {
+	if c.RefreshToken == "" {
+		return c.AccessToken, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current != "" && time.Until(c.expiry) > time.Minute {
+		return c.current, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", c.RefreshToken)
+	form.Set("client_id", c.ClientID)
+	if c.ClientSecret != "" {
+		form.Set("client_secret", c.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token refresh failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		// invalid_grant: the refresh token was revoked or expired
+		return "", ErrUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("token refresh error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %w", err)
+	}
+	if result.AccessToken == "" {
+		return "", fmt.Errorf("token response had no access token")
+	}
+	c.current = result.AccessToken
+	c.expiry = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	return c.current, nil
+}
+
+// authorize sets a request's bearer token.
+func authorize(ctx context.Context, req *http.Request, creds *Credentials, client *http.Client) error {
+	token, err := creds.Token(ctx, client)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// checkStatus converts an error response into an error.
+func checkStatus(service string, resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		return fmt.Errorf("%s: %w", service, ErrUnauthorized)
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s error (status %d): %s", service, resp.StatusCode, string(body))
+}
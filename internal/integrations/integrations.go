@@ -0,0 +1,259 @@
+// Package integrations pushes parsed receipts to budgeting and expense
+// sharing apps (Splitwise and YNAB) with each user's own access token.
+package integrations
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"myprice/internal/crypt"
+)
+
+// Providers
+const (
+	ProviderSplitwise = "splitwise"
+	ProviderYNAB      = "ynab"
+)
+
+var (
+	ErrNotConfigured   = errors.New("integration not configured")
+	ErrUnknownProvider = errors.New("unknown integration provider")
+	ErrAlreadyExported = errors.New("receipt already exported")
+	ErrUnauthorized    = errors.New("access token rejected")
+)
+
+// Expense is a receipt as pushed to an app.
+type Expense struct {
+	ReceiptID string
+	Vendor    string
+	Date      string // YYYY-MM-DD
+	Total     float64
+	Paid      float64 // Out of pocket: Total less gift cards and store credit
+	Currency  string  // Empty for the app's default
+	Memo      string
+}
+
+// Exporter pushes an expense to an app and returns its ID there.
+type Exporter interface {
+	Export(ctx context.Context, e Expense) (string, error)
+}
+
+// Splitwise configures pushing receipts to Splitwise as expenses paid by
+// the user. Without Shares the cost is split equally within GroupID.
+type Splitwise struct {
+	Token   string  `json:"token"` // OAuth access token or API key
+	GroupID int64   `json:"group_id,omitempty"`
+	Shares  []Share `json:"shares,omitempty"`
+	Auto    bool    `json:"auto"` // Push each new receipt after analysis
+}
+
+// Share is one person's percentage of a Splitwise expense.
+type Share struct {
+	UserID  int64   `json:"user_id"` // Splitwise user ID
+	Percent float64 `json:"percent"`
+}
+
+// Validate checks that the settings can create an expense.
+func (s *Splitwise) Validate() error {
+	if s.Token == "" {
+		return errors.New("token is required")
+	}
+	if s.GroupID == 0 && len(s.Shares) == 0 {
+		return errors.New("group_id or shares is required")
+	}
+	if len(s.Shares) == 0 {
+		return nil
+	}
+	seen := make(map[int64]bool, len(s.Shares))
+	var total float64
+	for _, sh := range s.Shares {
+		if sh.UserID <= 0 || sh.Percent < 0 {
+			return errors.New("each share needs a user_id and a non-negative percent")
+		}
+		if seen[sh.UserID] {
+			return fmt.Errorf("user %d has more than one share", sh.UserID)
+		}
+		seen[sh.UserID] = true
+		total += sh.Percent
+	}
+	if math.Abs(total-100) > 0.01 {
+		return fmt.Errorf("shares must add up to 100 percent, got %g", total)
+	}
+	return nil
+}
+
+// YNAB configures pushing receipts to YNAB as outflow transactions.
+type YNAB struct {
+	Token      string `json:"token"`               // OAuth access token or personal access token
+	BudgetID   string `json:"budget_id,omitempty"` // Default "last-used"
+	AccountID  string `json:"account_id"`
+	CategoryID string `json:"category_id,omitempty"`
+	Auto       bool   `json:"auto"` // Push each new receipt after analysis
+}
+
+// Validate checks that the settings can create a transaction.
+func (y *YNAB) Validate() error {
+	if y.Token == "" {
+		return errors.New("token is required")
+	}
+	if y.AccountID == "" {
+		return errors.New("account_id is required")
+	}
+	return nil
+}
+
+// Settings are one user's integrations and what has been pushed.
+type Settings struct {
+	User      string     `json:"user"`
+	Splitwise *Splitwise `json:"splitwise,omitempty"`
+	YNAB      *YNAB      `json:"ynab,omitempty"`
+	Exports   []Export   `json:"exports,omitempty"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// Export records a receipt pushed to an app.
+type Export struct {
+	Provider   string    `json:"provider"`
+	ReceiptID  string    `json:"receipt_id"`
+	RemoteID   string    `json:"remote_id,omitempty"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+// Exported returns the export of a receipt to provider, if any.
+func (s *Settings) Exported(provider, receiptID string) (Export, bool) {
+	for _, e := range s.Exports {
+		if e.Provider == provider && e.ReceiptID == receiptID {
+			return e, true
+		}
+	}
+	return Export{}, false
+}
+
+// Store holds every user's settings, persisted as one JSON file.
+type Store struct {
+	path   string
+	cipher *crypt.Cipher
+	mu     sync.RWMutex
+	users  map[string]*Settings
+}
+
+// Open loads the store at path, starting empty if the file doesn't exist.
+// The file holds access tokens, so it is encrypted when c is non-nil.
+func Open(path string, c *crypt.Cipher) (*Store, error) {
+	s := &Store{path: path, cipher: c, users: make(map[string]*Settings)}
+
+	data, err := c.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read integrations: %w", err)
+	}
+
+	var list []*Settings
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse integrations: %w", err)
+	}
+	for _, u := range list {
+		s.users[u.User] = u
+	}
+	return s, nil
+}
+
+// Get returns a copy of a user's settings, empty if they have none.
+func (s *Store) Get(user string) *Settings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if u, ok := s.users[user]; ok {
+		return cloneSettings(u)
+	}
+	return &Settings{User: user}
+}
+
+// Update applies fn to a copy of a user's settings and saves the result.
+// Nothing is saved if fn returns an error.
+func (s *Store) Update(user string, fn func(*Settings) error) (*Settings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := &Settings{User: user}
+	if existing, ok := s.users[user]; ok {
+		u = cloneSettings(existing)
+	}
+	if err := fn(u); err != nil {
+		return nil, err
+	}
+	u.UpdatedAt = time.Now().UTC()
+
+	next := make(map[string]*Settings, len(s.users)+1)
+	for k, v := range s.users {
+		next[k] = v
+	}
+	if u.Splitwise == nil && u.YNAB == nil && len(u.Exports) == 0 {
+		delete(next, user)
+	} else {
+		next[user] = u
+	}
+	if err := s.save(next); err != nil {
+		return nil, err
+	}
+	s.users = next
+	return cloneSettings(u), nil
+}
+
+// RecordExport notes that a receipt was pushed, replacing an earlier
+// export of it to the same provider.
+func (s *Store) RecordExport(user string, e Export) error {
+	_, err := s.Update(user, func(u *Settings) error {
+		kept := u.Exports[:0]
+		for _, old := range u.Exports {
+			if old.Provider != e.Provider || old.ReceiptID != e.ReceiptID {
+				kept = append(kept, old)
+			}
+		}
+		u.Exports = append(kept, e)
+		return nil
+	})
+	return err
+}
+
+// save writes users to disk. The caller holds s.mu.
+func (s *Store) save(users map[string]*Settings) error {
+	list := make([]*Settings, 0, len(users))
+	for _, u := range users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].User < list[j].User })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize integrations: %w", err)
+	}
+	if err := s.cipher.WriteFile(s.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write integrations: %w", err)
+	}
+	return nil
+}
+
+func cloneSettings(u *Settings) *Settings {
+	c := *u
+	if u.Splitwise != nil {
+		sw := *u.Splitwise
+		sw.Shares = append([]Share(nil), u.Splitwise.Shares...)
+		c.Splitwise = &sw
+	}
+	if u.YNAB != nil {
+		y := *u.YNAB
+		c.YNAB = &y
+	}
+	c.Exports = append([]Export(nil), u.Exports...)
+	return &c
+}
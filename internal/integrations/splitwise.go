@@ -0,0 +1,182 @@
+// Package integrations pushes parsed receipts to budgeting and expense
+// sharing apps (Splitwise and YNAB) with each user's own access token.
+package integrations
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSplitwiseURL is the Splitwise API server.
+const DefaultSplitwiseURL = "https://secure.splitwise.com"
+
+// SplitwiseExporter creates Splitwise expenses paid by the token's user.
+type SplitwiseExporter struct {
+	baseURL string
+	cfg     Splitwise
+	client  *http.Client
+}
+
+// NewSplitwiseExporter creates an exporter for the Splitwise server at
+// baseURL.
+func NewSplitwiseExporter(baseURL string, cfg Splitwise) *SplitwiseExporter {
+	if baseURL == "" {
+		baseURL = DefaultSplitwiseURL
+	}
+	return &SplitwiseExporter{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// Export creates an expense for e's total, split equally within the group
+// or by the configured shares.
+func (x *SplitwiseExporter) Export(ctx context.Context, e Expense) (string, error) {
+	body := map[string]any{
+		"cost":        strconv.FormatFloat(e.Total, 'f', 2, 64),
+		"description": e.Vendor,
+		"details":     e.Memo,
+	}
+	if e.Date != "" {
+		body["date"] = e.Date + "T12:00:00Z"
+	}
+	if e.Currency != "" {
+		body["currency_code"] = e.Currency
+	}
+	if x.cfg.GroupID != 0 {
+		body["group_id"] = x.cfg.GroupID
+	}
+
+	if len(x.cfg.Shares) == 0 {
+		body["split_equally"] = true
+	} else {
+		payer, err := x.currentUser(ctx)
+		if err != nil {
+			return "", err
+		}
+		for i, sh := range splitShares(e.Total, payer, x.cfg.Shares) {
+			prefix := fmt.Sprintf("users__%d__", i)
+			body[prefix+"user_id"] = sh.userID
+			body[prefix+"paid_share"] = strconv.FormatFloat(sh.paid, 'f', 2, 64)
+			body[prefix+"owed_share"] = strconv.FormatFloat(sh.owed, 'f', 2, 64)
+		}
+	}
+
+	var result struct {
+		Expenses []struct {
+			ID int64 `json:"id"`
+		} `json:"expenses"`
+		Errors json.RawMessage `json:"errors"`
+	}
+	if err := x.do(ctx, "POST", "/api/v3.0/create_expense", body, &result); err != nil {
+		return "", err
+	}
+	// Validation failures come back as 200 with a non-empty errors object
+	if errs := strings.TrimSpace(string(result.Errors)); errs != "" && errs != "{}" && errs != "[]" && errs != "null" {
+		return "", fmt.Errorf("splitwise rejected the expense: %s", errs)
+	}
+	if len(result.Expenses) == 0 {
+		return "", fmt.Errorf("splitwise created no expense")
+	}
+	return strconv.FormatInt(result.Expenses[0].ID, 10), nil
+}
+
+// currentUser returns the token owner's Splitwise user ID.
+func (x *SplitwiseExporter) currentUser(ctx context.Context) (int64, error) {
+	var result struct {
+		User struct {
+			ID int64 `json:"id"`
+		} `json:"user"`
+	}
+	if err := x.do(ctx, "GET", "/api/v3.0/get_current_user", nil, &result); err != nil {
+		return 0, err
+	}
+	if result.User.ID == 0 {
+		return 0, fmt.Errorf("splitwise returned no current user")
+	}
+	return result.User.ID, nil
+}
+
+// do sends a request and decodes the JSON response into out.
+func (x *SplitwiseExporter) do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, x.baseURL+path, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+x.cfg.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("splitwise request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("splitwise: %w", ErrUnauthorized)
+	}
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("splitwise error (status %d): %s", resp.StatusCode, string(data))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode splitwise response: %w", err)
+	}
+	return nil
+}
+
+// splitShare is one user's part of a Splitwise expense.
+type splitShare struct {
+	userID     int64
+	paid, owed float64
+}
+
+// splitShares divides total by percentage with payer paying all of it.
+// Shares are rounded to cents and the rounding remainder goes to the first
+// share, so owed shares add up to the total exactly.
+func splitShares(total float64, payer int64, shares []Share) []splitShare {
+	cents := int64(math.Round(total * 100))
+	out := make([]splitShare, 0, len(shares)+1)
+	var assigned int64
+	payerIncluded := false
+	for _, sh := range shares {
+		owed := int64(math.Round(float64(cents) * sh.Percent / 100))
+		assigned += owed
+		s := splitShare{userID: sh.UserID, owed: float64(owed)}
+		if sh.UserID == payer {
+			s.paid, payerIncluded = float64(cents), true
+		}
+		out = append(out, s)
+	}
+	if len(out) > 0 {
+		out[0].owed += float64(cents - assigned)
+	}
+	if !payerIncluded {
+		out = append(out, splitShare{userID: payer, paid: float64(cents)})
+	}
+	for i := range out {
+		out[i].paid /= 100
+		out[i].owed /= 100
+	}
+	return out
+}
@@ -0,0 +1,128 @@
+// Package integrations pushes parsed receipts to budgeting and expense
+// sharing apps (Splitwise and YNAB) with each user's own access token.
+package integrations
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultYNABURL is the YNAB API server.
+const DefaultYNABURL = "https://api.ynab.com"
+
+// YNAB field limits
+const (
+	ynabMaxPayee    = 200
+	ynabMaxMemo     = 200
+	ynabMaxImportID = 36
+)
+
+// YNABExporter creates YNAB transactions.
+type YNABExporter struct {
+	baseURL string
+	cfg     YNAB
+	client  *http.Client
+}
+
+// NewYNABExporter creates an exporter for the YNAB server at baseURL.
+func NewYNABExporter(baseURL string, cfg YNAB) *YNABExporter {
+	if baseURL == "" {
+		baseURL = DefaultYNABURL
+	}
+	return &YNABExporter{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// Export creates an unapproved outflow for e's total. The receipt ID is
+// sent as the import ID, so YNAB itself refuses a second copy and reports
+// it as ErrAlreadyExported.
+func (x *YNABExporter) Export(ctx context.Context, e Expense) (string, error) {
+	budget := x.cfg.BudgetID
+	if budget == "" {
+		budget = "last-used"
+	}
+
+	txn := map[string]any{
+		"account_id": x.cfg.AccountID,
+		"date":       e.Date,
+		"amount":     -int64(math.Round(e.Paid * 1000)), // Milliunits, of what left the account
+		"payee_name": truncate(e.Vendor, ynabMaxPayee),
+		"memo":       truncate(e.Memo, ynabMaxMemo),
+		"cleared":    "uncleared",
+		"approved":   false,
+		"import_id":  truncate("MYPRICE:"+e.ReceiptID, ynabMaxImportID),
+	}
+	if x.cfg.CategoryID != "" {
+		txn["category_id"] = x.cfg.CategoryID
+	}
+	data, err := json.Marshal(map[string]any{"transaction": txn})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	endpoint := x.baseURL + "/v1/budgets/" + url.PathEscape(budget) + "/transactions"
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+x.cfg.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("ynab request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+	case http.StatusUnauthorized:
+		return "", fmt.Errorf("ynab: %w", ErrUnauthorized)
+	case http.StatusConflict:
+		return "", fmt.Errorf("ynab: %w", ErrAlreadyExported)
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("ynab error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Data struct {
+			TransactionIDs     []string `json:"transaction_ids"`
+			DuplicateImportIDs []string `json:"duplicate_import_ids"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode ynab response: %w", err)
+	}
+	if slices.Contains(result.Data.DuplicateImportIDs, txn["import_id"].(string)) {
+		return "", fmt.Errorf("ynab: %w", ErrAlreadyExported)
+	}
+	if len(result.Data.TransactionIDs) == 0 {
+		return "", fmt.Errorf("ynab created no transaction")
+	}
+	return result.Data.TransactionIDs[0], nil
+}
+
+// truncate shortens s to at most n bytes without splitting a character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,114 @@
+// Package limit bounds how many calls to a provider run at once, so bursts
+// of analyses queue instead of tripping the provider's rate limits.
+package limit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter admits at most a fixed number of concurrent calls. Callers past
+// the limit wait in line until a slot frees up or their context ends.
+type Limiter struct {
+	name  string
+	slots chan struct{}
+
+	mu        sync.Mutex
+	queued    int
+	admitted  int64
+	cancelled int64
+	waitTotal time.Duration
+	waitMax   time.Duration
+}
+
+// Stats is a snapshot of a limiter's activity.
+type Stats struct {
+	Name      string  `json:"name"`
+	Limit     int     `json:"limit"`
+	InFlight  int     `json:"in_flight"`
+	Queued    int     `json:"queued"`
+	Admitted  int64   `json:"admitted"`  // Calls admitted since startup
+	Cancelled int64   `json:"cancelled"` // Callers that gave up while queued
+	MeanWait  float64 `json:"mean_wait_ms"`
+	MaxWait   float64 `json:"max_wait_ms"`
+}
+
+// New creates a limiter admitting n concurrent calls. n < 1 is treated as 1.
+func New(name string, n int) *Limiter {
+	return &Limiter{name: name, slots: make(chan struct{}, max(n, 1))}
+}
+
+// Acquire waits for a slot and returns a function that releases it. It
+// returns ctx's error if ctx ends first.
+func (l *Limiter) Acquire(ctx context.Context) (func(), error) {
+	start := time.Now()
+	select {
+	case l.slots <- struct{}{}:
+		l.recordAdmit(0)
+		return l.release, nil
+	default:
+	}
+
+	l.mu.Lock()
+	l.queued++
+	l.mu.Unlock()
+
+	select {
+	case l.slots <- struct{}{}:
+		l.mu.Lock()
+		l.queued--
+		l.mu.Unlock()
+		l.recordAdmit(time.Since(start))
+		return l.release, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.queued--
+		l.cancelled++
+		l.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Full reports whether a call would have to wait right now.
+func (l *Limiter) Full() bool {
+	return len(l.slots) == cap(l.slots)
+}
+
+func (l *Limiter) recordAdmit(wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.admitted++
+	l.waitTotal += wait
+	l.waitMax = max(l.waitMax, wait)
+}
+
+func (l *Limiter) release() {
+	<-l.slots
+}
+
+// Stats returns a snapshot of the limiter's activity.
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := Stats{
+		Name:      l.name,
+		Limit:     cap(l.slots),
+		InFlight:  len(l.slots),
+		Queued:    l.queued,
+		Admitted:  l.admitted,
+		Cancelled: l.cancelled,
+		MaxWait:   millis(l.waitMax),
+	}
+	if l.admitted > 0 {
+		s.MeanWait = millis(l.waitTotal / time.Duration(l.admitted))
+	}
+	return s
+}
+
+// millis converts d to milliseconds, rounded to a tenth.
+func millis(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*10) / 10
+}
@@ -0,0 +1,159 @@
+// Package llmfiles remembers the images uploaded to the Anthropic Files
+// API, by the SHA-256 of their contents, so an image analyzed again (a
+// retry, a repair turn, an experiment, reprocessing) is referenced by its
+// file ID instead of being sent whole each time.
+package llmfiles
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"myprice/internal/crypt"
+	"myprice/internal/flight"
+)
+
+// Entry is an uploaded image.
+type Entry struct {
+	FileID     string    `json:"file_id"`
+	MediaType  string    `json:"media_type"`
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// Cache maps image hashes to their uploaded files, persisted as one JSON
+// file. Entries older than its maximum age aren't used again, so files are
+// uploaded afresh now and then instead of being kept indefinitely.
+type Cache struct {
+	path   string
+	maxAge time.Duration // 0 keeps entries until they are forgotten
+	cipher *crypt.Cipher
+
+	mu      sync.Mutex
+	entries map[string]Entry // By image SHA-256
+	flight  flight.Group[Entry]
+}
+
+// Open loads the cache at path, starting empty if the file doesn't exist.
+// The file is encrypted when c is non-nil.
+func Open(path string, maxAge time.Duration, c *crypt.Cipher) (*Cache, error) {
+	cache := &Cache{path: path, maxAge: maxAge, cipher: c, entries: make(map[string]Entry)}
+
+	data, err := c.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file cache: %w", err)
+	}
+	if err := json.Unmarshal(data, &cache.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse file cache: %w", err)
+	}
+	return cache, nil
+}
+
+// Get returns the file uploaded for the image with hash sha, unless there
+// is none or it has expired.
+func (c *Cache) Get(sha string) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[sha]
+	if !ok || c.expired(e, time.Now()) {
+		return Entry{}, false
+	}
+	return e, true
+}
+
+// Lookup returns the file uploaded for the image with hash sha, calling
+// upload to upload it when there is none or it has expired. Concurrent
+// lookups of one image share one upload. cached reports whether the call
+// didn't upload the image itself. The cache is saved on a best-effort
+// basis: an entry that fails to save only costs another upload after a
+// restart.
+func (c *Cache) Lookup(sha string, upload func() (Entry, error)) (e Entry, cached bool, err error) {
+	if e, ok := c.Get(sha); ok {
+		return e, true, nil
+	}
+	e, err, shared := c.flight.Do(sha, func() (Entry, error) {
+		e, err := upload()
+		if err != nil {
+			return Entry{}, err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.entries[sha] = e
+		c.save()
+		return e, nil
+	})
+	return e, shared, err
+}
+
+// Forget removes the entries of the images with the given hashes and
+// returns them, for their files to be deleted.
+func (c *Cache) Forget(shas ...string) []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var gone []Entry
+	for _, sha := range shas {
+		if e, ok := c.entries[sha]; ok {
+			gone = append(gone, e)
+			delete(c.entries, sha)
+		}
+	}
+	if len(gone) > 0 {
+		c.save()
+	}
+	return gone
+}
+
+// ForgetFile removes the entry for a file ID, such as one the API no longer
+// knows.
+func (c *Cache) ForgetFile(fileID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for sha, e := range c.entries {
+		if e.FileID == fileID {
+			delete(c.entries, sha)
+			c.save()
+			return
+		}
+	}
+}
+
+// TakeExpired removes the expired entries and returns them, for their
+// files to be deleted.
+func (c *Cache) TakeExpired() []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	var gone []Entry
+	for sha, e := range c.entries {
+		if c.expired(e, now) {
+			gone = append(gone, e)
+			delete(c.entries, sha)
+		}
+	}
+	if len(gone) > 0 {
+		c.save()
+	}
+	return gone
+}
+
+func (c *Cache) expired(e Entry, now time.Time) bool {
+	return c.maxAge > 0 && now.Sub(e.UploadedAt) > c.maxAge
+}
+
+// save writes the entries. Callers hold c.mu.
+func (c *Cache) save() error {
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize file cache: %w", err)
+	}
+	if err := c.cipher.WriteFile(c.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write file cache: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Package memo keeps the results of expensive computations over stored
+// records until the records change, so repeated analytics queries don't
+// each scan the whole store.
+package memo
+
+import (
+	"sync"
+	"time"
+
+	"myprice/internal/flight"
+)
+
+// entry is a cached result and the store stamp it was computed at.
+type entry[V any] struct {
+	val     V
+	stamp   string
+	expires time.Time
+}
+
+// Cache maps keys to values computed from the store. An entry is used only
+// while the store's stamp is the one it was computed at, and for at most
+// its TTL, for results that also depend on the clock or on other data.
+type Cache[V any] struct {
+	ttl time.Duration
+	max int
+
+	mu      sync.Mutex
+	entries map[string]entry[V]
+	flight  flight.Group[V]
+}
+
+// New returns a cache of up to max entries, each kept for at most ttl. A
+// zero ttl or max disables caching: every Get computes its value.
+func New[V any](ttl time.Duration, max int) *Cache[V] {
+	return &Cache[V]{ttl: ttl, max: max, entries: make(map[string]entry[V])}
+}
+
+// Get returns the value cached for key at stamp, or computes it with load
+// and caches it. Concurrent misses for the same key and stamp share one
+// load. Values are shared between callers, who must not modify them.
+func (c *Cache[V]) Get(key, stamp string, load func() (V, error)) (V, error) {
+	if c == nil || c.ttl <= 0 || c.max <= 0 {
+		return load()
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && e.stamp == stamp && now.Before(e.expires) {
+		c.mu.Unlock()
+		return e.val, nil
+	}
+	c.mu.Unlock()
+
+	val, err, _ := c.flight.Do(key+"\x00"+stamp, load)
+	if err != nil {
+		return val, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.max {
+		c.evict(now)
+	}
+	c.entries[key] = entry[V]{val: val, stamp: stamp, expires: now.Add(c.ttl)}
+	return val, nil
+}
+
+// evict makes room for an entry: it drops the expired entries, or the one
+// closest to expiring if none are. c.mu must be held.
+func (c *Cache[V]) evict(now time.Time) {
+	oldest := ""
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+			oldest = key
+		}
+	}
+	if len(c.entries) >= c.max && oldest != "" {
+		delete(c.entries, oldest)
+	}
+}
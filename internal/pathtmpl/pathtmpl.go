@@ -0,0 +1,252 @@
+// Package pathtmpl names output files from the data they hold, with
+// templates such as "{vendor}/{date}_{total}.json", so results organize
+// themselves by vendor and date instead of every caller inventing paths.
+package pathtmpl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"myprice/internal/receipt"
+)
+
+// Placeholders a template may use.
+const (
+	Vendor = "vendor" // Vendor name
+	Date   = "date"   // Purchase or invoice date, YYYY-MM-DD
+	Year   = "year"
+	Month  = "month"
+	Day    = "day"
+	Total  = "total"  // Total with two decimals
+	Number = "number" // Invoice number
+	Type   = "type"   // "receipt" or "invoice"
+	ID     = "id"     // Receipt ID, or a random ID for ad hoc writes
+)
+
+var placeholders = map[string]bool{
+	Vendor: true, Date: true, Year: true, Month: true, Day: true,
+	Total: true, Number: true, Type: true, ID: true,
+}
+
+// unknownValue replaces placeholders without a value.
+const unknownValue = "unknown"
+
+// maxValueLen bounds each substituted value, in runes.
+const maxValueLen = 64
+
+// maxSuffix is how many numbered names PolicySuffix tries.
+const maxSuffix = 1000
+
+// Policy says what to do when the rendered path already exists.
+type Policy string
+
+// Collision policies.
+const (
+	PolicyError     Policy = "error"     // Fail with ErrExists
+	PolicyOverwrite Policy = "overwrite" // Replace the existing file
+	PolicySuffix    Policy = "suffix"    // Add _2, _3, ... before the extension
+)
+
+// ErrExists is returned by Resolve under PolicyError when the path is taken.
+var ErrExists = errors.New("output file already exists")
+
+// ParsePolicy parses a collision policy. An empty string returns def.
+func ParsePolicy(s string, def Policy) (Policy, error) {
+	switch p := Policy(strings.ToLower(strings.TrimSpace(s))); p {
+	case "":
+		return def, nil
+	case PolicyError, PolicyOverwrite, PolicySuffix:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown collision policy %q (want error, overwrite, or suffix)", s)
+	}
+}
+
+// Template is a parsed path template.
+type Template struct {
+	raw   string
+	parts []part
+}
+
+// part is literal text or, when name is set, a placeholder.
+type part struct {
+	text string
+	name string
+}
+
+// Parse parses a template. Templates are relative paths using / between
+// directories, and may not climb out of their base directory.
+func Parse(s string) (*Template, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, errors.New("template is empty")
+	}
+	if filepath.IsAbs(s) || strings.HasPrefix(s, "/") || strings.HasPrefix(s, `\`) {
+		return nil, fmt.Errorf("template %q must be a relative path", s)
+	}
+	for _, elem := range strings.FieldsFunc(s, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if elem == ".." {
+			return nil, fmt.Errorf("template %q may not contain ..", s)
+		}
+	}
+
+	t := &Template{raw: s}
+	rest := s
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			t.parts = append(t.parts, part{text: rest})
+			break
+		}
+		if open > 0 {
+			t.parts = append(t.parts, part{text: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("template %q has an unclosed {", s)
+		}
+		name := strings.ToLower(strings.TrimSpace(rest[open+1 : open+end]))
+		if !placeholders[name] {
+			return nil, fmt.Errorf("template %q uses unknown placeholder {%s}", s, name)
+		}
+		t.parts = append(t.parts, part{name: name})
+		rest = rest[open+end+1:]
+	}
+	if strings.ContainsRune(t.literal(), '}') {
+		return nil, fmt.Errorf("template %q has an unopened }", s)
+	}
+	return t, nil
+}
+
+// literal returns the template's text outside placeholders.
+func (t *Template) literal() string {
+	var sb strings.Builder
+	for _, p := range t.parts {
+		sb.WriteString(p.text)
+	}
+	return sb.String()
+}
+
+// String returns the template as written.
+func (t *Template) String() string {
+	return t.raw
+}
+
+// Fields are the values substituted for placeholders.
+type Fields map[string]string
+
+// Render substitutes fields into the template and returns a relative path.
+// Values can't add directories: separators and other characters unsafe in
+// file names are replaced, and missing values become "unknown".
+func (t *Template) Render(f Fields) string {
+	var sb strings.Builder
+	for _, p := range t.parts {
+		if p.name == "" {
+			sb.WriteString(p.text)
+			continue
+		}
+		sb.WriteString(sanitize(f[p.name]))
+	}
+	return filepath.Clean(filepath.FromSlash(sb.String()))
+}
+
+// sanitize makes a value safe as part of one file name.
+func sanitize(v string) string {
+	var sb strings.Builder
+	dash := false
+	for _, r := range strings.TrimSpace(v) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '_' || r == '-' {
+			sb.WriteRune(r)
+			dash = false
+		} else if !dash {
+			sb.WriteByte('-')
+			dash = true
+		}
+	}
+	// Leading dots would hide the file, and a bare ".." would climb
+	s := strings.Trim(sb.String(), "-.")
+	if runes := []rune(s); len(runes) > maxValueLen {
+		s = strings.TrimRight(string(runes[:maxValueLen]), "-.")
+	}
+	if s == "" {
+		return unknownValue
+	}
+	return s
+}
+
+// FromData extracts fields from parsed receipt or invoice output. Dates are
+// normalized to YYYY-MM-DD when they can be read.
+func FromData(data map[string]any) Fields {
+	docType := receipt.DetectDocumentType(data)
+	f := Fields{Type: string(docType)}
+	rawDate, _ := data["date"].(string)
+	if docType == receipt.DocumentTypeInvoice {
+		party, _ := data["vendor"].(map[string]any)
+		f[Vendor], _ = party["name"].(string)
+		rawDate, _ = data["invoice_date"].(string)
+		f[Number], _ = data["invoice_number"].(string)
+	} else {
+		f[Vendor], _ = data["vendor"].(string)
+		if f[Vendor] == "" {
+			f[Vendor], _ = data["vendor_full"].(string)
+		}
+	}
+	f.SetDate(rawDate)
+	if total, ok := data["total"].(float64); ok {
+		f[Total] = strconv.FormatFloat(total, 'f', 2, 64)
+	}
+	return f
+}
+
+// SetDate sets the date fields from a date as printed on a document. Dates
+// that can't be read are kept as printed, without year, month, and day.
+func (f Fields) SetDate(raw string) {
+	year, month, day, ok := receipt.ParseReceiptDate(raw)
+	if !ok {
+		f[Date] = raw
+		delete(f, Year)
+		delete(f, Month)
+		delete(f, Day)
+		return
+	}
+	f[Date] = fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	f[Year] = fmt.Sprintf("%04d", year)
+	f[Month] = fmt.Sprintf("%02d", month)
+	f[Day] = fmt.Sprintf("%02d", day)
+}
+
+// Resolve applies policy to path: under PolicyError a taken path fails with
+// ErrExists, under PolicySuffix the first free numbered name is returned, and
+// under PolicyOverwrite path is returned as is. The check races with other
+// writers; callers that need exclusivity must create the file exclusively.
+func Resolve(path string, policy Policy) (string, error) {
+	if policy == PolicyOverwrite {
+		return path, nil
+	}
+	if !exists(path) {
+		return path, nil
+	}
+	if policy == PolicyError {
+		return "", fmt.Errorf("%w: %s", ErrExists, path)
+	}
+
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for n := 2; n <= maxSuffix; n++ {
+		candidate := fmt.Sprintf("%s_%d%s", base, n, ext)
+		if !exists(candidate) {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s and %d numbered copies", ErrExists, path, maxSuffix-1)
+}
+
+// exists reports whether something is at path.
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
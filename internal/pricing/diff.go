@@ -0,0 +1,303 @@
+package pricing
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Ways two receipts' items are matched, strongest first.
+const (
+	MatchCode        = "code"         // Same UPC or store item number
+	MatchProduct     = "product"      // Same product looked up from their codes
+	MatchName        = "name"         // Same words in the name, in any order
+	MatchSimilarName = "similar_name" // Most words of the names in common
+)
+
+// minNameSimilarity is the share of their distinct words two item names
+// must have in common to match as MatchSimilarName.
+const minNameSimilarity = 0.5
+
+// Line is one line item of a receipt being compared.
+type Line struct {
+	Name    string  `json:"name"`
+	Code    string  `json:"code,omitempty"`
+	Product string  `json:"product,omitempty"` // Product name looked up from the code
+	Qty     float64 `json:"qty"`
+	Price   float64 `json:"price"`
+
+	// Price per 100 g or 100 ml, when the item's package size is known
+	NormalizedPrice float64 `json:"normalized_price,omitempty"`
+	NormalizedUnit  string  `json:"normalized_unit,omitempty"`
+}
+
+// SharedItem is an item bought on both receipts, with its prices compared
+// per Basis: each unit bought, or per 100 g or 100 ml when both lines have
+// a package size.
+type SharedItem struct {
+	A             Line    `json:"a"`
+	B             Line    `json:"b"`
+	MatchedBy     string  `json:"matched_by"`
+	Basis         string  `json:"basis"`
+	UnitPriceA    float64 `json:"unit_price_a"`
+	UnitPriceB    float64 `json:"unit_price_b"`
+	Difference    float64 `json:"difference"`     // B's price less A's
+	DifferencePct float64 `json:"difference_pct"` // Difference as a percentage of A's price
+}
+
+// ReceiptDiff compares the items of two receipts, A and B.
+type ReceiptDiff struct {
+	Shared []SharedItem `json:"shared"` // Largest difference first
+	OnlyA  []Line       `json:"only_a"`
+	OnlyB  []Line       `json:"only_b"`
+
+	// Shared items cheaper on each receipt
+	CheaperA int `json:"cheaper_a"`
+	CheaperB int `json:"cheaper_b"`
+
+	// What the shared items cost at each receipt's prices, in the
+	// quantities bought on A, and B's cost less A's
+	SharedCostA      float64 `json:"shared_cost_a"`
+	SharedCostB      float64 `json:"shared_cost_b"`
+	SharedDifference float64 `json:"shared_difference"`
+}
+
+// DiffReceipts matches the items of receipts a and b and compares the
+// prices of those on both. Items are matched by code, then by the product
+// looked up from it, then by name, ignoring case, word order, plurals,
+// and common receipt abbreviations, and last by names sharing most of their
+// words. Repeated lines of one item are combined first. Discounts, voids,
+// and returns aren't prices paid, and are left out.
+func DiffReceipts(a, b []Line) ReceiptDiff {
+	as, bs := combineLines(a), combineLines(b)
+	matchedA, matchedB := make([]bool, len(as)), make([]bool, len(bs))
+	var pairs [][2]int
+	var how []string
+
+	// Exact keys, strongest first
+	for _, m := range []struct {
+		by  string
+		key func(Line) string
+	}{
+		{MatchCode, func(l Line) string { return strings.TrimLeft(strings.TrimSpace(l.Code), "0") }},
+		{MatchProduct, func(l Line) string { return nameKey(l.Product) }},
+		{MatchName, func(l Line) string { return nameKey(l.Name) }},
+	} {
+		index := make(map[string]int)
+		for j, l := range bs {
+			if k := m.key(l); k != "" && !matchedB[j] {
+				if _, seen := index[k]; !seen {
+					index[k] = j
+				}
+			}
+		}
+		for i, l := range as {
+			if matchedA[i] {
+				continue
+			}
+			j, ok := index[m.key(l)]
+			if !ok || matchedB[j] {
+				continue
+			}
+			matchedA[i], matchedB[j] = true, true
+			pairs, how = append(pairs, [2]int{i, j}), append(how, m.by)
+		}
+	}
+
+	// Then names with most words in common, most similar first
+	type candidate struct {
+		i, j  int
+		score float64
+	}
+	var candidates []candidate
+	for i, la := range as {
+		if matchedA[i] {
+			continue
+		}
+		for j, lb := range bs {
+			if matchedB[j] {
+				continue
+			}
+			if score := nameSimilarity(la.Name, lb.Name); score >= minNameSimilarity {
+				candidates = append(candidates, candidate{i, j, score})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(x, y int) bool { return candidates[x].score > candidates[y].score })
+	for _, c := range candidates {
+		if matchedA[c.i] || matchedB[c.j] {
+			continue
+		}
+		matchedA[c.i], matchedB[c.j] = true, true
+		pairs, how = append(pairs, [2]int{c.i, c.j}), append(how, MatchSimilarName)
+	}
+
+	d := ReceiptDiff{Shared: make([]SharedItem, 0, len(pairs)), OnlyA: make([]Line, 0), OnlyB: make([]Line, 0)}
+	for k, p := range pairs {
+		item := compareLines(as[p[0]], bs[p[1]], how[k])
+		d.Shared = append(d.Shared, item)
+		switch {
+		case item.Difference < 0:
+			d.CheaperB++
+		case item.Difference > 0:
+			d.CheaperA++
+		}
+		d.SharedCostA += item.A.Price
+		d.SharedCostB += item.A.Price * item.UnitPriceB / item.UnitPriceA
+	}
+	sort.SliceStable(d.Shared, func(x, y int) bool {
+		return math.Abs(d.Shared[x].DifferencePct) > math.Abs(d.Shared[y].DifferencePct)
+	})
+	for i, l := range as {
+		if !matchedA[i] {
+			d.OnlyA = append(d.OnlyA, l)
+		}
+	}
+	for j, l := range bs {
+		if !matchedB[j] {
+			d.OnlyB = append(d.OnlyB, l)
+		}
+	}
+	d.SharedCostA, d.SharedCostB = roundCents(d.SharedCostA), roundCents(d.SharedCostB)
+	d.SharedDifference = roundCents(d.SharedCostB - d.SharedCostA)
+	return d
+}
+
+// compareLines compares the prices of one item bought on both receipts.
+func compareLines(a, b Line, matchedBy string) SharedItem {
+	item := SharedItem{A: a, B: b, MatchedBy: matchedBy, Basis: BasisEach}
+	unitA, unitB := UnitPrice(a.Qty, a.Price), UnitPrice(b.Qty, b.Price)
+	round := roundCents
+	if a.NormalizedUnit != "" && a.NormalizedUnit == b.NormalizedUnit && a.NormalizedPrice > 0 && b.NormalizedPrice > 0 {
+		item.Basis = a.NormalizedUnit
+		unitA, unitB = a.NormalizedPrice, b.NormalizedPrice
+		round = roundMills
+	}
+	item.UnitPriceA, item.UnitPriceB = round(unitA), round(unitB)
+	item.Difference = round(unitB - unitA)
+	item.DifferencePct = math.Round((unitB-unitA)/unitA*1000) / 10
+	return item
+}
+
+// combineLines drops lines that aren't prices paid and combines lines of
+// the same item, by code or name, adding up their quantities and prices.
+func combineLines(lines []Line) []Line {
+	var combined []Line
+	index := make(map[string]int)
+	for _, l := range lines {
+		if l.Price <= 0 {
+			continue
+		}
+		l.Qty = max(l.Qty, 1)
+		key := "name:" + nameKey(l.Name)
+		if code := strings.TrimLeft(strings.TrimSpace(l.Code), "0"); code != "" {
+			key = "code:" + code
+		}
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(combined)
+			combined = append(combined, l)
+			continue
+		}
+		c := &combined[i]
+		// Total price over total amount bought, in the normalized unit
+		if c.NormalizedUnit != "" && c.NormalizedUnit == l.NormalizedUnit && c.NormalizedPrice > 0 && l.NormalizedPrice > 0 {
+			c.NormalizedPrice = (c.Price + l.Price) / (c.Price/c.NormalizedPrice + l.Price/l.NormalizedPrice)
+		} else {
+			c.NormalizedPrice, c.NormalizedUnit = 0, ""
+		}
+		c.Qty += l.Qty
+		c.Price = roundCents(c.Price + l.Price)
+	}
+	return combined
+}
+
+// nameAbbreviations expands words receipts commonly shorten.
+var nameAbbreviations = map[string]string{
+	"org": "organic", "orgnc": "organic", "lg": "large", "sm": "small", "med": "medium",
+	"wht": "white", "whl": "whole", "grn": "green", "brn": "brown", "chkn": "chicken",
+	"bnls": "boneless", "sknls": "skinless", "crm": "cream", "chs": "cheese", "bnna": "banana",
+	"pk": "pack", "ct": "count", "btl": "bottle", "gal": "gallon", "lb": "pound", "lbs": "pound",
+}
+
+// sizeWords are the units of package sizes, which say nothing about what
+// an item is.
+var sizeWords = map[string]bool{
+	"oz": true, "fl": true, "g": true, "kg": true, "ml": true, "l": true, "pound": true,
+	"count": true, "pack": true, "gallon": true, "qt": true, "pt": true,
+}
+
+// nameWords splits an item name into lowercase words, with numbers apart
+// from the letters around them, abbreviations expanded, and plurals made
+// singular.
+func nameWords(name string) []string {
+	var fields []string
+	start := -1
+	runes := []rune(strings.ToLower(name))
+	for i, r := range runes {
+		wordRune := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if start >= 0 && (!wordRune || unicode.IsDigit(r) != unicode.IsDigit(runes[i-1])) {
+			fields = append(fields, string(runes[start:i]))
+			start = -1
+		}
+		if wordRune && start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, string(runes[start:]))
+	}
+
+	words := make([]string, 0, len(fields))
+	for _, w := range fields {
+		if full, ok := nameAbbreviations[w]; ok {
+			w = full
+		}
+		if len(w) > 3 && strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "ss") {
+			w = strings.TrimSuffix(w, "s")
+		}
+		words = append(words, w)
+	}
+	return words
+}
+
+// nameKey is an item name's distinct words in order, so names that differ
+// only in case, punctuation, word order, or plurals share it.
+func nameKey(name string) string {
+	words := nameWords(name)
+	slices.Sort(words)
+	return strings.Join(slices.Compact(words), " ")
+}
+
+// nameSimilarity is the share of two names' distinct words that both have,
+// not counting package sizes, which often differ between stores. Names
+// only sharing short words aren't similar.
+func nameSimilarity(a, b string) float64 {
+	wordsA, wordsB := describingWords(a), describingWords(b)
+	shared, long := 0, false
+	for w := range wordsA {
+		if wordsB[w] {
+			shared++
+			long = long || len(w) >= 3
+		}
+	}
+	union := len(wordsA) + len(wordsB) - shared
+	if union == 0 || !long {
+		return 0
+	}
+	return float64(shared) / float64(union)
+}
+
+// describingWords returns the distinct words of an item name other than
+// numbers and size units.
+func describingWords(name string) map[string]bool {
+	words := make(map[string]bool)
+	for _, w := range nameWords(name) {
+		if !sizeWords[w] && strings.Trim(w, "0123456789") != "" {
+			words[w] = true
+		}
+	}
+	return words
+}
@@ -0,0 +1,229 @@
+// Package pricing compares what an item cost across vendors and over time,
+// from line items observed on stored receipts.
+package pricing
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Trend directions. A price is stable when its fitted change over the
+// observed period is within stableThreshold of its starting price.
+const (
+	TrendRising       = "rising"
+	TrendFalling      = "falling"
+	TrendStable       = "stable"
+	TrendInsufficient = "insufficient_data"
+
+	stableThreshold = 0.02
+)
+
+// BasisEach compares prices per unit bought. Comparisons on a normalized
+// basis use the unit from units, e.g. "100g".
+const BasisEach = "each"
+
+// Observation is one purchase of an item.
+type Observation struct {
+	ReceiptID string  `json:"receipt_id"`
+	Vendor    string  `json:"vendor"`
+	Store     string  `json:"store,omitempty"` // The vendor's location, when compared by store
+	Item      string  `json:"item"`            // Name as printed on the receipt
+	Date      string  `json:"date"`            // Purchase date, "2006-01-02"
+	Qty       float64 `json:"qty"`
+	UnitPrice float64 `json:"unit_price"`
+
+	// Price per 100 g or 100 ml, when the item's package size is known
+	NormalizedPrice float64 `json:"normalized_price,omitempty"`
+	NormalizedUnit  string  `json:"normalized_unit,omitempty"`
+
+	compared float64 // UnitPrice or NormalizedPrice, per the comparison's basis
+}
+
+// VendorPrices summarizes one vendor's observed prices, or one of its
+// stores' when observations name their store.
+type VendorPrices struct {
+	Vendor       string  `json:"vendor"`
+	Store        string  `json:"store,omitempty"`
+	Observations int     `json:"observations"`
+	Latest       float64 `json:"latest"`
+	LatestDate   string  `json:"latest_date"`
+	Min          float64 `json:"min"`
+	Max          float64 `json:"max"`
+	Mean         float64 `json:"mean"`
+	Trend        string  `json:"trend"`
+	ChangePct    float64 `json:"change_pct"` // Fitted change over the observed period
+}
+
+// Comparison is the price history of an item across vendors. Prices are
+// per Basis: each unit bought, or per 100 g or 100 ml.
+type Comparison struct {
+	Basis        string         `json:"basis"`
+	Observations int            `json:"observations"`
+	Vendors      []VendorPrices `json:"vendors"` // Cheapest latest price first
+	Cheapest     *Observation   `json:"cheapest,omitempty"`
+	Trend        string         `json:"trend"`
+	ChangePct    float64        `json:"change_pct"`
+}
+
+// UnitPrice derives a per-unit price from a line's quantity and amount.
+// A missing or non-positive quantity counts as one unit.
+func UnitPrice(qty, amount float64) float64 {
+	if qty <= 0 {
+		return amount
+	}
+	return amount / qty
+}
+
+// Compare groups observations by vendor, and by store within a vendor when
+// they name one, case-insensitively, and reports each group's price range
+// and trend, the cheapest single purchase, and the trend across all
+// vendors. Observations without a positive unit price
+// (voids, discounts) are ignored. When every observation has a normalized
+// price in the same unit, those are compared instead, so package sizes
+// don't skew the result.
+func Compare(obs []Observation) Comparison {
+	valid := make([]Observation, 0, len(obs))
+	for _, o := range obs {
+		if o.UnitPrice > 0 && o.Date != "" {
+			valid = append(valid, o)
+		}
+	}
+	sort.SliceStable(valid, func(i, j int) bool { return valid[i].Date < valid[j].Date })
+
+	c := Comparison{Basis: basis(valid), Observations: len(valid), Vendors: make([]VendorPrices, 0), Trend: TrendInsufficient}
+	if len(valid) == 0 {
+		return c
+	}
+	round := roundCents
+	for i := range valid {
+		valid[i].compared = valid[i].UnitPrice
+		if c.Basis != BasisEach {
+			valid[i].compared = valid[i].NormalizedPrice
+			round = roundMills
+		}
+	}
+
+	byVendor := make(map[string][]Observation)
+	var order []string
+	for i, o := range valid {
+		key := strings.ToLower(strings.TrimSpace(o.Vendor) + "\x00" + strings.TrimSpace(o.Store))
+		if _, ok := byVendor[key]; !ok {
+			order = append(order, key)
+		}
+		byVendor[key] = append(byVendor[key], o)
+		if c.Cheapest == nil || o.compared < c.Cheapest.compared {
+			c.Cheapest = &valid[i]
+		}
+	}
+
+	for _, key := range order {
+		c.Vendors = append(c.Vendors, summarize(byVendor[key], round))
+	}
+	sort.SliceStable(c.Vendors, func(i, j int) bool { return c.Vendors[i].Latest < c.Vendors[j].Latest })
+
+	c.Trend, c.ChangePct = trend(valid)
+	return c
+}
+
+// basis returns the normalized unit shared by every observation, or
+// BasisEach if any lacks one or they differ.
+func basis(obs []Observation) string {
+	if len(obs) == 0 {
+		return BasisEach
+	}
+	unit := obs[0].NormalizedUnit
+	for _, o := range obs {
+		if o.NormalizedUnit == "" || o.NormalizedUnit != unit || o.NormalizedPrice <= 0 {
+			return BasisEach
+		}
+	}
+	return unit
+}
+
+// summarize reports one vendor's observations, which are sorted by date,
+// rounding prices with round.
+func summarize(obs []Observation, round func(float64) float64) VendorPrices {
+	last := obs[len(obs)-1]
+	v := VendorPrices{
+		Vendor:       last.Vendor,
+		Store:        last.Store,
+		Observations: len(obs),
+		Latest:       round(last.compared),
+		LatestDate:   last.Date,
+		Min:          math.Inf(1),
+	}
+	var sum float64
+	for _, o := range obs {
+		v.Min = math.Min(v.Min, o.compared)
+		v.Max = math.Max(v.Max, o.compared)
+		sum += o.compared
+	}
+	v.Min, v.Max = round(v.Min), round(v.Max)
+	v.Mean = round(sum / float64(len(obs)))
+	v.Trend, v.ChangePct = trend(obs)
+	return v
+}
+
+// trend fits a least-squares line of compared price against purchase day and
+// returns its direction and the change it predicts from the first to the
+// last purchase, as a percentage of the fitted first price. Observations on
+// a single day have no trend.
+func trend(obs []Observation) (string, float64) {
+	days := make([]float64, len(obs))
+	var meanX, meanY float64
+	for i, o := range obs {
+		days[i] = dayNumber(o.Date)
+		meanX += days[i]
+		meanY += o.compared
+	}
+	n := float64(len(obs))
+	meanX, meanY = meanX/n, meanY/n
+
+	var sxy, sxx float64
+	for i, o := range obs {
+		dx := days[i] - meanX
+		sxy += dx * (o.compared - meanY)
+		sxx += dx * dx
+	}
+	if sxx == 0 {
+		return TrendInsufficient, 0
+	}
+
+	slope := sxy / sxx
+	start := meanY + slope*(days[0]-meanX)
+	if start <= 0 {
+		return TrendInsufficient, 0
+	}
+	change := slope * (days[len(days)-1] - days[0]) / start
+
+	pct := math.Round(change*1000) / 10
+	switch {
+	case change > stableThreshold:
+		return TrendRising, pct
+	case change < -stableThreshold:
+		return TrendFalling, pct
+	}
+	return TrendStable, pct
+}
+
+// dayNumber converts a "2006-01-02" date to days since the Unix epoch.
+func dayNumber(date string) float64 {
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return 0
+	}
+	return float64(t.Unix() / 86400)
+}
+
+// roundCents rounds a price to whole cents.
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// roundMills rounds a normalized price, which is often under a dollar, to
+// a tenth of a cent.
+func roundMills(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
@@ -0,0 +1,97 @@
+// Package product looks up item codes printed on receipts, such as UPCs or
+// warehouse item numbers, in a pluggable product database.
+package product
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultOpenFoodFactsURL is the public Open Food Facts server.
+const DefaultOpenFoodFactsURL = "https://world.openfoodfacts.org"
+
+// OpenFoodFactsDatabase queries the Open Food Facts product API. Only UPC
+// and EAN codes are sent; store item numbers are never found there.
+type OpenFoodFactsDatabase struct {
+	baseURL   string
+	userAgent string
+	client    *http.Client
+}
+
+// NewOpenFoodFactsDatabase creates a database for the Open Food Facts
+// server at baseURL.
+func NewOpenFoodFactsDatabase(baseURL, userAgent string) *OpenFoodFactsDatabase {
+	if baseURL == "" {
+		baseURL = DefaultOpenFoodFactsURL
+	}
+	return &OpenFoodFactsDatabase{
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		userAgent: userAgent,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// openFoodFactsResponse is the subset of a product response we use.
+type openFoodFactsResponse struct {
+	Status  int `json:"status"` // 1 when found
+	Product struct {
+		ProductName string `json:"product_name"`
+		Brands      string `json:"brands"`
+		Quantity    string `json:"quantity"`
+	} `json:"product"`
+}
+
+// Lookup fetches a product by barcode.
+func (db *OpenFoodFactsDatabase) Lookup(ctx context.Context, code string) (*Product, error) {
+	if !ValidGTIN(code) {
+		return nil, ErrNotFound
+	}
+
+	q := url.Values{}
+	q.Set("fields", "product_name,brands,quantity")
+	endpoint := db.baseURL + "/api/v2/product/" + url.PathEscape(code) + ".json?" + q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("User-Agent", db.userAgent)
+
+	resp, err := db.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("product lookup failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("open food facts error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var result openFoodFactsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode product response: %w", err)
+	}
+	if result.Status != 1 || result.Product.ProductName == "" {
+		return nil, ErrNotFound
+	}
+
+	// Brands is a comma-separated list, most specific first
+	brand, _, _ := strings.Cut(result.Product.Brands, ",")
+	return &Product{
+		Code:     code,
+		Name:     strings.TrimSpace(result.Product.ProductName),
+		Brand:    strings.TrimSpace(brand),
+		Size:     strings.TrimSpace(result.Product.Quantity),
+		Provider: "openfoodfacts",
+	}, nil
+}
@@ -0,0 +1,207 @@
+// Package product looks up item codes printed on receipts, such as UPCs or
+// warehouse item numbers, in a pluggable product database.
+package product
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"myprice/internal/crypt"
+)
+
+// ErrNotFound is returned when a database has no product for a code.
+var ErrNotFound = errors.New("product not found")
+
+// codeRegex matches an item code printed before or after an item name, as
+// on warehouse club and grocery receipts: "1234567 KS ORGANIC MILK".
+var codeRegex = regexp.MustCompile(`^\s*(\d{6,14})\s+(.*\S)\s*$|^\s*(.*\S)\s+(\d{6,14})\s*$`)
+
+// Product is what a database knows about an item code.
+type Product struct {
+	Code     string `json:"code"`
+	Name     string `json:"name,omitempty"`
+	Brand    string `json:"brand,omitempty"`
+	Size     string `json:"size,omitempty"` // As listed, e.g. "1 gal" or "500 g"
+	Provider string `json:"provider,omitempty"`
+}
+
+// Database resolves an item code to a product.
+type Database interface {
+	Lookup(ctx context.Context, code string) (*Product, error)
+}
+
+// NormalizeCode strips spaces and dashes from a printed code and returns
+// it if what remains is 6 to 14 digits.
+func NormalizeCode(code string) (string, bool) {
+	code = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, code)
+	if len(code) < 6 || len(code) > 14 {
+		return "", false
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return "", false
+		}
+	}
+	return code, true
+}
+
+// ValidGTIN reports whether code is a UPC or EAN (GTIN-8, -12, -13, or
+// -14) with a correct check digit. Store-specific item numbers aren't.
+func ValidGTIN(code string) bool {
+	switch len(code) {
+	case 8, 12, 13, 14:
+	default:
+		return false
+	}
+	sum := 0
+	for i := len(code) - 2; i >= 0; i-- {
+		d := int(code[i] - '0')
+		if d < 0 || d > 9 {
+			return false
+		}
+		// Weights alternate 3, 1, ... from the digit left of the check digit
+		if (len(code)-2-i)%2 == 0 {
+			d *= 3
+		}
+		sum += d
+	}
+	return int(code[len(code)-1]-'0') == (10-sum%10)%10
+}
+
+// SplitCode separates an item code printed alongside an item name. It
+// returns the code and the remaining name, or ok false if there is none.
+func SplitCode(name string) (code, rest string, ok bool) {
+	m := codeRegex.FindStringSubmatch(name)
+	switch {
+	case m == nil:
+		return "", name, false
+	case m[1] != "":
+		return m[1], m[2], true
+	default:
+		return m[4], m[3], true
+	}
+}
+
+// FileDatabase serves products from a JSON file mapping codes to products,
+// for store item numbers and products that public databases lack. It needs
+// no network.
+type FileDatabase struct {
+	products map[string]*Product
+}
+
+// OpenFile loads a product file of the form {"<code>": {"name": ...}}. The
+// file is decrypted when c is non-nil.
+func OpenFile(path string, c *crypt.Cipher) (*FileDatabase, error) {
+	data, err := c.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read product file: %w", err)
+	}
+	var products map[string]*Product
+	if err := json.Unmarshal(data, &products); err != nil {
+		return nil, fmt.Errorf("failed to parse product file: %w", err)
+	}
+
+	db := &FileDatabase{products: make(map[string]*Product, len(products))}
+	for code, p := range products {
+		normalized, ok := NormalizeCode(code)
+		if !ok || p == nil {
+			continue
+		}
+		p.Code = normalized
+		if p.Provider == "" {
+			p.Provider = "file"
+		}
+		db.products[normalized] = p
+	}
+	return db, nil
+}
+
+// Len returns the number of products in the file.
+func (db *FileDatabase) Len() int {
+	return len(db.products)
+}
+
+// Lookup returns the product listed for code.
+func (db *FileDatabase) Lookup(ctx context.Context, code string) (*Product, error) {
+	p, ok := db.products[code]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	copied := *p
+	return &copied, nil
+}
+
+// Chain asks each database in turn, returning the first product found.
+type Chain []Database
+
+// Lookup returns the first database's match. An error other than
+// ErrNotFound is returned only if no later database finds the product.
+func (c Chain) Lookup(ctx context.Context, code string) (*Product, error) {
+	var lastErr error
+	for _, db := range c {
+		p, err := db.Lookup(ctx, code)
+		if err == nil {
+			return p, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, ErrNotFound
+}
+
+// CachingDatabase memoizes results of another database, including misses,
+// so each code is only looked up once per process.
+type CachingDatabase struct {
+	next  Database
+	mu    sync.Mutex
+	cache map[string]*Product
+}
+
+// NewCachingDatabase wraps next with an in-memory cache.
+func NewCachingDatabase(next Database) *CachingDatabase {
+	return &CachingDatabase{next: next, cache: make(map[string]*Product)}
+}
+
+// Lookup returns a cached product or asks the wrapped database.
+func (c *CachingDatabase) Lookup(ctx context.Context, code string) (*Product, error) {
+	c.mu.Lock()
+	p, ok := c.cache[code]
+	c.mu.Unlock()
+	if ok {
+		if p == nil {
+			return nil, ErrNotFound
+		}
+		copied := *p
+		return &copied, nil
+	}
+
+	p, err := c.next.Lookup(ctx, code)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		// Don't cache transient failures
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.cache[code] = p
+	c.mu.Unlock()
+
+	if p == nil {
+		return nil, ErrNotFound
+	}
+	copied := *p
+	return &copied, nil
+}
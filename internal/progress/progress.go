@@ -0,0 +1,24 @@
+// Package progress carries a stage reporter through a context, so long
+// pipeline runs can tell a waiting client what they are doing.
+package progress
+
+import "context"
+
+// Func receives a short description of the stage that just started or
+// finished, e.g. "OCR complete, calling model".
+type Func func(message string)
+
+// reporterKey is the context key for the reporter.
+type reporterKey struct{}
+
+// With returns a context whose pipeline stages report to fn.
+func With(ctx context.Context, fn Func) context.Context {
+	return context.WithValue(ctx, reporterKey{}, fn)
+}
+
+// Report sends message to the context's reporter, if it has one.
+func Report(ctx context.Context, message string) {
+	if fn, ok := ctx.Value(reporterKey{}).(Func); ok && fn != nil {
+		fn(message)
+	}
+}
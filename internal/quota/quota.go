@@ -0,0 +1,245 @@
+// Package quota tracks how much upload storage each user holds and
+// enforces per-user limits on it.
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"myprice/internal/crypt"
+)
+
+// ExceededError is returned when an upload would take a user past their
+// quota.
+type ExceededError struct {
+	User      string
+	Used      int64
+	Limit     int64
+	Requested int64
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("storage quota exceeded for %s: %d of %d bytes used, %d more requested", e.User, e.Used, e.Limit, e.Requested)
+}
+
+// Limits are the per-user quotas in bytes. Zero means unlimited.
+type Limits struct {
+	Default int64
+	Users   map[string]int64 // Overrides Default; 0 exempts a user
+}
+
+// Limit returns a user's quota, or 0 when they have none.
+func (l Limits) Limit(user string) int64 {
+	if limit, ok := l.Users[user]; ok {
+		return limit
+	}
+	return l.Default
+}
+
+// ParseLimits parses per-user quotas written as comma-separated
+// name:bytes entries, e.g. "alice:5000000000,scanner:0".
+func ParseLimits(s string) (map[string]int64, error) {
+	users := make(map[string]int64)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, raw, ok := strings.Cut(entry, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid quota entry %q: want name:bytes", entry)
+		}
+		limit, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid quota for %s: %q", name, raw)
+		}
+		users[name] = limit
+	}
+	return users, nil
+}
+
+// Entry records who uploaded a file. Files named by their content may be
+// held by several users, each with an entry of their own.
+type Entry struct {
+	Name       string    `json:"name"` // Within the upload directory
+	User       string    `json:"user"`
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// Usage is the storage a user holds.
+type Usage struct {
+	User  string `json:"user"`
+	Used  int64  `json:"used"`
+	Files int    `json:"files"`
+}
+
+// Ledger records the owner of each file in the upload directory,
+// persisted as one JSON file. Files removed by deletion or retention stop
+// counting as soon as they are gone.
+type Ledger struct {
+	path    string
+	dir     string
+	cipher  *crypt.Cipher
+	mu      sync.Mutex
+	entries map[string]Entry // By entryKey
+	pending map[string]bool  // Reserved entries whose files aren't yet on disk
+}
+
+// entryKey identifies user's entry for a file. User names can't hold a
+// colon.
+func entryKey(user, name string) string {
+	return user + ":" + name
+}
+
+// Open loads the ledger at path for uploads in dir, starting empty if the
+// file doesn't exist. The file is encrypted when c is non-nil.
+func Open(path, dir string, c *crypt.Cipher) (*Ledger, error) {
+	l := &Ledger{path: path, dir: dir, cipher: c, entries: make(map[string]Entry), pending: make(map[string]bool)}
+
+	data, err := c.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quota ledger: %w", err)
+	}
+	var entries map[string]Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse quota ledger: %w", err)
+	}
+	for key, e := range entries {
+		// Ledgers written before entries had names were keyed by file name
+		if e.Name == "" {
+			e.Name = key
+		}
+		l.entries[entryKey(e.User, e.Name)] = e
+	}
+	return l, nil
+}
+
+// Reserve records an upload of size bytes to name by user, unless it
+// would take them past limit (0 means unlimited). A file that replaces an
+// existing one of theirs frees the old file's size; other users' entries
+// for the same name are left alone. Call Release if the upload isn't saved
+// after all.
+func (l *Ledger) Reserve(name, user string, size, limit int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := entryKey(user, name)
+	next := l.live()
+	if limit > 0 {
+		used := int64(0)
+		for k, e := range next {
+			if e.User == user && k != key {
+				used += e.Size
+			}
+		}
+		if used+size > limit {
+			return &ExceededError{User: user, Used: used, Limit: limit, Requested: size}
+		}
+	}
+
+	next[key] = Entry{Name: name, User: user, Size: size, UploadedAt: time.Now().UTC()}
+	if err := l.save(next); err != nil {
+		return err
+	}
+	l.entries = next
+	l.pending[key] = true
+	return nil
+}
+
+// Release forgets user's reservation of a file whose upload failed.
+func (l *Ledger) Release(name, user string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := entryKey(user, name)
+	delete(l.pending, key)
+	next := l.live()
+	delete(next, key)
+	if err := l.save(next); err != nil {
+		return err
+	}
+	l.entries = next
+	return nil
+}
+
+// Usage returns the storage held by user.
+func (l *Ledger) Usage(user string) Usage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	u := Usage{User: user}
+	for _, e := range l.live() {
+		if e.User == user {
+			u.Used += e.Size
+			u.Files++
+		}
+	}
+	return u
+}
+
+// All returns every user's usage, largest first.
+func (l *Ledger) All() []Usage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	byUser := make(map[string]*Usage)
+	for _, e := range l.live() {
+		u, ok := byUser[e.User]
+		if !ok {
+			u = &Usage{User: e.User}
+			byUser[e.User] = u
+		}
+		u.Used += e.Size
+		u.Files++
+	}
+
+	list := make([]Usage, 0, len(byUser))
+	for _, u := range byUser {
+		list = append(list, *u)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Used != list[j].Used {
+			return list[i].Used > list[j].Used
+		}
+		return list[i].User < list[j].User
+	})
+	return list
+}
+
+// live copies the entries whose files still exist or are still being
+// written. Callers hold l.mu.
+func (l *Ledger) live() map[string]Entry {
+	next := make(map[string]Entry, len(l.entries))
+	for key, e := range l.entries {
+		if _, err := os.Stat(filepath.Join(l.dir, e.Name)); err == nil {
+			delete(l.pending, key)
+			next[key] = e
+		} else if l.pending[key] {
+			next[key] = e
+		}
+	}
+	return next
+}
+
+func (l *Ledger) save(entries map[string]Entry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize quota ledger: %w", err)
+	}
+	if err := l.cipher.WriteFile(l.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write quota ledger: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+// Package rawresponse keeps the model's answers to each analysis exactly as
+// they arrived, with their usage, next to the analysis log entry they
+// belong to. An answer that didn't parse can then be read to see why, and
+// parsed again once the JSON extraction or repair handles it.
+package rawresponse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"myprice/internal/crypt"
+)
+
+// ErrNotFound is returned for an analysis with no responses kept.
+var ErrNotFound = errors.New("no raw responses for this analysis")
+
+// idPattern matches analysis log entry IDs, which name the files.
+var idPattern = regexp.MustCompile(`^[0-9a-f]{1,64}$`)
+
+// Usage is what a model call used, as reported by the API.
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// Response is one model answer.
+type Response struct {
+	Time       time.Time `json:"time"`
+	Model      string    `json:"model,omitempty"` // As reported in the answer
+	StopReason string    `json:"stop_reason,omitempty"`
+	Usage      Usage     `json:"usage"`
+	Text       string    `json:"text"` // The first content block, before JSON extraction
+
+	// What parsing made of it: why it didn't decode, or the validation
+	// problems sent back to the model
+	DecodeError string   `json:"decode_error,omitempty"`
+	Issues      []string `json:"issues,omitempty"`
+}
+
+// Record is every answer of one analysis, in order: the first answer and
+// each attempt to repair it.
+type Record struct {
+	ID            string     `json:"id"` // The analysis log entry's
+	Time          time.Time  `json:"time"`
+	ImagePath     string     `json:"image_path,omitempty"`
+	ImageSHA256   string     `json:"image_sha256,omitempty"`
+	DocumentType  string     `json:"document_type,omitempty"`
+	PromptVersion string     `json:"prompt_version,omitempty"`
+	Outcome       string     `json:"outcome"`
+	Error         string     `json:"error,omitempty"`
+	ReceiptID     string     `json:"receipt_id,omitempty"`  // The stored result, if any
+	PreviousID    string     `json:"previous_id,omitempty"` // The receipt reprocessed, if any
+	Responses     []Response `json:"responses"`
+}
+
+// Store keeps records as one file each in a directory, encrypted when the
+// cipher is enabled. Old files are removed by the retention janitor.
+type Store struct {
+	dir    string
+	cipher *crypt.Cipher
+}
+
+// NewStore opens the store in dir, creating it if needed.
+func NewStore(dir string, cipher *crypt.Cipher) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, cipher: cipher}, nil
+}
+
+// Dir returns the directory the store keeps records in.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Save writes rec, replacing any record with its ID.
+func (s *Store) Save(rec *Record) error {
+	if !idPattern.MatchString(rec.ID) {
+		return errors.New("invalid raw response record ID")
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.cipher.WriteFile(s.path(rec.ID), data, 0600)
+}
+
+// Get returns the record of an analysis, or ErrNotFound.
+func (s *Store) Get(id string) (*Record, error) {
+	if !idPattern.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	data, err := s.cipher.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec Record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// DeleteReceipts removes the records of analyses that stored or
+// reprocessed erased receipts, since their answers hold the receipts'
+// contents, and returns how many were removed.
+func (s *Store) DeleteReceipts(ids []string) (int, error) {
+	doomed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		doomed[id] = true
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read raw response dir: %w", err)
+	}
+	removed := 0
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		rec, err := s.Get(strings.TrimSuffix(name, ".json"))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return removed, fmt.Errorf("failed to read raw responses %s: %w", name, err)
+		}
+		if !doomed[rec.ReceiptID] && !doomed[rec.PreviousID] {
+			continue
+		}
+		if err := os.Remove(s.path(rec.ID)); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("failed to delete raw responses %s: %w", rec.ID, err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
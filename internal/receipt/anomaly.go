@@ -0,0 +1,438 @@
+package receipt
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Severity is how much an anomaly calls a receipt into question.
+type Severity string
+
+const (
+	// SeverityInfo is worth a look but often fine, like a line bought twice.
+	SeverityInfo Severity = "info"
+	// SeverityWarning is probably a misreading, like an unusual price.
+	SeverityWarning Severity = "warning"
+	// SeverityError can't be right as read, like totals that don't add up.
+	SeverityError Severity = "error"
+)
+
+// Anomaly is a problem a detector found on a parsed receipt. Unlike the
+// receipt's Anomalies, which the parser or model writes, these come from
+// checks of the parsed values.
+type Anomaly struct {
+	Detector string   `json:"detector"`        // Name of the detector, e.g. "arithmetic"
+	Severity Severity `json:"severity"`        // "info", "warning", or "error"
+	Field    string   `json:"field,omitempty"` // The value in question, e.g. "items[2].price"
+	Message  string   `json:"message"`
+}
+
+// PriceHistory is what was paid for items on earlier receipts.
+type PriceHistory interface {
+	// UnitPrices returns the unit prices paid for item at vendor before.
+	UnitPrices(vendor, item string) []float64
+}
+
+// ItemHistory is what one person paid for items before, at any vendor.
+type ItemHistory interface {
+	// ItemPrices returns the prices paid for the item CanonicalItem
+	// identifies by key.
+	ItemPrices(key string) []float64
+}
+
+// DetectContext is what detectors know besides the receipt.
+type DetectContext struct {
+	Now      time.Time
+	History  PriceHistory // nil when there are no earlier receipts to compare with
+	Personal ItemHistory  // The receipt owner's earlier purchases; nil when unknown
+}
+
+// Detector checks a parsed receipt for one kind of anomaly.
+type Detector interface {
+	// Name identifies the detector in anomalies and ANOMALY_DETECTORS.
+	Name() string
+	// Detect returns the anomalies found on r, if any. It must not modify r.
+	Detect(r *Receipt, dc DetectContext) []Anomaly
+}
+
+// Detectors returns the built-in detectors, in the order they run.
+func Detectors() []Detector {
+	return []Detector{
+		arithmeticDetector{},
+		duplicateLineDetector{},
+		impossibleDateDetector{},
+		priceOutlierDetector{},
+		personalPriceDetector{},
+		missingTaxDetector{},
+	}
+}
+
+// DetectorsNamed returns the built-in detectors with the given names, in
+// the order they run, or an error naming one that doesn't exist.
+func DetectorsNamed(names []string) ([]Detector, error) {
+	all := Detectors()
+	var selected []Detector
+	for _, name := range names {
+		i := slices.IndexFunc(all, func(d Detector) bool { return d.Name() == name })
+		if i < 0 {
+			return nil, fmt.Errorf("unknown anomaly detector %q", name)
+		}
+		selected = append(selected, all[i])
+	}
+	sort.SliceStable(selected, func(i, j int) bool {
+		return slices.Index(all, selected[i]) < slices.Index(all, selected[j])
+	})
+	return slices.Compact(selected), nil
+}
+
+// DetectAnomalies runs each detector on r in turn and returns everything
+// they found, most severe first.
+func DetectAnomalies(r *Receipt, detectors []Detector, dc DetectContext) []Anomaly {
+	anomalies := make([]Anomaly, 0)
+	for _, d := range detectors {
+		for _, a := range d.Detect(r, dc) {
+			a.Detector = d.Name()
+			anomalies = append(anomalies, a)
+		}
+	}
+	sort.SliceStable(anomalies, func(i, j int) bool {
+		return severityRank(anomalies[i].Severity) > severityRank(anomalies[j].Severity)
+	})
+	return anomalies
+}
+
+// severityRank orders severities from info up to error.
+func severityRank(s Severity) int {
+	switch s {
+	case SeverityError:
+		return 2
+	case SeverityWarning:
+		return 1
+	}
+	return 0
+}
+
+// totalsTolerance is how far totals may disagree before it is an anomaly:
+// the larger of 10 cents and 2%, as for validating parses.
+func totalsTolerance(amount float64) float64 {
+	return math.Max(0.10, math.Abs(amount)*0.02)
+}
+
+// itemLabel names an item in messages: "items[2] (Milk)".
+func itemLabel(i int, item Item) string {
+	return fmt.Sprintf("items[%d] (%s)", i, item.Name)
+}
+
+// arithmeticDetector checks that lines, the subtotal, and the total add up.
+type arithmeticDetector struct{}
+
+func (arithmeticDetector) Name() string { return "arithmetic" }
+
+func (arithmeticDetector) Detect(r *Receipt, _ DetectContext) []Anomaly {
+	var anomalies []Anomaly
+	itemSum, lineSum := 0.0, 0.0
+	for i, item := range r.Items {
+		if item.UnitPrice != 0 && item.Qty > 0 && !lineAgrees(float64(item.Qty), item.UnitPrice, item.Price) {
+			anomalies = append(anomalies, Anomaly{
+				Severity: SeverityWarning,
+				Field:    fmt.Sprintf("items[%d].price", i),
+				Message: fmt.Sprintf("%s: %d × %.2f is %.2f but the line total is %.2f",
+					itemLabel(i, item), item.Qty, item.UnitPrice, float64(item.Qty)*item.UnitPrice, item.Price),
+			})
+		}
+		itemSum += item.Price
+		lineSum += item.Price * float64(max(item.Qty, 1))
+	}
+
+	// Prices may be per unit or per line, so either sum may match
+	if r.Subtotal != nil && len(r.Items) > 0 {
+		subtotal, tolerance := *r.Subtotal, totalsTolerance(*r.Subtotal)
+		if math.Abs(itemSum-subtotal) > tolerance && math.Abs(lineSum-subtotal) > tolerance {
+			anomalies = append(anomalies, Anomaly{
+				Severity: SeverityError,
+				Field:    "subtotal",
+				Message:  fmt.Sprintf("item prices add up to %.2f but the subtotal is %.2f", itemSum, subtotal),
+			})
+		}
+	}
+
+	if r.Subtotal != nil && r.Total != nil && r.Unknown["tax"] != ReasonUnreadable {
+		fees := 0.0
+		for _, fee := range r.Fees {
+			fees += fee.Amount
+		}
+		_, included := TaxTotals(r.TaxLines)
+		sum := *r.Subtotal + Value(r.Tax) - included + fees
+		if math.Abs(sum-*r.Total) > totalsTolerance(*r.Total) {
+			anomalies = append(anomalies, Anomaly{
+				Severity: SeverityError,
+				Field:    "total",
+				Message:  fmt.Sprintf("subtotal + tax + fees is %.2f but the total is %.2f", sum, *r.Total),
+			})
+		}
+	}
+	return anomalies
+}
+
+// duplicateLineDetector finds lines printed twice with the same name,
+// quantity, and price, which may be a double scan or a line OCR repeated.
+type duplicateLineDetector struct{}
+
+func (duplicateLineDetector) Name() string { return "duplicate_line" }
+
+func (duplicateLineDetector) Detect(r *Receipt, _ DetectContext) []Anomaly {
+	var anomalies []Anomaly
+	first := make(map[string]int)
+	for i, item := range r.Items {
+		if item.Name == "" || item.Price <= 0 {
+			continue
+		}
+		key := fmt.Sprintf("%s\x00%d\x00%.2f", strings.ToLower(strings.Join(strings.Fields(item.Name), " ")), item.Qty, item.Price)
+		j, seen := first[key]
+		if !seen {
+			first[key] = i
+			continue
+		}
+		// Next to each other, it is more likely OCR read one line twice
+		severity := SeverityInfo
+		if j == i-1 {
+			severity = SeverityWarning
+		}
+		anomalies = append(anomalies, Anomaly{
+			Severity: severity,
+			Field:    fmt.Sprintf("items[%d]", i),
+			Message:  fmt.Sprintf("%s repeats items[%d] with the same quantity and price %.2f", itemLabel(i, item), j, item.Price),
+		})
+	}
+	return anomalies
+}
+
+// maxReceiptAge is how old a purchase date may be before it is suspect.
+const maxReceiptAge = 20 * 365 * 24 * time.Hour
+
+// impossibleDateDetector finds dates that can't be, like February 30 or
+// next month, or that are too old to be likely.
+type impossibleDateDetector struct{}
+
+func (impossibleDateDetector) Name() string { return "impossible_date" }
+
+func (impossibleDateDetector) Detect(r *Receipt, dc DetectContext) []Anomaly {
+	if strings.TrimSpace(r.Date) == "" {
+		return nil
+	}
+	year, month, day, ok := ParseReceiptDate(r.Date)
+	if !ok {
+		return []Anomaly{{
+			Severity: SeverityWarning,
+			Field:    "date",
+			Message:  fmt.Sprintf("date %q isn't a date that exists", r.Date),
+		}}
+	}
+	date := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	now := dc.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	// A day of slack for time zones ahead of the server's
+	switch {
+	case date.After(now.AddDate(0, 0, 1)):
+		return []Anomaly{{
+			Severity: SeverityError,
+			Field:    "date",
+			Message:  fmt.Sprintf("date %s is in the future", date.Format("2006-01-02")),
+		}}
+	case date.Before(now.Add(-maxReceiptAge)):
+		return []Anomaly{{
+			Severity: SeverityWarning,
+			Field:    "date",
+			Message:  fmt.Sprintf("date %s is more than 20 years ago", date.Format("2006-01-02")),
+		}}
+	}
+	return nil
+}
+
+const (
+	// minPriceHistory is how many earlier prices an item needs before a
+	// price can be called unusual for it.
+	minPriceHistory = 3
+
+	// outlierFactor is how many times above or below the usual price a
+	// price must be to be unusual.
+	outlierFactor = 3
+)
+
+// priceOutlierDetector finds items priced far from what was paid for them
+// at the same vendor before, often a misread digit or decimal point.
+type priceOutlierDetector struct{}
+
+func (priceOutlierDetector) Name() string { return "price_outlier" }
+
+func (priceOutlierDetector) Detect(r *Receipt, dc DetectContext) []Anomaly {
+	if dc.History == nil || r.Vendor == "" || r.Refund {
+		return nil
+	}
+	var anomalies []Anomaly
+	for i, item := range r.Items {
+		if item.Name == "" || item.Price <= 0 {
+			continue
+		}
+		unit := item.UnitPrice
+		if unit <= 0 {
+			unit = item.Price / float64(max(item.Qty, 1))
+		}
+		history := dc.History.UnitPrices(r.Vendor, item.Name)
+		if len(history) < minPriceHistory {
+			continue
+		}
+		usual := median(history)
+		if usual <= 0 || (unit <= usual*outlierFactor && unit >= usual/outlierFactor) {
+			continue
+		}
+		anomalies = append(anomalies, Anomaly{
+			Severity: SeverityWarning,
+			Field:    fmt.Sprintf("items[%d].price", i),
+			Message: fmt.Sprintf("%s: unit price %.2f is %.1f× the usual %.2f at %s, over %d earlier purchases",
+				itemLabel(i, item), unit, unit/usual, usual, r.Vendor, len(history)),
+		})
+	}
+	return anomalies
+}
+
+const (
+	// personalPriceChange is how far a price must be from what the owner
+	// usually pays, as a fraction of it, to be worth telling them about.
+	personalPriceChange = 0.5
+
+	// personalPriceSpread is how many scaled median absolute deviations a
+	// price must also be from the usual one, so items whose price swings
+	// anyway, like produce by weight, aren't flagged for every swing.
+	personalPriceSpread = 3
+)
+
+// personalPriceDetector finds items priced far from what the receipt's
+// owner usually pays for them, at whichever vendor: a price rise, a sale,
+// or a misread worth checking.
+type personalPriceDetector struct{}
+
+func (personalPriceDetector) Name() string { return "price_history" }
+
+func (personalPriceDetector) Detect(r *Receipt, dc DetectContext) []Anomaly {
+	if dc.Personal == nil || r.Refund {
+		return nil
+	}
+	var anomalies []Anomaly
+	for i, item := range r.Items {
+		key, price, unit := CanonicalItem(item)
+		if key == "" || price <= 0 {
+			continue
+		}
+		history := dc.Personal.ItemPrices(key)
+		if len(history) < minPriceHistory {
+			continue
+		}
+		usual := median(history)
+		if usual <= 0 || math.Abs(price-usual) < usual*personalPriceChange ||
+			math.Abs(price-usual) <= personalPriceSpread*1.4826*medianDeviation(history, usual) {
+			continue
+		}
+		// Paying more is what people want to hear about; less is a sale
+		severity := SeverityWarning
+		if price < usual {
+			severity = SeverityInfo
+		}
+		per := ""
+		if unit != "" {
+			per = " per " + unit
+		}
+		anomalies = append(anomalies, Anomaly{
+			Severity: severity,
+			Field:    fmt.Sprintf("items[%d].price", i),
+			Message: fmt.Sprintf("%s: you usually pay %.2f%s for this (median of %d earlier purchases); this receipt says %.2f%s",
+				itemLabel(i, item), usual, per, len(history), price, per),
+		})
+	}
+	return anomalies
+}
+
+// CanonicalItem identifies an item across receipts and vendors, and returns
+// the price to compare between purchases of it. Items whose code a product
+// database knows are the same product wherever bought; others match by
+// name, ignoring case and punctuation. With a package size the price is
+// per normalized unit, so a larger pack isn't a price rise, and unit names
+// it. The key is "" for an item that can't be identified.
+func CanonicalItem(item Item) (key string, price float64, unit string) {
+	switch {
+	case item.Product != nil && item.Code != "":
+		key = "code:" + item.Code
+	case normalizeVendor(item.Name) != "":
+		key = "name:" + normalizeVendor(item.Name)
+	default:
+		return "", 0, ""
+	}
+	if item.NormalizedUnit != "" && item.NormalizedPrice > 0 {
+		return key + "/" + item.NormalizedUnit, item.NormalizedPrice, item.NormalizedUnit
+	}
+	price = item.UnitPrice
+	if price <= 0 {
+		price = item.Price / float64(max(item.Qty, 1))
+	}
+	return key, price, ""
+}
+
+// medianDeviation returns the median absolute deviation of values from
+// their median m.
+func medianDeviation(values []float64, m float64) float64 {
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - m)
+	}
+	return median(deviations)
+}
+
+// median returns the middle of values, which it doesn't modify.
+func median(values []float64) float64 {
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// missingTaxDetector finds receipts whose total is more than their
+// subtotal and fees with no tax read to explain the difference.
+type missingTaxDetector struct{}
+
+func (missingTaxDetector) Name() string { return "missing_tax" }
+
+func (missingTaxDetector) Detect(r *Receipt, _ DetectContext) []Anomaly {
+	if r.Tax != nil || r.Refund || r.Subtotal == nil || r.Total == nil {
+		return nil
+	}
+	if taxes, _ := TaxTotals(r.TaxLines); taxes != 0 {
+		return nil
+	}
+	fees := 0.0
+	for _, fee := range r.Fees {
+		fees += fee.Amount
+	}
+	gap := *r.Total - *r.Subtotal - fees
+	if gap <= 0.005 {
+		return nil
+	}
+	severity := SeverityWarning
+	if r.Unknown["tax"] == ReasonUnreadable {
+		// The parser already knows the tax is there but illegible
+		severity = SeverityInfo
+	}
+	return []Anomaly{{
+		Severity: severity,
+		Field:    "tax",
+		Message:  fmt.Sprintf("total is %.2f more than the subtotal and fees but no tax was read", gap),
+	}}
+}
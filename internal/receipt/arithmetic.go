@@ -0,0 +1,170 @@
+package receipt
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// lineTolerance is how far qty × unit price may be from a line total, for
+// rounding of fractional quantities like 1.37 lb.
+const lineTolerance = 0.011
+
+// digitConfusions are the digits OCR commonly reads each digit as.
+var digitConfusions = map[byte]string{
+	'0': "689",
+	'1': "47",
+	'2': "7",
+	'3': "58",
+	'4': "19",
+	'5': "36",
+	'6': "058",
+	'7': "12",
+	'8': "0369",
+	'9': "048",
+}
+
+// lineFix is a single misread digit that, once corrected, makes a line's
+// qty × unit price match its total.
+type lineFix struct {
+	field    string // "qty", "unit_price", or the line total's field
+	from, to float64
+	digit    [2]byte // The digit as read and as corrected
+}
+
+// checkLine compares qty × unit price with a line total. It returns ok when
+// they agree or can't be compared, and otherwise the one digit correction
+// that makes them agree, if exactly one does. totalField names the line
+// total in messages.
+func checkLine(qty, unit, total float64, totalField string) (fix *lineFix, ok bool) {
+	if qty <= 0 || unit == 0 || total == 0 || lineAgrees(qty, unit, total) {
+		return nil, true
+	}
+
+	var fixes []lineFix
+	for _, alt := range digitAlternatives(total, 2) {
+		if lineAgrees(qty, unit, alt.value) {
+			fixes = append(fixes, lineFix{field: totalField, from: total, to: alt.value, digit: alt.digit})
+		}
+	}
+	for _, alt := range digitAlternatives(unit, 2) {
+		if lineAgrees(qty, alt.value, total) {
+			fixes = append(fixes, lineFix{field: "unit_price", from: unit, to: alt.value, digit: alt.digit})
+		}
+	}
+	if qty == math.Trunc(qty) {
+		for _, alt := range digitAlternatives(qty, 0) {
+			if alt.value > 0 && lineAgrees(alt.value, unit, total) {
+				fixes = append(fixes, lineFix{field: "qty", from: qty, to: alt.value, digit: alt.digit})
+			}
+		}
+	}
+	if len(fixes) != 1 {
+		// None, or several that work equally well: leave it to a person
+		return nil, false
+	}
+	return &fixes[0], false
+}
+
+// lineAgrees reports whether qty × unit comes to total.
+func lineAgrees(qty, unit, total float64) bool {
+	return math.Abs(qty*unit-total) <= lineTolerance
+}
+
+// digitAlternative is a value with one digit replaced.
+type digitAlternative struct {
+	value float64
+	digit [2]byte
+}
+
+// digitAlternatives returns v, printed with decimals places, with each
+// single digit replaced by each digit OCR confuses it with.
+func digitAlternatives(v float64, decimals int) []digitAlternative {
+	s := strconv.FormatFloat(math.Abs(v), 'f', decimals, 64)
+	var alts []digitAlternative
+	for i := 0; i < len(s); i++ {
+		for _, c := range []byte(digitConfusions[s[i]]) {
+			alt, err := strconv.ParseFloat(s[:i]+string(c)+s[i+1:], 64)
+			if err != nil {
+				continue
+			}
+			if v < 0 {
+				alt = -alt
+			}
+			alts = append(alts, digitAlternative{value: alt, digit: [2]byte{s[i], c}})
+		}
+	}
+	return alts
+}
+
+// lineAnomaly describes a checked line for the anomalies list: the
+// correction made, or the mismatch that couldn't be corrected. qty and
+// unit are the line's values after any correction.
+func lineAnomaly(label string, qty, unit, total float64, fix *lineFix) string {
+	if fix == nil {
+		return fmt.Sprintf("%s: %s × %.2f is %.2f but the line total is %.2f",
+			label, formatQty(qty), unit, qty*unit, total)
+	}
+	from, to := fmt.Sprintf("%.2f", fix.from), fmt.Sprintf("%.2f", fix.to)
+	if fix.field == "qty" {
+		from, to = formatQty(fix.from), formatQty(fix.to)
+	}
+	return fmt.Sprintf("%s: corrected %s from %s to %s to match %s × %.2f (OCR likely misread %c as %c)",
+		label, fix.field, from, to, formatQty(qty), unit, fix.digit[1], fix.digit[0])
+}
+
+// formatQty prints a quantity without trailing zeros.
+func formatQty(qty float64) string {
+	return strconv.FormatFloat(qty, 'f', -1, 64)
+}
+
+// CheckLineItems checks each item that has a unit price against its line
+// total, correcting a single misread digit when exactly one correction
+// makes qty × unit price match, and notes every correction and remaining
+// mismatch in Anomalies.
+func (r *Receipt) CheckLineItems() {
+	for i := range r.Items {
+		item := &r.Items[i]
+		if item.UnitPrice == 0 {
+			continue
+		}
+		fix, ok := checkLine(float64(item.Qty), item.UnitPrice, item.Price, "price")
+		if ok {
+			continue
+		}
+		if fix != nil {
+			switch fix.field {
+			case "qty":
+				item.Qty = int(fix.to)
+			case "unit_price":
+				item.UnitPrice = fix.to
+			default:
+				item.Price = fix.to
+			}
+		}
+		r.Anomalies = append(r.Anomalies, lineAnomaly(fmt.Sprintf("items[%d] (%s)", i, item.Name), float64(item.Qty), item.UnitPrice, item.Price, fix))
+	}
+}
+
+// CheckLineItems checks each line's qty × unit price against its amount as
+// Receipt.CheckLineItems does.
+func (inv *Invoice) CheckLineItems() {
+	for i := range inv.Items {
+		item := &inv.Items[i]
+		fix, ok := checkLine(item.Qty, item.UnitPrice, item.Amount, "amount")
+		if ok {
+			continue
+		}
+		if fix != nil {
+			switch fix.field {
+			case "qty":
+				item.Qty = fix.to
+			case "unit_price":
+				item.UnitPrice = fix.to
+			default:
+				item.Amount = fix.to
+			}
+		}
+		inv.Anomalies = append(inv.Anomalies, lineAnomaly(fmt.Sprintf("items[%d] (%s)", i, item.Description), item.Qty, item.UnitPrice, item.Amount, fix))
+	}
+}
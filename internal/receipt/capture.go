@@ -0,0 +1,225 @@
+package receipt
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// CaptureLine is an OCR line as capture coaching sees it: its position,
+// how sure OCR was of it, and the block it is in.
+type CaptureLine struct {
+	LayoutLine
+	Confidence float64 // 0 to 100
+	Block      BlockLabel
+}
+
+// CaptureHint is advice for taking a better photo of a document, from
+// where its text was read and how well.
+type CaptureHint struct {
+	Code    string  `json:"code"`             // e.g. "cut_off_bottom" or "glare"
+	Region  string  `json:"region"`           // "top", "bottom", "left", "page", or a block such as "totals"
+	Top     float64 `json:"top,omitempty"`    // Where on the photo the region starts, as a fraction of its height
+	Bottom  float64 `json:"bottom,omitempty"` // And where it ends; both zero when unknown
+	Message string  `json:"message"`
+}
+
+const (
+	// captureEdge is how close to the edge of the photo, as a fraction of
+	// it, text must come to look cut off there.
+	captureEdge = 0.02
+
+	// captureLowConfidence is the line confidence below which a line
+	// counts as hard to read, as for low-confidence lines.
+	captureLowConfidence = 80.0
+
+	// blurryConfidence is the mean confidence below which a document whose
+	// hard-to-read lines are spread all over it is likely out of focus.
+	blurryConfidence = 85.0
+
+	// captureGap is the smallest stretch of the photo, as a fraction of its
+	// height, with no text between lines that suggests text went unread.
+	captureGap = 0.2
+
+	// smallTextHeight is the median line height, as a fraction of the
+	// photo, below which the document is too far away.
+	smallTextHeight = 0.006
+)
+
+// CaptureHints returns what could be done better when photographing the
+// document lines were read from: text cut off at an edge, a region hard
+// to read, likely from glare or a shadow, a stretch where nothing was
+// read, blur, or a document too far away. vendorRead and totalRead say
+// whether parsing found the vendor and total, whose absence suggests the
+// top or bottom is missing. Lines must be sorted top to bottom; hints
+// about position need lines whose position is known.
+func CaptureHints(lines []CaptureLine, vendorRead, totalRead bool) []CaptureHint {
+	var hints []CaptureHint
+	var placed []CaptureLine
+	for _, line := range lines {
+		if line.Height > 0 {
+			placed = append(placed, line)
+		}
+	}
+
+	if len(placed) > 0 {
+		first, last := placed[0], placed[len(placed)-1]
+		if !vendorRead && first.Top <= captureEdge {
+			hints = append(hints, CaptureHint{
+				Code:    "cut_off_top",
+				Region:  "top",
+				Bottom:  round2(first.Top + first.Height),
+				Message: "the top of the receipt looks cut off: text starts at the edge of the photo and no store name was read",
+			})
+		}
+		if bottom := last.Top + last.Height; !totalRead && bottom >= 1-captureEdge {
+			hints = append(hints, CaptureHint{
+				Code:    "cut_off_bottom",
+				Region:  "bottom",
+				Top:     round2(last.Top),
+				Bottom:  1,
+				Message: "the bottom of the receipt looks cut off: text runs to the edge of the photo and no total was read",
+			})
+		}
+		atLeft := 0
+		for _, line := range placed {
+			if line.Left <= captureEdge/2 {
+				atLeft++
+			}
+		}
+		if atLeft >= 3 && float64(atLeft) >= 0.3*float64(len(placed)) {
+			hints = append(hints, CaptureHint{
+				Code:    "cut_off_left",
+				Region:  "left",
+				Message: fmt.Sprintf("the left side of the receipt looks cut off: %d of %d lines start at the edge of the photo", atLeft, len(placed)),
+			})
+		}
+		hints = append(hints, gapHints(placed)...)
+
+		heights := make([]float64, len(placed))
+		for i, line := range placed {
+			heights[i] = line.Height
+		}
+		if median(heights) < smallTextHeight {
+			hints = append(hints, CaptureHint{
+				Code:    "too_far",
+				Region:  "page",
+				Message: "the receipt is small in the photo; move closer so it fills the frame",
+			})
+		}
+	}
+
+	return append(hints, confidenceHints(lines)...)
+}
+
+// gapHints finds stretches between lines where nothing was read, which a
+// fold, glare, or a shadow may be hiding.
+func gapHints(lines []CaptureLine) []CaptureHint {
+	var hints []CaptureHint
+	for i := 1; i < len(lines); i++ {
+		above, below := lines[i-1], lines[i]
+		end := above.Top + above.Height
+		if below.Top-end < captureGap {
+			continue
+		}
+		region := string(below.Block)
+		if region == "" {
+			region = "page"
+		}
+		hints = append(hints, CaptureHint{
+			Code:   "gap",
+			Region: region,
+			Top:    round2(end),
+			Bottom: round2(below.Top),
+			Message: fmt.Sprintf("nothing was read from %.0f%% to %.0f%% of the way down the photo; a fold, glare, or a shadow may be hiding text",
+				end*100, below.Top*100),
+		})
+	}
+	return hints
+}
+
+// confidenceHints finds where text was hard to read: all over, as when the
+// photo is blurry, or in one block, as when glare or a shadow covers it.
+func confidenceHints(lines []CaptureLine) []CaptureHint {
+	if len(lines) == 0 {
+		return nil
+	}
+	total, low := 0.0, 0
+	var blocks []BlockLabel
+	for _, line := range lines {
+		total += line.Confidence
+		if line.Confidence < captureLowConfidence {
+			low++
+			if !slices.Contains(blocks, line.Block) {
+				blocks = append(blocks, line.Block)
+			}
+		}
+	}
+	if low == 0 {
+		return nil
+	}
+	// Hard lines all in one block are something over that block instead
+	spread := len(blocks) >= 3 || len(blocks) == 2 && float64(low) >= 0.4*float64(len(lines))
+	if mean := total / float64(len(lines)); mean < blurryConfidence && spread {
+		return []CaptureHint{{
+			Code:    "blurry",
+			Region:  "page",
+			Message: fmt.Sprintf("text is hard to read all over (%d of %d lines); hold the camera steady and let it focus", low, len(lines)),
+		}}
+	}
+
+	var hints []CaptureHint
+	for _, block := range blocks {
+		if block == "" {
+			continue
+		}
+		n, hard := 0, 0
+		top, bottom := math.Inf(1), math.Inf(-1)
+		for _, line := range lines {
+			if line.Block != block {
+				continue
+			}
+			n++
+			if line.Confidence < captureLowConfidence {
+				hard++
+				if line.Height > 0 {
+					top, bottom = math.Min(top, line.Top), math.Max(bottom, line.Top+line.Height)
+				}
+			}
+		}
+		if hard < 2 || float64(hard) < 0.5*float64(n) {
+			continue
+		}
+		hint := CaptureHint{
+			Code:   "glare",
+			Region: string(block),
+			Message: fmt.Sprintf("the %s are hard to read (%d of %d lines); glare or a shadow may be covering them, so tilt the receipt or move the light",
+				blockNoun(block), hard, n),
+		}
+		if !math.IsInf(top, 1) {
+			hint.Top, hint.Bottom = round2(top), round2(bottom)
+		}
+		hints = append(hints, hint)
+	}
+	return hints
+}
+
+// blockNoun names a block's contents in a sentence.
+func blockNoun(block BlockLabel) string {
+	switch block {
+	case BlockHeader:
+		return "store name and date"
+	case BlockItems:
+		return "items"
+	case BlockTotals:
+		return "totals"
+	case BlockPayment:
+		return "payment details"
+	}
+	return "lines at the bottom"
+}
+
+// round2 rounds a fraction of the photo to two places for responses.
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
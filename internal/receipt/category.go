@@ -0,0 +1,199 @@
+// Package receipt provides vendor category inference for receipt data.
+package receipt
+
+import (
+	"regexp"
+	"strings"
+)
+
+// VendorCategory is the kind of business a vendor is. Codes are ISO 18245
+// merchant category codes, as card networks use, so they stay stable and
+// line up with card statements.
+type VendorCategory struct {
+	Code  string `json:"code"`  // e.g. "5411"
+	Name  string `json:"name"`  // Short key, e.g. "grocery"
+	Label string `json:"label"` // e.g. "Grocery stores and supermarkets"
+}
+
+// VendorCategories lists the categories vendors are coded with.
+var VendorCategories = []VendorCategory{
+	{"5411", "grocery", "Grocery stores and supermarkets"},
+	{"5300", "wholesale_club", "Wholesale clubs"},
+	{"5310", "discount_store", "Discount and general merchandise stores"},
+	{"5499", "convenience", "Convenience and specialty food stores"},
+	{"5812", "restaurant", "Restaurants"},
+	{"5813", "bar", "Bars and taverns"},
+	{"5814", "fast_food", "Fast food and coffee shops"},
+	{"5541", "fuel", "Gas stations"},
+	{"5912", "pharmacy", "Pharmacies and drug stores"},
+	{"5251", "hardware", "Hardware and home improvement stores"},
+	{"5732", "electronics", "Electronics stores"},
+	{"5651", "clothing", "Clothing stores"},
+	{"5943", "office_supplies", "Office and school supply stores"},
+	{"5995", "pet", "Pet stores"},
+	{"5533", "auto", "Auto parts and service"},
+	{"7011", "lodging", "Hotels and lodging"},
+	{"7523", "parking", "Parking"},
+	{"4121", "transport", "Taxis, rideshare, and transit"},
+	{"8099", "medical", "Medical and health services"},
+}
+
+// LookupVendorCategory returns the category with the given code or name.
+func LookupVendorCategory(codeOrName string) (VendorCategory, bool) {
+	key := strings.ToLower(strings.TrimSpace(codeOrName))
+	for _, c := range VendorCategories {
+		if c.Code == key || c.Name == key {
+			return c, true
+		}
+	}
+	return VendorCategory{}, false
+}
+
+// chainCategories codes the chains ResolveChain knows.
+var chainCategories = map[string]string{
+	"Walmart":                "5310",
+	"Target":                 "5310",
+	"Meijer":                 "5310",
+	"Sam's Club":             "5300",
+	"Costco":                 "5300",
+	"Kroger":                 "5411",
+	"Ralphs":                 "5411",
+	"Fred Meyer":             "5411",
+	"Safeway":                "5411",
+	"Vons":                   "5411",
+	"Albertsons":             "5411",
+	"Whole Foods Market":     "5411",
+	"Trader Joe's":           "5411",
+	"Aldi":                   "5411",
+	"Publix":                 "5411",
+	"H-E-B":                  "5411",
+	"Wegmans":                "5411",
+	"Sprouts Farmers Market": "5411",
+	"CVS":                    "5912",
+	"Walgreens":              "5912",
+	"Rite Aid":               "5912",
+	"The Home Depot":         "5251",
+	"Lowe's":                 "5251",
+	"Starbucks":              "5814",
+	"McDonald's":             "5814",
+	"Chevron":                "5541",
+	"Shell":                  "5541",
+	"7-Eleven":               "5499",
+}
+
+// vendorNamePatterns map words in a vendor's name, and contentPatterns
+// words in what the receipt says, to a category. The first match wins, so
+// narrower patterns come first.
+var (
+	vendorNamePatterns = []categoryPattern{
+		{regexp.MustCompile(`(?i)\b(pharmacy|drug ?store|drugs|apothecary)\b`), "5912"},
+		{regexp.MustCompile(`(?i)\b(hardware|home improvement|lumber|ace hdwe)\b`), "5251"},
+		{regexp.MustCompile(`(?i)\b(gas|fuel|petrol|petroleum|exxon|mobil|arco|valero|sunoco|texaco|marathon|bp)\b`), "5541"},
+		{regexp.MustCompile(`(?i)\b(pub|tavern|bar|brewery|brewing|taproom|saloon|lounge)\b`), "5813"},
+		{regexp.MustCompile(`(?i)\b(coffee|espresso|cafe|café|donuts?|bagels?|burgers?|taco|subway|wendy'?s|chick-fil-a|taco bell|dunkin|chipotle)\b`), "5814"},
+		{regexp.MustCompile(`(?i)\b(restaurant|grill|bistro|diner|kitchen|trattoria|pizzeria|pizza|steakhouse|sushi|ramen|eatery|bbq|cantina)\b`), "5812"},
+		{regexp.MustCompile(`(?i)\b(grocery|groceries|supermarket|market|foods|farmers)\b`), "5411"},
+		{regexp.MustCompile(`(?i)\b(convenience|mini ?mart|food ?mart|quick ?stop|circle k|wawa|sheetz)\b`), "5499"},
+		{regexp.MustCompile(`(?i)\b(electronics|best buy|apple store|micro center)\b`), "5732"},
+		{regexp.MustCompile(`(?i)\b(office ?depot|officemax|staples)\b`), "5943"},
+		{regexp.MustCompile(`(?i)\b(petco|petsmart|pet supply|pet supplies)\b`), "5995"},
+		{regexp.MustCompile(`(?i)\b(auto ?zone|o'?reilly|napa|jiffy lube|auto parts|tire|tires|car wash)\b`), "5533"},
+		{regexp.MustCompile(`(?i)\b(hotel|inn|motel|suites|resort|lodge|marriott|hilton|hyatt)\b`), "7011"},
+		{regexp.MustCompile(`(?i)\b(parking|garage|park ?mobile)\b`), "7523"},
+		{regexp.MustCompile(`(?i)\b(taxi|cab|uber|lyft|transit|metro)\b`), "4121"},
+		{regexp.MustCompile(`(?i)\b(clinic|medical|dental|dentist|urgent care|hospital|optometr\w*|vision)\b`), "8099"},
+		{regexp.MustCompile(`(?i)\b(apparel|clothing|boutique|outfitters|old navy|gap|h&m|uniqlo)\b`), "5651"},
+	}
+
+	contentPatterns = []categoryPattern{
+		// Not "gallon" alone, which grocery receipts print for milk
+		{regexp.MustCompile(`(?i)\b(gallons|unleaded|diesel|pump ?#?\s*\d+|price/gal)\b`), "5541"},
+		{regexp.MustCompile(`(?i)\b(rx ?#?|prescription|pharmacist|copay)\b`), "5912"},
+		{regexp.MustCompile(`(?i)\b(check in|check out|room ?#?|nights?|folio)\b`), "7011"},
+		{regexp.MustCompile(`(?i)\b(table ?#?|guests?|server|gratuity|tip)\b`), "5812"},
+		{regexp.MustCompile(`(?i)\b(produce|dairy|deli|bakery|meat|frozen|grocery)\b`), "5411"},
+	}
+)
+
+type categoryPattern struct {
+	re   *regexp.Regexp
+	code string
+}
+
+// groceryItemCategories are item categories typical of grocery trips.
+var groceryItemCategories = map[string]bool{
+	"produce": true, "dairy": true, "meat": true, "seafood": true, "bakery": true,
+	"frozen": true, "pantry": true, "deli": true, "groceries": true, "grocery": true,
+}
+
+// InferVendorCategory works out what kind of business a vendor is: from its
+// chain, then words in its name, then the receipt's lines (OCR text or item
+// names), then its item categories. It reports false when nothing points
+// to a category.
+func InferVendorCategory(vendor, chain string, lines, itemCategories []string) (VendorCategory, bool) {
+	if code, ok := chainCategories[chain]; ok {
+		return LookupVendorCategory(code)
+	}
+	// A merged vendor's canonical name counts as one of its names
+	name := vendor + " " + chain
+	for _, p := range vendorNamePatterns {
+		if p.re.MatchString(name) {
+			return LookupVendorCategory(p.code)
+		}
+	}
+	text := strings.Join(lines, "\n")
+	for _, p := range contentPatterns {
+		if p.re.MatchString(text) {
+			return LookupVendorCategory(p.code)
+		}
+	}
+	grocery := 0
+	for _, c := range itemCategories {
+		if groceryItemCategories[strings.ToLower(strings.TrimSpace(c))] {
+			grocery++
+		}
+	}
+	if grocery >= 2 {
+		return LookupVendorCategory("5411")
+	}
+	return VendorCategory{}, false
+}
+
+// CategorizeData infers the vendor category of stored output, a receipt or
+// an invoice by docType, with InferVendorCategory. chain is the vendor's
+// resolved chain, if any. Without OCR lines, as for records analyzed
+// before categories were inferred, the item names stand in for them.
+func CategorizeData(docType DocumentType, data map[string]any, chain string, lines []string) (VendorCategory, bool) {
+	var names []string
+	nameKey := "name"
+	if docType == DocumentTypeInvoice {
+		party, _ := data["vendor"].(map[string]any)
+		name, _ := party["name"].(string)
+		names = append(names, name)
+		nameKey = "description"
+	} else {
+		vendor, _ := data["vendor"].(string)
+		vendorFull, _ := data["vendor_full"].(string)
+		names = append(names, vendor, vendorFull)
+	}
+
+	if len(lines) == 0 {
+		items, _ := data["items"].([]any)
+		for _, it := range items {
+			if m, ok := it.(map[string]any); ok {
+				if name, ok := m[nameKey].(string); ok {
+					lines = append(lines, name)
+				}
+			}
+		}
+	}
+	var itemCategories []string
+	if cats, ok := data["item_categories"].([]any); ok {
+		for _, c := range cats {
+			if name, ok := c.(string); ok {
+				itemCategories = append(itemCategories, name)
+			}
+		}
+	}
+	return InferVendorCategory(strings.Join(names, " "), chain, lines, itemCategories)
+}
@@ -0,0 +1,112 @@
+// Package receipt provides vendor chain resolution for receipt data.
+package receipt
+
+import (
+	"regexp"
+	"strings"
+)
+
+// chainAliases maps lowercase name fragments, as they appear on receipts,
+// to a canonical chain name. Longer fragments are checked first.
+var chainAliases = []struct {
+	fragment string
+	chain    string
+}{
+	{"wm supercenter", "Walmart"},
+	{"wal-mart", "Walmart"},
+	{"walmart", "Walmart"},
+	{"sam's club", "Sam's Club"},
+	{"sams club", "Sam's Club"},
+	{"costco", "Costco"},
+	{"target", "Target"},
+	{"kroger", "Kroger"},
+	{"ralphs", "Ralphs"},
+	{"fred meyer", "Fred Meyer"},
+	{"safeway", "Safeway"},
+	{"vons", "Vons"},
+	{"albertsons", "Albertsons"},
+	{"whole foods", "Whole Foods Market"},
+	{"trader joe", "Trader Joe's"},
+	{"aldi", "Aldi"},
+	{"publix", "Publix"},
+	{"h-e-b", "H-E-B"},
+	{"heb ", "H-E-B"},
+	{"meijer", "Meijer"},
+	{"wegmans", "Wegmans"},
+	{"sprouts", "Sprouts Farmers Market"},
+	{"cvs", "CVS"},
+	{"walgreens", "Walgreens"},
+	{"rite aid", "Rite Aid"},
+	{"home depot", "The Home Depot"},
+	{"lowe's", "Lowe's"},
+	{"lowes", "Lowe's"},
+	{"starbucks", "Starbucks"},
+	{"mcdonald", "McDonald's"},
+	{"chevron", "Chevron"},
+	{"shell", "Shell"},
+	{"7-eleven", "7-Eleven"},
+}
+
+// storeNumberRegex matches store identifiers like "#2389", "Store 123", "ST# 0456".
+var storeNumberRegex = regexp.MustCompile(`(?i)(?:store|str|st)?\s*(?:#|no\.?|num(?:ber)?)\s*(\d{2,6})\b|\bstore\s+(\d{2,6})\b`)
+
+// ResolveChain identifies the chain behind a vendor string such as
+// "WAL-MART #2389" and extracts the store number if present. The chain is
+// empty when the vendor isn't a known chain.
+func ResolveChain(vendor string) (chain, storeNumber string) {
+	lower := strings.ToLower(vendor) + " "
+	for _, alias := range chainAliases {
+		if strings.Contains(lower, alias.fragment) {
+			chain = alias.chain
+			break
+		}
+	}
+
+	if m := storeNumberRegex.FindStringSubmatch(vendor); m != nil {
+		storeNumber = m[1]
+		if storeNumber == "" {
+			storeNumber = m[2]
+		}
+	}
+
+	return chain, storeNumber
+}
+
+// storeLabelRegex matches a store number printed on its own in a receipt
+// header, like "Store #0456" or "STR 123". Unlike storeNumberRegex it needs
+// the word store, since a header's other numbers, such as register and
+// transaction numbers, are also printed after "#".
+var storeLabelRegex = regexp.MustCompile(`(?i)\b(?:store|str)\s*(?:#|no\.?|num(?:ber)?)?\s*(\d{2,6})\b|\bst\s*(?:#|no\.?)\s*(\d{2,6})\b`)
+
+// storePhoneRegex matches a phone number like (614) 555-1234 or
+// 1-800-555-0199 that isn't the tail of a longer number.
+var storePhoneRegex = regexp.MustCompile(`(?:^|[^\d])((?:\+?1[\s.-]?)?\(?\d{3}\)?[\s.-]?\d{3}[\s.-]?\d{4})\b`)
+
+// ParseStoreHeader finds the store number and phone number printed in a
+// receipt's header lines. Either is empty when it isn't printed.
+func ParseStoreHeader(lines []string) (storeNumber, phone string) {
+	for _, line := range lines {
+		if m := storeLabelRegex.FindStringSubmatch(line); m != nil && storeNumber == "" {
+			storeNumber = m[1] + m[2]
+		}
+		if m := storePhoneRegex.FindStringSubmatch(line); m != nil && phone == "" {
+			phone = m[1]
+		}
+	}
+	return storeNumber, phone
+}
+
+// PhoneDigits returns the digits of a phone number, without a leading
+// US country code, so differently printed numbers compare equal.
+func PhoneDigits(phone string) string {
+	var digits []byte
+	for _, r := range phone {
+		if '0' <= r && r <= '9' {
+			digits = append(digits, byte(r))
+		}
+	}
+	if len(digits) == 11 && digits[0] == '1' {
+		digits = digits[1:]
+	}
+	return string(digits)
+}
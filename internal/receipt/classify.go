@@ -0,0 +1,131 @@
+// Package receipt provides document classification for receipt data.
+package receipt
+
+import (
+	"regexp"
+	"strings"
+)
+
+// DocumentType identifies the kind of document being analyzed.
+type DocumentType string
+
+const (
+	// DocumentTypeAuto asks the classifier to pick the document type.
+	DocumentTypeAuto DocumentType = "auto"
+	// DocumentTypeReceipt is a point-of-sale receipt.
+	DocumentTypeReceipt DocumentType = "receipt"
+	// DocumentTypeInvoice is a vendor invoice or bill.
+	DocumentTypeInvoice DocumentType = "invoice"
+)
+
+// invoiceKeywords are phrases that rarely appear on point-of-sale receipts.
+var invoiceKeywords = []string{
+	"invoice",
+	"bill to",
+	"ship to",
+	"sold to",
+	"remit to",
+	"purchase order",
+	"p.o.",
+	"po number",
+	"po #",
+	"due date",
+	"payment terms",
+	"terms:",
+	"net 30",
+	"net 15",
+	"net 60",
+	"amount due",
+	"balance due",
+	"part no",
+	"part #",
+	"sku",
+}
+
+// receiptKeywords are phrases typical of point-of-sale receipts.
+var receiptKeywords = []string{
+	"cashier",
+	"change due",
+	"change",
+	"cash",
+	"visa",
+	"mastercard",
+	"debit",
+	"approved",
+	"auth code",
+	"thank you",
+	"server",
+	"table",
+	"guests",
+	"tip",
+	"register",
+	"trans",
+	"transaction",
+}
+
+// Keywords match as whole words, so "tip" doesn't count in "multiple" or
+// "change" in "exchange".
+var (
+	invoiceKeywordRegexes = keywordRegexes(invoiceKeywords)
+	receiptKeywordRegexes = keywordRegexes(receiptKeywords)
+)
+
+// keywordRegexes compiles keywords to match case-insensitively, with word
+// boundaries at the ends that are letters or digits. "terms:" needs none
+// after its colon.
+func keywordRegexes(keywords []string) []*regexp.Regexp {
+	res := make([]*regexp.Regexp, len(keywords))
+	for i, kw := range keywords {
+		pattern := regexp.QuoteMeta(kw)
+		if isWordByte(kw[0]) {
+			pattern = `\b` + pattern
+		}
+		if isWordByte(kw[len(kw)-1]) {
+			pattern += `\b`
+		}
+		res[i] = regexp.MustCompile(`(?i)` + pattern)
+	}
+	return res
+}
+
+// isWordByte reports whether \b treats c as part of a word.
+func isWordByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// ParseDocumentType converts a request value into a DocumentType.
+// Empty or unknown values map to DocumentTypeAuto.
+func ParseDocumentType(s string) DocumentType {
+	switch DocumentType(strings.ToLower(strings.TrimSpace(s))) {
+	case DocumentTypeReceipt:
+		return DocumentTypeReceipt
+	case DocumentTypeInvoice:
+		return DocumentTypeInvoice
+	default:
+		return DocumentTypeAuto
+	}
+}
+
+// ClassifyDocument guesses the document type from OCR text lines.
+// It scores invoice-specific and receipt-specific keywords and only
+// reports an invoice when invoice evidence clearly outweighs receipt evidence.
+func ClassifyDocument(lines []string) DocumentType {
+	invoiceScore, receiptScore := 0, 0
+	for _, line := range lines {
+		for _, re := range invoiceKeywordRegexes {
+			if re.MatchString(line) {
+				invoiceScore++
+			}
+		}
+		for _, re := range receiptKeywordRegexes {
+			if re.MatchString(line) {
+				receiptScore++
+			}
+		}
+	}
+
+	if invoiceScore >= 2 && invoiceScore > receiptScore {
+		return DocumentTypeInvoice
+	}
+	return DocumentTypeReceipt
+}
@@ -0,0 +1,46 @@
+package receipt
+
+import "testing"
+
+func TestClassifyDocument(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  DocumentType
+	}{
+		{
+			name:  "invoice",
+			lines: []string{"INVOICE #1042", "Bill To: Acme Corp", "Payment Terms: Net 30", "Amount Due $1,200.00"},
+			want:  DocumentTypeInvoice,
+		},
+		{
+			name:  "receipt",
+			lines: []string{"KROGER", "Cashier: Dana", "VISA 1234", "Change Due 0.00", "Thank you"},
+			want:  DocumentTypeReceipt,
+		},
+		{
+			// "tip", "trans", and "change" inside other words aren't receipt evidence
+			name:  "invoice with receipt words inside other words",
+			lines: []string{"Invoice 2291", "Bill To: Multiple Locations LLC", "Wire transfer accepted", "Exchange rate applied", "Due Date 11/30/2026"},
+			want:  DocumentTypeInvoice,
+		},
+		{
+			// "sku" and "terms" inside other words aren't invoice evidence
+			name:  "receipt with invoice words inside other words",
+			lines: []string{"SKUNK RIVER CAFE", "Determs Lane", "Subtotal 12.50"},
+			want:  DocumentTypeReceipt,
+		},
+		{
+			name:  "punctuated keywords",
+			lines: []string{"P.O. 88123", "Terms: 2/10 Net 30"},
+			want:  DocumentTypeInvoice,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyDocument(tt.lines); got != tt.want {
+				t.Errorf("ClassifyDocument(%q) = %q, want %q", tt.lines, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package receipt
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Content types DetectContent reports for uploads that aren't documents.
+const (
+	// ContentPhoto is a picture with little or no text: a selfie, a pet,
+	// a landscape.
+	ContentPhoto = "photo"
+	// ContentChat is a screenshot of a messaging app.
+	ContentChat = "chat_screenshot"
+	// ContentOtherText is text with nothing of a receipt or invoice about
+	// it, such as an article or a letter.
+	ContentOtherText = "other_text"
+)
+
+var (
+	// documentPattern matches words on nearly every receipt and invoice
+	// that totalsPattern doesn't.
+	documentPattern = keywordPattern("receipt", "invoice", "qty", "price", "amount", "paid", "payment")
+
+	// chatTimePattern matches a message timestamp standing alone on a line.
+	chatTimePattern = regexp.MustCompile(`(?i)^\d{1,2}:\d{2}(\s?[ap]\.?m\.?)?$`)
+)
+
+// chatMarkers are status lines and labels messaging apps print around
+// messages.
+var chatMarkers = []string{
+	"delivered", "read", "seen", "today", "yesterday", "imessage",
+	"text message", "typing", "online", "last seen", "reply", "message",
+	"sent", "edited", "you:",
+}
+
+// Content is DetectContent's verdict on an upload.
+type Content struct {
+	Type   string // "" when the upload may be a receipt or invoice
+	Reason string // Why it isn't one
+}
+
+// IsDocument reports whether the upload may be a receipt or invoice.
+func (c Content) IsDocument() bool {
+	return c.Type == ""
+}
+
+// DetectContent tells uploads that clearly aren't receipts or invoices
+// from those that may be, by their OCR text. fromImage is false for text
+// given as such, which can't be a photo. It only rules out an upload
+// with no money amount and no money keyword on it, so a faded or
+// crumpled receipt with one legible total still goes through.
+func DetectContent(lines []string, fromImage bool) Content {
+	amounts, keywords, chat := 0, 0, 0
+	for _, line := range lines {
+		lower := strings.ToLower(strings.TrimSpace(line))
+		if amountPattern.MatchString(lower) {
+			amounts++
+		}
+		if totalsPattern.MatchString(lower) || documentPattern.MatchString(lower) {
+			keywords++
+		}
+		if chatTimePattern.MatchString(lower) {
+			chat++
+			continue
+		}
+		for _, marker := range chatMarkers {
+			if lower == marker || strings.HasPrefix(lower, marker+" ") {
+				chat++
+				break
+			}
+		}
+	}
+
+	switch {
+	case amounts > 0 || keywords > 0:
+		return Content{}
+	case fromImage && len(lines) < 4:
+		return Content{Type: ContentPhoto, Reason: fmt.Sprintf("the image has almost no text (%d lines) and no prices", len(lines))}
+	case chat >= 3:
+		return Content{Type: ContentChat, Reason: fmt.Sprintf("the text has %d message timestamps or chat labels and no prices or totals", chat)}
+	case len(lines) >= 4:
+		return Content{Type: ContentOtherText, Reason: fmt.Sprintf("none of its %d lines has a price, total, or tax", len(lines))}
+	}
+	// A few lines of text with nothing to go on either way
+	return Content{}
+}
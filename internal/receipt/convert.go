@@ -0,0 +1,63 @@
+// Package receipt provides conversions between the typed schema and the
+// generic maps that stored records, API responses, and tools carry.
+package receipt
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Map returns the receipt as stored in records and returned by the API.
+func (r *Receipt) Map() map[string]any {
+	return toMap(r)
+}
+
+// Map returns the invoice as stored in records and returned by the API.
+func (inv *Invoice) Map() map[string]any {
+	return toMap(inv)
+}
+
+// toMap converts a schema type to a generic map through its JSON encoding,
+// so the map holds exactly what clients see.
+func toMap(v any) map[string]any {
+	var m map[string]any
+	data, _ := json.Marshal(v)
+	json.Unmarshal(data, &m)
+	return m
+}
+
+// ReceiptFromMap reads generic output as a receipt. Fields the schema
+// doesn't have are ignored; fields of the wrong type are an error.
+func ReceiptFromMap(data map[string]any) (*Receipt, error) {
+	r := NewReceipt()
+	if err := fromMap(data, r); err != nil {
+		return nil, fmt.Errorf("data doesn't match the receipt schema: %w", err)
+	}
+	return r, nil
+}
+
+// InvoiceFromMap reads generic output as an invoice, like ReceiptFromMap.
+func InvoiceFromMap(data map[string]any) (*Invoice, error) {
+	inv := NewInvoice()
+	if err := fromMap(data, inv); err != nil {
+		return nil, fmt.Errorf("data doesn't match the invoice schema: %w", err)
+	}
+	return inv, nil
+}
+
+func fromMap(data map[string]any, v any) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// DetectDocumentType tells parsed receipts from invoices by their shape: an
+// invoice's vendor is an object with a name, a receipt's is a string.
+func DetectDocumentType(data map[string]any) DocumentType {
+	if _, ok := data["vendor"].(map[string]any); ok {
+		return DocumentTypeInvoice
+	}
+	return DocumentTypeReceipt
+}
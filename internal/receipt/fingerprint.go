@@ -0,0 +1,123 @@
+// Package receipt provides receipt fingerprinting for duplicate detection.
+package receipt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// fingerprintVersion is mixed into every fingerprint; bump it when the
+// normalization below changes so old and new fingerprints never collide.
+const fingerprintVersion = "fp1"
+
+var (
+	// cardNetworkRegex matches lines that introduce a card payment.
+	cardNetworkRegex = regexp.MustCompile(`(?i)\b(visa|master\s?card|mc|amex|american express|discover|debit|credit|card\s*(?:#|no|num)|acct)\b`)
+	// maskedCardRegex matches a masked card number, e.g. "************1234", "XXXX-1234"
+	maskedCardRegex = regexp.MustCompile(`(?:^|[\s:#])[*xX•]{4,}[\s-]*(\d{4})\b`)
+	// bareLast4Regex matches a line holding only the last four digits
+	bareLast4Regex = regexp.MustCompile(`^\s*(\d{4})\s*$`)
+	// notCardRegex matches masked numbers that belong to something other than the card
+	notCardRegex = regexp.MustCompile(`(?i)\b(mid|tid|merchant|terminal|auth|ref|rewards|member|loyalty|club|phone)\b`)
+	// checkNumberRegex matches a check, ticket, or transaction number
+	checkNumberRegex = regexp.MustCompile(`(?i)\b(?:check|chk|ticket|trans(?:action)?|trx|tran)\s*(?:#|no\.?|num(?:ber)?)?\s*[:#]?\s*(\d{3,})\b`)
+)
+
+// ExtractCardLast4 returns the last four digits of the payment card, or ""
+// if none is printed. It looks at the line naming the card network and the
+// two lines after it, skipping merchant, terminal, and loyalty numbers.
+func ExtractCardLast4(lines []string) string {
+	for i, line := range lines {
+		if !cardNetworkRegex.MatchString(line) {
+			continue
+		}
+		for j := i; j < len(lines) && j <= i+2; j++ {
+			// Skip numbers on, or just below, a merchant/terminal label
+			if notCardRegex.MatchString(lines[j]) || (j > i && notCardRegex.MatchString(lines[j-1])) {
+				continue
+			}
+			if m := maskedCardRegex.FindStringSubmatch(lines[j]); m != nil {
+				return m[1]
+			}
+			if j == i+1 {
+				if m := bareLast4Regex.FindStringSubmatch(lines[j]); m != nil {
+					return m[1]
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// ExtractCheckNumber returns the check, ticket, or transaction number
+// printed on a receipt, or "" if none is found.
+func ExtractCheckNumber(lines []string) string {
+	for _, line := range lines {
+		if m := checkNumberRegex.FindStringSubmatch(line); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// FingerprintParts are the fields that identify one purchase regardless of
+// which photo or scan of the receipt was submitted.
+type FingerprintParts struct {
+	Vendor      string // Chain name if resolved, otherwise the printed vendor
+	DateTime    string // Local "2006-01-02T15:04", or just the date
+	Total       float64
+	CardLast4   string
+	CheckNumber string // Check, transaction, or invoice number
+}
+
+// Key returns the normalized parts joined for comparison. Two receipts with
+// the same Key but different totals look like an edited copy.
+func (p FingerprintParts) Key(withTotal bool) string {
+	fields := []string{
+		normalizeVendor(p.Vendor),
+		p.DateTime,
+		p.CardLast4,
+		strings.ToLower(strings.TrimSpace(p.CheckNumber)),
+	}
+	if withTotal {
+		fields = append(fields, fmt.Sprintf("%.2f", p.Total))
+	}
+	return strings.Join(fields, "|")
+}
+
+// Fingerprint returns a stable hash of the parts, or "" when the vendor,
+// date, or total is missing and a fingerprint would match unrelated receipts.
+func Fingerprint(p FingerprintParts) string {
+	if normalizeVendor(p.Vendor) == "" || p.DateTime == "" || p.Total == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(fingerprintVersion + "|" + p.Key(true)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// SameVendor reports whether two vendor names are the same once case,
+// spacing, and punctuation are ignored.
+func SameVendor(a, b string) bool {
+	key := normalizeVendor(a)
+	return key != "" && key == normalizeVendor(b)
+}
+
+// VendorKey returns the form of a vendor name SameVendor compares, for
+// grouping by vendor.
+func VendorKey(vendor string) string {
+	return normalizeVendor(vendor)
+}
+
+// normalizeVendor lowercases a vendor name and drops punctuation and spacing.
+func normalizeVendor(vendor string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(vendor) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
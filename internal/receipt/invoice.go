@@ -0,0 +1,55 @@
+// Package receipt defines the structured output schema for parsed receipts.
+package receipt
+
+// Party represents a vendor or buyer block on an invoice.
+type Party struct {
+	Name    string `json:"name" jsonschema:"Company or person name"`
+	Address string `json:"address,omitempty" jsonschema:"Address as printed"`
+	Phone   string `json:"phone,omitempty" jsonschema:"Phone number"`
+	Email   string `json:"email,omitempty" jsonschema:"Email address"`
+	TaxID   string `json:"tax_id,omitempty" jsonschema:"Tax or VAT ID"`
+}
+
+// InvoiceItem represents a single line item on an invoice.
+type InvoiceItem struct {
+	SKU         string  `json:"sku,omitempty" jsonschema:"SKU or part number"`
+	Description string  `json:"description" jsonschema:"Line item description"`
+	Qty         float64 `json:"qty" jsonschema:"Quantity"`
+	UnitPrice   float64 `json:"unit_price" jsonschema:"Price per unit"`
+	Amount      float64 `json:"amount" jsonschema:"Line total; negative for discounts and credits"`
+
+	ItemEnrichment
+}
+
+// Invoice represents the normalized, structured output from invoice analysis.
+type Invoice struct {
+	Vendor          Party         `json:"vendor" jsonschema:"Issuing company"`
+	Buyer           Party         `json:"buyer" jsonschema:"Billed company or person"`
+	InvoiceNumber   string        `json:"invoice_number" jsonschema:"Invoice number"`
+	PONumber        string        `json:"po_number,omitempty" jsonschema:"Purchase order number"`
+	InvoiceDate     string        `json:"invoice_date" jsonschema:"Invoice date, YYYY-MM-DD"`
+	DueDate         string        `json:"due_date,omitempty" jsonschema:"Due date, YYYY-MM-DD"`
+	PaymentTerms    string        `json:"payment_terms,omitempty" jsonschema:"Payment terms, e.g. Net 30"`
+	Currency        string        `json:"currency,omitempty" jsonschema:"ISO 4217 currency code"`
+	Items           []InvoiceItem `json:"items" jsonschema:"Line items"`
+	Subtotal        *float64      `json:"subtotal" jsonschema:"Subtotal before tax and shipping; null when unknown, with the reason in unknown"`
+	Tax             *float64      `json:"tax" jsonschema:"Total tax; null when unknown, with the reason in unknown"`
+	TaxLines        []TaxLine     `json:"tax_lines,omitempty" jsonschema:"Each tax printed on its own line, such as VAT by rate"`
+	Shipping        float64       `json:"shipping,omitempty" jsonschema:"Shipping and handling"`
+	Total           *float64      `json:"total" jsonschema:"Invoice total; null when unknown, with the reason in unknown"`
+	AmountDue       float64       `json:"amount_due,omitempty" jsonschema:"Balance due, when different from the total"`
+	Handwritten     bool          `json:"handwritten" jsonschema:"Whether OCR found handwriting"`
+	ConfidenceNotes string        `json:"confidence_notes" jsonschema:"Notes on how confident the extraction is"`
+	Anomalies       []string      `json:"anomalies" jsonschema:"Problems noticed, such as totals that don't add up"`
+
+	// Unknown maps each null amount to why it has none, as for Receipt.
+	Unknown map[string]string `json:"unknown,omitempty" jsonschema:"Why each null amount is null: absent (not printed) or unreadable (printed but illegible)"`
+}
+
+// NewInvoice creates a new Invoice with initialized slices.
+func NewInvoice() *Invoice {
+	return &Invoice{
+		Items:     make([]InvoiceItem, 0),
+		Anomalies: make([]string, 0),
+	}
+}
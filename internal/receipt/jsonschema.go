@@ -0,0 +1,55 @@
+// Package receipt publishes JSON Schemas for the output formats.
+package receipt
+
+import (
+	"sync"
+
+	"github.com/google/jsonschema-go/jsonschema"
+)
+
+var (
+	receiptSchema = sync.OnceValues(func() (*jsonschema.Schema, error) {
+		return outputSchema[Receipt]("Receipt", "A receipt parsed by myprice, as returned in llm_output and stored in receipt records.")
+	})
+	invoiceSchema = sync.OnceValues(func() (*jsonschema.Schema, error) {
+		return outputSchema[Invoice]("Invoice", "An invoice parsed by myprice, as returned in llm_output and stored in receipt records.")
+	})
+)
+
+// Schema returns the JSON Schema of parsed output for a document type;
+// DocumentTypeAuto gets the receipt schema. Callers must not modify it.
+func Schema(docType DocumentType) (*jsonschema.Schema, error) {
+	if docType == DocumentTypeInvoice {
+		return invoiceSchema()
+	}
+	return receiptSchema()
+}
+
+// outputSchema generates the schema of T from its fields and their
+// jsonschema descriptions. Fields without omitempty are required. Objects
+// allow properties the schema doesn't list, so consumers validating against
+// it keep working when fields are added.
+func outputSchema[T any](title, description string) (*jsonschema.Schema, error) {
+	s, err := jsonschema.For[T](nil)
+	if err != nil {
+		return nil, err
+	}
+	allowAdditional(s)
+	s.Schema = "https://json-schema.org/draft/2020-12/schema"
+	s.Title = title
+	s.Description = description
+	return s, nil
+}
+
+// allowAdditional drops the additionalProperties: false that For puts on
+// every struct. The output types only nest through properties and items.
+func allowAdditional(s *jsonschema.Schema) {
+	if s == nil {
+		return
+	}
+	s.AdditionalProperties = nil
+	for _, p := range s.Properties {
+		allowAdditional(p)
+	}
+	allowAdditional(s.Items)
+}
@@ -0,0 +1,245 @@
+// Package receipt provides layout analysis for receipt data, grouping OCR
+// lines into the blocks a receipt is printed in.
+package receipt
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// BlockLabel names a block of a receipt.
+type BlockLabel string
+
+// Blocks in the order they are printed.
+const (
+	BlockHeader  BlockLabel = "header"  // Vendor, address, date, register
+	BlockItems   BlockLabel = "items"   // The item table
+	BlockTotals  BlockLabel = "totals"  // Subtotal, tax, total
+	BlockPayment BlockLabel = "payment" // Tender, card, change, approval
+	BlockFooter  BlockLabel = "footer"  // Thanks, return policy, surveys
+)
+
+// Block is a run of consecutive lines with one label. Start and End index
+// the lines, End exclusive.
+type Block struct {
+	Label BlockLabel `json:"label"`
+	Start int        `json:"start"`
+	End   int        `json:"end"`
+}
+
+// LayoutLine is an OCR line's text and position, as fractions of the page.
+// A zero Height means the position is unknown. Page numbers the pages of a
+// multi-page document, and is 0 for a single page.
+type LayoutLine struct {
+	Text   string
+	Top    float64
+	Left   float64
+	Height float64
+	Page   int
+}
+
+var (
+	// amountPattern matches money amounts, which have cents, unlike phone
+	// numbers, dates, and store numbers.
+	amountPattern = regexp.MustCompile(`\d[.,]\d{2}\b`)
+
+	// maskedCardPattern matches a masked card number like "**** 1234".
+	maskedCardPattern = regexp.MustCompile(`[*xX#]{4,}\s*\d{4}\b`)
+
+	totalsPattern  = keywordPattern("subtotal", "sub total", "sub-total", "total", "tax", "hst", "gst", "pst", "vat", "balance", "amount due", "savings", "you saved", "discount", "tip", "gratuity")
+	paymentPattern = keywordPattern("visa", "mastercard", "master card", "amex", "american express", "discover", "debit", "credit", "cash", "change", "tender", "tendered", "card", "auth", "authorization", "approval", "approved", "chip", "contactless", "ebt", "gift card", "acct", "account", "ref", "aid", "entry method", "payment", "paid")
+	footerPattern  = keywordPattern("thank you", "thanks", "return", "returns", "refund", "exchange", "policy", "survey", "feedback", "visit us", "www", "http", "come again", "items sold", "customer copy", "merchant copy", "please", "keep this receipt")
+)
+
+// keywordPattern matches any of words as whole words, case-insensitively.
+func keywordPattern(words ...string) *regexp.Regexp {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = regexp.QuoteMeta(w)
+	}
+	return regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+}
+
+// row is one printed row: lines side by side, such as an item name and its
+// price, which OCR often reads as separate lines.
+type row struct {
+	lines []int
+	text  string
+}
+
+// SegmentLayout labels each line with the block it belongs to. Lines must be
+// sorted top to bottom, as load_textract returns them. Lines on the same
+// printed row are labeled together. The blocks follow the order receipts
+// print them in, and any block may be empty.
+func SegmentLayout(lines []LayoutLine) []BlockLabel {
+	labels := make([]BlockLabel, len(lines))
+	if len(lines) == 0 {
+		return labels
+	}
+	rows := groupRows(lines)
+
+	// Keyword evidence for each row; a row with an amount but no keyword
+	// is an item
+	const (
+		kindNone = iota
+		kindTotals
+		kindPayment
+		kindFooter
+	)
+	kinds := make([]int, len(rows))
+	amounts := make([]bool, len(rows))
+	for i, r := range rows {
+		amounts[i] = amountPattern.MatchString(r.text)
+		switch {
+		case maskedCardPattern.MatchString(r.text), paymentPattern.MatchString(r.text):
+			kinds[i] = kindPayment
+		case totalsPattern.MatchString(r.text):
+			kinds[i] = kindTotals
+		case footerPattern.MatchString(r.text):
+			kinds[i] = kindFooter
+		}
+	}
+	// Totals lines name their amounts, so a "total" that is also paid by
+	// card ("TOTAL VISA 23.10") is still a total
+	for i, r := range rows {
+		if kinds[i] == kindPayment && amounts[i] && totalsPattern.MatchString(r.text) && !maskedCardPattern.MatchString(r.text) {
+			kinds[i] = kindTotals
+		}
+	}
+
+	first := func(from, kind int) int {
+		for i := from; i < len(rows); i++ {
+			if kinds[i] == kind {
+				return i
+			}
+		}
+		return -1
+	}
+
+	// The item table starts at the first amount without a keyword, or
+	// where the money does when there are no items
+	itemsStart := -1
+	for i := range rows {
+		if amounts[i] && kinds[i] == kindNone {
+			itemsStart = i
+			break
+		}
+	}
+	if itemsStart < 0 {
+		itemsStart = len(rows)
+		for i := range rows {
+			if kinds[i] == kindTotals || kinds[i] == kindPayment {
+				itemsStart = i
+				break
+			}
+		}
+	}
+
+	totalsStart := first(itemsStart, kindTotals)
+	paymentFrom := itemsStart
+	if totalsStart >= 0 {
+		paymentFrom = totalsStart
+	}
+	paymentStart := first(paymentFrom, kindPayment)
+
+	// The footer starts at its first keyword past the last amount, since
+	// card slips often print "CUSTOMER COPY" above the amount charged.
+	// Without one it starts after the last line about money.
+	footerFrom := paymentFrom
+	if paymentStart >= 0 {
+		footerFrom = paymentStart
+	}
+	lastAmount, lastMoney := -1, -1
+	for i := range rows {
+		if amounts[i] {
+			lastAmount = i
+		}
+		if amounts[i] || kinds[i] == kindTotals || kinds[i] == kindPayment {
+			lastMoney = i
+		}
+	}
+	footerStart := first(max(footerFrom, lastAmount+1), kindFooter)
+	if footerStart < 0 {
+		footerStart = max(footerFrom, lastMoney+1)
+	}
+	if paymentStart < 0 {
+		paymentStart = footerStart
+	}
+	if totalsStart < 0 {
+		totalsStart = paymentStart
+	}
+
+	for i, r := range rows {
+		label := BlockHeader
+		switch {
+		case i >= footerStart:
+			label = BlockFooter
+		case i >= paymentStart:
+			label = BlockPayment
+		case i >= totalsStart:
+			label = BlockTotals
+		case i >= itemsStart:
+			label = BlockItems
+		}
+		for _, l := range r.lines {
+			labels[l] = label
+		}
+	}
+	return labels
+}
+
+// RowTexts returns the text of each printed row of lines, the lines side by
+// side on it joined left to right. Lines must be sorted as for
+// SegmentLayout.
+func RowTexts(lines []LayoutLine) []string {
+	rows := groupRows(lines)
+	texts := make([]string, len(rows))
+	for i, r := range rows {
+		texts[i] = r.text
+	}
+	return texts
+}
+
+// groupRows groups lines printed side by side: a line joins the row above
+// when it starts within half that row's height on the same page. Lines
+// without a position are rows of their own.
+func groupRows(lines []LayoutLine) []row {
+	var rows []row
+	rowTop, rowHeight, rowPage := 0.0, 0.0, 0
+	for i, line := range lines {
+		if len(rows) > 0 && line.Height > 0 && rowHeight > 0 && line.Page == rowPage && line.Top-rowTop < rowHeight/2 {
+			last := &rows[len(rows)-1]
+			last.lines = append(last.lines, i)
+			continue
+		}
+		rows = append(rows, row{lines: []int{i}})
+		rowTop, rowHeight, rowPage = line.Top, line.Height, line.Page
+	}
+
+	for i := range rows {
+		r := &rows[i]
+		sort.SliceStable(r.lines, func(a, b int) bool { return lines[r.lines[a]].Left < lines[r.lines[b]].Left })
+		texts := make([]string, len(r.lines))
+		for j, l := range r.lines {
+			texts[j] = lines[l].Text
+		}
+		r.text = strings.Join(texts, " ")
+		// Keep the lines in their original order for labeling
+		sort.Ints(r.lines)
+	}
+	return rows
+}
+
+// GroupBlocks turns per-line labels into blocks of consecutive lines.
+func GroupBlocks(labels []BlockLabel) []Block {
+	var blocks []Block
+	for i, label := range labels {
+		if n := len(blocks); n > 0 && blocks[n-1].Label == label {
+			blocks[n-1].End = i + 1
+			continue
+		}
+		blocks = append(blocks, Block{Label: label, Start: i, End: i + 1})
+	}
+	return blocks
+}
@@ -0,0 +1,311 @@
+package receipt
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// FieldLines are the OCR lines a field of a parsed document was read from.
+type FieldLines struct {
+	Field string `json:"field"` // Path in the parsed data, e.g. "total" or "items[2].price"
+	Value any    `json:"value"`
+	Lines []int  `json:"lines"` // Indexes of the lines; empty when no line shows the value
+}
+
+// unlocatedFields are fields not printed as such: judgments, summaries,
+// lookups, and amounts worked out from others.
+var unlocatedFields = map[string]bool{
+	"confidence_notes": true, "anomalies": true, "handwritten": true, "unknown": true,
+	"item_categories": true, "cart_description": true, "product": true,
+	"normalized_price": true, "normalized_unit": true, "refund": true, "included": true,
+	"currency": true, "type": true, "out_of_pocket": true, "qty": true,
+}
+
+// fieldBlocks are the blocks each top-level field is printed in. When a
+// value is found there, matches elsewhere are left out, so a total isn't
+// also located on the card slip's amount charged.
+var fieldBlocks = map[string][]BlockLabel{
+	"vendor": {BlockHeader}, "vendor_full": {BlockHeader}, "address": {BlockHeader},
+	"store_number": {BlockHeader}, "phone": {BlockHeader},
+	"items": {BlockItems}, "fees": {BlockItems, BlockTotals},
+	"subtotal": {BlockTotals}, "tax": {BlockTotals}, "tax_lines": {BlockTotals},
+	"total": {BlockTotals}, "shipping": {BlockTotals}, "amount_due": {BlockTotals},
+	"tenders": {BlockPayment},
+}
+
+// nonAlphanumeric matches what locating text ignores.
+var nonAlphanumeric = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+// LocateFields finds the lines of an OCR document each field of data, a
+// parsed receipt or invoice, was read from, so a review UI can show what
+// OCR saw beside what was extracted. labels are the lines' blocks, as
+// SegmentLayout gives them, or nil. Fields are listed in path order, with
+// array elements in their own order.
+//
+// Amounts are found as printed with two decimals, dates and times by
+// parsing each line, and text where a line holds it, or holds a part of
+// it, such as one line of an address, ignoring case and punctuation.
+// Among several lines, those in the block the field is printed in are
+// preferred, and an item's amounts are looked for on the rows its name is
+// on first. Judgments and lookups the pipeline adds, such as
+// confidence_notes and product, aren't listed.
+func LocateFields(data map[string]any, lines []LayoutLine, labels []BlockLabel) []FieldLines {
+	l := locator{lines: lines, labels: labels, texts: make([]string, len(lines))}
+	for i, line := range lines {
+		l.texts[i] = normalizeLocated(line.Text)
+	}
+	var fields []FieldLines
+	for _, key := range sortedKeys(data) {
+		fields = l.locate(fields, key, key, data[key], fieldBlocks[key], nil)
+	}
+	return fields
+}
+
+// locator holds an OCR document's lines while fields are located in it.
+type locator struct {
+	lines  []LayoutLine
+	labels []BlockLabel
+	texts  []string // Normalized
+}
+
+// locate appends the fields of value, at path under key, to fields.
+// near are lines to prefer: the rows an entry's name is on.
+func (l locator) locate(fields []FieldLines, path, key string, value any, blocks []BlockLabel, near []int) []FieldLines {
+	if unlocatedFields[key] {
+		return fields
+	}
+	switch v := value.(type) {
+	case map[string]any:
+		fields, _ = l.locateEntry(fields, path, v, blocks, -1)
+	case []any:
+		// Entries are printed in order, so of several lines with the same
+		// name, such as "SPECIAL", each entry takes the next
+		after := -1
+		for i, e := range v {
+			entryPath := fmt.Sprintf("%s[%d]", path, i)
+			if entry, ok := e.(map[string]any); ok {
+				fields, after = l.locateEntry(fields, entryPath, entry, blocks, after)
+				continue
+			}
+			fields = l.locate(fields, entryPath, key, e, blocks, nil)
+		}
+	case float64:
+		fields = append(fields, FieldLines{Field: path, Value: v, Lines: l.prefer(l.amountLines(v), blocks, near)})
+	case string:
+		if strings.TrimSpace(v) == "" {
+			return fields
+		}
+		var found []int
+		switch {
+		case key == "date" || strings.HasSuffix(key, "_date"):
+			found = l.dateLines(v)
+		case key == "time":
+			found = l.timeLines(v)
+		default:
+			found = l.textLines(v)
+		}
+		fields = append(fields, FieldLines{Field: path, Value: v, Lines: l.prefer(found, blocks, nil)})
+	}
+	return fields
+}
+
+// locateEntry appends the fields of entry, an item, fee, tax line, or
+// party at path, to fields. Its name is located first, on the lines after
+// line after when it is on any, and its other fields are looked for on the
+// rows the name is on first. It returns the first line of the name, or
+// after when the name is on none.
+func (l locator) locateEntry(fields []FieldLines, path string, entry map[string]any, blocks []BlockLabel, after int) ([]FieldLines, int) {
+	keys := sortedKeys(entry)
+	sort.SliceStable(keys, func(i, j int) bool { return isNameKey(keys[i]) && !isNameKey(keys[j]) })
+	var rows []int
+	for _, k := range keys {
+		name, ok := entry[k].(string)
+		if !isNameKey(k) || !ok || strings.TrimSpace(name) == "" {
+			fields = l.locate(fields, path+"."+k, k, entry[k], blocks, rows)
+			continue
+		}
+		found := l.prefer(l.textLines(name), blocks, nil)
+		if i := slices.IndexFunc(found, func(line int) bool { return line > after }); i >= 0 {
+			found = found[i:]
+		}
+		// Of the same name printed apart, the first; a name wrapped onto
+		// the next line is kept whole
+		for i := 1; i < len(found); i++ {
+			if found[i] != found[i-1]+1 {
+				found = found[:i]
+				break
+			}
+		}
+		fields = append(fields, FieldLines{Field: path + "." + k, Value: name, Lines: found})
+		if len(found) > 0 {
+			rows, after = found, max(after, found[0])
+		}
+	}
+	return fields, after
+}
+
+// amountLines returns the lines printing amount, ignoring its sign, which
+// receipts often print after it or leave to a label.
+func (l locator) amountLines(amount float64) []int {
+	printed := fmt.Sprintf("%.2f", math.Abs(amount))
+	patterns := []*regexp.Regexp{regexp.MustCompile(`(?:^|[^\d.,])` + regexp.QuoteMeta(printed) + `(?:$|\D)`)}
+	// Decimal commas, and whole numbers such as points
+	comma := strings.Replace(printed, ".", ",", 1)
+	patterns = append(patterns, regexp.MustCompile(`(?:^|[^\d.,])`+regexp.QuoteMeta(comma)+`(?:$|\D)`))
+	if amount == math.Trunc(amount) && math.Abs(amount) >= 10 {
+		patterns = append(patterns, regexp.MustCompile(fmt.Sprintf(`(?:^|[^\d.,])%d(?:$|[^\d.,])`, int64(math.Abs(amount)))))
+	}
+
+	var found []int
+	for i, line := range l.lines {
+		for _, p := range patterns {
+			if p.MatchString(line.Text) {
+				found = append(found, i)
+				break
+			}
+		}
+	}
+	return found
+}
+
+// dateLines returns the lines printing the date value, YYYY-MM-DD.
+func (l locator) dateLines(value string) []int {
+	y, m, d, ok := ParseReceiptDate(value)
+	if !ok {
+		return nil
+	}
+	var found []int
+	for i, line := range l.lines {
+		if ly, lm, ld, ok := ParseReceiptDate(line.Text); ok && ly == y && lm == m && ld == d {
+			found = append(found, i)
+		}
+	}
+	return found
+}
+
+// timeLines returns the lines printing the clock time value.
+func (l locator) timeLines(value string) []int {
+	h, m, _, ok := ParseReceiptTime(value)
+	if !ok {
+		return l.textLines(value)
+	}
+	var found []int
+	for i, line := range l.lines {
+		if lh, lm, _, ok := ParseReceiptTime(line.Text); ok && lh == h && lm == m {
+			found = append(found, i)
+		}
+	}
+	return found
+}
+
+// textLines returns the lines holding value, or else those holding a part
+// of it of four characters or more, as the lines of an address do.
+func (l locator) textLines(value string) []int {
+	want := normalizeLocated(value)
+	if want == "" {
+		return nil
+	}
+	var whole, parts []int
+	for i, text := range l.texts {
+		switch {
+		case text == "":
+		case containsWords(text, want):
+			whole = append(whole, i)
+		case len(text) >= 4 && containsWords(want, text):
+			parts = append(parts, i)
+		}
+	}
+	if len(whole) > 0 {
+		return whole
+	}
+	return parts
+}
+
+// prefer narrows found to the lines on the rows of near, or else to those
+// in blocks, when any are.
+func (l locator) prefer(found []int, blocks []BlockLabel, near []int) []int {
+	if found == nil {
+		return []int{}
+	}
+	if len(near) > 0 {
+		var onRow []int
+		for _, i := range found {
+			for _, n := range near {
+				if l.sameRow(i, n) {
+					onRow = append(onRow, i)
+					break
+				}
+			}
+		}
+		if len(onRow) > 0 {
+			return onRow
+		}
+	}
+	if len(blocks) > 0 && len(l.labels) == len(l.lines) {
+		var inBlock []int
+		for _, i := range found {
+			for _, b := range blocks {
+				if l.labels[i] == b {
+					inBlock = append(inBlock, i)
+					break
+				}
+			}
+		}
+		if len(inBlock) > 0 {
+			return inBlock
+		}
+	}
+	return found
+}
+
+// sameRow reports whether lines a and b are printed side by side: on the
+// same page, with tops within half a line's height.
+func (l locator) sameRow(a, b int) bool {
+	if a == b {
+		return true
+	}
+	la, lb := l.lines[a], l.lines[b]
+	height := max(la.Height, lb.Height)
+	return height > 0 && la.Page == lb.Page && math.Abs(la.Top-lb.Top) < height/2
+}
+
+// isNameKey reports whether key names an item, fee, or tax.
+func isNameKey(key string) bool {
+	return key == "name" || key == "description"
+}
+
+// normalizeLocated lowercases text and reduces it to words separated by
+// single spaces.
+func normalizeLocated(text string) string {
+	return strings.TrimSpace(nonAlphanumeric.ReplaceAllString(strings.ToLower(text), " "))
+}
+
+// containsWords reports whether normalized text holds want, starting and
+// ending at word boundaries.
+func containsWords(text, want string) bool {
+	for from := 0; ; {
+		i := strings.Index(text[from:], want)
+		if i < 0 {
+			return false
+		}
+		start, end := from+i, from+i+len(want)
+		if (start == 0 || text[start-1] == ' ') && (end == len(text) || text[end] == ' ') {
+			return true
+		}
+		from = start + 1
+	}
+}
+
+// sortedKeys returns m's keys in order.
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,88 @@
+// Package receipt provides loyalty program extraction for receipt data.
+package receipt
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Loyalty captures rewards/membership details printed on a receipt.
+type Loyalty struct {
+	Program        string  `json:"program,omitempty" jsonschema:"Program name, e.g. Ralphs Rewards"`
+	MemberNumber   string  `json:"member_number,omitempty" jsonschema:"Member number as printed, usually masked"`
+	PointsEarned   float64 `json:"points_earned,omitempty" jsonschema:"Points earned on this purchase"`
+	PointsRedeemed float64 `json:"points_redeemed,omitempty" jsonschema:"Points redeemed on this purchase"`
+	PointsBalance  float64 `json:"points_balance,omitempty" jsonschema:"Points balance after the purchase"`
+	MemberSavings  float64 `json:"member_savings,omitempty" jsonschema:"Savings from member prices"`
+}
+
+var (
+	// memberNumberRegex matches "Rewards # ****1234", "Member ID: 123456789", "Card XXXXX6789"
+	memberNumberRegex = regexp.MustCompile(`(?i)(?:rewards|member(?:ship)?|loyalty|club|plus|card)\s*(?:card\s*)?(?:#|no\.?|id|number)?\s*:?\s*([*xX\d][*xX\d\s-]{3,})`)
+
+	// programRegex matches program names like "Ralphs Rewards" or "CVS ExtraCare"
+	programRegex = regexp.MustCompile(`(?i)\b([a-z][a-z'&]+\s+(?:rewards|extracare|perks|plus|club))\b`)
+
+	// amountRegex matches the last number on a line, e.g. "12.34" or "1,250"
+	amountRegex = regexp.MustCompile(`(\d[\d,]*\.?\d*)\s*-?\s*$`)
+)
+
+// ExtractLoyalty scans OCR lines for loyalty program details. It returns
+// nil if none are found.
+func ExtractLoyalty(lines []string) *Loyalty {
+	loyalty := &Loyalty{}
+	found := false
+
+	for _, line := range lines {
+		lower := strings.ToLower(line)
+
+		switch {
+		case strings.Contains(lower, "points earned"), strings.Contains(lower, "pts earned"), strings.Contains(lower, "earned today"):
+			loyalty.PointsEarned = lastAmount(line)
+			found = true
+		case strings.Contains(lower, "points redeemed"), strings.Contains(lower, "pts redeemed"), strings.Contains(lower, "points used"):
+			loyalty.PointsRedeemed = lastAmount(line)
+			found = true
+		case strings.Contains(lower, "points balance"), strings.Contains(lower, "total points"), strings.Contains(lower, "available points"):
+			loyalty.PointsBalance = lastAmount(line)
+			found = true
+		case strings.Contains(lower, "annual"), strings.Contains(lower, "year to date"), strings.Contains(lower, "ytd"):
+			// Cumulative savings summaries aren't about this purchase
+		case strings.Contains(lower, "total savings"), strings.Contains(lower, "member savings"), strings.Contains(lower, "card savings"),
+			strings.Contains(lower, "you saved"), strings.Contains(lower, "your savings"):
+			// Savings are often repeated (and sometimes truncated); keep the largest
+			if amount := lastAmount(line); amount > loyalty.MemberSavings {
+				loyalty.MemberSavings = amount
+				found = true
+			}
+		}
+
+		if loyalty.Program == "" {
+			if m := programRegex.FindStringSubmatch(line); m != nil {
+				loyalty.Program = m[1]
+				found = true
+			}
+		}
+
+		if loyalty.MemberNumber == "" {
+			if m := memberNumberRegex.FindStringSubmatch(line); m != nil && strings.ContainsAny(m[1], "0123456789") {
+				loyalty.MemberNumber = strings.TrimSpace(m[1])
+				found = true
+			}
+		}
+	}
+
+	if !found {
+		return nil
+	}
+	return loyalty
+}
+
+// lastAmount parses the trailing number on a line, or 0 if there is none.
+func lastAmount(line string) float64 {
+	m := amountRegex.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return 0
+	}
+	return NormalizePrice(m[1])
+}
@@ -22,10 +22,11 @@ var (
 )
 
 // NormalizePrice cleans a price string and parses it as a float64.
+// Non-ASCII digits and OCR lookalikes are read as NormalizeNumerals does.
 // Returns 0.0 if the string cannot be parsed.
 func NormalizePrice(s string) float64 {
 	// Remove dollar sign, commas, and whitespace
-	cleaned := strings.TrimSpace(s)
+	cleaned, _ := NormalizeNumerals(strings.TrimSpace(s))
 	cleaned = strings.TrimPrefix(cleaned, "$")
 	cleaned = strings.ReplaceAll(cleaned, ",", "")
 
@@ -36,9 +37,10 @@ func NormalizePrice(s string) float64 {
 	return val
 }
 
-// IsPrice checks if a string looks like a price value.
+// IsPrice checks if a string looks like a price value, once its numerals
+// are normalized.
 func IsPrice(s string) bool {
-	cleaned := strings.TrimSpace(s)
+	cleaned, _ := NormalizeNumerals(strings.TrimSpace(s))
 	return pricePattern.MatchString(cleaned)
 }
 
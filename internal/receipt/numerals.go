@@ -0,0 +1,183 @@
+package receipt
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// numeralPunctuation are the non-ASCII separators and currency signs
+// printed among non-ASCII digits.
+var numeralPunctuation = map[rune]rune{
+	'．': '.', // Full-width full stop
+	'，': ',', // Full-width comma
+	'＄': '$', // Full-width dollar sign
+	'٫': '.', // Arabic decimal separator
+	'٬': ',', // Arabic thousands separator
+}
+
+// digitLookalikes are the letters and marks OCR reads in place of digits.
+var digitLookalikes = map[rune]rune{
+	'O': '0', 'o': '0',
+	'l': '1', 'I': '1', '|': '1',
+	'S': '5',
+	'B': '8',
+}
+
+// lookalikePricePattern matches a price, digits and lookalikes mixed, with
+// two decimal places: "1O.99" or "$l2.5O". Only such tokens have their
+// lookalikes corrected, since in "B12" or "SOLD" they are letters.
+var lookalikePricePattern = regexp.MustCompile(`^[-(]?\$?[0-9OolI|SB,]*[0-9OolI|SB][.,][0-9OolI|SB]{2}[-)]?$`)
+
+// NumeralFix is a token of OCR text whose numerals were rewritten as ASCII
+// digits so prices can be parsed.
+type NumeralFix struct {
+	From    string    // The token as read
+	To      string    // The token as corrected
+	Scripts []string  // Which non-ASCII digits it had, e.g. "Arabic-Indic"
+	Misread [][2]rune // Lookalikes corrected: the character read and the digit
+}
+
+// String describes the fix for the anomalies list.
+func (f NumeralFix) String() string {
+	var reasons []string
+	if len(f.Scripts) > 0 {
+		reasons = append(reasons, strings.Join(f.Scripts, " and ")+" digits")
+	}
+	for _, m := range f.Misread {
+		reasons = append(reasons, fmt.Sprintf("OCR likely misread %c as %c", m[1], m[0]))
+	}
+	return fmt.Sprintf("numerals: read %q as %q (%s)", f.From, f.To, strings.Join(reasons, "; "))
+}
+
+// NormalizeNumerals rewrites the numbers in s with ASCII digits: digits of
+// other scripts, such as full-width and Arabic-Indic ones, with their
+// separators, and in a token shaped like a price, letters OCR mistakes for
+// digits, such as O for 0 and l for 1. It returns the rewritten text and
+// a fix for each token it changed.
+func NormalizeNumerals(s string) (string, []NumeralFix) {
+	if !strings.ContainsFunc(s, needsNumeralCheck) {
+		return s, nil
+	}
+
+	var fixes []NumeralFix
+	var sb strings.Builder
+	for _, token := range strings.SplitAfter(s, " ") {
+		word := strings.TrimRight(token, " ")
+		fixed, fix, ok := normalizeToken(word)
+		if ok {
+			fixes = append(fixes, fix)
+		}
+		sb.WriteString(fixed)
+		sb.WriteString(token[len(word):])
+	}
+	return sb.String(), fixes
+}
+
+// needsNumeralCheck reports whether r may be part of a number
+// NormalizeNumerals rewrites.
+func needsNumeralCheck(r rune) bool {
+	if r > unicode.MaxASCII {
+		return unicode.IsDigit(r) || numeralPunctuation[r] != 0
+	}
+	return digitLookalikes[r] != 0
+}
+
+// normalizeToken rewrites one whitespace-free token, reporting whether it
+// changed.
+func normalizeToken(token string) (string, NumeralFix, bool) {
+	fix := NumeralFix{From: token}
+	var sb strings.Builder
+	hasDigit := false
+	for _, r := range token {
+		switch {
+		case r > unicode.MaxASCII && unicode.IsDigit(r):
+			if script := digitScript(r); !slices.Contains(fix.Scripts, script) {
+				fix.Scripts = append(fix.Scripts, script)
+			}
+			r = '0' + digitValue(r)
+			hasDigit = true
+		case numeralPunctuation[r] != 0:
+			r = numeralPunctuation[r]
+		case r >= '0' && r <= '9':
+			hasDigit = true
+		}
+		sb.WriteRune(r)
+	}
+	fixed := sb.String()
+
+	if hasDigit && lookalikePricePattern.MatchString(fixed) {
+		var corrected strings.Builder
+		for _, r := range fixed {
+			if d := digitLookalikes[r]; d != 0 {
+				if !slices.Contains(fix.Misread, [2]rune{d, r}) {
+					fix.Misread = append(fix.Misread, [2]rune{d, r})
+				}
+				r = d
+			}
+			corrected.WriteRune(r)
+		}
+		fixed = corrected.String()
+	}
+
+	if fixed == token {
+		return token, NumeralFix{}, false
+	}
+	fix.To = fixed
+	return fixed, fix, true
+}
+
+// digitValue returns the value of a Unicode decimal digit. Each script's
+// digits run from zero to nine in consecutive code points, and some
+// scripts' runs follow one another.
+func digitValue(r rune) rune {
+	start := r
+	for unicode.IsDigit(start - 1) {
+		start--
+	}
+	return (r - start) % 10
+}
+
+// digitScript names the digits r is one of.
+func digitScript(r rune) string {
+	switch {
+	case r >= '０' && r <= '９':
+		return "full-width"
+	case r >= '٠' && r <= '٩':
+		return "Arabic-Indic"
+	case r >= '۰' && r <= '۹':
+		return "Eastern Arabic-Indic"
+	}
+	for _, script := range []struct {
+		name  string
+		table *unicode.RangeTable
+	}{
+		{"Devanagari", unicode.Devanagari},
+		{"Bengali", unicode.Bengali},
+		{"Thai", unicode.Thai},
+		{"Khmer", unicode.Khmer},
+		{"Myanmar", unicode.Myanmar},
+	} {
+		if unicode.Is(script.table, r) {
+			return script.name
+		}
+	}
+	return "non-ASCII"
+}
+
+// NoteNumeralFixes adds the numeral corrections made to the OCR text this
+// receipt was read from to Anomalies.
+func (r *Receipt) NoteNumeralFixes(fixes []NumeralFix) {
+	for _, fix := range fixes {
+		r.Anomalies = append(r.Anomalies, fix.String())
+	}
+}
+
+// NoteNumeralFixes adds an invoice's numeral corrections as Receipt's does.
+func (inv *Invoice) NoteNumeralFixes(fixes []NumeralFix) {
+	for _, fix := range fixes {
+		inv.Anomalies = append(inv.Anomalies, fix.String())
+	}
+}
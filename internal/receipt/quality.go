@@ -0,0 +1,109 @@
+package receipt
+
+import "math"
+
+// Quality is how far a parsed receipt can be trusted, as a score from 0
+// (nothing checks out) to 100 (read clearly, complete, adding up, and
+// nothing unusual), with the parts it is made of, each also from 0 to 100.
+type Quality struct {
+	Score        int  `json:"score"`
+	OCR          *int `json:"ocr,omitempty"`        // Mean OCR line confidence; nil without OCR, as for text input
+	Arithmetic   *int `json:"arithmetic,omitempty"` // nil when there is no subtotal or total to check
+	Completeness int  `json:"completeness"`         // Share of the key fields read
+	Anomalies    int  `json:"anomalies"`            // Less for each anomaly, by severity
+}
+
+// Weights of the parts of a quality score. A part that doesn't apply
+// leaves the others to make up the score.
+const (
+	qualityWeightOCR          = 0.25
+	qualityWeightArithmetic   = 0.30
+	qualityWeightCompleteness = 0.25
+	qualityWeightAnomalies    = 0.20
+)
+
+// ScoreQuality scores r, read by OCR with ocrConfidence (0-100, or 0 when
+// it wasn't OCRed), given the anomalies the detectors found on it.
+// Arithmetic is checked here whichever detectors ran, and arithmetic
+// anomalies aren't counted again under anomalies.
+func ScoreQuality(r *Receipt, ocrConfidence float64, anomalies []Anomaly) Quality {
+	q := Quality{
+		Completeness: completeness(r),
+		Anomalies:    anomalyScore(anomalies),
+	}
+	if ocrConfidence > 0 {
+		ocr := int(math.Round(math.Min(ocrConfidence, 100)))
+		q.OCR = &ocr
+	}
+	if r.Subtotal != nil || r.Total != nil {
+		arithmetic := arithmeticScore(arithmeticDetector{}.Detect(r, DetectContext{}))
+		q.Arithmetic = &arithmetic
+	}
+
+	sum := qualityWeightCompleteness*float64(q.Completeness) + qualityWeightAnomalies*float64(q.Anomalies)
+	weights := qualityWeightCompleteness + qualityWeightAnomalies
+	if q.OCR != nil {
+		sum += qualityWeightOCR * float64(*q.OCR)
+		weights += qualityWeightOCR
+	}
+	if q.Arithmetic != nil {
+		sum += qualityWeightArithmetic * float64(*q.Arithmetic)
+		weights += qualityWeightArithmetic
+	}
+	q.Score = int(math.Round(sum / weights))
+	return q
+}
+
+// completeness is the percentage of a receipt's key fields that were read:
+// the vendor, date, items, and total, and the subtotal and tax unless they
+// aren't printed.
+func completeness(r *Receipt) int {
+	read := 0
+	for _, ok := range []bool{
+		r.Vendor != "",
+		r.Date != "",
+		len(r.Items) > 0,
+		r.Total != nil,
+		r.Subtotal != nil || r.Unknown["subtotal"] == ReasonAbsent,
+		r.Tax != nil || r.Unknown["tax"] == ReasonAbsent,
+	} {
+		if ok {
+			read++
+		}
+	}
+	return read * 100 / 6
+}
+
+// arithmeticScore is 0 when the subtotal or total doesn't add up, since
+// then some amount can't be right as read, and otherwise takes 20 from 100
+// for each line that doesn't.
+func arithmeticScore(found []Anomaly) int {
+	score := 100
+	for _, a := range found {
+		if a.Severity == SeverityError {
+			return 0
+		}
+		score -= 20
+	}
+	return max(score, 0)
+}
+
+// anomalyScore takes 25 from 100 for each error the detectors other than
+// arithmetic found, 10 for each warning, and 2 for each info.
+func anomalyScore(anomalies []Anomaly) int {
+	score := 100
+	for _, a := range anomalies {
+		if a.Detector == "arithmetic" {
+			continue
+		}
+		switch a.Severity {
+		case SeverityError:
+			score -= 25
+		case SeverityWarning:
+			score -= 10
+		default:
+			score -= 2
+		}
+	}
+	return max(score, 0)
+}
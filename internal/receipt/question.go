@@ -0,0 +1,130 @@
+// Package receipt provides ambiguity detection for receipt data, so a client
+// can be asked to resolve a field instead of the parser guessing.
+package receipt
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Question fields and reasons.
+const (
+	QuestionTotal = "total"
+	QuestionDate  = "date"
+
+	ReasonConflicting = "conflicting" // Several different candidate values
+	ReasonUnreadable  = "unreadable"  // A labeled value with no legible amount
+)
+
+// Question is a targeted question about one receipt field.
+type Question struct {
+	Field      string   `json:"field"`
+	Reason     string   `json:"reason"`
+	Message    string   `json:"message"`
+	Candidates []string `json:"candidates,omitempty"` // Choices, when conflicting
+}
+
+var (
+	// moneyRegex matches an amount with cents, e.g. "$1,234.56" or "14.00"
+	moneyRegex = regexp.MustCompile(`\$?(\d[\d,]*\.\d{2})\b`)
+
+	// totalLabelRegex matches the labels that introduce the amount paid
+	totalLabelRegex = regexp.MustCompile(`(?i)\b(?:total|balance due|amount due)\b`)
+
+	// notTotalRegex matches labels that mention a total but aren't the amount paid
+	notTotalRegex = regexp.MustCompile(`(?i)sub\s*-?\s*total|tax|sav(?:ed|ings?)|points|discount|deposit|crv|fees?\b|total\s+(?:items|qty|number)|items?\s+sold`)
+
+	// notPurchaseDateRegex matches lines whose date isn't the purchase date
+	notPurchaseDateRegex = regexp.MustCompile(`(?i)expir|exp\.?\s|valid|return|through|thru|due|until|member since|birth`)
+)
+
+// FindAmbiguities scans OCR lines for a total or purchase date that can't be
+// settled from the text alone: a total label with no legible amount, totals
+// that disagree, or more than one purchase date. It returns nil when the
+// receipt is unambiguous.
+func FindAmbiguities(lines []string) []Question {
+	var questions []Question
+	if q := totalQuestion(lines); q != nil {
+		questions = append(questions, *q)
+	}
+	if q := dateQuestion(lines); q != nil {
+		questions = append(questions, *q)
+	}
+	return questions
+}
+
+// totalQuestion compares the amounts on total lines. An amount on the line
+// below a bare label counts, since OCR often splits label and amount.
+func totalQuestion(lines []string) *Question {
+	var candidates []string
+	seen := make(map[string]bool)
+	labeled := false
+	for i, line := range lines {
+		if !totalLabelRegex.MatchString(line) || notTotalRegex.MatchString(line) {
+			continue
+		}
+		labeled = true
+
+		m := moneyRegex.FindStringSubmatch(line)
+		if m == nil && i+1 < len(lines) {
+			m = moneyRegex.FindStringSubmatch(lines[i+1])
+		}
+		if m == nil {
+			continue
+		}
+		amount := fmt.Sprintf("%.2f", NormalizePrice(m[1]))
+		if !seen[amount] {
+			seen[amount] = true
+			candidates = append(candidates, amount)
+		}
+	}
+
+	switch {
+	case len(candidates) > 1:
+		return &Question{
+			Field:      QuestionTotal,
+			Reason:     ReasonConflicting,
+			Message:    fmt.Sprintf("The receipt shows different totals (%s). Which is the amount paid?", strings.Join(candidates, ", ")),
+			Candidates: candidates,
+		}
+	case labeled && len(candidates) == 0:
+		return &Question{
+			Field:   QuestionTotal,
+			Reason:  ReasonUnreadable,
+			Message: "The receipt's total is unreadable. What was the amount paid?",
+		}
+	}
+	return nil
+}
+
+// dateQuestion collects the distinct dates printed on the receipt, skipping
+// expiry, return-by, and due dates.
+func dateQuestion(lines []string) *Question {
+	var candidates []string
+	seen := make(map[string]bool)
+	for _, line := range lines {
+		if notPurchaseDateRegex.MatchString(line) {
+			continue
+		}
+		year, month, day, ok := ParseReceiptDate(line)
+		if !ok {
+			continue
+		}
+		date := fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+		if !seen[date] {
+			seen[date] = true
+			candidates = append(candidates, date)
+		}
+	}
+
+	if len(candidates) < 2 {
+		return nil
+	}
+	return &Question{
+		Field:      QuestionDate,
+		Reason:     ReasonConflicting,
+		Message:    fmt.Sprintf("The receipt shows more than one date (%s). Which is the purchase date?", strings.Join(candidates, ", ")),
+		Candidates: candidates,
+	}
+}
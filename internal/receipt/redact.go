@@ -0,0 +1,106 @@
+// Package receipt provides redaction of personal details for sharing.
+package receipt
+
+import (
+	"regexp"
+	"slices"
+)
+
+// redactedText replaces personal details found in free text.
+const redactedText = "[redacted]"
+
+var (
+	// Card, account, and member numbers: runs of 8 or more digits, allowing
+	// spaces, dashes, and mask characters between them
+	longNumberRegex = regexp.MustCompile(`[\dXx*#][\dXx*# -]{6,}\d`)
+
+	// Email addresses
+	emailRegex = regexp.MustCompile(`[\w.+-]+@[\w-]+(?:\.[\w-]+)+`)
+
+	// Phone numbers like (310) 836-2458, 310-836-2458, +1 310 836 2458
+	phoneRegex = regexp.MustCompile(`(?:\+?\d{1,2}[\s.-]?)?\(?\d{3}\)?[\s.-]?\d{3}[\s.-]?\d{4}\b`)
+)
+
+// RedactText replaces card and account numbers, email addresses, and phone
+// numbers in s.
+func RedactText(s string) string {
+	s = emailRegex.ReplaceAllString(s, redactedText)
+	s = phoneRegex.ReplaceAllString(s, redactedText)
+	return longNumberRegex.ReplaceAllStringFunc(s, func(m string) string {
+		digits := 0
+		for _, r := range m {
+			if '0' <= r && r <= '9' || r == 'X' || r == 'x' || r == '*' {
+				digits++
+			}
+		}
+		if digits < 8 {
+			return m
+		}
+		return redactedText
+	})
+}
+
+// Redacted returns a copy of r fit to show people other than its owner: the
+// customer, server, check and table numbers, loyalty membership, the card
+// digits of tenders, and notes are removed, and personal details in item
+// names are replaced. Items, totals, tenders, and the store stay, so the
+// copy can settle a bill or a dispute.
+func (r *Receipt) Redacted() *Receipt {
+	out := *r
+	out.Customer = ""
+	out.Server = ""
+	out.CheckNumber = ""
+	out.Table = ""
+	out.Loyalty = nil
+	out.ConfidenceNotes = ""
+	out.Anomalies = make([]string, 0)
+	out.Items = slices.Clone(r.Items)
+	for i := range out.Items {
+		out.Items[i].Name = RedactText(out.Items[i].Name)
+	}
+	out.Fees = slices.Clone(r.Fees)
+	for i := range out.Fees {
+		out.Fees[i].Name = RedactText(out.Fees[i].Name)
+	}
+	out.Tenders = slices.Clone(r.Tenders)
+	for i := range out.Tenders {
+		out.Tenders[i].CardLast4 = ""
+		out.Tenders[i].Name = RedactText(out.Tenders[i].Name)
+	}
+	out.CartDescription = RedactText(r.CartDescription)
+	return &out
+}
+
+// Redacted returns a copy of inv fit to show people other than its owner,
+// like Receipt.Redacted. The buyer is reduced to nothing, and the vendor
+// keeps only its name and address.
+func (inv *Invoice) Redacted() *Invoice {
+	out := *inv
+	out.Vendor = Party{Name: inv.Vendor.Name, Address: inv.Vendor.Address}
+	out.Buyer = Party{}
+	out.PONumber = ""
+	out.ConfidenceNotes = ""
+	out.Anomalies = make([]string, 0)
+	out.Items = slices.Clone(inv.Items)
+	for i := range out.Items {
+		out.Items[i].Description = RedactText(out.Items[i].Description)
+	}
+	return &out
+}
+
+// RedactData returns a redacted copy of stored output, as a receipt or an
+// invoice by its shape. Fields outside the schema are dropped.
+func RedactData(data map[string]any) (map[string]any, error) {
+	if DetectDocumentType(data) == DocumentTypeInvoice {
+		inv, err := InvoiceFromMap(data)
+		if err != nil {
+			return nil, err
+		}
+		return inv.Redacted().Map(), nil
+	}
+	r, err := ReceiptFromMap(data)
+	if err != nil {
+		return nil, err
+	}
+	return r.Redacted().Map(), nil
+}
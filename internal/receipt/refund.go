@@ -0,0 +1,107 @@
+package receipt
+
+import (
+	"math"
+	"regexp"
+)
+
+var (
+	// refundMarkerRegex matches lines that mark a return or refund receipt,
+	// such as "REFUND", "MERCHANDISE RETURN", or "TOTAL REFUND"
+	refundMarkerRegex = regexp.MustCompile(`(?i)\b(?:refund(?:ed)?|return(?:ed)?\s+(?:items?|merchandise|receipt|slip|total)|merchandise\s+return|total\s+returns?|credit\s+(?:voucher|slip)|amount\s+refunded)\b`)
+
+	// refundPolicyRegex matches the return policy most receipts print, which
+	// mentions refunds without being one
+	refundPolicyRegex = regexp.MustCompile(`(?i)polic|within|days|eligib|accept|allowed|may\b|must|requir|without|non-?refundable|\bno\s+refunds?\b|refundable|exchange`)
+)
+
+// HasRefundMarker reports whether lines, a document's OCR text, mark it as
+// a return or refund receipt. Return policies don't count.
+func HasRefundMarker(lines []string) bool {
+	for _, line := range lines {
+		if refundMarkerRegex.MatchString(line) && !refundPolicyRegex.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeRefund gives a refund receipt negative amounts, so money given
+// back subtracts from spending wherever receipts are added up. A negative
+// total marks a receipt as a refund. A refund read without any minus signs,
+// with a positive total and no negative item, has the sign of every item,
+// tax, tender, and total amount flipped, with a note in Anomalies.
+func (r *Receipt) NormalizeRefund() {
+	if r.Total != nil && *r.Total < 0 {
+		r.Refund = true
+	}
+	if !r.Refund {
+		return
+	}
+	for i := range r.Items {
+		// A unit price takes its line's sign, so qty × unit price still holds
+		if item := &r.Items[i]; item.UnitPrice != 0 {
+			item.UnitPrice = math.Copysign(item.UnitPrice, item.Price)
+		}
+	}
+	if r.Total == nil || *r.Total <= 0 {
+		return
+	}
+	for _, item := range r.Items {
+		if item.Price < 0 {
+			// Signs were read; an exchange can come to more than it returns
+			return
+		}
+	}
+	for i := range r.Items {
+		r.Items[i].Price = -r.Items[i].Price
+		r.Items[i].UnitPrice = -r.Items[i].UnitPrice
+	}
+	for i := range r.TaxLines {
+		r.TaxLines[i].Amount = -r.TaxLines[i].Amount
+		r.TaxLines[i].Base = -r.TaxLines[i].Base
+	}
+	for i := range r.Tenders {
+		r.Tenders[i].Amount = -r.Tenders[i].Amount
+	}
+	for _, amount := range []*float64{r.Subtotal, r.Tax, r.Total} {
+		if amount != nil {
+			*amount = -*amount
+		}
+	}
+	r.Anomalies = append(r.Anomalies, "refund receipt: item, tax, tender, and total amounts made negative")
+}
+
+// Returns reports whether refund r gives back something bought on
+// purchase: a returned item matches one of the purchase's items by code or
+// name at the same price, or the money given back is the purchase total.
+// Vendors and dates are the caller's to compare.
+func (r *Receipt) Returns(purchase *Receipt) bool {
+	if !r.Refund || purchase.Refund {
+		return false
+	}
+	for _, returned := range r.Items {
+		key := refundItemKey(returned.Name)
+		if returned.Price >= 0 || key == "" {
+			continue
+		}
+		for _, bought := range purchase.Items {
+			sameItem := returned.Code != "" && returned.Code == bought.Code || key == refundItemKey(bought.Name)
+			samePrice := math.Abs(-returned.Price-bought.Price) < 0.005 ||
+				bought.UnitPrice != 0 && math.Abs(-returned.Price-bought.UnitPrice*float64(max(returned.Qty, 1))) < 0.005
+			if sameItem && samePrice {
+				return true
+			}
+		}
+	}
+	if r.Total == nil || purchase.Total == nil {
+		return false
+	}
+	return math.Abs(*r.Total+*purchase.Total) < 0.005
+}
+
+// refundItemKey normalizes an item name for matching a return to its
+// purchase, ignoring case, spacing, and punctuation.
+func refundItemKey(name string) string {
+	return normalizeVendor(name)
+}
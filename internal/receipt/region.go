@@ -0,0 +1,242 @@
+package receipt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// amountFields are the fields holding an amount, which a region is read
+// for one of even when the field has no value yet.
+var amountFields = map[string]bool{
+	"amount": true, "amount_due": true, "price": true, "shipping": true,
+	"subtotal": true, "tax": true, "total": true, "unit_price": true,
+}
+
+// printedAmountPattern matches a word that is an amount with two decimals,
+// with a currency sign, thousands separators, a minus sign before or after
+// it, or a tax flag letter, as "$1,234.56", "12,50", "3.00-", or "4.99F".
+// The groups are the sign before it, the whole part, the decimals, and the
+// sign after it.
+var printedAmountPattern = regexp.MustCompile(`^(-)?[$€£]?(\d{1,3}(?:[,.]\d{3})+|\d+)[.,](\d{2})(-)?[A-Za-z]?$`)
+
+// ReadRegionField reads the value of field, a path in parsed data as
+// LocateFields names them, such as "total" or "items[2].price", from rows:
+// the printed rows of a region of the document, read again by OCR. current
+// is the field's value, or nil, and decides what is read:
+//
+//   - An amount, for a number or an amount field, from the row labeled
+//     with the field's name ("TOTAL 12.34"), or else the only row with an
+//     amount, taking the row's last amount. It keeps current's sign when
+//     the row prints none.
+//   - A date, YYYY-MM-DD, for date and *_date.
+//   - A clock time as printed, for time.
+//   - The rows' text, joined by spaces, for any other field.
+//
+// It fails when the region shows no such value, or amounts on several rows
+// none of which is labeled, and for a field holding an entry or a list.
+func ReadRegionField(field string, current any, rows []string) (any, error) {
+	key := fieldKey(field)
+	_, number := current.(float64)
+	switch current.(type) {
+	case map[string]any, []any:
+		return nil, fmt.Errorf("%s is not a single value; name one of its fields, such as items[0].price", field)
+	}
+	switch {
+	case number || (current == nil && amountFields[key]):
+		return readRegionAmount(key, current, rows)
+	case key == "date" || strings.HasSuffix(key, "_date"):
+		for _, row := range rows {
+			if y, m, d, ok := ParseReceiptDate(row); ok {
+				return fmt.Sprintf("%04d-%02d-%02d", y, m, d), nil
+			}
+		}
+		return nil, errors.New("no date was read in the region")
+	case key == "time":
+		for _, row := range rows {
+			if t := clockRegex.FindString(row); t != "" {
+				return strings.TrimSpace(t), nil
+			}
+		}
+		return nil, errors.New("no time was read in the region")
+	}
+	text := strings.TrimSpace(strings.Join(rows, " "))
+	if text == "" {
+		return nil, errors.New("no text was read in the region")
+	}
+	return text, nil
+}
+
+// readRegionAmount reads the amount for the field named key from rows.
+func readRegionAmount(key string, current any, rows []string) (float64, error) {
+	type amountRow struct {
+		text   string
+		amount float64
+	}
+	var found, labeled []amountRow
+	label := keywordPattern(strings.ReplaceAll(key, "_", " "))
+	for _, row := range rows {
+		amount, ok := lastPrintedAmount(row)
+		if !ok {
+			continue
+		}
+		found = append(found, amountRow{row, amount})
+		if label.MatchString(row) {
+			labeled = append(labeled, amountRow{row, amount})
+		}
+	}
+	if len(labeled) > 0 {
+		found = labeled
+	}
+	if len(found) == 0 {
+		return 0, errors.New("no amount was read in the region")
+	}
+	for _, r := range found[1:] {
+		if r.amount != found[0].amount {
+			texts := make([]string, len(found))
+			for i, r := range found {
+				texts[i] = strconv.Quote(r.text)
+			}
+			return 0, fmt.Errorf("the region shows amounts on %d rows (%s); narrow it to the row of %s", len(found), strings.Join(texts, ", "), key)
+		}
+	}
+
+	amount := found[0].amount
+	if c, ok := current.(float64); ok && c < 0 && amount > 0 {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+// lastPrintedAmount returns the last amount printed on row.
+func lastPrintedAmount(row string) (float64, bool) {
+	normalized, _ := NormalizeNumerals(row)
+	words := strings.Fields(normalized)
+	for i := len(words) - 1; i >= 0; i-- {
+		m := printedAmountPattern.FindStringSubmatch(words[i])
+		if m == nil {
+			continue
+		}
+		whole := strings.NewReplacer(",", "", ".", "").Replace(m[2])
+		amount, err := strconv.ParseFloat(whole+"."+m[3], 64)
+		if err != nil {
+			continue
+		}
+		if m[1] != "" || m[4] != "" {
+			amount = -amount
+		}
+		return amount, true
+	}
+	return 0, false
+}
+
+// ErrFieldNotFound is returned for a field path through an entry or list
+// the data doesn't have.
+var ErrFieldNotFound = errors.New("field not found")
+
+// FieldValue returns the value of field, a path as LocateFields names them,
+// in data, or nil when the entry it would be in has no such field.
+func FieldValue(data map[string]any, field string) (any, error) {
+	var value any
+	err := walkField(data, field, func(parent map[string]any, name string) {
+		value = parent[name]
+	}, func(list []any, index int) {
+		value = list[index]
+	})
+	return value, err
+}
+
+// SetField returns a copy of data with field, a path as LocateFields names
+// them, set to value. The entries and lists on the path must exist; the
+// field itself need not.
+func SetField(data map[string]any, field string, value any) (map[string]any, error) {
+	// A JSON round trip copies parsed data deeply, as it holds only JSON
+	// values
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy data: %w", err)
+	}
+	var copied map[string]any
+	if err := json.Unmarshal(raw, &copied); err != nil {
+		return nil, fmt.Errorf("failed to copy data: %w", err)
+	}
+	if copied == nil {
+		copied = map[string]any{}
+	}
+	err = walkField(copied, field, func(parent map[string]any, name string) {
+		parent[name] = value
+	}, func(list []any, index int) {
+		list[index] = value
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copied, nil
+}
+
+// walkField follows field's path through data to where the field is kept,
+// and calls inEntry with the entry holding it, or inList with the list
+// holding it when the path ends with an index.
+func walkField(data map[string]any, field string, inEntry func(map[string]any, string), inList func([]any, int)) error {
+	segments := strings.Split(field, ".")
+	parent := data
+	for i, segment := range segments {
+		name, index, err := parseFieldSegment(segment)
+		if err != nil {
+			return fmt.Errorf("invalid field %q: %w", field, err)
+		}
+		last := i == len(segments)-1
+		if index < 0 && last {
+			inEntry(parent, name)
+			return nil
+		}
+
+		next := parent[name]
+		if index >= 0 {
+			list, ok := next.([]any)
+			if !ok || index >= len(list) {
+				return fmt.Errorf("%w: %s", ErrFieldNotFound, field)
+			}
+			if last {
+				inList(list, index)
+				return nil
+			}
+			next = list[index]
+		}
+		entry, ok := next.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrFieldNotFound, field)
+		}
+		parent = entry
+	}
+	return fmt.Errorf("invalid field %q", field)
+}
+
+// parseFieldSegment splits one segment of a field path, "items[2]" or
+// "total", into its name and index, which is -1 for none.
+func parseFieldSegment(segment string) (string, int, error) {
+	name, rest, indexed := strings.Cut(segment, "[")
+	if name == "" {
+		return "", 0, errors.New("empty name")
+	}
+	if !indexed {
+		return name, -1, nil
+	}
+	digits, ok := strings.CutSuffix(rest, "]")
+	index, err := strconv.Atoi(digits)
+	if !ok || err != nil || index < 0 {
+		return "", 0, fmt.Errorf("bad index in %q", segment)
+	}
+	return name, index, nil
+}
+
+// fieldKey returns the name of the field at the end of path: "price" for
+// "items[2].price".
+func fieldKey(path string) string {
+	key := path[strings.LastIndex(path, ".")+1:]
+	name, _, _ := strings.Cut(key, "[")
+	return name
+}
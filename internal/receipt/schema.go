@@ -3,21 +3,72 @@ package receipt
 
 // Item represents a single line item on a receipt.
 type Item struct {
-	Name  string  `json:"name"`
-	Qty   int     `json:"qty"`
-	Price float64 `json:"price"`
+	Name      string  `json:"name" jsonschema:"Item name as printed, with OCR errors corrected"`
+	Code      string  `json:"code,omitempty" jsonschema:"UPC or store item number, when printed"`
+	Qty       int     `json:"qty" jsonschema:"Quantity purchased"`
+	Price     float64 `json:"price" jsonschema:"Price as printed; negative for discounts and credits"`
+	UnitPrice float64 `json:"unit_price,omitempty" jsonschema:"Price per unit, when printed with the quantity, e.g. 2 @ 1.99; price is then the line total"`
+
+	ItemEnrichment
+}
+
+// Fee represents a fee or surcharge on a receipt.
+type Fee struct {
+	Name   string  `json:"name" jsonschema:"Fee name, e.g. service charge or bag fee"`
+	Rate   string  `json:"rate,omitempty" jsonschema:"Rate as printed, e.g. 18%"`
+	Amount float64 `json:"amount" jsonschema:"Fee amount"`
+}
+
+// Product is what a product database knows about an item's code.
+type Product struct {
+	Name     string `json:"name" jsonschema:"Product name"`
+	Brand    string `json:"brand,omitempty" jsonschema:"Brand"`
+	Size     string `json:"size,omitempty" jsonschema:"Package size as listed, e.g. 20 oz"`
+	Provider string `json:"provider" jsonschema:"Database the product came from"`
+}
+
+// ItemEnrichment is added to line items after parsing, from product lookups
+// and package sizes. Parsers leave it empty.
+type ItemEnrichment struct {
+	Product         *Product `json:"product,omitempty" jsonschema:"Product looked up from the item code"`
+	Size            string   `json:"size,omitempty" jsonschema:"Package size, e.g. 20 oz"`
+	NormalizedPrice float64  `json:"normalized_price,omitempty" jsonschema:"Price per normalized_unit, for comparing package sizes"`
+	NormalizedUnit  string   `json:"normalized_unit,omitempty" jsonschema:"100g or 100ml"`
 }
 
 // Receipt represents the normalized, structured output from receipt analysis.
+// The model and the heuristic parser both produce it.
 type Receipt struct {
-	Vendor          string   `json:"vendor"`
-	Date            string   `json:"date"`
-	Items           []Item   `json:"items"`
-	Subtotal        float64  `json:"subtotal"`
-	Tax             float64  `json:"tax"`
-	Total           float64  `json:"total"`
-	ConfidenceNotes string   `json:"confidence_notes"`
-	Anomalies       []string `json:"anomalies"`
+	Vendor          string    `json:"vendor" jsonschema:"Short store or restaurant name"`
+	VendorFull      string    `json:"vendor_full,omitempty" jsonschema:"Full legal or printed business name"`
+	Address         string    `json:"address,omitempty" jsonschema:"Store address as printed"`
+	StoreNumber     string    `json:"store_number,omitempty" jsonschema:"Store or location number as printed, digits only, e.g. 0456 from Store #0456"`
+	Phone           string    `json:"phone,omitempty" jsonschema:"Store phone number as printed"`
+	Date            string    `json:"date" jsonschema:"Purchase date, YYYY-MM-DD"`
+	Time            string    `json:"time,omitempty" jsonschema:"Purchase time as printed"`
+	Items           []Item    `json:"items" jsonschema:"Purchased line items"`
+	Fees            []Fee     `json:"fees,omitempty" jsonschema:"Fees and surcharges"`
+	Subtotal        *float64  `json:"subtotal" jsonschema:"Subtotal before tax; null when unknown, with the reason in unknown"`
+	Tax             *float64  `json:"tax" jsonschema:"Total tax; null when unknown, with the reason in unknown"`
+	TaxLines        []TaxLine `json:"tax_lines,omitempty" jsonschema:"Each tax, levy, or deposit printed on its own line, such as VAT by rate or state and county tax"`
+	Total           *float64  `json:"total" jsonschema:"Amount charged; null when unknown, with the reason in unknown"`
+	Refund          bool      `json:"refund,omitempty" jsonschema:"Whether this is a return or refund receipt; its items, tax, and total are then negative"`
+	Tenders         []Tender  `json:"tenders,omitempty" jsonschema:"How the total was paid, one entry per tender, such as a gift card and a credit card"`
+	OutOfPocket     *float64  `json:"out_of_pocket,omitempty" jsonschema:"Total less what gift cards and store credit paid; set from tenders when they paid part of it"`
+	Server          string    `json:"server,omitempty" jsonschema:"Server or cashier name"`
+	CheckNumber     string    `json:"check_number,omitempty" jsonschema:"Check, order, or transaction number"`
+	Table           string    `json:"table,omitempty" jsonschema:"Table number"`
+	Customer        string    `json:"customer,omitempty" jsonschema:"Customer name, when printed"`
+	CartDescription string    `json:"cart_description,omitempty" jsonschema:"One-line summary of what was bought"`
+	ItemCategories  []string  `json:"item_categories,omitempty" jsonschema:"Categories of the items, e.g. groceries"`
+	Loyalty         *Loyalty  `json:"loyalty,omitempty" jsonschema:"Rewards or membership details"`
+	Handwritten     bool      `json:"handwritten" jsonschema:"Whether OCR found handwriting"`
+	ConfidenceNotes string    `json:"confidence_notes" jsonschema:"Notes on how confident the extraction is"`
+	Anomalies       []string  `json:"anomalies" jsonschema:"Problems noticed, such as totals that don't add up"`
+
+	// Unknown maps each null amount to why it has none: ReasonAbsent or
+	// ReasonUnreadable.
+	Unknown map[string]string `json:"unknown,omitempty" jsonschema:"Why each null amount is null: absent (not printed) or unreadable (printed but illegible)"`
 }
 
 // NewReceipt creates a new Receipt with initialized slices.
@@ -27,6 +78,3 @@ func NewReceipt() *Receipt {
 		Anomalies: make([]string, 0),
 	}
 }
-
-
-
@@ -0,0 +1,135 @@
+package receipt
+
+import "slices"
+
+const (
+	// splitGapLines is the vertical gap, in typical line heights, that can
+	// separate two receipts scanned onto one page. A blank line printed on a
+	// receipt is one or two.
+	splitGapLines = 4
+
+	// minSplitGap is the smallest gap, as a fraction of the page's height,
+	// that can separate two receipts, for pages of a few large lines.
+	minSplitGap = 0.03
+)
+
+// grandTotalPattern matches the line a receipt's total is printed on.
+var grandTotalPattern = keywordPattern("total", "amount due", "balance due", "total due")
+
+// piece is a run of lines printed together, with nothing but whitespace
+// around it, and what its rows say about where it belongs on a receipt.
+type piece struct {
+	lines    []int
+	total    bool // Has a total with its amount
+	amounts  bool // Has any amount
+	trailing bool // Only a receipt's payment and footer print like this
+}
+
+// SplitDocuments finds the receipts in a scan of several, such as a batch
+// fed through a document scanner or laid out on a flatbed, and returns the
+// indexes of each one's lines, in order. Lines must be sorted by page, then
+// top to bottom, as load_textract returns them.
+//
+// The lines are first cut into pieces at each new page and at each
+// vertical gap of splitGapLines typical line heights. Pieces are then
+// joined back into receipts: a receipt ends with the piece its total is
+// in, unless the next piece only carries on with payment or footer lines
+// ("VISA ****1234", "Thank you for shopping"). Pieces without a total, such
+// as a header separated from its items, start or continue a receipt.
+// Receipts printing no total at all are joined with the next, and lines
+// with no amount after the last receipt are kept with it. Columns of
+// receipts side by side are not told apart.
+func SplitDocuments(lines []LayoutLine) [][]int {
+	pieces := splitPieces(lines)
+	var docs []piece
+	for _, p := range pieces {
+		if n := len(docs); n > 0 && (!docs[n-1].total || p.trailing) {
+			last := &docs[n-1]
+			last.lines = append(last.lines, p.lines...)
+			last.total = last.total || p.total
+			last.amounts = last.amounts || p.amounts
+			continue
+		}
+		docs = append(docs, p)
+	}
+	if n := len(docs); n > 1 && !docs[n-1].amounts {
+		docs[n-2].lines = append(docs[n-2].lines, docs[n-1].lines...)
+		docs = docs[:n-1]
+	}
+
+	split := make([][]int, len(docs))
+	for i, d := range docs {
+		split[i] = d.lines
+	}
+	return split
+}
+
+// splitPieces cuts lines at each new page and at each gap wide enough to
+// separate two receipts.
+func splitPieces(lines []LayoutLine) []piece {
+	var heights []float64
+	for _, line := range lines {
+		if line.Height > 0 {
+			heights = append(heights, line.Height)
+		}
+	}
+	gap := minSplitGap
+	if len(heights) > 0 {
+		slices.Sort(heights)
+		gap = max(gap, splitGapLines*heights[len(heights)/2])
+	}
+
+	var pieces []piece
+	var current []int
+	bottom := 0.0
+	for i, line := range lines {
+		if len(current) > 0 {
+			prev := lines[current[len(current)-1]]
+			if line.Page != prev.Page || line.Height > 0 && bottom > 0 && line.Top-bottom > gap {
+				pieces = append(pieces, newPiece(lines, current))
+				current, bottom = nil, 0
+			}
+		}
+		current = append(current, i)
+		if line.Height > 0 {
+			bottom = max(bottom, line.Top+line.Height)
+		}
+	}
+	if len(current) > 0 {
+		pieces = append(pieces, newPiece(lines, current))
+	}
+	return pieces
+}
+
+// newPiece describes the piece made of lines' indexes.
+func newPiece(lines []LayoutLine, indexes []int) piece {
+	own := make([]LayoutLine, len(indexes))
+	for i, l := range indexes {
+		own[i] = lines[l]
+	}
+	p := piece{lines: indexes, trailing: true}
+	keywords := 0
+	rows := groupRows(own)
+	for _, r := range rows {
+		amount := amountPattern.MatchString(r.text)
+		payment := paymentPattern.MatchString(r.text) || maskedCardPattern.MatchString(r.text)
+		p.amounts = p.amounts || amount
+		// An amount that isn't paid is an item or a total, which come
+		// before the payment
+		if amount && grandTotalPattern.MatchString(r.text) {
+			p.total, p.trailing = true, false
+		}
+		if amount && !payment {
+			p.trailing = false
+		}
+		if payment || footerPattern.MatchString(r.text) {
+			keywords++
+		}
+	}
+	// A receipt's header is mostly a name, address, and date; its footer
+	// is mostly thanks and policies
+	if keywords*2 <= len(rows) {
+		p.trailing = false
+	}
+	return p
+}
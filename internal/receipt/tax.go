@@ -0,0 +1,44 @@
+package receipt
+
+// TaxLine is one tax, levy, or deposit on a receipt or invoice: each VAT
+// rate, state and county tax, or bottle deposit printed on its own line.
+type TaxLine struct {
+	Name     string  `json:"name" jsonschema:"Name as printed, e.g. VAT, State Tax, County Tax, CRV, Bottle Deposit"`
+	Rate     float64 `json:"rate,omitempty" jsonschema:"Rate in percent, e.g. 20 for 20%, when printed"`
+	Base     float64 `json:"base,omitempty" jsonschema:"Net amount the rate applies to, when printed"`
+	Amount   float64 `json:"amount" jsonschema:"Amount of this tax"`
+	Included bool    `json:"included,omitempty" jsonschema:"Whether the amount is already in the prices, as VAT usually is, rather than added to the subtotal"`
+}
+
+// TaxTotals returns what lines add up to, and how much of that is included
+// in the prices rather than added to them.
+func TaxTotals(lines []TaxLine) (total, included float64) {
+	for _, line := range lines {
+		total += line.Amount
+		if line.Included {
+			included += line.Amount
+		}
+	}
+	return roundCents(total), roundCents(included)
+}
+
+// FillTax sets a null tax to what the tax lines add up to, so tax stays
+// the total tax whether or not the document prints one.
+func (r *Receipt) FillTax() {
+	if r.Tax != nil || len(r.TaxLines) == 0 {
+		return
+	}
+	total, _ := TaxTotals(r.TaxLines)
+	r.Tax = Amount(total)
+	delete(r.Unknown, "tax")
+}
+
+// FillTax sets a null invoice tax from its tax lines as Receipt's does.
+func (inv *Invoice) FillTax() {
+	if inv.Tax != nil || len(inv.TaxLines) == 0 {
+		return
+	}
+	total, _ := TaxTotals(inv.TaxLines)
+	inv.Tax = Amount(total)
+	delete(inv.Unknown, "tax")
+}
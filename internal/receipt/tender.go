@@ -0,0 +1,55 @@
+package receipt
+
+// Tender types. Gift cards and store credit were paid for earlier, or given
+// back on a return, so they don't come out of pocket at the register.
+const (
+	TenderCard        = "card"
+	TenderCash        = "cash"
+	TenderGiftCard    = "gift_card"
+	TenderStoreCredit = "store_credit"
+	TenderEBT         = "ebt"
+	TenderOther       = "other"
+)
+
+// Tender is one way part of a receipt's total was paid, such as the part
+// on a gift card and the rest on a credit card.
+type Tender struct {
+	Type      string  `json:"type" jsonschema:"card, cash, gift_card, store_credit, ebt, or other"`
+	Name      string  `json:"name,omitempty" jsonschema:"Tender as printed, e.g. VISA, Target GiftCard, Merchandise Credit"`
+	Amount    float64 `json:"amount" jsonschema:"Amount applied to the total: cash tendered less change; negative when a refund is paid back to it"`
+	CardLast4 string  `json:"card_last4,omitempty" jsonschema:"Last four digits of the card or gift card, when printed"`
+}
+
+// ValidTenderType reports whether t is one of the tender types.
+func ValidTenderType(t string) bool {
+	switch t {
+	case TenderCard, TenderCash, TenderGiftCard, TenderStoreCredit, TenderEBT, TenderOther:
+		return true
+	}
+	return false
+}
+
+// Prepaid reports whether the tender was paid for before the purchase.
+func (t Tender) Prepaid() bool {
+	return t.Type == TenderGiftCard || t.Type == TenderStoreCredit
+}
+
+// FillOutOfPocket sets OutOfPocket to the total less what gift cards and
+// store credit paid, when they paid any of it. Otherwise it is left unset,
+// and the whole total came out of pocket.
+func (r *Receipt) FillOutOfPocket() {
+	r.OutOfPocket = nil
+	if r.Total == nil {
+		return
+	}
+	prepaid, found := 0.0, false
+	for _, t := range r.Tenders {
+		if t.Prepaid() {
+			prepaid += t.Amount
+			found = true
+		}
+	}
+	if found {
+		r.OutOfPocket = Amount(roundCents(*r.Total - prepaid))
+	}
+}
@@ -0,0 +1,194 @@
+// Package receipt provides timestamp normalization for receipt data.
+package receipt
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	// Embed the zone database so time zone inference works on hosts without one
+	_ "time/tzdata"
+)
+
+// PurchaseTime is a receipt's purchase time, normalized to the vendor's time zone.
+type PurchaseTime struct {
+	RawDate        string `json:"raw_date,omitempty"`
+	RawTime        string `json:"raw_time,omitempty"`
+	LocalDate      string `json:"local_date,omitempty"` // YYYY-MM-DD in the vendor's time zone
+	Timestamp      string `json:"timestamp,omitempty"`  // RFC3339 with the vendor's UTC offset
+	TimeZone       string `json:"time_zone,omitempty"`
+	TimeZoneSource string `json:"time_zone_source,omitempty"` // "location", "address", "exif", or "default"
+	DateOnly       bool   `json:"date_only,omitempty"`
+	DateSource     string `json:"date_source,omitempty"` // "exif" when taken from the photo, not the receipt
+}
+
+var (
+	isoDateRegex     = regexp.MustCompile(`\b(\d{4})-(\d{1,2})-(\d{1,2})\b`)
+	numericDateRegex = regexp.MustCompile(`\b(\d{1,2})[/.-](\d{1,2})[/.-](\d{2,4})\b`)
+	monthNameRegex   = regexp.MustCompile(`(?i)\b(jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)[a-z]*\.?\s+(\d{1,2}),?\s+(\d{4})\b`)
+	dayMonthRegex    = regexp.MustCompile(`(?i)\b(\d{1,2})\s+(jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)[a-z]*\.?,?\s+(\d{4})\b`)
+	clockRegex       = regexp.MustCompile(`(?i)\b(\d{1,2}):(\d{2})(?::(\d{2}))?\s*([ap])?\.?m?\.?\b`)
+
+	monthNames = map[string]time.Month{
+		"jan": time.January, "feb": time.February, "mar": time.March, "apr": time.April,
+		"may": time.May, "jun": time.June, "jul": time.July, "aug": time.August,
+		"sep": time.September, "oct": time.October, "nov": time.November, "dec": time.December,
+	}
+)
+
+// ParseReceiptDate finds a date in text and returns its year, month, and day.
+// Numeric dates are read as US month/day unless the first number can't be a month.
+func ParseReceiptDate(text string) (int, time.Month, int, bool) {
+	if m := isoDateRegex.FindStringSubmatch(text); m != nil {
+		return validDate(atoi(m[1]), atoi(m[2]), atoi(m[3]))
+	}
+	if m := monthNameRegex.FindStringSubmatch(text); m != nil {
+		return validDate(atoi(m[3]), int(monthNames[strings.ToLower(m[1][:3])]), atoi(m[2]))
+	}
+	if m := dayMonthRegex.FindStringSubmatch(text); m != nil {
+		return validDate(atoi(m[3]), int(monthNames[strings.ToLower(m[2][:3])]), atoi(m[1]))
+	}
+	if m := numericDateRegex.FindStringSubmatch(text); m != nil {
+		first, second, year := atoi(m[1]), atoi(m[2]), atoi(m[3])
+		if year < 100 {
+			year += 2000
+		}
+		if first > 12 {
+			// Day-first (e.g. 25/12/2024)
+			return validDate(year, second, first)
+		}
+		return validDate(year, first, second)
+	}
+	return 0, 0, 0, false
+}
+
+// ParseReceiptTime finds a clock time in text and returns it in 24-hour form.
+func ParseReceiptTime(text string) (int, int, int, bool) {
+	m := clockRegex.FindStringSubmatch(text)
+	if m == nil {
+		return 0, 0, 0, false
+	}
+
+	hour, minute, second := atoi(m[1]), atoi(m[2]), atoi(m[3])
+	switch strings.ToLower(m[4]) {
+	case "a":
+		if hour == 12 {
+			hour = 0
+		}
+	case "p":
+		if hour < 12 {
+			hour += 12
+		}
+	}
+
+	if hour > 23 || minute > 59 || second > 59 {
+		return 0, 0, 0, false
+	}
+	return hour, minute, second, true
+}
+
+// NormalizePurchaseTime combines raw date and time strings into a
+// PurchaseTime in loc. source records how loc was chosen. The time may
+// also be embedded in rawDate (as on many receipts' date lines).
+func NormalizePurchaseTime(rawDate, rawTime string, loc *time.Location, source string) (*PurchaseTime, error) {
+	pt := &PurchaseTime{
+		RawDate:        rawDate,
+		RawTime:        rawTime,
+		TimeZone:       loc.String(),
+		TimeZoneSource: source,
+	}
+
+	year, month, day, ok := ParseReceiptDate(rawDate)
+	if !ok {
+		return pt, fmt.Errorf("unrecognized date: %q", rawDate)
+	}
+
+	hour, minute, second, hasTime := ParseReceiptTime(rawTime)
+	if !hasTime {
+		hour, minute, second, hasTime = ParseReceiptTime(rawDate)
+	}
+
+	t := time.Date(year, month, day, hour, minute, second, 0, loc)
+	pt.LocalDate = t.Format("2006-01-02")
+	pt.Timestamp = t.Format(time.RFC3339)
+	pt.DateOnly = !hasTime
+	return pt, nil
+}
+
+// stateTimeZones maps US states (abbreviation and name) to their principal
+// IANA time zone. States spanning zones use the zone covering most residents.
+var stateTimeZones = map[string]string{
+	"AL": "America/Chicago", "AK": "America/Anchorage", "AZ": "America/Phoenix", "AR": "America/Chicago",
+	"CA": "America/Los_Angeles", "CO": "America/Denver", "CT": "America/New_York", "DE": "America/New_York",
+	"DC": "America/New_York", "FL": "America/New_York", "GA": "America/New_York", "HI": "Pacific/Honolulu",
+	"ID": "America/Boise", "IL": "America/Chicago", "IN": "America/Indiana/Indianapolis", "IA": "America/Chicago",
+	"KS": "America/Chicago", "KY": "America/New_York", "LA": "America/Chicago", "ME": "America/New_York",
+	"MD": "America/New_York", "MA": "America/New_York", "MI": "America/Detroit", "MN": "America/Chicago",
+	"MS": "America/Chicago", "MO": "America/Chicago", "MT": "America/Denver", "NE": "America/Chicago",
+	"NV": "America/Los_Angeles", "NH": "America/New_York", "NJ": "America/New_York", "NM": "America/Denver",
+	"NY": "America/New_York", "NC": "America/New_York", "ND": "America/Chicago", "OH": "America/New_York",
+	"OK": "America/Chicago", "OR": "America/Los_Angeles", "PA": "America/New_York", "RI": "America/New_York",
+	"SC": "America/New_York", "SD": "America/Chicago", "TN": "America/Chicago", "TX": "America/Chicago",
+	"UT": "America/Denver", "VT": "America/New_York", "VA": "America/New_York", "WA": "America/Los_Angeles",
+	"WV": "America/New_York", "WI": "America/Chicago", "WY": "America/Denver", "PR": "America/Puerto_Rico",
+}
+
+// stateNames maps full US state names to abbreviations.
+var stateNames = map[string]string{
+	"alabama": "AL", "alaska": "AK", "arizona": "AZ", "arkansas": "AR", "california": "CA",
+	"colorado": "CO", "connecticut": "CT", "delaware": "DE", "district of columbia": "DC",
+	"florida": "FL", "georgia": "GA", "hawaii": "HI", "idaho": "ID", "illinois": "IL",
+	"indiana": "IN", "iowa": "IA", "kansas": "KS", "kentucky": "KY", "louisiana": "LA",
+	"maine": "ME", "maryland": "MD", "massachusetts": "MA", "michigan": "MI", "minnesota": "MN",
+	"mississippi": "MS", "missouri": "MO", "montana": "MT", "nebraska": "NE", "nevada": "NV",
+	"new hampshire": "NH", "new jersey": "NJ", "new mexico": "NM", "new york": "NY",
+	"north carolina": "NC", "north dakota": "ND", "ohio": "OH", "oklahoma": "OK", "oregon": "OR",
+	"pennsylvania": "PA", "rhode island": "RI", "south carolina": "SC", "south dakota": "SD",
+	"tennessee": "TN", "texas": "TX", "utah": "UT", "vermont": "VT", "virginia": "VA",
+	"washington": "WA", "west virginia": "WV", "wisconsin": "WI", "wyoming": "WY", "puerto rico": "PR",
+}
+
+// addressStateRegex matches a US state abbreviation before a ZIP code, e.g. ", CA 90012".
+var addressStateRegex = regexp.MustCompile(`\b([A-Z]{2})\s+\d{5}(?:-\d{4})?\b`)
+
+// TimeZoneForState returns the IANA zone for a US state name or abbreviation.
+func TimeZoneForState(state string) (string, bool) {
+	s := strings.TrimSpace(state)
+	if abbr, ok := stateNames[strings.ToLower(s)]; ok {
+		s = abbr
+	}
+	tz, ok := stateTimeZones[strings.ToUpper(s)]
+	return tz, ok
+}
+
+// StateFromAddress extracts a US state abbreviation from an address string.
+func StateFromAddress(address string) string {
+	m := addressStateRegex.FindStringSubmatch(address)
+	if m == nil {
+		return ""
+	}
+	if _, ok := stateTimeZones[m[1]]; !ok {
+		return ""
+	}
+	return m[1]
+}
+
+// validDate checks a calendar date, reporting false for impossible ones.
+func validDate(year, month, day int) (int, time.Month, int, bool) {
+	if month < 1 || month > 12 || day < 1 || day > 31 || year < 1900 || year > 2200 {
+		return 0, 0, 0, false
+	}
+	t := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if t.Day() != day {
+		return 0, 0, 0, false
+	}
+	return year, time.Month(month), day, true
+}
+
+// atoi parses a decimal string, returning 0 on failure.
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
@@ -0,0 +1,53 @@
+package receipt
+
+// ReasonAbsent is why a nullable field has no value when the document
+// doesn't print it, such as the tax on a receipt from a tax-free state.
+// The other reason in the unknown map of receipts and invoices is
+// ReasonUnreadable, for a field printed but not legible. A null field says
+// nothing about the document on its own, and neither reason is a zero.
+const ReasonAbsent = "absent"
+
+// ValidReason reports whether reason is one the unknown map allows.
+func ValidReason(reason string) bool {
+	return reason == ReasonAbsent || reason == ReasonUnreadable
+}
+
+// Amount returns a pointer to v, for setting a nullable amount.
+func Amount(v float64) *float64 {
+	return &v
+}
+
+// Value returns the amount p points to, or 0 when it is null. Use it where
+// an unknown amount may count as nothing, such as a sum that also notes
+// what it is missing.
+func Value(p *float64) float64 {
+	if p == nil {
+		return 0
+	}
+	return *p
+}
+
+// SetUnknown records why a receipt field, left null, has no value.
+func (r *Receipt) SetUnknown(field, reason string) {
+	if r.Unknown == nil {
+		r.Unknown = make(map[string]string)
+	}
+	r.Unknown[field] = reason
+}
+
+// SetUnknown records why an invoice field, left null, has no value.
+func (inv *Invoice) SetUnknown(field, reason string) {
+	if inv.Unknown == nil {
+		inv.Unknown = make(map[string]string)
+	}
+	inv.Unknown[field] = reason
+}
+
+// UnknownReason returns why field of a stored receipt or invoice has no
+// value, or "" if it has one or the record predates the unknown map. Older
+// records stored unknown amounts as 0, so their zeros stay ambiguous.
+func UnknownReason(data map[string]any, field string) string {
+	unknown, _ := data["unknown"].(map[string]any)
+	reason, _ := unknown[field].(string)
+	return reason
+}
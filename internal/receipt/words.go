@@ -0,0 +1,327 @@
+package receipt
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// numberWords are the number words below one hundred.
+var numberWords = map[string]int{
+	"zero": 0, "one": 1, "two": 2, "three": 3, "four": 4, "five": 5, "six": 6,
+	"seven": 7, "eight": 8, "nine": 9, "ten": 10, "eleven": 11, "twelve": 12,
+	"thirteen": 13, "fourteen": 14, "fifteen": 15, "sixteen": 16,
+	"seventeen": 17, "eighteen": 18, "nineteen": 19, "twenty": 20,
+	"thirty": 30, "forty": 40, "fourty": 40, "fifty": 50, "sixty": 60,
+	"seventy": 70, "eighty": 80, "ninety": 90,
+}
+
+// scaleWords multiply the number before them. Lakh and crore are used on
+// receipts from South Asia.
+var scaleWords = map[string]int{
+	"hundred": 100, "thousand": 1000, "lakh": 100000, "lakhs": 100000,
+	"million": 1000000, "crore": 10000000, "crores": 10000000,
+}
+
+// majorUnits and minorUnits are the currency words an amount in words is
+// given in, such as "dollars" and "cents".
+var (
+	majorUnits = wordSet("dollar", "dollars", "buck", "bucks", "euro", "euros", "pound", "pounds",
+		"rupee", "rupees", "peso", "pesos", "rand", "franc", "francs", "yen", "yuan", "ringgit", "shilling", "shillings")
+	minorUnits = wordSet("cent", "cents", "penny", "pence", "paisa", "paise", "centavo", "centavos", "centime", "centimes", "sen")
+)
+
+// fractionPattern matches the cents of a check-style amount, as in
+// "twenty-three and 50/100 dollars".
+var fractionPattern = regexp.MustCompile(`^(\d{1,2})/100$`)
+
+func wordSet(words ...string) map[string]bool {
+	set := make(map[string]bool, len(words))
+	for _, w := range words {
+		set[w] = true
+	}
+	return set
+}
+
+// WrittenAmount is an amount written out in words on a document.
+type WrittenAmount struct {
+	Value float64
+	Text  string // The words, lowercased, as found
+}
+
+// totalLabels mark a line as giving the total, as in "Amount in words:"
+// or "Total: twenty dollars". discountWords mark a promotion or discount
+// line, which can name an amount in words without it being the total.
+var (
+	totalLabels   = wordSet("total", "amount", "sum", "balance", "due", "payable")
+	discountWords = wordSet("save", "saves", "saving", "savings", "off", "discount", "coupon", "promo", "promotion", "rebate", "deal", "free")
+)
+
+// FindWrittenAmount returns the last amount written in words in lines, as
+// handwritten receipts and receipts from some countries print their
+// totals: "twenty-three dollars and fifty cents", "Rupees One Thousand
+// Two Hundred Only", or "Twenty-three and 50/100 dollars". Only number
+// words next to a currency word count, so item names like "Five Guys"
+// aren't amounts. Lines are read as one text, since a total in words
+// often wraps.
+//
+// An amount is only taken for a total when it reads like one: it has
+// cents or ends in "only", or a total label comes before it on its line
+// or the line above. Amounts on discount lines never count, so neither
+// "FIVE DOLLAR FOOTLONG" nor "SAVE TEN DOLLARS" is a total.
+func FindWrittenAmount(lines []string) (WrittenAmount, bool) {
+	var tokens []string
+	var lineOf []int
+	for n, line := range lines {
+		for _, t := range amountTokens(line) {
+			tokens = append(tokens, t)
+			lineOf = append(lineOf, n)
+		}
+	}
+	var found WrittenAmount
+	ok := false
+	for i := 0; i < len(tokens); {
+		amount, end := writtenAmountAt(tokens, i)
+		if end == i {
+			i++
+			continue
+		}
+		// Cents alone, like "fifty cents off", are promotions more often
+		// than totals
+		if amount >= 1 && totalContext(tokens, lineOf, i, end) {
+			found = WrittenAmount{Value: amount, Text: strings.Join(tokens[i:end], " ")}
+			ok = true
+		}
+		i = end
+	}
+	return found, ok
+}
+
+// totalContext reports whether the amount in tokens[i:end] reads like a
+// total rather than part of an item or discount line.
+func totalContext(tokens []string, lineOf []int, i, end int) bool {
+	first, last := lineOf[i], lineOf[end-1]
+	for j, t := range tokens {
+		if lineOf[j] >= first && lineOf[j] <= last && discountWords[t] {
+			return false
+		}
+	}
+	for _, t := range tokens[i:end] {
+		if minorUnits[t] || fractionPattern.MatchString(t) || t == "only" {
+			return true
+		}
+	}
+	for j := i - 1; j >= 0 && lineOf[j] >= first-1; j-- {
+		if totalLabels[tokens[j]] {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseWrittenAmount parses s as an amount in words, returning false unless
+// all of s is one.
+func ParseWrittenAmount(s string) (float64, bool) {
+	tokens := amountTokens(s)
+	if len(tokens) == 0 {
+		return 0, false
+	}
+	amount, end := writtenAmountAt(tokens, 0)
+	if end != len(tokens) {
+		return 0, false
+	}
+	return amount, true
+}
+
+// amountTokens lowercases s and splits it into words, keeping fractions
+// like 50/100 whole and splitting hyphenated numbers.
+func amountTokens(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '/'
+	})
+}
+
+// writtenAmountAt parses an amount in words starting at tokens[i],
+// returning it and the index after it, or i if there is none there.
+func writtenAmountAt(tokens []string, i int) (float64, int) {
+	at := func(j int) string {
+		if j < len(tokens) {
+			return tokens[j]
+		}
+		return ""
+	}
+
+	// A leading currency word: "rupees one thousand only"
+	leadingUnit := majorUnits[at(i)]
+	j := i
+	if leadingUnit {
+		j++
+	}
+	major, next := numberAt(tokens, j)
+	if next == j {
+		return 0, i
+	}
+	j = next
+
+	switch {
+	case leadingUnit:
+	case minorUnits[at(j)]:
+		// Cents alone, as in "fifty cents"
+		minor, end := minorAt(tokens, i)
+		if end == i {
+			return 0, i
+		}
+		return float64(minor) / 100, skipOnly(tokens, end)
+	case majorUnits[at(j)]:
+		j++
+	case at(j) == "and" && fractionPattern.MatchString(at(j+1)):
+		// "twenty-three and 50/100 dollars"; the currency word is optional
+		// since checks print it before the blank
+		cents, _ := strconv.Atoi(fractionPattern.FindStringSubmatch(at(j + 1))[1])
+		j += 2
+		if majorUnits[at(j)] {
+			j++
+		}
+		return roundCents(float64(major) + float64(cents)/100), skipOnly(tokens, j)
+	default:
+		return 0, i
+	}
+
+	// Cents after the dollars: "and fifty cents", "and 50/100"
+	k := j
+	if at(k) == "and" {
+		k++
+	}
+	if m := fractionPattern.FindStringSubmatch(at(k)); m != nil {
+		cents, _ := strconv.Atoi(m[1])
+		return roundCents(float64(major) + float64(cents)/100), skipOnly(tokens, k+1)
+	}
+	if minor, end := minorAt(tokens, k); end != k {
+		return roundCents(float64(major) + float64(minor)/100), skipOnly(tokens, end)
+	}
+	return float64(major), skipOnly(tokens, j)
+}
+
+// minorAt parses cents in words, such as "fifty cents", at tokens[i],
+// returning them and the index after them, or i if there are none there.
+func minorAt(tokens []string, i int) (int, int) {
+	minor, end := numberAt(tokens, i)
+	if end == i || end >= len(tokens) || !minorUnits[tokens[end]] || minor >= 100 {
+		return 0, i
+	}
+	return minor, end + 1
+}
+
+// skipOnly steps over the "only" that often ends an amount in words.
+func skipOnly(tokens []string, i int) int {
+	if i < len(tokens) && tokens[i] == "only" {
+		return i + 1
+	}
+	return i
+}
+
+// numberAt parses a number in words, such as "one thousand two hundred and
+// five", at tokens[i], returning it and the index after it, or i if there
+// is none there.
+func numberAt(tokens []string, i int) (int, int) {
+	total, current := 0, 0
+	j, end := i, i
+	for j < len(tokens) {
+		word := tokens[j]
+		if n, ok := numberWords[word]; ok {
+			current += n
+		} else if word == "a" && j == i && j+1 < len(tokens) && scaleWords[tokens[j+1]] > 0 {
+			// "a hundred dollars"
+			current = 1
+		} else if scale, ok := scaleWords[word]; ok && j > i {
+			if current == 0 {
+				current = 1
+			}
+			if scale == 100 {
+				current *= scale
+			} else {
+				total += current * scale
+				current = 0
+			}
+		} else if word == "and" && j > i && j+1 < len(tokens) {
+			// "one hundred and five", but not the "and" before cents
+			if _, ok := numberWords[tokens[j+1]]; !ok || minorAhead(tokens, j+1) {
+				break
+			}
+		} else {
+			break
+		}
+		j++
+		if word != "and" {
+			end = j
+		}
+	}
+	if end == i {
+		return 0, i
+	}
+	return total + current, end
+}
+
+// minorAhead reports whether the number words from tokens[i] end in a
+// minor currency word, making them cents.
+func minorAhead(tokens []string, i int) bool {
+	for ; i < len(tokens); i++ {
+		if _, ok := numberWords[tokens[i]]; !ok {
+			return minorUnits[tokens[i]]
+		}
+	}
+	return false
+}
+
+// roundCents rounds v to the cent.
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// writtenTotalAnomaly describes how a total compares with the amount in
+// words, or returns "" when they agree.
+func writtenTotalAnomaly(total *float64, written WrittenAmount) string {
+	switch {
+	case total == nil:
+		return fmt.Sprintf("total taken from the amount written in words (%q = %.2f)", written.Text, written.Value)
+	case math.Abs(*total-written.Value) >= 0.005:
+		return fmt.Sprintf("total is %.2f but the amount written in words (%q) is %.2f", *total, written.Text, written.Value)
+	}
+	return ""
+}
+
+// CheckWrittenTotal cross-checks the total against an amount written in
+// words in lines, the document's OCR text. A null total is filled in from
+// the words, and a total that disagrees with them is kept but noted in
+// Anomalies, since either may be the misreading.
+func (r *Receipt) CheckWrittenTotal(lines []string) {
+	written, ok := FindWrittenAmount(lines)
+	if !ok {
+		return
+	}
+	if note := writtenTotalAnomaly(r.Total, written); note != "" {
+		r.Anomalies = append(r.Anomalies, note)
+	}
+	if r.Total == nil {
+		r.Total = Amount(written.Value)
+		delete(r.Unknown, "total")
+	}
+}
+
+// CheckWrittenTotal cross-checks an invoice's total as Receipt's does.
+func (inv *Invoice) CheckWrittenTotal(lines []string) {
+	written, ok := FindWrittenAmount(lines)
+	if !ok {
+		return
+	}
+	if note := writtenTotalAnomaly(inv.Total, written); note != "" {
+		inv.Anomalies = append(inv.Anomalies, note)
+	}
+	if inv.Total == nil {
+		inv.Total = Amount(written.Value)
+		delete(inv.Unknown, "total")
+	}
+}
@@ -0,0 +1,103 @@
+package receipt
+
+import "testing"
+
+func TestFindWrittenAmount(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  float64
+		found bool
+	}{
+		{
+			name:  "dollars and cents",
+			lines: []string{"Received with thanks", "Twenty-three dollars and fifty cents"},
+			want:  23.50,
+			found: true,
+		},
+		{
+			name:  "check fraction",
+			lines: []string{"Twenty-three and 50/100 dollars"},
+			want:  23.50,
+			found: true,
+		},
+		{
+			name:  "ending in only",
+			lines: []string{"Rupees One Lakh Twenty Thousand Only"},
+			want:  120000,
+			found: true,
+		},
+		{
+			name:  "total label",
+			lines: []string{"TOTAL: forty dollars"},
+			want:  40,
+			found: true,
+		},
+		{
+			// The label is often on its own line above the words
+			name:  "label on the line above",
+			lines: []string{"Amount in words:", "Forty dollars"},
+			want:  40,
+			found: true,
+		},
+		{
+			name:  "wrapped onto the next line",
+			lines: []string{"Total: twenty-three dollars", "and fifty cents"},
+			want:  23.50,
+			found: true,
+		},
+		{
+			name:  "item name",
+			lines: []string{"FIVE DOLLAR FOOTLONG 5.00", "TOTAL 5.35"},
+		},
+		{
+			name:  "savings line",
+			lines: []string{"SAVE TEN DOLLARS", "TOTAL 42.10"},
+		},
+		{
+			name:  "discount with cents",
+			lines: []string{"Coupon: two dollars and fifty cents off"},
+		},
+		{
+			// A total label two lines up doesn't reach the item
+			name:  "label too far above",
+			lines: []string{"Order total", "2x", "Ten dollar meal deal"},
+		},
+		{
+			name:  "item before a labeled total",
+			lines: []string{"FIVE DOLLAR FOOTLONG", "Total: six dollars and forty cents"},
+			want:  6.40,
+			found: true,
+		},
+		{
+			name:  "cents alone",
+			lines: []string{"Total fifty cents"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := FindWrittenAmount(tt.lines)
+			if ok != tt.found {
+				t.Fatalf("FindWrittenAmount(%q) found = %v, want %v (got %+v)", tt.lines, ok, tt.found, got)
+			}
+			if ok && got.Value != tt.want {
+				t.Errorf("FindWrittenAmount(%q) = %v, want %v", tt.lines, got.Value, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckWrittenTotalIgnoresItems(t *testing.T) {
+	total := 5.35
+	r := Receipt{Total: &total}
+	r.CheckWrittenTotal([]string{"FIVE DOLLAR FOOTLONG 5.00", "SAVE TEN DOLLARS", "TOTAL 5.35"})
+	if len(r.Anomalies) != 0 {
+		t.Errorf("Anomalies = %q, want none", r.Anomalies)
+	}
+
+	r = Receipt{}
+	r.CheckWrittenTotal([]string{"FIVE DOLLAR FOOTLONG"})
+	if r.Total != nil {
+		t.Errorf("Total = %v, want nil", *r.Total)
+	}
+}
@@ -0,0 +1,140 @@
+// Package redact scrubs secrets from text before it is logged or returned
+// in an error: API keys and tokens the process was configured with, and
+// anything shaped like a credential, such as an Authorization header, a
+// bearer token, an AWS access key ID, or the signature of a signed URL.
+//
+// Secrets are replaced by [REDACTED], keeping the name they were given
+// under ("Authorization: [REDACTED]", "?X-Amz-Signature=[REDACTED]") so the
+// line still says what was there.
+package redact
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mask replaces each secret.
+const Mask = "[REDACTED]"
+
+// MinSecretLen is the shortest registered secret that is scrubbed. Shorter
+// values would match ordinary words and numbers in the text.
+const MinSecretLen = 8
+
+var (
+	mu      sync.RWMutex
+	secrets []string // Longest first, so a secret containing another goes whole
+)
+
+// Register adds secrets to scrub wherever they appear, such as configured
+// API keys. Empty and short values are ignored.
+func Register(values ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if len(v) < MinSecretLen || contains(secrets, v) {
+			continue
+		}
+		secrets = append(secrets, v)
+	}
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+// RegisterEnv registers the values of the named environment variables.
+func RegisterEnv(names ...string) {
+	for _, name := range names {
+		Register(os.Getenv(name))
+	}
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// patterns recognize credentials by their shape, each replaced as its
+// template says, keeping what its groups matched, such as the name of a
+// header.
+var patterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// Header and config style: "Authorization: Bearer ...", "x-api-key=...",
+	// "aws_secret_access_key = ...", and JSON fields of those names
+	{regexp.MustCompile(`(?i)(\b(?:proxy-)?authorization|\bx-api-key|\bapi[_-]?key|\baccess[_-]?token|\brefresh[_-]?token|\bclient[_-]?secret|\bsession[_-]?token|\baws[_-]?secret[_-]?access[_-]?key|\bpassword)("?\s*[:=]\s*"?)(?:(?:bearer|basic)\s+)?[^\s"'&,;]+`), "${1}${2}" + Mask},
+	// A bearer token on its own
+	{regexp.MustCompile(`(?i)(\bbearer\s+)[\w.~+/=-]{8,}`), "${1}" + Mask},
+	// Signatures and credentials in URL query strings, such as presigned S3
+	// URLs
+	{regexp.MustCompile(`(?i)([?&](?:x-amz-signature|x-amz-credential|x-amz-security-token|signature|sig|token|key|api_key|access_token)=)[^&\s"'#]+`), "${1}" + Mask},
+	// Passwords in URLs, such as DATABASE_URL
+	{regexp.MustCompile(`(\b[a-zA-Z][\w+.-]*://[^/\s:@]*:)[^/\s@]+@`), "${1}" + Mask + "@"},
+	// Signed upload and share link tokens, which are the URL's path
+	{regexp.MustCompile(`(/api/(?:uploads/signed|shared)/)[\w-]+\.[\w-]+`), "${1}" + Mask},
+	// Anthropic and OpenAI keys
+	{regexp.MustCompile(`\bsk-(?:ant-)?[\w-]{16,}`), Mask},
+	// AWS access key IDs
+	{regexp.MustCompile(`\b(?:AKIA|ASIA)[A-Z0-9]{16}\b`), Mask},
+}
+
+// String returns s with every secret in it masked.
+func String(s string) string {
+	mu.RLock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, Mask)
+	}
+	mu.RUnlock()
+	for _, p := range patterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// Error returns err with its message scrubbed, still wrapping err for
+// errors.Is and errors.As. It returns err itself when there is nothing to
+// scrub.
+func Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := String(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{err: err, msg: msg}
+}
+
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e *redactedError) Error() string { return e.msg }
+func (e *redactedError) Unwrap() error { return e.err }
+
+// Writer returns a writer that scrubs what is written to it, a line at a
+// time as the log package writes, before writing it to w. Pass it to
+// log.SetOutput to scrub everything logged.
+func Writer(w io.Writer) io.Writer {
+	return writer{w: w}
+}
+
+type writer struct {
+	w io.Writer
+}
+
+// Write scrubs p and writes it, reporting all of p as written.
+func (w writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,273 @@
+// Package report provides expense report bundles: totals by category, a
+// CSV manifest, and a PDF with the receipt images. Mileage and per diem
+// entries are totaled alongside the receipts.
+package report
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"myprice/internal/expense"
+	"myprice/internal/store"
+)
+
+// Expense is an expense report with its receipts and their totals.
+type Expense struct {
+	expense.Report
+	GeneratedAt time.Time        `json:"generated_at"`
+	Receipts    []ExpenseReceipt `json:"receipts"`
+	Entries     []ExpenseEntry   `json:"entries,omitempty"`
+	Total       float64          `json:"total"`
+	Tax         float64          `json:"tax"`
+	Categories  []Line           `json:"categories"`
+	Missing     []string         `json:"missing,omitempty"` // Receipts and entries deleted since the report was made
+}
+
+// ExpenseReceipt is one receipt in an expense report.
+type ExpenseReceipt struct {
+	Number     int      `json:"number"` // 1-based, as in the PDF and manifest
+	ID         string   `json:"id"`
+	Date       string   `json:"date"`
+	Vendor     string   `json:"vendor"`
+	MCC        string   `json:"vendor_category,omitempty"` // Merchant category code of the vendor
+	Categories []string `json:"categories,omitempty"`
+	Tax        float64  `json:"tax"`
+	Total      float64  `json:"total"`
+	Image      string   `json:"image,omitempty"` // File name of the original image
+}
+
+// ExpenseEntry is a mileage or per diem entry in an expense report,
+// numbered after the receipts.
+type ExpenseEntry struct {
+	Number int `json:"number"`
+	expense.Entry
+}
+
+// entryCategory is the category an entry's amount is totaled under.
+func entryCategory(kind expense.EntryKind) string {
+	if kind == expense.KindPerDiem {
+		return "per diem"
+	}
+	return string(kind)
+}
+
+// entryDetails describes how an entry's amount was worked out.
+func entryDetails(e expense.Entry) string {
+	if e.Kind == expense.KindPerDiem {
+		return fmt.Sprintf("%g days at %s, %s to %s", e.Days, money(e.Rate), e.Date, e.LastDate())
+	}
+	return fmt.Sprintf("%g mi at %s", e.Miles, money(e.Rate))
+}
+
+// BuildExpense totals the receipts and entries of rep. records holds the
+// stored record for each of rep.ReceiptIDs, in order, and entries the entry
+// for each of rep.EntryIDs, with nil for one that no longer exists.
+// Receipts are split between categories as in Build. Entries are totaled
+// as "mileage" and "per diem".
+func BuildExpense(rep expense.Report, records []*store.Record, entries []*expense.Entry, now time.Time) *Expense {
+	e := &Expense{
+		Report:      rep,
+		GeneratedAt: now.UTC(),
+		Receipts:    make([]ExpenseReceipt, 0, len(records)),
+		Categories:  make([]Line, 0),
+	}
+
+	categories := make(map[string]*Line)
+	for i, rec := range records {
+		if rec == nil {
+			e.Missing = append(e.Missing, rep.ReceiptIDs[i])
+			continue
+		}
+		pu := fromRecord(rec)
+		er := ExpenseReceipt{
+			Number:     len(e.Receipts) + 1,
+			ID:         rec.ID,
+			Date:       pu.date,
+			Vendor:     pu.vendor,
+			MCC:        pu.category.Code,
+			Categories: pu.categories,
+			Tax:        roundCents(pu.tax),
+			Total:      roundCents(pu.total),
+		}
+		if rec.ImagePath != "" {
+			er.Image = baseName(rec.ImagePath)
+		}
+		e.Receipts = append(e.Receipts, er)
+		e.Total += pu.total
+		e.Tax += pu.tax
+
+		cats := pu.spendCategories()
+		for _, c := range cats {
+			addLine(categories, c, pu.total/float64(len(cats)))
+		}
+	}
+	for i, en := range entries {
+		if en == nil {
+			e.Missing = append(e.Missing, rep.EntryIDs[i])
+			continue
+		}
+		e.Entries = append(e.Entries, ExpenseEntry{Number: len(e.Receipts) + len(e.Entries) + 1, Entry: *en})
+		e.Total += en.Amount
+		addLine(categories, entryCategory(en.Kind), en.Amount)
+	}
+	e.Total, e.Tax = roundCents(e.Total), roundCents(e.Tax)
+	e.Categories = sortedLines(categories, e.Total, 0)
+	return e
+}
+
+// baseName returns the last element of a slash- or backslash-separated path.
+func baseName(path string) string {
+	if i := strings.LastIndexAny(path, `/\`); i >= 0 {
+		return path[i+1:]
+	}
+	return path
+}
+
+// RenderExpenseCSV writes the manifest of e: a row per receipt and entry,
+// numbered as in the PDF. Entries give their description as the vendor and
+// how their amount was worked out as details.
+func RenderExpenseCSV(out io.Writer, e *Expense) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"number", "kind", "id", "date", "vendor", "vendor_category", "categories", "tax", "total", "image", "details"})
+	for _, r := range e.Receipts {
+		w.Write([]string{
+			fmt.Sprint(r.Number),
+			"receipt",
+			r.ID,
+			r.Date,
+			r.Vendor,
+			r.MCC,
+			strings.Join(r.Categories, "; "),
+			fmt.Sprintf("%.2f", r.Tax),
+			fmt.Sprintf("%.2f", r.Total),
+			r.Image,
+			"",
+		})
+	}
+	for _, en := range e.Entries {
+		w.Write([]string{
+			fmt.Sprint(en.Number),
+			string(en.Kind),
+			en.ID,
+			en.Date,
+			en.Description,
+			"",
+			entryCategory(en.Kind),
+			"0.00",
+			fmt.Sprintf("%.2f", en.Amount),
+			"",
+			entryDetails(en.Entry),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// RenderExpensePDF writes e as a PDF: a summary page with totals by
+// category and the lists of receipts and entries, then a page per receipt
+// with its image. images holds each receipt's image as a JPEG, by receipt ID;
+// receipts without one get a page saying so.
+func RenderExpensePDF(out io.Writer, e *Expense, images map[string][]byte) error {
+	w := newPDFWriter()
+	left, right := pageMargin, pageWidth-pageMargin
+
+	w.text(left, truncate("Expense report: "+e.Title, right-left, 20), 20, true)
+	w.line(18)
+	meta := fmt.Sprintf("%s to %s", e.From, e.To)
+	if e.Owner != "" {
+		meta += " - " + e.Owner
+	}
+	meta += " - generated " + e.GeneratedAt.Format("2006-01-02 15:04 MST")
+	w.text(left, meta, 9, false)
+	w.line(16)
+	if e.Purpose != "" {
+		w.text(left, truncate("Purpose: "+e.Purpose, right-left, 10), 10, false)
+		w.line(16)
+	}
+	w.line(12)
+
+	w.text(left, "Total", 10, false)
+	w.text(left+170, "Receipts and entries", 10, false)
+	w.text(left+340, "Tax", 10, false)
+	w.line(18)
+	w.text(left, money(e.Total), 16, true)
+	w.text(left+170, fmt.Sprint(len(e.Receipts)+len(e.Entries)), 16, true)
+	w.text(left+340, money(e.Tax), 16, true)
+	w.line(30)
+
+	if len(e.Missing) > 0 {
+		w.text(left, fmt.Sprintf("%d receipt(s) or entries in this report have since been deleted and are not included.", len(e.Missing)), 10, false)
+		w.line(20)
+	}
+
+	pdfHeading(w, "By category")
+	categories := make([][]string, len(e.Categories))
+	for i, l := range e.Categories {
+		categories[i] = []string{l.Name, fmt.Sprint(l.Receipts), money(l.Amount), fmt.Sprintf("%.1f%%", l.Share*100)}
+	}
+	pdfTable(w, []column{
+		{title: "Category", x: left, width: 280},
+		{title: "Count", x: 400, right: true},
+		{title: "Amount", x: 480, right: true},
+		{title: "Share", x: right, right: true},
+	}, categories)
+
+	pdfHeading(w, "Receipts")
+	receipts := make([][]string, len(e.Receipts))
+	for i, r := range e.Receipts {
+		receipts[i] = []string{fmt.Sprint(r.Number), r.Date, r.Vendor, strings.Join(r.Categories, ", "), money(r.Total)}
+	}
+	pdfTable(w, []column{
+		{title: "#", x: left + 14, right: true},
+		{title: "Date", x: left + 24, width: 70},
+		{title: "Vendor", x: left + 100, width: 170},
+		{title: "Categories", x: left + 280, width: 150},
+		{title: "Total", x: right, right: true},
+	}, receipts)
+
+	if len(e.Entries) > 0 {
+		pdfHeading(w, "Mileage and per diem")
+		entries := make([][]string, len(e.Entries))
+		for i, en := range e.Entries {
+			entries[i] = []string{fmt.Sprint(en.Number), en.Date, en.Description, entryDetails(en.Entry), money(en.Amount)}
+		}
+		pdfTable(w, []column{
+			{title: "#", x: left + 14, right: true},
+			{title: "Date", x: left + 24, width: 70},
+			{title: "Description", x: left + 100, width: 170},
+			{title: "Details", x: left + 280, width: 150},
+			{title: "Amount", x: right, right: true},
+		}, entries)
+	}
+
+	// A page per receipt, its image scaled to fill what's left below the
+	// heading without distorting it
+	for _, r := range e.Receipts {
+		w.newPage()
+		w.text(left, truncate(fmt.Sprintf("Receipt %d: %s", r.Number, r.Vendor), right-left-120, 14), 14, true)
+		w.textRight(right, money(r.Total), 14, true)
+		w.line(16)
+		w.text(left, r.Date+" - "+r.ID, 9, false)
+		w.line(16)
+
+		data, ok := images[r.ID]
+		if !ok {
+			w.text(left, "Image not available.", 10, false)
+			continue
+		}
+		i, err := w.addImage(data)
+		if err != nil {
+			return fmt.Errorf("receipt %s: %w", r.ID, err)
+		}
+		img := w.images[i]
+		boxWidth, boxHeight := right-left, w.y-pageMargin
+		scale := min(boxWidth/float64(img.width), boxHeight/float64(img.height))
+		width, height := float64(img.width)*scale, float64(img.height)*scale
+		w.drawImage(i, left+(boxWidth-width)/2, w.y-height, width, height)
+	}
+
+	return w.writeTo(out)
+}
@@ -0,0 +1,273 @@
+package report
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"myprice/internal/store"
+)
+
+const (
+	// MinForecastMonths is the fewest complete months of history a
+	// forecast is made from.
+	MinForecastMonths = 3
+
+	// maxForecastMonths bounds the history a forecast looks at, so habits
+	// from years ago don't weigh on it.
+	maxForecastMonths = 36
+
+	// seasonalMonths is the history needed to see each calendar month at
+	// least once, so seasonal indexes can be estimated.
+	seasonalMonths = 12
+
+	// z80 and z95 are the normal quantiles of 80% and 95% intervals.
+	z80 = 1.2816
+	z95 = 1.9600
+)
+
+// Forecast projects one month's spending from the complete months before
+// the current one.
+type Forecast struct {
+	Month         Period    `json:"month"` // The month projected
+	GeneratedAt   time.Time `json:"generated_at"`
+	Owner         string    `json:"owner,omitempty"`
+	Workspace     string    `json:"workspace,omitempty"`
+	Tags          []string  `json:"tags,omitempty"`
+	MinQuality    int       `json:"min_quality,omitempty"`
+	HistoryFrom   string    `json:"history_from,omitempty"` // First month of history, "2025-01"
+	HistoryTo     string    `json:"history_to,omitempty"`   // Last complete month of history
+	HistoryMonths int       `json:"history_months"`
+	Method        string    `json:"method,omitempty"` // "seasonal" or "average"; empty without enough history
+
+	Total      *Projection          `json:"total"` // Nil without enough history
+	Categories []CategoryProjection `json:"categories"`
+}
+
+// Projection is a projected amount and the ranges the actual amount should
+// fall in 80% and 95% of the time, were spending to continue as before.
+type Projection struct {
+	Amount float64 `json:"amount"`
+	Low80  float64 `json:"low_80"`
+	High80 float64 `json:"high_80"`
+	Low95  float64 `json:"low_95"`
+	High95 float64 `json:"high_95"`
+}
+
+// CategoryProjection is the projection for one spending category, with the
+// amounts it is easiest to compare with.
+type CategoryProjection struct {
+	Name string `json:"name"`
+	Projection
+	Average           float64  `json:"average"`                        // Monthly, over the last 12 months of history or fewer
+	LastMonth         float64  `json:"last_month"`                     // The last month of history
+	SameMonthLastYear *float64 `json:"same_month_last_year,omitempty"` // When in history
+}
+
+// series is one category's spending in each month of history, oldest first.
+type series struct {
+	name   string
+	amount []float64
+}
+
+// BuildForecast projects spending in month by category from the latest
+// version of each record purchased in the complete months before now's,
+// up to three years of them. Categories are split as in Build.
+//
+// Each category is projected as its average monthly spend over the last
+// 12 months of history (or all of it, when shorter). With 12 months or
+// more, that is scaled by a seasonal index for month's calendar month: how
+// its spending compared with the overall average, shrunk toward 1 when it
+// was seen only once or twice. Intervals come from how far each past month
+// was from what the same method would have projected for it, assuming
+// normally distributed errors. The total is the sum of the categories.
+func BuildForecast(records []*store.Record, month Period, now time.Time) *Forecast {
+	f := &Forecast{Month: month, GeneratedAt: now.UTC(), Categories: make([]CategoryProjection, 0)}
+
+	// History runs from the first purchase month to last month
+	current := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	end := current.AddDate(0, -1, 0)
+	earliest := current.AddDate(0, -maxForecastMonths, 0)
+	var purchases []purchase
+	start := current
+	for _, rec := range records {
+		if rec.SupersededBy != "" {
+			continue
+		}
+		pu := fromRecord(rec)
+		day, err := time.Parse("2006-01-02", pu.date)
+		if err != nil {
+			continue
+		}
+		first := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+		if first.Before(earliest) || !first.Before(current) {
+			continue
+		}
+		if first.Before(start) {
+			start = first
+		}
+		purchases = append(purchases, pu)
+	}
+	if len(purchases) == 0 {
+		return f
+	}
+	n := monthsBetween(start, end) + 1
+	f.HistoryFrom, f.HistoryTo, f.HistoryMonths = start.Format("2006-01"), end.Format("2006-01"), n
+	if n < MinForecastMonths {
+		return f
+	}
+
+	byName := make(map[string]*series)
+	for _, pu := range purchases {
+		day, _ := time.Parse("2006-01-02", pu.date)
+		i := monthsBetween(start, day)
+		cats := pu.spendCategories()
+		for _, c := range cats {
+			s, ok := byName[c]
+			if !ok {
+				s = &series{name: c, amount: make([]float64, n)}
+				byName[c] = s
+			}
+			s.amount[i] += pu.total / float64(len(cats))
+		}
+	}
+
+	target, _ := time.Parse("2006-01-02", month.From)
+	seasonal := n >= seasonalMonths
+	f.Method = "average"
+	if seasonal {
+		f.Method = "seasonal"
+	}
+
+	// Past months the method can be checked against: each after the first,
+	// projected from the months before it
+	fittedTotal := make([]float64, n)
+	actualTotal := make([]float64, n)
+	var total float64
+	for _, s := range byName {
+		index := seasonalIndexes(s.amount, start, seasonal)
+		// Refunds can leave a category below zero; nothing is spent then
+		amount := math.Max(trailingMean(s.amount, n)*index[target.Month()-1], 0)
+		total += amount
+
+		var sq float64
+		for t := 1; t < n; t++ {
+			fitted := trailingMean(s.amount, t)
+			if seasonal && t >= seasonalMonths {
+				fitted *= index[start.AddDate(0, t, 0).Month()-1]
+			}
+			sq += (s.amount[t] - fitted) * (s.amount[t] - fitted)
+			fittedTotal[t] += fitted
+			actualTotal[t] += s.amount[t]
+		}
+
+		cp := CategoryProjection{
+			Name:       s.name,
+			Projection: project(amount, math.Sqrt(sq/float64(n-1)), n),
+			Average:    roundCents(trailingMean(s.amount, n)),
+			LastMonth:  roundCents(s.amount[n-1]),
+		}
+		if cp.Amount == 0 && cp.Average == 0 {
+			continue // Nothing spent on it in the last year
+		}
+		if i := monthsBetween(start, target.AddDate(-1, 0, 0)); i >= 0 && i < n {
+			same := roundCents(s.amount[i])
+			cp.SameMonthLastYear = &same
+		}
+		f.Categories = append(f.Categories, cp)
+	}
+
+	var sq float64
+	for t := 1; t < n; t++ {
+		sq += (actualTotal[t] - fittedTotal[t]) * (actualTotal[t] - fittedTotal[t])
+	}
+	p := project(total, math.Sqrt(sq/float64(n-1)), n)
+	f.Total = &p
+
+	sort.Slice(f.Categories, func(i, j int) bool {
+		if f.Categories[i].Amount != f.Categories[j].Amount {
+			return f.Categories[i].Amount > f.Categories[j].Amount
+		}
+		return f.Categories[i].Name < f.Categories[j].Name
+	})
+	return f
+}
+
+// ForecastMonth returns the month after now's, the default month to
+// project.
+func ForecastMonth(now time.Time) Period {
+	next := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 1, 0)
+	return monthPeriod(next.Year(), next.Month())
+}
+
+// trailingMean returns the mean of the up to 12 months of amount before t.
+func trailingMean(amount []float64, t int) float64 {
+	from := max(t-seasonalMonths, 0)
+	if t <= from {
+		return 0
+	}
+	var sum float64
+	for _, a := range amount[from:t] {
+		sum += a
+	}
+	return sum / float64(t-from)
+}
+
+// seasonalIndexes returns, for each calendar month, how spending in it
+// compared with the average month, from amount's months beginning at
+// start. An index seen k times is shrunk toward 1 by k/(k+1), so one
+// unusual month doesn't set the next year's projection. Without seasonal,
+// or for months without spending to compare, every index is 1.
+func seasonalIndexes(amount []float64, start time.Time, seasonal bool) [12]float64 {
+	var index [12]float64
+	for m := range index {
+		index[m] = 1
+	}
+	if !seasonal {
+		return index
+	}
+
+	var mean float64
+	for _, a := range amount {
+		mean += a
+	}
+	mean /= float64(len(amount))
+	if mean <= 0 {
+		return index
+	}
+
+	var sums [12]float64
+	var counts [12]int
+	for i, a := range amount {
+		m := start.AddDate(0, i, 0).Month() - 1
+		sums[m] += a
+		counts[m]++
+	}
+	for m := range index {
+		if counts[m] == 0 {
+			continue
+		}
+		raw := sums[m] / float64(counts[m]) / mean
+		k := float64(counts[m])
+		index[m] = 1 + (raw-1)*k/(k+1)
+	}
+	return index
+}
+
+// project returns amount with intervals for errors of standard deviation
+// sd, widened for the uncertainty of a mean of n months.
+func project(amount, sd float64, n int) Projection {
+	spread := sd * math.Sqrt(1+1/float64(min(n, seasonalMonths)))
+	return Projection{
+		Amount: roundCents(amount),
+		Low80:  roundCents(math.Max(amount-z80*spread, 0)),
+		High80: roundCents(amount + z80*spread),
+		Low95:  roundCents(math.Max(amount-z95*spread, 0)),
+		High95: roundCents(amount + z95*spread),
+	}
+}
+
+// monthsBetween returns how many calendar months t is after from.
+func monthsBetween(from, t time.Time) int {
+	return (t.Year()-from.Year())*12 + int(t.Month()) - int(from.Month())
+}
@@ -0,0 +1,121 @@
+// Package report provides the HTML rendering of spending reports.
+package report
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+)
+
+const (
+	// chartWidth is the width in pixels of the longest bar in a chart.
+	chartWidth = 320
+
+	// labelWidth is the room to the right of a bar for its label.
+	labelWidth = 300
+)
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"money": money,
+	"join":  strings.Join,
+	"pct":   func(v float64) string { return fmt.Sprintf("%.1f%%", v*100) },
+	"signed": func(v float64) string {
+		return fmt.Sprintf("%+.1f%%", v)
+	},
+	"bar": func(amount float64, lines []Line) int {
+		if len(lines) == 0 || lines[0].Amount <= 0 {
+			return 0
+		}
+		return int(amount / lines[0].Amount * chartWidth)
+	},
+	"chartHeight": func(lines []Line) int { return len(lines)*24 + 4 },
+	"rowY":        func(i int) int { return i*24 + 2 },
+	"textY":       func(i int) int { return i*24 + 17 },
+	"svgWidth":    func() int { return chartWidth + labelWidth },
+	"labelX":      func(w int) int { return w + 6 },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Spending report: {{.Period.Label}}</title>
+<style>
+body { font-family: -apple-system, "Helvetica Neue", Arial, sans-serif; color: #222; max-width: 860px; margin: 2em auto; padding: 0 1em; }
+h1 { margin-bottom: 0.2em; }
+.meta { color: #666; margin-top: 0; }
+.summary { display: flex; gap: 2em; margin: 1.5em 0; }
+.summary div { background: #f4f6f8; border-radius: 6px; padding: 0.8em 1.2em; }
+.summary strong { display: block; font-size: 1.5em; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1.5em; }
+th, td { text-align: left; padding: 0.35em 0.6em; border-bottom: 1px solid #e3e3e3; }
+td.num, th.num { text-align: right; font-variant-numeric: tabular-nums; }
+.up { color: #b3261e; }
+.down { color: #1e7b34; }
+svg text { font-size: 12px; fill: #333; }
+</style>
+</head>
+<body>
+<h1>Spending report: {{.Period.Label}}</h1>
+<p class="meta">{{.Period.From}} to {{.Period.To}}{{if .Workspace}} &middot; {{.Workspace}}{{end}}{{if .Owner}} &middot; {{.Owner}}{{end}}{{if .Tags}} &middot; tagged {{join .Tags ", "}}{{end}}{{if .MinQuality}} &middot; quality {{.MinQuality}}+{{end}} &middot; generated {{.GeneratedAt.Format "2006-01-02 15:04 MST"}}</p>
+
+<div class="summary">
+<div>Total spent<strong>{{money .Total}}</strong></div>
+<div>Receipts<strong>{{.Receipts}}</strong></div>
+<div>Tax<strong>{{money .Tax}}</strong></div>
+</div>
+{{if .TotalUnreadable}}<p class="meta">Total leaves out {{.TotalUnreadable}} receipt(s) whose total couldn't be read.</p>{{end}}
+{{if .TaxUnreadable}}<p class="meta">Tax leaves out {{.TaxUnreadable}} receipt(s) whose tax couldn't be read.</p>{{end}}
+{{if .Refunds}}<p class="meta">Total is net of {{.Refunds}} refund(s) totaling {{money .Refunded}}.</p>{{end}}
+{{if ne .OutOfPocket .Total}}<p class="meta">{{money .OutOfPocket}} of it came out of pocket; gift cards and store credit paid the rest.</p>{{end}}
+
+{{if not .Receipts}}<p>No receipts were found for this period.</p>{{else}}
+{{if .Members}}<h2>By member</h2>
+{{template "chart" .Members}}
+<table>
+<tr><th>Member</th><th class="num">Receipts</th><th class="num">Amount</th><th class="num">Share</th></tr>
+{{range .Members}}<tr><td>{{.Name}}</td><td class="num">{{.Receipts}}</td><td class="num">{{money .Amount}}</td><td class="num">{{pct .Share}}</td></tr>
+{{end}}</table>
+{{end}}
+<h2>By category</h2>
+{{template "chart" .Categories}}
+<table>
+<tr><th>Category</th><th class="num">Receipts</th><th class="num">Amount</th><th class="num">Share</th></tr>
+{{range .Categories}}<tr><td>{{.Name}}</td><td class="num">{{.Receipts}}</td><td class="num">{{money .Amount}}</td><td class="num">{{pct .Share}}</td></tr>
+{{end}}</table>
+
+<h2>By vendor category</h2>
+{{template "chart" .VendorTypes}}
+<table>
+<tr><th>Vendor category</th><th class="num">Receipts</th><th class="num">Amount</th><th class="num">Share</th></tr>
+{{range .VendorTypes}}<tr><td>{{.Name}}{{if .Code}} ({{.Code}}){{end}}</td><td class="num">{{.Receipts}}</td><td class="num">{{money .Amount}}</td><td class="num">{{pct .Share}}</td></tr>
+{{end}}</table>
+
+<h2>By vendor</h2>
+{{template "chart" .Vendors}}
+<table>
+<tr><th>Vendor</th><th class="num">Receipts</th><th class="num">Amount</th><th class="num">Share</th></tr>
+{{range .Vendors}}<tr><td>{{.Name}}</td><td class="num">{{.Receipts}}</td><td class="num">{{money .Amount}}</td><td class="num">{{pct .Share}}</td></tr>
+{{end}}</table>
+
+<h2>Top items</h2>
+<table>
+<tr><th>Item</th><th class="num">Purchases</th><th class="num">Qty</th><th class="num">Spent</th></tr>
+{{range .TopItems}}<tr><td>{{.Name}}</td><td class="num">{{.Purchases}}</td><td class="num">{{.Qty}}</td><td class="num">{{money .Spent}}</td></tr>
+{{end}}</table>
+
+<h2>Price changes</h2>
+{{if .PriceChanges}}<table>
+<tr><th>Item</th><th>Vendor</th><th class="num">Before</th><th class="num">Now</th><th class="num">Change</th></tr>
+{{range .PriceChanges}}<tr><td>{{.Item}}</td><td>{{.Vendor}}{{if .Store}} <small>{{.Store}}</small>{{end}}</td><td class="num">{{money .Previous}} <small>({{.PrevDate}})</small></td><td class="num">{{money .Current}} <small>({{.Date}})</small></td><td class="num {{if gt .ChangePct 0.0}}up{{else}}down{{end}}">{{signed .ChangePct}}</td></tr>
+{{end}}</table>{{else}}<p>No price changes against earlier purchases.</p>{{end}}
+{{end}}
+</body>
+</html>
+{{define "chart"}}<svg width="{{svgWidth}}" height="{{chartHeight .}}" viewBox="0 0 {{svgWidth}} {{chartHeight .}}" style="margin-bottom: 1em" role="img">
+{{$lines := .}}{{range $i, $l := .}}{{$w := bar $l.Amount $lines}}<rect x="0" y="{{rowY $i}}" width="{{$w}}" height="20" fill="#4a78b5"></rect><text x="{{labelX $w}}" y="{{textY $i}}">{{$l.Name}} {{money $l.Amount}}</text>
+{{end}}</svg>{{end}}`))
+
+// RenderHTML writes r as a standalone HTML page with inline SVG charts.
+func RenderHTML(w io.Writer, r *Report) error {
+	return htmlTemplate.Execute(w, r)
+}
@@ -0,0 +1,180 @@
+package report
+
+import (
+	"time"
+
+	"myprice/internal/store"
+)
+
+// Weekdays label the rows of a spending heatmap, Monday first.
+var Weekdays = []string{"Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"}
+
+// dayparts name the parts of the day by their first hour. Late night runs
+// past midnight, to 5 am.
+var dayparts = []struct {
+	name  string
+	start int
+}{
+	{"late_night", 0},
+	{"morning", 5},
+	{"afternoon", 11},
+	{"evening", 17},
+	{"late_night", 22},
+}
+
+// Patterns is spending in a period by time of day and day of week, in each
+// vendor's local time.
+type Patterns struct {
+	Period      Period    `json:"period"`
+	GeneratedAt time.Time `json:"generated_at"`
+	Owner       string    `json:"owner,omitempty"`
+	Workspace   string    `json:"workspace,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	MinQuality  int       `json:"min_quality,omitempty"`
+	Receipts    int       `json:"receipts"`
+	Total       float64   `json:"total"`
+	DateOnly    int       `json:"date_only"` // Receipts with a date but no time, left out of the hourly figures
+	Undated     int       `json:"undated"`   // Receipts without a purchase date, placed by when they were analyzed and left out
+
+	Weekdays []string `json:"weekdays"` // Row labels of Heatmap, Monday first
+	Hours    []int    `json:"hours"`    // Column labels of Heatmap, 0-23
+
+	// Heatmap[weekday][hour] is what was spent at that hour on that day of
+	// the week, over the whole period
+	Heatmap   [][]Cell `json:"heatmap"`
+	ByHour    []Cell   `json:"by_hour"`    // Receipts with a time
+	ByWeekday []Cell   `json:"by_weekday"` // Every receipt, timed or not
+	Dayparts  []Line   `json:"dayparts"`   // late_night, morning, afternoon, evening
+	Peak      *Peak    `json:"peak,omitempty"`
+}
+
+// Cell is spending in one slot of a heatmap.
+type Cell struct {
+	Amount   float64 `json:"amount"`
+	Receipts int     `json:"receipts"`
+	Average  float64 `json:"average"` // Per receipt
+}
+
+// Peak is the weekday and hour with the most spending.
+type Peak struct {
+	Weekday string  `json:"weekday"`
+	Hour    int     `json:"hour"`
+	Amount  float64 `json:"amount"`
+}
+
+// BuildPatterns places the latest version of each record purchased in p on
+// a weekday-by-hour grid, by its purchase time in the vendor's time zone.
+// Receipts with only a date count toward their weekday but no hour, and
+// receipts without a purchase date are only counted, since the day they
+// were analyzed says nothing about when the money was spent.
+func BuildPatterns(records []*store.Record, p Period, now time.Time) *Patterns {
+	pt := &Patterns{
+		Period:      p,
+		GeneratedAt: now.UTC(),
+		Weekdays:    Weekdays,
+		Hours:       make([]int, 24),
+		Heatmap:     make([][]Cell, 7),
+		ByHour:      make([]Cell, 24),
+		ByWeekday:   make([]Cell, 7),
+		Dayparts:    make([]Line, 0),
+	}
+	for h := range pt.Hours {
+		pt.Hours[h] = h
+	}
+	for d := range pt.Heatmap {
+		pt.Heatmap[d] = make([]Cell, 24)
+	}
+
+	parts := make(map[string]*Line)
+	for _, rec := range records {
+		if rec.SupersededBy != "" {
+			continue
+		}
+		pu := fromRecord(rec)
+		if pu.date < p.From || pu.date > p.To || pu.refund {
+			continue // Returns aren't shopping
+		}
+		if rec.PurchaseTime == nil || rec.PurchaseTime.LocalDate == "" {
+			pt.Undated++
+			continue
+		}
+		day, err := time.Parse("2006-01-02", pu.date)
+		if err != nil {
+			pt.Undated++
+			continue
+		}
+		weekday := (int(day.Weekday()) + 6) % 7 // Monday first
+		pt.Receipts++
+		pt.Total += pu.total
+		pt.ByWeekday[weekday].add(pu.total)
+
+		hour, ok := localHour(rec)
+		if !ok {
+			pt.DateOnly++
+			continue
+		}
+		pt.ByHour[hour].add(pu.total)
+		pt.Heatmap[weekday][hour].add(pu.total)
+		addLine(parts, daypart(hour), pu.total)
+	}
+
+	pt.Total = roundCents(pt.Total)
+	var timed float64
+	for _, l := range parts {
+		timed += l.Amount
+	}
+	pt.Dayparts = sortedLines(parts, roundCents(timed), 0)
+	for d := range pt.Heatmap {
+		for h := range pt.Heatmap[d] {
+			c := &pt.Heatmap[d][h]
+			c.finish()
+			if c.Amount > 0 && (pt.Peak == nil || c.Amount > pt.Peak.Amount) {
+				pt.Peak = &Peak{Weekday: Weekdays[d], Hour: h, Amount: c.Amount}
+			}
+		}
+	}
+	for i := range pt.ByHour {
+		pt.ByHour[i].finish()
+	}
+	for i := range pt.ByWeekday {
+		pt.ByWeekday[i].finish()
+	}
+	return pt
+}
+
+// localHour returns the hour rec was purchased, in the vendor's time zone.
+// It reports false for receipts without a printed time.
+func localHour(rec *store.Record) (int, bool) {
+	if rec.PurchaseTime == nil || rec.PurchaseTime.DateOnly || rec.PurchaseTime.Timestamp == "" {
+		return 0, false
+	}
+	// The timestamp carries the vendor's UTC offset, so its clock is local
+	t, err := time.Parse(time.RFC3339, rec.PurchaseTime.Timestamp)
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour(), true
+}
+
+// daypart names the part of the day hour falls in.
+func daypart(hour int) string {
+	name := dayparts[0].name
+	for _, d := range dayparts {
+		if hour >= d.start {
+			name = d.name
+		}
+	}
+	return name
+}
+
+func (c *Cell) add(amount float64) {
+	c.Amount += amount
+	c.Receipts++
+}
+
+func (c *Cell) finish() {
+	c.Amount = roundCents(c.Amount)
+	if c.Receipts > 0 {
+		c.Average = roundCents(c.Amount / float64(c.Receipts))
+	}
+}
@@ -0,0 +1,402 @@
+// Package report provides a minimal PDF rendering of spending reports, using
+// the standard Helvetica fonts so no font files need embedding.
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"strings"
+)
+
+// Page geometry in points (US Letter).
+const (
+	pageWidth   = 612.0
+	pageHeight  = 792.0
+	pageMargin  = 50.0
+	rowHeight   = 16.0
+	pdfBarWidth = 260.0
+)
+
+// pdfWriter lays out text, filled rectangles, and images on a flow of pages.
+type pdfWriter struct {
+	pages  []*bytes.Buffer
+	images []pdfImage
+	y      float64 // Baseline of the next line, from the bottom of the page
+}
+
+// pdfImage is a JPEG embedded as is, which PDF readers decode themselves.
+type pdfImage struct {
+	data          []byte
+	width, height int
+	gray          bool
+}
+
+func newPDFWriter() *pdfWriter {
+	w := &pdfWriter{}
+	w.newPage()
+	return w
+}
+
+func (w *pdfWriter) newPage() {
+	w.pages = append(w.pages, &bytes.Buffer{})
+	w.y = pageHeight - pageMargin
+}
+
+// need starts a new page unless there's room for height more points.
+func (w *pdfWriter) need(height float64) {
+	if w.y-height < pageMargin {
+		w.newPage()
+	}
+}
+
+func (w *pdfWriter) page() *bytes.Buffer {
+	return w.pages[len(w.pages)-1]
+}
+
+// text draws s with its left edge at x on the current line.
+func (w *pdfWriter) text(x float64, s string, size float64, bold bool) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(w.page(), "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, w.y, pdfEscape(s))
+}
+
+// textRight draws s with its right edge at x on the current line.
+func (w *pdfWriter) textRight(x float64, s string, size float64, bold bool) {
+	w.text(x-textWidth(s, size), s, size, bold)
+}
+
+// rect fills a rectangle whose bottom-left corner is at x, y.
+func (w *pdfWriter) rect(x, y, width, height float64, r, g, b float64) {
+	fmt.Fprintf(w.page(), "%.3f %.3f %.3f rg %.2f %.2f %.2f %.2f re f 0 g\n", r, g, b, x, y, width, height)
+}
+
+// addImage embeds a JPEG and returns its index for drawImage.
+func (w *pdfWriter) addImage(data []byte) (int, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read JPEG: %w", err)
+	}
+	w.images = append(w.images, pdfImage{
+		data:   data,
+		width:  cfg.Width,
+		height: cfg.Height,
+		gray:   cfg.ColorModel == color.GrayModel,
+	})
+	return len(w.images) - 1, nil
+}
+
+// drawImage draws image i with its bottom-left corner at x, y, scaled to
+// width by height points.
+func (w *pdfWriter) drawImage(i int, x, y, width, height float64) {
+	fmt.Fprintf(w.page(), "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n", width, height, x, y, i)
+}
+
+// line advances to the next line.
+func (w *pdfWriter) line(height float64) {
+	w.y -= height
+}
+
+// writeTo assembles the document: catalog, page tree, the two fonts, the
+// images, then a page and content stream per page, followed by the
+// cross-reference table.
+func (w *pdfWriter) writeTo(out io.Writer) error {
+	var buf bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	const firstImage = 5 // Objects 1-4 are the catalog, page tree, and fonts
+	firstPage := firstImage + len(w.images)
+	kids := make([]string, len(w.pages))
+	for i := range w.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(w.pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	xobjects := make([]string, len(w.images))
+	for i, img := range w.images {
+		colorSpace := "/DeviceRGB"
+		if img.gray {
+			colorSpace = "/DeviceGray"
+		}
+		obj(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>\nstream\n%s\nendstream",
+			img.width, img.height, colorSpace, len(img.data), img.data))
+		xobjects[i] = fmt.Sprintf("/Im%d %d 0 R", i, firstImage+i)
+	}
+	resources := "/Font << /F1 3 0 R /F2 4 0 R >>"
+	if len(xobjects) > 0 {
+		resources += " /XObject << " + strings.Join(xobjects, " ") + " >>"
+	}
+	for i, content := range w.pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << %s >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, resources, firstPage+2*i+1))
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := out.Write(buf.Bytes())
+	return err
+}
+
+// pdfEscape escapes a string for a PDF literal. Characters outside Latin-1
+// have no glyph in the standard fonts' encoding and become '?'.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20:
+			b.WriteByte(' ')
+		case r > 0xff:
+			b.WriteByte('?')
+		case r >= 0x80:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// textWidth estimates the width of s in Helvetica. Digits and common
+// punctuation use the font's metrics; other characters an average width.
+func textWidth(s string, size float64) float64 {
+	var units float64
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9', r == '$', r == '+':
+			units += 556
+		case r == '.' || r == ',' || r == ' ':
+			units += 278
+		case r == '-' || r == '(' || r == ')':
+			units += 333
+		case r == '%':
+			units += 889
+		default:
+			units += 560
+		}
+	}
+	return units * size / 1000
+}
+
+// truncate shortens s to fit width points at size.
+func truncate(s string, width, size float64) string {
+	if textWidth(s, size) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 && textWidth(string(runes)+"...", size) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "..."
+}
+
+// column is a table column: its left edge, or right edge when right aligned.
+type column struct {
+	title string
+	x     float64
+	right bool
+	width float64 // Truncation width for left-aligned text
+}
+
+// RenderPDF writes r as a PDF document with bar charts for categories and
+// vendors.
+func RenderPDF(out io.Writer, r *Report) error {
+	w := newPDFWriter()
+	left, right := pageMargin, pageWidth-pageMargin
+
+	w.text(left, "Spending report: "+r.Period.Label, 20, true)
+	w.line(18)
+	meta := fmt.Sprintf("%s to %s", r.Period.From, r.Period.To)
+	if r.Workspace != "" {
+		meta += " - " + r.Workspace
+	}
+	if r.Owner != "" {
+		meta += " - " + r.Owner
+	}
+	if len(r.Tags) > 0 {
+		meta += " - tagged " + strings.Join(r.Tags, ", ")
+	}
+	if r.MinQuality > 0 {
+		meta += fmt.Sprintf(" - quality %d+", r.MinQuality)
+	}
+	meta += " - generated " + r.GeneratedAt.Format("2006-01-02 15:04 MST")
+	w.text(left, meta, 9, false)
+	w.line(28)
+
+	w.text(left, "Total spent", 10, false)
+	w.text(left+170, "Receipts", 10, false)
+	w.text(left+340, "Tax", 10, false)
+	w.line(18)
+	w.text(left, money(r.Total), 16, true)
+	w.text(left+170, fmt.Sprint(r.Receipts), 16, true)
+	w.text(left+340, money(r.Tax), 16, true)
+	w.line(30)
+	if r.TotalUnreadable > 0 {
+		w.text(left, fmt.Sprintf("Total leaves out %d receipt(s) whose total couldn't be read.", r.TotalUnreadable), 9, false)
+		w.line(14)
+	}
+	if r.TaxUnreadable > 0 {
+		w.text(left, fmt.Sprintf("Tax leaves out %d receipt(s) whose tax couldn't be read.", r.TaxUnreadable), 9, false)
+		w.line(14)
+	}
+	if r.Refunds > 0 {
+		w.text(left, fmt.Sprintf("Total is net of %d refund(s) totaling %s.", r.Refunds, money(r.Refunded)), 9, false)
+		w.line(14)
+	}
+	if r.OutOfPocket != r.Total {
+		w.text(left, fmt.Sprintf("%s of it came out of pocket; gift cards and store credit paid the rest.", money(r.OutOfPocket)), 9, false)
+		w.line(14)
+	}
+
+	if r.Receipts == 0 {
+		w.text(left, "No receipts were found for this period.", 11, false)
+		return w.writeTo(out)
+	}
+
+	lineColumns := func(name string) []column {
+		return []column{
+			{title: name, x: left, width: 280},
+			{title: "Receipts", x: 400, right: true},
+			{title: "Amount", x: 480, right: true},
+			{title: "Share", x: right, right: true},
+		}
+	}
+	lineRows := func(lines []Line) [][]string {
+		rows := make([][]string, len(lines))
+		for i, l := range lines {
+			rows[i] = []string{l.Name, fmt.Sprint(l.Receipts), money(l.Amount), fmt.Sprintf("%.1f%%", l.Share*100)}
+		}
+		return rows
+	}
+
+	if len(r.Members) > 0 {
+		pdfHeading(w, "By member")
+		pdfChart(w, r.Members)
+		pdfTable(w, lineColumns("Member"), lineRows(r.Members))
+	}
+
+	pdfHeading(w, "By category")
+	pdfChart(w, r.Categories)
+	pdfTable(w, lineColumns("Category"), lineRows(r.Categories))
+
+	pdfHeading(w, "By vendor category")
+	pdfChart(w, r.VendorTypes)
+	pdfTable(w, lineColumns("Vendor category"), lineRows(r.VendorTypes))
+
+	pdfHeading(w, "By vendor")
+	pdfChart(w, r.Vendors)
+	pdfTable(w, lineColumns("Vendor"), lineRows(r.Vendors))
+
+	pdfHeading(w, "Top items")
+	items := make([][]string, len(r.TopItems))
+	for i, it := range r.TopItems {
+		items[i] = []string{it.Name, fmt.Sprint(it.Purchases), fmt.Sprint(it.Qty), money(it.Spent)}
+	}
+	pdfTable(w, []column{
+		{title: "Item", x: left, width: 300},
+		{title: "Purchases", x: 420, right: true},
+		{title: "Qty", x: 480, right: true},
+		{title: "Spent", x: right, right: true},
+	}, items)
+
+	pdfHeading(w, "Price changes")
+	if len(r.PriceChanges) == 0 {
+		w.text(left, "No price changes against earlier purchases.", 10, false)
+		return w.writeTo(out)
+	}
+	changes := make([][]string, len(r.PriceChanges))
+	for i, c := range r.PriceChanges {
+		vendor := c.Vendor
+		if c.Store != "" {
+			vendor += " " + c.Store
+		}
+		changes[i] = []string{c.Item, vendor, money(c.Previous), money(c.Current), fmt.Sprintf("%+.1f%%", c.ChangePct)}
+	}
+	pdfTable(w, []column{
+		{title: "Item", x: left, width: 190},
+		{title: "Vendor", x: 245, width: 130},
+		{title: "Before", x: 430, right: true},
+		{title: "Now", x: 490, right: true},
+		{title: "Change", x: right, right: true},
+	}, changes)
+
+	return w.writeTo(out)
+}
+
+func pdfHeading(w *pdfWriter, title string) {
+	w.need(60) // Keep a heading with at least the first rows below it
+	w.text(pageMargin, title, 14, true)
+	w.line(20)
+}
+
+// pdfChart draws a horizontal bar per line, scaled to the largest.
+func pdfChart(w *pdfWriter, lines []Line) {
+	if len(lines) == 0 || lines[0].Amount <= 0 {
+		return
+	}
+	for _, l := range lines {
+		w.need(rowHeight)
+		width := l.Amount / lines[0].Amount * pdfBarWidth
+		w.rect(pageMargin, w.y-3, width, 12, 0.29, 0.47, 0.71)
+		w.text(pageMargin+width+6, truncate(l.Name, 160, 9)+" "+money(l.Amount), 9, false)
+		w.line(rowHeight)
+	}
+	w.line(6)
+}
+
+// pdfTable draws a header row and rows, repeating the header on new pages.
+func pdfTable(w *pdfWriter, cols []column, rows [][]string) {
+	header := func() {
+		for _, c := range cols {
+			if c.right {
+				w.textRight(c.x, c.title, 9, true)
+			} else {
+				w.text(c.x, c.title, 9, true)
+			}
+		}
+		w.rect(pageMargin, w.y-4, pageWidth-2*pageMargin, 0.5, 0.6, 0.6, 0.6)
+		w.line(rowHeight)
+	}
+
+	header()
+	for _, row := range rows {
+		if w.y-rowHeight < pageMargin {
+			w.newPage()
+			header()
+		}
+		for i, c := range cols {
+			switch {
+			case c.right:
+				w.textRight(c.x, row[i], 9, false)
+			default:
+				w.text(c.x, truncate(row[i], c.width, 9), 9, false)
+			}
+		}
+		w.line(rowHeight)
+	}
+	w.line(10)
+}
+
+func money(v float64) string {
+	return fmt.Sprintf("$%.2f", v)
+}
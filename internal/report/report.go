@@ -0,0 +1,542 @@
+// Package report builds monthly and quarterly spending reports from stored
+// receipts and renders them as HTML or PDF.
+package report
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"myprice/internal/pricing"
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+)
+
+const (
+	// topN bounds the vendor, item, and price change tables.
+	topN = 10
+
+	// minPriceChange is the smallest unit price change worth reporting.
+	minPriceChange = 0.01
+
+	// Uncategorized labels spending on receipts without item categories,
+	// and on vendors of no known category.
+	Uncategorized = "uncategorized"
+)
+
+var (
+	monthRegex   = regexp.MustCompile(`^(\d{4})-(\d{2})$`)
+	quarterRegex = regexp.MustCompile(`^(\d{4})-[Qq]([1-4])$`)
+)
+
+// Period is a calendar month or quarter of purchase dates.
+type Period struct {
+	Name  string `json:"name"`  // "2025-11" or "2025-Q4"
+	Label string `json:"label"` // "November 2025" or "Q4 2025"
+	From  string `json:"from"`  // First day, "2006-01-02"
+	To    string `json:"to"`    // Last day, inclusive
+}
+
+// ParsePeriod parses a month ("2025-11") or quarter ("2025-Q4").
+func ParsePeriod(name string) (Period, error) {
+	if m := monthRegex.FindStringSubmatch(name); m != nil {
+		year, _ := strconv.Atoi(m[1])
+		month, _ := strconv.Atoi(m[2])
+		if month < 1 || month > 12 {
+			return Period{}, fmt.Errorf("invalid month in period %q", name)
+		}
+		return monthPeriod(year, time.Month(month)), nil
+	}
+	if m := quarterRegex.FindStringSubmatch(name); m != nil {
+		year, _ := strconv.Atoi(m[1])
+		quarter, _ := strconv.Atoi(m[2])
+		return quarterPeriod(year, quarter), nil
+	}
+	return Period{}, fmt.Errorf("period must be a month (2025-11) or quarter (2025-Q4), got %q", name)
+}
+
+func monthPeriod(year int, month time.Month) Period {
+	start := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	return Period{
+		Name:  start.Format("2006-01"),
+		Label: start.Format("January 2006"),
+		From:  start.Format("2006-01-02"),
+		To:    start.AddDate(0, 1, -1).Format("2006-01-02"),
+	}
+}
+
+func quarterPeriod(year, quarter int) Period {
+	start := time.Date(year, time.Month(3*quarter-2), 1, 0, 0, 0, 0, time.UTC)
+	return Period{
+		Name:  fmt.Sprintf("%d-Q%d", year, quarter),
+		Label: fmt.Sprintf("Q%d %d", quarter, year),
+		From:  start.Format("2006-01-02"),
+		To:    start.AddDate(0, 3, -1).Format("2006-01-02"),
+	}
+}
+
+// Previous returns the last complete month or quarter before now.
+func Previous(quarterly bool, now time.Time) Period {
+	if quarterly {
+		q := (int(now.Month())-1)/3 + 1
+		if q == 1 {
+			return quarterPeriod(now.Year()-1, 4)
+		}
+		return quarterPeriod(now.Year(), q-1)
+	}
+	last := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0)
+	return monthPeriod(last.Year(), last.Month())
+}
+
+// Report is a spending summary for one period.
+type Report struct {
+	Period          Period        `json:"period"`
+	GeneratedAt     time.Time     `json:"generated_at"`
+	Owner           string        `json:"owner,omitempty"`       // Limited to one user's receipts
+	Workspace       string        `json:"workspace,omitempty"`   // Limited to a workspace's members
+	Tags            []string      `json:"tags,omitempty"`        // Limited to receipts with every tag
+	MinQuality      int           `json:"min_quality,omitempty"` // Limited to receipts scoring at least this
+	Receipts        int           `json:"receipts"`
+	Total           float64       `json:"total"`
+	Tax             float64       `json:"tax"`
+	TaxUnreadable   int           `json:"tax_unreadable,omitempty"`   // Receipts with a printed but illegible tax, which Tax leaves out
+	TotalUnreadable int           `json:"total_unreadable,omitempty"` // Likewise for Total
+	Refunds         int           `json:"refunds,omitempty"`          // Refund receipts, whose negative totals Total nets out
+	Refunded        float64       `json:"refunded,omitempty"`         // Money they gave back
+	OutOfPocket     float64       `json:"out_of_pocket"`              // Total less what gift cards and store credit paid
+	Categories      []Line        `json:"categories"`
+	VendorTypes     []Line        `json:"vendor_categories"` // By merchant category code
+	Vendors         []Line        `json:"vendors"`
+	Members         []Line        `json:"members,omitempty"` // Spend per workspace member
+	TopItems        []ItemLine    `json:"top_items"`
+	PriceChanges    []PriceChange `json:"price_changes"`
+}
+
+// Line is spending attributed to a category, vendor, or member.
+type Line struct {
+	Name     string  `json:"name"`
+	Code     string  `json:"code,omitempty"` // Merchant category code, for vendor categories
+	Amount   float64 `json:"amount"`
+	Receipts int     `json:"receipts"`
+	Share    float64 `json:"share"` // Fraction of the period's total
+}
+
+// ItemLine is spending on one item.
+type ItemLine struct {
+	Name      string  `json:"name"`
+	Purchases int     `json:"purchases"`
+	Qty       float64 `json:"qty"`
+	Spent     float64 `json:"spent"`
+}
+
+// PriceChange compares an item's unit price at one vendor with the last
+// price paid there before the period.
+type PriceChange struct {
+	Item      string  `json:"item"`
+	Vendor    string  `json:"vendor"`
+	Store     string  `json:"store,omitempty"` // The vendor's location, when known
+	Previous  float64 `json:"previous"`
+	PrevDate  string  `json:"previous_date"`
+	Current   float64 `json:"current"`
+	Date      string  `json:"date"`
+	ChangePct float64 `json:"change_pct"`
+}
+
+// purchase is the part of a stored record a report uses.
+type purchase struct {
+	date        string
+	vendor      string
+	store       string // Tells the vendor's locations apart; "" when unknown
+	total       float64
+	tax         float64
+	unreadable  []string // Of total and tax, those printed but illegible
+	refund      bool     // A return, with negative amounts
+	outOfPocket float64  // Total less gift cards and store credit
+	categories  []string
+	category    receipt.VendorCategory // Of the vendor; zero when unknown
+	items       []item
+}
+
+type item struct {
+	name  string
+	qty   float64
+	price float64 // Line amount
+}
+
+// Build summarizes the latest version of each record whose purchase date
+// falls in p. Records before p are used only as the baseline for price
+// changes. Receipts listing several item categories have their total split
+// evenly between them, since items aren't categorized individually.
+// Receipts without item categories are counted under their vendor's
+// category instead.
+func Build(records []*store.Record, p Period, now time.Time) *Report {
+	r := &Report{
+		Period:       p,
+		GeneratedAt:  now.UTC(),
+		Categories:   make([]Line, 0),
+		VendorTypes:  make([]Line, 0),
+		Vendors:      make([]Line, 0),
+		TopItems:     make([]ItemLine, 0),
+		PriceChanges: make([]PriceChange, 0),
+	}
+
+	var inPeriod, before []purchase
+	for _, rec := range records {
+		if rec.SupersededBy != "" {
+			continue
+		}
+		pu := fromRecord(rec)
+		switch {
+		case pu.date >= p.From && pu.date <= p.To:
+			inPeriod = append(inPeriod, pu)
+		case pu.date < p.From:
+			before = append(before, pu)
+		}
+	}
+
+	categories := make(map[string]*Line)
+	vendorTypes := make(map[string]*Line)
+	vendors := make(map[string]*Line)
+	items := make(map[string]*ItemLine)
+	var returned []item
+	for _, pu := range inPeriod {
+		r.Receipts++
+		r.Total += pu.total
+		r.Tax += pu.tax
+		r.OutOfPocket += pu.outOfPocket
+		if pu.refund {
+			r.Refunds++
+			r.Refunded -= pu.total
+		}
+		for _, field := range pu.unreadable {
+			if field == "tax" {
+				r.TaxUnreadable++
+			} else {
+				r.TotalUnreadable++
+			}
+		}
+
+		cats := pu.spendCategories()
+		for _, c := range cats {
+			addLine(categories, c, pu.total/float64(len(cats)))
+		}
+		addVendorType(vendorTypes, pu.category, pu.total)
+		addLine(vendors, pu.vendor, pu.total)
+
+		for _, it := range pu.items {
+			if it.price < 0 && pu.refund {
+				returned = append(returned, it)
+				continue
+			}
+			if it.price <= 0 {
+				continue // Voids and discounts
+			}
+			key := strings.ToLower(it.name)
+			il, ok := items[key]
+			if !ok {
+				il = &ItemLine{Name: it.name}
+				items[key] = il
+			}
+			il.Purchases++
+			il.Qty += max(it.qty, 1)
+			il.Spent += it.price
+		}
+	}
+
+	// Returns take back what was spent on items bought in the period, and
+	// an item returned in full isn't a top item
+	for _, it := range returned {
+		key := strings.ToLower(it.name)
+		if il, ok := items[key]; ok {
+			il.Qty = math.Max(il.Qty-max(it.qty, 1), 0)
+			if il.Spent += it.price; il.Spent < 0.005 {
+				delete(items, key)
+			}
+		}
+	}
+
+	r.Total, r.Tax, r.Refunded = roundCents(r.Total), roundCents(r.Tax), roundCents(r.Refunded)
+	r.OutOfPocket = roundCents(r.OutOfPocket)
+	r.Categories = sortedLines(categories, r.Total, 0)
+	r.VendorTypes = sortedLines(vendorTypes, r.Total, 0)
+	r.Vendors = sortedLines(vendors, r.Total, topN)
+	for _, il := range items {
+		il.Spent = roundCents(il.Spent)
+		r.TopItems = append(r.TopItems, *il)
+	}
+	sort.Slice(r.TopItems, func(i, j int) bool {
+		if r.TopItems[i].Spent != r.TopItems[j].Spent {
+			return r.TopItems[i].Spent > r.TopItems[j].Spent
+		}
+		return r.TopItems[i].Name < r.TopItems[j].Name
+	})
+	if len(r.TopItems) > topN {
+		r.TopItems = r.TopItems[:topN]
+	}
+
+	r.PriceChanges = priceChanges(before, inPeriod)
+	return r
+}
+
+// ByMember attributes the period's spending in records to the members who
+// submitted it. Every member gets a line, even with nothing spent.
+func ByMember(records []*store.Record, p Period, members []string) []Line {
+	lines := make(map[string]*Line, len(members))
+	for _, name := range members {
+		lines[name] = &Line{Name: name}
+	}
+
+	var total float64
+	for _, rec := range records {
+		l, ok := lines[rec.Owner]
+		if !ok || rec.SupersededBy != "" {
+			continue
+		}
+		pu := fromRecord(rec)
+		if pu.date < p.From || pu.date > p.To {
+			continue
+		}
+		l.Amount += pu.total
+		l.Receipts++
+		total += pu.total
+	}
+	return sortedLines(lines, roundCents(total), 0)
+}
+
+// Spent totals the period's spending in records on category, split between
+// a receipt's categories as in Build, or else at vendor, named as in
+// Build's vendor lines. Both match case-insensitively. It also returns the
+// number of receipts counted.
+func Spent(records []*store.Record, p Period, category, vendor string) (float64, int) {
+	var total float64
+	receipts := 0
+	for _, rec := range records {
+		if rec.SupersededBy != "" {
+			continue
+		}
+		pu := fromRecord(rec)
+		if pu.date < p.From || pu.date > p.To {
+			continue
+		}
+		if category == "" {
+			if strings.EqualFold(pu.vendor, vendor) {
+				total += pu.total
+				receipts++
+			}
+			continue
+		}
+		cats := pu.spendCategories()
+		for _, c := range cats {
+			if strings.EqualFold(c, category) {
+				total += pu.total / float64(len(cats))
+				receipts++
+				break
+			}
+		}
+	}
+	return roundCents(total), receipts
+}
+
+// addLine adds amount to the line named name, case-insensitively.
+func addLine(lines map[string]*Line, name string, amount float64) {
+	key := strings.ToLower(name)
+	l, ok := lines[key]
+	if !ok {
+		l = &Line{Name: name}
+		lines[key] = l
+	}
+	l.Amount += amount
+	l.Receipts++
+}
+
+// addVendorType adds amount to the line for the vendor category c.
+func addVendorType(lines map[string]*Line, c receipt.VendorCategory, amount float64) {
+	if c.Code == "" {
+		addLine(lines, Uncategorized, amount)
+		return
+	}
+	addLine(lines, c.Label, amount)
+	lines[strings.ToLower(c.Label)].Code = c.Code
+}
+
+// spendCategories returns the categories pu's total is split between: its
+// item categories, else its vendor's category, else Uncategorized.
+func (pu purchase) spendCategories() []string {
+	switch {
+	case len(pu.categories) > 0:
+		return pu.categories
+	case pu.category.Name != "":
+		return []string{pu.category.Name}
+	default:
+		return []string{Uncategorized}
+	}
+}
+
+// sortedLines returns lines by amount, largest first, keeping at most n
+// (all when n is 0).
+func sortedLines(lines map[string]*Line, total float64, n int) []Line {
+	out := make([]Line, 0, len(lines))
+	for _, l := range lines {
+		l.Amount = roundCents(l.Amount)
+		if total > 0 {
+			l.Share = math.Round(l.Amount/total*1000) / 1000
+		}
+		out = append(out, *l)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Amount != out[j].Amount {
+			return out[i].Amount > out[j].Amount
+		}
+		return out[i].Name < out[j].Name
+	})
+	if n > 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// priceChanges compares the last unit price paid for each item at each
+// store during the period with the last one before it, largest changes
+// first. Chains price differently by location, so a store's prices are
+// only compared with its own.
+func priceChanges(before, during []purchase) []PriceChange {
+	type observation struct {
+		name, vendor, store, date string
+		unit                      float64
+	}
+	latest := func(purchases []purchase) map[string]observation {
+		seen := make(map[string]observation)
+		for _, pu := range purchases {
+			for _, it := range pu.items {
+				if it.price <= 0 {
+					continue
+				}
+				key := strings.ToLower(pu.vendor + "|" + pu.store + "|" + it.name)
+				o := observation{it.name, pu.vendor, pu.store, pu.date, pricing.UnitPrice(it.qty, it.price)}
+				if prev, ok := seen[key]; !ok || o.date >= prev.date {
+					seen[key] = o
+				}
+			}
+		}
+		return seen
+	}
+
+	prev, cur := latest(before), latest(during)
+	changes := make([]PriceChange, 0)
+	for key, c := range cur {
+		p, ok := prev[key]
+		if !ok || p.unit <= 0 {
+			continue
+		}
+		change := (c.unit - p.unit) / p.unit
+		if math.Abs(change) < minPriceChange {
+			continue
+		}
+		changes = append(changes, PriceChange{
+			Item:      c.name,
+			Vendor:    c.vendor,
+			Store:     c.store,
+			Previous:  roundCents(p.unit),
+			PrevDate:  p.date,
+			Current:   roundCents(c.unit),
+			Date:      c.date,
+			ChangePct: math.Round(change*1000) / 10,
+		})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := math.Abs(changes[i].ChangePct), math.Abs(changes[j].ChangePct)
+		if a != b {
+			return a > b
+		}
+		return changes[i].Item < changes[j].Item
+	})
+	if len(changes) > topN {
+		changes = changes[:topN]
+	}
+	return changes
+}
+
+// fromRecord extracts the purchase date, vendor, totals, categories, and
+// items from a stored receipt or invoice.
+func fromRecord(rec *store.Record) purchase {
+	pu := purchase{date: rec.CreatedAt.Format("2006-01-02")}
+	if rec.PurchaseTime != nil && rec.PurchaseTime.LocalDate != "" {
+		pu.date = rec.PurchaseTime.LocalDate
+	}
+
+	invoice := rec.DocumentType == string(receipt.DocumentTypeInvoice)
+	if invoice {
+		party, _ := rec.Data["vendor"].(map[string]any)
+		pu.vendor, _ = party["name"].(string)
+	} else {
+		pu.vendor, _ = rec.Data["vendor"].(string)
+	}
+	if rec.Location != nil && rec.Location.Chain != "" {
+		pu.vendor = rec.Location.Chain
+	}
+	pu.store = rec.Location.Store()
+	if strings.TrimSpace(pu.vendor) == "" {
+		pu.vendor = "Unknown vendor"
+	}
+
+	pu.total, _ = rec.Data["total"].(float64)
+	pu.tax, _ = rec.Data["tax"].(float64)
+	pu.refund, _ = rec.Data["refund"].(bool)
+	pu.outOfPocket = pu.total
+	if v, ok := rec.Data["out_of_pocket"].(float64); ok {
+		pu.outOfPocket = v
+	}
+	for _, field := range []string{"total", "tax"} {
+		if receipt.UnknownReason(rec.Data, field) == receipt.ReasonUnreadable {
+			pu.unreadable = append(pu.unreadable, field)
+		}
+	}
+	if cats, ok := rec.Data["item_categories"].([]any); ok {
+		for _, c := range cats {
+			if name, ok := c.(string); ok && strings.TrimSpace(name) != "" {
+				pu.categories = append(pu.categories, strings.ToLower(strings.TrimSpace(name)))
+			}
+		}
+	}
+
+	// Records analyzed before vendors were categorized are categorized now
+	if c, ok := receipt.LookupVendorCategory(rec.VendorCategory); ok {
+		pu.category = c
+	} else if rec.VendorCategory == "" {
+		chain := ""
+		if rec.Location != nil {
+			chain = rec.Location.Chain
+		}
+		pu.category, _ = receipt.CategorizeData(receipt.DocumentType(rec.DocumentType), rec.Data, chain, nil)
+	}
+
+	raw, _ := rec.Data["items"].([]any)
+	for _, r := range raw {
+		m, ok := r.(map[string]any)
+		if !ok {
+			continue
+		}
+		var it item
+		it.qty, _ = m["qty"].(float64)
+		if invoice {
+			it.name, _ = m["description"].(string)
+			it.price, _ = m["amount"].(float64)
+		} else {
+			it.name, _ = m["name"].(string)
+			it.price, _ = m["price"].(float64)
+		}
+		if it.name = strings.TrimSpace(it.name); it.name != "" {
+			pu.items = append(pu.items, it)
+		}
+	}
+	return pu
+}
+
+// roundCents rounds an amount to whole cents.
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
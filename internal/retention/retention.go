@@ -0,0 +1,191 @@
+// Package retention enforces age and size limits on the upload and cache
+// directories, which otherwise grow without bound.
+package retention
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// staleTempAge is how old an in-progress temp file (dotfile) must be before
+// it is considered abandoned and eligible for removal.
+const staleTempAge = time.Hour
+
+// Policy limits what a directory may hold. Zero values mean unlimited.
+type Policy struct {
+	MaxAge   time.Duration `json:"max_age"`
+	MaxBytes int64         `json:"max_bytes"`
+}
+
+// Dir is a directory managed by a retention policy.
+type Dir struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Policy Policy `json:"policy"`
+}
+
+// Result reports what a cleanup pass did to one directory.
+type Result struct {
+	Dir            string `json:"dir"`
+	Removed        int    `json:"removed"`
+	FreedBytes     int64  `json:"freed_bytes"`
+	Remaining      int    `json:"remaining"`
+	RemainingBytes int64  `json:"remaining_bytes"`
+}
+
+// fileEntry is a candidate file for eviction.
+type fileEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Clean removes files older than the policy's MaxAge, then evicts the least
+// recently used files (by modification time) until the directory fits within
+// MaxBytes. Callers that reuse a cached file should touch it so it counts as used.
+func Clean(d Dir, now time.Time) (Result, error) {
+	result := Result{Dir: d.Name}
+
+	dirEntries, err := os.ReadDir(d.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return result, fmt.Errorf("failed to read %s: %w", d.Path, err)
+	}
+
+	var files []fileEntry
+	for _, de := range dirEntries {
+		if !de.Type().IsRegular() {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		entry := fileEntry{
+			path:    filepath.Join(d.Path, de.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		}
+
+		// Temp files belong to in-progress writes unless they are old
+		if strings.HasPrefix(de.Name(), ".") {
+			if now.Sub(entry.modTime) > staleTempAge {
+				result.remove(entry)
+			}
+			continue
+		}
+
+		if d.Policy.MaxAge > 0 && now.Sub(entry.modTime) > d.Policy.MaxAge {
+			result.remove(entry)
+			continue
+		}
+		files = append(files, entry)
+	}
+
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+
+	if d.Policy.MaxBytes > 0 && total > d.Policy.MaxBytes {
+		// Oldest first
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].modTime.Before(files[j].modTime)
+		})
+		for len(files) > 0 && total > d.Policy.MaxBytes {
+			if result.remove(files[0]) {
+				total -= files[0].size
+			}
+			files = files[1:]
+		}
+	}
+
+	result.Remaining = len(files)
+	result.RemainingBytes = total
+	return result, nil
+}
+
+// remove deletes a file and records it, reporting whether it was removed.
+func (r *Result) remove(f fileEntry) bool {
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: retention could not remove %s: %v", f.path, err)
+		return false
+	}
+	r.Removed++
+	r.FreedBytes += f.size
+	return true
+}
+
+// Touch marks a file as recently used for LRU eviction.
+func Touch(path string) {
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		log.Printf("Warning: could not touch %s: %v", path, err)
+	}
+}
+
+// Janitor periodically applies retention policies to a set of directories.
+type Janitor struct {
+	dirs     []Dir
+	interval time.Duration
+	mu       sync.Mutex // serializes cleanup passes
+}
+
+// NewJanitor creates a janitor for dirs that runs every interval.
+func NewJanitor(dirs []Dir, interval time.Duration) *Janitor {
+	return &Janitor{dirs: dirs, interval: interval}
+}
+
+// Dirs returns the managed directories and their policies.
+func (j *Janitor) Dirs() []Dir {
+	return j.dirs
+}
+
+// CleanAll runs one cleanup pass over every directory.
+func (j *Janitor) CleanAll() []Result {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	results := make([]Result, 0, len(j.dirs))
+	for _, d := range j.dirs {
+		result, err := Clean(d, now)
+		if err != nil {
+			log.Printf("Warning: retention cleanup of %s failed: %v", d.Name, err)
+		}
+		if result.Removed > 0 {
+			log.Printf("Retention: removed %d files (%d bytes) from %s", result.Removed, result.FreedBytes, d.Name)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Run cleans on every tick until ctx is cancelled. A non-positive interval
+// disables the background loop.
+func (j *Janitor) Run(ctx context.Context) {
+	if j.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			j.CleanAll()
+		}
+	}
+}
@@ -0,0 +1,256 @@
+// Package review keeps the state of the review queue: which receipts a
+// reviewer has claimed, and how the ones checked were resolved, so several
+// people can work through low-quality parses without checking the same
+// receipt twice. What is in the queue is worked out from the receipts
+// themselves; only claims and resolutions are kept here.
+package review
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"myprice/internal/crypt"
+)
+
+// ErrClaimed is returned when another reviewer holds the claim on a
+// receipt.
+var ErrClaimed = errors.New("receipt is claimed by another reviewer")
+
+// ErrResolved is returned for a receipt that has already been resolved.
+var ErrResolved = errors.New("receipt has already been resolved")
+
+// ErrNotClaimed is returned when releasing a receipt nobody has claimed.
+var ErrNotClaimed = errors.New("receipt is not claimed")
+
+// Resolution is what a reviewer decided about a receipt. A receipt whose
+// data needed fixing is corrected instead, as a new version.
+type Resolution string
+
+const (
+	// ResolutionAccepted means the data is right as stored, despite what
+	// put it in the queue.
+	ResolutionAccepted Resolution = "accepted"
+	// ResolutionRejected means the data can't be made better, as for a
+	// photo too poor to read; it is kept as it is.
+	ResolutionRejected Resolution = "rejected"
+)
+
+// Valid reports whether r is a known resolution.
+func (r Resolution) Valid() bool {
+	return r == ResolutionAccepted || r == ResolutionRejected
+}
+
+// Entry is the review state of one receipt version.
+type Entry struct {
+	ReceiptID string `json:"receipt_id"`
+
+	// The reviewer working on it, until ClaimExpiresAt
+	ClaimedBy      string     `json:"claimed_by,omitempty"`
+	ClaimedAt      *time.Time `json:"claimed_at,omitempty"`
+	ClaimExpiresAt *time.Time `json:"claim_expires_at,omitempty"`
+
+	Resolution Resolution `json:"resolution,omitempty"`
+	ResolvedBy string     `json:"resolved_by,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	Note       string     `json:"note,omitempty"`
+}
+
+// Claimed reports whether the entry holds a claim that hasn't expired.
+func (e Entry) Claimed(now time.Time) bool {
+	return e.ClaimedAt != nil && (e.ClaimExpiresAt == nil || now.Before(*e.ClaimExpiresAt))
+}
+
+// Resolved reports whether the receipt has been resolved.
+func (e Entry) Resolved() bool {
+	return e.Resolution != ""
+}
+
+// Store keeps entries by receipt ID, persisted as one JSON file. A claim
+// lasts its TTL, so a receipt whose reviewer went away goes back to the
+// queue; claiming it again renews it.
+type Store struct {
+	path     string
+	claimTTL time.Duration // 0 keeps claims until released or resolved
+	cipher   *crypt.Cipher
+
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+// Open loads the store at path, starting empty if the file doesn't exist.
+// The file is encrypted when c is non-nil.
+func Open(path string, claimTTL time.Duration, c *crypt.Cipher) (*Store, error) {
+	s := &Store{path: path, claimTTL: claimTTL, cipher: c, entries: make(map[string]Entry)}
+
+	data, err := c.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read review state: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse review state: %w", err)
+	}
+	return s, nil
+}
+
+// Get returns the entry for a receipt, with an expired claim cleared. It
+// is empty but for the ID when the receipt has none.
+func (s *Store) Get(id string) Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(id, time.Now())
+}
+
+// All returns every entry, with expired claims cleared, by receipt ID.
+func (s *Store) All() map[string]Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	all := make(map[string]Entry, len(s.entries))
+	for id := range s.entries {
+		all[id] = s.get(id, now)
+	}
+	return all
+}
+
+// Claim claims a receipt for reviewer, or renews their claim. It returns
+// ErrClaimed when someone else holds it and ErrResolved once it is
+// resolved, with the entry that stood in the way.
+func (s *Store) Claim(id, reviewer string) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	e := s.get(id, now)
+	switch {
+	case e.Resolved():
+		return e, ErrResolved
+	case e.Claimed(now) && e.ClaimedBy != reviewer:
+		return e, ErrClaimed
+	}
+	if !e.Claimed(now) {
+		e.ClaimedBy, e.ClaimedAt = reviewer, &now
+	}
+	if s.claimTTL > 0 {
+		expires := now.Add(s.claimTTL)
+		e.ClaimExpiresAt = &expires
+	}
+	return e, s.put(e)
+}
+
+// Release gives up reviewer's claim on a receipt. override releases
+// anyone's claim, for an admin.
+func (s *Store) Release(id, reviewer string, override bool) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	e := s.get(id, now)
+	switch {
+	case !e.Claimed(now):
+		return e, ErrNotClaimed
+	case e.ClaimedBy != reviewer && !override:
+		return e, ErrClaimed
+	}
+	e.ClaimedBy, e.ClaimedAt, e.ClaimExpiresAt = "", nil, nil
+	return e, s.put(e)
+}
+
+// Resolve records reviewer's resolution of a receipt and ends the claim on
+// it. A receipt claimed by someone else can only be resolved with
+// override; otherwise ErrClaimed comes with the entry holding the claim.
+func (s *Store) Resolve(id, reviewer string, resolution Resolution, note string, override bool) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	e := s.get(id, now)
+	switch {
+	case e.Resolved():
+		return e, ErrResolved
+	case e.Claimed(now) && e.ClaimedBy != reviewer && !override:
+		return e, ErrClaimed
+	}
+	e.ClaimedBy, e.ClaimedAt, e.ClaimExpiresAt = "", nil, nil
+	e.Resolution, e.ResolvedBy, e.ResolvedAt, e.Note = resolution, reviewer, &now, note
+	return e, s.put(e)
+}
+
+// Delete removes the entries of erased receipts.
+func (s *Store) Delete(ids ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := false
+	for _, id := range ids {
+		if _, ok := s.entries[id]; ok {
+			delete(s.entries, id)
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+	return s.save()
+}
+
+// Resolutions returns the resolved entries, most recent first.
+func (s *Store) Resolutions() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var resolved []Entry
+	for _, e := range s.entries {
+		if e.Resolved() {
+			resolved = append(resolved, e)
+		}
+	}
+	sort.Slice(resolved, func(i, j int) bool { return resolved[i].ResolvedAt.After(*resolved[j].ResolvedAt) })
+	return resolved
+}
+
+// get returns the entry for id as of now. Callers hold s.mu.
+func (s *Store) get(id string, now time.Time) Entry {
+	e, ok := s.entries[id]
+	if !ok {
+		return Entry{ReceiptID: id}
+	}
+	if e.ClaimedAt != nil && !e.Claimed(now) {
+		e.ClaimedBy, e.ClaimedAt, e.ClaimExpiresAt = "", nil, nil
+	}
+	return e
+}
+
+// put stores e and saves, keeping the previous entry if saving fails.
+// Callers hold s.mu.
+func (s *Store) put(e Entry) error {
+	prev, had := s.entries[e.ReceiptID]
+	if e.ClaimedAt == nil && !e.Resolved() {
+		delete(s.entries, e.ReceiptID)
+	} else {
+		s.entries[e.ReceiptID] = e
+	}
+	if err := s.save(); err != nil {
+		if had {
+			s.entries[e.ReceiptID] = prev
+		} else {
+			delete(s.entries, e.ReceiptID)
+		}
+		return err
+	}
+	return nil
+}
+
+// save writes the entries. Callers hold s.mu.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize review state: %w", err)
+	}
+	if err := s.cipher.WriteFile(s.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write review state: %w", err)
+	}
+	return nil
+}
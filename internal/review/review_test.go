@@ -0,0 +1,45 @@
+package review
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestClaimWithoutTTL(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "review.json"), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := s.Claim("r1", "alice")
+	if err != nil {
+		t.Fatalf("Claim by alice: %v", err)
+	}
+	if e.ClaimExpiresAt != nil {
+		t.Errorf("claim without a TTL expires at %v", e.ClaimExpiresAt)
+	}
+
+	e, err = s.Claim("r1", "bob")
+	if !errors.Is(err, ErrClaimed) {
+		t.Fatalf("Claim by bob = %v, want ErrClaimed", err)
+	}
+	if e.ClaimedBy != "alice" || e.ReceiptID != "r1" {
+		t.Errorf("conflicting entry = %+v, want r1 claimed by alice", e)
+	}
+
+	e, err = s.Resolve("r1", "bob", ResolutionAccepted, "", false)
+	if !errors.Is(err, ErrClaimed) || e.ClaimedBy != "alice" {
+		t.Errorf("Resolve by bob = %+v, %v, want alice's claim and ErrClaimed", e, err)
+	}
+	if _, err := s.Release("r1", "bob", false); !errors.Is(err, ErrClaimed) {
+		t.Errorf("Release by bob = %v, want ErrClaimed", err)
+	}
+
+	if _, err := s.Resolve("r1", "alice", ResolutionAccepted, "", false); err != nil {
+		t.Fatalf("Resolve by alice: %v", err)
+	}
+	if e := s.Get("r1"); !e.Resolved() || e.ClaimedAt != nil {
+		t.Errorf("after resolving, entry = %+v", e)
+	}
+}
@@ -0,0 +1,89 @@
+package sink
+
+import (
+	"context"
+
+	"myprice/internal/receipt"
+)
+
+// PriceAlertDetector is the anomaly detector whose findings a PriceAlerts
+// sink sends.
+const PriceAlertDetector = "price_history"
+
+// PriceAlerts POSTs a result to a webhook only when an item on it costs
+// much more or less than its owner usually pays, as a notification rather
+// than a copy of every receipt. The body is the result with only those
+// anomalies.
+type PriceAlerts struct {
+	webhook *Webhook
+}
+
+// NewPriceAlerts posts price alerts to rawURL, signed as NewWebhook's are.
+func NewPriceAlerts(rawURL string, sign func([]byte) string) (*PriceAlerts, error) {
+	w, err := NewWebhook(rawURL, sign)
+	if err != nil {
+		return nil, err
+	}
+	return &PriceAlerts{webhook: w}, nil
+}
+
+// Kind returns "price_alerts".
+func (p *PriceAlerts) Kind() string {
+	return "price_alerts"
+}
+
+// Target is the webhook URL without its query string.
+func (p *PriceAlerts) Target() string {
+	return p.webhook.Target()
+}
+
+// Send posts r if it has price alerts, and otherwise does nothing.
+func (p *PriceAlerts) Send(ctx context.Context, r Result) error {
+	var alerts []receipt.Anomaly
+	for _, a := range r.Anomalies {
+		if a.Detector == PriceAlertDetector {
+			alerts = append(alerts, a)
+		}
+	}
+	if len(alerts) == 0 {
+		return nil
+	}
+	r.Anomalies = alerts
+	return p.webhook.Send(ctx, r)
+}
+
+// BudgetAlerts POSTs a result to a webhook only when its spending crossed
+// a threshold of one of its owner's budgets. The body is the result with
+// its budget alerts.
+type BudgetAlerts struct {
+	webhook *Webhook
+}
+
+// NewBudgetAlerts posts budget alerts to rawURL, signed as NewWebhook's
+// are.
+func NewBudgetAlerts(rawURL string, sign func([]byte) string) (*BudgetAlerts, error) {
+	w, err := NewWebhook(rawURL, sign)
+	if err != nil {
+		return nil, err
+	}
+	return &BudgetAlerts{webhook: w}, nil
+}
+
+// Kind returns "budget_alerts".
+func (b *BudgetAlerts) Kind() string {
+	return "budget_alerts"
+}
+
+// Target is the webhook URL without its query string.
+func (b *BudgetAlerts) Target() string {
+	return b.webhook.Target()
+}
+
+// Send posts r if it crossed a budget threshold, and otherwise does
+// nothing.
+func (b *BudgetAlerts) Send(ctx context.Context, r Result) error {
+	if len(r.BudgetAlerts) == 0 {
+		return nil
+	}
+	return b.webhook.Send(ctx, r)
+}
@@ -0,0 +1,48 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"myprice/internal/crypt"
+)
+
+// File writes each result as a JSON file named by its receipt ID into a
+// directory, for tools that watch a folder.
+type File struct {
+	dir    string
+	cipher *crypt.Cipher
+}
+
+// NewFile writes results into dir, encrypted when c is non-nil.
+func NewFile(dir string, c *crypt.Cipher) *File {
+	return &File{dir: filepath.Clean(dir), cipher: c}
+}
+
+// Kind returns "file".
+func (f *File) Kind() string {
+	return "file"
+}
+
+// Target is the directory.
+func (f *File) Target() string {
+	return f.dir
+}
+
+// Send writes r to <dir>/<receipt_id>.json.
+func (f *File) Send(ctx context.Context, r Result) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return Permanent(fmt.Errorf("failed to serialize result: %w", err))
+	}
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create sink directory: %w", err)
+	}
+	if err := f.cipher.WriteFile(filepath.Join(f.dir, r.ReceiptID+".json"), data, 0644); err != nil {
+		return fmt.Errorf("failed to write result: %w", err)
+	}
+	return nil
+}
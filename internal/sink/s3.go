@@ -0,0 +1,63 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// S3 uploads each result as a JSON object with the AWS CLI, using its
+// usual credentials.
+type S3 struct {
+	prefix string // s3://bucket/prefix, without a trailing slash
+	cli    func(ctx context.Context, args ...string) ([]byte, error)
+}
+
+// NewS3 uploads results under dest, an s3://bucket or s3://bucket/prefix
+// URL, running AWS CLI commands with cli.
+func NewS3(dest string, cli func(ctx context.Context, args ...string) ([]byte, error)) (*S3, error) {
+	bucket, _, _ := strings.Cut(strings.TrimPrefix(dest, "s3://"), "/")
+	if !strings.HasPrefix(dest, "s3://") || bucket == "" {
+		return nil, fmt.Errorf("S3 destination must be an s3://bucket/prefix URL: %q", dest)
+	}
+	return &S3{prefix: strings.TrimSuffix(dest, "/"), cli: cli}, nil
+}
+
+// Kind returns "s3".
+func (s *S3) Kind() string {
+	return "s3"
+}
+
+// Target is the s3:// URL results go under.
+func (s *S3) Target() string {
+	return s.prefix
+}
+
+// Send uploads r as <prefix>/<receipt_id>.json.
+func (s *S3) Send(ctx context.Context, r Result) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return Permanent(fmt.Errorf("failed to serialize result: %w", err))
+	}
+
+	// The CLI reads the object from a file, so results never appear in its
+	// arguments
+	tmp, err := os.CreateTemp("", "sink-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+
+	_, err = s.cli(ctx, "s3", "cp", tmp.Name(), s.prefix+"/"+r.ReceiptID+".json",
+		"--content-type", "application/json", "--only-show-errors")
+	return err
+}
@@ -0,0 +1,77 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultSheetsURL is the Google Sheets API server.
+const DefaultSheetsURL = "https://sheets.googleapis.com"
+
+// SheetsColumns are the columns of the rows a Sheets sink appends.
+var SheetsColumns = []string{"Date", "Vendor", "Total", "Currency", "Type", "Owner", "Receipt ID", "Version"}
+
+// Sheets appends a row for each result to a Google Sheet.
+type Sheets struct {
+	spreadsheetID string
+	sheet         string
+	baseURL       string
+	token         func(ctx context.Context) (string, error)
+	client        *http.Client
+}
+
+// NewSheets appends to the named sheet (tab) of a spreadsheet, after its
+// last row. token returns an OAuth access token with the spreadsheets
+// scope. An empty baseURL uses Google's servers.
+func NewSheets(spreadsheetID, sheet, baseURL string, token func(ctx context.Context) (string, error)) *Sheets {
+	if baseURL == "" {
+		baseURL = DefaultSheetsURL
+	}
+	return &Sheets{
+		spreadsheetID: spreadsheetID,
+		sheet:         sheet,
+		baseURL:       strings.TrimSuffix(baseURL, "/"),
+		token:         token,
+		client:        &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Kind returns "sheets".
+func (s *Sheets) Kind() string {
+	return "sheets"
+}
+
+// Target is the spreadsheet ID and sheet.
+func (s *Sheets) Target() string {
+	return s.spreadsheetID + "/" + s.sheet
+}
+
+// Send appends r's row, in SheetsColumns order.
+func (s *Sheets) Send(ctx context.Context, r Result) error {
+	body, err := json.Marshal(map[string]any{
+		"values": [][]any{{r.Date, r.Vendor, r.Total, r.Currency, r.DocumentType, r.Owner, r.ReceiptID, r.Version}},
+	})
+	if err != nil {
+		return Permanent(fmt.Errorf("failed to serialize row: %w", err))
+	}
+	token, err := s.token(ctx)
+	if err != nil {
+		return fmt.Errorf("google sheets token: %w", err)
+	}
+
+	q := url.Values{}
+	q.Set("valueInputOption", "USER_ENTERED")
+	q.Set("insertDataOption", "INSERT_ROWS")
+	endpoint := fmt.Sprintf("%s/v4/spreadsheets/%s/values/%s:append?%s",
+		s.baseURL, url.PathEscape(s.spreadsheetID), url.PathEscape(s.sheet), q.Encode())
+	header := http.Header{
+		"Content-Type":  {"application/json"},
+		"Authorization": {"Bearer " + token},
+	}
+	return post(ctx, s.client, "google sheets", endpoint, header, body)
+}
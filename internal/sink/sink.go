@@ -0,0 +1,337 @@
+// Package sink fans completed analyses out to other destinations, such as
+// a webhook, a folder, S3, or a Google Sheet. Each sink has its own queue,
+// so a slow or failing destination doesn't hold up the others, and retries
+// failed deliveries with backoff. Deliveries that still fail are kept for
+// a manual retry.
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"myprice/internal/budget"
+	"myprice/internal/crypt"
+	"myprice/internal/receipt"
+)
+
+const (
+	// queueSize bounds the deliveries waiting for one sink.
+	queueSize = 1000
+
+	// maxFailedIDs bounds the failed deliveries kept per sink for retry.
+	maxFailedIDs = 1000
+
+	// Delay before the first retry of a delivery, doubled each time up to
+	// maxBackoff.
+	initialBackoff = 2 * time.Second
+	maxBackoff     = time.Minute
+)
+
+// Result is a completed analysis as sinks receive it.
+type Result struct {
+	ReceiptID    string         `json:"receipt_id"`
+	PreviousID   string         `json:"previous_id,omitempty"` // The version this one replaces
+	Version      int            `json:"version"`
+	Owner        string         `json:"owner,omitempty"`
+	DocumentType string         `json:"document_type"`
+	ImageSHA256  string         `json:"image_sha256,omitempty"`
+	CreatedAt    time.Time      `json:"created_at"`
+	Vendor       string         `json:"vendor,omitempty"` // Chain when known
+	Date         string         `json:"date,omitempty"`   // Purchase date, YYYY-MM-DD
+	Total        float64        `json:"total"`
+	Currency     string         `json:"currency,omitempty"`
+	Data         map[string]any `json:"data"`
+
+	Anomalies    []receipt.Anomaly `json:"anomalies,omitempty"`     // Found by the anomaly detectors
+	Quality      *receipt.Quality  `json:"quality,omitempty"`       // How far the result can be trusted
+	BudgetAlerts []budget.Alert    `json:"budget_alerts,omitempty"` // Budget thresholds the receipt's spending crossed
+}
+
+// Sink is a destination for completed analyses.
+type Sink interface {
+	// Kind is the sink type, e.g. "webhook".
+	Kind() string
+	// Target describes where results go, without credentials.
+	Target() string
+	// Send delivers one result. Errors wrapped with Permanent aren't retried.
+	Send(ctx context.Context, r Result) error
+}
+
+// permanentError is a delivery failure retrying won't fix.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying, e.g. a rejected request.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// Status is one sink's delivery progress.
+type Status struct {
+	Name        string    `json:"name"`
+	Kind        string    `json:"kind"`
+	Target      string    `json:"target"`
+	Delivered   int       `json:"delivered"`
+	Failed      int       `json:"failed"`     // Deliveries that ran out of attempts
+	Queued      []string  `json:"queued"`     // Receipt IDs waiting or being retried
+	FailedIDs   []string  `json:"failed_ids"` // Receipt IDs to deliver on a manual retry, oldest first
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	LastFailure time.Time `json:"last_failure,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Loader looks up the result for a receipt ID, to deliver results queued
+// before a restart or retried by hand.
+type Loader func(id string) (Result, error)
+
+// named is a sink and its queue.
+type named struct {
+	Sink
+	name     string
+	queue    chan Result
+	restored []string // Receipt IDs queued before the last shutdown
+}
+
+// Dispatcher delivers results to every sink.
+type Dispatcher struct {
+	sinks    []*named
+	attempts int
+	path     string
+	cipher   *crypt.Cipher
+	load     Loader
+
+	mu     sync.Mutex
+	states map[string]*Status
+}
+
+// NewDispatcher delivers to sinks, trying each delivery up to attempts
+// times. Progress is kept in the file at statePath, encrypted when c is
+// non-nil. Sinks are named by kind, numbered from the second of a kind,
+// e.g. "webhook" and "webhook-2".
+func NewDispatcher(sinks []Sink, attempts int, statePath string, c *crypt.Cipher) (*Dispatcher, error) {
+	d := &Dispatcher{attempts: max(attempts, 1), path: statePath, cipher: c, states: make(map[string]*Status)}
+
+	data, err := c.ReadFile(statePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read sink state: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &d.states); err != nil {
+			return nil, fmt.Errorf("failed to parse sink state: %w", err)
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, s := range sinks {
+		counts[s.Kind()]++
+		name := s.Kind()
+		if n := counts[s.Kind()]; n > 1 {
+			name += "-" + strconv.Itoa(n)
+		}
+		d.sinks = append(d.sinks, &named{Sink: s, name: name, queue: make(chan Result, queueSize)})
+
+		st := d.states[name]
+		if st == nil {
+			st = &Status{Name: name}
+			d.states[name] = st
+		}
+		// The configuration may have changed since the state was saved
+		st.Kind, st.Target = s.Kind(), s.Target()
+		d.sinks[len(d.sinks)-1].restored = slices.Clone(st.Queued)
+	}
+	return d, nil
+}
+
+// Start delivers queued results until ctx is cancelled. Results queued
+// before the last shutdown are looked up with load and sent again.
+func (d *Dispatcher) Start(ctx context.Context, load Loader) {
+	d.mu.Lock()
+	d.load = load
+	d.mu.Unlock()
+
+	for _, s := range d.sinks {
+		for _, id := range s.restored {
+			r, err := load(id)
+			if err != nil {
+				d.finish(s, id, fmt.Errorf("failed to load queued result: %w", err))
+				continue
+			}
+			d.push(s, r)
+		}
+		go d.run(ctx, s)
+	}
+}
+
+// Deliver queues a result for every sink.
+func (d *Dispatcher) Deliver(r Result) {
+	for _, s := range d.sinks {
+		d.enqueue(s, r)
+	}
+}
+
+// Retry queues the failed deliveries of the named sink again, returning
+// how many were queued.
+func (d *Dispatcher) Retry(name string) (int, error) {
+	var s *named
+	for _, candidate := range d.sinks {
+		if candidate.name == name {
+			s = candidate
+		}
+	}
+	if s == nil {
+		return 0, fmt.Errorf("no sink named %q", name)
+	}
+
+	d.mu.Lock()
+	load := d.load
+	if load == nil {
+		d.mu.Unlock()
+		return 0, errors.New("sinks are not running")
+	}
+	st := d.states[name]
+	ids := st.FailedIDs
+	st.FailedIDs = nil
+	d.saveLocked()
+	d.mu.Unlock()
+
+	queued := 0
+	for _, id := range ids {
+		r, err := load(id)
+		if err != nil {
+			d.finish(s, id, fmt.Errorf("failed to load result: %w", err))
+			continue
+		}
+		d.enqueue(s, r)
+		queued++
+	}
+	return queued, nil
+}
+
+// Statuses returns every sink's progress, in configuration order.
+func (d *Dispatcher) Statuses() []Status {
+	statuses := make([]Status, 0, len(d.sinks))
+	for _, s := range d.sinks {
+		statuses = append(statuses, d.Status(s.name))
+	}
+	return statuses
+}
+
+// Status returns a copy of the named sink's progress.
+func (d *Dispatcher) Status(name string) Status {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st := *d.states[name]
+	st.Queued = append([]string{}, st.Queued...)
+	st.FailedIDs = append([]string{}, st.FailedIDs...)
+	return st
+}
+
+// enqueue records a result as queued for s and queues it.
+func (d *Dispatcher) enqueue(s *named, r Result) {
+	d.mu.Lock()
+	st := d.states[s.name]
+	st.Queued = append(st.Queued, r.ReceiptID)
+	d.saveLocked()
+	d.mu.Unlock()
+	d.push(s, r)
+}
+
+// push queues a result already recorded as queued, failing it when the
+// queue is full.
+func (d *Dispatcher) push(s *named, r Result) {
+	select {
+	case s.queue <- r:
+	default:
+		d.finish(s, r.ReceiptID, errors.New("queue is full"))
+	}
+}
+
+// run sends s's queued results in order, retrying each with backoff.
+func (d *Dispatcher) run(ctx context.Context, s *named) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-s.queue:
+			err := d.send(ctx, s, r)
+			if ctx.Err() != nil {
+				// Still queued, so it is sent after a restart
+				return
+			}
+			d.finish(s, r.ReceiptID, err)
+		}
+	}
+}
+
+// send tries a delivery until it succeeds, fails permanently, runs out of
+// attempts, or ctx is cancelled.
+func (d *Dispatcher) send(ctx context.Context, s *named, r Result) error {
+	backoff := initialBackoff
+	var err error
+	for attempt := 1; attempt <= d.attempts; attempt++ {
+		if err = s.Send(ctx, r); err == nil {
+			return nil
+		}
+		var permanent permanentError
+		if errors.As(err, &permanent) || attempt == d.attempts {
+			break
+		}
+		log.Printf("Warning: delivery of %s to sink %s failed (attempt %d of %d), retrying in %s: %v", r.ReceiptID, s.name, attempt, d.attempts, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+	return err
+}
+
+// finish records how a delivery ended.
+func (d *Dispatcher) finish(s *named, id string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	st := d.states[s.name]
+	for i, queued := range st.Queued {
+		if queued == id {
+			st.Queued = append(st.Queued[:i:i], st.Queued[i+1:]...)
+			break
+		}
+	}
+	if err == nil {
+		st.Delivered++
+		st.LastSuccess = time.Now().UTC()
+	} else {
+		log.Printf("Warning: delivery of %s to sink %s failed: %v", id, s.name, err)
+		st.Failed++
+		st.LastFailure, st.LastError = time.Now().UTC(), err.Error()
+		st.FailedIDs = append(st.FailedIDs, id)
+		if len(st.FailedIDs) > maxFailedIDs {
+			st.FailedIDs = st.FailedIDs[len(st.FailedIDs)-maxFailedIDs:]
+		}
+	}
+	d.saveLocked()
+}
+
+// saveLocked writes the state file, logging failures rather than failing
+// deliveries. d.mu must be held.
+func (d *Dispatcher) saveLocked() {
+	data, err := json.MarshalIndent(d.states, "", "  ")
+	if err == nil {
+		err = d.cipher.WriteFile(d.path, data, 0644)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to write sink state: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Webhook POSTs each result as JSON to a URL.
+type Webhook struct {
+	url    string
+	sign   func([]byte) string
+	client *http.Client
+}
+
+// NewWebhook posts results to rawURL. When sign is non-nil, the
+// X-Myprice-Signature header carries sign(body), so receivers can check
+// where a result came from.
+func NewWebhook(rawURL string, sign func([]byte) string) (*Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("webhook URL must be an http or https URL: %q", rawURL)
+	}
+	return &Webhook{url: rawURL, sign: sign, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+// Kind returns "webhook".
+func (w *Webhook) Kind() string {
+	return "webhook"
+}
+
+// Target is the URL without its query string, which may hold a secret.
+func (w *Webhook) Target() string {
+	u, _ := url.Parse(w.url)
+	u.RawQuery, u.User = "", nil
+	return u.String()
+}
+
+// Send posts r.
+func (w *Webhook) Send(ctx context.Context, r Result) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return Permanent(fmt.Errorf("failed to serialize result: %w", err))
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	if w.sign != nil {
+		header.Set("X-Myprice-Signature", w.sign(body))
+	}
+	return post(ctx, w.client, "webhook", w.url, header, body)
+}
+
+// post sends body to url. Client errors other than timeouts and rate
+// limits are permanent: sending the same body again gets the same answer.
+func post(ctx context.Context, client *http.Client, service, url string, header http.Header, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(fmt.Errorf("failed to create request: %w", err))
+	}
+	req.Header = header
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s request failed: %w", service, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("%s error (status %d): %s", service, resp.StatusCode, bytes.TrimSpace(msg))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return Permanent(err)
+	}
+	return err
+}
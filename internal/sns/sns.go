@@ -0,0 +1,241 @@
+// Package sns reads and verifies messages Amazon SNS delivers to HTTP
+// endpoints.
+//
+// SNS signs each message with the private key of a certificate it serves
+// from an amazonaws.com URL given in the message. Verify checks that URL
+// before fetching the certificate, so a forged message can't point it at a
+// key of the sender's choosing.
+package sns
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message types.
+const (
+	TypeNotification             = "Notification"
+	TypeSubscriptionConfirmation = "SubscriptionConfirmation"
+	TypeUnsubscribeConfirmation  = "UnsubscribeConfirmation"
+)
+
+// maxCertSize bounds a signing certificate download.
+const maxCertSize = 64 << 10
+
+// ErrInvalid is returned for a message that is malformed or whose
+// signature doesn't check out.
+var ErrInvalid = errors.New("invalid SNS message")
+
+// certHost matches the hosts SNS serves signing certificates from.
+var certHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// Message is an SNS message as delivered to an HTTP endpoint.
+type Message struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	Token            string `json:"Token,omitempty"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject,omitempty"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+	SubscribeURL     string `json:"SubscribeURL,omitempty"`
+	UnsubscribeURL   string `json:"UnsubscribeURL,omitempty"`
+}
+
+// Parse decodes a message from an HTTP request body.
+func Parse(data []byte) (*Message, error) {
+	var m Message
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if m.Type == "" || m.TopicArn == "" || m.Signature == "" {
+		return nil, fmt.Errorf("%w: missing fields", ErrInvalid)
+	}
+	return &m, nil
+}
+
+// stringToSign builds the text SNS signs for m: its fields, by type, as
+// alternating name and value lines in a fixed order.
+func (m *Message) stringToSign() (string, error) {
+	var fields [][2]string
+	switch m.Type {
+	case TypeNotification:
+		fields = [][2]string{{"Message", m.Message}, {"MessageId", m.MessageID}}
+		if m.Subject != "" {
+			fields = append(fields, [2]string{"Subject", m.Subject})
+		}
+		fields = append(fields, [2]string{"Timestamp", m.Timestamp}, [2]string{"TopicArn", m.TopicArn}, [2]string{"Type", m.Type})
+	case TypeSubscriptionConfirmation, TypeUnsubscribeConfirmation:
+		fields = [][2]string{
+			{"Message", m.Message}, {"MessageId", m.MessageID}, {"SubscribeURL", m.SubscribeURL},
+			{"Timestamp", m.Timestamp}, {"Token", m.Token}, {"TopicArn", m.TopicArn}, {"Type", m.Type},
+		}
+	default:
+		return "", fmt.Errorf("%w: unknown type %q", ErrInvalid, m.Type)
+	}
+
+	var b strings.Builder
+	for _, f := range fields {
+		b.WriteString(f[0])
+		b.WriteByte('\n')
+		b.WriteString(f[1])
+		b.WriteByte('\n')
+	}
+	return b.String(), nil
+}
+
+// Verifier checks message signatures, caching the certificates it fetches.
+type Verifier struct {
+	client *http.Client
+
+	mu    sync.Mutex
+	certs map[string]*x509.Certificate
+}
+
+// NewVerifier creates a Verifier that fetches certificates with client, or
+// a client with a short timeout if nil.
+func NewVerifier(client *http.Client) *Verifier {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Verifier{client: client, certs: make(map[string]*x509.Certificate)}
+}
+
+// Verify checks that m was signed by SNS. It returns an error wrapping
+// ErrInvalid for a bad signature or certificate URL, and other errors when
+// the certificate couldn't be fetched.
+func (v *Verifier) Verify(ctx context.Context, m *Message) error {
+	var hash crypto.Hash
+	switch m.SignatureVersion {
+	case "1":
+		hash = crypto.SHA1
+	case "2":
+		hash = crypto.SHA256
+	default:
+		return fmt.Errorf("%w: unsupported signature version %q", ErrInvalid, m.SignatureVersion)
+	}
+
+	text, err := m.stringToSign()
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: malformed signature", ErrInvalid)
+	}
+	cert, err := v.cert(ctx, m.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("%w: certificate has no RSA key", ErrInvalid)
+	}
+
+	var digest []byte
+	if hash == crypto.SHA1 {
+		sum := sha1.Sum([]byte(text))
+		digest = sum[:]
+	} else {
+		sum := sha256.Sum256([]byte(text))
+		digest = sum[:]
+	}
+	if err := rsa.VerifyPKCS1v15(key, hash, digest, sig); err != nil {
+		return fmt.Errorf("%w: signature mismatch", ErrInvalid)
+	}
+	return nil
+}
+
+// cert returns the certificate at rawURL, fetching it on first use. Only
+// https URLs on SNS hosts are accepted.
+func (v *Verifier) cert(ctx context.Context, rawURL string) (*x509.Certificate, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || !certHost.MatchString(u.Hostname()) || u.Port() != "" {
+		return nil, fmt.Errorf("%w: untrusted certificate URL %q", ErrInvalid, rawURL)
+	}
+
+	v.mu.Lock()
+	cert, ok := v.certs[rawURL]
+	v.mu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signing certificate: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch signing certificate: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCertSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signing certificate: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: signing certificate is not PEM", ErrInvalid)
+	}
+	cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, fmt.Errorf("%w: signing certificate expired", ErrInvalid)
+	}
+
+	v.mu.Lock()
+	v.certs[rawURL] = cert
+	v.mu.Unlock()
+	return cert, nil
+}
+
+// Confirm confirms a subscription by visiting the SubscribeURL of a
+// verified SubscriptionConfirmation message, which must be an SNS URL.
+func (v *Verifier) Confirm(ctx context.Context, m *Message) error {
+	if m.Type != TypeSubscriptionConfirmation {
+		return fmt.Errorf("%w: not a subscription confirmation", ErrInvalid)
+	}
+	u, err := url.Parse(m.SubscribeURL)
+	if err != nil || u.Scheme != "https" || !certHost.MatchString(u.Hostname()) {
+		return fmt.Errorf("%w: untrusted subscribe URL %q", ErrInvalid, m.SubscribeURL)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.SubscribeURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to confirm subscription: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxCertSize))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to confirm subscription: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+// Package store persists analysis results so they can be listed, exported,
+// and revisited after the HTTP response is gone.
+package store
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"myprice/internal/crypt"
+)
+
+// ArchiveVersion is written in the header line of every export.
+const ArchiveVersion = 1
+
+// archiveLine is one line of a JSONL archive. The first line is a header
+// (Type "header"); every following line is a record (Type "record").
+type archiveLine struct {
+	Type    string        `json:"type"`
+	Version int           `json:"version,omitempty"`
+	Record  *Record       `json:"record,omitempty"`
+	Image   *ArchiveImage `json:"image,omitempty"`
+}
+
+// ArchiveImage carries an original image inside an archive.
+type ArchiveImage struct {
+	Name string `json:"name"`
+	Data string `json:"data"` // base64
+}
+
+// ExportOptions controls what an export contains.
+type ExportOptions struct {
+	// EmbedImages includes each record's original image as base64. Without
+	// it, records only reference images by path.
+	EmbedImages bool
+	// Cipher decrypts images encrypted at rest; archives hold plaintext.
+	Cipher *crypt.Cipher
+}
+
+// ExportResult summarizes an export.
+type ExportResult struct {
+	Records       int `json:"records"`
+	Images        int `json:"images"`
+	MissingImages int `json:"missing_images"`
+}
+
+// Export writes every record in s to w as JSON Lines.
+func Export(w io.Writer, s Store, opts ExportOptions) (ExportResult, error) {
+	var result ExportResult
+
+	records, err := s.List()
+	if err != nil {
+		return result, err
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(archiveLine{Type: "header", Version: ArchiveVersion}); err != nil {
+		return result, fmt.Errorf("failed to write archive header: %w", err)
+	}
+
+	for _, rec := range records {
+		line := archiveLine{Type: "record", Record: rec}
+		if opts.EmbedImages && rec.ImagePath != "" {
+			data, err := opts.Cipher.ReadFile(rec.ImagePath)
+			if err != nil {
+				result.MissingImages++
+			} else {
+				line.Image = &ArchiveImage{
+					Name: filepath.Base(rec.ImagePath),
+					Data: base64.StdEncoding.EncodeToString(data),
+				}
+				result.Images++
+			}
+		}
+		if err := enc.Encode(line); err != nil {
+			return result, fmt.Errorf("failed to write record %s: %w", rec.ID, err)
+		}
+		result.Records++
+	}
+
+	if err := bw.Flush(); err != nil {
+		return result, fmt.Errorf("failed to write archive: %w", err)
+	}
+	return result, nil
+}
+
+// ImportOptions controls how an archive is merged into a store.
+type ImportOptions struct {
+	// ImageDir receives embedded images; their records are repointed there.
+	ImageDir string
+	// Overwrite replaces existing records with the same ID instead of skipping them.
+	Overwrite bool
+	// Cipher encrypts restored images at rest.
+	Cipher *crypt.Cipher
+}
+
+// ImportResult summarizes an import.
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+	Images   int `json:"images"`
+}
+
+// maxArchiveLine bounds a single archive line (a record with an embedded image).
+const maxArchiveLine = 64 << 20
+
+// Import reads a JSON Lines archive from r into s.
+func Import(r io.Reader, s Store, opts ImportOptions) (ImportResult, error) {
+	var result ImportResult
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxArchiveLine)
+
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var line archiveLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return result, fmt.Errorf("line %d: invalid JSON: %w", lineNum, err)
+		}
+
+		switch line.Type {
+		case "header":
+			if line.Version > ArchiveVersion {
+				return result, fmt.Errorf("unsupported archive version %d", line.Version)
+			}
+			continue
+		case "record":
+		default:
+			return result, fmt.Errorf("line %d: unknown line type %q", lineNum, line.Type)
+		}
+
+		rec := line.Record
+		if rec == nil || rec.ID == "" {
+			return result, fmt.Errorf("line %d: record is missing", lineNum)
+		}
+
+		if _, err := s.Get(rec.ID); err == nil && !opts.Overwrite {
+			result.Skipped++
+			continue
+		}
+
+		if line.Image != nil && opts.ImageDir != "" {
+			path, err := restoreImage(opts.ImageDir, line.Image, opts.Cipher)
+			if err != nil {
+				return result, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			rec.ImagePath = path
+			result.Images++
+		}
+
+		// Cached OCR and output paths are machine-specific
+		rec.TextractPath = ""
+		rec.OutputPath = ""
+
+		if err := s.Put(rec); err != nil {
+			return result, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		result.Imported++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return result, fmt.Errorf("failed to read archive: %w", err)
+	}
+	return result, nil
+}
+
+// restoreImage writes an embedded image into dir and returns its path.
+func restoreImage(dir string, img *ArchiveImage, c *crypt.Cipher) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(img.Data)
+	if err != nil {
+		return "", fmt.Errorf("invalid image data: %w", err)
+	}
+
+	name := filepath.Base(img.Name)
+	if name == "." || name == string(filepath.Separator) {
+		return "", fmt.Errorf("invalid image name %q", img.Name)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create image dir: %w", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := c.WriteFile(path, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write image: %w", err)
+	}
+	return path, nil
+}
@@ -0,0 +1,87 @@
+// Package store persists analysis results so they can be listed, exported,
+// and revisited after the HTTP response is gone.
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Change is one field that differs between two results. Path uses dots for
+// object keys and brackets for array indexes, e.g. "items[2].price".
+type Change struct {
+	Path string `json:"path"`
+	Old  any    `json:"old"`
+	New  any    `json:"new"`
+}
+
+// Diff compares two parsed outputs field by field and returns the changed
+// leaf values, sorted by path. Fields missing on one side have a nil value.
+func Diff(oldData, newData map[string]any) []Change {
+	oldFlat, newFlat := map[string]any{}, map[string]any{}
+	flatten("", normalizeJSON(oldData), oldFlat)
+	flatten("", normalizeJSON(newData), newFlat)
+
+	paths := make(map[string]bool)
+	for p := range oldFlat {
+		paths[p] = true
+	}
+	for p := range newFlat {
+		paths[p] = true
+	}
+
+	changes := make([]Change, 0)
+	for p := range paths {
+		o, n := oldFlat[p], newFlat[p]
+		if !reflect.DeepEqual(o, n) {
+			changes = append(changes, Change{Path: p, Old: o, New: n})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+// normalizeJSON round-trips v through JSON so fresh results (which may hold
+// typed slices and structs) compare equal to ones loaded from disk.
+func normalizeJSON(v map[string]any) any {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var out any
+	if err := json.Unmarshal(data, &out); err != nil {
+		return v
+	}
+	return out
+}
+
+// flatten records every leaf of v under its path.
+func flatten(prefix string, v any, out map[string]any) {
+	switch val := v.(type) {
+	case map[string]any:
+		if len(val) == 0 && prefix != "" {
+			out[prefix] = val
+		}
+		for k, child := range val {
+			path := k
+			if prefix != "" {
+				path = prefix + "." + k
+			}
+			flatten(path, child, out)
+		}
+	case []any:
+		if len(val) == 0 {
+			out[prefix] = val
+		}
+		for i, child := range val {
+			flatten(fmt.Sprintf("%s[%d]", prefix, i), child, out)
+		}
+	default:
+		out[prefix] = val
+	}
+}
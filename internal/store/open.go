@@ -0,0 +1,62 @@
+// Package store persists analysis results so they can be listed, exported,
+// and revisited after the HTTP response is gone.
+package store
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"myprice/internal/crypt"
+)
+
+var (
+	postgresMu     sync.Mutex
+	postgresStores = make(map[string]*PostgresStore)
+)
+
+// Open opens the store STORE_BACKEND selects: "file", the default, keeps
+// records in dir, and "postgres" in the database at DATABASE_URL. A
+// Postgres store is opened once per database and shared by later calls,
+// since it always reads the database anyway.
+func Open(dir string, c *crypt.Cipher) (Store, error) {
+	switch backend := os.Getenv("STORE_BACKEND"); backend {
+	case "", "file":
+		return NewFileStore(dir, c)
+	case "postgres":
+		dsn := os.Getenv("DATABASE_URL")
+		if dsn == "" {
+			return nil, fmt.Errorf("STORE_BACKEND=postgres needs DATABASE_URL")
+		}
+		postgresMu.Lock()
+		defer postgresMu.Unlock()
+		if s, ok := postgresStores[dsn]; ok {
+			return s, nil
+		}
+		s, err := OpenPostgres(dsn, c)
+		if err != nil {
+			return nil, err
+		}
+		postgresStores[dsn] = s
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown STORE_BACKEND %q (want file or postgres)", backend)
+	}
+}
+
+// OpenStamp returns the Stamp of the store Open would open, without
+// loading a file store's records: its stamp is read from the names, sizes,
+// and modification times of the record files, so unlike FileStore.Stamp
+// it changes with writes from other processes too.
+func OpenStamp(dir string, c *crypt.Cipher) (string, error) {
+	switch backend := os.Getenv("STORE_BACKEND"); backend {
+	case "", "file":
+		return dirStamp(dir)
+	default:
+		s, err := Open(dir, c)
+		if err != nil {
+			return "", err
+		}
+		return s.Stamp()
+	}
+}
@@ -0,0 +1,277 @@
+// Package store persists analysis results so they can be listed, exported,
+// and revisited after the HTTP response is gone.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"myprice/internal/crypt"
+
+	_ "github.com/lib/pq" // Registers the "postgres" driver
+)
+
+// migrations create and upgrade the Postgres schema, applied in order.
+// Migration N is recorded as version N in schema_migrations; never edit
+// one that was released, add another.
+var migrations = []string{
+	// 1: one row per record, the record JSON kept whole (and encrypted with
+	// encryption at rest on) beside the columns the store queries by
+	`CREATE TABLE receipts (
+		id         TEXT PRIMARY KEY,
+		revision   INTEGER NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL,
+		record     BYTEA NOT NULL
+	);
+	CREATE INDEX receipts_created_at ON receipts (created_at DESC);`,
+
+	// 2: a counter every write to receipts bumps, which Stamp reads, so
+	// instances can tell their cached analytics are stale in one row
+	`CREATE TABLE receipts_version (version BIGINT NOT NULL);
+	INSERT INTO receipts_version (version) VALUES (0);
+	CREATE FUNCTION bump_receipts_version() RETURNS trigger AS $$
+	BEGIN
+		UPDATE receipts_version SET version = version + 1;
+		RETURN NULL;
+	END
+	$$ LANGUAGE plpgsql;
+	CREATE TRIGGER receipts_version AFTER INSERT OR UPDATE OR DELETE ON receipts
+		FOR EACH STATEMENT EXECUTE PROCEDURE bump_receipts_version();`,
+}
+
+// migrationLock is the advisory lock instances hold while migrating, so
+// several starting at once apply each migration once.
+const migrationLock = 7311842
+
+// PostgresStore keeps records in a Postgres table, so several API
+// instances behind a load balancer share them. Unlike FileStore it keeps
+// no in-memory index: every read goes to the database and sees the other
+// instances' writes.
+type PostgresStore struct {
+	db     *sql.DB
+	cipher *crypt.Cipher
+}
+
+// OpenPostgres connects to the database at dsn, a postgres:// URL or
+// key=value connection string, and brings its schema up to date. Records
+// are encrypted in the database when c is non-nil.
+func OpenPostgres(dsn string, c *crypt.Cipher) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	if err := migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &PostgresStore{db: db, cipher: c}, nil
+}
+
+// migrate applies the migrations the database doesn't have yet, each in
+// its own transaction.
+func migrate(ctx context.Context, db *sql.DB) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to migrate database: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLock); err != nil {
+		return fmt.Errorf("failed to lock database for migration: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLock)
+
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	var current int
+	if err := conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this build knows (%d)", current, len(migrations))
+	}
+
+	for i := current; i < len(migrations); i++ {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the database connections.
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+// Put creates or replaces a record.
+func (s *PostgresStore) Put(rec *Record) error {
+	return s.put(rec, false)
+}
+
+// Update replaces a record only if it wasn't written since rec was read.
+func (s *PostgresStore) Update(rec *Record) error {
+	return s.put(rec, true)
+}
+
+// put writes rec, bumping its Revision. With check, the stored record must
+// still be at rec.Revision. The revision column is authoritative; the one
+// in the record JSON is replaced with it on read.
+func (s *PostgresStore) put(rec *Record, check bool) error {
+	if rec.ID == "" {
+		rec.ID = NewID()
+	}
+	if !validID(rec.ID) {
+		return fmt.Errorf("invalid record id: %q", rec.ID)
+	}
+
+	now := time.Now().UTC()
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = now
+	}
+	rec.UpdatedAt = now
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to serialize record: %w", err)
+	}
+	sealed := s.cipher.Seal(data)
+
+	var revision int
+	if check {
+		err = s.db.QueryRow(`UPDATE receipts
+			SET revision = revision + 1, created_at = $3, updated_at = $4, record = $5
+			WHERE id = $1 AND revision = $2
+			RETURNING revision`,
+			rec.ID, rec.Revision, rec.CreatedAt, rec.UpdatedAt, sealed).Scan(&revision)
+		if errors.Is(err, sql.ErrNoRows) {
+			var exists bool
+			if err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM receipts WHERE id = $1)`, rec.ID).Scan(&exists); err != nil {
+				return fmt.Errorf("failed to write record: %w", err)
+			}
+			if !exists {
+				return ErrNotFound
+			}
+			return ErrConflict
+		}
+	} else {
+		err = s.db.QueryRow(`INSERT INTO receipts (id, revision, created_at, updated_at, record)
+			VALUES ($1, 1, $2, $3, $4)
+			ON CONFLICT (id) DO UPDATE
+			SET revision = receipts.revision + 1, created_at = EXCLUDED.created_at,
+				updated_at = EXCLUDED.updated_at, record = EXCLUDED.record
+			RETURNING revision`,
+			rec.ID, rec.CreatedAt, rec.UpdatedAt, sealed).Scan(&revision)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write record: %w", err)
+	}
+	rec.Revision = revision
+	return nil
+}
+
+// Get returns the record with the given ID.
+func (s *PostgresStore) Get(id string) (*Record, error) {
+	var revision int
+	var data []byte
+	err := s.db.QueryRow(`SELECT revision, record FROM receipts WHERE id = $1`, id).Scan(&revision, &data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record: %w", err)
+	}
+	return s.decode(id, revision, data)
+}
+
+// List returns all records, newest first.
+func (s *PostgresStore) List() ([]*Record, error) {
+	rows, err := s.db.Query(`SELECT id, revision, record FROM receipts ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list records: %w", err)
+	}
+	defer rows.Close()
+
+	records := make([]*Record, 0)
+	for rows.Next() {
+		var id string
+		var revision int
+		var data []byte
+		if err := rows.Scan(&id, &revision, &data); err != nil {
+			return nil, fmt.Errorf("failed to list records: %w", err)
+		}
+		rec, err := s.decode(id, revision, data)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list records: %w", err)
+	}
+	return records, nil
+}
+
+// Delete removes a record.
+func (s *PostgresStore) Delete(id string) error {
+	res, err := s.db.Exec(`DELETE FROM receipts WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete record: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Stamp returns the database's write counter, which every instance's
+// writes bump.
+func (s *PostgresStore) Stamp() (string, error) {
+	var version int64
+	if err := s.db.QueryRow(`SELECT version FROM receipts_version`).Scan(&version); err != nil {
+		return "", fmt.Errorf("failed to read store version: %w", err)
+	}
+	return strconv.FormatInt(version, 10), nil
+}
+
+// decode decrypts and parses a stored record.
+func (s *PostgresStore) decode(id string, revision int, data []byte) (*Record, error) {
+	plaintext, err := s.cipher.Open(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record %s: %w", id, err)
+	}
+	var rec Record
+	if err := json.Unmarshal(plaintext, &rec); err != nil {
+		return nil, fmt.Errorf("failed to parse record %s: %w", id, err)
+	}
+	rec.Revision = revision
+	return &rec, nil
+}
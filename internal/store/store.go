@@ -0,0 +1,373 @@
+// Package store persists analysis results so they can be listed, exported,
+// and revisited after the HTTP response is gone.
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"myprice/internal/crypt"
+	"myprice/internal/exif"
+	"myprice/internal/geo"
+	"myprice/internal/receipt"
+)
+
+// ErrNotFound is returned when a record does not exist.
+var ErrNotFound = errors.New("record not found")
+
+// ErrConflict is returned by Update when the record changed since it was read.
+var ErrConflict = errors.New("record was changed since it was read")
+
+// Record is one stored analysis result.
+type Record struct {
+	ID           string `json:"id"`
+	ImagePath    string `json:"image_path"`
+	ImageSHA256  string `json:"image_sha256,omitempty"`
+	TextractPath string `json:"textract_path,omitempty"`
+	OutputPath   string `json:"output_path,omitempty"` // Copy of Data named by OUTPUT_TEMPLATE
+	DocumentType string `json:"document_type"`
+	Source       string `json:"source"`          // Where the textract came from
+	Owner        string `json:"owner,omitempty"` // Name of the API key that submitted the image
+
+	// File the receipt was ingested from, kept in the archive as received
+	Original *Original `json:"original,omitempty"`
+
+	// Scanned batch the receipt was split from, when it held several
+	Split *Split `json:"split,omitempty"`
+
+	// Pipeline that produced Data
+	Parser        string  `json:"parser,omitempty"` // "llm" or "heuristic"
+	Model         string  `json:"model,omitempty"`
+	PromptVersion string  `json:"prompt_version,omitempty"`
+	OCRConfidence float64 `json:"ocr_confidence,omitempty"` // Mean OCR line confidence (0-100)
+
+	// Versioning: each analysis of the same image stores a new record that
+	// supersedes the previous one
+	Version      int    `json:"version,omitempty"`
+	PreviousID   string `json:"previous_id,omitempty"`
+	SupersededBy string `json:"superseded_by,omitempty"`
+
+	// Revision counts the writes to this record, so an edit can tell whether
+	// it was changed since it was read
+	Revision int `json:"revision,omitempty"`
+
+	Location     *geo.Location         `json:"location,omitempty"`
+	PurchaseTime *receipt.PurchaseTime `json:"purchase_time,omitempty"`
+	Capture      *exif.Metadata        `json:"capture,omitempty"` // When and where the photo was taken
+
+	// Purchase identity, for duplicate detection across different images
+	CardLast4   string `json:"card_last4,omitempty"`
+	CheckNumber string `json:"check_number,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// Merchant category code of the vendor, such as "5411" for groceries
+	VendorCategory string `json:"vendor_category,omitempty"`
+
+	// The purchase a refund receipt returns items from, when one matched
+	RefundOf string `json:"refund_of,omitempty"`
+
+	// Problems the anomaly detectors found on Data
+	Anomalies []receipt.Anomaly `json:"anomalies,omitempty"`
+
+	// How far Data can be trusted, scored when it is stored; nil for
+	// invoices
+	Quality *receipt.Quality `json:"quality,omitempty"`
+
+	// Hooks that failed on Data before it was stored
+	HookErrors []HookError `json:"hook_errors,omitempty"`
+
+	// Labels and notes users add, such as "reimbursable"; later versions
+	// of the receipt keep them
+	Tags  []string `json:"tags,omitempty"`
+	Notes string   `json:"notes,omitempty"`
+
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	Data      map[string]any `json:"data"` // Parsed output, as returned in llm_output
+}
+
+// HookError is a hook's failure on a record, whose data was stored
+// without that hook's changes.
+type HookError struct {
+	Hook  string `json:"hook"`
+	Error string `json:"error"`
+}
+
+// Original describes an archived source file: where it came from and
+// the SHA-256 it is archived under.
+type Original struct {
+	SHA256      string    `json:"sha256"`
+	Name        string    `json:"name"` // File name at the source
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Source      string    `json:"source"`              // e.g. "dropbox" or "text"
+	SourceID    string    `json:"source_id,omitempty"` // The file's ID at the source
+	ModifiedAt  time.Time `json:"modified_at,omitempty"`
+	ArchivedAt  time.Time `json:"archived_at"`
+}
+
+// Split says which part of a scanned batch, a PDF holding several
+// receipts, a record was analyzed from.
+type Split struct {
+	Name   string `json:"name"`   // File name of the batch as uploaded
+	SHA256 string `json:"sha256"` // Of the batch, the key it is archived under
+	Part   int    `json:"part"`   // From 1, in the order the batch holds them
+	Parts  int    `json:"parts"`
+	Pages  []int  `json:"pages"` // Pages of the batch the receipt is on
+}
+
+// Store is the persistence interface for analysis records.
+type Store interface {
+	// Put creates or replaces a record. An empty ID is assigned a new one.
+	Put(rec *Record) error
+	// Update replaces a record only if its stored Revision is still
+	// rec.Revision, and returns ErrConflict otherwise.
+	Update(rec *Record) error
+	// Get returns a copy of the record with the given ID.
+	Get(id string) (*Record, error)
+	// List returns copies of all records, newest first.
+	List() ([]*Record, error)
+	// Delete removes a record.
+	Delete(id string) error
+	// Stamp returns a token that changes whenever a record is written or
+	// deleted, so what was computed from the records can be kept until
+	// they change.
+	Stamp() (string, error)
+}
+
+// FileStore keeps one JSON file per record in a directory, with an
+// in-memory index loaded at startup.
+type FileStore struct {
+	dir     string
+	cipher  *crypt.Cipher
+	mu      sync.RWMutex
+	records map[string]*Record
+
+	// Stamp is instance plus writes: each open has its own index
+	instance string
+	writes   uint64
+}
+
+// NewFileStore opens (creating if needed) a file store rooted at dir.
+// Records are encrypted on disk when c is non-nil.
+func NewFileStore(dir string, c *crypt.Cipher) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create store dir: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store dir: %w", err)
+	}
+
+	s := &FileStore{dir: dir, cipher: c, records: make(map[string]*Record), instance: NewID()}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		data, err := c.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read record %s: %w", name, err)
+		}
+		var rec Record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("failed to parse record %s: %w", name, err)
+		}
+		s.records[rec.ID] = &rec
+	}
+
+	return s, nil
+}
+
+// NewID returns a random record ID.
+func NewID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Put creates or replaces a record.
+func (s *FileStore) Put(rec *Record) error {
+	return s.put(rec, false)
+}
+
+// Update replaces a record only if it wasn't written since rec was read.
+func (s *FileStore) Update(rec *Record) error {
+	return s.put(rec, true)
+}
+
+// put writes rec, bumping its Revision. With check, the stored record must
+// still be at rec.Revision.
+func (s *FileStore) put(rec *Record, check bool) error {
+	if rec.ID == "" {
+		rec.ID = NewID()
+	}
+	if !validID(rec.ID) {
+		return fmt.Errorf("invalid record id: %q", rec.ID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.records[rec.ID]
+	if check && !ok {
+		return ErrNotFound
+	}
+	revision := 0
+	if ok {
+		revision = stored.Revision
+	}
+	if check && revision != rec.Revision {
+		return ErrConflict
+	}
+
+	now := time.Now().UTC()
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = now
+	}
+	rec.UpdatedAt = now
+	rec.Revision = revision + 1
+
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		rec.Revision = revision
+		return fmt.Errorf("failed to serialize record: %w", err)
+	}
+	if err := s.cipher.WriteFile(s.path(rec.ID), data, 0644); err != nil {
+		rec.Revision = revision
+		return fmt.Errorf("failed to write record: %w", err)
+	}
+
+	c, err := clone(rec)
+	if err != nil {
+		return err
+	}
+	s.records[rec.ID] = c
+	s.writes++
+	return nil
+}
+
+// Get returns a copy of the record with the given ID.
+func (s *FileStore) Get(id string) (*Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rec, ok := s.records[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return clone(rec)
+}
+
+// List returns copies of all records, newest first.
+func (s *FileStore) List() ([]*Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	records := make([]*Record, 0, len(s.records))
+	for _, rec := range s.records {
+		c, err := clone(rec)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, c)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.After(records[j].CreatedAt)
+	})
+	return records, nil
+}
+
+// Delete removes a record.
+func (s *FileStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.records[id]; !ok {
+		return ErrNotFound
+	}
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete record: %w", err)
+	}
+	delete(s.records, id)
+	s.writes++
+	return nil
+}
+
+// Stamp returns a token that changes with every write to this store.
+func (s *FileStore) Stamp() (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fmt.Sprintf("%s.%d", s.instance, s.writes), nil
+}
+
+// dirStamp returns a token that changes whenever a record file in dir is
+// written or removed, by any process.
+func dirStamp(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read store dir: %w", err)
+	}
+	h := sha256.New()
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		info, err := e.Info()
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read store dir: %w", err)
+		}
+		fmt.Fprintf(h, "%s %d %d\n", name, info.Size(), info.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// path returns the file path for a record ID.
+func (s *FileStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// validID reports whether id is safe to use as a file name.
+func validID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// clone deep-copies a record so callers can't mutate the index.
+func clone(rec *Record) (*Record, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy record: %w", err)
+	}
+	var c Record
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to copy record: %w", err)
+	}
+	return &c, nil
+}
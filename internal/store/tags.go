@@ -0,0 +1,70 @@
+package store
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits on the labels users put on a receipt.
+const (
+	MaxTags      = 20
+	MaxTagLength = 50
+	MaxNotes     = 10000 // Bytes
+)
+
+// NormalizeTag lowercases a tag and joins its words with hyphens, so
+// "Tax Deductible" and "tax-deductible" are the same tag.
+func NormalizeTag(tag string) (string, error) {
+	tag = strings.Join(strings.Fields(strings.ToLower(tag)), "-")
+	if tag == "" {
+		return "", fmt.Errorf("tags can't be empty")
+	}
+	if utf8.RuneCountInString(tag) > MaxTagLength {
+		return "", fmt.Errorf("tag %q is longer than %d characters", tag, MaxTagLength)
+	}
+	for _, r := range tag {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' && r != ':' && r != '.' {
+			return "", fmt.Errorf("tag %q may only hold letters, digits, and - _ : .", tag)
+		}
+	}
+	return tag, nil
+}
+
+// NormalizeTags normalizes tags, dropping repeats and sorting them.
+func NormalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		t, err := NormalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, t)
+	}
+	slices.Sort(normalized)
+	normalized = slices.Compact(normalized)
+	if len(normalized) > MaxTags {
+		return nil, fmt.Errorf("a receipt can have at most %d tags", MaxTags)
+	}
+	return normalized, nil
+}
+
+// HasTags reports whether rec has every one of tags, which are normalized.
+func (rec *Record) HasTags(tags ...string) bool {
+	for _, tag := range tags {
+		if !slices.Contains(rec.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateNotes checks notes fit within MaxNotes.
+func ValidateNotes(notes string) error {
+	if len(notes) > MaxNotes {
+		return fmt.Errorf("notes are longer than %d bytes", MaxNotes)
+	}
+	return nil
+}
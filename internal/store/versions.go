@@ -0,0 +1,74 @@
+// Package store persists analysis results so they can be listed, exported,
+// and revisited after the HTTP response is gone.
+package store
+
+import "sort"
+
+// Latest returns the current (not superseded) record an owner has for an
+// image hash, or nil if they have no record of that image.
+func Latest(s Store, owner, imageSHA256 string) (*Record, error) {
+	if imageSHA256 == "" {
+		return nil, nil
+	}
+
+	records, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *Record
+	for _, rec := range records {
+		if rec.ImageSHA256 != imageSHA256 || rec.Owner != owner || rec.SupersededBy != "" {
+			continue
+		}
+		if latest == nil || rec.Version > latest.Version {
+			latest = rec
+		}
+	}
+	return latest, nil
+}
+
+// Versions returns every stored result for the same source image and owner
+// as rec, oldest version first. Records are grouped by image hash and by
+// their PreviousID/SupersededBy links, so chains survive an image being moved.
+func Versions(s Store, rec *Record) ([]*Record, error) {
+	records, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]*Record, len(records))
+	byHash := make(map[string][]string)
+	for _, r := range records {
+		byID[r.ID] = r
+		if r.ImageSHA256 != "" && r.Owner == rec.Owner {
+			byHash[r.ImageSHA256] = append(byHash[r.ImageSHA256], r.ID)
+		}
+	}
+
+	seen := map[string]bool{rec.ID: true}
+	queue := []*Record{rec}
+	if stored, ok := byID[rec.ID]; ok {
+		queue[0] = stored
+	}
+	for i := 0; i < len(queue); i++ {
+		cur := queue[i]
+		linked := append([]string{cur.PreviousID, cur.SupersededBy}, byHash[cur.ImageSHA256]...)
+		for _, id := range linked {
+			next, ok := byID[id]
+			if !ok || seen[id] || next.Owner != rec.Owner {
+				continue
+			}
+			seen[id] = true
+			queue = append(queue, next)
+		}
+	}
+
+	sort.SliceStable(queue, func(i, j int) bool {
+		if queue[i].Version != queue[j].Version {
+			return queue[i].Version < queue[j].Version
+		}
+		return queue[i].CreatedAt.Before(queue[j].CreatedAt)
+	})
+	return queue, nil
+}
@@ -0,0 +1,383 @@
+// Package textindex is a full-text index over the raw OCR lines of each
+// receipt, so searches can find text the parsers don't extract, such as a
+// promo code or the cashier's name.
+//
+// Queries are words that must all appear somewhere on a receipt. A word
+// ending in * matches as a prefix, and "quoted phrases" must appear within
+// one line. Matching ignores case and punctuation.
+package textindex
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"myprice/internal/crypt"
+)
+
+// ErrEmptyQuery is returned by Search for a query without any words.
+var ErrEmptyQuery = errors.New("search query has no words")
+
+// Doc is the OCR text of one receipt.
+type Doc struct {
+	ID    string   `json:"id"`
+	Lines []string `json:"lines"`
+}
+
+// Match is one line of a receipt that matched a query.
+type Match struct {
+	Line    int    `json:"line"` // 1-based, in OCR order
+	Text    string `json:"text"`
+	Snippet string `json:"snippet"` // Text with each match wrapped in [brackets]
+}
+
+// Hit is a receipt that matched a query.
+type Hit struct {
+	ID      string  `json:"id"`
+	Score   int     `json:"score"` // Occurrences of query words; higher is better
+	Matches []Match `json:"matches"`
+}
+
+// Index holds the OCR lines of every receipt, persisted as one JSON file,
+// with an in-memory inverted index from words to receipts.
+type Index struct {
+	path     string
+	cipher   *crypt.Cipher
+	mu       sync.RWMutex
+	docs     map[string][]string            // Lines by receipt ID
+	postings map[string]map[string]struct{} // Receipt IDs by word
+}
+
+// Open loads the index at path, starting empty if the file doesn't exist.
+// The file is encrypted when c is non-nil.
+func Open(path string, c *crypt.Cipher) (*Index, error) {
+	x := &Index{path: path, cipher: c, docs: make(map[string][]string), postings: make(map[string]map[string]struct{})}
+
+	data, err := c.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return x, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read text index: %w", err)
+	}
+	if err := json.Unmarshal(data, &x.docs); err != nil {
+		return nil, fmt.Errorf("failed to parse text index: %w", err)
+	}
+	for id, lines := range x.docs {
+		x.post(id, lines)
+	}
+	return x, nil
+}
+
+// Put indexes docs, replacing any earlier text for the same IDs.
+func (x *Index) Put(docs ...Doc) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	next := make(map[string][]string, len(x.docs)+len(docs))
+	for id, lines := range x.docs {
+		next[id] = lines
+	}
+	for _, d := range docs {
+		next[d.ID] = d.Lines
+	}
+	if err := x.save(next); err != nil {
+		return err
+	}
+	for _, d := range docs {
+		x.unpost(d.ID, x.docs[d.ID])
+		x.post(d.ID, d.Lines)
+	}
+	x.docs = next
+	return nil
+}
+
+// Delete removes receipts from the index. Unknown IDs are ignored.
+func (x *Index) Delete(ids ...string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	next := make(map[string][]string, len(x.docs))
+	removed := false
+	for id, lines := range x.docs {
+		next[id] = lines
+	}
+	for _, id := range ids {
+		if _, ok := next[id]; ok {
+			delete(next, id)
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+	if err := x.save(next); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		x.unpost(id, x.docs[id])
+	}
+	x.docs = next
+	return nil
+}
+
+// Has reports whether a receipt is indexed.
+func (x *Index) Has(id string) bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	_, ok := x.docs[id]
+	return ok
+}
+
+// Len returns the number of indexed receipts.
+func (x *Index) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.docs)
+}
+
+// term is one word or phrase of a query.
+type term struct {
+	words  []string // A phrase has several
+	prefix bool     // The last word matches as a prefix
+}
+
+// Search returns the receipts containing every word of query, best first,
+// with their matching lines. keep, if non-nil, restricts the results to the
+// IDs it accepts.
+func (x *Index) Search(query string, keep func(id string) bool) ([]Hit, error) {
+	terms := parseQuery(query)
+	if len(terms) == 0 {
+		return nil, ErrEmptyQuery
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	// Narrow to receipts holding every word, then check phrases line by line
+	candidates := x.candidates(terms[0])
+	for _, t := range terms[1:] {
+		if len(candidates) == 0 {
+			break
+		}
+		next := x.candidates(t)
+		for id := range candidates {
+			if _, ok := next[id]; !ok {
+				delete(candidates, id)
+			}
+		}
+	}
+
+	var hits []Hit
+	for id := range candidates {
+		if keep != nil && !keep(id) {
+			continue
+		}
+		if hit, ok := matchDoc(id, x.docs[id], terms); ok {
+			hits = append(hits, hit)
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	return hits, nil
+}
+
+// candidates returns the receipts holding every word of t. Callers hold x.mu.
+func (x *Index) candidates(t term) map[string]struct{} {
+	var set map[string]struct{}
+	for i, w := range t.words {
+		ids := make(map[string]struct{})
+		if t.prefix && i == len(t.words)-1 {
+			for word, posting := range x.postings {
+				if strings.HasPrefix(word, w) {
+					for id := range posting {
+						ids[id] = struct{}{}
+					}
+				}
+			}
+		} else {
+			for id := range x.postings[w] {
+				ids[id] = struct{}{}
+			}
+		}
+		if set == nil {
+			set = ids
+			continue
+		}
+		for id := range set {
+			if _, ok := ids[id]; !ok {
+				delete(set, id)
+			}
+		}
+	}
+	return set
+}
+
+// matchDoc finds each term in a receipt's lines. It fails when some term,
+// such as a phrase whose words are on different lines, isn't found.
+func matchDoc(id string, lines []string, terms []term) (Hit, bool) {
+	hit := Hit{ID: id}
+	found := make([]bool, len(terms))
+	for n, line := range lines {
+		tokens := tokenize(line)
+		var spans [][2]int
+		for i, t := range terms {
+			for start := 0; start+len(t.words) <= len(tokens); start++ {
+				if t.matches(tokens[start : start+len(t.words)]) {
+					found[i] = true
+					hit.Score++
+					spans = append(spans, [2]int{tokens[start].start, tokens[start+len(t.words)-1].end})
+				}
+			}
+		}
+		if len(spans) > 0 {
+			hit.Matches = append(hit.Matches, Match{Line: n + 1, Text: line, Snippet: highlight(line, spans)})
+		}
+	}
+	for _, ok := range found {
+		if !ok {
+			return Hit{}, false
+		}
+	}
+	return hit, true
+}
+
+// matches reports whether tokens spell out t.
+func (t term) matches(tokens []token) bool {
+	for i, w := range t.words {
+		if t.prefix && i == len(t.words)-1 {
+			if !strings.HasPrefix(tokens[i].word, w) {
+				return false
+			}
+		} else if tokens[i].word != w {
+			return false
+		}
+	}
+	return true
+}
+
+// highlight wraps the spans of line in brackets, merging overlaps.
+func highlight(line string, spans [][2]int) string {
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	var sb strings.Builder
+	pos := 0
+	for i := 0; i < len(spans); i++ {
+		start, end := spans[i][0], spans[i][1]
+		for i+1 < len(spans) && spans[i+1][0] <= end {
+			end = max(end, spans[i+1][1])
+			i++
+		}
+		sb.WriteString(line[pos:start])
+		sb.WriteString("[" + line[start:end] + "]")
+		pos = end
+	}
+	sb.WriteString(line[pos:])
+	return sb.String()
+}
+
+// parseQuery splits a query into words and quoted phrases.
+func parseQuery(query string) []term {
+	var terms []term
+	for i, part := range strings.Split(query, `"`) {
+		if i%2 == 1 {
+			// Inside quotes
+			if t := newTerm(part); len(t.words) > 0 {
+				terms = append(terms, t)
+			}
+			continue
+		}
+		for _, field := range strings.Fields(part) {
+			if t := newTerm(field); len(t.words) > 0 {
+				terms = append(terms, t)
+			}
+		}
+	}
+	return terms
+}
+
+// newTerm makes a term from one word or phrase. Punctuation inside a word,
+// as in "SAVE-20", splits it into a phrase.
+func newTerm(s string) term {
+	s = strings.TrimSpace(s)
+	t := term{prefix: strings.HasSuffix(s, "*")}
+	for _, tok := range tokenize(s) {
+		t.words = append(t.words, tok.word)
+	}
+	return t
+}
+
+// token is one lowercase word of a line and its byte offsets.
+type token struct {
+	word       string
+	start, end int
+}
+
+// tokenize splits s into lowercase runs of letters and digits.
+func tokenize(s string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range s {
+		alnum := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if alnum && start < 0 {
+			start = i
+		} else if !alnum && start >= 0 {
+			tokens = append(tokens, token{word: strings.ToLower(s[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{word: strings.ToLower(s[start:]), start: start, end: len(s)})
+	}
+	return tokens
+}
+
+// post adds a receipt's words to the postings. Callers hold x.mu.
+func (x *Index) post(id string, lines []string) {
+	for _, line := range lines {
+		for _, tok := range tokenize(line) {
+			posting, ok := x.postings[tok.word]
+			if !ok {
+				posting = make(map[string]struct{})
+				x.postings[tok.word] = posting
+			}
+			posting[id] = struct{}{}
+		}
+	}
+}
+
+// unpost removes a receipt's words from the postings. Callers hold x.mu.
+func (x *Index) unpost(id string, lines []string) {
+	for _, line := range lines {
+		for _, tok := range tokenize(line) {
+			if posting, ok := x.postings[tok.word]; ok {
+				delete(posting, id)
+				if len(posting) == 0 {
+					delete(x.postings, tok.word)
+				}
+			}
+		}
+	}
+}
+
+func (x *Index) save(docs map[string][]string) error {
+	data, err := json.Marshal(docs)
+	if err != nil {
+		return fmt.Errorf("failed to serialize text index: %w", err)
+	}
+	if err := x.cipher.WriteFile(x.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write text index: %w", err)
+	}
+	return nil
+}
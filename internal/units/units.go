@@ -0,0 +1,155 @@
+// Package units reads package sizes such as "20 OZ" or "1.5L" from item
+// names and converts between weight and volume units, so prices of
+// different package sizes can be compared per 100 g or 100 ml.
+package units
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Dimension is what a unit measures.
+type Dimension string
+
+const (
+	Mass   Dimension = "mass"
+	Volume Dimension = "volume"
+)
+
+// Normalized price bases.
+const (
+	Per100g  = "100g"
+	Per100ml = "100ml"
+)
+
+// unit is a unit's dimension and size in grams or milliliters.
+type unit struct {
+	dim  Dimension
+	base float64
+}
+
+// table maps canonical unit names to their size. Bare "oz" is weight;
+// liquids are sold by "fl oz".
+var table = map[string]unit{
+	"g":     {Mass, 1},
+	"kg":    {Mass, 1000},
+	"oz":    {Mass, 28.349523125},
+	"lb":    {Mass, 453.59237},
+	"ml":    {Volume, 1},
+	"l":     {Volume, 1000},
+	"fl oz": {Volume, 29.5735295625},
+	"pt":    {Volume, 473.176473},
+	"qt":    {Volume, 946.352946},
+	"gal":   {Volume, 3785.411784},
+}
+
+// aliases maps spellings found on receipts to canonical unit names.
+var aliases = map[string]string{
+	"g": "g", "gm": "g", "gr": "g", "gram": "g", "grams": "g",
+	"kg": "kg", "kgs": "kg",
+	"oz": "oz", "ozs": "oz",
+	"lb": "lb", "lbs": "lb",
+	"ml": "ml",
+	"l":  "l", "lt": "l", "ltr": "l", "liter": "l", "liters": "l", "litre": "l", "litres": "l",
+	"floz": "fl oz", "fl oz": "fl oz", "fl.oz": "fl oz", "fl. oz": "fl oz",
+	"pt": "pt", "pint": "pt",
+	"qt": "qt", "quart": "qt",
+	"gal": "gal", "gallon": "gal",
+}
+
+// sizeRegex matches a size such as "20OZ", "1.5 L", "12 FL OZ", or a
+// multipack such as "6/12 OZ" or "12 x 355ml".
+var sizeRegex = regexp.MustCompile(`(?i)(?:\b(\d{1,3})\s*[x/]\s*)?(\d+(?:\.\d+)?|\.\d+)\s*(fl\.?\s*oz|floz|ozs?|lbs?|kgs?|grams?|gm|gr|g|ml|liters?|litres?|ltr|lt|l|pints?|pt|quarts?|qt|gallons?|gal)\b`)
+
+// Size is a package size.
+type Size struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"` // Canonical unit, e.g. "oz" or "fl oz"
+	Count int     `json:"count,omitempty"`
+}
+
+// String formats the size as printed, e.g. "20 oz" or "6 x 12 fl oz".
+func (s Size) String() string {
+	value := strconv.FormatFloat(s.Value, 'f', -1, 64)
+	if s.Count > 1 {
+		return fmt.Sprintf("%d x %s %s", s.Count, value, s.Unit)
+	}
+	return value + " " + s.Unit
+}
+
+// Base returns the total size in grams or milliliters and its dimension.
+func (s Size) Base() (float64, Dimension) {
+	u := table[s.Unit]
+	return s.Value * float64(max(s.Count, 1)) * u.base, u.dim
+}
+
+// ParseSize finds the first package size in an item name.
+func ParseSize(text string) (Size, bool) {
+	m := sizeRegex.FindStringSubmatch(text)
+	if m == nil {
+		return Size{}, false
+	}
+	value, err := strconv.ParseFloat(m[2], 64)
+	if err != nil || value <= 0 {
+		return Size{}, false
+	}
+	name, ok := canonical(m[3])
+	if !ok {
+		return Size{}, false
+	}
+
+	s := Size{Value: value, Unit: name}
+	if m[1] != "" {
+		s.Count, _ = strconv.Atoi(m[1])
+	}
+	return s, true
+}
+
+// Convert converts value between two units of the same dimension, e.g.
+// ounces to grams.
+func Convert(value float64, from, to string) (float64, error) {
+	fromName, ok := canonical(from)
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", from)
+	}
+	toName, ok := canonical(to)
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", to)
+	}
+	f, t := table[fromName], table[toName]
+	if f.dim != t.dim {
+		return 0, fmt.Errorf("can't convert %s (%s) to %s (%s)", from, f.dim, to, t.dim)
+	}
+	return value * f.base / t.base, nil
+}
+
+// PricePer100 returns the price of 100 g or 100 ml, given what qty
+// packages of size s cost in total, and the basis it's expressed in. A
+// non-positive qty counts as one package.
+func PricePer100(amount, qty float64, s Size) (float64, string) {
+	base, dim := s.Base()
+	if base <= 0 {
+		return 0, ""
+	}
+	if qty <= 0 {
+		qty = 1
+	}
+	price := math.Round(amount/(qty*base)*100*1000) / 1000
+	if dim == Volume {
+		return price, Per100ml
+	}
+	return price, Per100g
+}
+
+// canonical resolves a unit spelling to its canonical name.
+func canonical(name string) (string, bool) {
+	name = strings.Join(strings.Fields(strings.ToLower(name)), " ")
+	if c, ok := aliases[name]; ok {
+		return c, true
+	}
+	c, ok := aliases[strings.TrimSuffix(name, "s")]
+	return c, ok
+}
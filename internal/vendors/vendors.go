@@ -0,0 +1,271 @@
+// Package vendors keeps user-defined vendor aliases, so spelling variants
+// such as "WM Supercenter" and "WAL-MART #2389" resolve to one canonical
+// vendor alongside the built-in chain table.
+package vendors
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"myprice/internal/crypt"
+	"myprice/internal/receipt"
+)
+
+// storeNumberRegex matches store numbers such as "#2389" or "Store 123".
+var storeNumberRegex = regexp.MustCompile(`#\s*\d+|\b(?:store|str|st)\s*#?\s*\d{2,6}\b`)
+
+var (
+	ErrNotFound = errors.New("vendor not found")
+	ErrNoName   = errors.New("vendor name is required")
+)
+
+// Vendor is a canonical vendor and the name fragments that resolve to it.
+type Vendor struct {
+	Name      string    `json:"name"`
+	Aliases   []string  `json:"aliases"` // Lowercase fragments matched within printed names
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Registry holds the user-defined vendors, persisted as one JSON file.
+type Registry struct {
+	path    string
+	cipher  *crypt.Cipher
+	mu      sync.RWMutex
+	vendors map[string]*Vendor // By lowercase canonical name
+}
+
+// Open loads the registry at path, starting empty if the file doesn't
+// exist. The file is encrypted when c is non-nil.
+func Open(path string, c *crypt.Cipher) (*Registry, error) {
+	r := &Registry{path: path, cipher: c, vendors: make(map[string]*Vendor)}
+
+	data, err := c.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vendor aliases: %w", err)
+	}
+
+	var list []*Vendor
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse vendor aliases: %w", err)
+	}
+	for _, v := range list {
+		r.vendors[strings.ToLower(v.Name)] = v
+	}
+	return r, nil
+}
+
+// Resolve returns the canonical vendor for a printed vendor name. User
+// aliases are checked first, longest first, then the built-in chains. It
+// returns "" when the name matches neither.
+func (r *Registry) Resolve(name string) string {
+	if r != nil {
+		lower := normalize(name)
+		r.mu.RLock()
+		best, bestLen := "", 0
+		for _, v := range r.vendors {
+			for _, alias := range append([]string{normalize(v.Name)}, v.Aliases...) {
+				if len(alias) > bestLen && strings.Contains(lower, alias) {
+					best, bestLen = v.Name, len(alias)
+				}
+			}
+		}
+		r.mu.RUnlock()
+		if best != "" {
+			return best
+		}
+	}
+
+	chain, _ := receipt.ResolveChain(name)
+	return chain
+}
+
+// Merge makes name the canonical vendor for each of variants. A variant
+// that is itself a user-defined vendor is folded in with its aliases.
+func (r *Registry) Merge(name string, variants []string) (*Vendor, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, ErrNoName
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := strings.ToLower(name)
+	v := &Vendor{Name: name}
+	if existing, ok := r.vendors[key]; ok {
+		v.Aliases = append(v.Aliases, existing.Aliases...)
+	}
+
+	folded := make(map[string]bool)
+	for _, variant := range variants {
+		alias := normalize(variant)
+		if alias == "" || alias == key {
+			continue
+		}
+		if other, ok := r.vendors[alias]; ok {
+			v.Aliases = append(v.Aliases, other.Aliases...)
+			folded[alias] = true
+		}
+		v.Aliases = append(v.Aliases, alias)
+	}
+	v.Aliases = dedupe(v.Aliases)
+	v.UpdatedAt = time.Now().UTC()
+
+	// An alias belongs to one vendor, so moving it here takes it from others
+	claimed := make(map[string]bool, len(v.Aliases))
+	for _, a := range v.Aliases {
+		claimed[a] = true
+	}
+	next := make(map[string]*Vendor, len(r.vendors)+1)
+	for k, existing := range r.vendors {
+		if k == key || folded[k] {
+			continue
+		}
+		other := cloneVendor(existing)
+		other.Aliases = slices.DeleteFunc(other.Aliases, func(a string) bool { return claimed[a] })
+		if len(other.Aliases) > 0 || len(existing.Aliases) == 0 {
+			next[k] = other
+		}
+	}
+	next[key] = v
+	if err := r.save(next); err != nil {
+		return nil, err
+	}
+	r.vendors = next
+	return cloneVendor(v), nil
+}
+
+// RemoveAlias drops one alias from a vendor, removing the vendor when no
+// aliases remain.
+func (r *Registry) RemoveAlias(name, alias string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := strings.ToLower(name)
+	v, ok := r.vendors[key]
+	if !ok {
+		return ErrNotFound
+	}
+
+	alias = normalize(alias)
+	updated := cloneVendor(v)
+	updated.Aliases = updated.Aliases[:0]
+	for _, a := range v.Aliases {
+		if a != alias {
+			updated.Aliases = append(updated.Aliases, a)
+		}
+	}
+	if len(updated.Aliases) == len(v.Aliases) {
+		return ErrNotFound
+	}
+	updated.UpdatedAt = time.Now().UTC()
+
+	next := make(map[string]*Vendor, len(r.vendors))
+	for k, existing := range r.vendors {
+		next[k] = existing
+	}
+	if len(updated.Aliases) == 0 {
+		delete(next, key)
+	} else {
+		next[key] = updated
+	}
+	if err := r.save(next); err != nil {
+		return err
+	}
+	r.vendors = next
+	return nil
+}
+
+// Delete removes a vendor and all its aliases.
+func (r *Registry) Delete(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := strings.ToLower(name)
+	if _, ok := r.vendors[key]; !ok {
+		return ErrNotFound
+	}
+	next := make(map[string]*Vendor, len(r.vendors))
+	for k, existing := range r.vendors {
+		if k != key {
+			next[k] = existing
+		}
+	}
+	if err := r.save(next); err != nil {
+		return err
+	}
+	r.vendors = next
+	return nil
+}
+
+// List returns copies of the user-defined vendors by name.
+func (r *Registry) List() []*Vendor {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := make([]*Vendor, 0, len(r.vendors))
+	for _, v := range r.vendors {
+		list = append(list, cloneVendor(v))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name)
+	})
+	return list
+}
+
+// save writes vendors to disk. The caller holds r.mu.
+func (r *Registry) save(vendors map[string]*Vendor) error {
+	list := make([]*Vendor, 0, len(vendors))
+	for _, v := range vendors {
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name)
+	})
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize vendor aliases: %w", err)
+	}
+	if err := r.cipher.WriteFile(r.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write vendor aliases: %w", err)
+	}
+	return nil
+}
+
+// normalize lowercases a name, drops store numbers such as "#2389", and
+// collapses spacing, so aliases match however the store is numbered.
+func normalize(name string) string {
+	name = storeNumberRegex.ReplaceAllString(strings.ToLower(name), " ")
+	return strings.Join(strings.Fields(name), " ")
+}
+
+func dedupe(aliases []string) []string {
+	seen := make(map[string]bool, len(aliases))
+	out := make([]string, 0, len(aliases))
+	for _, a := range aliases {
+		if !seen[a] {
+			seen[a] = true
+			out = append(out, a)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func cloneVendor(v *Vendor) *Vendor {
+	c := *v
+	c.Aliases = append([]string(nil), v.Aliases...)
+	return &c
+}
@@ -0,0 +1,367 @@
+// Package workspace groups users into shared workspaces, such as a household
+// or a small team, whose receipts are tracked and reported on together.
+package workspace
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"myprice/internal/crypt"
+	"myprice/internal/store"
+)
+
+// Member roles. Owners manage membership; members share receipts.
+const (
+	RoleOwner  = "owner"
+	RoleMember = "member"
+)
+
+// InvitationTTL is how long an invitation can be accepted.
+const InvitationTTL = 7 * 24 * time.Hour
+
+var (
+	ErrNotFound       = errors.New("workspace not found")
+	ErrInvitation     = errors.New("invitation not found or expired")
+	ErrAlreadyMember  = errors.New("user is already a member")
+	ErrAlreadyInvited = errors.New("user already has a pending invitation")
+	ErrNotMember      = errors.New("user is not a member")
+	ErrLastOwner      = errors.New("a workspace needs at least one owner")
+)
+
+// Workspace is a named group of users.
+type Workspace struct {
+	ID          string       `json:"id"`
+	Name        string       `json:"name"`
+	Members     []Member     `json:"members"`
+	Invitations []Invitation `json:"invitations,omitempty"` // Pending only
+	CreatedBy   string       `json:"created_by"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
+
+// Member is a user (an API key name) in a workspace.
+type Member struct {
+	Name     string    `json:"name"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// Invitation asks a user to join a workspace.
+type Invitation struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	InvitedBy string    `json:"invited_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Pending is an invitation along with the workspace it's for.
+type Pending struct {
+	Invitation
+	WorkspaceID   string `json:"workspace_id"`
+	WorkspaceName string `json:"workspace_name"`
+}
+
+// Member returns the named member, if present.
+func (w *Workspace) Member(name string) (Member, bool) {
+	for _, m := range w.Members {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return Member{}, false
+}
+
+// IsOwner reports whether name is an owner of w.
+func (w *Workspace) IsOwner(name string) bool {
+	m, ok := w.Member(name)
+	return ok && m.Role == RoleOwner
+}
+
+// MemberNames returns the names of w's members in joining order.
+func (w *Workspace) MemberNames() []string {
+	names := make([]string, len(w.Members))
+	for i, m := range w.Members {
+		names[i] = m.Name
+	}
+	return names
+}
+
+// FileStore keeps one JSON file per workspace in a directory, with an
+// in-memory index loaded at startup.
+type FileStore struct {
+	dir        string
+	cipher     *crypt.Cipher
+	mu         sync.RWMutex
+	workspaces map[string]*Workspace
+}
+
+// NewFileStore opens (creating if needed) a workspace store rooted at dir.
+// Workspaces are encrypted on disk when c is non-nil.
+func NewFileStore(dir string, c *crypt.Cipher) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create workspace dir: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read workspace dir: %w", err)
+	}
+
+	s := &FileStore{dir: dir, cipher: c, workspaces: make(map[string]*Workspace)}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		data, err := c.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read workspace %s: %w", name, err)
+		}
+		var ws Workspace
+		if err := json.Unmarshal(data, &ws); err != nil {
+			return nil, fmt.Errorf("failed to parse workspace %s: %w", name, err)
+		}
+		s.workspaces[ws.ID] = &ws
+	}
+
+	return s, nil
+}
+
+// Create makes a workspace with owner as its first member.
+func (s *FileStore) Create(name, owner string) (*Workspace, error) {
+	now := time.Now().UTC()
+	ws := &Workspace{
+		ID:        store.NewID(),
+		Name:      name,
+		Members:   []Member{{Name: owner, Role: RoleOwner, JoinedAt: now}},
+		CreatedBy: owner,
+		CreatedAt: now,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.save(ws); err != nil {
+		return nil, err
+	}
+	return clone(ws), nil
+}
+
+// Get returns a copy of the workspace with the given ID.
+func (s *FileStore) Get(id string) (*Workspace, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ws, ok := s.workspaces[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return clone(ws), nil
+}
+
+// List returns copies of all workspaces, oldest first.
+func (s *FileStore) List() []*Workspace {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*Workspace, 0, len(s.workspaces))
+	for _, ws := range s.workspaces {
+		list = append(list, clone(ws))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// Invite creates an invitation for user to join workspace id.
+func (s *FileStore) Invite(id, user, invitedBy string) (*Invitation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ws, ok := s.workspaces[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if _, ok := ws.Member(user); ok {
+		return nil, ErrAlreadyMember
+	}
+
+	now := time.Now().UTC()
+	updated := clone(ws)
+	updated.Invitations = pruneExpired(updated.Invitations, now)
+	for _, inv := range updated.Invitations {
+		if inv.User == user {
+			return nil, ErrAlreadyInvited
+		}
+	}
+	inv := Invitation{
+		ID:        store.NewID(),
+		User:      user,
+		InvitedBy: invitedBy,
+		CreatedAt: now,
+		ExpiresAt: now.Add(InvitationTTL),
+	}
+	updated.Invitations = append(updated.Invitations, inv)
+
+	if err := s.save(updated); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// Invitations returns user's unexpired invitations, oldest first.
+func (s *FileStore) Invitations(user string) []Pending {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	pending := make([]Pending, 0)
+	for _, ws := range s.workspaces {
+		for _, inv := range pruneExpired(ws.Invitations, now) {
+			if inv.User == user {
+				pending = append(pending, Pending{Invitation: inv, WorkspaceID: ws.ID, WorkspaceName: ws.Name})
+			}
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].CreatedAt.Before(pending[j].CreatedAt)
+	})
+	return pending
+}
+
+// Respond accepts or declines user's invitation. Accepting adds user as a
+// member. It returns the workspace the invitation was for.
+func (s *FileStore) Respond(invitationID, user string, accept bool) (*Workspace, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, ws := range s.workspaces {
+		for i, inv := range ws.Invitations {
+			if inv.ID != invitationID {
+				continue
+			}
+			if inv.User != user || now.After(inv.ExpiresAt) {
+				return nil, ErrInvitation
+			}
+
+			updated := clone(ws)
+			updated.Invitations = append(updated.Invitations[:i], updated.Invitations[i+1:]...)
+			if accept {
+				updated.Members = append(updated.Members, Member{Name: user, Role: RoleMember, JoinedAt: now})
+			}
+			if err := s.save(updated); err != nil {
+				return nil, err
+			}
+			return clone(updated), nil
+		}
+	}
+	return nil, ErrInvitation
+}
+
+// RemoveMember removes name from workspace id, cancelling any invitation
+// for them instead if they haven't joined.
+func (s *FileStore) RemoveMember(id, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ws, ok := s.workspaces[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	updated := clone(ws)
+	for i, inv := range updated.Invitations {
+		if inv.User == name {
+			updated.Invitations = append(updated.Invitations[:i], updated.Invitations[i+1:]...)
+			return s.save(updated)
+		}
+	}
+
+	owners, index := 0, -1
+	for i, m := range updated.Members {
+		if m.Role == RoleOwner {
+			owners++
+		}
+		if m.Name == name {
+			index = i
+		}
+	}
+	if index < 0 {
+		return ErrNotMember
+	}
+	if updated.Members[index].Role == RoleOwner && owners == 1 && len(updated.Members) > 1 {
+		return ErrLastOwner
+	}
+	updated.Members = append(updated.Members[:index], updated.Members[index+1:]...)
+
+	// The last member leaving takes the workspace with them
+	if len(updated.Members) == 0 {
+		return s.delete(id)
+	}
+	return s.save(updated)
+}
+
+// Delete removes a workspace. Members' receipts are unaffected.
+func (s *FileStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.workspaces[id]; !ok {
+		return ErrNotFound
+	}
+	return s.delete(id)
+}
+
+// save writes ws and updates the index. The caller holds s.mu.
+func (s *FileStore) save(ws *Workspace) error {
+	data, err := json.MarshalIndent(ws, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize workspace: %w", err)
+	}
+	if err := s.cipher.WriteFile(s.path(ws.ID), data, 0644); err != nil {
+		return fmt.Errorf("failed to write workspace: %w", err)
+	}
+	s.workspaces[ws.ID] = clone(ws)
+	return nil
+}
+
+// delete removes a workspace's file and index entry. The caller holds s.mu.
+func (s *FileStore) delete(id string) error {
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete workspace: %w", err)
+	}
+	delete(s.workspaces, id)
+	return nil
+}
+
+// path returns the file path for a workspace ID.
+func (s *FileStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// pruneExpired drops invitations that can no longer be accepted.
+func pruneExpired(invitations []Invitation, now time.Time) []Invitation {
+	var live []Invitation
+	for _, inv := range invitations {
+		if now.Before(inv.ExpiresAt) {
+			live = append(live, inv)
+		}
+	}
+	return live
+}
+
+// clone deep-copies a workspace so callers can't mutate the index.
+func clone(ws *Workspace) *Workspace {
+	c := *ws
+	c.Members = append([]Member(nil), ws.Members...)
+	c.Invitations = append([]Invitation(nil), ws.Invitations...)
+	return &c
+}
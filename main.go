@@ -1,19 +1,24 @@
 // Package main implements an MCP server for multimodal receipt processing.
 //
 // This server exposes tools for loading images, parsing Textract OCR output,
-// and writing structured receipt data to disk. It is designed to be used
+// writing structured receipt data to disk, running the full analysis
+// pipeline, and querying stored receipts. It is designed to be used
 // with an LLM that orchestrates the receipt extraction workflow.
 package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 
+	"myprice/internal/crypt"
+	apiserver "myprice/server"
 	"myprice/tools"
 )
 
@@ -23,6 +28,14 @@ const (
 )
 
 func main() {
+	// -fake swaps in the fixtures of FAKE_FIXTURES_DIR for Textract and
+	// the Claude API, as FAKE_PROVIDERS=true does
+	fake := flag.Bool("fake", false, "use deterministic fake OCR and LLM providers instead of AWS Textract and the Claude API")
+	flag.Parse()
+	if *fake {
+		os.Setenv("FAKE_PROVIDERS", "true")
+	}
+
 	// Create the MCP server
 	server := mcp.NewServer(
 		&mcp.Implementation{
@@ -34,12 +47,51 @@ func main() {
 		},
 	)
 
-	// Register tools using the typed AddTool function
-	mcp.AddTool(server, tools.LoadImageTool(), tools.HandleLoadImage)
-	mcp.AddTool(server, tools.LoadTextractTool(), tools.HandleLoadTextract)
+	// Files are encrypted at rest as the HTTP API wrote them
+	cipher, err := crypt.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid encryption key: %v", err)
+	}
+
+	// Register tools using the typed AddTool function. Loaded images and
+	// lines are kept within limits clients can take in one message.
+	limits, err := tools.PayloadLimitsFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid payload limits: %v", err)
+	}
+	loader := tools.NewLoader(limits, cipher)
+	mcp.AddTool(server, tools.LoadImageTool(), loader.HandleLoadImage)
+	mcp.AddTool(server, tools.LoadTextractTool(), loader.HandleLoadTextract)
 	mcp.AddTool(server, tools.WriteOutputTool(), tools.HandleWriteOutput)
 
-	log.Printf("Registered tools: load_image, load_textract, write_output")
+	// Receipts are queried from the HTTP API's store
+	receiptsDir := os.Getenv("RECEIPTS_DIR")
+	if receiptsDir == "" {
+		receiptsDir = "receipts"
+	}
+	querier := tools.NewReceiptQuerier(receiptsDir, cipher)
+	mcp.AddTool(server, tools.QueryReceiptsTool(), querier.Handle)
+	mcp.AddTool(server, tools.ComparePricesTool(), querier.HandleComparePrices)
+	mcp.AddTool(server, tools.CompareReceiptsTool(), querier.HandleCompareReceipts)
+
+	// Full analysis runs the HTTP API's pipeline with the same configuration
+	uploadDir := os.Getenv("UPLOAD_DIR")
+	if uploadDir == "" {
+		cwd, _ := os.Getwd()
+		uploadDir = filepath.Join(cwd, "uploads")
+	}
+	api := apiserver.NewServer(uploadDir)
+	analysis := tools.NewImageAnalysis(api)
+	mcp.AddTool(server, tools.AnalyzeImageTool(), analysis.Handle)
+	mcp.AddTool(server, tools.AnalyzeURLTool(), analysis.HandleURL)
+	mcp.AddTool(server, tools.AnalyzeTextTool(), analysis.HandleText)
+	mcp.AddTool(server, tools.ReOCRRegionTool(), analysis.HandleReOCR)
+
+	// Earlier results are checked with the pipeline's own rules
+	reader := tools.NewOutputReader(receiptsDir, cipher, api)
+	mcp.AddTool(server, tools.ReadOutputTool(), reader.HandleReadOutput)
+
+	log.Printf("Registered tools: load_image, load_textract, write_output, read_output, query_receipts, compare_prices, compare_receipts, analyze_image, analyze_url, analyze_text, reocr_region")
 
 	// Set up graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -0,0 +1,167 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"myprice/internal/accesslog"
+)
+
+// Access log defaults: a day's or 50 MB of requests to a file, keeping two
+// weeks of them.
+const (
+	defaultAccessLogMaxBytes = 50 << 20
+	defaultAccessLogMaxAge   = 24 * time.Hour
+	defaultAccessLogBackups  = 14
+)
+
+// accessLogConfig opens the access log in ACCESS_LOG, or access.jsonl
+// under projectRoot, rotated by ACCESS_LOG_MAX_BYTES and ACCESS_LOG_MAX_AGE
+// and keeping ACCESS_LOG_BACKUPS rotated files. ACCESS_LOG=off turns it
+// off. With LOG_PRIVACY on, file names are hashed with LOG_HASH_KEY, in the
+// access log and in the server's log on stderr alike, whose output this
+// redirects through the scrubber.
+func accessLogConfig(projectRoot string) *accesslog.Logger {
+	privacy := os.Getenv("LOG_PRIVACY") == "true" || os.Getenv("LOG_PRIVACY") == "1"
+	key := []byte(os.Getenv("LOG_HASH_KEY"))
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+
+	path := os.Getenv("ACCESS_LOG")
+	if path == "" {
+		path = filepath.Join(projectRoot, "access.jsonl")
+	}
+	var file *accesslog.RotatingFile
+	if path != "off" {
+		file = accesslog.NewRotatingFile(path,
+			envInt64("ACCESS_LOG_MAX_BYTES", defaultAccessLogMaxBytes),
+			envDuration("ACCESS_LOG_MAX_AGE", defaultAccessLogMaxAge),
+			envInt("ACCESS_LOG_BACKUPS", defaultAccessLogBackups))
+	}
+
+	// A nil *RotatingFile must not reach New as a non-nil io.Writer
+	logger := accesslog.New(nil, privacy, key)
+	if file != nil {
+		logger = accesslog.New(file, privacy, key)
+		log.Printf("Logging requests to %s", path)
+	}
+	if privacy {
+		log.SetOutput(logger.ScrubWriter(log.Writer()))
+		log.Printf("Log privacy mode on: file names are hashed in logs")
+		if os.Getenv("LOG_HASH_KEY") == "" {
+			log.Printf("LOG_HASH_KEY not set; hashed file names in logs differ after the server restarts")
+		}
+	}
+	return logger
+}
+
+// accessRecordKey is the context key for an accessRecord.
+type accessRecordKey struct{}
+
+// accessRecord collects what handlers learn about a request for its access
+// log entry: the caller, once authenticated, and the files it names.
+type accessRecord struct {
+	mu        sync.Mutex
+	principal *Principal
+	files     []string
+}
+
+// notePrincipal records the caller of the request on ctx, if it is logged.
+func notePrincipal(ctx context.Context, p Principal) {
+	rec, _ := ctx.Value(accessRecordKey{}).(*accessRecord)
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.principal = &p
+}
+
+// noteFile records a file the request on ctx uploaded or named, if it is
+// logged.
+func noteFile(ctx context.Context, name string) {
+	rec, _ := ctx.Value(accessRecordKey{}).(*accessRecord)
+	if rec == nil || name == "" {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.files = append(rec.files, name)
+}
+
+// LogRequests wraps the API's handler so every request is written to the
+// access log once it is answered.
+func (s *Server) LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &accessRecord{}
+		sw := &statusWriter{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, rec))
+		next.ServeHTTP(sw, r)
+
+		entry := accesslog.Entry{
+			Time:       start.UTC(),
+			Method:     r.Method,
+			Route:      r.Pattern,
+			Path:       r.URL.Path,
+			Query:      r.URL.RawQuery,
+			Status:     sw.status,
+			Bytes:      sw.bytes,
+			DurationMS: time.Since(start).Milliseconds(),
+			UserAgent:  r.UserAgent(),
+		}
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			entry.RemoteAddr = host
+		}
+		rec.mu.Lock()
+		if rec.principal != nil {
+			entry.Actor, entry.Role = rec.principal.Name, rec.principal.Role.String()
+		}
+		entry.Files = rec.files
+		rec.mu.Unlock()
+		if err := s.accessLog.Log(entry); err != nil {
+			log.Printf("Warning: failed to write access log: %v", err)
+		}
+	})
+}
+
+// statusWriter records the status and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,267 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"myprice/internal/receipt"
+	"myprice/internal/retention"
+	"myprice/internal/store"
+)
+
+// CleanupResponse reports the result of a manual retention pass.
+type CleanupResponse struct {
+	Success bool               `json:"success"`
+	Results []retention.Result `json:"results"`
+}
+
+// handleAdminCleanup runs the retention policies immediately.
+func (s *Server) handleAdminCleanup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.Printf("Running manual retention cleanup")
+	results := s.janitor.CleanAll()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CleanupResponse{
+		Success: true,
+		Results: results,
+	})
+}
+
+// retentionPolicy reads <prefix>_MAX_AGE and <prefix>_MAX_BYTES from the environment.
+func retentionPolicy(prefix string) retention.Policy {
+	return retention.Policy{
+		MaxAge:   envDuration(prefix+"_MAX_AGE", 0),
+		MaxBytes: envInt64(prefix+"_MAX_BYTES", 0),
+	}
+}
+
+// ReprocessRequest selects stored receipts to run through the current pipeline.
+// All filters are optional and combined with AND.
+type ReprocessRequest struct {
+	IDs           []string `json:"ids,omitempty"`
+	From          string   `json:"from,omitempty"` // YYYY-MM-DD, inclusive
+	To            string   `json:"to,omitempty"`   // YYYY-MM-DD, inclusive
+	Vendor        string   `json:"vendor,omitempty"`
+	PromptVersion string   `json:"prompt_version,omitempty"`
+	Outdated      bool     `json:"outdated,omitempty"`       // Only results from an older prompt/parser
+	MaxConfidence float64  `json:"max_confidence,omitempty"` // Only results with mean OCR confidence below this
+	Limit         int      `json:"limit,omitempty"`
+	DryRun        bool     `json:"dry_run,omitempty"` // List matches without reprocessing
+	Batch         bool     `json:"batch,omitempty"`   // Submit to the Message Batches API and reconcile in the background
+}
+
+// ReprocessResult reports what happened to one receipt.
+type ReprocessResult struct {
+	ID      string         `json:"id"`
+	NewID   string         `json:"new_id,omitempty"`
+	Changes []store.Change `json:"changes,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// ReprocessResponse summarizes a reprocess run.
+type ReprocessResponse struct {
+	Matched     int               `json:"matched"`
+	Reprocessed int               `json:"reprocessed"`
+	Failed      int               `json:"failed"`
+	DryRun      bool              `json:"dry_run"`
+	BatchIDs    []string          `json:"batch_ids,omitempty"`
+	Results     []ReprocessResult `json:"results"`
+}
+
+// handleAdminReprocess re-runs selected stored receipts through the current
+// pipeline. Each new result is stored as a new version linked to the old
+// one, and the field-level differences are reported.
+func (s *Server) handleAdminReprocess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+
+	var req ReprocessRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	records, err := s.store.List()
+	if err != nil {
+		jsonError(w, "Failed to list receipts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	matched := s.selectForReprocess(records, req)
+	resp := ReprocessResponse{
+		Matched: len(matched),
+		DryRun:  req.DryRun,
+		Results: make([]ReprocessResult, 0, len(matched)),
+	}
+
+	if req.Batch && !req.DryRun {
+		s.handleBatchReprocess(w, r, matched, resp)
+		return
+	}
+
+	log.Printf("Reprocessing %d receipts (dry run: %v)", len(matched), req.DryRun)
+	for _, rec := range matched {
+		if req.DryRun {
+			resp.Results = append(resp.Results, ReprocessResult{ID: rec.ID})
+			continue
+		}
+		if r.Context().Err() != nil {
+			log.Printf("Reprocessing cancelled after %d of %d receipts: client disconnected", len(resp.Results), len(matched))
+			return
+		}
+
+		result := s.reprocess(r, rec)
+		if result.Error != "" {
+			resp.Failed++
+		} else {
+			resp.Reprocessed++
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleBatchReprocess submits matched receipts as message batches. Results
+// are saved in the background; poll /api/admin/batches/{id} for them.
+func (s *Server) handleBatchReprocess(w http.ResponseWriter, r *http.Request, matched []*store.Record, resp ReprocessResponse) {
+	if s.claudeAPI == nil {
+		jsonError(w, "Batch mode requires the Claude API", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Submitting %d receipts for batch reprocessing", len(matched))
+	jobs, failures := s.submitBatchReprocess(r.Context(), matched)
+
+	failed := make(map[string]bool, len(failures))
+	for _, f := range failures {
+		failed[f.ID] = true
+	}
+	resp.Failed = len(failures)
+	resp.Results = append(resp.Results, failures...)
+	for _, rec := range matched {
+		if !failed[rec.ID] {
+			resp.Results = append(resp.Results, ReprocessResult{ID: rec.ID})
+		}
+	}
+	for _, job := range jobs {
+		resp.BatchIDs = append(resp.BatchIDs, job.ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// reprocess analyzes a stored receipt's image again and stores the result
+// as the next version. An image retention removed is restored from the
+// archive first, if it was archived.
+func (s *Server) reprocess(r *http.Request, old *store.Record) ReprocessResult {
+	var actor string
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		actor = p.Name
+	}
+	ctx, attempt := s.startAttempt(r.Context(), viaReprocess, actor, old.ImagePath)
+	attempt.entry.PreviousID = old.ID
+	if err := s.restoreOriginal(old); err != nil {
+		attempt.finish(nil, "", err)
+		return ReprocessResult{ID: old.ID, Error: err.Error()}
+	}
+	result, err := s.analyze(ctx, old.ImagePath, receipt.ParseDocumentType(old.DocumentType), "")
+	if err != nil {
+		attempt.finish(nil, "", err)
+		return ReprocessResult{ID: old.ID, Error: err.Error()}
+	}
+
+	rec := result.record(old.ImagePath)
+	rec.PreviousID = old.ID
+	rec.Owner = old.Owner
+	newID := s.saveResult(rec)
+	attempt.finish(result, newID, nil)
+	if newID == "" {
+		return ReprocessResult{ID: old.ID, Error: "failed to save new version"}
+	}
+
+	return ReprocessResult{
+		ID:      old.ID,
+		NewID:   newID,
+		Changes: store.Diff(old.Data, rec.Data),
+	}
+}
+
+// selectForReprocess applies the request filters to the latest version of each receipt.
+func (s *Server) selectForReprocess(records []*store.Record, req ReprocessRequest) []*store.Record {
+	ids := make(map[string]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		ids[id] = true
+	}
+
+	var matched []*store.Record
+	for _, rec := range records {
+		if rec.SupersededBy != "" {
+			continue
+		}
+		if len(ids) > 0 && !ids[rec.ID] {
+			continue
+		}
+
+		date := recordDate(rec)
+		if req.From != "" && date < req.From {
+			continue
+		}
+		if req.To != "" && date > req.To {
+			continue
+		}
+		if req.Vendor != "" && !strings.Contains(strings.ToLower(recordVendor(rec)), strings.ToLower(req.Vendor)) {
+			continue
+		}
+		if req.PromptVersion != "" && rec.PromptVersion != req.PromptVersion {
+			continue
+		}
+		if req.Outdated && rec.PromptVersion == s.currentPromptVersion(receipt.DocumentType(rec.DocumentType)) {
+			continue
+		}
+		if req.MaxConfidence > 0 && rec.OCRConfidence >= req.MaxConfidence {
+			continue
+		}
+
+		matched = append(matched, rec)
+		if req.Limit > 0 && len(matched) >= req.Limit {
+			break
+		}
+	}
+	return matched
+}
+
+// recordDate returns the receipt's local purchase date, or the date it was
+// stored if no purchase date was extracted.
+func recordDate(rec *store.Record) string {
+	if rec.PurchaseTime != nil && rec.PurchaseTime.LocalDate != "" {
+		return rec.PurchaseTime.LocalDate
+	}
+	return rec.CreatedAt.Format("2006-01-02")
+}
+
+// recordVendor returns the vendor name and chain of a stored result.
+func recordVendor(rec *store.Record) string {
+	vendor, vendorFull, _ := vendorFields(receipt.DocumentType(rec.DocumentType), rec.Data)
+	name := vendor + " " + vendorFull
+	if rec.Location != nil {
+		name += " " + rec.Location.Chain
+	}
+	return name
+}
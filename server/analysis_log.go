@@ -0,0 +1,279 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"myprice/internal/analysislog"
+	"myprice/internal/receipt"
+)
+
+// Entry points recorded in the analysis log.
+const (
+	viaAPI          = "api"
+	viaMCP          = "mcp"
+	viaReprocess    = "reprocess"
+	viaBatch        = "batch"
+	viaIngest       = "ingest"
+	viaSignedUpload = "signed_upload"
+	viaUploadJob    = "upload_job"
+	viaReextract    = "reextract"
+	viaRevalidate   = "revalidate"
+)
+
+const (
+	// defaultAnalysisLogLimit and maxAnalysisLogLimit bound log queries.
+	defaultAnalysisLogLimit = 100
+	maxAnalysisLogLimit     = 1000
+)
+
+// AnalysisLogResponse lists analysis attempts, newest first.
+type AnalysisLogResponse struct {
+	Entries []analysislog.Entry `json:"entries"`
+	Count   int                 `json:"count"`
+	Total   int                 `json:"total"` // Matches before the limit
+}
+
+// tokenMeterKey is the context key for a tokenMeter.
+type tokenMeterKey struct{}
+
+// tokenMeter adds up the model tokens used by one analysis.
+type tokenMeter struct {
+	mu     sync.Mutex
+	tokens analysislog.Tokens
+}
+
+// countTokens adds a model call to the meter on ctx, if any.
+func countTokens(ctx context.Context, input, output int) {
+	m, ok := ctx.Value(tokenMeterKey{}).(*tokenMeter)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens.Calls++
+	m.tokens.Input += input
+	m.tokens.Output += output
+}
+
+// total returns the tokens counted so far.
+func (m *tokenMeter) total() analysislog.Tokens {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tokens
+}
+
+// meteredTokens returns the tokens counted so far by the meter on ctx, if any.
+func meteredTokens(ctx context.Context) analysislog.Tokens {
+	m, ok := ctx.Value(tokenMeterKey{}).(*tokenMeter)
+	if !ok {
+		return analysislog.Tokens{}
+	}
+	return m.total()
+}
+
+// tokensSince returns the tokens counted by the meter on ctx since it
+// counted before.
+func tokensSince(ctx context.Context, before analysislog.Tokens) analysislog.Tokens {
+	now := meteredTokens(ctx)
+	return analysislog.Tokens{
+		Calls:  now.Calls - before.Calls,
+		Input:  now.Input - before.Input,
+		Output: now.Output - before.Output,
+	}
+}
+
+// analysisAttempt is an analysis being timed for the analysis log.
+type analysisAttempt struct {
+	s         *Server
+	entry     analysislog.Entry
+	start     time.Time
+	meter     *tokenMeter
+	responses *responseRecorder // Nil unless raw responses are kept
+}
+
+// startAttempt begins logging an analysis of imagePath. Run the analysis
+// with the returned context so its model calls are counted, then call
+// finish.
+func (s *Server) startAttempt(ctx context.Context, via, actor, imagePath string) (context.Context, *analysisAttempt) {
+	a := &analysisAttempt{
+		s:     s,
+		entry: analysislog.Entry{ID: analysislog.NewID(), Time: time.Now().UTC(), Actor: actor, Via: via, ImagePath: imagePath},
+		start: time.Now(),
+		meter: &tokenMeter{},
+	}
+	ctx = context.WithValue(ctx, tokenMeterKey{}, a.meter)
+	if s.rawResponses != nil {
+		a.responses = &responseRecorder{}
+		ctx = context.WithValue(ctx, responseRecorderKey{}, a.responses)
+	}
+	return ctx, a
+}
+
+// finish logs the attempt's outcome, and saves its experiment pair if it
+// joined one. result is nil when the analysis failed, and receiptID is ""
+// when nothing was stored.
+func (a *analysisAttempt) finish(result *analysisResult, receiptID string, err error) {
+	if result != nil && result.Trial != nil {
+		a.s.savePair(result.Trial, receiptID)
+	}
+	if a.s.analysisLog == nil && a.responses == nil {
+		return
+	}
+	e := a.entry
+	e.DurationMS = time.Since(a.start).Milliseconds()
+	e.Tokens = a.meter.total()
+	e.ReceiptID = receiptID
+
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		e.Outcome, e.Error = analysislog.OutcomeCancelled, err.Error()
+	case err != nil:
+		e.Outcome, e.Error = analysislog.OutcomeFailed, err.Error()
+	case result.partial():
+		e.Outcome = analysislog.OutcomePartial
+	default:
+		e.Outcome = analysislog.OutcomeOK
+	}
+	if result != nil {
+		e.ImageSHA256 = result.ImageSHA256
+		e.DocumentType = string(result.DocType)
+		e.OCRSource = result.Source
+		e.Parser, e.Model, e.PromptVersion = result.Parser, result.Model, result.PromptVersion
+		for _, st := range result.Stages {
+			e.Stages = append(e.Stages, analysislog.Stage{Stage: st.Stage, Status: st.Status, Error: st.Error, DurationMS: st.DurationMS})
+		}
+	} else if hash, err := fileSHA256(e.ImagePath); err == nil {
+		e.ImageSHA256 = hash
+	}
+	if a.responses != nil {
+		e.RawResponses = a.s.saveRawResponses(e, a.responses.all())
+	}
+	if a.s.analysisLog != nil {
+		a.s.appendAnalysisLog(e)
+	}
+}
+
+// logBatchAttempt logs the outcome of one message batch answer. The batch
+// API reports no per-request timing, so only the outcome is recorded.
+func (s *Server) logBatchAttempt(job *BatchJob, item BatchItem, res ReprocessResult) {
+	if s.analysisLog == nil {
+		return
+	}
+	e := analysislog.Entry{
+		Time:          time.Now().UTC(),
+		Via:           viaBatch,
+		ImageSHA256:   item.ImageSHA256,
+		DocumentType:  item.DocumentType,
+		OCRSource:     item.Source,
+		Parser:        parserLLM,
+		Model:         claudeModel,
+		PromptVersion: s.currentPromptVersion(receipt.DocumentType(item.DocumentType)),
+		Outcome:       analysislog.OutcomeOK,
+		Error:         res.Error,
+		ReceiptID:     res.NewID,
+		PreviousID:    item.RecordID,
+	}
+	if res.Error != "" {
+		e.Outcome = analysislog.OutcomeFailed
+	}
+	if job.Actor != "" {
+		e.Actor = job.Actor
+	}
+	s.appendAnalysisLog(e)
+}
+
+// appendAnalysisLog writes an entry, logging failures rather than failing
+// the analysis.
+func (s *Server) appendAnalysisLog(e analysislog.Entry) {
+	if err := s.analysisLog.Append(e); err != nil {
+		log.Printf("Warning: failed to write analysis log: %v", err)
+	}
+}
+
+// handleAnalysisLog queries the analysis log. Filters are actor, via,
+// outcome, model, prompt_version, image_sha256, receipt (every attempt on
+// that receipt's image), since and until (RFC 3339 or YYYY-MM-DD), and
+// limit.
+func (s *Server) handleAnalysisLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.analysisLog == nil {
+		jsonError(w, "Analysis log is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	q := analysislog.Query{
+		Actor:         query.Get("actor"),
+		Via:           query.Get("via"),
+		Outcome:       query.Get("outcome"),
+		Model:         query.Get("model"),
+		PromptVersion: query.Get("prompt_version"),
+		ImageSHA256:   query.Get("image_sha256"),
+		Limit:         defaultAnalysisLogLimit,
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			jsonError(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		q.Limit = min(n, maxAnalysisLogLimit)
+	}
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		parsed, err := parseLogTime(v)
+		if err != nil {
+			jsonError(w, name+" must be an RFC 3339 time or YYYY-MM-DD date", http.StatusBadRequest)
+			return
+		}
+		*t = parsed
+	}
+
+	// A receipt stands for its image, so attempts that stored other
+	// versions, or failed, show up too
+	if id := query.Get("receipt"); id != "" {
+		if !s.requireStore(w) {
+			return
+		}
+		rec, ok := s.loadRecord(w, id)
+		if !ok {
+			return
+		}
+		if rec.ImageSHA256 != "" {
+			q.ImageSHA256 = rec.ImageSHA256
+		} else {
+			q.ReceiptID = rec.ID
+		}
+	}
+
+	entries, total, err := s.analysisLog.Find(q)
+	if err != nil {
+		jsonError(w, "Failed to read analysis log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalysisLogResponse{Entries: entries, Count: len(entries), Total: total})
+}
+
+// parseLogTime parses an RFC 3339 time or a YYYY-MM-DD date (midnight UTC).
+func parseLogTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
@@ -0,0 +1,294 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+)
+
+const (
+	// defaultAnalysisQueueSize is how many uploads may wait for analysis
+	// before /api/upload-and-analyze turns new ones away.
+	defaultAnalysisQueueSize = 100
+
+	// defaultJobDuration estimates how long an analysis takes before any
+	// has finished, for Retry-After.
+	defaultJobDuration = 10 * time.Second
+
+	// maxRetryAfter caps the Retry-After sent when the queue is full.
+	maxRetryAfter = 5 * time.Minute
+)
+
+// UploadAndAnalyzeResponse is the stored upload and its queued analysis.
+type UploadAndAnalyzeResponse struct {
+	UploadResponse
+	JobID     string `json:"job_id"`
+	Status    string `json:"status"`
+	StatusURL string `json:"status_url"` // GET for the job's UploadStatus
+}
+
+// analysisJob is an upload waiting for, or done with, its analysis.
+type analysisJob struct {
+	status       UploadStatus
+	owner        string
+	documentType receipt.DocumentType
+	model        string
+}
+
+// analysisQueue runs queued analyses on a fixed set of workers. It holds at
+// most size jobs that haven't started, so a burst of uploads is turned away
+// with a retry hint rather than piling up unbounded work. Statuses live in
+// memory for signedUploadRetention after their last change.
+type analysisQueue struct {
+	jobs    chan *analysisJob
+	size    int
+	workers int
+
+	mu       sync.Mutex
+	waiting  int // Admitted jobs that haven't started
+	statuses map[string]*analysisJob
+	finished int
+	busy     time.Duration // Total run time of finished jobs
+}
+
+// StartAnalysisQueue starts ANALYSIS_WORKERS workers (default
+// MAX_PARALLEL_LLM) for /api/upload-and-analyze, with room for
+// ANALYSIS_QUEUE_SIZE jobs waiting. Workers stop when ctx is cancelled;
+// until this is called, the endpoint answers 503.
+func (s *Server) StartAnalysisQueue(ctx context.Context) {
+	q := &analysisQueue{
+		size:     max(envInt("ANALYSIS_QUEUE_SIZE", defaultAnalysisQueueSize), 1),
+		workers:  max(envInt("ANALYSIS_WORKERS", s.llmLimit.Stats().Limit), 1),
+		statuses: make(map[string]*analysisJob),
+	}
+	q.jobs = make(chan *analysisJob, q.size)
+	for i := 0; i < q.workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-q.jobs:
+					q.start(job)
+					start := time.Now()
+					s.runAnalysisJob(ctx, q, job)
+					q.finish(time.Since(start))
+				}
+			}
+		}()
+	}
+	log.Printf("Analysis queue: %d workers, up to %d waiting", q.workers, q.size)
+	s.analysisQueue = q
+}
+
+// reserve claims a place in the queue, reporting false when it is full.
+func (q *analysisQueue) reserve() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.waiting >= q.size {
+		return false
+	}
+	q.waiting++
+	return true
+}
+
+// unreserve gives back a place claimed by reserve for a job never added.
+func (q *analysisQueue) unreserve() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.waiting--
+}
+
+// add queues a job in a place claimed by reserve. It never blocks, since
+// the channel has room for every reserved place.
+func (q *analysisQueue) add(job *analysisJob) {
+	q.set(job, UploadQueued, "", nil)
+	q.jobs <- job
+}
+
+// start marks a job's place in the queue free as a worker takes it.
+func (q *analysisQueue) start(job *analysisJob) {
+	q.mu.Lock()
+	q.waiting--
+	q.mu.Unlock()
+	q.set(job, UploadAnalyzing, "", nil)
+}
+
+// pending returns how many admitted jobs haven't started.
+func (q *analysisQueue) pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiting
+}
+
+// finish records how long a job ran, for Retry-After estimates.
+func (q *analysisQueue) finish(d time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.finished++
+	q.busy += d
+}
+
+// set records a job's status, along with its receipt or error once it is
+// done.
+func (q *analysisQueue) set(job *analysisJob, status, receiptID string, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now().UTC()
+	job.status.Status = status
+	job.status.ReceiptID, job.status.Error, job.status.ContentType = receiptID, "", ""
+	if err != nil {
+		job.status.Error, job.status.ContentType = err.Error(), rejectedContent(err)
+	}
+	job.status.UpdatedAt = now
+	job.status.ExpiresAt = now.Add(signedUploadRetention)
+	q.statuses[job.status.ID] = job
+
+	// Forget jobs whose status has been kept long enough
+	for id, old := range q.statuses {
+		if now.After(old.status.ExpiresAt) {
+			delete(q.statuses, id)
+		}
+	}
+}
+
+// get returns a copy of a job's status and its owner.
+func (q *analysisQueue) get(id string) (UploadStatus, string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.statuses[id]
+	if !ok {
+		return UploadStatus{}, "", false
+	}
+	return job.status, job.owner, true
+}
+
+// retryAfter estimates how long until the queue has room: the time for
+// the workers to get through the jobs waiting, from the mean run time.
+func (q *analysisQueue) retryAfter() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	mean := defaultJobDuration
+	if q.finished > 0 {
+		mean = q.busy / time.Duration(q.finished)
+	}
+	wait := mean * time.Duration(q.waiting) / time.Duration(q.workers)
+	if wait < time.Second {
+		return time.Second
+	}
+	if wait > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return wait
+}
+
+// runAnalysisJob analyzes a queued upload and saves the result for its
+// owner.
+func (s *Server) runAnalysisJob(ctx context.Context, q *analysisQueue, job *analysisJob) {
+	ctx, cancel := context.WithTimeout(ctx, signedAnalysisTimeout)
+	defer cancel()
+
+	path := job.status.FilePath
+	actx, attempt := s.startAttempt(ctx, viaUploadJob, job.owner, path)
+	result, err := s.analyze(actx, path, job.documentType, job.model)
+	if err != nil {
+		attempt.finish(nil, "", err)
+		log.Printf("Warning: queued analysis %s of %s failed: %v", job.status.ID, path, err)
+		q.set(job, UploadFailed, "", err)
+		return
+	}
+
+	rec := result.record(path)
+	rec.Owner = job.owner
+	receiptID := s.saveResult(rec)
+	attempt.finish(result, receiptID, nil)
+	if receiptID != "" {
+		s.autoExport(rec)
+	}
+	q.set(job, UploadDone, receiptID, nil)
+}
+
+// handleUploadAndAnalyze stores a multipart image upload, as /api/upload
+// does, and queues it for analysis in the same call, answering 202 with
+// the upload and a job to poll. The optional document_type and model query
+// parameters are as for /api/analyze. When the queue is full the upload is
+// refused with 503 and a Retry-After header, before the body is read.
+func (s *Server) handleUploadAndAnalyze(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := s.analysisQueue
+	if q == nil {
+		jsonError(w, "Analysis queue is not running", http.StatusServiceUnavailable)
+		return
+	}
+	model := r.URL.Query().Get("model")
+	if !s.checkModel(w, model) {
+		return
+	}
+	if !q.reserve() {
+		retry := q.retryAfter()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		jsonError(w, "Analysis queue is full, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	upload, ok := s.receiveUpload(w, r)
+	if !ok {
+		q.unreserve()
+		return
+	}
+
+	job := &analysisJob{
+		status: UploadStatus{
+			ID:       store.NewID(),
+			FileName: upload.FileName,
+			FilePath: upload.FilePath,
+			Size:     upload.Size,
+		},
+		documentType: receipt.ParseDocumentType(r.URL.Query().Get("document_type")),
+		model:        model,
+	}
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		job.owner = p.Name
+	}
+	q.add(job)
+	log.Printf("Queued analysis %s of %s", job.status.ID, upload.FilePath)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/jobs/"+job.status.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(UploadAndAnalyzeResponse{
+		UploadResponse: upload,
+		JobID:          job.status.ID,
+		Status:         UploadQueued,
+		StatusURL:      "/api/jobs/" + job.status.ID,
+	})
+}
+
+// handleJob reports a queued analysis's status. Jobs are visible to their
+// owner and reviewers.
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	q := s.analysisQueue
+	if q == nil {
+		jsonError(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	st, owner, ok := q.get(r.PathValue("id"))
+	if !ok || !canReadOwned(r, owner) {
+		jsonError(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,203 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"myprice/internal/pricing"
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+)
+
+// anomalyDetectors returns the detectors ANOMALY_DETECTORS names,
+// comma-separated, or all of them when it is unset. "none" turns detection
+// off.
+func anomalyDetectors() []receipt.Detector {
+	raw := strings.TrimSpace(os.Getenv("ANOMALY_DETECTORS"))
+	switch raw {
+	case "":
+		return receipt.Detectors()
+	case "none":
+		return nil
+	}
+	var names []string
+	for _, name := range strings.Split(raw, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	detectors, err := receipt.DetectorsNamed(names)
+	if err != nil {
+		log.Printf("Warning: invalid ANOMALY_DETECTORS: %v; running all detectors", err)
+		return receipt.Detectors()
+	}
+	return detectors
+}
+
+// detectAnomalies runs the anomaly detectors on a result about to be
+// stored. Only receipts are checked; invoices get nil. Prices are compared
+// with earlier receipts at the same vendor and with the owner's own
+// purchases, leaving out earlier versions of the same receipt.
+func (s *Server) detectAnomalies(rec *store.Record) []receipt.Anomaly {
+	if receipt.DocumentType(rec.DocumentType) == receipt.DocumentTypeInvoice || rec.Data == nil || len(s.detectors) == 0 {
+		return nil
+	}
+	r, err := receipt.ReceiptFromMap(rec.Data)
+	if err != nil {
+		log.Printf("Warning: anomaly detection skipped: %v", err)
+		return nil
+	}
+
+	dc := receipt.DetectContext{Now: time.Now()}
+	if history, err := s.priceHistory(); err != nil {
+		log.Printf("Warning: price outliers not checked: %v", err)
+	} else if history != nil {
+		dc.History = history
+	}
+	if items, err := s.itemHistory(rec.Owner); err != nil {
+		log.Printf("Warning: prices not compared with the owner's history: %v", err)
+	} else if items != nil {
+		dc.Personal = ownHistory{items: items, exclude: rec.ImageSHA256}
+	}
+	return receipt.DetectAnomalies(r, s.detectors, dc)
+}
+
+// priceHistory is the unit prices paid for each item at each vendor on
+// stored receipts, keyed by vendor and item name.
+type priceHistory map[string][]float64
+
+// priceHistoryKey groups an item at a vendor, ignoring case and spacing.
+func priceHistoryKey(vendor, item string) string {
+	return receipt.VendorKey(vendor) + "\x00" + strings.ToLower(strings.Join(strings.Fields(item), " "))
+}
+
+// UnitPrices returns the unit prices paid for item at vendor.
+func (h priceHistory) UnitPrices(vendor, item string) []float64 {
+	return h[priceHistoryKey(vendor, item)]
+}
+
+// priceHistory returns the prices on the current versions of stored
+// receipts, cached until a receipt changes as reports are. It returns nil
+// without a store.
+func (s *Server) priceHistory() (priceHistory, error) {
+	if s.store == nil {
+		return nil, nil
+	}
+	stamp, err := s.store.Stamp()
+	if err != nil {
+		return nil, err
+	}
+	return s.historyCache.Get("", stamp, func() (priceHistory, error) {
+		records, err := s.store.List()
+		if err != nil {
+			return nil, err
+		}
+		history := make(priceHistory)
+		for _, rec := range latestVersions(records) {
+			addPrices(history, rec)
+		}
+		return history, nil
+	})
+}
+
+// addPrices adds the item prices on a stored receipt to history. Refunds
+// and discount lines aren't prices paid.
+func addPrices(history priceHistory, rec *store.Record) {
+	if receipt.DocumentType(rec.DocumentType) == receipt.DocumentTypeInvoice {
+		return
+	}
+	r, err := receipt.ReceiptFromMap(rec.Data)
+	if err != nil || r.Vendor == "" || r.Refund {
+		return
+	}
+	for _, item := range r.Items {
+		if item.Name == "" || item.Price <= 0 {
+			continue
+		}
+		unit := item.UnitPrice
+		if unit <= 0 {
+			unit = pricing.UnitPrice(float64(item.Qty), item.Price)
+		}
+		key := priceHistoryKey(r.Vendor, item.Name)
+		history[key] = append(history[key], unit)
+	}
+}
+
+// itemPrice is a price paid for an item, and the image of the receipt it
+// was paid on.
+type itemPrice struct {
+	price float64
+	image string
+}
+
+// itemHistory is the prices one owner paid for each item, keyed as
+// receipt.CanonicalItem identifies items.
+type itemHistory map[string][]itemPrice
+
+// ownHistory is an owner's item history as one receipt's detectors see it:
+// without the prices on the receipt's earlier versions, which would
+// otherwise be compared with themselves.
+type ownHistory struct {
+	items   itemHistory
+	exclude string // Image hash of the receipt being checked
+}
+
+// ItemPrices returns what the owner paid for the item before.
+func (h ownHistory) ItemPrices(key string) []float64 {
+	var prices []float64
+	for _, p := range h.items[key] {
+		if h.exclude == "" || p.image != h.exclude {
+			prices = append(prices, p.price)
+		}
+	}
+	return prices
+}
+
+// itemHistory returns the item prices on the current versions of owner's
+// stored receipts, or on every receipt when owner is "", as without API
+// keys. It is cached per owner until a receipt changes, and nil without a
+// store.
+func (s *Server) itemHistory(owner string) (itemHistory, error) {
+	if s.store == nil {
+		return nil, nil
+	}
+	stamp, err := s.store.Stamp()
+	if err != nil {
+		return nil, err
+	}
+	return s.itemHistoryCache.Get(owner, stamp, func() (itemHistory, error) {
+		records, err := s.store.List()
+		if err != nil {
+			return nil, err
+		}
+		history := make(itemHistory)
+		for _, rec := range latestVersions(records) {
+			if owner == "" || rec.Owner == owner {
+				addItemPrices(history, rec)
+			}
+		}
+		return history, nil
+	})
+}
+
+// addItemPrices adds the item prices on a stored receipt to an owner's
+// history, skipping refunds and discount lines as addPrices does.
+func addItemPrices(history itemHistory, rec *store.Record) {
+	if receipt.DocumentType(rec.DocumentType) == receipt.DocumentTypeInvoice {
+		return
+	}
+	r, err := receipt.ReceiptFromMap(rec.Data)
+	if err != nil || r.Refund {
+		return
+	}
+	for _, item := range r.Items {
+		key, price, _ := receipt.CanonicalItem(item)
+		if key == "" || item.Price <= 0 || price <= 0 {
+			continue
+		}
+		history[key] = append(history[key], itemPrice{price: price, image: rec.ImageSHA256})
+	}
+}
@@ -0,0 +1,331 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+)
+
+const (
+	// defaultAskReceipts and maxAskReceipts bound how many receipts a
+	// question is answered from.
+	defaultAskReceipts = 20
+	maxAskReceipts     = 50
+
+	// askTimeout bounds retrieving receipts for a question and answering it.
+	askTimeout = 2 * time.Minute
+
+	// maxQuestionLength bounds a question, in bytes.
+	maxQuestionLength = 1000
+)
+
+// AskRequest is a question about the stored receipts. The filters are
+// optional and combined with AND; receipts passing them are ranked by
+// relevance to the question.
+type AskRequest struct {
+	Question     string   `json:"question"`
+	Vendor       string   `json:"vendor,omitempty"` // Case-insensitive substring of the vendor or chain
+	From         string   `json:"from,omitempty"`   // Earliest purchase date, YYYY-MM-DD
+	To           string   `json:"to,omitempty"`     // Latest purchase date, inclusive
+	DocumentType string   `json:"document_type,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Limit        int      `json:"limit,omitempty"` // Most receipts to answer from
+}
+
+// AskCitation is a receipt an answer relies on.
+type AskCitation struct {
+	ID     string   `json:"id"`
+	Vendor string   `json:"vendor"`
+	Date   string   `json:"date"`
+	Total  *float64 `json:"total"`
+}
+
+// AskResponse is the model's answer and the receipts it cited.
+type AskResponse struct {
+	Question  string        `json:"question"`
+	Answer    string        `json:"answer"`
+	Citations []AskCitation `json:"citations"`
+	Retrieval string        `json:"retrieval"` // "all", "semantic", or "recent"
+	Receipts  int           `json:"receipts"`  // Receipts the answer was drawn from
+	Matched   int           `json:"matched"`   // Receipts passing the filters
+}
+
+// askReceipt is a stored receipt as the model reads it.
+type askReceipt struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	Vendor      string    `json:"vendor"`
+	Category    string    `json:"category,omitempty"`
+	City        string    `json:"city,omitempty"`
+	Date        string    `json:"date"`
+	When        string    `json:"when,omitempty"`
+	Total       *float64  `json:"total"`
+	Currency    string    `json:"currency,omitempty"`
+	Refund      bool      `json:"refund,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Items       []askItem `json:"items,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Notes       string    `json:"notes,omitempty"`
+}
+
+// askItem is a line item as the model reads it.
+type askItem struct {
+	Name  string  `json:"name"`
+	Qty   float64 `json:"qty,omitempty"`
+	Price float64 `json:"price"`
+}
+
+// askAnswer is the model's answer, before its citations are checked.
+type askAnswer struct {
+	Answer    string   `json:"answer"`
+	Citations []string `json:"citations"`
+}
+
+// handleAsk answers a natural-language question about the stored receipts,
+// such as "how much did we spend on team lunches in Q3?". The receipts
+// passing the request's filters are ranked by semantic search when it is
+// enabled, or else by date, and the closest are given to the model, which
+// answers from them alone and cites the receipts it used.
+func (s *Server) handleAsk(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) {
+		return
+	}
+	if s.claudeAPI == nil {
+		jsonError(w, "Questions require the Claude API", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req AskRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Question = strings.TrimSpace(req.Question)
+	if req.Question == "" || len(req.Question) > maxQuestionLength {
+		jsonError(w, fmt.Sprintf("question is required and must be at most %d characters", maxQuestionLength), http.StatusBadRequest)
+		return
+	}
+	for _, date := range []string{req.From, req.To} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			jsonError(w, "from and to must be dates like 2025-11-03", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.DocumentType != "" && req.DocumentType != string(receipt.DocumentTypeReceipt) && req.DocumentType != string(receipt.DocumentTypeInvoice) {
+		jsonError(w, `document_type must be "receipt" or "invoice"`, http.StatusBadRequest)
+		return
+	}
+	tags, err := store.NormalizeTags(req.Tags)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultAskReceipts
+	if req.Limit > 0 {
+		limit = min(req.Limit, maxAskReceipts)
+	}
+
+	records, err := s.store.List()
+	if err != nil {
+		jsonError(w, "Failed to list receipts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	vendor := strings.ToLower(strings.TrimSpace(req.Vendor))
+	var matched []*store.Record
+	for _, rec := range latestVersions(records) {
+		if req.DocumentType != "" && rec.DocumentType != req.DocumentType || !rec.HasTags(tags...) {
+			continue
+		}
+		if vendor != "" && !strings.Contains(strings.ToLower(recordVendor(rec)), vendor) {
+			continue
+		}
+		if date := recordDate(rec); req.From != "" && date < req.From || req.To != "" && date > req.To {
+			continue
+		}
+		matched = append(matched, rec)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), askTimeout)
+	defer cancel()
+	chosen, retrieval := s.retrieveForQuestion(ctx, req.Question, matched, limit)
+
+	resp := AskResponse{Question: req.Question, Citations: make([]AskCitation, 0), Retrieval: retrieval, Receipts: len(chosen), Matched: len(matched)}
+	if len(chosen) == 0 {
+		resp.Answer = "No stored receipts match the filters, so there is nothing to answer from."
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	prompt, err := s.askPrompt(req.Question, chosen, len(matched), retrieval)
+	if err != nil {
+		jsonError(w, "Failed to build the prompt: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	text, err := s.claudeAPI.sendTextPrompt(ctx, claudeModel, prompt)
+	if err != nil {
+		jsonError(w, "Failed to answer the question: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	var answer askAnswer
+	if err := json.Unmarshal([]byte(text), &answer); err != nil || strings.TrimSpace(answer.Answer) == "" {
+		jsonError(w, "The model's answer could not be read", http.StatusBadGateway)
+		return
+	}
+
+	// Only receipts the model was given can be cited
+	byID := make(map[string]*store.Record, len(chosen))
+	for _, rec := range chosen {
+		byID[rec.ID] = rec
+	}
+	seen := make(map[string]bool)
+	for _, id := range answer.Citations {
+		rec := byID[strings.TrimSpace(id)]
+		if rec == nil || seen[rec.ID] {
+			continue
+		}
+		seen[rec.ID] = true
+		resp.Citations = append(resp.Citations, askCitation(rec))
+	}
+	resp.Answer = strings.TrimSpace(answer.Answer)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// retrieveForQuestion picks up to limit of records to answer question
+// from, and says how: "all" when every record fits, "semantic" when ranked
+// by semantic search, or "recent" for the newest purchases, when semantic
+// search is off or fails.
+func (s *Server) retrieveForQuestion(ctx context.Context, question string, records []*store.Record, limit int) ([]*store.Record, string) {
+	if len(records) <= limit {
+		return records, "all"
+	}
+
+	if s.embeddings != nil {
+		vectors, err := s.embedder.Embed(ctx, []string{question})
+		if err == nil {
+			byID := make(map[string]*store.Record, len(records))
+			for _, rec := range records {
+				byID[rec.ID] = rec
+			}
+			hits := s.embeddings.Search(vectors[0], -1, func(id string) bool { return byID[id] != nil })
+			chosen := make([]*store.Record, 0, limit)
+			for _, hit := range hits[:min(len(hits), limit)] {
+				chosen = append(chosen, byID[hit.ID])
+			}
+			if len(chosen) > 0 {
+				return chosen, "semantic"
+			}
+		} else {
+			log.Printf("Warning: failed to embed a question, answering from the newest receipts: %v", err)
+		}
+	}
+
+	recent := append([]*store.Record(nil), records...)
+	sort.SliceStable(recent, func(i, j int) bool { return recordDate(recent[i]) > recordDate(recent[j]) })
+	return recent[:limit], "recent"
+}
+
+// askPrompt builds the prompt answering question from records, of which
+// matched passed the filters.
+func (s *Server) askPrompt(question string, records []*store.Record, matched int, retrieval string) (string, error) {
+	var lines strings.Builder
+	for _, rec := range records {
+		line, err := json.Marshal(askReceiptOf(rec))
+		if err != nil {
+			return "", err
+		}
+		lines.Write(line)
+		lines.WriteByte('\n')
+	}
+
+	chosen := "all of them"
+	switch retrieval {
+	case "semantic":
+		chosen = "those most relevant to the question"
+	case "recent":
+		chosen = "the most recent"
+	}
+	today := time.Now().In(s.defaultTZ).Format("Monday, January 2, 2006")
+
+	return fmt.Sprintf(`You answer questions about someone's purchases from their stored receipts and invoices. Today is %s.
+
+Below are %d of the %d stored receipts that match the question's filters (%s), as JSON, one per line. Amounts are in the receipt's currency, or US dollars when it has none. A null total is unknown.
+
+%s
+Rules:
+- Answer only from these receipts. If they don't hold the answer, say so, and say what is missing.
+- Add up amounts exactly, and give the sum when the question asks how much.
+- Mention dates and vendors where they help identify a purchase.
+- Keep the answer short: a sentence or a few, not a report.
+- Cite every receipt the answer relies on by its id.
+
+Question: %s
+
+Respond with only a JSON object, no other text:
+{"answer": "the answer, in plain text", "citations": ["<receipt id>"]}`,
+		today, len(records), matched, chosen, lines.String(), question), nil
+}
+
+// askReceiptOf describes a stored result for the model.
+func askReceiptOf(rec *store.Record) askReceipt {
+	docType := receipt.DocumentType(rec.DocumentType)
+	vendor, vendorFull, _ := vendorFields(docType, rec.Data)
+	if vendor == "" {
+		vendor = vendorFull
+	}
+	a := askReceipt{
+		ID:     rec.ID,
+		Type:   rec.DocumentType,
+		Vendor: vendor,
+		Date:   recordDate(rec),
+		When:   purchaseWhen(rec),
+		Tags:   rec.Tags,
+		Notes:  rec.Notes,
+	}
+	if category, ok := receipt.LookupVendorCategory(rec.VendorCategory); ok {
+		a.Category = category.Label
+	}
+	if rec.Location != nil {
+		a.City = rec.Location.City
+	}
+	if total, ok := rec.Data["total"].(float64); ok {
+		a.Total = &total
+	}
+	a.Currency, _ = rec.Data["currency"].(string)
+	a.Refund, _ = rec.Data["refund"].(bool)
+	a.Description, _ = rec.Data["cart_description"].(string)
+
+	nameKey, priceKey := "name", "price"
+	if docType == receipt.DocumentTypeInvoice {
+		nameKey, priceKey = "description", "amount"
+	}
+	items, _ := rec.Data["items"].([]any)
+	for _, raw := range items {
+		item, _ := raw.(map[string]any)
+		var it askItem
+		it.Name, _ = item[nameKey].(string)
+		it.Qty, _ = item["qty"].(float64)
+		it.Price, _ = item[priceKey].(float64)
+		if it.Name != "" {
+			a.Items = append(a.Items, it)
+		}
+	}
+	return a
+}
+
+// askCitation summarizes a cited receipt.
+func askCitation(rec *store.Record) AskCitation {
+	a := askReceiptOf(rec)
+	return AskCitation{ID: rec.ID, Vendor: a.Vendor, Date: a.Date, Total: a.Total}
+}
@@ -0,0 +1,179 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+)
+
+// Audit flag reasons.
+const (
+	// flagDuplicateImage: the same image was submitted by more than one user.
+	flagDuplicateImage = "duplicate_image"
+	// flagDuplicatePurchase: different images fingerprint to the same purchase.
+	flagDuplicatePurchase = "duplicate_purchase"
+	// flagTotalMismatch: the same vendor, time, and card or check number
+	// appear with different totals, as if one copy was edited.
+	flagTotalMismatch = "total_mismatch"
+)
+
+// AuditReceipt summarizes one receipt in a flag.
+type AuditReceipt struct {
+	ID          string    `json:"id"`
+	Owner       string    `json:"owner,omitempty"`
+	ImageSHA256 string    `json:"image_sha256,omitempty"`
+	Total       float64   `json:"total"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// AuditFlag is a group of receipts that look like the same expense.
+type AuditFlag struct {
+	Reason      string         `json:"reason"`
+	Fingerprint string         `json:"fingerprint,omitempty"`
+	Detail      string         `json:"detail"`
+	Receipts    []AuditReceipt `json:"receipts"`
+}
+
+// AuditResponse lists suspicious receipt groups.
+type AuditResponse struct {
+	Checked int         `json:"checked"` // Fingerprinted receipts examined
+	Flags   []AuditFlag `json:"flags"`
+	Count   int         `json:"count"`
+}
+
+// handleAuditDuplicates flags receipts that look like duplicate or edited
+// expense submissions. Only the latest version of each receipt is checked,
+// and receipts analyzed before fingerprinting was added are skipped until
+// they are reprocessed.
+func (s *Server) handleAuditDuplicates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+
+	records, err := s.store.List()
+	if err != nil {
+		jsonError(w, "Failed to list receipts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var fingerprinted []*store.Record
+	for _, rec := range latestVersions(records) {
+		if rec.Fingerprint != "" {
+			fingerprinted = append(fingerprinted, rec)
+		}
+	}
+
+	flags := auditFingerprints(fingerprinted)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AuditResponse{
+		Checked: len(fingerprinted),
+		Flags:   flags,
+		Count:   len(flags),
+	})
+}
+
+// auditFingerprints groups records by fingerprint, and by fingerprint
+// without the total, and returns a flag for every suspicious group.
+func auditFingerprints(records []*store.Record) []AuditFlag {
+	byFingerprint := make(map[string][]*store.Record)
+	byPurchase := make(map[string][]*store.Record)
+	for _, rec := range records {
+		byFingerprint[rec.Fingerprint] = append(byFingerprint[rec.Fingerprint], rec)
+
+		// Without the total, only a timed receipt tied to a card or check
+		// is specific enough to call two totals a mismatch
+		parts := recordFingerprintParts(rec)
+		if len(parts.DateTime) > len("2006-01-02") && (parts.CardLast4 != "" || parts.CheckNumber != "") {
+			key := parts.Key(false)
+			byPurchase[key] = append(byPurchase[key], rec)
+		}
+	}
+
+	flags := make([]AuditFlag, 0)
+	for fingerprint, group := range byFingerprint {
+		if len(group) < 2 {
+			continue
+		}
+		reason, detail := flagDuplicateImage, "Same image submitted more than once"
+		if distinctImages(group) > 1 {
+			reason, detail = flagDuplicatePurchase, "Different images of the same purchase"
+		}
+		flags = append(flags, AuditFlag{
+			Reason:      reason,
+			Fingerprint: fingerprint,
+			Detail:      detail,
+			Receipts:    auditReceipts(group),
+		})
+	}
+	for _, group := range byPurchase {
+		totals := make(map[string]bool)
+		for _, rec := range group {
+			totals[fmt.Sprintf("%.2f", recordFingerprintParts(rec).Total)] = true
+		}
+		if len(totals) < 2 {
+			continue
+		}
+		flags = append(flags, AuditFlag{
+			Reason:   flagTotalMismatch,
+			Detail:   fmt.Sprintf("Same purchase recorded with %d different totals", len(totals)),
+			Receipts: auditReceipts(group),
+		})
+	}
+
+	sort.Slice(flags, func(i, j int) bool {
+		if flags[i].Reason != flags[j].Reason {
+			return flags[i].Reason < flags[j].Reason
+		}
+		return flags[i].Receipts[0].ID < flags[j].Receipts[0].ID
+	})
+	return flags
+}
+
+// recordFingerprintParts rebuilds the fingerprint inputs of a stored record.
+func recordFingerprintParts(rec *store.Record) receipt.FingerprintParts {
+	return fingerprintParts(receipt.DocumentType(rec.DocumentType), rec.Data,
+		rec.Location, rec.PurchaseTime, rec.CardLast4, rec.CheckNumber)
+}
+
+// distinctImages counts the different images in a group. Records without a
+// hash are counted as distinct.
+func distinctImages(group []*store.Record) int {
+	hashes := make(map[string]bool)
+	for _, rec := range group {
+		hash := rec.ImageSHA256
+		if hash == "" {
+			hash = "id:" + rec.ID
+		}
+		hashes[hash] = true
+	}
+	return len(hashes)
+}
+
+// auditReceipts summarizes a group, oldest first.
+func auditReceipts(group []*store.Record) []AuditReceipt {
+	receipts := make([]AuditReceipt, 0, len(group))
+	for _, rec := range group {
+		total, _ := rec.Data["total"].(float64)
+		receipts = append(receipts, AuditReceipt{
+			ID:          rec.ID,
+			Owner:       rec.Owner,
+			ImageSHA256: rec.ImageSHA256,
+			Total:       total,
+			CreatedAt:   rec.CreatedAt,
+		})
+	}
+	sort.Slice(receipts, func(i, j int) bool {
+		return receipts[i].CreatedAt.Before(receipts[j].CreatedAt)
+	})
+	return receipts
+}
@@ -0,0 +1,161 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"myprice/internal/redact"
+)
+
+// Role is an access level granted to an API key. Roles are ordered: each
+// role may do everything the roles below it can.
+type Role int
+
+const (
+	// RoleNone marks public routes that need no key.
+	RoleNone Role = iota
+	// RoleUploader may upload and analyze images.
+	RoleUploader
+	// RoleReviewer may also read, compare, and correct stored results.
+	RoleReviewer
+	// RoleAdmin may also reprocess, import/export, and run maintenance.
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{
+	RoleNone:     "none",
+	RoleUploader: "uploader",
+	RoleReviewer: "reviewer",
+	RoleAdmin:    "admin",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// ParseRole converts a configured role name into a Role.
+func ParseRole(s string) (Role, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	for role, n := range roleNames {
+		if role != RoleNone && n == name {
+			return role, nil
+		}
+	}
+	return RoleNone, fmt.Errorf("unknown role %q", s)
+}
+
+// Principal identifies the caller of an authenticated request.
+type Principal struct {
+	Name string
+	Role Role
+}
+
+type principalKey struct{}
+
+// PrincipalFrom returns the caller attached to ctx by the auth middleware.
+// It reports false when auth is disabled or the route is public.
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// apiKey is one configured credential.
+type apiKey struct {
+	principal Principal
+	secret    []byte
+}
+
+// loadAPIKeys parses API_KEYS, a comma-separated list of name:role:key
+// entries. An empty list disables authentication.
+func loadAPIKeys() ([]apiKey, error) {
+	raw := strings.TrimSpace(os.Getenv("API_KEYS"))
+	if raw == "" {
+		return nil, nil
+	}
+
+	var keys []apiKey
+	names := make(map[string]bool)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid API_KEYS entry: want name:role:key")
+		}
+		role, err := ParseRole(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("API key %q: %w", parts[0], err)
+		}
+		if names[parts[0]] {
+			return nil, fmt.Errorf("duplicate API key name %q", parts[0])
+		}
+		names[parts[0]] = true
+		redact.Register(parts[2])
+		keys = append(keys, apiKey{
+			principal: Principal{Name: parts[0], Role: role},
+			secret:    []byte(parts[2]),
+		})
+	}
+	return keys, nil
+}
+
+// authenticate returns the principal for the request's key, if it matches one.
+func (s *Server) authenticate(r *http.Request) (Principal, bool) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			key = strings.TrimPrefix(auth, "Bearer ")
+		}
+	}
+	if key == "" {
+		return Principal{}, false
+	}
+
+	// Compare against every key so timing doesn't reveal which one matched
+	var found Principal
+	matched := false
+	for _, k := range s.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(key), k.secret) == 1 {
+			found, matched = k.principal, true
+		}
+	}
+	return found, matched
+}
+
+// require wraps a handler with the route's access policy. Requests without
+// a valid key get 401; keys whose role is below min get 403. When no keys
+// are configured every route is open.
+func (s *Server) require(min Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if min == RoleNone || len(s.apiKeys) == 0 {
+			next(w, r)
+			return
+		}
+
+		p, ok := s.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="myprice"`)
+			jsonError(w, "Missing or invalid API key", http.StatusUnauthorized)
+			return
+		}
+		notePrincipal(r.Context(), p)
+		if p.Role < min {
+			log.Printf("Denied %s %s to %s (role %s, need %s)", r.Method, r.URL.Path, p.Name, p.Role, min)
+			jsonError(w, fmt.Sprintf("Requires %s role", min), http.StatusForbidden)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
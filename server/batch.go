@@ -0,0 +1,445 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+	"myprice/tools"
+)
+
+// Batch job states.
+const (
+	batchSubmitted  = "submitted"  // Waiting for the API to finish
+	batchReconciled = "reconciled" // Results saved to the store
+	batchFailed     = "failed"     // Results could not be retrieved
+)
+
+// BatchJob tracks one message batch from submission until its results are
+// saved as new receipt versions. Jobs are persisted so polling resumes
+// after a restart.
+type BatchJob struct {
+	ID        string            `json:"id"` // Message batch ID
+	Status    string            `json:"status"`
+	Counts    map[string]int    `json:"counts,omitempty"` // Latest request counts from the API
+	Items     []BatchItem       `json:"items"`
+	Results   []ReprocessResult `json:"results,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Actor     string            `json:"actor,omitempty"` // API key that submitted the reprocess
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// BatchItem is what is needed to turn one batch answer into a new version:
+// the OCR stage already ran when the batch was submitted.
+type BatchItem struct {
+	RecordID     string `json:"record_id"`
+	DocumentType string `json:"document_type"`
+	TextractPath string `json:"textract_path"`
+	Source       string `json:"source"`
+	ImageSHA256  string `json:"image_sha256,omitempty"`
+}
+
+// submitBatchReprocess runs OCR for each record and submits the LLM prompts
+// as message batches, returning the submitted jobs and any per-record
+// failures. Polling and reconciliation continue in the background; ctx only
+// bounds the submission.
+func (s *Server) submitBatchReprocess(ctx context.Context, records []*store.Record) ([]*BatchJob, []ReprocessResult) {
+	var failures []ReprocessResult
+	var requests []batchRequest
+	items := make(map[string]BatchItem)
+
+	for _, rec := range records {
+		if err := ctx.Err(); err != nil {
+			failures = append(failures, ReprocessResult{ID: rec.ID, Error: err.Error()})
+			continue
+		}
+		if isTextSource(rec.ImagePath) {
+			// Batch requests carry an image; text is cheap to redo directly
+			failures = append(failures, ReprocessResult{ID: rec.ID, Error: "plain text receipts can't be batched; reprocess them without batch"})
+			continue
+		}
+		if err := s.restoreOriginal(rec); err != nil {
+			failures = append(failures, ReprocessResult{ID: rec.ID, Error: err.Error()})
+			continue
+		}
+		ws, err := s.openWorkspace(rec.ImagePath)
+		if err != nil {
+			failures = append(failures, ReprocessResult{ID: rec.ID, Error: err.Error()})
+			continue
+		}
+		// Prepared images must survive until the batch body is sent
+		defer ws.Close()
+
+		result, preparedPath, err := s.recognize(ctx, ws, rec.ImagePath, receipt.ParseDocumentType(rec.DocumentType))
+		if err != nil {
+			failures = append(failures, ReprocessResult{ID: rec.ID, Error: err.Error()})
+			continue
+		}
+
+		requests = append(requests, batchRequest{
+			CustomID:  rec.ID,
+			ImagePath: preparedPath,
+			Prompt:    buildPrompt(result.DocType, result.Textract),
+		})
+		items[rec.ID] = BatchItem{
+			RecordID:     rec.ID,
+			DocumentType: string(result.DocType),
+			TextractPath: result.TextractPath,
+			Source:       result.Source,
+			ImageSHA256:  result.ImageSHA256,
+		}
+	}
+
+	groups, err := splitBatches(requests)
+	if err != nil {
+		for _, r := range requests {
+			failures = append(failures, ReprocessResult{ID: r.CustomID, Error: err.Error()})
+		}
+		return nil, failures
+	}
+
+	var jobs []*BatchJob
+	for _, group := range groups {
+		batch, err := s.createBatch(ctx, group)
+		if err != nil {
+			log.Printf("Failed to submit message batch: %v", err)
+			for _, r := range group {
+				failures = append(failures, ReprocessResult{ID: r.CustomID, Error: err.Error()})
+			}
+			continue
+		}
+
+		now := time.Now().UTC()
+		job := &BatchJob{ID: batch.ID, Status: batchSubmitted, CreatedAt: now, UpdatedAt: now}
+		if p, ok := PrincipalFrom(ctx); ok {
+			job.Actor = p.Name
+		}
+		for _, r := range group {
+			job.Items = append(job.Items, items[r.CustomID])
+		}
+		if err := s.saveBatchJob(job); err != nil {
+			log.Printf("Warning: failed to save batch job %s: %v", job.ID, err)
+		}
+		log.Printf("Submitted message batch %s (%d receipts)", job.ID, len(job.Items))
+
+		go s.watchBatch(job)
+		jobs = append(jobs, job)
+	}
+	return jobs, failures
+}
+
+// ResumeBatches restarts polling for batches submitted before a restart.
+// ctx bounds the lifetime of all batch watchers.
+func (s *Server) ResumeBatches(ctx context.Context) {
+	s.batchCtx = ctx
+	if s.claudeAPI == nil {
+		return
+	}
+
+	jobs, err := s.listBatchJobs()
+	if err != nil {
+		log.Printf("Warning: failed to load batch jobs: %v", err)
+		return
+	}
+	for _, job := range jobs {
+		if job.Status == batchSubmitted {
+			log.Printf("Resuming message batch %s", job.ID)
+			go s.watchBatch(job)
+		}
+	}
+}
+
+// watchBatch polls a batch until it ends, then reconciles its results.
+func (s *Server) watchBatch(job *BatchJob) {
+	ctx := s.batchCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	ticker := time.NewTicker(s.batchPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		batch, err := s.claudeAPI.GetBatch(ctx, job.ID)
+		if err != nil {
+			log.Printf("Warning: failed to poll message batch %s: %v", job.ID, err)
+			continue
+		}
+
+		job.Counts = map[string]int{
+			"processing": batch.RequestCounts.Processing,
+			"succeeded":  batch.RequestCounts.Succeeded,
+			"errored":    batch.RequestCounts.Errored,
+			"canceled":   batch.RequestCounts.Canceled,
+			"expired":    batch.RequestCounts.Expired,
+		}
+		if batch.ProcessingStatus == "ended" {
+			s.reconcileBatch(ctx, job, batch)
+		}
+		job.UpdatedAt = time.Now().UTC()
+		if err := s.saveBatchJob(job); err != nil {
+			log.Printf("Warning: failed to save batch job %s: %v", job.ID, err)
+		}
+		if job.Status != batchSubmitted {
+			return
+		}
+	}
+}
+
+// reconcileBatch saves each successful answer as a new version of its
+// receipt, exactly as a synchronous reprocess would.
+func (s *Server) reconcileBatch(ctx context.Context, job *BatchJob, batch *MessageBatch) {
+	items := make(map[string]BatchItem, len(job.Items))
+	for _, item := range job.Items {
+		items[item.RecordID] = item
+	}
+
+	results := make(map[string]ReprocessResult)
+	err := s.claudeAPI.BatchResults(ctx, batch, func(customID, jsonText string, err error) {
+		item, ok := items[customID]
+		if !ok {
+			return
+		}
+		if err != nil {
+			results[customID] = ReprocessResult{ID: customID, Error: err.Error()}
+		} else {
+			results[customID] = s.applyAnswer(ctx, item, jsonText, claudeModel, "")
+		}
+		s.logBatchAttempt(job, item, results[customID])
+	})
+	if err != nil {
+		log.Printf("Failed to fetch results for message batch %s: %v", job.ID, err)
+		job.Status, job.Error = batchFailed, err.Error()
+		return
+	}
+
+	job.Results = make([]ReprocessResult, 0, len(job.Items))
+	for _, item := range job.Items {
+		result, ok := results[item.RecordID]
+		if !ok {
+			result = ReprocessResult{ID: item.RecordID, Error: "missing from batch results"}
+		}
+		job.Results = append(job.Results, result)
+	}
+	job.Status = batchReconciled
+	log.Printf("Reconciled message batch %s (%d receipts)", job.ID, len(job.Results))
+}
+
+// applyAnswer stores a model answer, from a message batch or a kept raw
+// response, as the next version of its receipt. model and promptVersion
+// are what produced it; promptVersion is the current prompt's if "".
+func (s *Server) applyAnswer(ctx context.Context, item BatchItem, jsonText, model, promptVersion string) ReprocessResult {
+	old, err := s.store.Get(item.RecordID)
+	if err != nil {
+		return ReprocessResult{ID: item.RecordID, Error: err.Error()}
+	}
+	if old.SupersededBy != "" {
+		return ReprocessResult{ID: old.ID, Error: "superseded by " + old.SupersededBy}
+	}
+
+	// Items whose OCR failed were sent with the image alone
+	var textract tools.LoadTextractOutput
+	if item.TextractPath != "" {
+		if textract, err = s.loadTextract(item.TextractPath); err != nil {
+			return ReprocessResult{ID: old.ID, Error: err.Error()}
+		}
+	}
+
+	result := &analysisResult{
+		ImageSHA256:   item.ImageSHA256,
+		Textract:      textract,
+		TextractPath:  item.TextractPath,
+		Source:        item.Source,
+		DocType:       receipt.DocumentType(item.DocumentType),
+		Parser:        parserLLM,
+		Model:         model,
+		PromptVersion: promptVersion,
+	}
+	if result.PromptVersion == "" {
+		result.PromptVersion = receiptPromptVersion
+		if result.DocType == receipt.DocumentTypeInvoice {
+			result.PromptVersion = invoicePromptVersion
+		}
+	}
+	if result.Output, _, err = decodeAnswer(result.DocType, jsonText, textract); err != nil {
+		return ReprocessResult{ID: old.ID, Error: err.Error()}
+	}
+	s.enrich(ctx, result)
+
+	rec := result.record(old.ImagePath)
+	rec.PreviousID = old.ID
+	rec.Owner = old.Owner
+	newID := s.saveResult(rec)
+	if newID == "" {
+		return ReprocessResult{ID: old.ID, Error: "failed to save new version"}
+	}
+
+	return ReprocessResult{
+		ID:      old.ID,
+		NewID:   newID,
+		Changes: store.Diff(old.Data, rec.Data),
+	}
+}
+
+// decodeAnswer decodes a model answer that can't be sent back for
+// correction, noting its validation problems in its anomalies, and returns
+// it as stored along with the problems.
+func decodeAnswer(docType receipt.DocumentType, jsonText string, textract tools.LoadTextractOutput) (map[string]any, []string, error) {
+	if docType == receipt.DocumentTypeInvoice {
+		invoice, err := decodeInvoiceOutput(jsonText, textract)
+		if err != nil {
+			return nil, nil, err
+		}
+		issues := validateInvoiceOutput(invoice)
+		invoice.Anomalies = append(invoice.Anomalies, validationAnomalies(issues)...)
+		return invoice.Map(), issues, nil
+	}
+	parsed, err := decodeReceiptOutput(jsonText, textract)
+	if err != nil {
+		return nil, nil, err
+	}
+	issues := validateReceiptOutput(parsed)
+	parsed.Anomalies = append(parsed.Anomalies, validationAnomalies(issues)...)
+	return parsed.Map(), issues, nil
+}
+
+// batchJobPath returns the file a batch job is persisted to.
+func (s *Server) batchJobPath(id string) string {
+	return filepath.Join(s.batchDir, id+".json")
+}
+
+// saveBatchJob persists a batch job.
+func (s *Server) saveBatchJob(job *BatchJob) error {
+	if err := os.MkdirAll(s.batchDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.cipher.WriteFile(s.batchJobPath(job.ID), data, 0644)
+}
+
+// loadBatchJob reads a persisted batch job.
+func (s *Server) loadBatchJob(id string) (*BatchJob, error) {
+	data, err := s.cipher.ReadFile(s.batchJobPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var job BatchJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("failed to parse batch job %s: %w", id, err)
+	}
+	return &job, nil
+}
+
+// listBatchJobs returns every persisted batch job, newest first.
+func (s *Server) listBatchJobs() ([]*BatchJob, error) {
+	entries, err := os.ReadDir(s.batchDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*BatchJob
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		job, err := s.loadBatchJob(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+	})
+	return jobs, nil
+}
+
+// BatchListResponse lists batch reprocessing jobs.
+type BatchListResponse struct {
+	Batches []*BatchJob `json:"batches"`
+	Count   int         `json:"count"`
+}
+
+// handleAdminBatches lists batch reprocessing jobs.
+func (s *Server) handleAdminBatches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jobs, err := s.listBatchJobs()
+	if err != nil {
+		jsonError(w, "Failed to list batches: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if jobs == nil {
+		jobs = []*BatchJob{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BatchListResponse{Batches: jobs, Count: len(jobs)})
+}
+
+// handleAdminBatch returns one batch job with its results once reconciled.
+func (s *Server) handleAdminBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.PathValue("id")
+	if !validBatchID(id) {
+		jsonError(w, "Batch not found", http.StatusNotFound)
+		return
+	}
+	job, err := s.loadBatchJob(id)
+	if errors.Is(err, os.ErrNotExist) {
+		jsonError(w, "Batch not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Failed to load batch: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// validBatchID reports whether id is safe to use as a file name.
+func validBatchID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
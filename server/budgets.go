@@ -0,0 +1,262 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"myprice/internal/budget"
+	"myprice/internal/report"
+	"myprice/internal/store"
+)
+
+// BudgetRequest creates or replaces a budget. Exactly one of Category and
+// Vendor is given.
+type BudgetRequest struct {
+	Name     string  `json:"name,omitempty"`
+	Category string  `json:"category,omitempty"` // Spending category, as in reports
+	Vendor   string  `json:"vendor,omitempty"`   // Vendor or chain, as in reports
+	Amount   float64 `json:"amount"`             // Per calendar month
+}
+
+// BudgetProgress is spending against a budget in the current month.
+type BudgetProgress struct {
+	Period    string  `json:"period"` // "2025-11"
+	Spent     float64 `json:"spent"`
+	Remaining float64 `json:"remaining"` // Negative when over budget
+	Percent   float64 `json:"percent"`   // Of the budget spent
+	Receipts  int     `json:"receipts"`
+	Alerted   int     `json:"alerted,omitempty"` // Highest threshold alerted this month
+}
+
+// BudgetResponse is a budget with its progress.
+type BudgetResponse struct {
+	*budget.Budget
+	Progress BudgetProgress `json:"progress"`
+}
+
+// BudgetListResponse lists budgets.
+type BudgetListResponse struct {
+	Budgets []BudgetResponse `json:"budgets"`
+	Count   int              `json:"count"`
+}
+
+// handleBudgets lists the caller's budgets (every budget, for reviewers)
+// with this month's progress on GET, and creates one on POST.
+func (s *Server) handleBudgets(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) || !s.requireBudgets(w) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		records, err := s.store.List()
+		if err != nil {
+			jsonError(w, "Failed to list receipts: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		period := s.budgetPeriod()
+		list := make([]BudgetResponse, 0)
+		for _, b := range s.budgets.List() {
+			if canReadOwned(r, b.Owner) {
+				list = append(list, budgetResponse(b, records, period))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(BudgetListResponse{Budgets: list, Count: len(list)})
+
+	case http.MethodPost:
+		var req BudgetRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		b := budget.Budget{Name: req.Name, Category: req.Category, Vendor: req.Vendor, Amount: req.Amount}
+		if p, ok := PrincipalFrom(r.Context()); ok {
+			b.Owner = p.Name
+		}
+		if err := b.Validate(); err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		created, err := s.budgets.Create(b)
+		if err != nil {
+			jsonError(w, "Failed to create budget: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s created budget %s (%s)", ownerName(created.Owner), created.ID, budgetLabel(created))
+		s.serveBudget(w, created, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleBudget returns a budget with this month's progress on GET,
+// replaces its name, scope, and amount on PUT, and removes it on DELETE.
+// Only its owner and admins may change it.
+func (s *Server) handleBudget(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) || !s.requireBudgets(w) {
+		return
+	}
+	b, err := s.budgets.Get(r.PathValue("id"))
+	if errors.Is(err, budget.ErrNotFound) || err == nil && !canReadOwned(r, b.Owner) {
+		jsonError(w, "Budget not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Failed to load budget: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.serveBudget(w, b, http.StatusOK)
+
+	case http.MethodPut:
+		if !canErase(r, b.Owner) {
+			jsonError(w, "Only the budget's owner or an admin can change it", http.StatusForbidden)
+			return
+		}
+		var req BudgetRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		replacement := budget.Budget{Name: req.Name, Category: req.Category, Vendor: req.Vendor, Amount: req.Amount}
+		if err := replacement.Validate(); err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		updated, err := s.budgets.Update(b.ID, replacement)
+		if err != nil {
+			jsonError(w, "Failed to update budget: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.serveBudget(w, updated, http.StatusOK)
+
+	case http.MethodDelete:
+		if !canErase(r, b.Owner) {
+			jsonError(w, "Only the budget's owner or an admin can delete it", http.StatusForbidden)
+			return
+		}
+		if err := s.budgets.Delete(b.ID); err != nil {
+			jsonError(w, "Failed to delete budget: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveBudget writes b with this month's progress.
+func (s *Server) serveBudget(w http.ResponseWriter, b *budget.Budget, status int) {
+	records, err := s.store.List()
+	if err != nil {
+		jsonError(w, "Failed to list receipts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(budgetResponse(b, records, s.budgetPeriod()))
+}
+
+// budgetResponse adds b's progress in period, from records.
+func budgetResponse(b *budget.Budget, records []*store.Record, period report.Period) BudgetResponse {
+	spent, receipts := report.Spent(budgetRecords(records, b.Owner), period, b.Category, b.Vendor)
+	return BudgetResponse{
+		Budget: b,
+		Progress: BudgetProgress{
+			Period:    period.Name,
+			Spent:     spent,
+			Remaining: math.Round((b.Amount-spent)*100) / 100,
+			Percent:   math.Round(spent/b.Amount*1000) / 10,
+			Receipts:  receipts,
+			Alerted:   b.Alerted(period.Name),
+		},
+	}
+}
+
+// checkBudgets alerts the budgets a newly stored result counts toward
+// whose spending this month it takes past a threshold. The alerts are
+// kept with the budget and sent to sinks with the result.
+func (s *Server) checkBudgets(rec *store.Record) {
+	if s.budgets == nil || s.store == nil {
+		return
+	}
+	period := s.budgetPeriod()
+	var matching []*budget.Budget
+	for _, b := range s.budgets.List() {
+		if b.Owner != "" && b.Owner != rec.Owner {
+			continue
+		}
+		if _, n := report.Spent([]*store.Record{rec}, period, b.Category, b.Vendor); n > 0 {
+			matching = append(matching, b)
+		}
+	}
+	if len(matching) == 0 {
+		return
+	}
+
+	records, err := s.store.List()
+	if err != nil {
+		log.Printf("Warning: failed to list receipts to check budgets: %v", err)
+		return
+	}
+	for _, b := range matching {
+		spent, _ := report.Spent(budgetRecords(records, b.Owner), period, b.Category, b.Vendor)
+		alert, err := s.budgets.Check(b.ID, period.Name, spent, rec.ID)
+		if err != nil {
+			if !errors.Is(err, budget.ErrNotFound) {
+				log.Printf("Warning: failed to record budget alert for %s: %v", b.ID, err)
+			}
+			continue
+		}
+		if alert != nil {
+			log.Printf("Budget %s (%s) of %s reached %d%% in %s: %.2f of %.2f", b.ID, budgetLabel(b), ownerName(b.Owner), alert.Threshold, period.Name, spent, b.Amount)
+		}
+	}
+}
+
+// budgetPeriod returns the current month in the default time zone.
+func (s *Server) budgetPeriod() report.Period {
+	p, _ := report.ParsePeriod(time.Now().In(s.defaultTZ).Format("2006-01"))
+	return p
+}
+
+// budgetRecords keeps the records a budget of owner counts: owner's, or
+// every record for a budget made without authentication.
+func budgetRecords(records []*store.Record, owner string) []*store.Record {
+	if owner == "" {
+		return records
+	}
+	return ownedBy(records, owner)
+}
+
+// budgetLabel names a budget in logs.
+func budgetLabel(b *budget.Budget) string {
+	switch {
+	case b.Name != "":
+		return b.Name
+	case b.Category != "":
+		return "category " + b.Category
+	default:
+		return "vendor " + b.Vendor
+	}
+}
+
+// requireBudgets writes a 503 and returns false if the budget store is
+// unavailable.
+func (s *Server) requireBudgets(w http.ResponseWriter) bool {
+	if s.budgets == nil {
+		jsonError(w, "Budget store is not available", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
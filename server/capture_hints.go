@@ -0,0 +1,51 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"log"
+
+	"myprice/internal/receipt"
+)
+
+// defaultCaptureHintConfidence is the mean OCR confidence below which an
+// analysis comes with advice for retaking the photo.
+const defaultCaptureHintConfidence = 90.0
+
+// captureHints returns advice for photographing the document better when
+// its OCR confidence was mediocre or its total wasn't read, and nil
+// otherwise, as for a clean read or text that wasn't OCRed.
+func (s *Server) captureHints(result *analysisResult) []receipt.CaptureHint {
+	if len(result.Textract.Lines) == 0 || result.Output == nil {
+		return nil
+	}
+
+	var vendorRead, totalRead bool
+	if result.DocType == receipt.DocumentTypeInvoice {
+		inv, err := receipt.InvoiceFromMap(result.Output)
+		if err != nil {
+			log.Printf("Warning: capture hints skipped: %v", err)
+			return nil
+		}
+		vendorRead, totalRead = inv.Vendor.Name != "", inv.Total != nil
+	} else {
+		r, err := receipt.ReceiptFromMap(result.Output)
+		if err != nil {
+			log.Printf("Warning: capture hints skipped: %v", err)
+			return nil
+		}
+		vendorRead, totalRead = r.Vendor != "", r.Total != nil
+	}
+	if totalRead && result.Textract.MeanConfidence >= s.hintConfidence {
+		return nil
+	}
+
+	lines := make([]receipt.CaptureLine, len(result.Textract.Lines))
+	for i, line := range result.Textract.Lines {
+		lines[i] = receipt.CaptureLine{
+			LayoutLine: receipt.LayoutLine{Text: line.Text, Top: line.Top, Left: line.Left, Height: line.Height},
+			Confidence: line.Confidence,
+			Block:      line.Block,
+		}
+	}
+	return receipt.CaptureHints(lines, vendorRead, totalRead)
+}
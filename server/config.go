@@ -0,0 +1,69 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envInt reads an integer environment variable, returning def when unset or invalid.
+func envInt(name string, def int) int {
+	return int(envInt64(name, int64(def)))
+}
+
+// envInt64 reads an int64 environment variable, returning def when unset or invalid.
+func envInt64(name string, def int64) int64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	val, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		log.Printf("Warning: invalid %s=%q, using default %d", name, raw, def)
+		return def
+	}
+	return val
+}
+
+// envDuration reads a time.Duration environment variable (e.g. "72h"),
+// returning def when unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	val, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Printf("Warning: invalid %s=%q, using default %s", name, raw, def)
+		return def
+	}
+	return val
+}
+
+// envFloat reads a float environment variable, returning def when unset or invalid.
+func envFloat(name string, def float64) float64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	val, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		log.Printf("Warning: invalid %s=%q, using default %g", name, raw, def)
+		return def
+	}
+	return val
+}
+
+// secretEnvVars are the settings holding credentials, whose values are
+// scrubbed from logs and error messages wherever they appear. API_KEYS is
+// registered key by key as it is parsed.
+var secretEnvVars = []string{
+	"ANTHROPIC_API_KEY", "OPENAI_API_KEY",
+	"UPLOAD_SIGNING_KEY", "SHARE_SIGNING_KEY", "LOG_HASH_KEY", "ENCRYPTION_KEY",
+	"AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+	"DROPBOX_TOKEN", "DROPBOX_REFRESH_TOKEN", "DROPBOX_APP_SECRET",
+	"GDRIVE_TOKEN", "GDRIVE_REFRESH_TOKEN", "GDRIVE_CLIENT_SECRET",
+	"SHEETS_TOKEN", "SHEETS_REFRESH_TOKEN", "SHEETS_CLIENT_SECRET",
+}
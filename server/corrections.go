@@ -0,0 +1,431 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+)
+
+// Fields a bulk correction rule can rewrite.
+const (
+	ruleVendor       = "vendor"        // The vendor name
+	ruleItemName     = "item_name"     // Each line item's name
+	ruleItemCategory = "item_category" // Each of the receipt's item categories
+)
+
+// CorrectionRule rewrites one field wherever Match finds it. A matched
+// value is replaced whole by Set.
+type CorrectionRule struct {
+	Field string `json:"field"` // "vendor", "item_name", or "item_category"
+	Match string `json:"match"` // Regular expression
+	Set   string `json:"set"`   // $1 and ${name} expand Match's groups; "" drops an item category
+
+	re *regexp.Regexp
+}
+
+// BulkCorrectionRequest applies rules to the current version of every
+// receipt the filters select. Filters are optional and combined with AND.
+type BulkCorrectionRequest struct {
+	Rules  []CorrectionRule `json:"rules"`
+	IDs    []string         `json:"ids,omitempty"`
+	Owner  string           `json:"owner,omitempty"`
+	From   string           `json:"from,omitempty"` // YYYY-MM-DD, inclusive
+	To     string           `json:"to,omitempty"`   // YYYY-MM-DD, inclusive
+	Limit  int              `json:"limit,omitempty"`
+	DryRun bool             `json:"dry_run,omitempty"` // List the changes without storing them
+}
+
+// CorrectionResult is what a bulk correction did to one receipt.
+type CorrectionResult struct {
+	ID        string         `json:"id"`               // The version corrected
+	NewID     string         `json:"new_id,omitempty"` // The corrected version
+	Changes   []store.Change `json:"changes"`
+	Error     string         `json:"error,omitempty"`
+	UndoneID  string         `json:"undone_id,omitempty"` // The version undo stored the old data as
+	UndoError string         `json:"undo_error,omitempty"`
+}
+
+// BulkCorrection is one run of bulk correction rules. Runs that stored
+// corrections are kept so they can be undone.
+type BulkCorrection struct {
+	ID        string             `json:"id,omitempty"` // Unset for a dry run
+	Rules     []CorrectionRule   `json:"rules"`
+	DryRun    bool               `json:"dry_run"`
+	Matched   int                `json:"matched"` // Receipts the rules change
+	Corrected int                `json:"corrected"`
+	Failed    int                `json:"failed"`
+	Undone    int                `json:"undone,omitempty"`
+	Actor     string             `json:"actor,omitempty"` // API key that ran it
+	CreatedAt time.Time          `json:"created_at"`
+	UndoneAt  *time.Time         `json:"undone_at,omitempty"`
+	Results   []CorrectionResult `json:"results"`
+}
+
+// compileRules checks rules and compiles their patterns.
+func compileRules(rules []CorrectionRule) error {
+	if len(rules) == 0 {
+		return errors.New("rules is required")
+	}
+	for i := range rules {
+		rule := &rules[i]
+		switch rule.Field {
+		case ruleVendor, ruleItemName:
+			if strings.TrimSpace(rule.Set) == "" {
+				return fmt.Errorf("rule %d: set is required for %s", i+1, rule.Field)
+			}
+		case ruleItemCategory:
+		default:
+			return fmt.Errorf("rule %d: unknown field %q (want vendor, item_name, or item_category)", i+1, rule.Field)
+		}
+		if rule.Match == "" {
+			return fmt.Errorf("rule %d: match is required", i+1)
+		}
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return fmt.Errorf("rule %d: invalid match: %w", i+1, err)
+		}
+		rule.re = re
+	}
+	return nil
+}
+
+// rewrite returns v as the rule rewrites it, and whether the rule matched.
+func (rule *CorrectionRule) rewrite(v string) (string, bool) {
+	m := rule.re.FindStringSubmatchIndex(v)
+	if m == nil {
+		return v, false
+	}
+	return strings.TrimSpace(string(rule.re.ExpandString(nil, rule.Set, v, m))), true
+}
+
+// applyRules returns a copy of a stored output, a receipt or an invoice by
+// docType, rewritten by rules in order.
+func applyRules(docType receipt.DocumentType, data map[string]any, rules []CorrectionRule) (map[string]any, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]any
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, err
+	}
+
+	vendor, vendorKey, nameKey := out, "vendor", "name"
+	if docType == receipt.DocumentTypeInvoice {
+		vendor, _ = out["vendor"].(map[string]any)
+		vendorKey, nameKey = "name", "description"
+	}
+	for i := range rules {
+		rule := &rules[i]
+		switch rule.Field {
+		case ruleVendor:
+			if v, ok := vendor[vendorKey].(string); ok {
+				if nv, ok := rule.rewrite(v); ok {
+					vendor[vendorKey] = nv
+				}
+			}
+		case ruleItemName:
+			items, _ := out["items"].([]any)
+			for _, it := range items {
+				m, _ := it.(map[string]any)
+				if v, ok := m[nameKey].(string); ok {
+					if nv, ok := rule.rewrite(v); ok {
+						m[nameKey] = nv
+					}
+				}
+			}
+		case ruleItemCategory:
+			cats, ok := out["item_categories"].([]any)
+			if !ok {
+				continue
+			}
+			kept := make([]any, 0, len(cats))
+			for _, c := range cats {
+				if v, ok := c.(string); ok {
+					if nv, matched := rule.rewrite(v); matched {
+						if nv == "" || slices.Contains(kept, any(nv)) {
+							continue
+						}
+						c = nv
+					}
+				}
+				kept = append(kept, c)
+			}
+			out["item_categories"] = kept
+		}
+	}
+	return out, nil
+}
+
+// handleAdminCorrections applies bulk correction rules on POST, or
+// previews them with dry_run, and lists past runs on GET. Each corrected
+// receipt is stored as its next version, as a correction by hand is.
+func (s *Server) handleAdminCorrections(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		runs, err := s.listCorrections()
+		if err != nil {
+			jsonError(w, "Failed to list corrections: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if runs == nil {
+			runs = []*BulkCorrection{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"corrections": runs, "count": len(runs)})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+
+	var req BulkCorrectionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := compileRules(req.Rules); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.correctionMu.Lock()
+	defer s.correctionMu.Unlock()
+
+	records, err := s.store.List()
+	if err != nil {
+		jsonError(w, "Failed to list receipts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	run := &BulkCorrection{Rules: req.Rules, DryRun: req.DryRun, CreatedAt: time.Now().UTC(), Results: []CorrectionResult{}}
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		run.Actor = p.Name
+	}
+
+	ids := make(map[string]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		ids[id] = true
+	}
+	// List is newest first; correct oldest first
+	slices.Reverse(records)
+	for _, rec := range records {
+		if rec.SupersededBy != "" || (len(ids) > 0 && !ids[rec.ID]) {
+			continue
+		}
+		if req.Owner != "" && rec.Owner != req.Owner {
+			continue
+		}
+		if date := recordDate(rec); (req.From != "" && date < req.From) || (req.To != "" && date > req.To) {
+			continue
+		}
+
+		data, err := applyRules(receipt.DocumentType(rec.DocumentType), rec.Data, req.Rules)
+		if err != nil {
+			run.Failed++
+			run.Results = append(run.Results, CorrectionResult{ID: rec.ID, Changes: []store.Change{}, Error: err.Error()})
+			continue
+		}
+		changes := store.Diff(rec.Data, data)
+		if len(changes) == 0 {
+			continue
+		}
+		run.Matched++
+		result := CorrectionResult{ID: rec.ID, Changes: changes}
+		if !req.DryRun {
+			if result.NewID = s.saveResult(s.correctedVersion(rec, data)); result.NewID == "" {
+				result.Error = "failed to save corrected version"
+				run.Failed++
+			} else {
+				run.Corrected++
+			}
+		}
+		run.Results = append(run.Results, result)
+		if req.Limit > 0 && run.Matched >= req.Limit {
+			break
+		}
+	}
+
+	if !req.DryRun && run.Matched > 0 {
+		run.ID = store.NewID()
+		if err := s.saveCorrection(run); err != nil {
+			log.Printf("Warning: failed to save bulk correction %s: %v", run.ID, err)
+		}
+		log.Printf("Bulk correction %s: corrected %d receipts, %d failed", run.ID, run.Corrected, run.Failed)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+// handleAdminCorrection returns one bulk correction run.
+func (s *Server) handleAdminCorrection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	run, ok := s.loadCorrectionOrFail(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+// handleAdminCorrectionUndo undoes a bulk correction: each receipt it
+// corrected gets its data from before as its next version. A receipt that
+// was reanalyzed or corrected again since is left as it is.
+func (s *Server) handleAdminCorrectionUndo(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) {
+		return
+	}
+	s.correctionMu.Lock()
+	defer s.correctionMu.Unlock()
+
+	run, ok := s.loadCorrectionOrFail(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	if run.UndoneAt != nil {
+		jsonError(w, "Correction was already undone", http.StatusConflict)
+		return
+	}
+
+	for i := range run.Results {
+		result := &run.Results[i]
+		if result.NewID == "" || result.UndoneID != "" {
+			continue
+		}
+		if err := s.undoCorrection(result); err != nil {
+			result.UndoError = err.Error()
+			continue
+		}
+		run.Undone++
+	}
+	now := time.Now().UTC()
+	run.UndoneAt = &now
+	if err := s.saveCorrection(run); err != nil {
+		jsonError(w, "Failed to save correction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Undid bulk correction %s: restored %d receipts", run.ID, run.Undone)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+// undoCorrection stores the data a receipt had before a bulk correction as
+// its next version, made by the parser that made the data.
+func (s *Server) undoCorrection(result *CorrectionResult) error {
+	cur, err := s.store.Get(result.NewID)
+	if err != nil {
+		return err
+	}
+	if cur.SupersededBy != "" {
+		return fmt.Errorf("changed since by %s; left as it is", cur.SupersededBy)
+	}
+	old, err := s.store.Get(result.ID)
+	if err != nil {
+		return err
+	}
+
+	rec := s.correctedVersion(cur, old.Data)
+	rec.Parser, rec.Model, rec.PromptVersion = old.Parser, old.Model, old.PromptVersion
+	if result.UndoneID = s.saveResult(rec); result.UndoneID == "" {
+		return errors.New("failed to save restored version")
+	}
+	return nil
+}
+
+// correctionPath returns the file a bulk correction run is persisted to.
+func (s *Server) correctionPath(id string) string {
+	return filepath.Join(s.correctionDir, id+".json")
+}
+
+// saveCorrection persists a bulk correction run.
+func (s *Server) saveCorrection(run *BulkCorrection) error {
+	if err := os.MkdirAll(s.correctionDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.cipher.WriteFile(s.correctionPath(run.ID), data, 0644)
+}
+
+// loadCorrection reads a persisted bulk correction run.
+func (s *Server) loadCorrection(id string) (*BulkCorrection, error) {
+	data, err := s.cipher.ReadFile(s.correctionPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var run BulkCorrection
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, fmt.Errorf("failed to parse correction %s: %w", id, err)
+	}
+	return &run, nil
+}
+
+// loadCorrectionOrFail loads a bulk correction run, answering 404 when
+// there is none.
+func (s *Server) loadCorrectionOrFail(w http.ResponseWriter, id string) (*BulkCorrection, bool) {
+	if !validBatchID(id) {
+		jsonError(w, "Correction not found", http.StatusNotFound)
+		return nil, false
+	}
+	run, err := s.loadCorrection(id)
+	if errors.Is(err, os.ErrNotExist) {
+		jsonError(w, "Correction not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		jsonError(w, "Failed to load correction: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return run, true
+}
+
+// listCorrections returns every persisted bulk correction run, newest
+// first.
+func (s *Server) listCorrections() ([]*BulkCorrection, error) {
+	entries, err := os.ReadDir(s.correctionDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []*BulkCorrection
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		run, err := s.loadCorrection(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].CreatedAt.After(runs[j].CreatedAt)
+	})
+	return runs, nil
+}
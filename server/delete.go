@@ -0,0 +1,292 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"myprice/internal/fsutil"
+	"myprice/internal/imageprep"
+	"myprice/internal/store"
+)
+
+// DeleteResponse reports what a deletion removed.
+type DeleteResponse struct {
+	Success      bool     `json:"success"`
+	Records      []string `json:"records"`       // IDs of every deleted version
+	FilesRemoved int      `json:"files_removed"` // Images and cached OCR/downscaled copies
+	FilesKept    int      `json:"files_kept"`    // Files still used by other receipts, or outside the upload dir
+}
+
+// DeletionEntry is one line of the deletion audit log. It records who
+// erased what, but none of the receipt's contents.
+type DeletionEntry struct {
+	Time         time.Time `json:"time"`
+	Actor        string    `json:"actor,omitempty"`
+	Reason       string    `json:"reason"` // "receipt" or "user_purge"
+	Subject      string    `json:"subject"`
+	Records      []string  `json:"records"`
+	FilesRemoved int       `json:"files_removed"`
+}
+
+// handleDeleteReceipt erases a receipt: every version of it, the original
+// image and its archived copy, and the cached OCR output and downscaled
+// copy. Callers may delete their own receipts; admins may delete any.
+func (s *Server) handleDeleteReceipt(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) {
+		return
+	}
+
+	rec, ok := s.loadRecord(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	if !canErase(r, rec.Owner) {
+		jsonError(w, "Only the receipt's owner or an admin can delete it", http.StatusForbidden)
+		return
+	}
+
+	s.eraseAndRespond(w, r, []*store.Record{rec}, "receipt", rec.ID)
+}
+
+// handlePurgeUser erases every receipt submitted by one API key. Callers
+// may purge their own receipts; admins may purge anyone's.
+func (s *Server) handlePurgeUser(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) {
+		return
+	}
+
+	owner := r.PathValue("name")
+	if !canErase(r, owner) {
+		jsonError(w, "Only the user or an admin can purge their receipts", http.StatusForbidden)
+		return
+	}
+
+	records, err := s.store.List()
+	if err != nil {
+		jsonError(w, "Failed to list receipts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var owned []*store.Record
+	for _, rec := range records {
+		if rec.Owner == owner {
+			owned = append(owned, rec)
+		}
+	}
+
+	s.eraseAndRespond(w, r, owned, "user_purge", owner)
+}
+
+// canErase reports whether the caller may delete data belonging to owner.
+// With authentication disabled there is no caller identity to check.
+func canErase(r *http.Request, owner string) bool {
+	p, ok := PrincipalFrom(r.Context())
+	if !ok {
+		return true
+	}
+	return p.Role >= RoleAdmin || (owner != "" && p.Name == owner)
+}
+
+// eraseAndRespond erases records, writes the audit entry, and sends the response.
+func (s *Server) eraseAndRespond(w http.ResponseWriter, r *http.Request, records []*store.Record, reason, subject string) {
+	resp, err := s.erase(records)
+	if err != nil {
+		log.Printf("Deletion of %s %s failed: %v", reason, subject, err)
+		jsonError(w, "Deletion failed, nothing was removed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	entry := DeletionEntry{
+		Time:         time.Now().UTC(),
+		Reason:       reason,
+		Subject:      subject,
+		Records:      resp.Records,
+		FilesRemoved: resp.FilesRemoved,
+	}
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		entry.Actor = p.Name
+	}
+	if err := s.appendDeletionLog(entry); err != nil {
+		log.Printf("Warning: failed to write deletion audit log: %v", err)
+	}
+	log.Printf("Deleted %d records and %d files (%s %s)", len(resp.Records), resp.FilesRemoved, reason, subject)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// erase removes records, all of their versions, and the files derived from
+// their images. Either everything is removed or nothing is: files are
+// staged aside first and restored if any record fails to delete.
+func (s *Server) erase(records []*store.Record) (*DeleteResponse, error) {
+	s.deleteMu.Lock()
+	defer s.deleteMu.Unlock()
+
+	// Expand to every version of each receipt
+	doomed := make(map[string]*store.Record)
+	for _, rec := range records {
+		versions, err := store.Versions(s.store, rec)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range versions {
+			doomed[v.ID] = v
+		}
+	}
+
+	all, err := s.store.List()
+	if err != nil {
+		return nil, err
+	}
+	inUse := make(map[string]bool)
+	for _, rec := range all {
+		if doomed[rec.ID] == nil {
+			inUse[rec.ImagePath] = true
+			inUse[rec.TextractPath] = true
+			for _, path := range s.derivedFiles(rec) {
+				inUse[path] = true
+			}
+		}
+	}
+
+	resp := &DeleteResponse{Success: true, Records: make([]string, 0, len(doomed))}
+	var removal fsutil.Removal
+	var removedHashes []string // Of the files removed, for their Files API uploads
+	seen := make(map[string]bool)
+	for _, rec := range doomed {
+		for _, path := range s.derivedFiles(rec) {
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			if inUse[path] {
+				resp.FilesKept++
+				continue
+			}
+			if s.claudeAPI != nil && s.claudeAPI.files != nil {
+				if sha, err := fileSHA256(path); err == nil {
+					removedHashes = append(removedHashes, sha)
+				}
+			}
+			staged, err := removal.Stage(path)
+			if err != nil {
+				removal.Rollback()
+				return nil, err
+			}
+			if staged {
+				resp.FilesRemoved++
+			}
+		}
+		if rec.ImagePath != "" && !s.isUploadPath(rec.ImagePath) && !seen[rec.ImagePath] {
+			seen[rec.ImagePath] = true
+			resp.FilesKept++
+		}
+	}
+
+	var deleted []*store.Record
+	for id, rec := range doomed {
+		if err := s.store.Delete(id); err != nil {
+			for _, d := range deleted {
+				if putErr := s.store.Put(d); putErr != nil {
+					log.Printf("Warning: failed to restore record %s: %v", d.ID, putErr)
+				}
+			}
+			if rbErr := removal.Rollback(); rbErr != nil {
+				log.Printf("Warning: failed to restore files: %v", rbErr)
+			}
+			return nil, fmt.Errorf("failed to delete record %s: %w", id, err)
+		}
+		deleted = append(deleted, rec)
+		resp.Records = append(resp.Records, id)
+	}
+
+	s.unindexRecords(resp.Records)
+	s.unembedRecords(resp.Records)
+	if s.evals != nil {
+		// Experiment pairs hold copies of the parsed receipts
+		if _, err := s.evals.DeleteReceipts(resp.Records); err != nil {
+			log.Printf("Warning: failed to delete experiment pairs: %v", err)
+		}
+	}
+	if s.rawResponses != nil {
+		// So do the model's raw answers
+		if _, err := s.rawResponses.DeleteReceipts(resp.Records); err != nil {
+			log.Printf("Warning: failed to delete raw model responses: %v", err)
+		}
+	}
+	if s.reviews != nil {
+		if err := s.reviews.Delete(resp.Records...); err != nil {
+			log.Printf("Warning: failed to delete review state: %v", err)
+		}
+	}
+
+	if err := removal.Commit(); err != nil {
+		// Records are gone; leftover staged dotfiles are swept by the janitor
+		log.Printf("Warning: failed to remove some staged files: %v", err)
+	}
+	s.forgetUploadedImages(removedHashes)
+	return resp, nil
+}
+
+// derivedFiles returns the files the server wrote for a record: the uploaded
+// image, its cached Textract output and downscaled copy, the copy under
+// OUTPUT_DIR, and its archived original. Images outside the upload directory were supplied by path and
+// are never deleted.
+func (s *Server) derivedFiles(rec *store.Record) []string {
+	var files []string
+	if rec.TextractPath != "" && strings.HasPrefix(rec.TextractPath, s.textractDir+string(filepath.Separator)) {
+		files = append(files, rec.TextractPath)
+	}
+	if rec.ImagePath != "" {
+		files = append(files,
+			s.textractCachePath(rec.ImagePath),
+			imageprep.PreparedPath(rec.ImagePath, s.preparedDir),
+		)
+		if s.isUploadPath(rec.ImagePath) {
+			files = append(files, rec.ImagePath)
+		}
+	}
+	if s.isOutputPath(rec.OutputPath) {
+		files = append(files, rec.OutputPath)
+	}
+	if rec.Original != nil && s.originals != nil {
+		if path := s.originals.Path(rec.Original.SHA256); path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// isUploadPath reports whether path is inside the upload directory.
+func (s *Server) isUploadPath(path string) bool {
+	rel, err := filepath.Rel(s.uploadDir, path)
+	return err == nil && !strings.HasPrefix(rel, "..") && rel != "."
+}
+
+// appendDeletionLog appends one entry to the deletion audit log.
+func (s *Server) appendDeletionLog(entry DeletionEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.deletionLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,247 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+)
+
+// maxEditAttempts is how many times a write to a receipt is tried when
+// another write lands between reading and saving it.
+const maxEditAttempts = 5
+
+// CorrectionRequest replaces a receipt's parsed output.
+type CorrectionRequest struct {
+	Data map[string]any `json:"data"`
+}
+
+// ConflictResponse answers an edit to a receipt that changed since the
+// client read it, as named by If-Match.
+type ConflictResponse struct {
+	Error   bool           `json:"error"`
+	Code    string         `json:"code"` // Always "conflict"
+	Message string         `json:"message"`
+	ETag    string         `json:"etag"`    // Of the current version, for a retried edit
+	Receipt *store.Record  `json:"receipt"` // The current version
+	Changes []store.Change `json:"changes"` // What the edit would change on it
+}
+
+// receiptETag names a record and its revision. A receipt that was
+// reanalyzed since has a new ID, and one edited in place a new revision.
+func receiptETag(rec *store.Record) string {
+	return fmt.Sprintf(`"%s.%d"`, rec.ID, rec.Revision)
+}
+
+// ifMatch reports whether the request's If-Match header, if it has one,
+// names cur.
+func ifMatch(r *http.Request, cur *store.Record) bool {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return true
+	}
+	want := receiptETag(cur)
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == want {
+			return true
+		}
+	}
+	return false
+}
+
+// editFields are the parts of a receipt users edit, for diffs between
+// versions of it: "data.total", "tags[0]", "notes".
+func editFields(rec *store.Record) map[string]any {
+	tags := rec.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return map[string]any{"data": rec.Data, "tags": tags, "notes": rec.Notes}
+}
+
+// editReceipt applies change to the current version of the receipt in the
+// path and saves it in place, so edits made through an old version's ID
+// aren't lost on a version nobody reads. Only the receipt's owner or an
+// admin may edit it. A request with If-Match naming another revision gets
+// a 409 conflict; without one, an edit that races another write is applied
+// again to what that write saved. An error from change is a bad request.
+func (s *Server) editReceipt(w http.ResponseWriter, r *http.Request, change func(*store.Record) error) (*store.Record, bool) {
+	if !s.requireStore(w) {
+		return nil, false
+	}
+	id := r.PathValue("id")
+	if _, ok := s.loadRecord(w, id); !ok {
+		return nil, false
+	}
+
+	for attempt := 1; ; attempt++ {
+		rec, err := s.latestRecord(id)
+		if err != nil {
+			jsonError(w, "Failed to load receipt: "+err.Error(), http.StatusInternalServerError)
+			return nil, false
+		}
+		if !canErase(r, rec.Owner) {
+			jsonError(w, "Only the receipt's owner or an admin can edit it", http.StatusForbidden)
+			return nil, false
+		}
+		if !ifMatch(r, rec) {
+			s.writeConflict(w, id, change)
+			return nil, false
+		}
+
+		if err := change(rec); err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+		err = s.store.Update(rec)
+		if errors.Is(err, store.ErrConflict) || errors.Is(err, store.ErrNotFound) {
+			if attempt < maxEditAttempts {
+				continue
+			}
+			s.writeConflict(w, id, change)
+			return nil, false
+		}
+		if err != nil {
+			jsonError(w, "Failed to save receipt: "+err.Error(), http.StatusInternalServerError)
+			return nil, false
+		}
+		return rec, true
+	}
+}
+
+// writeConflict answers 409 with the current version of the receipt id
+// leads to and what change would make different on it.
+func (s *Server) writeConflict(w http.ResponseWriter, id string, change func(*store.Record) error) {
+	cur, err := s.latestRecord(id)
+	if err != nil {
+		jsonError(w, "Failed to load receipt: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	edited, err := s.store.Get(cur.ID)
+	if err != nil {
+		jsonError(w, "Failed to load receipt: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	changes := []store.Change{}
+	if change(edited) == nil {
+		changes = store.Diff(editFields(cur), editFields(edited))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", receiptETag(cur))
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(ConflictResponse{
+		Error:   true,
+		Code:    "conflict",
+		Message: "The receipt was changed since it was read; review the current version and send the edit again with its ETag",
+		ETag:    receiptETag(cur),
+		Receipt: cur,
+		Changes: changes,
+	})
+}
+
+// canEdit reports whether the caller may correct the parsed data of a
+// receipt belonging to owner: its owner, or any reviewer, since correcting
+// stored results is what reviewers are for. With authentication disabled
+// there is no caller identity to check.
+func canEdit(r *http.Request, owner string) bool {
+	p, ok := PrincipalFrom(r.Context())
+	if !ok {
+		return true
+	}
+	return p.Role >= RoleReviewer || (owner != "" && p.Name == owner)
+}
+
+// handleCorrectReceipt replaces a receipt's parsed output with a corrected
+// one, stored as its next version so the parser's answer stays in the
+// version history. Background reanalysis leaves corrected receipts alone.
+// Reviewers may correct anyone's receipts; uploaders only their own.
+func (s *Server) handleCorrectReceipt(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) {
+		return
+	}
+	var req CorrectionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Data) == 0 {
+		jsonError(w, "data is required", http.StatusBadRequest)
+		return
+	}
+	correct := func(rec *store.Record) error {
+		rec.Data = req.Data
+		return nil
+	}
+
+	id := r.PathValue("id")
+	if _, ok := s.loadRecord(w, id); !ok {
+		return
+	}
+	cur, err := s.latestRecord(id)
+	if err != nil {
+		jsonError(w, "Failed to load receipt: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !canEdit(r, cur.Owner) {
+		jsonError(w, "Only the receipt's owner or a reviewer can correct it", http.StatusForbidden)
+		return
+	}
+	if !ifMatch(r, cur) {
+		s.writeConflict(w, id, correct)
+		return
+	}
+
+	rec := s.correctedVersion(cur, req.Data)
+	if s.saveResult(rec) == "" {
+		if latest, err := s.latestRecord(id); err == nil && latest.ID != cur.ID {
+			s.writeConflict(w, id, correct)
+			return
+		}
+		jsonError(w, "Failed to save corrected receipt", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", receiptETag(rec))
+	json.NewEncoder(w).Encode(rec)
+}
+
+// correctedVersion returns the record storing data as the next version of
+// cur, made by parserManual. The chain, fingerprint, and vendor category
+// follow a corrected vendor, and its anomalies are detected again.
+func (s *Server) correctedVersion(cur *store.Record, data map[string]any) *store.Record {
+	rec := &store.Record{
+		ImagePath:      cur.ImagePath,
+		ImageSHA256:    cur.ImageSHA256,
+		TextractPath:   cur.TextractPath,
+		DocumentType:   cur.DocumentType,
+		Source:         cur.Source,
+		Owner:          cur.Owner,
+		Parser:         parserManual,
+		OCRConfidence:  cur.OCRConfidence,
+		PreviousID:     cur.ID,
+		PurchaseTime:   cur.PurchaseTime,
+		Capture:        cur.Capture,
+		CardLast4:      cur.CardLast4,
+		CheckNumber:    cur.CheckNumber,
+		VendorCategory: cur.VendorCategory,
+		Tags:           cur.Tags,
+		Notes:          cur.Notes,
+		Data:           data,
+	}
+	if cur.Location != nil {
+		loc := *cur.Location
+		rec.Location = &loc
+	}
+	if cur.Fingerprint != "" {
+		rec.Fingerprint = receipt.Fingerprint(recordFingerprintParts(rec))
+	}
+	s.recodeVendor(rec)
+	return rec
+}
@@ -0,0 +1,59 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"myprice/internal/crypt"
+)
+
+// workspace holds the plaintext files one analysis needs.
+type workspace struct {
+	imagePath   string // Readable copy of the image
+	preparedDir string // Where downscaled copies go
+	tempDir     string
+}
+
+// openWorkspace returns readable paths for analyzing imagePath. Without
+// encryption these are the image itself and the shared prepared-image
+// cache. With encryption the image is decrypted, and downscaled copies are
+// written, into a private temp directory removed by Close, so plaintext
+// never lands in the shared upload or cache directories.
+func (s *Server) openWorkspace(imagePath string) (*workspace, error) {
+	if !s.cipher.Enabled() {
+		return &workspace{imagePath: imagePath, preparedDir: s.preparedDir}, nil
+	}
+
+	tempDir, err := os.MkdirTemp("", "myprice-analyze-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workspace: %w", err)
+	}
+	ws := &workspace{imagePath: imagePath, preparedDir: tempDir, tempDir: tempDir}
+
+	// Unreadable images are left for the pipeline to report, as without encryption
+	data, err := os.ReadFile(imagePath)
+	if err != nil || !crypt.IsSealed(data) {
+		return ws, nil
+	}
+
+	plaintext, err := s.cipher.Open(data)
+	if err != nil {
+		ws.Close()
+		return nil, fmt.Errorf("failed to decrypt image: %w", err)
+	}
+	ws.imagePath = filepath.Join(tempDir, filepath.Base(imagePath))
+	if err := os.WriteFile(ws.imagePath, plaintext, 0600); err != nil {
+		ws.Close()
+		return nil, fmt.Errorf("failed to write workspace image: %w", err)
+	}
+	return ws, nil
+}
+
+// Close removes the workspace's temp directory, if any.
+func (ws *workspace) Close() {
+	if ws.tempDir != "" {
+		os.RemoveAll(ws.tempDir)
+	}
+}
@@ -0,0 +1,293 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"myprice/internal/exif"
+	"myprice/internal/geo"
+	"myprice/internal/receipt"
+	"myprice/internal/units"
+)
+
+// geocodeTimeout bounds how long an analysis waits on the geocoder.
+const geocodeTimeout = 5 * time.Second
+
+// newGeocoder builds the geocoder selected by the GEOCODER environment
+// variable, or returns nil when geocoding is disabled (the default).
+func newGeocoder() geo.Geocoder {
+	switch strings.ToLower(os.Getenv("GEOCODER")) {
+	case "":
+		return nil
+	case "nominatim":
+		userAgent := os.Getenv("GEOCODER_USER_AGENT")
+		if userAgent == "" {
+			userAgent = "myprice-api/0.1.0"
+		}
+		log.Printf("Geocoding vendor addresses with Nominatim")
+		return geo.NewCachingGeocoder(geo.NewNominatimGeocoder(os.Getenv("NOMINATIM_URL"), userAgent))
+	default:
+		log.Printf("Warning: unknown GEOCODER %q, geocoding disabled", os.Getenv("GEOCODER"))
+		return nil
+	}
+}
+
+// enrichLocation resolves the vendor's chain and store number, keeps the
+// printed address and phone number that tell the chain's stores apart, and,
+// when a geocoder is configured, geocodes the address. If the address can't
+// be placed, the photo's GPS position is used instead. It returns nil if
+// nothing could be resolved.
+func (s *Server) enrichLocation(ctx context.Context, docType receipt.DocumentType, output map[string]any, capture *exif.Metadata) *geo.Location {
+	_, _, address := vendorFields(docType, output)
+
+	loc := &geo.Location{Address: strings.TrimSpace(address), Phone: vendorPhone(docType, output)}
+	loc.Chain, loc.StoreNumber = s.resolveChain(docType, output)
+
+	if s.geocoder != nil && address != "" {
+		ctx, cancel := context.WithTimeout(ctx, geocodeTimeout)
+		defer cancel()
+
+		resolved, err := s.geocoder.Geocode(ctx, address)
+		switch {
+		case err == nil:
+			resolved.SetStore(loc)
+			loc = resolved
+		case errors.Is(err, geo.ErrNoMatch):
+			log.Printf("No geocoding match for address: %s", address)
+		default:
+			log.Printf("Warning: geocoding failed: %v", err)
+		}
+	}
+
+	if loc.Lat == 0 && loc.Lon == 0 && capture != nil && capture.GPS != nil {
+		loc = s.locateCapture(ctx, loc, capture.GPS)
+	}
+
+	if *loc == (geo.Location{}) {
+		return nil
+	}
+	return loc
+}
+
+// resolveChain identifies the canonical vendor, from the vendor aliases and
+// then the built-in chains, and the store number, as extracted or else from
+// the printed vendor names.
+func (s *Server) resolveChain(docType receipt.DocumentType, output map[string]any) (chain, storeNumber string) {
+	vendor, vendorFull, _ := vendorFields(docType, output)
+	storeNumber, _ = output["store_number"].(string)
+	storeNumber = strings.TrimSpace(storeNumber)
+	for _, name := range []string{vendor, vendorFull} {
+		if chain == "" {
+			chain = s.vendors.Resolve(name)
+		}
+		if storeNumber == "" {
+			_, storeNumber = receipt.ResolveChain(name)
+		}
+	}
+	return chain, storeNumber
+}
+
+// vendorCategory codes the vendor of a parsed receipt or invoice from its
+// chain, names, OCR lines, and item categories. It returns "" when nothing
+// points to a category.
+func (s *Server) vendorCategory(docType receipt.DocumentType, output map[string]any, loc *geo.Location, lines []string) string {
+	chain := ""
+	if loc != nil {
+		chain = loc.Chain
+	}
+	if c, ok := receipt.CategorizeData(docType, output, chain, lines); ok {
+		return c.Code
+	}
+	return ""
+}
+
+// locateCapture places a receipt where its photo was taken, reverse
+// geocoding the position when the geocoder supports it. Photos are usually
+// taken at the register, but not always, so this is only a fallback.
+func (s *Server) locateCapture(ctx context.Context, loc *geo.Location, gps *exif.GPS) *geo.Location {
+	if reverser, ok := s.geocoder.(geo.ReverseGeocoder); ok {
+		ctx, cancel := context.WithTimeout(ctx, geocodeTimeout)
+		defer cancel()
+
+		resolved, err := reverser.Reverse(ctx, gps.Lat, gps.Lon)
+		switch {
+		case err == nil:
+			resolved.SetStore(loc)
+			loc = resolved
+		case errors.Is(err, geo.ErrNoMatch):
+			log.Printf("No reverse geocoding match for %.5f,%.5f", gps.Lat, gps.Lon)
+		default:
+			log.Printf("Warning: reverse geocoding failed: %v", err)
+		}
+	}
+	loc.Lat, loc.Lon = gps.Lat, gps.Lon
+	loc.Provider = "exif"
+	return loc
+}
+
+// vendorFields pulls the vendor name(s) and address out of a parsed receipt or invoice.
+func vendorFields(docType receipt.DocumentType, output map[string]any) (vendor, vendorFull, address string) {
+	if docType == receipt.DocumentTypeInvoice {
+		party, _ := output["vendor"].(map[string]any)
+		name, _ := party["name"].(string)
+		addr, _ := party["address"].(string)
+		return name, "", addr
+	}
+
+	vendor, _ = output["vendor"].(string)
+	vendorFull, _ = output["vendor_full"].(string)
+	address, _ = output["address"].(string)
+	return vendor, vendorFull, address
+}
+
+// vendorPhone returns the vendor's phone number as extracted, or "".
+func vendorPhone(docType receipt.DocumentType, output map[string]any) string {
+	fields := output
+	if docType == receipt.DocumentTypeInvoice {
+		fields, _ = output["vendor"].(map[string]any)
+	}
+	phone, _ := fields["phone"].(string)
+	return strings.TrimSpace(phone)
+}
+
+// normalizePurchaseTime turns the extracted date and time strings into an
+// RFC3339 timestamp in the vendor's time zone, inferred from the resolved
+// location, the address, or the photo's UTC offset, and falling back to the
+// server default. Without a date on the receipt the photo's capture time is
+// used. It returns nil when there is neither.
+func (s *Server) normalizePurchaseTime(docType receipt.DocumentType, output map[string]any, location *geo.Location, capture *exif.Metadata) *receipt.PurchaseTime {
+	var rawDate, rawTime string
+	if docType == receipt.DocumentTypeInvoice {
+		rawDate, _ = output["invoice_date"].(string)
+	} else {
+		rawDate, _ = output["date"].(string)
+		rawTime, _ = output["time"].(string)
+	}
+	fromPhoto := false
+	if rawDate == "" {
+		if capture == nil || capture.CapturedAt == "" {
+			return nil
+		}
+		rawDate, rawTime, _ = strings.Cut(capture.CapturedAt, "T")
+		fromPhoto = true
+	}
+
+	tz, source := s.defaultTZ, "default"
+	_, _, address := vendorFields(docType, output)
+	if location != nil && (location.Country == "" || location.Country == "us") {
+		if name, ok := receipt.TimeZoneForState(location.State); ok {
+			tz, source = loadZone(name, tz), "location"
+		}
+	}
+	if source == "default" {
+		if name, ok := receipt.TimeZoneForState(receipt.StateFromAddress(address)); ok {
+			tz, source = loadZone(name, tz), "address"
+		}
+	}
+	if source == "default" && capture != nil && capture.Offset != "" {
+		if offset, err := time.Parse("-07:00", capture.Offset); err == nil {
+			_, seconds := offset.Zone()
+			tz, source = time.FixedZone("UTC"+capture.Offset, seconds), "exif"
+		}
+	}
+
+	pt, err := receipt.NormalizePurchaseTime(rawDate, rawTime, tz, source)
+	if err != nil {
+		log.Printf("Could not normalize purchase time: %v", err)
+	}
+	if fromPhoto && pt != nil {
+		pt.RawDate, pt.RawTime = "", ""
+		pt.DateSource = "exif"
+	}
+	return pt
+}
+
+// loadZone loads an IANA zone, returning fallback if it is unknown.
+func loadZone(name string, fallback *time.Location) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Printf("Warning: unknown time zone %q: %v", name, err)
+		return fallback
+	}
+	return loc
+}
+
+// defaultTimeZone returns the zone named by DEFAULT_TIMEZONE, or the host's local zone.
+func defaultTimeZone() *time.Location {
+	name := os.Getenv("DEFAULT_TIMEZONE")
+	if name == "" {
+		return time.Local
+	}
+	return loadZone(name, time.Local)
+}
+
+// annotateItemSizes adds the package size read from each item's name, or
+// from its looked-up product, and the item's price per 100 g or 100 ml, so
+// different package sizes can be compared. Items without a recognizable
+// size are left as they are.
+func annotateItemSizes(docType receipt.DocumentType, output map[string]any) {
+	nameKey, amountKey := "name", "price"
+	if docType == receipt.DocumentTypeInvoice {
+		nameKey, amountKey = "description", "amount"
+	}
+
+	items, _ := output["items"].([]any)
+	for _, raw := range items {
+		item, ok := raw.(map[string]any)
+		if !ok {
+			continue
+		}
+		name, _ := item[nameKey].(string)
+		amount, _ := item[amountKey].(float64)
+		size, ok := units.ParseSize(name)
+		if info, isProduct := item["product"].(map[string]any); !ok && isProduct {
+			listed, _ := info["size"].(string)
+			size, ok = units.ParseSize(listed)
+		}
+		if !ok || amount <= 0 {
+			continue
+		}
+		qty, _ := item["qty"].(float64)
+		item["size"] = size.String()
+		item["normalized_price"], item["normalized_unit"] = units.PricePer100(amount, qty, size)
+	}
+}
+
+// fingerprintParts collects the fields that identify a purchase. The chain
+// name is preferred over the printed vendor so that OCR variations of the
+// same store still match, and an invoice's number stands in for the check
+// number.
+func fingerprintParts(docType receipt.DocumentType, output map[string]any, location *geo.Location, pt *receipt.PurchaseTime, cardLast4, checkNumber string) receipt.FingerprintParts {
+	parts := receipt.FingerprintParts{CardLast4: cardLast4, CheckNumber: checkNumber}
+
+	vendor, vendorFull, _ := vendorFields(docType, output)
+	switch {
+	case location != nil && location.Chain != "":
+		parts.Vendor = location.Chain
+	case vendor != "":
+		parts.Vendor = vendor
+	default:
+		parts.Vendor = vendorFull
+	}
+
+	// A photo's capture time says nothing about which purchase it shows
+	if pt != nil && pt.DateSource == "" {
+		parts.DateTime = pt.LocalDate
+		if !pt.DateOnly && len(pt.Timestamp) >= len("2006-01-02T15:04") {
+			parts.DateTime = pt.Timestamp[:len("2006-01-02T15:04")]
+		}
+	}
+
+	parts.Total, _ = output["total"].(float64)
+	if docType == receipt.DocumentTypeInvoice {
+		if number, _ := output["invoice_number"].(string); number != "" {
+			parts.CheckNumber = number
+		}
+	}
+	return parts
+}
@@ -0,0 +1,121 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"myprice/internal/expense"
+)
+
+// defaultMileageRate is the IRS standard business mileage rate for 2025, in
+// dollars per mile, used when MILEAGE_RATE is unset.
+const defaultMileageRate = 0.70
+
+// ExpenseEntryListResponse lists mileage and per diem entries.
+type ExpenseEntryListResponse struct {
+	Entries []*expense.Entry `json:"entries"`
+	Count   int              `json:"count"`
+}
+
+// handleExpenseEntries lists the caller's mileage and per diem entries
+// (every entry, for reviewers) on GET and records a new one on POST.
+func (s *Server) handleExpenseEntries(w http.ResponseWriter, r *http.Request) {
+	if !s.requireExpenses(w) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		list := make([]*expense.Entry, 0)
+		for _, e := range s.expenses.ListEntries() {
+			if canReadOwned(r, e.Owner) {
+				list = append(list, e)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ExpenseEntryListResponse{Entries: list, Count: len(list)})
+
+	case http.MethodPost:
+		var e expense.Entry
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			jsonError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(e.Description) > maxExpenseTitle {
+			jsonError(w, "description must be at most 200 characters", http.StatusBadRequest)
+			return
+		}
+		if e.Rate == 0 {
+			e.Rate = s.mileageRate
+			if e.Kind == expense.KindPerDiem {
+				e.Rate = s.perDiemRate
+			}
+			if e.Rate == 0 {
+				jsonError(w, "rate is required: no default rate is set for "+string(e.Kind), http.StatusBadRequest)
+				return
+			}
+		}
+		e.Owner = ""
+		if p, ok := PrincipalFrom(r.Context()); ok {
+			e.Owner = p.Name
+		}
+
+		if err := e.Complete(); err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		created, err := s.expenses.CreateEntry(e)
+		if err != nil {
+			jsonError(w, "Failed to save expense entry: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Recorded %s entry %s (%.2f) for %s", created.Kind, created.ID, created.Amount, ownerName(created.Owner))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleExpenseEntry returns a mileage or per diem entry on GET and
+// removes it on DELETE.
+func (s *Server) handleExpenseEntry(w http.ResponseWriter, r *http.Request) {
+	if !s.requireExpenses(w) {
+		return
+	}
+	e, err := s.expenses.GetEntry(r.PathValue("id"))
+	if errors.Is(err, expense.ErrEntryNotFound) || (err == nil && !canReadOwned(r, e.Owner)) {
+		jsonError(w, "Expense entry not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Failed to load expense entry: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e)
+
+	case http.MethodDelete:
+		if !canErase(r, e.Owner) {
+			jsonError(w, "Only the entry's owner or an admin can delete it", http.StatusForbidden)
+			return
+		}
+		if err := s.expenses.DeleteEntry(e.ID); err != nil {
+			jsonError(w, "Failed to delete expense entry: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
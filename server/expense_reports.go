@@ -0,0 +1,400 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"myprice/internal/expense"
+	"myprice/internal/imageprep"
+	"myprice/internal/report"
+	"myprice/internal/store"
+)
+
+const (
+	// maxExpenseReceipts bounds the receipts in one expense report.
+	maxExpenseReceipts = 200
+
+	// maxExpenseTitle bounds expense report titles and purposes.
+	maxExpenseTitle = 200
+
+	// maxSupersededHops bounds how far a receipt is followed through
+	// newer versions of itself.
+	maxSupersededHops = 100
+)
+
+// expenseImageOptions shrink receipt images for the expense report PDF,
+// which may hold a couple of hundred of them.
+var expenseImageOptions = imageprep.Options{
+	MaxDimension: 1600,
+	MaxBytes:     1_000_000,
+	JPEGQuality:  80,
+}
+
+// ExpenseReportRequest creates an expense report.
+type ExpenseReportRequest struct {
+	Title      string   `json:"title"`
+	Purpose    string   `json:"purpose,omitempty"`
+	From       string   `json:"from,omitempty"` // YYYY-MM-DD; default the earliest receipt
+	To         string   `json:"to,omitempty"`   // YYYY-MM-DD; default the latest receipt
+	ReceiptIDs []string `json:"receipt_ids"`
+	EntryIDs   []string `json:"entry_ids,omitempty"` // Mileage and per diem entries
+}
+
+// ExpenseReportListResponse lists expense reports.
+type ExpenseReportListResponse struct {
+	Reports []*expense.Report `json:"reports"`
+	Count   int               `json:"count"`
+}
+
+// handleExpenseReports lists the caller's expense reports (every report,
+// for reviewers) on GET and bundles receipts into a new one on POST.
+func (s *Server) handleExpenseReports(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) || !s.requireExpenses(w) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		list := make([]*expense.Report, 0)
+		for _, rep := range s.expenses.List() {
+			if canReadOwned(r, rep.Owner) {
+				list = append(list, rep)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ExpenseReportListResponse{Reports: list, Count: len(list)})
+
+	case http.MethodPost:
+		s.createExpenseReport(w, r)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createExpenseReport validates the request's receipts and date range and
+// saves the report.
+func (s *Server) createExpenseReport(w http.ResponseWriter, r *http.Request) {
+	var req ExpenseReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	title := strings.TrimSpace(req.Title)
+	if title == "" || len(title) > maxExpenseTitle || len(req.Purpose) > maxExpenseTitle {
+		jsonError(w, "title is required, and title and purpose must be at most 200 characters", http.StatusBadRequest)
+		return
+	}
+	if n := len(req.ReceiptIDs) + len(req.EntryIDs); n == 0 || n > maxExpenseReceipts {
+		jsonError(w, fmt.Sprintf("receipt_ids and entry_ids must list 1 to %d receipts and entries", maxExpenseReceipts), http.StatusBadRequest)
+		return
+	}
+	for _, date := range []string{req.From, req.To} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			jsonError(w, "from and to must be dates like 2025-11-03", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.From != "" && req.To != "" && req.From > req.To {
+		jsonError(w, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+
+	// Each receipt once, as its latest version, and only the caller's own
+	// unless they may read every receipt
+	rep := expense.Report{Title: title, Purpose: strings.TrimSpace(req.Purpose)}
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		rep.Owner = p.Name
+	}
+	var records []*store.Record
+	seen := make(map[string]bool)
+	for _, id := range req.ReceiptIDs {
+		rec, err := s.latestRecord(id)
+		if errors.Is(err, store.ErrNotFound) {
+			jsonError(w, "Receipt not found: "+id, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			jsonError(w, "Failed to load receipt: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !canBundle(r, rec.Owner) {
+			jsonError(w, "Only your own receipts can go in an expense report: "+id, http.StatusForbidden)
+			return
+		}
+		if seen[rec.ID] {
+			continue
+		}
+		seen[rec.ID] = true
+		rep.ReceiptIDs = append(rep.ReceiptIDs, rec.ID)
+		records = append(records, rec)
+	}
+	var entries []*expense.Entry
+	for _, id := range req.EntryIDs {
+		e, err := s.expenses.GetEntry(id)
+		if errors.Is(err, expense.ErrEntryNotFound) {
+			jsonError(w, "Expense entry not found: "+id, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			jsonError(w, "Failed to load expense entry: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !canBundle(r, e.Owner) {
+			jsonError(w, "Only your own entries can go in an expense report: "+id, http.StatusForbidden)
+			return
+		}
+		if seen[e.ID] {
+			continue
+		}
+		seen[e.ID] = true
+		rep.EntryIDs = append(rep.EntryIDs, e.ID)
+		entries = append(entries, e)
+	}
+
+	// Everything must fall within the range asked for, which otherwise
+	// spans what the report holds
+	rep.From, rep.To = req.From, req.To
+	built := report.BuildExpense(rep, records, entries, time.Now())
+	type dated struct{ what, id, first, last string }
+	var items []dated
+	for _, receipt := range built.Receipts {
+		items = append(items, dated{"Receipt", receipt.ID, receipt.Date, receipt.Date})
+	}
+	for _, e := range built.Entries {
+		items = append(items, dated{"Entry", e.ID, e.Date, e.LastDate()})
+	}
+	for _, it := range items {
+		if (req.From != "" && it.first < req.From) || (req.To != "" && it.last > req.To) {
+			jsonError(w, fmt.Sprintf("%s %s dated %s is outside %s to %s", it.what, it.id, it.first, req.From, req.To), http.StatusBadRequest)
+			return
+		}
+		if req.From == "" && (rep.From == "" || it.first < rep.From) {
+			rep.From = it.first
+		}
+		if req.To == "" && it.last > rep.To {
+			rep.To = it.last
+		}
+	}
+
+	created, err := s.expenses.Create(rep)
+	if err != nil {
+		jsonError(w, "Failed to save expense report: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Created expense report %s (%d receipts, %d entries) for %s", created.ID, len(created.ReceiptIDs), len(created.EntryIDs), ownerName(created.Owner))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(report.BuildExpense(*created, records, entries, time.Now()))
+}
+
+// handleExpenseReport returns an expense report with its totals as json, or
+// exports it (?format=pdf, csv, or zip with both). DELETE removes it.
+func (s *Server) handleExpenseReport(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) || !s.requireExpenses(w) {
+		return
+	}
+	rep, err := s.expenses.Get(r.PathValue("id"))
+	if errors.Is(err, expense.ErrNotFound) {
+		jsonError(w, "Expense report not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Failed to load expense report: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !canReadOwned(r, rep.Owner) {
+			jsonError(w, "Expense report not found", http.StatusNotFound)
+			return
+		}
+		s.serveExpenseReport(w, r, rep)
+
+	case http.MethodDelete:
+		if !canErase(r, rep.Owner) {
+			jsonError(w, "Only the report's owner or an admin can delete it", http.StatusForbidden)
+			return
+		}
+		if err := s.expenses.Delete(rep.ID); err != nil {
+			jsonError(w, "Failed to delete expense report: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveExpenseReport writes rep in the format r asks for.
+func (s *Server) serveExpenseReport(w http.ResponseWriter, r *http.Request, rep *expense.Report) {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "json", "pdf", "csv", "zip":
+	default:
+		jsonError(w, "format must be json, pdf, csv, or zip", http.StatusBadRequest)
+		return
+	}
+
+	// Receipts are read fresh, so corrections made since show up
+	records := make([]*store.Record, len(rep.ReceiptIDs))
+	for i, id := range rep.ReceiptIDs {
+		rec, err := s.latestRecord(id)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			jsonError(w, "Failed to load receipt: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		records[i] = rec
+	}
+	entries := make([]*expense.Entry, len(rep.EntryIDs))
+	for i, id := range rep.EntryIDs {
+		e, err := s.expenses.GetEntry(id)
+		if err != nil && !errors.Is(err, expense.ErrEntryNotFound) {
+			jsonError(w, "Failed to load expense entry: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entries[i] = e
+	}
+	e := report.BuildExpense(*rep, records, entries, time.Now())
+
+	if format == "" || format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	// Render fully first, so a failure can still be reported as an error
+	var manifest, pdf bytes.Buffer
+	if format == "csv" || format == "zip" {
+		if err := report.RenderExpenseCSV(&manifest, e); err != nil {
+			jsonError(w, "Failed to render manifest: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if format == "pdf" || format == "zip" {
+		if err := report.RenderExpensePDF(&pdf, e, s.expenseImages(records)); err != nil {
+			jsonError(w, "Failed to render expense report: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	name := "expense-report-" + rep.ID
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, name))
+		w.Write(manifest.Bytes())
+	case "pdf":
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pdf"`, name))
+		w.Write(pdf.Bytes())
+	case "zip":
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for _, f := range []struct {
+			name string
+			data []byte
+		}{{name + ".pdf", pdf.Bytes()}, {name + ".csv", manifest.Bytes()}} {
+			fw, err := zw.Create(f.name)
+			if err == nil {
+				_, err = fw.Write(f.data)
+			}
+			if err != nil {
+				jsonError(w, "Failed to build bundle: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := zw.Close(); err != nil {
+			jsonError(w, "Failed to build bundle: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, name))
+		w.Write(buf.Bytes())
+	}
+}
+
+// expenseImages returns the images of records as JPEGs small enough to
+// embed, by receipt ID. Images that are gone or can't be decoded, such as
+// HEIC photos, are left out and logged.
+func (s *Server) expenseImages(records []*store.Record) map[string][]byte {
+	images := make(map[string][]byte)
+	for _, rec := range records {
+		if rec == nil || rec.ImagePath == "" || isTextSource(rec.ImagePath) {
+			continue
+		}
+		data, err := s.cipher.ReadFile(rec.ImagePath)
+		if err != nil {
+			log.Printf("Expense report: no image for receipt %s: %v", rec.ID, err)
+			continue
+		}
+		jpeg, err := imageprep.ToJPEG(bytes.NewReader(data), expenseImageOptions)
+		if err != nil {
+			log.Printf("Expense report: can't embed image for receipt %s: %v", rec.ID, err)
+			continue
+		}
+		images[rec.ID] = jpeg
+	}
+	return images
+}
+
+// latestRecord returns the newest version of the receipt with the given
+// ID, following the records that superseded it.
+func (s *Server) latestRecord(id string) (*store.Record, error) {
+	rec, err := s.store.Get(id)
+	for hops := 0; err == nil && rec.SupersededBy != "" && hops < maxSupersededHops; hops++ {
+		var next *store.Record
+		if next, err = s.store.Get(rec.SupersededBy); err == nil {
+			rec = next
+		}
+	}
+	if errors.Is(err, store.ErrNotFound) && rec != nil {
+		// A newer version that was since erased leaves this one current
+		return rec, nil
+	}
+	return rec, err
+}
+
+// canReadOwned reports whether the caller may see an expense report or
+// entry created by owner: its owner, reviewers, and anyone when
+// authentication is disabled.
+func canReadOwned(r *http.Request, owner string) bool {
+	p, ok := PrincipalFrom(r.Context())
+	return !ok || p.Role >= RoleReviewer || p.Name == owner
+}
+
+// canBundle reports whether the caller may put a receipt submitted by
+// owner in an expense report: their own, or any for reviewers.
+func canBundle(r *http.Request, owner string) bool {
+	p, ok := PrincipalFrom(r.Context())
+	return !ok || p.Role >= RoleReviewer || (owner != "" && p.Name == owner)
+}
+
+// ownerName names an owner in logs, which may be empty without auth.
+func ownerName(owner string) string {
+	if owner == "" {
+		return "anonymous"
+	}
+	return owner
+}
+
+// requireExpenses reports an error when the expense report store is not
+// available.
+func (s *Server) requireExpenses(w http.ResponseWriter) bool {
+	if s.expenses == nil {
+		jsonError(w, "Expense report store is not available", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
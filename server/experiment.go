@@ -0,0 +1,369 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"myprice/internal/eval"
+	"myprice/internal/receipt"
+	"myprice/tools"
+)
+
+// promptOCRPlaceholder marks where a candidate prompt gets the OCR text.
+const promptOCRPlaceholder = "{{ocr_text}}"
+
+const (
+	// defaultExperimentLimit and maxExperimentLimit bound pair queries.
+	defaultExperimentLimit = 50
+	maxExperimentLimit     = 1000
+)
+
+// llmVariant is a model and prompt the LLM parsers run with.
+type llmVariant struct {
+	Model string
+
+	// Candidate prompt templates by document type, and the version that
+	// names them. Document types without one use the built-in prompt.
+	prompts       map[receipt.DocumentType]string
+	promptVersion string
+}
+
+// defaultVariant is the production model with the built-in prompts.
+var defaultVariant = llmVariant{Model: claudeModel}
+
+// prompt returns the extraction prompt for a document type.
+func (v llmVariant) prompt(docType receipt.DocumentType, textractOutput tools.LoadTextractOutput) string {
+	tmpl, ok := v.prompts[docType]
+	if !ok {
+		return buildPrompt(docType, textractOutput)
+	}
+	ocrText := buildOCRText(textractOutput)
+	if textractOutput.Handwritten {
+		ocrText += handwritingGuidance
+	}
+	return strings.ReplaceAll(tmpl, promptOCRPlaceholder, ocrText)
+}
+
+// versionFor returns the version of the prompt used for a document type.
+func (v llmVariant) versionFor(docType receipt.DocumentType) string {
+	if _, ok := v.prompts[docType]; ok {
+		return v.promptVersion
+	}
+	if docType == receipt.DocumentTypeInvoice {
+		return invoicePromptVersion
+	}
+	return receiptPromptVersion
+}
+
+// experiment routes a share of analyses to a candidate model or prompt as
+// well as the production one, and records both results as a pair.
+type experiment struct {
+	Name      string
+	Percent   float64
+	Candidate llmVariant
+}
+
+// ExperimentInfo describes the running experiment.
+type ExperimentInfo struct {
+	Name           string  `json:"name"`
+	Percent        float64 `json:"percent"`
+	CandidateModel string  `json:"candidate_model"`
+	PromptVersion  string  `json:"prompt_version,omitempty"` // Of the candidate prompts, if any
+}
+
+// llmModels reads LLM_MODELS, the comma-separated models an analyze request
+// may choose. The production model is always allowed.
+func llmModels() []string {
+	models := []string{claudeModel}
+	for _, m := range strings.Split(os.Getenv("LLM_MODELS"), ",") {
+		if m = strings.TrimSpace(m); m != "" && !slices.Contains(models, m) {
+			models = append(models, m)
+		}
+	}
+	return models
+}
+
+// experimentConfig reads EXPERIMENT_PERCENT, EXPERIMENT_MODEL,
+// EXPERIMENT_RECEIPT_PROMPT, EXPERIMENT_INVOICE_PROMPT,
+// EXPERIMENT_PROMPT_VERSION, and EXPERIMENT_NAME. It returns nil when no
+// experiment is running.
+func experimentConfig() (*experiment, error) {
+	raw := os.Getenv("EXPERIMENT_PERCENT")
+	if raw == "" {
+		return nil, nil
+	}
+	percent, err := strconv.ParseFloat(raw, 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("EXPERIMENT_PERCENT must be a number from 0 to 100, got %q", raw)
+	}
+	if percent == 0 {
+		return nil, nil
+	}
+
+	candidate := llmVariant{Model: strings.TrimSpace(os.Getenv("EXPERIMENT_MODEL"))}
+	if candidate.Model == "" {
+		candidate.Model = claudeModel
+	}
+	for docType, env := range map[receipt.DocumentType]string{
+		receipt.DocumentTypeReceipt: "EXPERIMENT_RECEIPT_PROMPT",
+		receipt.DocumentTypeInvoice: "EXPERIMENT_INVOICE_PROMPT",
+	} {
+		path := os.Getenv(env)
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", env, err)
+		}
+		if !strings.Contains(string(data), promptOCRPlaceholder) {
+			return nil, fmt.Errorf("%s: %s has no %s placeholder for the OCR text", env, path, promptOCRPlaceholder)
+		}
+		if candidate.prompts == nil {
+			candidate.prompts = make(map[receipt.DocumentType]string)
+		}
+		candidate.prompts[docType] = string(data)
+	}
+	if candidate.prompts != nil {
+		candidate.promptVersion = strings.TrimSpace(os.Getenv("EXPERIMENT_PROMPT_VERSION"))
+		if candidate.promptVersion == "" {
+			return nil, errors.New("EXPERIMENT_PROMPT_VERSION is required with a candidate prompt")
+		}
+	}
+	if candidate.Model == claudeModel && candidate.prompts == nil {
+		return nil, errors.New("set EXPERIMENT_MODEL or a candidate prompt that differs from production")
+	}
+
+	name := strings.TrimSpace(os.Getenv("EXPERIMENT_NAME"))
+	if name == "" {
+		name = candidate.Model
+		if candidate.promptVersion != "" {
+			name += "/" + candidate.promptVersion
+		}
+	}
+	return &experiment{Name: name, Percent: percent, Candidate: candidate}, nil
+}
+
+// info describes the experiment, or returns nil if there is none.
+func (e *experiment) info() *ExperimentInfo {
+	if e == nil {
+		return nil
+	}
+	return &ExperimentInfo{
+		Name:           e.Name,
+		Percent:        e.Percent,
+		CandidateModel: e.Candidate.Model,
+		PromptVersion:  e.Candidate.promptVersion,
+	}
+}
+
+// variant returns the variant for a requested model: the production one for
+// "", and otherwise the model with the built-in prompts. model must be
+// allowed; see allowedModel.
+func variant(model string) llmVariant {
+	if model == "" {
+		return defaultVariant
+	}
+	return llmVariant{Model: model}
+}
+
+// allowedModel reports whether an analyze request may choose model.
+func (s *Server) allowedModel(model string) bool {
+	return slices.Contains(s.llmModels, model)
+}
+
+// pickCandidate decides whether an analysis joins the experiment, returning
+// the candidate to run alongside production, or nil. Analyses that chose
+// their model, or that have no LLM to run, never join.
+func (s *Server) pickCandidate(model string) *llmVariant {
+	if s.experiment == nil || s.evals == nil || s.claudeAPI == nil || model != "" {
+		return nil
+	}
+	if rand.Float64()*100 >= s.experiment.Percent {
+		return nil
+	}
+	return &s.experiment.Candidate
+}
+
+// runCandidate parses result's image with the candidate, for comparison
+// only: it reads result but doesn't change it. Its model calls are counted
+// on their own meter, not the attempt's, and its answers aren't kept with
+// the attempt's.
+func (s *Server) runCandidate(ctx context.Context, imagePath string, result *analysisResult, v llmVariant) eval.Run {
+	run := eval.Run{Model: v.Model, PromptVersion: v.versionFor(result.DocType)}
+	meter := &tokenMeter{}
+	ctx = context.WithValue(ctx, tokenMeterKey{}, meter)
+	ctx = context.WithValue(ctx, responseRecorderKey{}, (*responseRecorder)(nil))
+
+	release, err := s.acquire(ctx, s.llmLimit, "model")
+	if err != nil {
+		run.Error = err.Error()
+		return run
+	}
+	defer release()
+
+	log.Printf("Parsing %s with candidate %s for experiment %s...", result.DocType, v.Model, s.experiment.Name)
+	start := time.Now()
+	if result.DocType == receipt.DocumentTypeInvoice {
+		var invoice *receipt.Invoice
+		if invoice, err = s.claudeAPI.ParseInvoiceWithLLM(ctx, imagePath, result.Textract, v); err == nil {
+			run.Output = invoice.Map()
+		}
+	} else {
+		var parsed *receipt.Receipt
+		if parsed, err = s.claudeAPI.ParseReceiptWithLLM(ctx, imagePath, result.Textract, v); err == nil {
+			run.Output = parsed.Map()
+		}
+	}
+	run.DurationMS = time.Since(start).Milliseconds()
+	run.Tokens = meter.total()
+	if err != nil {
+		log.Printf("Candidate %s failed: %v", v.Model, err)
+		run.Error = err.Error()
+	}
+	return run
+}
+
+// pairTrial pairs the production parse in result with the candidate's run.
+// Call it before enrichment, so both sides are compared as parsed.
+func (s *Server) pairTrial(result *analysisResult, control, candidate eval.Run) {
+	if result.Parser != parserLLM {
+		// The production LLM call failed and the regex parser stood in
+		control.Error = "LLM parsing failed"
+		for _, st := range result.Stages {
+			if st.Stage == tools.StageParse && st.Error != "" {
+				control.Error = st.Error
+			}
+		}
+	} else {
+		control.Output = copyOutput(result.Output)
+	}
+	pair := &eval.Pair{
+		Experiment:   s.experiment.Name,
+		ImageSHA256:  result.ImageSHA256,
+		DocumentType: string(result.DocType),
+		Control:      control,
+		Candidate:    candidate,
+	}
+	pair.Control.Issues = s.outputIssues(pair.Control.Output, result.DocType)
+	pair.Candidate.Issues = s.outputIssues(pair.Candidate.Output, result.DocType)
+	pair.Compare()
+	result.Trial = pair
+}
+
+// outputIssues returns the validation problems in a parsed output.
+func (s *Server) outputIssues(output map[string]any, docType receipt.DocumentType) []string {
+	if output == nil {
+		return nil
+	}
+	validated, err := s.ValidateOutput(output, string(docType))
+	if err != nil {
+		return []string{err.Error()}
+	}
+	return validated.Issues
+}
+
+// copyOutput deep-copies a parsed output.
+func copyOutput(output map[string]any) map[string]any {
+	data, err := json.Marshal(output)
+	if err != nil {
+		return nil
+	}
+	var c map[string]any
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil
+	}
+	return c
+}
+
+// savePair stores an experiment pair for the stored result receiptID,
+// logging failures rather than failing the analysis.
+func (s *Server) savePair(pair *eval.Pair, receiptID string) {
+	pair.ReceiptID = receiptID
+	if err := s.evals.Put(pair); err != nil {
+		log.Printf("Warning: failed to save experiment pair: %v", err)
+	}
+}
+
+// ExperimentsResponse lists experiment pairs, newest first, with a summary
+// of every pair that matched.
+type ExperimentsResponse struct {
+	Experiment *ExperimentInfo `json:"experiment"` // The running experiment, or null
+	Summary    eval.Summary    `json:"summary"`
+	Pairs      []*eval.Pair    `json:"pairs"`
+	Count      int             `json:"count"`
+	Total      int             `json:"total"` // Matches before the limit
+}
+
+// handleExperiments queries experiment pairs. Filters are experiment,
+// model (either side), document_type, receipt, since and until (RFC 3339
+// or YYYY-MM-DD), and limit, which doesn't apply to the summary.
+func (s *Server) handleExperiments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.evals == nil {
+		jsonError(w, "Experiment results are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	q := eval.Query{
+		Experiment:   query.Get("experiment"),
+		Model:        query.Get("model"),
+		DocumentType: query.Get("document_type"),
+		ReceiptID:    query.Get("receipt"),
+	}
+	limit := defaultExperimentLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			jsonError(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxExperimentLimit)
+	}
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		parsed, err := parseLogTime(v)
+		if err != nil {
+			jsonError(w, name+" must be an RFC 3339 time or YYYY-MM-DD date", http.StatusBadRequest)
+			return
+		}
+		*t = parsed
+	}
+
+	pairs, total, err := s.evals.Find(q)
+	if err != nil {
+		jsonError(w, "Failed to read experiment results: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	summary := eval.Summarize(pairs)
+	if len(pairs) > limit {
+		pairs = pairs[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ExperimentsResponse{
+		Experiment: s.experiment.info(),
+		Summary:    summary,
+		Pairs:      pairs,
+		Count:      len(pairs),
+		Total:      total,
+	})
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"myprice/tools"
+)
+
+// Fake providers stand in for Textract and the Claude API with golden
+// fixtures, so the HTTP and MCP servers run end to end without AWS or
+// Anthropic credentials, for integration tests and local development. Each
+// fixture is a set of files in the fixtures directory sharing a name:
+//
+//	NAME.jpg (or .jpeg, .png, .gif, .webp)  an image to upload, or NAME.pdf
+//	NAME.textract.json                      the Textract output for the image
+//	NAME.txt                                a text document, instead of an image
+//	NAME.llm.json                           the model's answer for the document
+//
+// An image matches its fixture by content, whatever it was uploaded as, and
+// an image without one fails OCR. A prompt gets the answer of the fixture
+// whose OCR lines it contains; one without an answer gets an API error, so
+// the heuristic parser takes over, as it does when the real API fails.
+type fakeProviders struct {
+	dir      string
+	textract map[string]string // Image SHA-256 to its Textract fixture
+	answers  []fakeAnswer
+
+	mu    sync.Mutex
+	files map[string]bool // IDs of the files uploaded to the fake Files API
+}
+
+// fakeAnswer is a fixture's model answer and the OCR lines that pick it.
+type fakeAnswer struct {
+	name  string
+	lines []string
+	text  string
+}
+
+// fakeImageExts are the image (and PDF) extensions fixtures are found by.
+var fakeImageExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".pdf": true}
+
+// fakeProvidersConfig loads the fixtures in FAKE_FIXTURES_DIR, or
+// testdata/fake under projectRoot, when FAKE_PROVIDERS is on. It returns nil
+// when it is off.
+func fakeProvidersConfig(projectRoot string) (*fakeProviders, error) {
+	if os.Getenv("FAKE_PROVIDERS") != "true" && os.Getenv("FAKE_PROVIDERS") != "1" {
+		return nil, nil
+	}
+	dir := os.Getenv("FAKE_FIXTURES_DIR")
+	if dir == "" {
+		dir = filepath.Join(projectRoot, "testdata", "fake")
+	}
+	return loadFakeProviders(dir)
+}
+
+// loadFakeProviders reads the fixtures in dir.
+func loadFakeProviders(dir string) (*fakeProviders, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixtures: %w", err)
+	}
+	f := &fakeProviders{dir: dir, textract: make(map[string]string)}
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := strings.ToLower(filepath.Ext(name))
+		if entry.IsDir() || !fakeImageExts[ext] {
+			continue
+		}
+		textractPath := filepath.Join(dir, strings.TrimSuffix(name, filepath.Ext(name))+".textract.json")
+		if _, err := os.Stat(textractPath); err != nil {
+			return nil, fmt.Errorf("fixture image %s has no Textract output: %w", name, err)
+		}
+		hash, err := fileSHA256(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		f.textract[hash] = textractPath
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".llm.json")
+		if entry.IsDir() || !ok {
+			continue
+		}
+		answer, err := loadFakeAnswer(dir, name)
+		if err != nil {
+			return nil, fmt.Errorf("fixture %s: %w", name, err)
+		}
+		f.answers = append(f.answers, answer)
+	}
+	return f, nil
+}
+
+// loadFakeAnswer reads fixture name's answer and the OCR lines of its
+// Textract output or text document.
+func loadFakeAnswer(dir, name string) (fakeAnswer, error) {
+	text, err := os.ReadFile(filepath.Join(dir, name+".llm.json"))
+	if err != nil {
+		return fakeAnswer{}, err
+	}
+	var doc tools.LoadTextractOutput
+	if data, err := os.ReadFile(filepath.Join(dir, name+".textract.json")); err == nil {
+		if doc, err = tools.ParseTextract(data); err != nil {
+			return fakeAnswer{}, err
+		}
+	} else if data, err := os.ReadFile(filepath.Join(dir, name+".txt")); err == nil {
+		doc = textDocument(string(data))
+	} else {
+		return fakeAnswer{}, fmt.Errorf("no %s.textract.json or %s.txt to match prompts with", name, name)
+	}
+	lines := textractLineTexts(doc)
+	if len(lines) == 0 {
+		return fakeAnswer{}, fmt.Errorf("document has no text to match prompts with")
+	}
+	return fakeAnswer{name: name, lines: lines, text: string(text)}, nil
+}
+
+// runFakeTextract saves the Textract fixture of the image at imagePath to
+// outputPath, as runTextract saves real output.
+func (s *Server) runFakeTextract(imagePath, outputPath string) (string, error) {
+	hash, err := fileSHA256(imagePath)
+	if err != nil {
+		return "", err
+	}
+	fixture, ok := s.fake.textract[hash]
+	if !ok {
+		return "", fmt.Errorf("no fake Textract fixture matches %s", filepath.Base(imagePath))
+	}
+	output, err := os.ReadFile(fixture)
+	if err != nil {
+		return "", err
+	}
+	if err := s.cipher.WriteFile(outputPath, output, 0644); err != nil {
+		return "", fmt.Errorf("failed to save textract output: %w", err)
+	}
+	log.Printf("Fake Textract output from %s", fixture)
+	return outputPath, nil
+}
+
+// claudeAPI returns a Claude API client whose requests the fixtures answer.
+func (f *fakeProviders) claudeAPI() *ClaudeAPI {
+	return &ClaudeAPI{
+		apiKey:         "fake",
+		client:         &http.Client{Transport: f},
+		repairAttempts: max(envInt("LLM_REPAIR_ATTEMPTS", 2), 0),
+	}
+}
+
+// RoundTrip answers Messages API requests from the fixtures, and keeps
+// track of files uploaded to the Files API, which last as long as the
+// process. Message batches aren't faked.
+func (f *fakeProviders) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	if strings.HasPrefix(req.URL.Path, "/v1/files") {
+		return f.filesRoundTrip(req)
+	}
+	if req.Method != http.MethodPost || req.URL.Path != "/v1/messages" {
+		return fakeResponse(req, http.StatusNotImplemented, fakeError("message batches are not supported by fake providers")), nil
+	}
+
+	var body struct {
+		Model    string `json:"model"`
+		Messages []struct {
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("fake Claude API: failed to decode request: %w", err)
+	}
+	if len(body.Messages) == 0 {
+		return fakeResponse(req, http.StatusBadRequest, fakeError("messages: at least one message is required")), nil
+	}
+	prompt := fakeMessageText(body.Messages[0].Content)
+	if id := fakeMessageFileID(body.Messages[0].Content); id != "" {
+		f.mu.Lock()
+		known := f.files[id]
+		f.mu.Unlock()
+		if !known {
+			return fakeResponse(req, http.StatusNotFound, fakeError("file not found: "+id)), nil
+		}
+	}
+
+	answer, ok := f.answer(prompt)
+	if !ok {
+		return fakeResponse(req, http.StatusNotFound, fakeError("no fake answer matches this document")), nil
+	}
+	log.Printf("Fake Claude API answer from %s", answer.name)
+	return fakeResponse(req, http.StatusOK, map[string]any{
+		"model":       body.Model,
+		"stop_reason": "end_turn",
+		"content":     []map[string]string{{"type": "text", "text": answer.text}},
+		// Roughly four characters a token, so token counts are deterministic
+		"usage": map[string]int{"input_tokens": len(prompt) / 4, "output_tokens": len(answer.text) / 4},
+	}), nil
+}
+
+// answer returns the answer of the fixture with the most OCR lines that
+// all appear in prompt.
+func (f *fakeProviders) answer(prompt string) (fakeAnswer, bool) {
+	var best fakeAnswer
+	found := false
+	for _, candidate := range f.answers {
+		if found && len(candidate.lines) <= len(best.lines) {
+			continue
+		}
+		matches := true
+		for _, line := range candidate.lines {
+			if !strings.Contains(prompt, line) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			best, found = candidate, true
+		}
+	}
+	return best, found
+}
+
+// fakeMessageText returns the text of a message's content, either a string
+// or a list of blocks of which the text ones count.
+func fakeMessageText(content json.RawMessage) string {
+	var text string
+	if json.Unmarshal(content, &text) == nil {
+		return text
+	}
+	var blocks []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	json.Unmarshal(content, &blocks)
+	var sb strings.Builder
+	for _, block := range blocks {
+		if block.Type == "text" {
+			sb.WriteString(block.Text)
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+// fakeMessageFileID returns the ID of the uploaded file a message's image
+// refers to, if any.
+func fakeMessageFileID(content json.RawMessage) string {
+	var blocks []struct {
+		Source struct {
+			Type   string `json:"type"`
+			FileID string `json:"file_id"`
+		} `json:"source"`
+	}
+	json.Unmarshal(content, &blocks)
+	for _, block := range blocks {
+		if block.Source.Type == "file" {
+			return block.Source.FileID
+		}
+	}
+	return ""
+}
+
+// filesRoundTrip answers Files API uploads, named by the uploaded file's
+// hash, and deletions.
+func (f *fakeProviders) filesRoundTrip(req *http.Request) (*http.Response, error) {
+	switch {
+	case req.Method == http.MethodPost && req.URL.Path == "/v1/files":
+		file, header, err := req.FormFile("file")
+		if err != nil {
+			return fakeResponse(req, http.StatusBadRequest, fakeError("file: "+err.Error())), nil
+		}
+		defer file.Close()
+		h := sha256.New()
+		size, err := io.Copy(h, file)
+		if err != nil {
+			return nil, fmt.Errorf("fake Files API: failed to read upload: %w", err)
+		}
+		id := "file_fake" + hex.EncodeToString(h.Sum(nil))[:24]
+		f.mu.Lock()
+		if f.files == nil {
+			f.files = make(map[string]bool)
+		}
+		f.files[id] = true
+		f.mu.Unlock()
+		log.Printf("Fake Files API upload %s", id)
+		return fakeResponse(req, http.StatusOK, map[string]any{"id": id, "type": "file", "mime_type": header.Header.Get("Content-Type"), "size_bytes": size}), nil
+	case req.Method == http.MethodDelete:
+		id := strings.TrimPrefix(req.URL.Path, "/v1/files/")
+		f.mu.Lock()
+		known := f.files[id]
+		delete(f.files, id)
+		f.mu.Unlock()
+		if !known {
+			return fakeResponse(req, http.StatusNotFound, fakeError("file not found: "+id)), nil
+		}
+		log.Printf("Fake Files API deleted %s", id)
+		return fakeResponse(req, http.StatusOK, map[string]string{"id": id, "type": "file_deleted"}), nil
+	}
+	return fakeResponse(req, http.StatusNotImplemented, fakeError("not supported by fake providers")), nil
+}
+
+// fakeError is an API error body.
+func fakeError(message string) map[string]any {
+	return map[string]any{
+		"type":  "error",
+		"error": map[string]string{"type": "fake_provider_error", "message": message},
+	}
+}
+
+// fakeResponse is a JSON response to req.
+func fakeResponse(req *http.Request, status int, v any) *http.Response {
+	data, _ := json.Marshal(v)
+	return &http.Response{
+		StatusCode:    status,
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}
+}
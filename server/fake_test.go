@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newFakeServer starts the HTTP API with fake providers answering from
+// testdata/fake, keeping everything it writes in a temp dir.
+func newFakeServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	fixtures, err := filepath.Abs(filepath.Join("..", "testdata", "fake"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FAKE_PROVIDERS", "true")
+	t.Setenv("FAKE_FIXTURES_DIR", fixtures)
+	uploadDir := filepath.Join(t.TempDir(), "uploads")
+	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	NewServer(uploadDir).RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// uploadFixture uploads a fixture image and returns its path on the server.
+func uploadFixture(t *testing.T, ts *httptest.Server, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("..", "testdata", "fake", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("image", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	resp, err := http.Post(ts.URL+"/api/upload", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var upload UploadResponse
+	decodeResponse(t, resp, http.StatusOK, &upload)
+	return upload.FilePath
+}
+
+// analyzeFixture runs an image or text document through /api/analyze.
+func analyzeFixture(t *testing.T, ts *httptest.Server, imagePath string) AnalyzeResponse {
+	t.Helper()
+	req, _ := json.Marshal(AnalyzeRequest{ImagePath: imagePath})
+	resp, err := http.Post(ts.URL+"/api/analyze", "application/json", bytes.NewReader(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result AnalyzeResponse
+	decodeResponse(t, resp, http.StatusOK, &result)
+	return result
+}
+
+func decodeResponse(t *testing.T, resp *http.Response, status int, v any) {
+	t.Helper()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != status {
+		t.Fatalf("%s: status = %d, want %d: %s", resp.Request.URL.Path, resp.StatusCode, status, body)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		t.Fatalf("%s: %v: %s", resp.Request.URL.Path, err, body)
+	}
+}
+
+func TestFakeAnalyzeReceipt(t *testing.T) {
+	ts := newFakeServer(t)
+	result := analyzeFixture(t, ts, uploadFixture(t, ts, "veggie-grocery.jpeg"))
+
+	if result.ReceiptID == "" {
+		t.Error("receipt_id is empty; the result wasn't stored")
+	}
+	if result.DocumentType != "receipt" {
+		t.Errorf("document_type = %q, want receipt", result.DocumentType)
+	}
+	if result.Source == "" || len(result.Textract.Lines) == 0 {
+		t.Errorf("source = %q with %d OCR lines, want the Textract fixture", result.Source, len(result.Textract.Lines))
+	}
+	if result.Model == "" {
+		t.Error("model is empty; the fake Claude API didn't answer")
+	}
+	out := result.LLMOutput
+	if out["vendor"] != "Produce Market" {
+		t.Errorf("vendor = %v, want Produce Market", out["vendor"])
+	}
+	if out["date"] != "2016-06-01" {
+		t.Errorf("date = %v, want 2016-06-01", out["date"])
+	}
+	if out["total"] != 24.20 {
+		t.Errorf("total = %v, want 24.20", out["total"])
+	}
+	if items, _ := out["items"].([]any); len(items) != 13 {
+		t.Errorf("got %d items, want 13", len(items))
+	}
+}
+
+func TestFakeAnalyzeInvoiceText(t *testing.T) {
+	ts := newFakeServer(t)
+	path, err := filepath.Abs(filepath.Join("..", "testdata", "fake", "office-supplies.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := analyzeFixture(t, ts, path)
+
+	if result.ReceiptID == "" {
+		t.Error("receipt_id is empty; the result wasn't stored")
+	}
+	if result.DocumentType != "invoice" {
+		t.Errorf("document_type = %q, want invoice", result.DocumentType)
+	}
+	if result.Source != "text" {
+		t.Errorf("source = %q, want text", result.Source)
+	}
+	if result.Model == "" {
+		t.Error("model is empty; the fake Claude API didn't answer")
+	}
+	out := result.LLMOutput
+	if vendor, _ := out["vendor"].(map[string]any); vendor["name"] != "Harbor Office Supply Co." {
+		t.Errorf("vendor = %v, want Harbor Office Supply Co.", out["vendor"])
+	}
+	if buyer, _ := out["buyer"].(map[string]any); buyer["name"] != "Casco Bay Design LLC" {
+		t.Errorf("buyer = %v, want Casco Bay Design LLC", out["buyer"])
+	}
+	if out["invoice_number"] != "INV-20417" {
+		t.Errorf("invoice_number = %v, want INV-20417", out["invoice_number"])
+	}
+	if out["total"] != 216.26 {
+		t.Errorf("total = %v, want 216.26", out["total"])
+	}
+	if items, _ := out["items"].([]any); len(items) != 2 {
+		t.Errorf("got %d items, want 2", len(items))
+	}
+}
@@ -0,0 +1,203 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"myprice/internal/imageprep"
+)
+
+const (
+	// urlFetchTimeout bounds an image download, including redirects.
+	urlFetchTimeout = 30 * time.Second
+
+	// maxFetchRedirects is how many redirects an image download follows.
+	maxFetchRedirects = 5
+)
+
+var (
+	// errInvalidImageURL is returned for URLs that can't be fetched at all.
+	errInvalidImageURL = errors.New("invalid image URL")
+
+	// errBlockedAddress is returned when a URL resolves to an address on
+	// the server's own network, so callers can't use it to probe internal
+	// services.
+	errBlockedAddress = errors.New("image URL resolves to a non-public address")
+
+	// errNotImage is returned when a download or inline image isn't in a
+	// format the pipeline reads.
+	errNotImage = errors.New("not a supported image")
+)
+
+// blockedPrefixes are ranges, beyond those netip.Addr classifies, that
+// are not reachable on the public internet.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "This network"
+	netip.MustParsePrefix("100.64.0.0/10"),   // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // Documentation
+	netip.MustParsePrefix("198.18.0.0/15"),   // Benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // Documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // Documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // Reserved, including broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, which can reach private IPv4
+	netip.MustParsePrefix("2001:db8::/32"),   // Documentation
+}
+
+// publicAddress reports whether ip is routable on the public internet.
+func publicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, p := range blockedPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newFetchClient returns the client for requests to URLs callers choose,
+// such as images to download and upload callbacks. The
+// address is checked after DNS resolution, on every connection including
+// redirects, so a hostname can't be pointed at an internal address after it
+// was checked. Proxies are ignored for the same reason.
+func newFetchClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !publicAddress(addrPort.Addr()) {
+				return errBlockedAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: urlFetchTimeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 15 * time.Second,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxFetchRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxFetchRedirects)
+			}
+			return checkImageURL(req.URL)
+		},
+	}
+}
+
+// checkImageURL rejects URLs other than plain http and https ones.
+func checkImageURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: only http and https URLs are supported", errInvalidImageURL)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("%w: no host", errInvalidImageURL)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: credentials in URLs are not supported", errInvalidImageURL)
+	}
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil && !publicAddress(ip) {
+		return errBlockedAddress
+	}
+	return nil
+}
+
+// downloadImage saves the image at rawURL to the upload directory, charged
+// to owner's quota, and returns its path. The download must be an image no
+// larger than MAX_UPLOAD_BYTES.
+func (s *Server) downloadImage(ctx context.Context, rawURL, owner string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidImageURL, err)
+	}
+	if err := checkImageURL(u); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidImageURL, err)
+	}
+	req.Header.Set("Accept", "image/*")
+	resp, err := s.fetchClient.Do(req)
+	if err != nil {
+		if errors.Is(err, errBlockedAddress) {
+			return "", errBlockedAddress
+		}
+		if errors.Is(err, errInvalidImageURL) {
+			return "", fmt.Errorf("redirect rejected: %w", err)
+		}
+		return "", fmt.Errorf("download failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download failed: %s", resp.Status)
+	}
+	if resp.ContentLength > s.maxUploadBytes {
+		return "", errTooLarge
+	}
+	// Storage links often serve images as octet-stream; the content decides
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil &&
+		!strings.HasPrefix(mediaType, "image/") && mediaType != "application/octet-stream" && mediaType != "binary/octet-stream" {
+		return "", fmt.Errorf("URL is %w: served as %s", errNotImage, mediaType)
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&limitedWriter{w: &buf, n: s.maxUploadBytes}, resp.Body); err != nil {
+		if errors.Is(err, errTooLarge) {
+			return "", errTooLarge
+		}
+		return "", fmt.Errorf("download failed: %w", err)
+	}
+	format := imageprep.Sniff(buf.Bytes())
+	if format == "" {
+		return "", fmt.Errorf("URL is %w", errNotImage)
+	}
+
+	// Prefix names with the URL's identity, since many URLs end in the same name
+	id := sha256.Sum256([]byte(u.String()))
+	name := path.Base(resp.Request.URL.Path)
+	if name == "." || name == "/" {
+		name = "image"
+	}
+	if filepath.Ext(name) == "" {
+		name += "." + format
+	}
+	destPath := filepath.Join(s.uploadDir, fmt.Sprintf("url-%s-%s", hex.EncodeToString(id[:4]), uploadFileName(name)))
+
+	if err := s.storeImage(owner, destPath, buf.Bytes()); err != nil {
+		return "", err
+	}
+	// Query strings of storage links often hold access tokens
+	log.Printf("Downloaded %s://%s%s to %s", u.Scheme, u.Host, u.Path, destPath)
+	return destPath, nil
+}
@@ -0,0 +1,101 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"myprice/internal/store"
+)
+
+// hookTimeout bounds the context each hook runs with.
+const hookTimeout = 30 * time.Second
+
+// Hook is custom post-processing, such as company-specific GL coding, run
+// on every parsed receipt or invoice before it is stored: new analyses,
+// reanalyses, and corrections alike. Register hooks with RegisterHook.
+type Hook interface {
+	// Name identifies the hook in logs and in a result's hook_errors.
+	Name() string
+	// Process may read and change doc. When it returns an error, or
+	// panics, its changes are discarded, the error is recorded with the
+	// result, and the result is stored anyway.
+	Process(ctx context.Context, doc *HookDocument) error
+}
+
+// HookDocument is a parsed document about to be stored, as hooks see it.
+type HookDocument struct {
+	Owner        string         // API key name of the uploader; "" without API keys
+	DocumentType string         // "receipt" or "invoice"
+	ImagePath    string         // The image or plain text file it was read from
+	Data         map[string]any // The parsed result, as in llm_output; hooks may change it
+}
+
+// hooks are the registered hooks, run in the order they were registered.
+type hooks struct {
+	mu   sync.RWMutex
+	list []Hook
+}
+
+// RegisterHook adds a hook run on each result before it is stored, after
+// those registered before it. Register hooks at startup, before the server
+// handles requests.
+func (s *Server) RegisterHook(h Hook) error {
+	s.hooks.mu.Lock()
+	defer s.hooks.mu.Unlock()
+	if h.Name() == "" {
+		return fmt.Errorf("hook has no name")
+	}
+	for _, other := range s.hooks.list {
+		if other.Name() == h.Name() {
+			return fmt.Errorf("hook %q is already registered", h.Name())
+		}
+	}
+	s.hooks.list = append(s.hooks.list, h)
+	return nil
+}
+
+// runHooks runs the registered hooks on rec's data in turn, keeping each
+// one's changes when it succeeds, and records the failures in
+// rec.HookErrors.
+func (s *Server) runHooks(rec *store.Record) {
+	s.hooks.mu.RLock()
+	list := s.hooks.list
+	s.hooks.mu.RUnlock()
+
+	rec.HookErrors = nil
+	for _, h := range list {
+		doc := &HookDocument{
+			Owner:        rec.Owner,
+			DocumentType: rec.DocumentType,
+			ImagePath:    rec.ImagePath,
+			Data:         copyOutput(rec.Data),
+		}
+		err := runHook(h, doc)
+		if err == nil && doc.Data == nil {
+			err = fmt.Errorf("hook removed the data")
+		}
+		if err != nil {
+			log.Printf("Warning: hook %s failed on %s: %v", h.Name(), rec.ImagePath, err)
+			rec.HookErrors = append(rec.HookErrors, store.HookError{Hook: h.Name(), Error: err.Error()})
+			continue
+		}
+		rec.Data = doc.Data
+	}
+}
+
+// runHook runs one hook, turning a panic into an error so a faulty hook
+// can't take the server down.
+func runHook(h Hook, doc *HookDocument) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return h.Process(ctx, doc)
+}
@@ -2,26 +2,217 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
+	"myprice/internal/accesslog"
+	"myprice/internal/analysislog"
+	"myprice/internal/archive"
+	"myprice/internal/budget"
+	"myprice/internal/crypt"
+	"myprice/internal/embed"
+	"myprice/internal/eval"
+	"myprice/internal/exif"
+	"myprice/internal/expense"
+	"myprice/internal/flight"
+	"myprice/internal/fsutil"
+	"myprice/internal/geo"
+	"myprice/internal/imageprep"
+	"myprice/internal/ingest"
+	"myprice/internal/integrations"
+	"myprice/internal/limit"
+	"myprice/internal/memo"
+	"myprice/internal/pathtmpl"
+	"myprice/internal/product"
+	"myprice/internal/quota"
+	"myprice/internal/rawresponse"
+	"myprice/internal/receipt"
+	"myprice/internal/redact"
+	"myprice/internal/report"
+	"myprice/internal/retention"
+	"myprice/internal/review"
+	"myprice/internal/signed"
+	"myprice/internal/sink"
+	"myprice/internal/store"
+	"myprice/internal/textindex"
+	"myprice/internal/vendors"
+	shared "myprice/internal/workspace"
 	"myprice/tools"
 )
 
 // Server holds the HTTP server configuration.
 type Server struct {
-	uploadDir   string
-	textractDir string
-	projectRoot string
-	claudeAPI   *ClaudeAPI
+	uploadDir    string
+	textractDir  string
+	preparedDir  string
+	projectRoot  string
+	imageOpts    imageprep.Options
+	claudeAPI    *ClaudeAPI
+	janitor      *retention.Janitor
+	store        store.Store
+	textIndex    *textindex.Index
+	embedder     embed.Embedder
+	embeddings   *embed.Index // Nil unless EMBEDDINGS is set
+	workspaces   *shared.FileStore
+	vendors      *vendors.Registry
+	geocoder     geo.Geocoder
+	products     product.Database
+	integrations *integrations.Store
+	quotas       *quota.Ledger
+	quotaLimits  quota.Limits
+	defaultTZ    *time.Location
+	apiKeys      []apiKey
+	cipher       *crypt.Cipher
+	deletionLog  string
+	analysisLog  *analysislog.Log
+	accessLog    *accesslog.Logger
+	rawResponses *rawresponse.Store // Nil unless LLM_RAW_RESPONSES is on
+
+	// Copies of saved results named from their data, when OUTPUT_DIR is set
+	outputDir      string
+	outputTemplate *pathtmpl.Template
+	outputPolicy   pathtmpl.Policy
+	outputMu       sync.Mutex // Serializes collision checks with writes
+
+	// Models an analyze request may choose, and the running A/B experiment
+	// with the store of its paired results
+	llmModels  []string
+	experiment *experiment
+	evals      *eval.Store
+
+	// Largest image accepted from any upload path
+	maxUploadBytes int64
+
+	// Message batch jobs for bulk reprocessing
+	batchDir          string
+	batchPollInterval time.Duration
+	batchCtx          context.Context
+
+	// Bulk correction runs, kept so they can be undone
+	correctionDir string
+	correctionMu  sync.Mutex
+
+	// Uploads queued by /api/upload-and-analyze; nil until started
+	analysisQueue *analysisQueue
+
+	// Receipts bundled into expense reports
+	expenses *expense.FileStore
+
+	// Users' monthly budgets and the alerts sent for them
+	budgets *budget.FileStore
+
+	// Original files from cloud folders and pasted text, kept as received
+	originals *archive.Archive
+
+	// Default rates for mileage (per mile) and per diem (per day) entries;
+	// 0 means entries must give their own
+	mileageRate float64
+	perDiemRate float64
+
+	// Spending reports saved on a schedule
+	reportsDir     string
+	reportSchedule string // "monthly", "quarterly", or "" when off
+
+	// Reports, spending patterns, and forecasts, kept until receipts change
+	reportCache   *memo.Cache[*report.Report]
+	patternsCache *memo.Cache[*report.Patterns]
+	forecastCache *memo.Cache[*report.Forecast]
+
+	// Checks run on each parsed receipt, and the earlier prices the price
+	// outlier and price history checks compare with
+	detectors        []receipt.Detector
+	historyCache     *memo.Cache[priceHistory]
+	itemHistoryCache *memo.Cache[itemHistory]
+
+	// Stages analyses run through, and hooks run on results before they
+	// are stored
+	pipeline *pipeline
+	hooks    hooks
+
+	// Mean OCR confidence below which analyses advise retaking the photo
+	hintConfidence float64
+
+	// Quality score below which receipts are queued for review, and at or
+	// above which analytics asked for trusted data count them
+	qualityThreshold int
+
+	// Claims on and resolutions of the receipts in the review queue
+	reviews *review.Store
+
+	// Dropbox and Google Drive folders polled for new receipt images
+	ingestSources      []ingestSource
+	ingestState        *ingest.StateStore
+	ingestPollInterval time.Duration
+	ingestExisting     bool // Also analyze images already in a folder on the first poll
+
+	// Re-runs of old low-confidence receipts while idle; nil unless
+	// REVALIDATE_INTERVAL is set
+	revalidation *revalidation
+
+	// Other destinations each stored result is sent to; nil unless SINKS
+	// is set
+	sinks *sink.Dispatcher
+
+	// Prices for the average cost per receipt in /api/stats
+	statsPrices statsPrices
+
+	// Signed URLs for uploads from clients without an API key
+	uploadSigner    *signed.Signer
+	signedUploadTTL time.Duration
+	signedUploads   signedUploads
+	publicBaseURL   string // PUBLIC_URL, or "" to use the request's host
+
+	// Expiring links to redacted, read-only views of receipts
+	shareSigner *signed.Signer
+	shareTTL    time.Duration
+
+	fetchClient *http.Client // Downloads images for image_url and sends upload callbacks, refusing non-public addresses
+
+	// Concurrent analyses of the same image share one Textract call and one
+	// downscale instead of racing on the same output paths.
+	textractFlight flight.Group[string]
+	prepareFlight  flight.Group[string]
+
+	// Concurrent exports of the same receipt to the same app share one push
+	exportFlight flight.Group[integrations.Export]
+
+	// Run AnalyzeDocument with TABLES instead of DetectDocumentText, so
+	// itemized receipts parse from their tables
+	textractTables bool
+
+	// Run Textract as async jobs on documents staged in S3, nil for
+	// synchronous calls
+	textractAsync *asyncTextract
+
+	// Golden fixtures answering in place of Textract and the Claude API,
+	// nil unless FAKE_PROVIDERS is on
+	fake *fakeProviders
+
+	// Bound concurrent provider calls across every entry point
+	textractLimit *limit.Limiter
+	llmLimit      *limit.Limiter
+
+	// Serializes deletions so concurrent erasures see a consistent store
+	deleteMu sync.Mutex
+
+	// Serializes vendor merges and their rewrites of stored receipts
+	vendorMu sync.Mutex
 }
 
 // NewServer creates a new HTTP API server.
@@ -34,32 +225,479 @@ func NewServer(uploadDir string) *Server {
 	// Determine project root (parent of uploads)
 	projectRoot := filepath.Dir(uploadDir)
 
+	// Secrets are scrubbed from everything logged from here on, and from
+	// error responses
+	redact.RegisterEnv(secretEnvVars...)
+	log.SetOutput(redact.Writer(log.Writer()))
+
+	// Access log, set up first so privacy mode covers everything logged after
+	accessLog := accessLogConfig(projectRoot)
+
 	// Textract cache directory
 	textractDir := filepath.Join(projectRoot, "textract_cache")
 	if err := os.MkdirAll(textractDir, 0755); err != nil {
 		log.Printf("Warning: could not create textract cache dir: %v", err)
 	}
 
-	// Initialize Claude API (optional - will log warning if not configured)
-	claudeAPI, err := NewClaudeAPI()
+	// Downscaled copies of large images sent to Textract and Claude
+	preparedDir := filepath.Join(projectRoot, "prepared_images")
+
+	imageOpts := imageprep.DefaultOptions()
+	imageOpts.MaxDimension = envInt("IMAGE_MAX_DIMENSION", imageOpts.MaxDimension)
+	imageOpts.MaxBytes = envInt64("IMAGE_MAX_BYTES", imageOpts.MaxBytes)
+	imageOpts.JPEGQuality = envInt("IMAGE_JPEG_QUALITY", imageOpts.JPEGQuality)
+
+	// Raw model answers, kept for debugging when LLM_RAW_RESPONSES is on
+	rawResponsesDir, rawResponsesPolicy := rawResponsesConfig(projectRoot)
+
+	// Retention policies for everything the server writes to disk
+	retentionDirs := []retention.Dir{
+		{Name: "uploads", Path: uploadDir, Policy: retentionPolicy("UPLOADS")},
+		{Name: "textract_cache", Path: textractDir, Policy: retentionPolicy("TEXTRACT_CACHE")},
+		{Name: "prepared_images", Path: preparedDir, Policy: retentionPolicy("PREPARED_IMAGES")},
+	}
+	if rawResponsesDir != "" {
+		retentionDirs = append(retentionDirs, retention.Dir{Name: "llm_responses", Path: rawResponsesDir, Policy: rawResponsesPolicy})
+	}
+	janitor := retention.NewJanitor(retentionDirs, envDuration("RETENTION_INTERVAL", time.Hour))
+
+	// Optional at-rest encryption. A bad key must not silently store plaintext.
+	cipher, err := crypt.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid encryption key: %v", err)
+	}
+	if cipher.Enabled() {
+		log.Printf("At-rest encryption enabled")
+	}
+
+	// Receipt store for analysis results, in RECEIPTS_DIR or Postgres
+	receiptsDir := os.Getenv("RECEIPTS_DIR")
+	if receiptsDir == "" {
+		receiptsDir = filepath.Join(projectRoot, "receipts")
+	}
+	var receiptStore store.Store
+	if opened, err := store.Open(receiptsDir, cipher); err != nil {
+		log.Printf("Warning: could not open receipt store: %v. Results will not be saved.", err)
+	} else {
+		receiptStore = opened
+	}
+
+	// Full-text index of every receipt's OCR lines
+	ocrIndexFile := os.Getenv("OCR_INDEX_FILE")
+	if ocrIndexFile == "" {
+		ocrIndexFile = filepath.Join(projectRoot, "ocr_index.json")
+	}
+	textIndex, err := textindex.Open(ocrIndexFile, cipher)
+	if err != nil {
+		log.Printf("Warning: could not open OCR text index: %v. Text search is disabled.", err)
+	}
+
+	// Optional embeddings of every receipt, for semantic search
+	embedder := newEmbedder()
+	var embeddings *embed.Index
+	if embedder != nil {
+		embeddingsFile := os.Getenv("EMBEDDINGS_INDEX_FILE")
+		if embeddingsFile == "" {
+			embeddingsFile = filepath.Join(projectRoot, "embeddings.json")
+		}
+		if embeddings, err = embed.Open(embeddingsFile, embedder.Model(), cipher); err != nil {
+			log.Printf("Warning: could not open embedding index: %v. Semantic search is disabled.", err)
+		}
+	}
+
+	// Shared workspaces (households, small teams)
+	workspacesDir := os.Getenv("WORKSPACES_DIR")
+	if workspacesDir == "" {
+		workspacesDir = filepath.Join(projectRoot, "workspaces")
+	}
+	workspaces, err := shared.NewFileStore(workspacesDir, cipher)
+	if err != nil {
+		log.Printf("Warning: could not open workspace store: %v. Workspaces are disabled.", err)
+	}
+
+	// Expense reports bundling receipts for reimbursement
+	expenseReportsDir := os.Getenv("EXPENSE_REPORTS_DIR")
+	if expenseReportsDir == "" {
+		expenseReportsDir = filepath.Join(projectRoot, "expense_reports")
+	}
+	expenses, err := expense.NewFileStore(expenseReportsDir, cipher)
+	if err != nil {
+		log.Printf("Warning: could not open expense report store: %v. Expense reports are disabled.", err)
+	}
+
+	// Monthly budgets by category or vendor
+	budgetsDir := os.Getenv("BUDGETS_DIR")
+	if budgetsDir == "" {
+		budgetsDir = filepath.Join(projectRoot, "budgets")
+	}
+	budgets, err := budget.NewFileStore(budgetsDir, cipher)
+	if err != nil {
+		log.Printf("Warning: could not open budget store: %v. Budgets are disabled.", err)
+	}
+
+	// Originals of ingested receipts, kept apart from the upload dir so
+	// retention doesn't remove them
+	archiveDir := os.Getenv("ARCHIVE_DIR")
+	if archiveDir == "" {
+		archiveDir = filepath.Join(projectRoot, "archive")
+	}
+	originals, err := archive.New(archiveDir, cipher)
+	if err != nil {
+		log.Printf("Warning: could not open archive: %v. Originals will not be archived.", err)
+	}
+
+	// Vendor aliases merging spelling variants into canonical vendors
+	vendorAliases := os.Getenv("VENDOR_ALIASES")
+	if vendorAliases == "" {
+		vendorAliases = filepath.Join(projectRoot, "vendor_aliases.json")
+	}
+	vendorRegistry, err := vendors.Open(vendorAliases, cipher)
+	if err != nil {
+		log.Fatalf("Invalid vendor aliases: %v", err)
+	}
+
+	// Per-user Splitwise and YNAB settings, including access tokens
+	integrationsFile := os.Getenv("INTEGRATIONS_FILE")
+	if integrationsFile == "" {
+		integrationsFile = filepath.Join(projectRoot, "integrations.json")
+	}
+	integrationStore, err := integrations.Open(integrationsFile, cipher)
+	if err != nil {
+		log.Printf("Warning: could not open integrations: %v. Integrations are disabled.", err)
+	}
+
+	// Upload size limit and per-user storage quotas
+	maxUploadBytes := envInt64("MAX_UPLOAD_BYTES", defaultMaxUploadBytes)
+	if maxUploadBytes <= 0 {
+		maxUploadBytes = defaultMaxUploadBytes
+	}
+	limits, err := quotaLimits()
+	if err != nil {
+		log.Fatalf("Invalid USER_QUOTAS: %v", err)
+	}
+	quotaFile := os.Getenv("QUOTA_FILE")
+	if quotaFile == "" {
+		quotaFile = filepath.Join(projectRoot, "quota.json")
+	}
+	quotaLedger, err := quota.Open(quotaFile, uploadDir, cipher)
+	if err != nil {
+		log.Printf("Warning: could not open quota ledger: %v. Quotas are disabled.", err)
+	}
+
+	// Audit log of erased receipts
+	deletionLog := os.Getenv("DELETION_LOG")
+	if deletionLog == "" {
+		deletionLog = filepath.Join(projectRoot, "deletions.jsonl")
+	}
+
+	// Audit log of every analysis attempt
+	analysisLogFile := os.Getenv("ANALYSIS_LOG")
+	if analysisLogFile == "" {
+		analysisLogFile = filepath.Join(projectRoot, "analyses.jsonl")
+	}
+
+	// Copies of saved results, organized by OUTPUT_TEMPLATE
+	outputDir, outputTemplate, outputPolicy, err := outputConfig()
+	if err != nil {
+		log.Fatalf("Invalid output settings: %v", err)
+	}
+
+	// Model choices and the A/B experiment, if any
+	experiment, err := experimentConfig()
+	if err != nil {
+		log.Fatalf("Invalid experiment settings: %v", err)
+	}
+	evalDir := os.Getenv("EVAL_DIR")
+	if evalDir == "" {
+		evalDir = filepath.Join(projectRoot, "evals")
+	}
+	evals, err := eval.Open(evalDir, cipher)
+	if err != nil {
+		log.Printf("Warning: could not open eval store: %v. Experiments are disabled.", err)
+	}
+	if experiment != nil && evals != nil {
+		log.Printf("Experiment %s: %g%% of analyses also run %s", experiment.Name, experiment.Percent, experiment.Candidate.Model)
+	}
+
+	// Polling for bulk reprocessing batches
+	batchPollInterval := envDuration("BATCH_POLL_INTERVAL", time.Minute)
+	if batchPollInterval <= 0 {
+		batchPollInterval = time.Minute
+	}
+
+	// Scheduled spending reports
+	// Analytics are cached until a receipt changes, and for at most the TTL
+	// since vendor categories and the clock also go into them
+	analyticsCacheTTL := envDuration("ANALYTICS_CACHE_TTL", 10*time.Minute)
+	analyticsCacheEntries := envInt("ANALYTICS_CACHE_ENTRIES", 256)
+
+	reportsDir := os.Getenv("REPORTS_DIR")
+	if reportsDir == "" {
+		reportsDir = filepath.Join(projectRoot, "reports")
+	}
+
+	// Cloud folder ingestion progress, so restarts don't reprocess images
+	ingestStateFile := os.Getenv("INGEST_STATE")
+	if ingestStateFile == "" {
+		ingestStateFile = filepath.Join(projectRoot, "ingest_state.json")
+	}
+	ingestState, err := ingest.OpenState(ingestStateFile, cipher)
+	if err != nil {
+		log.Printf("Warning: could not open ingest state: %v. Cloud folder ingestion is disabled.", err)
+	}
+	ingestPollInterval := envDuration("INGEST_POLL_INTERVAL", 5*time.Minute)
+	if ingestPollInterval <= 0 {
+		ingestPollInterval = 5 * time.Minute
+	}
+
+	// Background revalidation of low-confidence receipts
+	revalidation, err := revalidationConfig(projectRoot, llmModels(), cipher)
+	if err != nil {
+		log.Fatalf("Invalid revalidation settings: %v", err)
+	}
+
+	// Signed upload URLs for mobile apps
+	uploadSigner, err := newUploadSigner()
 	if err != nil {
+		log.Fatalf("Invalid UPLOAD_SIGNING_KEY: %v", err)
+	}
+	if os.Getenv("UPLOAD_SIGNING_KEY") == "" {
+		log.Printf("UPLOAD_SIGNING_KEY not set; signed upload URLs stop working when the server restarts")
+	}
+	// Destinations each stored result is also sent to
+	sinks, err := sinkConfig(projectRoot, cipher, uploadSigner)
+	if err != nil {
+		log.Fatalf("Invalid sink settings: %v", err)
+	}
+
+	signedUploadTTL := envDuration("SIGNED_UPLOAD_TTL", 15*time.Minute)
+	if signedUploadTTL <= 0 || signedUploadTTL > maxSignedUploadTTL {
+		signedUploadTTL = 15 * time.Minute
+	}
+
+	// Share links to redacted receipts
+	shareSigner, err := newShareSigner()
+	if err != nil {
+		log.Fatalf("Invalid SHARE_SIGNING_KEY: %v", err)
+	}
+	if os.Getenv("SHARE_SIGNING_KEY") == "" {
+		log.Printf("SHARE_SIGNING_KEY not set; share links stop working when the server restarts")
+	}
+	shareTTL := envDuration("SHARE_TTL", defaultShareTTL)
+	if shareTTL <= 0 || shareTTL > maxShareTTL {
+		shareTTL = defaultShareTTL
+	}
+
+	// Optional geocoder for vendor addresses
+	geocoder := newGeocoder()
+
+	// Optional product database for item codes
+	products := newProductDatabase(cipher)
+
+	// Fixtures in place of Textract and the Claude API, when FAKE_PROVIDERS is on
+	fake, err := fakeProvidersConfig(projectRoot)
+	if err != nil {
+		log.Fatalf("Invalid fake providers: %v", err)
+	}
+
+	// Initialize Claude API (optional - will log warning if not configured)
+	var claudeAPI *ClaudeAPI
+	if fake != nil {
+		log.Printf("Using fake Textract and Claude API with the fixtures in %s", fake.dir)
+		claudeAPI = fake.claudeAPI()
+	} else if claudeAPI, err = NewClaudeAPI(); err != nil {
 		log.Printf("Warning: Claude API not configured: %v. LLM parsing will fail.", err)
 		log.Printf("Set ANTHROPIC_API_KEY environment variable to enable LLM parsing.")
 	}
+	if claudeAPI != nil {
+		// Images uploaded once and referred to after, when LLM_FILES_API is on
+		if claudeAPI.files = llmFilesConfig(projectRoot, cipher); claudeAPI.files != nil {
+			go claudeAPI.deleteFiles(claudeAPI.files.TakeExpired())
+		}
+	}
+
+	// API keys and roles. A malformed list must not leave the server open.
+	apiKeys, err := loadAPIKeys()
+	if err != nil {
+		log.Fatalf("Invalid API_KEYS: %v", err)
+	}
+	if len(apiKeys) == 0 {
+		log.Printf("Warning: API_KEYS not set; all endpoints are open.")
+	} else {
+		log.Printf("Loaded %d API keys", len(apiKeys))
+	}
 
 	return &Server{
-		uploadDir:   uploadDir,
-		textractDir: textractDir,
-		projectRoot: projectRoot,
-		claudeAPI:   claudeAPI,
+		uploadDir:    uploadDir,
+		textractDir:  textractDir,
+		preparedDir:  preparedDir,
+		projectRoot:  projectRoot,
+		imageOpts:    imageOpts,
+		claudeAPI:    claudeAPI,
+		fake:         fake,
+		janitor:      janitor,
+		store:        receiptStore,
+		textIndex:    textIndex,
+		embedder:     embedder,
+		embeddings:   embeddings,
+		workspaces:   workspaces,
+		vendors:      vendorRegistry,
+		integrations: integrationStore,
+		quotas:       quotaLedger,
+		quotaLimits:  limits,
+		geocoder:     geocoder,
+		products:     products,
+		defaultTZ:    defaultTimeZone(),
+		apiKeys:      apiKeys,
+		cipher:       cipher,
+		deletionLog:  deletionLog,
+		analysisLog:  analysislog.New(analysisLogFile),
+		accessLog:    accessLog,
+		rawResponses: openRawResponses(rawResponsesDir, cipher),
+
+		outputDir:      outputDir,
+		outputTemplate: outputTemplate,
+		outputPolicy:   outputPolicy,
+
+		llmModels:  llmModels(),
+		experiment: experiment,
+		evals:      evals,
+
+		maxUploadBytes: maxUploadBytes,
+
+		batchDir:           filepath.Join(projectRoot, "batches"),
+		correctionDir:      filepath.Join(projectRoot, "corrections"),
+		batchPollInterval:  batchPollInterval,
+		expenses:           expenses,
+		budgets:            budgets,
+		originals:          originals,
+		mileageRate:        envFloat("MILEAGE_RATE", defaultMileageRate),
+		perDiemRate:        envFloat("PER_DIEM_RATE", 0),
+		reportsDir:         reportsDir,
+		reportSchedule:     reportSchedule(),
+		reportCache:        memo.New[*report.Report](analyticsCacheTTL, analyticsCacheEntries),
+		patternsCache:      memo.New[*report.Patterns](analyticsCacheTTL, analyticsCacheEntries),
+		forecastCache:      memo.New[*report.Forecast](analyticsCacheTTL, analyticsCacheEntries),
+		detectors:          anomalyDetectors(),
+		historyCache:       memo.New[priceHistory](analyticsCacheTTL, 1),
+		itemHistoryCache:   memo.New[itemHistory](analyticsCacheTTL, analyticsCacheEntries),
+		hintConfidence:     envFloat("CAPTURE_HINT_CONFIDENCE", defaultCaptureHintConfidence),
+		qualityThreshold:   qualityThreshold(),
+		reviews:            reviewConfig(projectRoot, cipher),
+		pipeline:           newPipeline(),
+		ingestSources:      newIngestSources(),
+		ingestState:        ingestState,
+		ingestPollInterval: ingestPollInterval,
+		ingestExisting:     os.Getenv("INGEST_EXISTING") == "true" || os.Getenv("INGEST_EXISTING") == "1",
+		revalidation:       revalidation,
+		sinks:              sinks,
+		statsPrices:        statsPricesFromEnv(),
+		uploadSigner:       uploadSigner,
+		signedUploadTTL:    signedUploadTTL,
+		publicBaseURL:      strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/"),
+		shareSigner:        shareSigner,
+		shareTTL:           shareTTL,
+		fetchClient:        newFetchClient(),
+		textractTables:     os.Getenv("TEXTRACT_TABLES") == "true" || os.Getenv("TEXTRACT_TABLES") == "1",
+		textractAsync:      newAsyncTextract(),
+		textractLimit:      limit.New("textract", envInt("MAX_PARALLEL_TEXTRACT", defaultMaxParallel)),
+		llmLimit:           limit.New("llm", envInt("MAX_PARALLEL_LLM", defaultMaxParallel)),
 	}
 }
 
-// RegisterRoutes registers all API endpoints.
+// RegisterRoutes registers all API endpoints with their access policies.
 func (s *Server) RegisterRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/api/health", s.handleHealth)
-	mux.HandleFunc("/api/upload", s.handleUpload)
-	mux.HandleFunc("/api/analyze", s.handleAnalyze)
+	mux.HandleFunc("/api/schema/{type}", s.require(RoleNone, s.handleSchema))
+	mux.HandleFunc("/api/upload", s.require(RoleUploader, s.handleUpload))
+	mux.HandleFunc("/api/analyze", s.require(RoleUploader, s.handleAnalyze))
+	mux.HandleFunc("/api/upload-and-analyze", s.require(RoleUploader, s.handleUploadAndAnalyze))
+	mux.HandleFunc("GET /api/jobs/{id}", s.require(RoleUploader, s.handleJob))
+	mux.HandleFunc("/api/analyze-text", s.require(RoleUploader, s.handleAnalyzeText))
+	mux.HandleFunc("/api/analyze-pdf", s.require(RoleUploader, s.handleAnalyzePDF))
+	mux.HandleFunc("/api/quota", s.require(RoleUploader, s.handleQuota))
+	mux.HandleFunc("/api/usage", s.require(RoleUploader, s.handleUsage))
+	mux.HandleFunc("POST /api/uploads/signed", s.require(RoleUploader, s.handleSignedUploads))
+	mux.HandleFunc("/api/uploads/signed/{token}", s.require(RoleNone, s.handleSignedUpload))
+	mux.HandleFunc("/api/receipts", s.require(RoleReviewer, s.handleReceipts))
+	mux.HandleFunc("GET /api/receipts/search", s.require(RoleReviewer, s.handleSearch))
+	mux.HandleFunc("GET /api/receipts/search/semantic", s.require(RoleReviewer, s.handleSemanticSearch))
+	mux.HandleFunc("POST /api/ask", s.require(RoleReviewer, s.handleAsk))
+	mux.HandleFunc("GET /api/receipts/compare", s.require(RoleReviewer, s.handleCompareReceipts))
+	mux.HandleFunc("/api/review-queue", s.require(RoleReviewer, s.handleReviewQueue))
+	mux.HandleFunc("/api/review-queue/stats", s.require(RoleReviewer, s.handleReviewStats))
+	mux.HandleFunc("/api/review-queue/{id}/claim", s.require(RoleReviewer, s.handleReviewClaim))
+	mux.HandleFunc("/api/review-queue/{id}/resolve", s.require(RoleReviewer, s.handleReviewResolve))
+	mux.HandleFunc("/api/receipts/{id}", s.require(RoleReviewer, s.handleReceipt))
+	mux.HandleFunc("DELETE /api/receipts/{id}", s.require(RoleUploader, s.handleDeleteReceipt))
+	mux.HandleFunc("PUT /api/receipts/{id}/data", s.require(RoleUploader, s.handleCorrectReceipt))
+	mux.HandleFunc("/api/receipts/{id}/original", s.require(RoleReviewer, s.handleReceiptOriginal))
+	mux.HandleFunc("/api/receipts/{id}/ocr", s.require(RoleReviewer, s.handleReceiptOCR))
+	mux.HandleFunc("/api/receipts/{id}/reocr", s.require(RoleUploader, s.handleReOCRRegion))
+	mux.HandleFunc("/api/receipts/{id}/versions", s.require(RoleReviewer, s.handleReceiptVersions))
+	mux.HandleFunc("/api/receipts/{id}/diff", s.require(RoleReviewer, s.handleReceiptDiff))
+	mux.HandleFunc("/api/receipts/{id}/tags", s.require(RoleUploader, s.handleReceiptTags))
+	mux.HandleFunc("DELETE /api/receipts/{id}/tags/{tag}", s.require(RoleUploader, s.handleDeleteReceiptTag))
+	mux.HandleFunc("/api/receipts/{id}/notes", s.require(RoleUploader, s.handleReceiptNotes))
+	mux.HandleFunc("GET /api/tags", s.require(RoleReviewer, s.handleTags))
+	mux.HandleFunc("POST /api/receipts/{id}/share", s.require(RoleReviewer, s.handleShareReceipt))
+	mux.HandleFunc("/api/shared/{token}", s.require(RoleNone, s.handleShared))
+	mux.HandleFunc("POST /api/webhooks/textract", s.require(RoleNone, s.handleTextractWebhook))
+	mux.HandleFunc("DELETE /api/users/{name}/receipts", s.require(RoleUploader, s.handlePurgeUser))
+	mux.HandleFunc("/api/audit/duplicates", s.require(RoleReviewer, s.handleAuditDuplicates))
+	mux.HandleFunc("/api/reports", s.require(RoleReviewer, s.handleReports))
+	mux.HandleFunc("/api/reports/patterns", s.require(RoleReviewer, s.handleReportPatterns))
+	mux.HandleFunc("GET /api/analytics/forecast", s.require(RoleReviewer, s.handleForecast))
+	mux.HandleFunc("/api/reports/files", s.require(RoleReviewer, s.handleReportFiles))
+	mux.HandleFunc("/api/reports/files/{name}", s.require(RoleReviewer, s.handleReportFile))
+	mux.HandleFunc("/api/expense-reports", s.require(RoleUploader, s.handleExpenseReports))
+	mux.HandleFunc("/api/expense-reports/{id}", s.require(RoleUploader, s.handleExpenseReport))
+	mux.HandleFunc("/api/expense-entries", s.require(RoleUploader, s.handleExpenseEntries))
+	mux.HandleFunc("/api/expense-entries/{id}", s.require(RoleUploader, s.handleExpenseEntry))
+	mux.HandleFunc("/api/budgets", s.require(RoleUploader, s.handleBudgets))
+	mux.HandleFunc("/api/budgets/{id}", s.require(RoleUploader, s.handleBudget))
+	mux.HandleFunc("/api/workspaces", s.require(RoleUploader, s.handleWorkspaces))
+	mux.HandleFunc("/api/workspaces/{id}", s.require(RoleUploader, s.handleWorkspace))
+	mux.HandleFunc("/api/workspaces/{id}/invitations", s.require(RoleUploader, s.handleWorkspaceInvite))
+	mux.HandleFunc("DELETE /api/workspaces/{id}/members/{name}", s.require(RoleUploader, s.handleWorkspaceMember))
+	mux.HandleFunc("/api/workspaces/{id}/analytics", s.require(RoleUploader, s.handleWorkspaceAnalytics))
+	mux.HandleFunc("/api/invitations", s.require(RoleUploader, s.handleInvitations))
+	mux.HandleFunc("/api/invitations/{id}/accept", s.require(RoleUploader, s.handleAcceptInvitation))
+	mux.HandleFunc("/api/invitations/{id}/decline", s.require(RoleUploader, s.handleDeclineInvitation))
+	mux.HandleFunc("/api/vendors", s.require(RoleReviewer, s.handleVendors))
+	mux.HandleFunc("GET /api/vendors/variants", s.require(RoleReviewer, s.handleVendorVariants))
+	mux.HandleFunc("POST /api/vendors/merge", s.require(RoleReviewer, s.handleVendorMerge))
+	mux.HandleFunc("DELETE /api/vendors/{name}", s.require(RoleReviewer, s.handleDeleteVendor))
+	mux.HandleFunc("DELETE /api/vendors/{name}/aliases/{alias}", s.require(RoleReviewer, s.handleDeleteVendorAlias))
+	mux.HandleFunc("POST /api/receipts/{id}/export/{provider}", s.require(RoleUploader, s.handleExportReceipt))
+	mux.HandleFunc("/api/integrations", s.require(RoleUploader, s.handleIntegrations))
+	mux.HandleFunc("/api/integrations/{provider}", s.require(RoleUploader, s.handleIntegration))
+	mux.HandleFunc("/api/export", s.require(RoleAdmin, s.handleExport))
+	mux.HandleFunc("/api/import", s.require(RoleAdmin, s.handleImport))
+	mux.HandleFunc("/api/admin/cleanup", s.require(RoleAdmin, s.handleAdminCleanup))
+	mux.HandleFunc("/api/admin/reprocess", s.require(RoleAdmin, s.handleAdminReprocess))
+	mux.HandleFunc("/api/admin/batches", s.require(RoleAdmin, s.handleAdminBatches))
+	mux.HandleFunc("/api/admin/batches/{id}", s.require(RoleAdmin, s.handleAdminBatch))
+	mux.HandleFunc("/api/admin/corrections", s.require(RoleAdmin, s.handleAdminCorrections))
+	mux.HandleFunc("/api/admin/corrections/{id}", s.require(RoleAdmin, s.handleAdminCorrection))
+	mux.HandleFunc("POST /api/admin/corrections/{id}/undo", s.require(RoleAdmin, s.handleAdminCorrectionUndo))
+	mux.HandleFunc("/api/admin/workers", s.require(RoleAdmin, s.handleAdminWorkers))
+	mux.HandleFunc("/api/admin/ingest", s.require(RoleAdmin, s.handleAdminIngest))
+	mux.HandleFunc("/api/admin/revalidation", s.require(RoleAdmin, s.handleAdminRevalidation))
+	mux.HandleFunc("/api/admin/sinks", s.require(RoleAdmin, s.handleAdminSinks))
+	mux.HandleFunc("POST /api/admin/sinks/{name}/retry", s.require(RoleAdmin, s.handleAdminSinkRetry))
+	mux.HandleFunc("/api/admin/quotas", s.require(RoleAdmin, s.handleAdminQuotas))
+	mux.HandleFunc("/api/admin/usage", s.require(RoleAdmin, s.handleAdminUsage))
+	mux.HandleFunc("/api/admin/analyses", s.require(RoleAdmin, s.handleAnalysisLog))
+	mux.HandleFunc("/api/admin/analyses/{id}/responses", s.require(RoleAdmin, s.handleRawResponses))
+	mux.HandleFunc("/api/admin/analyses/{id}/reextract", s.require(RoleAdmin, s.handleReextract))
+	mux.HandleFunc("/api/stats", s.require(RoleAdmin, s.handleStats))
+	mux.HandleFunc("/api/admin/experiments", s.require(RoleAdmin, s.handleExperiments))
+}
+
+// StartJanitor runs the retention janitor in the background until ctx is cancelled.
+func (s *Server) StartJanitor(ctx context.Context) {
+	go s.janitor.Run(ctx)
 }
 
 // handleHealth returns server health status.
@@ -88,149 +726,510 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse multipart form (max 10MB)
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		jsonError(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+	resp, ok := s.receiveUpload(w, r)
+	if !ok {
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// receiveUpload saves the image in a multipart upload's image field to the
+// upload directory, charged to the caller's quota. It writes the error
+// response and reports false when the upload is rejected.
+func (s *Server) receiveUpload(w http.ResponseWriter, r *http.Request) (UploadResponse, bool) {
+	// Bound the whole request, with room for the form's own overhead, not
+	// just the part of it held in memory
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadBytes+1<<20)
+	if err := r.ParseMultipartForm(s.maxUploadBytes); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.uploadTooLarge(w)
+			return UploadResponse{}, false
+		}
+		jsonError(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return UploadResponse{}, false
+	}
 
 	file, header, err := r.FormFile("image")
 	if err != nil {
 		jsonError(w, "No image file provided: "+err.Error(), http.StatusBadRequest)
-		return
+		return UploadResponse{}, false
 	}
 	defer file.Close()
+	if header.Size > s.maxUploadBytes {
+		s.uploadTooLarge(w)
+		return UploadResponse{}, false
+	}
 
-	// Create destination file
-	destPath := filepath.Join(s.uploadDir, header.Filename)
-	dest, err := os.Create(destPath)
-	if err != nil {
-		jsonError(w, "Failed to create file: "+err.Error(), http.StatusInternalServerError)
-		return
+	// Check the content, not the name, is an image format the pipeline reads
+	sniff := make([]byte, 12)
+	n, _ := io.ReadFull(file, sniff)
+	format := imageprep.Sniff(sniff[:n])
+	if format == "" {
+		jsonError(w, "Unsupported image format: upload JPEG, PNG, GIF, WebP, HEIC, TIFF, or BMP", http.StatusUnsupportedMediaType)
+		return UploadResponse{}, false
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		jsonError(w, "Failed to read file: "+err.Error(), http.StatusInternalServerError)
+		return UploadResponse{}, false
 	}
-	defer dest.Close()
 
-	// Copy file contents
-	size, err := io.Copy(dest, file)
+	noteFile(r.Context(), header.Filename)
+	var owner string
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		owner = p.Name
+	}
+	destPath := filepath.Join(s.uploadDir, ownerUploadName(owner, header.Filename))
+	if err := s.reserveUpload(owner, destPath, header.Size); err != nil {
+		var exceeded *quota.ExceededError
+		if errors.As(err, &exceeded) {
+			quotaError(w, exceeded)
+			return UploadResponse{}, false
+		}
+	}
+	size, err := s.saveUpload(destPath, file)
 	if err != nil {
+		s.releaseUpload(owner, destPath)
 		jsonError(w, "Failed to save file: "+err.Error(), http.StatusInternalServerError)
-		return
+		return UploadResponse{}, false
 	}
 
 	// Determine MIME type
 	mimeType := header.Header.Get("Content-Type")
-	if mimeType == "" {
-		mimeType = "application/octet-stream"
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = "image/" + format
 	}
 
 	log.Printf("Uploaded image: %s (%d bytes)", destPath, size)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(UploadResponse{
+	return UploadResponse{
 		Success:  true,
 		FilePath: destPath,
 		FileName: header.Filename,
 		Size:     size,
 		MimeType: mimeType,
-	})
+	}, true
+}
+
+// ownerUploadName is the name an upload called name is stored under. With
+// API keys it is prefixed with the owner's identity, so users uploading
+// files of the same name never replace each other's, while a user's own
+// upload of the same name still replaces theirs.
+func ownerUploadName(owner, name string) string {
+	if owner == "" {
+		return name
+	}
+	id := sha256.Sum256([]byte(owner))
+	return fmt.Sprintf("%s-%s", hex.EncodeToString(id[:4]), name)
+}
+
+// saveUpload writes an uploaded image to destPath and returns its size.
+// The file is written to a temp file and renamed into place so concurrent
+// uploads and analyses never see a partially written image.
+func (s *Server) saveUpload(destPath string, src io.Reader) (int64, error) {
+	if s.cipher.Enabled() {
+		// The multipart form already bounds the size held in memory
+		data, err := io.ReadAll(src)
+		if err != nil {
+			return 0, err
+		}
+		return int64(len(data)), s.cipher.WriteFile(destPath, data, 0644)
+	}
+
+	dest, err := fsutil.Create(destPath)
+	if err != nil {
+		return 0, err
+	}
+	defer dest.Abort()
+
+	size, err := io.Copy(dest, src)
+	if err != nil {
+		return 0, err
+	}
+	return size, dest.Commit(0644)
+}
+
+// storeImage saves an image held in memory to destPath, charged to
+// owner's quota.
+func (s *Server) storeImage(owner, destPath string, data []byte) error {
+	if err := s.reserveUpload(owner, destPath, int64(len(data))); err != nil {
+		return err
+	}
+	if _, err := s.saveUpload(destPath, bytes.NewReader(data)); err != nil {
+		s.releaseUpload(owner, destPath)
+		return fmt.Errorf("%w: %v", errStoreImage, err)
+	}
+	return nil
 }
 
 // AnalyzeRequest is the request body for the analyze endpoint.
 type AnalyzeRequest struct {
-	ImagePath string `json:"image_path"`
+	ImagePath    string `json:"image_path,omitempty"`
+	ImageURL     string `json:"image_url,omitempty"`     // Downloaded to the upload directory in place of image_path
+	ImageBase64  string `json:"image_base64,omitempty"`  // Image data, or a data: URL, saved in place of image_path
+	MimeType     string `json:"mime_type,omitempty"`     // Type of image_base64, e.g. "image/jpeg"; checked against the content
+	DocumentType string `json:"document_type,omitempty"` // "auto" (default), "receipt", or "invoice"
+	Model        string `json:"model,omitempty"`         // One of LLM_MODELS; defaults to the production model
 }
 
 // AnalyzeResponse contains both textract and parsed output.
 type AnalyzeResponse struct {
-	Textract  tools.LoadTextractOutput `json:"textract"`
-	LLMOutput map[string]any           `json:"llm_output"`
-	Source    string                   `json:"source"` // Where the textract came from
+	ImagePath    string                   `json:"image_path"`
+	Textract     tools.LoadTextractOutput `json:"textract"`
+	LLMOutput    map[string]any           `json:"llm_output"`
+	Source       string                   `json:"source"`          // Where the textract came from
+	DocumentType string                   `json:"document_type"`   // "receipt" or "invoice"
+	Model        string                   `json:"model,omitempty"` // LLM model that parsed the result
+	Location     *geo.Location            `json:"location,omitempty"`
+	PurchaseTime *receipt.PurchaseTime    `json:"purchase_time,omitempty"`
+	Capture      *exif.Metadata           `json:"capture,omitempty"`
+	Anomalies    []receipt.Anomaly        `json:"anomalies,omitempty"`     // Found by the anomaly detectors
+	Quality      *receipt.Quality         `json:"quality,omitempty"`       // How far the result can be trusted
+	CaptureHints []receipt.CaptureHint    `json:"capture_hints,omitempty"` // How to retake a photo read poorly
+	HookErrors   []store.HookError        `json:"hook_errors,omitempty"`   // Hooks whose changes were discarded
+	ReceiptID    string                   `json:"receipt_id,omitempty"`
+	Partial      bool                     `json:"partial,omitempty"` // Some stage failed; see Stages
+	Stages       []tools.StageResult      `json:"stages"`
+	Usage        *tools.Usage             `json:"usage,omitempty"` // Tokens and estimated cost of this analysis
+}
+
+// NotReceiptResponse answers an analysis of an upload that clearly isn't a
+// receipt or invoice. Nothing is stored for it.
+type NotReceiptResponse struct {
+	Error       bool   `json:"error"`
+	Code        string `json:"code"` // Always "not_a_receipt"
+	Message     string `json:"message"`
+	ContentType string `json:"content_type"` // "photo", "chat_screenshot", or "other_text"
+	Reason      string `json:"reason"`
+	ImagePath   string `json:"image_path"`
+}
+
+// analysisFailed answers an analysis that produced no result: 422 with a
+// NotReceiptResponse for an upload that isn't a receipt, 500 otherwise.
+func analysisFailed(w http.ResponseWriter, imagePath string, err error) {
+	var notReceipt *notReceiptError
+	if !errors.As(err, &notReceipt) {
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(NotReceiptResponse{
+		Error:       true,
+		Code:        "not_a_receipt",
+		Message:     "This doesn't look like a receipt or invoice. Upload a photo or scan of one, with its prices legible.",
+		ContentType: notReceipt.Type,
+		Reason:      notReceipt.Reason,
+		ImagePath:   imagePath,
+	})
 }
 
-// handleAnalyze runs the full analysis pipeline.
+// handleAnalyze runs the full analysis pipeline. A result that some stage
+// failed on the way to, such as one parsed without OCR text or by the regex
+// parser after the LLM failed, is answered with 207 Multi-Status.
 func (s *Server) handleAnalyze(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	// Leave room for an inline image, which base64 grows by a third
+	r.Body = http.MaxBytesReader(w, r.Body, int64(base64.StdEncoding.EncodedLen(int(s.maxUploadBytes)))+1<<20)
 	var req AnalyzeRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.uploadTooLarge(w)
+			return
+		}
 		jsonError(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	if !s.checkModel(w, req.Model) {
+		return
+	}
+
+	var owner string
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		owner = p.Name
+	}
 
-	// Find the actual image path
-	imagePath := req.ImagePath
+	var imagePath string
+	switch sources := countNonEmpty(req.ImagePath, req.ImageURL, req.ImageBase64); {
+	case sources > 1:
+		jsonError(w, "Give only one of image_path, image_url, and image_base64", http.StatusBadRequest)
+		return
+	case req.ImageURL != "":
+		downloaded, err := s.downloadImage(r.Context(), req.ImageURL, owner)
+		if err != nil {
+			s.imageInputError(w, err)
+			return
+		}
+		imagePath = downloaded
+	case req.ImageBase64 != "":
+		stored, err := s.storeInlineImage(req.ImageBase64, req.MimeType, owner)
+		if err != nil {
+			s.imageInputError(w, err)
+			return
+		}
+		imagePath = stored
+	case req.ImagePath != "":
+		noteFile(r.Context(), req.ImagePath)
+		imagePath = s.resolveImagePath(req.ImagePath)
+	default:
+		jsonError(w, "image_path, image_url, or image_base64 is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, attempt := s.startAttempt(r.Context(), viaAPI, owner, imagePath)
+	result, err := s.analyze(ctx, imagePath, receipt.ParseDocumentType(req.DocumentType), req.Model)
+	if r.Context().Err() != nil {
+		// Nobody is waiting for the response, so don't store a result either
+		log.Printf("Analysis of %s cancelled: client disconnected", imagePath)
+		attempt.finish(nil, "", r.Context().Err())
+		return
+	}
+	if err != nil {
+		attempt.finish(nil, "", err)
+		analysisFailed(w, imagePath, err)
+		return
+	}
+
+	rec := result.record(imagePath)
+	rec.Owner = owner
+	receiptID := s.saveResult(rec)
+	attempt.finish(result, receiptID, nil)
+	if receiptID != "" {
+		s.autoExport(rec)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if result.partial() {
+		w.WriteHeader(http.StatusMultiStatus)
+	}
+	json.NewEncoder(w).Encode(AnalyzeResponse{
+		ImagePath:    imagePath,
+		Textract:     result.Textract,
+		LLMOutput:    result.Output,
+		Source:       result.Source,
+		DocumentType: string(result.DocType),
+		Model:        result.Model,
+		Location:     result.Location,
+		PurchaseTime: result.PurchaseTime,
+		Capture:      result.Capture,
+		Anomalies:    rec.Anomalies,
+		Quality:      rec.Quality,
+		CaptureHints: result.CaptureHints,
+		HookErrors:   rec.HookErrors,
+		ReceiptID:    receiptID,
+		Partial:      result.partial(),
+		Stages:       result.Stages,
+		Usage:        attempt.usage(result),
+	})
+}
+
+// checkModel reports whether a model asked for by a request may be used,
+// writing a 400 response when it may not. An empty model is the default.
+func (s *Server) checkModel(w http.ResponseWriter, model string) bool {
+	if model == "" {
+		return true
+	}
+	if s.claudeAPI == nil {
+		jsonError(w, "model was given but the Claude API is not configured", http.StatusBadRequest)
+		return false
+	}
+	if !s.allowedModel(model) {
+		jsonError(w, fmt.Sprintf("model %q is not allowed; choose one of %s", model, strings.Join(s.llmModels, ", ")), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// resolveImagePath finds the actual image for a path from a request:
+// relative paths name an upload if one exists.
+func (s *Server) resolveImagePath(imagePath string) string {
 	if !filepath.IsAbs(imagePath) {
 		// Check if it's in uploads folder
 		uploadPath := filepath.Join(s.uploadDir, filepath.Base(imagePath))
 		if _, err := os.Stat(uploadPath); err == nil {
-			imagePath = uploadPath
+			return uploadPath
 		}
 	}
+	return imagePath
+}
 
-	log.Printf("Analyzing image: %s", imagePath)
+// saveResult persists an analysis result and returns its record ID, or ""
+// if the store is unavailable or the write fails. A result for an image that
+// was analyzed before is stored as the next version of the latest result
+// for that image (or of rec.PreviousID, if set), which is marked superseded.
+func (s *Server) saveResult(rec *store.Record) string {
+	if s.store != nil && rec.ImageSHA256 == "" {
+		if hash, err := fileSHA256(rec.ImagePath); err == nil {
+			rec.ImageSHA256 = hash
+		}
+	}
+	s.runHooks(rec)
+	// Checked here rather than with the rest of enrichment, since the
+	// price history check needs the owner and the image hash
+	rec.Anomalies = s.detectAnomalies(rec)
+	rec.Quality = scoreQuality(rec)
+	if s.store == nil {
+		return ""
+	}
 
-	// Find or generate Textract output
-	textractPath, source, err := s.findOrRunTextract(imagePath)
-	if err != nil {
-		jsonError(w, "Textract failed: "+err.Error(), http.StatusInternalServerError)
-		return
+	prev := s.previousVersion(rec)
+	if prev != nil && prev.SupersededBy != "" {
+		// A correction or another analysis replaced it while this one ran
+		log.Printf("Warning: not saving analysis result: %s was superseded by %s meanwhile", prev.ID, prev.SupersededBy)
+		return ""
+	}
+	inherit := rec.Tags == nil && rec.Notes == ""
+	if prev != nil {
+		rec.Version = max(prev.Version, 1) + 1
+		rec.PreviousID = prev.ID
+		// Reanalysis doesn't touch what users added
+		if inherit {
+			rec.Tags, rec.Notes = prev.Tags, prev.Notes
+		}
+		if rec.Original == nil && prev.ImageSHA256 == rec.ImageSHA256 {
+			// Reanalyzing the same file keeps its archived original
+			rec.Original = prev.Original
+		}
+		if rec.Split == nil && prev.ImageSHA256 == rec.ImageSHA256 {
+			rec.Split = prev.Split
+		}
 	}
 
-	log.Printf("Using Textract file: %s (source: %s)", textractPath, source)
+	// The output is named after the record, so it needs its ID up front
+	if rec.ID == "" {
+		rec.ID = store.NewID()
+	}
+	rec.RefundOf = s.refundedPurchase(rec)
+	replaced := ""
+	if prev != nil {
+		replaced = prev.OutputPath
+	}
+	if err := s.writeOutput(rec, replaced); err != nil {
+		log.Printf("Warning: failed to write output for %s: %v", rec.ID, err)
+	}
 
-	// Load textract data
-	textractInput := tools.LoadTextractInput{Path: textractPath}
-	_, textractOutput, err := tools.HandleLoadTextract(r.Context(), nil, textractInput)
-	if err != nil {
-		jsonError(w, "Failed to load textract: "+err.Error(), http.StatusInternalServerError)
-		return
+	if err := s.store.Put(rec); err != nil {
+		log.Printf("Warning: failed to save analysis result: %v", err)
+		if rec.OutputPath != "" {
+			os.Remove(rec.OutputPath)
+		}
+		return ""
 	}
+	if prev != nil && !s.supersede(prev, rec, inherit) {
+		log.Printf("Warning: not saving analysis result: %s was superseded by another version meanwhile", prev.ID)
+		s.store.Delete(rec.ID)
+		if rec.OutputPath != "" {
+			os.Remove(rec.OutputPath)
+		}
+		return ""
+	}
+	log.Printf("Saved analysis result: %s (version %d)", rec.ID, rec.Version)
+	s.indexRecord(rec)
+	s.embedRecord(rec)
+	s.checkBudgets(rec)
+	s.deliverResult(rec)
+	return rec.ID
+}
+
+// supersede marks prev replaced by rec. An edit to prev since it was read
+// isn't overwritten: prev is read again and, when rec inherits its tags
+// and notes, the edited ones are carried over to rec. It reports false if
+// another version superseded prev first.
+func (s *Server) supersede(prev, rec *store.Record, inherit bool) bool {
+	for attempt := 1; ; attempt++ {
+		prev.SupersededBy = rec.ID
+		if s.isOutputPath(prev.OutputPath) {
+			prev.OutputPath = "" // Removed by writeOutput
+		}
+		err := s.store.Update(prev)
+		if err == nil {
+			return true
+		}
+		if !errors.Is(err, store.ErrConflict) || attempt == maxEditAttempts {
+			log.Printf("Warning: failed to mark %s superseded: %v", prev.ID, err)
+			return true
+		}
 
-	// Parse receipt using LLM
-	var llmOutput map[string]any
-	if s.claudeAPI != nil {
-		log.Printf("Parsing receipt with Claude API...")
-		receipt, err := s.claudeAPI.ParseReceiptWithLLM(imagePath, textractOutput)
+		if prev, err = s.store.Get(prev.ID); err != nil {
+			log.Printf("Warning: failed to mark %s superseded: %v", rec.PreviousID, err)
+			return true
+		}
+		if prev.SupersededBy != "" {
+			return false
+		}
+		if inherit && (!slices.Equal(prev.Tags, rec.Tags) || prev.Notes != rec.Notes) {
+			rec.Tags, rec.Notes = prev.Tags, prev.Notes
+			if err := s.store.Put(rec); err != nil {
+				log.Printf("Warning: failed to carry tags and notes over to %s: %v", rec.ID, err)
+			}
+		}
+	}
+}
+
+// previousVersion returns the record rec should supersede, if any.
+func (s *Server) previousVersion(rec *store.Record) *store.Record {
+	if rec.PreviousID != "" {
+		prev, err := s.store.Get(rec.PreviousID)
 		if err != nil {
-			log.Printf("LLM parsing failed: %v, falling back to regex parser", err)
-			// Fallback to regex parser if LLM fails
-			llmOutput = parseTextractToReceipt(textractOutput)
-		} else {
-			// Convert ReceiptOutput to map[string]any
-			jsonBytes, _ := json.Marshal(receipt)
-			json.Unmarshal(jsonBytes, &llmOutput)
+			log.Printf("Warning: previous version %s not found: %v", rec.PreviousID, err)
+			return nil
 		}
-	} else {
-		log.Printf("Claude API not configured, using regex parser")
-		// Fallback to regex parser
-		llmOutput = parseTextractToReceipt(textractOutput)
+		return prev
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(AnalyzeResponse{
-		Textract:  textractOutput,
-		LLMOutput: llmOutput,
-		Source:    source,
-	})
+	prev, err := store.Latest(s.store, rec.Owner, rec.ImageSHA256)
+	if err != nil {
+		log.Printf("Warning: failed to look up previous versions: %v", err)
+		return nil
+	}
+	return prev
 }
 
-// findOrRunTextract finds an existing Textract result or runs Textract on the image.
-func (s *Server) findOrRunTextract(imagePath string) (string, string, error) {
-	// Get base name of image
-	baseName := filepath.Base(imagePath)
-	nameWithoutExt := strings.TrimSuffix(baseName, filepath.Ext(baseName))
+// textractLineTexts returns the plain text of each OCR line.
+func textractLineTexts(textract tools.LoadTextractOutput) []string {
+	texts := make([]string, len(textract.Lines))
+	for i, line := range textract.Lines {
+		texts[i] = line.Text
+	}
+	return texts
+}
+
+// prepareImage returns the path of a provider-friendly version of the image,
+// written to outDir, falling back to the original if it can't be prepared.
+func (s *Server) prepareImage(imagePath, outDir string) string {
+	preparedPath, err, _ := s.prepareFlight.Do(imagePath, func() (string, error) {
+		return imageprep.Prepare(imagePath, outDir, s.imageOpts)
+	})
+	if err != nil {
+		log.Printf("Warning: could not downscale image, using original: %v", err)
+		return imagePath
+	}
+	if preparedPath != imagePath {
+		log.Printf("Using downscaled image: %s", preparedPath)
+		retention.Touch(preparedPath)
+	}
+	return preparedPath
+}
 
+// findOrRunTextract finds an existing Textract result for imagePath or runs
+// Textract on preparedPath (the possibly downscaled copy of the image).
+// Cancelling ctx stops the Textract call, unless another caller is sharing
+// it; if the caller that started a shared call cancels, the others retry.
+func (s *Server) findOrRunTextract(ctx context.Context, imagePath, preparedPath string) (string, string, error) {
 	// Check if caching is disabled (for testing)
 	disableCache := os.Getenv("DISABLE_CACHE") == "true" || os.Getenv("DISABLE_CACHE") == "1"
 
 	// Check for cached textract output in cache folder (skip if cache disabled)
-	cachedPath := filepath.Join(s.textractDir, nameWithoutExt+"_textract.json")
+	cachedPath := s.textractCachePath(imagePath)
 	if !disableCache {
 		if _, err := os.Stat(cachedPath); err == nil {
 			log.Printf("Found cached Textract: %s", cachedPath)
+			retention.Touch(cachedPath)
 			return cachedPath, "cached", nil
 		}
 	} else {
@@ -242,9 +1241,45 @@ func (s *Server) findOrRunTextract(imagePath string) (string, string, error) {
 		return "", "", fmt.Errorf("image file not found: %s", imagePath)
 	}
 
-	// Run AWS Textract on the image
-	log.Printf("Running AWS Textract on image: %s", imagePath)
-	textractOutput, err := s.runTextract(imagePath, cachedPath)
+	// Only one Textract call per cache file at a time; concurrent callers
+	// wait for and share its result
+	var textractOutput string
+	var err error
+	for {
+		var shared bool
+		textractOutput, err, shared = s.textractFlight.Do(cachedPath, func() (string, error) {
+			// A call that finished between our cache check and now already wrote it
+			if !disableCache {
+				if _, err := os.Stat(cachedPath); err == nil {
+					return cachedPath, nil
+				}
+			}
+
+			release, err := s.acquire(ctx, s.textractLimit, "Textract")
+			if err != nil {
+				return "", err
+			}
+			defer release()
+
+			if s.fake != nil {
+				return s.runFakeTextract(imagePath, cachedPath)
+			}
+
+			// Run AWS Textract on the image
+			log.Printf("Running AWS Textract on image: %s", imagePath)
+			return s.runTextract(ctx, preparedPath, cachedPath)
+		})
+		if shared && err == nil {
+			log.Printf("Shared in-flight Textract result: %s", textractOutput)
+		}
+		if !shared || !isCancellation(err) || ctx.Err() != nil {
+			break
+		}
+		log.Printf("Shared Textract call was cancelled by its caller, retrying")
+	}
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
 	if err != nil {
 		log.Printf("AWS Textract failed: %v", err)
 		return "", "", fmt.Errorf("AWS Textract failed: %w. Please ensure AWS CLI is configured", err)
@@ -253,37 +1288,59 @@ func (s *Server) findOrRunTextract(imagePath string) (string, string, error) {
 	return textractOutput, "aws_textract", nil
 }
 
-// runTextract calls AWS Textract CLI to process an image.
-func (s *Server) runTextract(imagePath, outputPath string) (string, error) {
-	// Read image and base64 encode it
-	imageData, err := os.ReadFile(imagePath)
+// textractCachePath returns where the Textract output for imagePath is
+// cached. AnalyzeDocument output is cached apart from DetectDocumentText's,
+// so turning tables on doesn't reuse results without them.
+func (s *Server) textractCachePath(imagePath string) string {
+	baseName := filepath.Base(imagePath)
+	nameWithoutExt := strings.TrimSuffix(baseName, filepath.Ext(baseName))
+	if s.textractTables {
+		return filepath.Join(s.textractDir, nameWithoutExt+"_textract_tables.json")
+	}
+	return filepath.Join(s.textractDir, nameWithoutExt+"_textract.json")
+}
+
+// textractWaitDelay bounds how long a cancelled Textract CLI's output is
+// drained before it is abandoned.
+const textractWaitDelay = 2 * time.Second
+
+// runTextract calls AWS Textract CLI to process an image, as an async job
+// when TEXTRACT_S3_BUCKET is set. Cancelling ctx kills the CLI, and nothing
+// is cached.
+func (s *Server) runTextract(ctx context.Context, imagePath, outputPath string) (string, error) {
+	imageSize, encodedSize, err := base64FileSize(imagePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to read image: %w", err)
+		return "", err
 	}
 
-	// Base64 encode the image
-	base64Data := base64.StdEncoding.EncodeToString(imageData)
+	log.Printf("Running AWS Textract (image size: %d bytes, base64 size: %d)", imageSize, encodedSize)
+	if s.textractAsync != nil {
+		return s.runTextractAsync(ctx, imagePath, outputPath)
+	}
 
-	log.Printf("Running AWS Textract (image size: %d bytes, base64 size: %d)", len(imageData), len(base64Data))
+	// Stream the request document to a temp file instead of passing it on the
+	// command line: a single argv entry is limited to 128KB on Linux, and this
+	// avoids holding the image and its encoding in memory.
+	documentPath, err := writeTextractDocument(imagePath)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(documentPath)
 
 	// Call AWS Textract via CLI
-	cmd := exec.Command("aws", "textract", "detect-document-text",
-		"--region", "us-east-1",
-		"--document", fmt.Sprintf(`{"Bytes":"%s"}`, base64Data),
-	)
-
-	output, err := cmd.Output()
+	args := []string{"textract", "detect-document-text"}
+	if s.textractTables {
+		args = []string{"textract", "analyze-document", "--feature-types", "TABLES"}
+	}
+	args = append(args, "--region", textractRegion, "--document", "file://"+documentPath)
+	output, err := awsCLI(ctx, args...)
 	if err != nil {
-		// Get stderr for better error messages
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return "", fmt.Errorf("textract failed: %s", string(exitErr.Stderr))
-		}
-		return "", fmt.Errorf("textract command failed: %w", err)
+		return "", err
 	}
 
 	// Always save the file (needed for loading), even if cache is disabled
 	// "Disable cache" means "don't reuse old cached files", not "don't save files"
-	if err := os.WriteFile(outputPath, output, 0644); err != nil {
+	if err := s.cipher.WriteFile(outputPath, output, 0644); err != nil {
 		return "", fmt.Errorf("failed to save textract output: %w", err)
 	}
 
@@ -296,70 +1353,184 @@ func (s *Server) runTextract(imagePath, outputPath string) (string, error) {
 	return outputPath, nil
 }
 
+// isCancellation reports whether err is a context cancellation or timeout.
+func isCancellation(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// writeTextractDocument writes a Textract Document JSON ({"Bytes": "<base64>"})
+// for the image to a temp file and returns its path.
+func writeTextractDocument(imagePath string) (string, error) {
+	f, err := os.CreateTemp("", "textract-document-*.json")
+	if err != nil {
+		return "", fmt.Errorf("failed to create textract document: %w", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	w.WriteString(`{"Bytes":"`)
+	if err := streamBase64(w, imagePath); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	w.WriteString(`"}`)
+	if err := w.Flush(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write textract document: %w", err)
+	}
+
+	return f.Name(), nil
+}
+
 // parseTextractToReceipt converts textract lines to a structured receipt.
-func parseTextractToReceipt(textract tools.LoadTextractOutput) map[string]any {
-	receipt := map[string]any{
-		"vendor":           "",
-		"date":             "",
-		"items":            []map[string]any{},
-		"subtotal":         0.0,
-		"tax":              0.0,
-		"total":            0.0,
-		"confidence_notes": "Parsed from Textract OCR output",
-		"anomalies":        []string{},
-	}
-
-	items := []map[string]any{}
-	var vendor string
-	var date string
-	var subtotal, tax, total float64
+func parseTextractToReceipt(textract tools.LoadTextractOutput) *receipt.Receipt {
+	textract, numeralFixes := normalizeNumerals(textract)
+	parsed := receipt.NewReceipt()
+	parsed.ConfidenceNotes = "Parsed from Textract OCR output"
+	parsed.Handwritten = textract.Handwritten
+	parsed.Loyalty = receipt.ExtractLoyalty(textractLineTexts(textract))
+	parsed.StoreNumber, parsed.Phone = receipt.ParseStoreHeader(headerLineTexts(textract))
+
+	// Items come from a detected table when there is one, since its columns
+	// keep names, quantities, and prices apart
+	parsed.Items = tableItems(textract)
+	fromTable := len(parsed.Items) > 0
 
+	minConfidence := vendorConfidenceThreshold(textract)
+	labeled := make(map[string]bool) // Amounts whose label is printed, legible or not
 	for i, line := range textract.Lines {
 		text := line.Text
+		lowerText := strings.ToLower(text)
 
 		// First high-confidence line is often the vendor
-		if i < 3 && line.Confidence > 90 && vendor == "" && len(text) > 3 {
-			vendor = text
+		if i < 3 && line.Confidence > minConfidence && parsed.Vendor == "" && len(text) > 3 && inBlock(line, receipt.BlockHeader) {
+			parsed.Vendor = text
 		}
 
 		// Look for date patterns
-		if containsDate(text) && date == "" {
-			date = text
+		if containsDate(text) && parsed.Date == "" {
+			parsed.Date = text
+		}
+
+		field := amountField(lowerText)
+		if field != "" {
+			labeled[field] = true
+		}
+		if field == "tax" || field == "tax_line" {
+			labeled["tax"] = true
+			if line, ok := parseTaxLine(text); ok && field == "tax" {
+				parsed.Tax = receipt.Amount(line.Amount)
+			} else if ok {
+				// A tax summary below the total, as on VAT receipts, is
+				// already in it
+				line.Included = line.Included || parsed.Total != nil
+				parsed.TaxLines = append(parsed.TaxLines, line)
+			}
+			continue
+		}
+
+		// Tenders follow the total
+		if field == "" && (parsed.Total != nil || line.Block == receipt.BlockPayment) {
+			if changeRegex.MatchString(text) {
+				if change := centsRegex.FindString(text); change != "" {
+					giveChange(parsed.Tenders, extractPrice(change))
+				}
+				continue
+			}
+			if tender, ok := parseTender(text); ok {
+				parsed.Tenders = append(parsed.Tenders, tender)
+				continue
+			}
 		}
 
 		// Look for dollar amounts
 		if containsPrice(text) {
-			lowerText := strings.ToLower(text)
 			price := extractPrice(text)
 
-			if strings.Contains(lowerText, "subtotal") {
-				subtotal = price
-			} else if strings.Contains(lowerText, "tax") {
-				tax = price
-			} else if strings.Contains(lowerText, "total") && !strings.Contains(lowerText, "subtotal") {
-				total = price
-			} else if price > 0 {
-				// Line item
-				name := extractItemName(text)
-				if name != "" && len(name) > 1 {
-					items = append(items, map[string]any{
-						"name":  name,
-						"qty":   1,
-						"price": price,
-					})
+			switch field {
+			case "subtotal":
+				parsed.Subtotal = receipt.Amount(price)
+			case "total":
+				parsed.Total = receipt.Amount(price)
+			default:
+				if price > 0 && !fromTable && inBlock(line, receipt.BlockItems) {
+					// Line item
+					name := extractItemName(text)
+					if name != "" && len(name) > 1 {
+						parsed.Items = append(parsed.Items, receipt.Item{Name: name, Qty: 1, Price: price})
+					}
 				}
 			}
 		}
 	}
+	parsed.FillTax()
+	parsed.TaxLines = detailedTaxLines(parsed.TaxLines)
+	parsed.Refund = receipt.HasRefundMarker(textractLineTexts(textract))
+	parsed.NormalizeRefund()
+	for field, amount := range map[string]*float64{"subtotal": parsed.Subtotal, "tax": parsed.Tax, "total": parsed.Total} {
+		if amount == nil {
+			parsed.SetUnknown(field, unknownReason(labeled[field]))
+		}
+	}
+	parsed.CheckWrittenTotal(textractLineTexts(textract))
+	parsed.FillOutOfPocket()
+	parsed.NoteNumeralFixes(numeralFixes)
+
+	if textract.Handwritten {
+		parsed.ConfidenceNotes += ". " + handwrittenNote
+		parsed.Anomalies = append(parsed.Anomalies, handwrittenNote)
+	}
+	return parsed
+}
+
+// headerFallbackLines is how many lines of an unlabeled receipt are taken
+// as its header.
+const headerFallbackLines = 6
+
+// headerLineTexts returns the text of the lines layout analysis put in the
+// header, or of the first few lines when it labeled none.
+func headerLineTexts(textract tools.LoadTextractOutput) []string {
+	var texts []string
+	for _, line := range textract.Lines {
+		if line.Block == receipt.BlockHeader {
+			texts = append(texts, line.Text)
+		}
+	}
+	if texts == nil {
+		for i, line := range textract.Lines {
+			if i == headerFallbackLines || line.Block != "" {
+				break
+			}
+			texts = append(texts, line.Text)
+		}
+	}
+	return texts
+}
+
+// unknownReason is why the heuristic parsers have no value for an amount:
+// unreadable when a line carries its label without a legible amount, and
+// absent when no line does.
+func unknownReason(labeled bool) string {
+	if labeled {
+		return receipt.ReasonUnreadable
+	}
+	return receipt.ReasonAbsent
+}
 
-	receipt["vendor"] = vendor
-	receipt["date"] = date
-	receipt["items"] = items
-	receipt["subtotal"] = subtotal
-	receipt["tax"] = tax
-	receipt["total"] = total
+// tableItems returns the items in the Textract tables that have an item and
+// a price column.
+func tableItems(textract tools.LoadTextractOutput) []receipt.Item {
+	var items []receipt.Item
+	for _, table := range textract.Tables {
+		items = append(items, table.Items()...)
+	}
+	return items
+}
 
-	return receipt
+// inBlock reports whether layout analysis put line in block. Lines it
+// didn't label may be in any block.
+func inBlock(line tools.TextractLine, block receipt.BlockLabel) bool {
+	return line.Block == "" || line.Block == block
 }
 
 // jsonError sends a JSON error response.
@@ -368,6 +1539,6 @@ func jsonError(w http.ResponseWriter, message string, status int) {
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(map[string]any{
 		"error":   true,
-		"message": message,
+		"message": redact.String(message),
 	})
 }
@@ -0,0 +1,127 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"myprice/internal/imageprep"
+	"myprice/internal/quota"
+)
+
+var (
+	// errInvalidBase64 is returned for image_base64 that doesn't decode.
+	errInvalidBase64 = errors.New("image_base64 is not valid base64")
+
+	// errWrongMIMEType is returned when an inline image's content doesn't
+	// match its declared type.
+	errWrongMIMEType = errors.New("image does not match mime_type")
+
+	// errStoreImage is returned when an image from a request can't be
+	// written to the upload directory.
+	errStoreImage = errors.New("failed to save image")
+)
+
+// imageMIMETypes maps the formats imageprep.Sniff reports to MIME types.
+var imageMIMETypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+	"heic": "image/heic",
+	"tiff": "image/tiff",
+	"bmp":  "image/bmp",
+}
+
+// storeInlineImage decodes an image sent as base64 in a request body and
+// saves it to the upload directory, charged to owner's quota, returning its
+// path. encoded may be a data: URL, whose media type stands in for an empty
+// mimeType. A given type must agree with the content.
+func (s *Server) storeInlineImage(encoded, mimeType, owner string) (string, error) {
+	if rest, ok := strings.CutPrefix(encoded, "data:"); ok {
+		header, data, ok := strings.Cut(rest, ",")
+		if !ok || !strings.HasSuffix(header, ";base64") {
+			return "", fmt.Errorf("%w: data URLs must be base64-encoded", errInvalidBase64)
+		}
+		if mimeType == "" {
+			mimeType = strings.TrimSuffix(header, ";base64")
+		}
+		encoded = data
+	}
+
+	// Tolerate line breaks and missing padding from hand-rolled encoders
+	encoded = strings.Join(strings.Fields(encoded), "")
+	if base64.StdEncoding.DecodedLen(len(encoded)) > int(s.maxUploadBytes)+2 {
+		return "", errTooLarge
+	}
+	data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return "", errInvalidBase64
+	}
+	if int64(len(data)) > s.maxUploadBytes {
+		return "", errTooLarge
+	}
+
+	format := imageprep.Sniff(data)
+	if format == "" {
+		return "", fmt.Errorf("image_base64 is %w", errNotImage)
+	}
+	if mimeType != "" {
+		declared, _, err := mime.ParseMediaType(mimeType)
+		if declared == "image/jpg" {
+			declared = "image/jpeg"
+		}
+		if err != nil || declared != imageMIMETypes[format] {
+			return "", fmt.Errorf("%w: image_base64 is %s, not %s", errWrongMIMEType, imageMIMETypes[format], mimeType)
+		}
+	}
+
+	// Name by content, so sending the same image again replaces it
+	id := sha256.Sum256(data)
+	destPath := filepath.Join(s.uploadDir, fmt.Sprintf("inline-%s.%s", hex.EncodeToString(id[:8]), format))
+	if err := s.storeImage(owner, destPath, data); err != nil {
+		return "", err
+	}
+	return destPath, nil
+}
+
+// imageInputError writes the response for an image from a request, such as
+// a download or inline data, that couldn't be stored.
+func (s *Server) imageInputError(w http.ResponseWriter, err error) {
+	var exceeded *quota.ExceededError
+	switch {
+	case errors.As(err, &exceeded):
+		quotaError(w, exceeded)
+	case errors.Is(err, errTooLarge):
+		s.uploadTooLarge(w)
+	case errors.Is(err, errNotImage):
+		jsonError(w, err.Error()+": use JPEG, PNG, GIF, WebP, HEIC, TIFF, or BMP", http.StatusUnsupportedMediaType)
+	case errors.Is(err, errWrongMIMEType):
+		jsonError(w, err.Error(), http.StatusUnsupportedMediaType)
+	case errors.Is(err, errInvalidImageURL), errors.Is(err, errBlockedAddress), errors.Is(err, errInvalidBase64):
+		jsonError(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errStoreImage):
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+	default:
+		// The rest are downloads the remote server failed
+		jsonError(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+// countNonEmpty returns how many of values are non-empty.
+func countNonEmpty(values ...string) int {
+	n := 0
+	for _, v := range values {
+		if v != "" {
+			n++
+		}
+	}
+	return n
+}
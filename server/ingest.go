@@ -0,0 +1,306 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"myprice/internal/imageprep"
+	"myprice/internal/ingest"
+	"myprice/internal/quota"
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+)
+
+// maxIngestAttempts is how often a file that fails analysis is retried
+// before it is skipped for good.
+const maxIngestAttempts = 3
+
+// errIngestSkip marks a file that will never ingest, such as a non-image.
+var errIngestSkip = errors.New("not a supported image")
+
+// ingestSource is a configured cloud folder and the API key its receipts
+// are attributed to.
+type ingestSource struct {
+	ingest.Source
+	folder string
+	owner  string
+}
+
+// IngestStatus reports a cloud folder's ingestion progress.
+type IngestStatus struct {
+	Source    string    `json:"source"`
+	Folder    string    `json:"folder"`
+	Owner     string    `json:"owner,omitempty"`
+	Processed int       `json:"processed"`
+	Skipped   int       `json:"skipped"`
+	Retrying  int       `json:"retrying"` // Files that failed and will be tried again
+	LastPoll  time.Time `json:"last_poll,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// newIngestSources builds the cloud folders configured by DROPBOX_FOLDER
+// and GDRIVE_FOLDER_ID.
+func newIngestSources() []ingestSource {
+	var sources []ingestSource
+
+	if folder := os.Getenv("DROPBOX_FOLDER"); folder != "" {
+		creds := &ingest.Credentials{
+			AccessToken:  os.Getenv("DROPBOX_TOKEN"),
+			RefreshToken: os.Getenv("DROPBOX_REFRESH_TOKEN"),
+			ClientID:     os.Getenv("DROPBOX_APP_KEY"),
+			ClientSecret: os.Getenv("DROPBOX_APP_SECRET"),
+		}
+		src := ingest.NewDropbox(folder, os.Getenv("DROPBOX_URL"), creds)
+		if creds.Valid() {
+			sources = append(sources, ingestSource{Source: src, folder: folder, owner: os.Getenv("DROPBOX_OWNER")})
+		} else {
+			log.Printf("Warning: DROPBOX_FOLDER is set without DROPBOX_TOKEN or DROPBOX_REFRESH_TOKEN and DROPBOX_APP_KEY; Dropbox ingestion disabled")
+		}
+	}
+
+	if folder := os.Getenv("GDRIVE_FOLDER_ID"); folder != "" {
+		creds := &ingest.Credentials{
+			AccessToken:  os.Getenv("GDRIVE_TOKEN"),
+			RefreshToken: os.Getenv("GDRIVE_REFRESH_TOKEN"),
+			ClientID:     os.Getenv("GDRIVE_CLIENT_ID"),
+			ClientSecret: os.Getenv("GDRIVE_CLIENT_SECRET"),
+		}
+		src := ingest.NewGoogleDrive(folder, os.Getenv("GDRIVE_URL"), creds)
+		if creds.Valid() {
+			sources = append(sources, ingestSource{Source: src, folder: folder, owner: os.Getenv("GDRIVE_OWNER")})
+		} else {
+			log.Printf("Warning: GDRIVE_FOLDER_ID is set without GDRIVE_TOKEN or GDRIVE_REFRESH_TOKEN and GDRIVE_CLIENT_ID; Google Drive ingestion disabled")
+		}
+	}
+	return sources
+}
+
+// StartIngest polls each configured cloud folder every
+// INGEST_POLL_INTERVAL until ctx is cancelled, analyzing new images.
+func (s *Server) StartIngest(ctx context.Context) {
+	if len(s.ingestSources) == 0 || s.ingestState == nil {
+		return
+	}
+	for _, src := range s.ingestSources {
+		log.Printf("Ingesting receipt images from %s folder %s every %s", src.Name(), src.folder, s.ingestPollInterval)
+		go func(src ingestSource) {
+			ticker := time.NewTicker(s.ingestPollInterval)
+			defer ticker.Stop()
+			for {
+				s.pollIngestSource(ctx, src)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(src)
+	}
+}
+
+// pollIngestSource analyzes the images added to a folder since its cursor.
+// On the first poll the cursor starts after the files already there,
+// unless INGEST_EXISTING is set. The cursor only advances once every listed
+// file is done, so a failed file is listed again on the next poll; files
+// already processed are remembered and skipped. A failure ends the poll,
+// so an outage costs one attempt rather than one per file.
+func (s *Server) pollIngestSource(ctx context.Context, src ingestSource) {
+	st := s.ingestState.Get(src.Name())
+	first := st.LastPoll.IsZero()
+	st.LastPoll = time.Now().UTC()
+	st.LastError = ""
+
+	if first && !s.ingestExisting {
+		cursor, err := src.Latest(ctx)
+		if err != nil {
+			s.ingestFailed(src, st, err)
+			return
+		}
+		st.Cursor = cursor
+		log.Printf("Watching %s folder %s for new images", src.Name(), src.folder)
+		s.saveIngestState(src, st)
+		return
+	}
+
+	files, next, err := src.Changes(ctx, st.Cursor)
+	if err != nil {
+		s.ingestFailed(src, st, err)
+		return
+	}
+
+	complete := true
+	var exceeded *quota.ExceededError
+	for _, f := range files {
+		if ctx.Err() != nil || st.LastError != "" {
+			complete = false
+			break
+		}
+		if st.HasSeen(f.ID) {
+			continue
+		}
+
+		err := s.ingestFile(ctx, src, f)
+		switch {
+		case err == nil:
+			st.Processed++
+			st.MarkSeen(f.ID)
+		case errors.Is(err, errIngestSkip):
+			log.Printf("Skipping %s file %s: %v", src.Name(), f.Name, err)
+			st.Skipped++
+			st.MarkSeen(f.ID)
+		case ctx.Err() != nil:
+			complete = false
+		case errors.As(err, &exceeded):
+			// Not the file's fault: wait for the owner to free up space
+			log.Printf("Warning: pausing %s ingestion: %v", src.Name(), err)
+			st.LastError = err.Error()
+		default:
+			st.LastError = fmt.Sprintf("%s: %v", f.Name, err)
+			st.Failures[f.ID]++
+			if st.Failures[f.ID] >= maxIngestAttempts {
+				log.Printf("Warning: giving up on %s file %s after %d attempts: %v", src.Name(), f.Name, maxIngestAttempts, err)
+				st.Skipped++
+				st.MarkSeen(f.ID)
+			} else {
+				log.Printf("Warning: failed to ingest %s file %s (will retry): %v", src.Name(), f.Name, err)
+			}
+		}
+		// Save as each file finishes, so a restart doesn't redo finished work
+		s.saveIngestState(src, st)
+	}
+
+	if complete && st.LastError == "" {
+		st.Cursor = next
+	}
+	s.saveIngestState(src, st)
+}
+
+// ingestFile downloads one image into the upload directory and analyzes
+// it, attributing the receipt to the source's owner. The file is archived
+// as downloaded, with where it came from, as the receipt's original.
+func (s *Server) ingestFile(ctx context.Context, src ingestSource, f ingest.File) error {
+	if f.Size > s.maxUploadBytes {
+		return fmt.Errorf("%w: larger than %d bytes", errIngestSkip, s.maxUploadBytes)
+	}
+
+	var buf bytes.Buffer
+	if err := src.Download(ctx, f, &limitedWriter{w: &buf, n: s.maxUploadBytes}); err != nil {
+		if errors.Is(err, errTooLarge) {
+			return fmt.Errorf("%w: larger than %d bytes", errIngestSkip, s.maxUploadBytes)
+		}
+		return fmt.Errorf("download failed: %w", err)
+	}
+	format := imageprep.Sniff(buf.Bytes())
+	if format == "" {
+		return errIngestSkip
+	}
+	original := s.archiveOriginal(buf.Bytes(), store.Original{
+		Name:        f.Name,
+		ContentType: imageMIMETypes[format],
+		Source:      src.Name(),
+		SourceID:    f.ID,
+		ModifiedAt:  f.ModifiedAt,
+	})
+
+	// Prefix names with the file's identity, since phones reuse names
+	id := sha256.Sum256([]byte(src.Name() + "\x00" + f.ID))
+	destPath := filepath.Join(s.uploadDir, fmt.Sprintf("%s-%s-%s", src.Name(), hex.EncodeToString(id[:4]), filepath.Base(f.Name)))
+	if err := s.reserveUpload(src.owner, destPath, int64(buf.Len())); err != nil {
+		return err
+	}
+	if _, err := s.saveUpload(destPath, &buf); err != nil {
+		s.releaseUpload(src.owner, destPath)
+		return fmt.Errorf("failed to save image: %w", err)
+	}
+	log.Printf("Downloaded %s file %s to %s", src.Name(), f.Name, destPath)
+
+	actx, attempt := s.startAttempt(ctx, viaIngest, src.owner, destPath)
+	result, err := s.analyze(actx, destPath, receipt.DocumentTypeAuto, "")
+	if err != nil {
+		attempt.finish(nil, "", err)
+		if rejectedContent(err) != "" {
+			// Analyzing it again won't make it a receipt
+			return fmt.Errorf("%w: %v", errIngestSkip, err)
+		}
+		return err
+	}
+	rec := result.record(destPath)
+	rec.Owner = src.owner
+	rec.Original = original
+	receiptID := s.saveResult(rec)
+	attempt.finish(result, receiptID, nil)
+	if receiptID == "" {
+		return fmt.Errorf("failed to save analysis result")
+	}
+	s.autoExport(rec)
+	return nil
+}
+
+// ingestFailed records and logs an error that ended a poll.
+func (s *Server) ingestFailed(src ingestSource, st ingest.State, err error) {
+	if errors.Is(err, ingest.ErrUnauthorized) {
+		log.Printf("Warning: %s rejected its credentials; check the token settings", src.Name())
+	} else {
+		log.Printf("Warning: polling %s failed: %v", src.Name(), err)
+	}
+	st.LastError = err.Error()
+	s.saveIngestState(src, st)
+}
+
+// saveIngestState saves a source's state, logging failures.
+func (s *Server) saveIngestState(src ingestSource, st ingest.State) {
+	if err := s.ingestState.Put(src.Name(), st); err != nil {
+		log.Printf("Warning: failed to save %s ingest state: %v", src.Name(), err)
+	}
+}
+
+// handleAdminIngest reports each cloud folder's ingestion progress.
+func (s *Server) handleAdminIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statuses := make([]IngestStatus, 0, len(s.ingestSources))
+	for _, src := range s.ingestSources {
+		status := IngestStatus{Source: src.Name(), Folder: src.folder, Owner: src.owner}
+		if s.ingestState != nil {
+			st := s.ingestState.Get(src.Name())
+			status.Processed, status.Skipped, status.Retrying = st.Processed, st.Skipped, len(st.Failures)
+			status.LastPoll, status.LastError = st.LastPoll, st.LastError
+		}
+		statuses = append(statuses, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"sources": statuses, "count": len(statuses)})
+}
+
+// errTooLarge is returned by limitedWriter once its limit is exceeded.
+var errTooLarge = errors.New("file too large")
+
+// limitedWriter fails writes past n bytes.
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, errTooLarge
+	}
+	l.n -= int64(len(p))
+	return l.w.Write(p)
+}
@@ -0,0 +1,354 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"myprice/internal/integrations"
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+)
+
+// exportTimeout bounds an automatic export after analysis.
+const exportTimeout = 30 * time.Second
+
+// maxListedExports bounds the exports returned with a user's settings.
+const maxListedExports = 50
+
+// IntegrationsResponse is the caller's integrations, with tokens masked,
+// and their most recent exports.
+type IntegrationsResponse struct {
+	Splitwise *integrations.Splitwise `json:"splitwise,omitempty"`
+	YNAB      *integrations.YNAB      `json:"ynab,omitempty"`
+	Exports   []integrations.Export   `json:"exports"` // Newest first
+}
+
+// ExportResponse reports a receipt pushed to an app.
+type ExportResponse struct {
+	Success bool `json:"success"`
+	integrations.Export
+}
+
+// handleIntegrations returns the caller's integration settings.
+func (s *Server) handleIntegrations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	caller, ok := s.integrationCaller(w, r)
+	if !ok {
+		return
+	}
+
+	writeIntegrations(w, s.integrations.Get(caller.Name))
+}
+
+// handleIntegration configures one of the caller's integrations on PUT,
+// replacing its settings, and removes it on DELETE. The body of a PUT is
+// the provider's settings, e.g. {"token": "...", "group_id": 123}.
+func (s *Server) handleIntegration(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.integrationCaller(w, r)
+	if !ok {
+		return
+	}
+	provider := r.PathValue("provider")
+
+	var update func(*integrations.Settings) error
+	switch r.Method {
+	case http.MethodPut:
+		switch provider {
+		case integrations.ProviderSplitwise:
+			var cfg integrations.Splitwise
+			if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+				jsonError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := cfg.Validate(); err != nil {
+				jsonError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			update = func(u *integrations.Settings) error { u.Splitwise = &cfg; return nil }
+		case integrations.ProviderYNAB:
+			var cfg integrations.YNAB
+			if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+				jsonError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := cfg.Validate(); err != nil {
+				jsonError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			update = func(u *integrations.Settings) error { u.YNAB = &cfg; return nil }
+		default:
+			jsonError(w, "Unknown integration: "+provider, http.StatusNotFound)
+			return
+		}
+
+	case http.MethodDelete:
+		update = func(u *integrations.Settings) error {
+			switch {
+			case provider == integrations.ProviderSplitwise && u.Splitwise != nil:
+				u.Splitwise = nil
+			case provider == integrations.ProviderYNAB && u.YNAB != nil:
+				u.YNAB = nil
+			default:
+				return integrations.ErrNotConfigured
+			}
+			return nil
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	settings, err := s.integrations.Update(caller.Name, update)
+	if errors.Is(err, integrations.ErrNotConfigured) {
+		jsonError(w, "Integration not configured", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Failed to save integration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		log.Printf("%s removed their %s integration", caller.Name, provider)
+	} else {
+		log.Printf("%s configured their %s integration", caller.Name, provider)
+	}
+
+	writeIntegrations(w, settings)
+}
+
+// handleExportReceipt pushes a receipt to one of the caller's apps.
+// Receipts already pushed there are refused unless ?force=true. Callers
+// may export their own receipts; admins may export any.
+func (s *Server) handleExportReceipt(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) {
+		return
+	}
+	caller, ok := s.integrationCaller(w, r)
+	if !ok {
+		return
+	}
+
+	rec, ok := s.loadRecord(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	if rec.Owner != caller.Name && caller.Role < RoleAdmin {
+		jsonError(w, "Only the receipt's owner or an admin can export it", http.StatusForbidden)
+		return
+	}
+
+	export, err := s.exportReceipt(r.Context(), caller.Name, rec, r.PathValue("provider"), r.URL.Query().Get("force") == "true")
+	switch {
+	case errors.Is(err, integrations.ErrUnknownProvider):
+		jsonError(w, "Unknown integration: "+r.PathValue("provider"), http.StatusNotFound)
+		return
+	case errors.Is(err, integrations.ErrNotConfigured):
+		jsonError(w, "Integration not configured; set it up with PUT /api/integrations/"+r.PathValue("provider"), http.StatusBadRequest)
+		return
+	case errors.Is(err, integrations.ErrAlreadyExported):
+		jsonError(w, "Receipt already exported; add ?force=true to export it again", http.StatusConflict)
+		return
+	case errors.Is(err, integrations.ErrUnauthorized):
+		jsonError(w, err.Error()+"; update the integration's token", http.StatusBadGateway)
+		return
+	case err != nil:
+		jsonError(w, "Export failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ExportResponse{Success: true, Export: export})
+}
+
+// exportReceipt pushes rec to user's provider and records the export.
+// Concurrent exports of the same receipt to the same app share one push.
+func (s *Server) exportReceipt(ctx context.Context, user string, rec *store.Record, provider string, force bool) (integrations.Export, error) {
+	key := user + "\x00" + provider + "\x00" + rec.ID
+	export, err, _ := s.exportFlight.Do(key, func() (integrations.Export, error) {
+		settings := s.integrations.Get(user)
+		if _, done := settings.Exported(provider, rec.ID); done && !force {
+			return integrations.Export{}, integrations.ErrAlreadyExported
+		}
+		exporter, err := s.exporter(settings, provider)
+		if err != nil {
+			return integrations.Export{}, err
+		}
+
+		remoteID, err := exporter.Export(ctx, expenseFromRecord(rec))
+		if err != nil {
+			return integrations.Export{}, err
+		}
+		export := integrations.Export{
+			Provider:   provider,
+			ReceiptID:  rec.ID,
+			RemoteID:   remoteID,
+			ExportedAt: time.Now().UTC(),
+		}
+		log.Printf("Exported receipt %s to %s for %s", rec.ID, provider, user)
+
+		// The push succeeded, so a failure here is only logged
+		if err := s.integrations.RecordExport(user, export); err != nil {
+			log.Printf("Warning: failed to record export of %s: %v", rec.ID, err)
+		}
+		return export, nil
+	})
+	return export, err
+}
+
+// exporter returns the configured exporter for provider.
+func (s *Server) exporter(settings *integrations.Settings, provider string) (integrations.Exporter, error) {
+	switch provider {
+	case integrations.ProviderSplitwise:
+		if settings.Splitwise == nil {
+			return nil, integrations.ErrNotConfigured
+		}
+		return integrations.NewSplitwiseExporter(os.Getenv("SPLITWISE_URL"), *settings.Splitwise), nil
+	case integrations.ProviderYNAB:
+		if settings.YNAB == nil {
+			return nil, integrations.ErrNotConfigured
+		}
+		return integrations.NewYNABExporter(os.Getenv("YNAB_URL"), *settings.YNAB), nil
+	}
+	return nil, integrations.ErrUnknownProvider
+}
+
+// autoExport pushes a newly analyzed receipt to each of its owner's apps
+// set to auto. Reanalyses of an image are new versions, not new purchases,
+// so only first versions are pushed. Failures are logged; the receipt can
+// still be exported by hand.
+func (s *Server) autoExport(rec *store.Record) {
+	if s.integrations == nil || rec.Owner == "" || rec.PreviousID != "" {
+		return
+	}
+	settings := s.integrations.Get(rec.Owner)
+
+	var providers []string
+	if settings.Splitwise != nil && settings.Splitwise.Auto {
+		providers = append(providers, integrations.ProviderSplitwise)
+	}
+	if settings.YNAB != nil && settings.YNAB.Auto {
+		providers = append(providers, integrations.ProviderYNAB)
+	}
+	if len(providers) == 0 {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		defer cancel()
+		for _, provider := range providers {
+			if _, err := s.exportReceipt(ctx, rec.Owner, rec, provider, false); err != nil {
+				log.Printf("Warning: automatic export of %s to %s failed: %v", rec.ID, provider, err)
+			}
+		}
+	}()
+}
+
+// expenseFromRecord describes a stored receipt for an app: the vendor
+// (chain when known), purchase date, total, and items in the memo.
+func expenseFromRecord(rec *store.Record) integrations.Expense {
+	docType := receipt.DocumentType(rec.DocumentType)
+	vendor, vendorFull, _ := vendorFields(docType, rec.Data)
+	if rec.Location != nil && rec.Location.Chain != "" {
+		vendor = rec.Location.Chain
+	}
+	if vendor == "" {
+		vendor = vendorFull
+	}
+	if vendor == "" {
+		vendor = "Receipt"
+	}
+
+	e := integrations.Expense{
+		ReceiptID: rec.ID,
+		Vendor:    vendor,
+		Date:      rec.CreatedAt.Format("2006-01-02"),
+	}
+	if rec.PurchaseTime != nil && rec.PurchaseTime.LocalDate != "" {
+		e.Date = rec.PurchaseTime.LocalDate
+	}
+	e.Total, _ = rec.Data["total"].(float64)
+	e.Paid = e.Total
+	if paid, ok := rec.Data["out_of_pocket"].(float64); ok {
+		e.Paid = paid
+	}
+	e.Currency, _ = rec.Data["currency"].(string)
+
+	nameKey := "name"
+	if docType == receipt.DocumentTypeInvoice {
+		nameKey = "description"
+	}
+	items, _ := rec.Data["items"].([]any)
+	names := make([]string, 0, len(items))
+	for _, raw := range items {
+		item, _ := raw.(map[string]any)
+		if name, _ := item[nameKey].(string); name != "" {
+			names = append(names, name)
+		}
+	}
+	e.Memo = fmt.Sprintf("myprice %s", rec.ID)
+	if len(names) > 0 {
+		e.Memo = strings.Join(names, ", ") + " (" + e.Memo + ")"
+	}
+	return e
+}
+
+// writeIntegrations writes settings with tokens masked.
+func writeIntegrations(w http.ResponseWriter, settings *integrations.Settings) {
+	resp := IntegrationsResponse{Splitwise: settings.Splitwise, YNAB: settings.YNAB, Exports: settings.Exports}
+	if resp.Splitwise != nil {
+		resp.Splitwise.Token = maskToken(resp.Splitwise.Token)
+	}
+	if resp.YNAB != nil {
+		resp.YNAB.Token = maskToken(resp.YNAB.Token)
+	}
+	sort.SliceStable(resp.Exports, func(i, j int) bool {
+		return resp.Exports[i].ExportedAt.After(resp.Exports[j].ExportedAt)
+	})
+	if len(resp.Exports) > maxListedExports {
+		resp.Exports = resp.Exports[:maxListedExports]
+	}
+	if resp.Exports == nil {
+		resp.Exports = []integrations.Export{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// maskToken hides all but the last four characters of a token.
+func maskToken(token string) string {
+	if len(token) <= 4 {
+		return "****"
+	}
+	return "****" + token[len(token)-4:]
+}
+
+// integrationCaller returns the authenticated caller, writing an error and
+// returning false if integrations are unavailable. Integrations hold each
+// user's own tokens, so they need authentication enabled.
+func (s *Server) integrationCaller(w http.ResponseWriter, r *http.Request) (Principal, bool) {
+	if s.integrations == nil {
+		jsonError(w, "Integration store is not available", http.StatusServiceUnavailable)
+		return Principal{}, false
+	}
+	p, ok := PrincipalFrom(r.Context())
+	if !ok {
+		jsonError(w, "Integrations require API_KEYS so users can be identified", http.StatusBadRequest)
+		return Principal{}, false
+	}
+	return p, true
+}
@@ -0,0 +1,213 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"myprice/internal/receipt"
+	"myprice/tools"
+)
+
+// parseTextractToInvoice converts textract lines to a structured invoice.
+func parseTextractToInvoice(textract tools.LoadTextractOutput) *receipt.Invoice {
+	textract, numeralFixes := normalizeNumerals(textract)
+	invoice := receipt.NewInvoice()
+	invoice.ConfidenceNotes = "Parsed from Textract OCR output"
+	invoice.Handwritten = textract.Handwritten
+	if textract.Handwritten {
+		invoice.ConfidenceNotes += ". " + handwrittenNote
+		invoice.Anomalies = append(invoice.Anomalies, handwrittenNote)
+	}
+	// Items come from a detected table when there is one, as on receipts
+	for _, item := range tableItems(textract) {
+		invoice.Items = append(invoice.Items, invoiceItem(item))
+	}
+	fromTable := len(invoice.Items) > 0
+
+	minConfidence := vendorConfidenceThreshold(textract)
+	labeled := make(map[string]bool) // Amounts whose label is printed, legible or not
+	// Whether the buyer's name or address line comes next
+	buyerName, buyerAddress := false, false
+
+	for i, line := range textract.Lines {
+		text := line.Text
+		lowerText := strings.ToLower(text)
+
+		// First high-confidence line is often the vendor
+		if i < 3 && line.Confidence > minConfidence && invoice.Vendor.Name == "" && len(text) > 3 && !strings.Contains(lowerText, "invoice") {
+			invoice.Vendor.Name = text
+		}
+
+		if invoice.InvoiceNumber == "" && strings.Contains(lowerText, "invoice") {
+			invoice.InvoiceNumber = extractIdentifier(invoiceNumberRegex, text)
+		}
+
+		if invoice.PONumber == "" {
+			invoice.PONumber = extractIdentifier(poNumberRegex, text)
+		}
+
+		if invoice.PaymentTerms == "" {
+			if m := termsRegex.FindString(text); m != "" {
+				invoice.PaymentTerms = m
+			}
+		}
+
+		// The buyer block: the billed party's name, on the label's line or
+		// the next, and the street address below it
+		if buyerName {
+			invoice.Buyer.Name, buyerName, buyerAddress = text, false, true
+			continue
+		}
+		if buyerAddress {
+			buyerAddress = false
+			if addressLineRegex.MatchString(text) && !centsRegex.MatchString(text) {
+				invoice.Buyer.Address = text
+				continue
+			}
+		}
+		if invoice.Buyer.Name == "" {
+			if m := buyerLabelRegex.FindStringSubmatch(text); m != nil {
+				name := strings.TrimSpace(shipToRegex.ReplaceAllString(m[1], ""))
+				if name == "" {
+					buyerName = true
+				} else {
+					invoice.Buyer.Name, buyerAddress = name, true
+				}
+				continue
+			}
+		}
+
+		if containsDate(text) {
+			date := dateRegex.FindString(text)
+			if strings.Contains(lowerText, "due") {
+				invoice.DueDate = date
+			} else if invoice.InvoiceDate == "" {
+				invoice.InvoiceDate = date
+			}
+			continue
+		}
+
+		field := ""
+		switch {
+		case strings.Contains(lowerText, "subtotal"):
+			field = "subtotal"
+		case strings.Contains(lowerText, "shipping"), strings.Contains(lowerText, "freight"):
+			field = "shipping"
+		case strings.Contains(lowerText, "amount due"), strings.Contains(lowerText, "balance due"):
+			field = "amount_due"
+		default:
+			field = amountField(lowerText)
+		}
+		if field != "" {
+			labeled[field] = true
+		}
+		if field == "tax" || field == "tax_line" {
+			labeled["tax"] = true
+			if line, ok := parseTaxLine(text); ok && field == "tax" {
+				invoice.Tax = receipt.Amount(line.Amount)
+			} else if ok {
+				// A tax summary below the total, as on VAT receipts, is
+				// already in it
+				line.Included = line.Included || invoice.Total != nil
+				invoice.TaxLines = append(invoice.TaxLines, line)
+			}
+			continue
+		}
+
+		// Look for dollar amounts
+		if containsPrice(text) {
+			price := extractPrice(text)
+
+			switch field {
+			case "subtotal":
+				invoice.Subtotal = receipt.Amount(price)
+			case "shipping":
+				invoice.Shipping = price
+			case "amount_due":
+				invoice.AmountDue = price
+			case "total":
+				invoice.Total = receipt.Amount(price)
+			case "":
+				// Line items come before the totals
+				if !fromTable && invoice.Subtotal == nil && invoice.Total == nil {
+					if item, ok := parseInvoiceItem(text); ok {
+						invoice.Items = append(invoice.Items, item)
+					}
+				}
+			}
+		}
+	}
+	invoice.FillTax()
+	invoice.TaxLines = detailedTaxLines(invoice.TaxLines)
+	for field, amount := range map[string]*float64{"subtotal": invoice.Subtotal, "tax": invoice.Tax, "total": invoice.Total} {
+		if amount == nil {
+			invoice.SetUnknown(field, unknownReason(labeled[field]))
+		}
+	}
+	invoice.CheckWrittenTotal(textractLineTexts(textract))
+	invoice.NoteNumeralFixes(numeralFixes)
+
+	return invoice
+}
+
+// invoiceItem converts an item read from a table to an invoice line item.
+// Tables give the line amount, so the unit price is worked out from it.
+func invoiceItem(item receipt.Item) receipt.InvoiceItem {
+	qty := max(item.Qty, 1)
+	return receipt.InvoiceItem{
+		SKU:         item.Code,
+		Description: item.Name,
+		Qty:         float64(qty),
+		UnitPrice:   item.Price / float64(qty),
+		Amount:      item.Price,
+	}
+}
+
+// parseInvoiceItem reads a line item from a line like "AB-220 Hinge, brass
+// 4 x 2.50 10.00": an optional SKU or part number, the description, an
+// optional quantity and unit price, and the line amount last. It reports
+// false for lines without a description or an amount in cents.
+func parseInvoiceItem(text string) (receipt.InvoiceItem, bool) {
+	amounts := centsRegex.FindAllStringIndex(text, -1)
+	if len(amounts) == 0 {
+		return receipt.InvoiceItem{}, false
+	}
+	last := text[amounts[len(amounts)-1][0]:amounts[len(amounts)-1][1]]
+	amount := extractPrice(last)
+	if strings.HasPrefix(last, "-") {
+		amount = -amount
+	}
+	item := receipt.InvoiceItem{Qty: 1, UnitPrice: amount, Amount: amount}
+
+	descEnd := amounts[0][0]
+	if m := invoiceQtyRegex.FindStringSubmatchIndex(text); m != nil {
+		qty, err := strconv.ParseFloat(text[m[2]:m[3]], 64)
+		if err == nil && qty > 0 {
+			item.Qty = qty
+			item.UnitPrice = extractPrice(text[m[4]:m[5]])
+		}
+		if m[0] < descEnd {
+			descEnd = m[0]
+		}
+	}
+
+	desc := text[:descEnd]
+	if sku := extractIdentifier(skuLabelRegex, desc); sku != "" {
+		item.SKU = sku
+		desc = skuLabelRegex.ReplaceAllString(desc, "")
+	} else if m := leadingCodeRegex.FindStringSubmatch(desc); m != nil && strings.ContainsAny(m[1], "0123456789") {
+		item.SKU = m[1]
+		desc = desc[len(m[0]):]
+	}
+	item.Description = receipt.NormalizeItemName(strings.Trim(desc, " \t:-$"))
+	if !strings.ContainsFunc(item.Description, isLetter) {
+		return receipt.InvoiceItem{}, false
+	}
+	return item, true
+}
+
+// isLetter reports whether r is an ASCII letter.
+func isLetter(r rune) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z'
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"os"
+	"testing"
+
+	"myprice/internal/receipt"
+)
+
+func TestParseTextractToInvoice(t *testing.T) {
+	text, err := os.ReadFile("../testdata/fake/office-supplies.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := parseTextractToInvoice(textDocument(string(text)))
+
+	if inv.Vendor.Name != "Harbor Office Supply Co." {
+		t.Errorf("vendor = %q", inv.Vendor.Name)
+	}
+	if inv.Buyer.Name != "Casco Bay Design LLC" {
+		t.Errorf("buyer = %q", inv.Buyer.Name)
+	}
+	if inv.InvoiceNumber != "INV-20417" || inv.InvoiceDate != "2026-03-02" || inv.DueDate != "2026-04-01" {
+		t.Errorf("invoice number, date, due date = %q, %q, %q", inv.InvoiceNumber, inv.InvoiceDate, inv.DueDate)
+	}
+	want := []receipt.InvoiceItem{
+		{Description: "Copy paper, letter, case", Qty: 2, UnitPrice: 42.50, Amount: 85.00},
+		{Description: "Toner cartridge, black", Qty: 1, UnitPrice: 119.99, Amount: 119.99},
+	}
+	if len(inv.Items) != len(want) {
+		t.Fatalf("items = %+v, want %d", inv.Items, len(want))
+	}
+	for i, item := range inv.Items {
+		if item != want[i] {
+			t.Errorf("item %d = %+v, want %+v", i, item, want[i])
+		}
+	}
+	for name, got := range map[string]*float64{"subtotal": inv.Subtotal, "tax": inv.Tax, "total": inv.Total} {
+		if got == nil {
+			t.Errorf("%s is null", name)
+		}
+	}
+}
+
+func TestParseTextractToInvoiceBuyerAndSKUs(t *testing.T) {
+	inv := parseTextractToInvoice(textDocument(`Ridgeline Hardware Supply
+INVOICE # 88231
+Bill To:                     Ship To: Dock 4
+Alder Street Builders
+42 Alder Street, Eugene, OR 97401
+SKU 44718 Wood screws, #8, box    3 x 6.25    18.75
+AB-220 Hinge, brass               4 @ 2.50    10.00
+Part # KX-9 Drawer slide                      14.10
+Subtotal                                      42.85
+Total                                         42.85`))
+
+	if inv.Buyer.Name != "Alder Street Builders" || inv.Buyer.Address != "42 Alder Street, Eugene, OR 97401" {
+		t.Errorf("buyer = %+v", inv.Buyer)
+	}
+	want := []receipt.InvoiceItem{
+		{SKU: "44718", Description: "Wood screws, #8, box", Qty: 3, UnitPrice: 6.25, Amount: 18.75},
+		{SKU: "AB-220", Description: "Hinge, brass", Qty: 4, UnitPrice: 2.50, Amount: 10.00},
+		{SKU: "KX-9", Description: "Drawer slide", Qty: 1, UnitPrice: 14.10, Amount: 14.10},
+	}
+	if len(inv.Items) != len(want) {
+		t.Fatalf("items = %+v, want %d", inv.Items, len(want))
+	}
+	for i, item := range inv.Items {
+		if item != want[i] {
+			t.Errorf("item %d = %+v, want %+v", i, item, want[i])
+		}
+	}
+}
@@ -2,8 +2,9 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,14 +14,44 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"myprice/internal/llmfiles"
+	"myprice/internal/rawresponse"
+	"myprice/internal/receipt"
 	"myprice/tools"
 )
 
+const (
+	// claudeModel is the model used for document parsing.
+	claudeModel = "claude-sonnet-4-20250514"
+
+	// receiptPromptVersion and invoicePromptVersion identify the prompts
+	// built below; bump them whenever a prompt changes so stored results
+	// can be found and reprocessed.
+	receiptPromptVersion = "receipt-v9"
+	invoicePromptVersion = "invoice-v6"
+)
+
 // ClaudeAPI handles calls to Anthropic's Claude API.
 type ClaudeAPI struct {
 	apiKey string
 	client *http.Client
+
+	// repairAttempts is how many times an invalid answer is sent back to
+	// the model with its problems before it is accepted as is.
+	repairAttempts int
+
+	// files records images uploaded to the Files API, which are referred
+	// to by ID instead of being sent again. Nil unless LLM_FILES_API is on.
+	files *llmfiles.Cache
+}
+
+// chatTurn is a text message following the first, image-bearing one, or
+// any message of a text-only conversation.
+type chatTurn struct {
+	Role    string `json:"role"` // "assistant" or "user"
+	Content string `json:"content"`
 }
 
 // NewClaudeAPI creates a new Claude API client.
@@ -36,18 +67,20 @@ func NewClaudeAPI() (*ClaudeAPI, error) {
 
 	// Validate API key format
 	if !strings.HasPrefix(apiKey, "sk-ant-") {
-		return nil, fmt.Errorf("API key format invalid: must start with 'sk-ant-' (got: %s...)", apiKey[:min(10, len(apiKey))])
+		return nil, fmt.Errorf("API key format invalid: must start with 'sk-ant-'")
 	}
 
 	if len(apiKey) < 20 {
 		return nil, fmt.Errorf("API key too short (length: %d)", len(apiKey))
 	}
 
-	log.Printf("Claude API key loaded: %s... (length: %d)", apiKey[:10], len(apiKey))
+	// Not even a prefix of the key is logged, as logs are kept and shipped
+	log.Printf("Claude API key loaded (length: %d)", len(apiKey))
 
 	return &ClaudeAPI{
-		apiKey: apiKey,
-		client: &http.Client{},
+		apiKey:         apiKey,
+		client:         &http.Client{},
+		repairAttempts: max(envInt("LLM_REPAIR_ATTEMPTS", 2), 0),
 	}, nil
 }
 
@@ -58,147 +91,391 @@ func min(a, b int) int {
 	return b
 }
 
-// ReceiptOutput represents the structured receipt output from the LLM.
-type ReceiptOutput struct {
-	Vendor          string   `json:"vendor"`
-	VendorFull      string   `json:"vendor_full,omitempty"`
-	Address         string   `json:"address,omitempty"`
-	Date            string   `json:"date"`
-	Time            string   `json:"time,omitempty"`
-	Items           []Item   `json:"items"`
-	Fees            []Fee    `json:"fees,omitempty"`
-	Subtotal        float64  `json:"subtotal"`
-	Tax             float64  `json:"tax"`
-	Total           float64  `json:"total"`
-	Server          string   `json:"server,omitempty"`
-	CheckNumber     string   `json:"check_number,omitempty"`
-	Table           string   `json:"table,omitempty"`
-	Customer        string   `json:"customer,omitempty"`
-	CartDescription string   `json:"cart_description,omitempty"`
-	ItemCategories  []string `json:"item_categories,omitempty"`
-	ConfidenceNotes string   `json:"confidence_notes"`
-	Anomalies       []string `json:"anomalies"`
+// ParseReceiptWithLLM uses Claude API to parse receipt from image and OCR
+// text, with the model and prompt of v. Without an imagePath, the OCR text
+// is a plain text receipt and is all the model gets.
+func (c *ClaudeAPI) ParseReceiptWithLLM(ctx context.Context, imagePath string, textractOutput tools.LoadTextractOutput, v llmVariant) (*receipt.Receipt, error) {
+	var parsed *receipt.Receipt
+	err := c.parseWithRepair(ctx, imagePath, v.Model, documentPrompt(imagePath, v.prompt(receipt.DocumentTypeReceipt, textractOutput)), func(jsonText string) ([]string, error) {
+		var err error
+		if parsed, err = decodeReceiptOutput(jsonText, textractOutput); err != nil {
+			return nil, err
+		}
+		return validateReceiptOutput(parsed), nil
+	}, func(issues []string) {
+		parsed.Anomalies = append(parsed.Anomalies, validationAnomalies(issues)...)
+	})
+	return parsed, err
 }
 
-// Item represents a line item on the receipt.
-type Item struct {
-	Name  string  `json:"name"`
-	Qty   int     `json:"qty"`
-	Price float64 `json:"price"`
+// ParseInvoiceWithLLM uses Claude API to parse an invoice from image and
+// OCR text, with the model and prompt of v, or from plain text alone as
+// ParseReceiptWithLLM does.
+func (c *ClaudeAPI) ParseInvoiceWithLLM(ctx context.Context, imagePath string, textractOutput tools.LoadTextractOutput, v llmVariant) (*receipt.Invoice, error) {
+	var invoice *receipt.Invoice
+	err := c.parseWithRepair(ctx, imagePath, v.Model, documentPrompt(imagePath, v.prompt(receipt.DocumentTypeInvoice, textractOutput)), func(jsonText string) ([]string, error) {
+		var err error
+		if invoice, err = decodeInvoiceOutput(jsonText, textractOutput); err != nil {
+			return nil, err
+		}
+		return validateInvoiceOutput(invoice), nil
+	}, func(issues []string) {
+		invoice.Anomalies = append(invoice.Anomalies, validationAnomalies(issues)...)
+	})
+	return invoice, err
 }
 
-// Fee represents a fee or surcharge on the receipt.
-type Fee struct {
-	Name   string  `json:"name"`
-	Rate   string  `json:"rate,omitempty"`
-	Amount float64 `json:"amount"`
-}
+// parseWithRepair sends prompt to model and checks the answer with check, which
+// decodes it and returns its validation problems. An answer that isn't
+// valid JSON or has problems is sent back with them, up to repairAttempts
+// times. If problems remain after that, the last answer that decoded is
+// kept and accept records its problems; only an answer that never decodes
+// is an error.
+func (c *ClaudeAPI) parseWithRepair(ctx context.Context, imagePath, model, prompt string, check func(jsonText string) ([]string, error), accept func(issues []string)) error {
+	var turns []chatTurn
+	var best string // Last answer that decoded
+	var bestIssues []string
+	var lastErr error
+	for attempt := 0; attempt <= c.repairAttempts; attempt++ {
+		if attempt > 0 {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Printf("Asking the model to correct its answer (attempt %d of %d)", attempt, c.repairAttempts)
+		}
+		jsonText, err := c.sendPrompt(ctx, imagePath, model, prompt, turns...)
+		if err != nil {
+			if best == "" {
+				return err
+			}
+			// A failed repair doesn't undo the answer we already have
+			log.Printf("Warning: correction request failed, keeping the previous answer: %v", err)
+			break
+		}
 
-// ParseReceiptWithLLM uses Claude API to parse receipt from image and OCR text.
-func (c *ClaudeAPI) ParseReceiptWithLLM(imagePath string, textractOutput tools.LoadTextractOutput) (*ReceiptOutput, error) {
-	// Read and encode image
-	imageData, err := os.ReadFile(imagePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read image: %w", err)
+		issues, err := check(jsonText)
+		noteParse(ctx, issues, err)
+		if err == nil {
+			if len(issues) == 0 {
+				if attempt > 0 {
+					log.Printf("Model answer passed validation after %d correction(s)", attempt)
+				}
+				return nil
+			}
+			best, bestIssues = jsonText, issues
+			log.Printf("Model answer has %d validation problem(s): %s", len(issues), strings.Join(issues, "; "))
+		} else {
+			lastErr = err
+			issues = []string{"the response is not valid JSON: " + err.Error()}
+		}
+		turns = append(turns, chatTurn{Role: "assistant", Content: jsonText}, chatTurn{Role: "user", Content: repairPrompt(issues)})
 	}
-	imageBase64 := base64.StdEncoding.EncodeToString(imageData)
 
-	// Detect MIME type from file extension
-	ext := filepath.Ext(imagePath)
-	mediaType := mime.TypeByExtension(ext)
-	if mediaType == "" {
-		// Fallback to common image types
-		switch strings.ToLower(ext) {
-		case ".jpg", ".jpeg":
-			mediaType = "image/jpeg"
-		case ".png":
-			mediaType = "image/png"
-		case ".gif":
-			mediaType = "image/gif"
-		case ".webp":
-			mediaType = "image/webp"
-		default:
-			mediaType = "image/jpeg" // Default fallback
-		}
+	if best == "" {
+		return lastErr
+	}
+	// Decode the kept answer again, since a later attempt may have replaced it
+	if _, err := check(best); err != nil {
+		return err
 	}
+	accept(bestIssues)
+	return nil
+}
 
-	// Build OCR text summary
+// validationAnomalies describes problems the model couldn't correct, for
+// the anomalies list.
+func validationAnomalies(issues []string) []string {
+	anomalies := make([]string, len(issues))
+	for i, issue := range issues {
+		anomalies[i] = "validation: " + issue
+	}
+	return anomalies
+}
+
+// buildPrompt returns the extraction prompt for a document type.
+func buildPrompt(docType receipt.DocumentType, textractOutput tools.LoadTextractOutput) string {
+	textractOutput, _ = normalizeNumerals(textractOutput)
 	ocrText := buildOCRText(textractOutput)
+	if docType == receipt.DocumentTypeInvoice {
+		return buildInvoicePrompt(ocrText, textractOutput.Handwritten)
+	}
+	return buildReceiptPrompt(ocrText, textractOutput.Handwritten)
+}
+
+// decodeReceiptOutput parses the model's JSON answer to a receipt prompt.
+func decodeReceiptOutput(jsonText string, textractOutput tools.LoadTextractOutput) (*receipt.Receipt, error) {
+	parsed := receipt.NewReceipt()
+	if err := json.Unmarshal([]byte(jsonText), parsed); err != nil {
+		log.Printf("Failed to parse JSON response: %v", err)
+		log.Printf("Response text: %s", jsonText)
+		return nil, fmt.Errorf("failed to parse JSON from LLM response: %w", err)
+	}
 
-	// Build the prompt
-	prompt := buildReceiptPrompt(ocrText)
+	// The model read the OCR text with its numerals normalized
+	textractOutput, numeralFixes := normalizeNumerals(textractOutput)
 
-	// Prepare Claude API request
-	requestBody := map[string]interface{}{
-		"model":      "claude-sonnet-4-20250514",
+	// The handwriting flag comes from Textract, not the model
+	parsed.Handwritten = textractOutput.Handwritten
+	parsed.NormalizeRefund()
+	parsed.CheckLineItems()
+	parsed.FillTax()
+	parsed.CheckWrittenTotal(textractLineTexts(textractOutput))
+	parsed.FillOutOfPocket()
+	parsed.NoteNumeralFixes(numeralFixes)
+
+	log.Printf("Successfully parsed receipt: vendor=%s, items=%d, total=$%.2f",
+		parsed.Vendor, len(parsed.Items), receipt.Value(parsed.Total))
+
+	return parsed, nil
+}
+
+// decodeInvoiceOutput parses the model's JSON answer to an invoice prompt.
+func decodeInvoiceOutput(jsonText string, textractOutput tools.LoadTextractOutput) (*receipt.Invoice, error) {
+	invoice := receipt.NewInvoice()
+	if err := json.Unmarshal([]byte(jsonText), invoice); err != nil {
+		log.Printf("Failed to parse JSON response: %v", err)
+		log.Printf("Response text: %s", jsonText)
+		return nil, fmt.Errorf("failed to parse JSON from LLM response: %w", err)
+	}
+
+	textractOutput, numeralFixes := normalizeNumerals(textractOutput)
+	invoice.Handwritten = textractOutput.Handwritten
+	invoice.CheckLineItems()
+	invoice.FillTax()
+	invoice.CheckWrittenTotal(textractLineTexts(textractOutput))
+	invoice.NoteNumeralFixes(numeralFixes)
+
+	log.Printf("Successfully parsed invoice: vendor=%s, number=%s, items=%d, total=$%.2f",
+		invoice.Vendor.Name, invoice.InvoiceNumber, len(invoice.Items), receipt.Value(invoice.Total))
+
+	return invoice, nil
+}
+
+// textOnlyNotice opens prompts for documents that arrived as plain text.
+const textOnlyNotice = `**Plain Text Notice:**
+There is no image of this document. It was provided as plain text, such as an email body or a digital receipt, and the OCR text below is that text, exactly as given. Wherever these instructions mention the image, use the text instead, and don't expect OCR errors.
+
+`
+
+// documentPrompt returns prompt as sent for a document at imagePath, or for
+// a plain text document when imagePath is empty.
+func documentPrompt(imagePath, prompt string) string {
+	if imagePath == "" {
+		return textOnlyNotice + prompt
+	}
+	return prompt
+}
+
+// sendPrompt sends prompt to a Claude model with the image at imagePath, or
+// alone when imagePath is empty, as sendImagePrompt and sendTextPrompt do.
+func (c *ClaudeAPI) sendPrompt(ctx context.Context, imagePath, model, prompt string, turns ...chatTurn) (string, error) {
+	if imagePath == "" {
+		return c.sendTextPrompt(ctx, model, prompt, turns...)
+	}
+	return c.sendImagePrompt(ctx, imagePath, model, prompt, turns...)
+}
+
+// sendTextPrompt sends prompt to a Claude model as a text-only message,
+// followed by any later turns, and returns the JSON text of the answer.
+func (c *ClaudeAPI) sendTextPrompt(ctx context.Context, model, prompt string, turns ...chatTurn) (string, error) {
+	messages := append([]chatTurn{{Role: "user", Content: prompt}}, turns...)
+	body, err := json.Marshal(map[string]any{
+		"model":      model,
 		"max_tokens": 4096,
-		"messages": []map[string]interface{}{
-			{
-				"role": "user",
-				"content": []map[string]interface{}{
-					{
-						"type": "image",
-						"source": map[string]interface{}{
-							"type":       "base64",
-							"media_type": mediaType,
-							"data":       imageBase64,
-						},
-					},
-					{
-						"type": "text",
-						"text": prompt,
-					},
-				},
-			},
-		},
-	}
-
-	jsonData, err := json.Marshal(requestBody)
+		"messages":   messages,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.anthropic.com/v1/messages", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.setHeaders(req)
+	return c.doMessages(ctx, req)
+}
+
+// sendImagePrompt sends the image and prompt to a Claude model, followed by any
+// later turns of the conversation, and returns the JSON text extracted from
+// the first content block of the response. With the Files API on, the
+// image is referred to by the ID of its upload instead. Cancelling ctx
+// aborts the request, including an upload in progress.
+func (c *ClaudeAPI) sendImagePrompt(ctx context.Context, imagePath, model, prompt string, turns ...chatTurn) (string, error) {
+	if c.files != nil {
+		if text, handled, err := c.sendFilePrompt(ctx, imagePath, model, prompt, turns...); handled {
+			return text, err
+		}
+	}
+
+	_, encodedSize, err := base64FileSize(imagePath)
+	if err != nil {
+		return "", err
+	}
+
+	// Prepare Claude API request. The image is base64-encoded straight into
+	// the request body as it is sent, so only the small JSON envelope around
+	// it is built in memory.
+	prefix, suffix, err := imageMessageEnvelope(model, imageMediaType(imagePath), prompt, turns...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
+		return "", fmt.Errorf("failed to marshal request: %w", err)
 	}
 
+	body, bodyWriter := io.Pipe()
+	go func() {
+		w := bufio.NewWriter(bodyWriter)
+		w.Write(prefix)
+		if err := streamBase64(w, imagePath); err != nil {
+			bodyWriter.CloseWithError(err)
+			return
+		}
+		w.Write(suffix)
+		bodyWriter.CloseWithError(w.Flush())
+	}()
+
 	// Make API call
-	req, err := http.NewRequest("POST", "https://api.anthropic.com/v1/messages", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.anthropic.com/v1/messages", body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		body.Close()
+		return "", fmt.Errorf("failed to create request: %w", err)
 	}
+	req.ContentLength = int64(len(prefix)) + encodedSize + int64(len(suffix))
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-api-key", c.apiKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
+	c.setHeaders(req)
+	return c.doMessages(ctx, req)
+}
 
-	log.Printf("Calling Claude API for receipt parsing...")
+// doMessages sends a Messages API request and returns the JSON text
+// extracted from the first content block of the response, counting the
+// tokens it used.
+func (c *ClaudeAPI) doMessages(ctx context.Context, req *http.Request) (string, error) {
+	log.Printf("Calling Claude API for document parsing...")
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("API request failed: %w", err)
+		return "", fmt.Errorf("API request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("Claude API error (status %d): %s", resp.StatusCode, string(body))
+		return "", &claudeAPIError{status: resp.StatusCode, body: string(body)}
 	}
 
 	// Parse response
 	var apiResponse struct {
-		Content []struct {
+		Model      string `json:"model"`
+		StopReason string `json:"stop_reason"`
+		Content    []struct {
 			Type string `json:"type"`
 			Text string `json:"text"`
 		} `json:"content"`
+		Usage rawresponse.Usage `json:"usage"`
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&apiResponse); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+		return "", fmt.Errorf("failed to decode response: %w", err)
 	}
+	countTokens(ctx, apiResponse.Usage.InputTokens, apiResponse.Usage.OutputTokens)
+
+	raw := rawresponse.Response{
+		Time:       time.Now().UTC(),
+		Model:      apiResponse.Model,
+		StopReason: apiResponse.StopReason,
+		Usage:      apiResponse.Usage,
+	}
+	if len(apiResponse.Content) > 0 {
+		raw.Text = apiResponse.Content[0].Text
+	}
+	recordResponse(ctx, raw)
 
 	if len(apiResponse.Content) == 0 {
-		return nil, fmt.Errorf("empty response from Claude API")
+		return "", fmt.Errorf("empty response from Claude API")
 	}
 
-	// Extract JSON from response (may be wrapped in markdown code blocks or have extra text)
-	jsonText := apiResponse.Content[0].Text
-	jsonText = strings.TrimSpace(jsonText)
+	return extractJSONText(apiResponse.Content[0].Text), nil
+}
+
+// claudeAPIError is an error response from the Claude API.
+type claudeAPIError struct {
+	status int
+	body   string
+}
+
+func (e *claudeAPIError) Error() string {
+	return fmt.Sprintf("Claude API error (status %d): %s", e.status, e.body)
+}
+
+// mentionsFile reports whether the error is about the uploaded file with
+// the given ID, such as one that was deleted.
+func (e *claudeAPIError) mentionsFile(fileID string) bool {
+	return e.status >= 400 && e.status < 500 && strings.Contains(e.body, fileID)
+}
+
+// setHeaders adds the authentication and version headers to an API request.
+func (c *ClaudeAPI) setHeaders(req *http.Request) {
+	req.Header.Set("x-api-key", c.apiKey)
+	req.Header.Set("anthropic-version", "2023-06-01")
+}
+
+// imageMediaType detects an image's MIME type from its file extension.
+func imageMediaType(imagePath string) string {
+	ext := filepath.Ext(imagePath)
+	if mediaType := mime.TypeByExtension(ext); mediaType != "" {
+		return mediaType
+	}
+
+	// Fallback to common image types
+	switch strings.ToLower(ext) {
+	case ".png":
+		return "image/png"
+	case ".gif":
+		return "image/gif"
+	case ".webp":
+		return "image/webp"
+	default:
+		return "image/jpeg"
+	}
+}
+
+// imageMessageEnvelope returns the JSON for a Messages API request to model
+// with one base64 image block and one text block, then any later turns,
+// split around the image data so the caller can stream the encoded image
+// between the two halves.
+func imageMessageEnvelope(model, mediaType, prompt string, turns ...chatTurn) ([]byte, []byte, error) {
+	modelJSON, err := json.Marshal(model)
+	if err != nil {
+		return nil, nil, err
+	}
+	mediaTypeJSON, err := json.Marshal(mediaType)
+	if err != nil {
+		return nil, nil, err
+	}
+	promptJSON, err := json.Marshal(prompt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prefix := `{"model":` + string(modelJSON) + `,"max_tokens":4096,"messages":[{"role":"user","content":[` +
+		`{"type":"image","source":{"type":"base64","media_type":` + string(mediaTypeJSON) + `,"data":"`
+	suffix := `"}},{"type":"text","text":` + string(promptJSON) + `}]}`
+	for _, turn := range turns {
+		turnJSON, err := json.Marshal(turn)
+		if err != nil {
+			return nil, nil, err
+		}
+		suffix += "," + string(turnJSON)
+	}
+	suffix += `]}`
+
+	return []byte(prefix), []byte(suffix), nil
+}
+
+// extractJSONText strips markdown fences and surrounding prose from a model
+// response, returning the outermost JSON object.
+func extractJSONText(text string) string {
+	jsonText := strings.TrimSpace(text)
 
 	// Remove markdown code blocks if present
 	jsonText = strings.TrimPrefix(jsonText, "```json")
@@ -215,44 +492,94 @@ func (c *ClaudeAPI) ParseReceiptWithLLM(imagePath string, textractOutput tools.L
 		}
 	}
 
-	// Parse JSON into ReceiptOutput
-	var receipt ReceiptOutput
-	if err := json.Unmarshal([]byte(jsonText), &receipt); err != nil {
-		log.Printf("Failed to parse JSON response: %v", err)
-		log.Printf("Response text: %s", jsonText)
-		return nil, fmt.Errorf("failed to parse JSON from LLM response: %w", err)
-	}
-
-	log.Printf("Successfully parsed receipt: vendor=%s, items=%d, total=$%.2f",
-		receipt.Vendor, len(receipt.Items), receipt.Total)
-
-	return &receipt, nil
+	return jsonText
 }
 
 // buildOCRText formats the Textract output into a readable text summary.
 func buildOCRText(textract tools.LoadTextractOutput) string {
+	if len(textract.Lines) == 0 {
+		return "OCR Results: none. OCR found no text or was unavailable; read every field from the image.\n"
+	}
+
 	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("OCR Results (%d lines, %d pages):\n\n", len(textract.Lines), textract.PageCount))
+	sb.WriteString(fmt.Sprintf("OCR Results (%d lines, %d pages, %d handwritten):\n", len(textract.Lines), textract.PageCount, textract.HandwrittenLines))
+	if len(textract.Blocks) > 0 {
+		sb.WriteString("Lines are grouped into blocks by layout analysis. The grouping is a hint and may be wrong.\n")
+	}
+	sb.WriteString("\n")
 
 	for i, line := range textract.Lines {
-		sb.WriteString(fmt.Sprintf("%d. [%.1f%% confidence] %s\n", i+1, line.Confidence, line.Text))
+		if line.Block != "" && (i == 0 || textract.Lines[i-1].Block != line.Block) {
+			sb.WriteString(fmt.Sprintf("[%s]\n", line.Block))
+		}
+		marker := ""
+		if line.Handwritten {
+			marker = " [handwritten]"
+		}
+		sb.WriteString(fmt.Sprintf("%d. [%.1f%% confidence]%s %s\n", i+1, line.Confidence, marker, line.Text))
+	}
+
+	for i, table := range textract.Tables {
+		sb.WriteString(fmt.Sprintf("\nTable %d (%.1f%% confidence, cells separated by |", i+1, table.Confidence))
+		if table.Columns.Item >= 0 && table.Columns.Price >= 0 {
+			sb.WriteString(fmt.Sprintf("; item in column %d, price in column %d", table.Columns.Item+1, table.Columns.Price+1))
+			if table.Columns.Qty >= 0 {
+				sb.WriteString(fmt.Sprintf(", quantity in column %d", table.Columns.Qty+1))
+			}
+		}
+		sb.WriteString("):\n")
+		for _, row := range table.Rows {
+			sb.WriteString("| " + strings.Join(row, " | ") + " |\n")
+		}
 	}
 
 	return sb.String()
 }
 
+// handwritingGuidance is added to prompts when Textract reports a mostly handwritten document.
+const handwritingGuidance = `
+**Handwriting Notice:**
+This document is mostly handwritten. OCR confidence on handwriting is low and the OCR text is often wrong or incomplete.
+- Rely primarily on the image; use the OCR text only as a hint.
+- Read numbers carefully (1/7, 4/9, 5/S, 0/6 are commonly confused in handwriting).
+- Still extract every field you can read, even if uncertain, rather than leaving fields empty.
+- List each uncertain reading in the anomalies array and explain overall legibility in confidence_notes.
+`
+
+// unknownAmountsGuidance has the model decide which totals are printed
+// before reading them, so a zero is never a guess. It is indented to sit
+// under a numbered instruction.
+const unknownAmountsGuidance = `   - Work in two passes. First decide, for each of subtotal, tax, and total, whether the document prints it at all. Then read each one that is printed.
+   - A printed amount of zero (e.g. "TAX 0.00") is 0. Never write 0 for an amount you couldn't find or read.
+   - An amount written in words is printed: convert it to a number (e.g. "twenty-three dollars and fifty cents" or "Twenty-three and 50/100" is 23.50). When both words and digits are given and they disagree, use the one the image supports and note the other in anomalies.
+   - An amount that isn't printed is null, with "absent" for it in the unknown object (e.g. no tax line on a tax-free purchase).
+   - An amount whose label is printed but whose value is torn, faded, cut off, or otherwise illegible is null, with "unreadable" for it in the unknown object. Don't compute it from the other amounts.`
+
+// taxLinesGuidance has the model itemize taxes that are printed separately,
+// keeping tax as their total. It is indented like unknownAmountsGuidance.
+const taxLinesGuidance = `   - When the document prints more than one tax, a tax rate, or tax already included in the prices, list each tax line in tax_lines: its name as printed (e.g. "VAT", "State Tax", "County Tax", "GST", "CRV"), its rate in percent (20 for 20%), the net base it applies to when printed, and its amount. Bottle and container deposits are tax lines too, not fees or items.
+   - Mark a tax line included when its amount is already in the prices, as with VAT on most receipts outside the US ("VAT included", "incl. VAT", or a VAT summary below the total). Included tax is not added to the subtotal again.
+   - tax is always the total of all tax lines. Omit tax_lines for a single tax line with no rate.`
+
 // buildReceiptPrompt creates the prompt for Claude to parse the receipt.
-func buildReceiptPrompt(ocrText string) string {
+func buildReceiptPrompt(ocrText string, handwritten bool) string {
+	guidance := ""
+	if handwritten {
+		guidance = handwritingGuidance
+	}
+
 	return `You are a receipt parsing expert. Analyze the receipt image and OCR text to extract structured data.
 
 **OCR Text Data:**
-` + ocrText + `
+` + ocrText + guidance + `
 
 **Instructions:**
 1. Extract vendor information:
    - Vendor name (short/common name)
    - Vendor full name (if different from short name)
    - Address (if present)
+   - Store number (if printed, e.g. "Store #0456" or "ST# 0456"; digits only, as printed with leading zeros)
+   - Phone number (if present)
 
 2. Extract date and time:
    - Date (normalize to ISO format: YYYY-MM-DD)
@@ -260,14 +587,19 @@ func buildReceiptPrompt(ocrText string) string {
 
 3. Extract all line items:
    - Item name (clean up OCR errors intelligently)
+   - Item code (if printed with the item, e.g. a UPC or warehouse item number; digits only, not part of the name)
    - Quantity (if specified, default to 1)
    - Price (per item or total for that line)
+   - Unit price, only when printed alongside the quantity (e.g. "2 @ 1.99"); price is then the line total
 
 4. Extract financial totals:
    - Subtotal
    - Tax
    - Fees (service fees, tips, surcharges, etc.)
    - Total
+` + unknownAmountsGuidance + `
+` + taxLinesGuidance + `
+   - Tenders: each way the total was paid, in order, from the payment lines below the total. Type is card, cash, gift_card, store_credit (store or merchandise credit, reward certificates), ebt, or other. The amount is what the tender paid toward the total: cash tendered less the change. A split payment, such as part on a gift card and the rest on a credit card, is one tender each. Skip gift card balances and cash back. Omit tenders when no payment lines are printed.
 
 5. Extract context information (if present):
    - Server/waitstaff name
@@ -282,13 +614,21 @@ func buildReceiptPrompt(ocrText string) string {
    - Handle multi-line item names
 
 7. Note any anomalies or low-confidence extractions in the anomalies array.
+   - If this is a return or refund receipt (marked REFUND, RETURN, or MERCHANDISE RETURN, or with a negative total), set refund to true and give the returned items, subtotal, tax, and total as negative amounts, even where the receipt prints them without a minus sign. Items bought in the same transaction, as in an exchange, stay positive. A return policy printed on an ordinary receipt doesn't make it a refund.
 
-8. Generate a cart description:
+8. Extract loyalty/membership details (if present):
+   - Program name (e.g., "Ralphs Rewards", "Costco Executive Member", "CVS ExtraCare")
+   - Member/rewards number exactly as printed (keep masking like ****1234)
+   - Points earned, points redeemed, and points balance
+   - Member savings: the total discount attributed to the loyalty card or membership ("Card Savings", "You Saved", "Member Savings")
+   - Omit the loyalty object entirely if the receipt shows no loyalty program
+
+9. Generate a cart description:
    - Write a brief narrative description (2-4 sentences) summarizing what was purchased
    - Describe the shopping pattern or theme (e.g., "Weekly grocery shopping with focus on fresh produce and dairy", "Quick convenience store stop for snacks and beverages", "Restaurant meal with multiple courses and drinks")
    - Include context about the type of purchase (grocery shopping, restaurant meal, convenience store, etc.)
 
-9. Categorize the items:
+10. Categorize the items:
    - Identify the main categories/types of items purchased
    - Use common categories like: produce, dairy, meat, seafood, beverages, snacks, frozen, bakery, deli, prepared_foods, alcohol, household, personal_care, etc.
    - Include all relevant categories (items can belong to multiple categories)
@@ -299,21 +639,32 @@ func buildReceiptPrompt(ocrText string) string {
   "vendor": "string",
   "vendor_full": "string (optional)",
   "address": "string (optional)",
+  "store_number": "string (optional)",
+  "phone": "string (optional)",
   "date": "YYYY-MM-DD",
   "time": "HH:MM AM/PM (optional)",
   "items": [
-    {"name": "string", "qty": number, "price": number}
+    {"name": "string", "code": "string (optional)", "qty": number, "price": number, "unit_price": number (optional)}
   ],
   "fees": [
     {"name": "string", "rate": "string (optional)", "amount": number}
   ],
-  "subtotal": number,
-  "tax": number,
-  "total": number,
+  "subtotal": number or null,
+  "tax": number or null,
+  "tax_lines": [
+    {"name": "string", "rate": number (optional), "base": number (optional), "amount": number, "included": boolean (optional)}
+  ] (optional),
+  "total": number or null,
+  "unknown": {"<subtotal, tax, or total>": "absent or unreadable"} (only for null amounts),
+  "refund": boolean (optional, true for return and refund receipts),
+  "tenders": [
+    {"type": "card, cash, gift_card, store_credit, ebt, or other", "name": "string (as printed, optional)", "amount": number, "card_last4": "string (optional)"}
+  ] (optional),
   "server": "string (optional)",
   "check_number": "string (optional)",
   "table": "string (optional)",
   "customer": "string (optional)",
+  "loyalty": {"program": "string", "member_number": "string", "points_earned": number, "points_redeemed": number, "points_balance": number, "member_savings": number} (optional),
   "cart_description": "string - brief narrative description of the shopping cart/purchase (2-4 sentences)",
   "item_categories": ["string array of item categories like: produce, dairy, meat, beverages, snacks, etc."],
   "confidence_notes": "string describing confidence level and any issues",
@@ -322,3 +673,71 @@ func buildReceiptPrompt(ocrText string) string {
 
 **CRITICAL:** Return ONLY valid JSON. Do not include markdown code blocks, explanations, or any text before or after the JSON. Start with { and end with }.`
 }
+
+// buildInvoicePrompt creates the prompt for Claude to parse an invoice.
+func buildInvoicePrompt(ocrText string, handwritten bool) string {
+	guidance := ""
+	if handwritten {
+		guidance = handwritingGuidance
+	}
+
+	return `You are an invoice parsing expert. Analyze the invoice image and OCR text to extract structured data.
+
+**OCR Text Data:**
+` + ocrText + guidance + `
+
+**Instructions:**
+1. Extract the vendor (seller) block: name, address, phone, email, tax ID (if present).
+
+2. Extract the buyer block ("Bill To", "Sold To", "Customer"): name, address, phone, email (if present).
+   - If both "Bill To" and "Ship To" are present, use "Bill To" for the buyer.
+
+3. Extract invoice identifiers and dates:
+   - Invoice number
+   - Purchase order (PO) number, if referenced
+   - Invoice date (normalize to ISO format: YYYY-MM-DD)
+   - Due date (normalize to ISO format: YYYY-MM-DD). If only payment terms like "Net 30" are given, compute it from the invoice date.
+   - Payment terms exactly as written (e.g., "Net 30", "Due on receipt", "2/10 Net 30")
+   - Currency code if stated or implied (e.g., "USD")
+
+4. Extract all line items:
+   - SKU / part number / item code (if present)
+   - Description (clean up OCR errors intelligently)
+   - Quantity (default to 1)
+   - Unit price
+   - Line amount (quantity × unit price as printed)
+
+5. Extract financial totals: subtotal, tax, shipping/freight, total, and amount due (if different from total because of deposits or prior payments).
+` + unknownAmountsGuidance + `
+` + taxLinesGuidance + `
+
+6. Note any anomalies or low-confidence extractions in the anomalies array (e.g., line amounts that don't match quantity × unit price).
+
+**Output Format (JSON only, no markdown):**
+{
+  "vendor": {"name": "string", "address": "string (optional)", "phone": "string (optional)", "email": "string (optional)", "tax_id": "string (optional)"},
+  "buyer": {"name": "string", "address": "string (optional)", "phone": "string (optional)", "email": "string (optional)"},
+  "invoice_number": "string",
+  "po_number": "string (optional)",
+  "invoice_date": "YYYY-MM-DD",
+  "due_date": "YYYY-MM-DD (optional)",
+  "payment_terms": "string (optional)",
+  "currency": "string (optional)",
+  "items": [
+    {"sku": "string (optional)", "description": "string", "qty": number, "unit_price": number, "amount": number}
+  ],
+  "subtotal": number or null,
+  "tax": number or null,
+  "tax_lines": [
+    {"name": "string", "rate": number (optional), "base": number (optional), "amount": number, "included": boolean (optional)}
+  ] (optional),
+  "shipping": number,
+  "total": number or null,
+  "amount_due": number,
+  "unknown": {"<subtotal, tax, or total>": "absent or unreadable"} (only for null amounts),
+  "confidence_notes": "string describing confidence level and any issues",
+  "anomalies": ["string array of any anomalies or uncertainties"]
+}
+
+**CRITICAL:** Return ONLY valid JSON. Do not include markdown code blocks, explanations, or any text before or after the JSON. Start with { and end with }.`
+}
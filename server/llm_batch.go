@@ -0,0 +1,262 @@
+// Package server provides LLM integration for receipt parsing.
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+const (
+	// batchesURL is the Message Batches API endpoint.
+	batchesURL = "https://api.anthropic.com/v1/messages/batches"
+
+	// maxBatchBytes keeps each batch under the API's 256MB request limit,
+	// leaving room for JSON framing.
+	maxBatchBytes = 240 << 20
+	// maxBatchRequests is the API's limit on requests per batch.
+	maxBatchRequests = 100_000
+)
+
+// batchRequest is one image prompt to include in a batch.
+type batchRequest struct {
+	CustomID  string // Echoed back with the result; [a-zA-Z0-9_-]{1,64}
+	ImagePath string
+	Prompt    string
+}
+
+// MessageBatch is the status of a submitted batch.
+type MessageBatch struct {
+	ID               string `json:"id"`
+	ProcessingStatus string `json:"processing_status"` // "in_progress", "canceling", or "ended"
+	RequestCounts    struct {
+		Processing int `json:"processing"`
+		Succeeded  int `json:"succeeded"`
+		Errored    int `json:"errored"`
+		Canceled   int `json:"canceled"`
+		Expired    int `json:"expired"`
+	} `json:"request_counts"`
+	ResultsURL string `json:"results_url"`
+}
+
+// batchResult is one line of a batch's results file.
+type batchResult struct {
+	CustomID string `json:"custom_id"`
+	Result   struct {
+		Type    string `json:"type"` // "succeeded", "errored", "canceled", or "expired"
+		Message struct {
+			Content []struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"content"`
+		} `json:"message"`
+		Error struct {
+			Error struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			} `json:"error"`
+		} `json:"error"`
+	} `json:"result"`
+}
+
+// batchEntry is one request's encoded framing around its streamed image.
+type batchEntry struct {
+	prefix, suffix []byte
+	imagePath      string
+	encodedSize    int64
+}
+
+// size returns the number of body bytes the request contributes.
+func (e batchEntry) size() int64 {
+	return int64(len(e.prefix)) + e.encodedSize + int64(len(e.suffix))
+}
+
+// newBatchEntry frames one request, leaving the image to be streamed.
+func newBatchEntry(r batchRequest) (batchEntry, error) {
+	_, encodedSize, err := base64FileSize(r.ImagePath)
+	if err != nil {
+		return batchEntry{}, err
+	}
+	prefix, suffix, err := imageMessageEnvelope(claudeModel, imageMediaType(r.ImagePath), r.Prompt)
+	if err != nil {
+		return batchEntry{}, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	customID, err := json.Marshal(r.CustomID)
+	if err != nil {
+		return batchEntry{}, err
+	}
+
+	return batchEntry{
+		prefix:      append([]byte(`{"custom_id":`+string(customID)+`,"params":`), prefix...),
+		suffix:      append(suffix, '}'),
+		imagePath:   r.ImagePath,
+		encodedSize: encodedSize,
+	}, nil
+}
+
+// splitBatches groups requests into batches that fit the API's limits.
+func splitBatches(requests []batchRequest) ([][]batchRequest, error) {
+	var batches [][]batchRequest
+	var current []batchRequest
+	var size int64
+	for _, r := range requests {
+		entry, err := newBatchEntry(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", r.CustomID, err)
+		}
+		if entry.size() > maxBatchBytes {
+			return nil, fmt.Errorf("%s: image too large for a batch", r.CustomID)
+		}
+		if len(current) > 0 && (size+entry.size() > maxBatchBytes || len(current) >= maxBatchRequests) {
+			batches = append(batches, current)
+			current, size = nil, 0
+		}
+		current = append(current, r)
+		size += entry.size() + 1
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+	return batches, nil
+}
+
+// CreateBatch submits image prompts as one message batch. Like
+// sendImagePrompt, images are base64-encoded into the body as it is sent.
+func (c *ClaudeAPI) CreateBatch(ctx context.Context, requests []batchRequest) (*MessageBatch, error) {
+	entries := make([]batchEntry, len(requests))
+	length := int64(len(`{"requests":[]}`))
+	for i, r := range requests {
+		entry, err := newBatchEntry(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", r.CustomID, err)
+		}
+		entries[i] = entry
+		length += entry.size()
+		if i > 0 {
+			length++ // comma
+		}
+	}
+
+	body, bodyWriter := io.Pipe()
+	go func() {
+		w := bufio.NewWriter(bodyWriter)
+		w.WriteString(`{"requests":[`)
+		for i, e := range entries {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.Write(e.prefix)
+			if err := streamBase64(w, e.imagePath); err != nil {
+				bodyWriter.CloseWithError(err)
+				return
+			}
+			w.Write(e.suffix)
+		}
+		w.WriteString(`]}`)
+		bodyWriter.CloseWithError(w.Flush())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", batchesURL, body)
+	if err != nil {
+		body.Close()
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Type", "application/json")
+	c.setHeaders(req)
+
+	log.Printf("Submitting message batch (%d requests, %d bytes)...", len(requests), length)
+	var batch MessageBatch
+	if err := c.doJSON(req, &batch); err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// GetBatch returns the current status of a batch.
+func (c *ClaudeAPI) GetBatch(ctx context.Context, id string) (*MessageBatch, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", batchesURL+"/"+id, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	c.setHeaders(req)
+
+	var batch MessageBatch
+	if err := c.doJSON(req, &batch); err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// BatchResults streams an ended batch's results, calling fn with each
+// request's JSON answer or its error.
+func (c *ClaudeAPI) BatchResults(ctx context.Context, batch *MessageBatch, fn func(customID, jsonText string, err error)) error {
+	if batch.ResultsURL == "" {
+		return fmt.Errorf("batch %s has no results yet", batch.ID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", batch.ResultsURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	c.setHeaders(req)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("Claude API error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var line batchResult
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return fmt.Errorf("failed to decode batch result: %w", err)
+		}
+
+		switch {
+		case line.Result.Type != "succeeded":
+			msg := line.Result.Type
+			if e := line.Result.Error.Error; e.Message != "" {
+				msg = fmt.Sprintf("%s: %s", e.Type, e.Message)
+			}
+			fn(line.CustomID, "", fmt.Errorf("batch request %s", msg))
+		case len(line.Result.Message.Content) == 0:
+			fn(line.CustomID, "", fmt.Errorf("empty response from Claude API"))
+		default:
+			fn(line.CustomID, extractJSONText(line.Result.Message.Content[0].Text), nil)
+		}
+	}
+	return scanner.Err()
+}
+
+// doJSON sends req and decodes a successful JSON response into v.
+func (c *ClaudeAPI) doJSON(req *http.Request, v any) error {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("Claude API error (status %d): %s", resp.StatusCode, string(body))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"myprice/internal/crypt"
+	"myprice/internal/llmfiles"
+)
+
+const (
+	// filesURL is the Anthropic Files API, and filesBeta the beta header
+	// that enables it, on uploads and on messages referring to uploads.
+	filesURL  = "https://api.anthropic.com/v1/files"
+	filesBeta = "files-api-2025-04-14"
+
+	// defaultLLMFilesMaxAge is how long an uploaded image is referred to
+	// before it is deleted and uploaded again, when LLM_FILES_MAX_AGE isn't
+	// set.
+	defaultLLMFilesMaxAge = 7 * 24 * time.Hour
+
+	// filesDeleteTimeout bounds each request deleting an uploaded image.
+	filesDeleteTimeout = 30 * time.Second
+)
+
+// llmFilesConfig opens the cache of images uploaded to the Files API, in
+// LLM_FILES_CACHE or llm_files.json under projectRoot, when LLM_FILES_API
+// is on. It returns nil when it is off or the cache can't be opened, and
+// images are sent inline with each request.
+func llmFilesConfig(projectRoot string, cipher *crypt.Cipher) *llmfiles.Cache {
+	if v := os.Getenv("LLM_FILES_API"); v != "true" && v != "1" {
+		return nil
+	}
+	path := os.Getenv("LLM_FILES_CACHE")
+	if path == "" {
+		path = filepath.Join(projectRoot, "llm_files.json")
+	}
+	files, err := llmfiles.Open(path, envDuration("LLM_FILES_MAX_AGE", defaultLLMFilesMaxAge), cipher)
+	if err != nil {
+		log.Printf("Warning: could not open Files API cache: %v. Images will be sent with each request.", err)
+		return nil
+	}
+	log.Printf("Uploading images to the Files API once, recorded in %s", path)
+	return files
+}
+
+// claudeFile is the Files API's description of an uploaded file.
+type claudeFile struct {
+	ID        string `json:"id"`
+	MimeType  string `json:"mime_type"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// sendFilePrompt sends the image at imagePath and prompt to a Claude model
+// as sendImagePrompt does, but refers to the image by the ID it was given
+// when uploaded to the Files API, uploading it first if it hasn't been.
+// handled is false when the Files API couldn't be used, and the caller
+// should send the image inline instead.
+func (c *ClaudeAPI) sendFilePrompt(ctx context.Context, imagePath, model, prompt string, turns ...chatTurn) (text string, handled bool, err error) {
+	fileID, err := c.imageFileID(ctx, imagePath)
+	if err != nil {
+		if isCancellation(err) {
+			return "", true, err
+		}
+		log.Printf("Warning: could not upload image to the Files API: %v. Sending it with the request.", err)
+		return "", false, nil
+	}
+
+	messages := []any{map[string]any{
+		"role": "user",
+		"content": []any{
+			map[string]any{"type": "image", "source": map[string]string{"type": "file", "file_id": fileID}},
+			map[string]any{"type": "text", "text": prompt},
+		},
+	}}
+	for _, turn := range turns {
+		messages = append(messages, turn)
+	}
+	body, err := json.Marshal(map[string]any{
+		"model":      model,
+		"max_tokens": 4096,
+		"messages":   messages,
+	})
+	if err != nil {
+		return "", true, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.anthropic.com/v1/messages", bytes.NewReader(body))
+	if err != nil {
+		return "", true, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("anthropic-beta", filesBeta)
+	c.setHeaders(req)
+	text, err = c.doMessages(ctx, req)
+
+	// A file deleted outside the server, or expired by the API, is
+	// forgotten so the image is uploaded again next time
+	var apiErr *claudeAPIError
+	if errors.As(err, &apiErr) && apiErr.mentionsFile(fileID) {
+		log.Printf("Uploaded image %s is gone from the Files API; sending the image with the request", fileID)
+		c.files.ForgetFile(fileID)
+		return "", false, nil
+	}
+	return text, true, err
+}
+
+// imageFileID returns the Files API ID of the image at imagePath,
+// uploading it if it hasn't been, or its upload has expired. Expired
+// uploads are deleted as new ones are made.
+func (c *ClaudeAPI) imageFileID(ctx context.Context, imagePath string) (string, error) {
+	sha, err := fileSHA256(imagePath)
+	if err != nil {
+		return "", err
+	}
+	entry, cached, err := c.files.Lookup(sha, func() (llmfiles.Entry, error) {
+		go c.deleteFiles(c.files.TakeExpired())
+		return c.uploadFile(ctx, imagePath, sha)
+	})
+	if err != nil {
+		return "", err
+	}
+	if cached {
+		log.Printf("Referring to uploaded image %s", entry.FileID)
+	}
+	return entry.FileID, nil
+}
+
+// uploadFile uploads the image at imagePath, whose SHA-256 is sha, to the
+// Files API. It is uploaded under a name made from its hash rather than its
+// own, which may say whose receipt it is.
+func (c *ClaudeAPI) uploadFile(ctx context.Context, imagePath, sha string) (llmfiles.Entry, error) {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return llmfiles.Entry{}, fmt.Errorf("failed to open image: %w", err)
+	}
+	defer f.Close()
+
+	mediaType := imageMediaType(imagePath)
+	body, bodyWriter := io.Pipe()
+	form := multipart.NewWriter(bodyWriter)
+	go func() {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s%s"`, sha[:16], strings.ToLower(filepath.Ext(imagePath))))
+		header.Set("Content-Type", mediaType)
+		part, err := form.CreatePart(header)
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		bodyWriter.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", filesURL, body)
+	if err != nil {
+		body.Close()
+		return llmfiles.Entry{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("anthropic-beta", filesBeta)
+	c.setHeaders(req)
+
+	log.Printf("Uploading image to the Files API...")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return llmfiles.Entry{}, fmt.Errorf("upload failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return llmfiles.Entry{}, &claudeAPIError{status: resp.StatusCode, body: string(data)}
+	}
+
+	var file claudeFile
+	if err := json.NewDecoder(resp.Body).Decode(&file); err != nil {
+		return llmfiles.Entry{}, fmt.Errorf("failed to decode upload response: %w", err)
+	}
+	if file.ID == "" {
+		return llmfiles.Entry{}, fmt.Errorf("upload response has no file ID")
+	}
+	log.Printf("Uploaded image as %s (%d bytes)", file.ID, file.SizeBytes)
+	return llmfiles.Entry{FileID: file.ID, MediaType: mediaType, Size: file.SizeBytes, UploadedAt: time.Now().UTC()}, nil
+}
+
+// deleteFiles deletes uploaded images from the Files API, logging the ones
+// that fail. A file that is already gone counts as deleted.
+func (c *ClaudeAPI) deleteFiles(entries []llmfiles.Entry) {
+	for _, e := range entries {
+		ctx, cancel := context.WithTimeout(context.Background(), filesDeleteTimeout)
+		err := c.deleteFile(ctx, e.FileID)
+		cancel()
+		if err != nil {
+			log.Printf("Warning: failed to delete uploaded image %s from the Files API: %v", e.FileID, err)
+		}
+	}
+}
+
+// deleteFile deletes one uploaded file from the Files API.
+func (c *ClaudeAPI) deleteFile(ctx context.Context, fileID string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", filesURL+"/"+fileID, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("anthropic-beta", filesBeta)
+	c.setHeaders(req)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		data, _ := io.ReadAll(resp.Body)
+		return &claudeAPIError{status: resp.StatusCode, body: string(data)}
+	}
+	return nil
+}
+
+// forgetUploadedImages deletes the Files API uploads of the images with the
+// given hashes, once the images themselves have been erased.
+func (s *Server) forgetUploadedImages(shas []string) {
+	if s.claudeAPI == nil || s.claudeAPI.files == nil || len(shas) == 0 {
+		return
+	}
+	if gone := s.claudeAPI.files.Forget(shas...); len(gone) > 0 {
+		log.Printf("Deleting %d erased images from the Files API", len(gone))
+		go s.claudeAPI.deleteFiles(gone)
+	}
+}
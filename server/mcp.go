@@ -0,0 +1,103 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"myprice/internal/progress"
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+	"myprice/tools"
+)
+
+// Analyze runs the full pipeline for the analyze_image MCP tool and stores
+// the result as handleAnalyze does. Pipeline stages are reported to any
+// progress reporter on ctx. Cancelling the call aborts the pipeline and
+// nothing is stored.
+func (s *Server) Analyze(ctx context.Context, imagePath, documentType string) (*tools.AnalyzeImageOutput, error) {
+	return s.analyzeForMCP(ctx, s.resolveImagePath(imagePath), documentType, nil)
+}
+
+// analyzeForMCP runs the pipeline for the analyze tools and stores the
+// result, linked to its archived original, if any.
+func (s *Server) analyzeForMCP(ctx context.Context, imagePath, documentType string, original *store.Original) (*tools.AnalyzeImageOutput, error) {
+	ctx, attempt := s.startAttempt(ctx, viaMCP, "", imagePath)
+	result, err := s.analyze(ctx, imagePath, receipt.ParseDocumentType(documentType), "")
+	if err != nil {
+		attempt.finish(nil, "", err)
+		return nil, err
+	}
+
+	rec := result.record(imagePath)
+	rec.Original = original
+	receiptID := s.saveResult(rec)
+	attempt.finish(result, receiptID, nil)
+	if receiptID != "" {
+		progress.Report(ctx, "Saved receipt "+receiptID)
+	}
+
+	return &tools.AnalyzeImageOutput{
+		ReceiptID:    receiptID,
+		DocumentType: string(result.DocType),
+		Source:       result.Source,
+		Parser:       result.Parser,
+		Data:         result.Output,
+		Location:     result.Location,
+		PurchaseTime: result.PurchaseTime,
+		Capture:      result.Capture,
+		Anomalies:    rec.Anomalies,
+		Quality:      rec.Quality,
+		CaptureHints: result.CaptureHints,
+		HookErrors:   rec.HookErrors,
+		Partial:      result.partial(),
+		Stages:       result.Stages,
+		Usage:        attempt.usage(result),
+	}, nil
+}
+
+// AnalyzeURL downloads an image for the analyze_url MCP tool and analyzes
+// it like Analyze. Downloads are checked as for image_url on /api/analyze.
+func (s *Server) AnalyzeURL(ctx context.Context, imageURL, documentType string) (*tools.AnalyzeImageOutput, error) {
+	progress.Report(ctx, "Downloading image")
+	imagePath, err := s.downloadImage(ctx, imageURL, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to download image: %w", err)
+	}
+	return s.Analyze(ctx, imagePath, documentType)
+}
+
+// AnalyzeText saves pasted text for the analyze_text MCP tool and analyzes
+// it like Analyze, without the image stages.
+func (s *Server) AnalyzeText(ctx context.Context, text, documentType string) (*tools.AnalyzeImageOutput, error) {
+	textPath, original, err := s.storeText(text, "", "text")
+	if err != nil {
+		return nil, fmt.Errorf("failed to save text: %w", err)
+	}
+	return s.analyzeForMCP(ctx, textPath, documentType, original)
+}
+
+// ValidateOutput checks output for the read_output MCP tool with the same
+// rules the pipeline applies to the model's answers.
+func (s *Server) ValidateOutput(data map[string]any, documentType string) (*tools.ValidatedOutput, error) {
+	docType := receipt.ParseDocumentType(documentType)
+	if docType == receipt.DocumentTypeAuto {
+		docType = receipt.DetectDocumentType(data)
+	}
+
+	validated := &tools.ValidatedOutput{DocumentType: string(docType)}
+	if docType == receipt.DocumentTypeInvoice {
+		inv, err := receipt.InvoiceFromMap(data)
+		if err != nil {
+			return nil, err
+		}
+		validated.Data, validated.Issues = inv.Map(), validateInvoiceOutput(inv)
+	} else {
+		r, err := receipt.ReceiptFromMap(data)
+		if err != nil {
+			return nil, err
+		}
+		validated.Data, validated.Issues = r.Map(), validateReceiptOutput(r)
+	}
+	return validated, nil
+}
@@ -0,0 +1,164 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+	"myprice/tools"
+)
+
+// OCRBox is where a line is on its page, as fractions of the page's width
+// and height from the top left corner.
+type OCRBox struct {
+	Top    float64 `json:"top"`
+	Left   float64 `json:"left"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// OCRLine is one OCR line of a receipt, with the parsed fields read from it.
+type OCRLine struct {
+	Index       int                `json:"index"`
+	Text        string             `json:"text"`
+	Confidence  float64            `json:"confidence"`
+	Page        int                `json:"page"` // From 1
+	Box         OCRBox             `json:"box"`
+	Block       receipt.BlockLabel `json:"block,omitempty"`
+	Handwritten bool               `json:"handwritten,omitempty"`
+	Fields      []string           `json:"fields"` // Paths of the fields located on the line
+}
+
+// OCRResponse is what OCR saw on a receipt, in reading order, beside what
+// was extracted from it.
+type OCRResponse struct {
+	ID             string                `json:"id"`
+	ImagePath      string                `json:"image_path"`
+	Source         string                `json:"source"` // "textract" or "text"
+	PageCount      int                   `json:"page_count"`
+	MeanConfidence float64               `json:"mean_confidence"`
+	MinConfidence  float64               `json:"min_confidence"`
+	Lines          []OCRLine             `json:"lines"`
+	Blocks         []receipt.Block       `json:"blocks"`
+	Fields         []receipt.FieldLines  `json:"fields"`
+	Tables         []tools.TextractTable `json:"tables,omitempty"`
+	Located        int                   `json:"located"`   // Fields found on some line
+	Unlocated      int                   `json:"unlocated"` // Fields found on none, such as values the model corrected
+}
+
+// handleReceiptOCR returns the OCR lines of a stored receipt in reading
+// order, with their confidences and positions, and where each parsed field
+// was read from, so a review UI can show what OCR saw next to what was
+// extracted. Fields are located by matching their values against the
+// lines (see receipt.LocateFields), so a value the model corrected or
+// inferred may be on no line. A receipt given as text has its lines spaced
+// evenly down one page, each read with full confidence.
+func (s *Server) handleReceiptOCR(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+
+	rec, ok := s.loadRecord(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	doc, source, err := s.recordOCR(rec)
+	if errors.Is(err, os.ErrNotExist) {
+		jsonError(w, "The receipt's OCR output is no longer kept; reprocess it to read it again", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Failed to load OCR output: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if doc == nil {
+		jsonError(w, "Receipt has no OCR output", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ocrResponse(rec, *doc, source))
+}
+
+// recordOCR loads the OCR lines a record was parsed from, and says whether
+// they came from Textract or a text document. It returns nil when there
+// are none, as for a receipt parsed from its image alone.
+func (s *Server) recordOCR(rec *store.Record) (*tools.LoadTextractOutput, string, error) {
+	switch {
+	case rec.TextractPath != "":
+		doc, err := s.loadTextract(rec.TextractPath)
+		if err != nil {
+			return nil, "", err
+		}
+		return &doc, "textract", nil
+	case isTextSource(rec.ImagePath):
+		var result analysisResult
+		if err := s.readText(rec.ImagePath, &result); err != nil {
+			return nil, "", err
+		}
+		return &result.Textract, "text", nil
+	}
+	return nil, "", nil
+}
+
+// ocrResponse lays doc out for a review UI, with the fields of rec located
+// on its lines.
+func ocrResponse(rec *store.Record, doc tools.LoadTextractOutput, source string) OCRResponse {
+	layout := make([]receipt.LayoutLine, len(doc.Lines))
+	labels := make([]receipt.BlockLabel, len(doc.Lines))
+	for i, line := range doc.Lines {
+		layout[i] = receipt.LayoutLine{Text: line.Text, Top: line.Top, Left: line.Left, Height: line.Height, Page: line.Page}
+		labels[i] = line.Block
+	}
+	fields := receipt.LocateFields(rec.Data, layout, labels)
+
+	resp := OCRResponse{
+		ID:             rec.ID,
+		ImagePath:      rec.ImagePath,
+		Source:         source,
+		PageCount:      max(doc.PageCount, 1),
+		MeanConfidence: doc.MeanConfidence,
+		MinConfidence:  doc.MinConfidence,
+		Lines:          make([]OCRLine, len(doc.Lines)),
+		Blocks:         doc.Blocks,
+		Fields:         fields,
+		Tables:         doc.Tables,
+	}
+	if resp.Blocks == nil {
+		resp.Blocks = []receipt.Block{}
+	}
+	for i, line := range doc.Lines {
+		resp.Lines[i] = OCRLine{
+			Index:       i,
+			Text:        line.Text,
+			Confidence:  line.Confidence,
+			Page:        max(line.Page, 1),
+			Box:         OCRBox{Top: line.Top, Left: line.Left, Width: line.Width, Height: line.Height},
+			Block:       line.Block,
+			Handwritten: line.Handwritten,
+			Fields:      []string{},
+		}
+	}
+	for _, f := range fields {
+		if len(f.Lines) == 0 {
+			resp.Unlocated++
+			continue
+		}
+		resp.Located++
+		for _, i := range f.Lines {
+			resp.Lines[i].Fields = append(resp.Lines[i].Fields, f.Field)
+		}
+	}
+	if resp.Fields == nil {
+		resp.Fields = []receipt.FieldLines{}
+	}
+	return resp
+}
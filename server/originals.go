@@ -0,0 +1,96 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"myprice/internal/archive"
+	"myprice/internal/store"
+)
+
+// archiveOriginal keeps data, the file a receipt is being analyzed from, in
+// the archive and returns orig filled in with its hash, size, and type. It
+// returns nil when the archive is unavailable or the write fails, which is
+// logged: the analysis goes ahead without it.
+func (s *Server) archiveOriginal(data []byte, orig store.Original) *store.Original {
+	if s.originals == nil {
+		return nil
+	}
+	hash, err := s.originals.Put(data)
+	if err != nil {
+		log.Printf("Warning: failed to archive %s file %s: %v", orig.Source, orig.Name, err)
+		return nil
+	}
+	orig.SHA256 = hash
+	orig.Size = int64(len(data))
+	if orig.ContentType == "" {
+		orig.ContentType = http.DetectContentType(data)
+	}
+	orig.ArchivedAt = time.Now().UTC()
+	return &orig
+}
+
+// handleReceiptOriginal serves the archived original of a receipt, exactly
+// as it was received, as a download.
+func (s *Server) handleReceiptOriginal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+
+	rec, ok := s.loadRecord(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	if rec.Original == nil || s.originals == nil {
+		jsonError(w, "Receipt has no archived original", http.StatusNotFound)
+		return
+	}
+	data, err := s.originals.Get(rec.Original.SHA256)
+	if errors.Is(err, archive.ErrNotFound) {
+		jsonError(w, "Archived original is missing", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Failed to read original: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", rec.Original.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": rec.Original.Name}))
+	w.Header().Set("ETag", `"`+rec.Original.SHA256+`"`)
+	w.Header().Set("X-Content-SHA256", rec.Original.SHA256)
+	http.ServeContent(w, r, "", rec.Original.ArchivedAt, bytes.NewReader(data))
+}
+
+// restoreOriginal puts an archived original back at rec's image path when
+// retention has removed it, so the receipt can be analyzed again. The
+// restored file counts against the owner's quota like a new upload.
+func (s *Server) restoreOriginal(rec *store.Record) error {
+	if rec.Original == nil || s.originals == nil || !s.isUploadPath(rec.ImagePath) {
+		return nil
+	}
+	if _, err := os.Stat(rec.ImagePath); !os.IsNotExist(err) {
+		return nil
+	}
+	data, err := s.originals.Get(rec.Original.SHA256)
+	if err != nil {
+		return fmt.Errorf("failed to restore original: %w", err)
+	}
+	if err := s.storeImage(rec.Owner, rec.ImagePath, data); err != nil {
+		return fmt.Errorf("failed to restore original: %w", err)
+	}
+	log.Printf("Restored %s from the archive", filepath.Base(rec.ImagePath))
+	return nil
+}
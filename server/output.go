@@ -0,0 +1,97 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"myprice/internal/pathtmpl"
+	"myprice/internal/store"
+)
+
+// defaultOutputTemplate names saved results when OUTPUT_TEMPLATE is unset.
+const defaultOutputTemplate = "{vendor}/{date}_{total}.json"
+
+// outputConfig reads OUTPUT_DIR, OUTPUT_TEMPLATE, and OUTPUT_ON_CONFLICT.
+// Without OUTPUT_DIR, results are only kept in the receipt store.
+func outputConfig() (dir string, tmpl *pathtmpl.Template, policy pathtmpl.Policy, err error) {
+	dir = os.Getenv("OUTPUT_DIR")
+	if dir == "" {
+		return "", nil, "", nil
+	}
+	raw := os.Getenv("OUTPUT_TEMPLATE")
+	if raw == "" {
+		raw = defaultOutputTemplate
+	}
+	if tmpl, err = pathtmpl.Parse(raw); err != nil {
+		return "", nil, "", fmt.Errorf("OUTPUT_TEMPLATE: %w", err)
+	}
+	if policy, err = pathtmpl.ParsePolicy(os.Getenv("OUTPUT_ON_CONFLICT"), pathtmpl.PolicySuffix); err != nil {
+		return "", nil, "", fmt.Errorf("OUTPUT_ON_CONFLICT: %w", err)
+	}
+	return filepath.Clean(dir), tmpl, policy, nil
+}
+
+// outputFields are the template values for a stored result. The date is
+// the normalized purchase date when known.
+func outputFields(rec *store.Record) pathtmpl.Fields {
+	fields := pathtmpl.FromData(rec.Data)
+	if rec.DocumentType != "" {
+		fields[pathtmpl.Type] = rec.DocumentType
+	}
+	if rec.PurchaseTime != nil && rec.PurchaseTime.LocalDate != "" {
+		fields.SetDate(rec.PurchaseTime.LocalDate)
+	}
+	fields[pathtmpl.ID] = rec.ID
+	return fields
+}
+
+// writeOutput writes a copy of rec.Data under OUTPUT_DIR, named by
+// OUTPUT_TEMPLATE, and sets rec.OutputPath. replaced is the output of the
+// version rec supersedes, which is removed first so reprocessing doesn't
+// pile up copies. The copy is encrypted like the rest of the data.
+func (s *Server) writeOutput(rec *store.Record, replaced string) error {
+	if s.outputTemplate == nil {
+		return nil
+	}
+	if s.isOutputPath(replaced) {
+		if err := os.Remove(replaced); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Warning: failed to remove superseded output %s: %v", replaced, err)
+		}
+	}
+
+	data, err := json.MarshalIndent(rec.Data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize output: %w", err)
+	}
+
+	s.outputMu.Lock()
+	defer s.outputMu.Unlock()
+
+	path, err := pathtmpl.Resolve(filepath.Join(s.outputDir, s.outputTemplate.Render(outputFields(rec))), s.outputPolicy)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if err := s.cipher.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	rec.OutputPath = path
+	return nil
+}
+
+// isOutputPath reports whether path is inside the output directory.
+func (s *Server) isOutputPath(path string) bool {
+	if s.outputDir == "" || path == "" {
+		return false
+	}
+	rel, err := filepath.Rel(s.outputDir, path)
+	return err == nil && !strings.HasPrefix(rel, "..") && rel != "."
+}
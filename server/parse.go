@@ -2,9 +2,13 @@
 package server
 
 import (
+	"math"
 	"regexp"
 	"strconv"
 	"strings"
+
+	"myprice/internal/receipt"
+	"myprice/tools"
 )
 
 var (
@@ -13,8 +17,92 @@ var (
 
 	// Date patterns
 	dateRegex = regexp.MustCompile(`\d{1,2}/\d{1,2}/\d{2,4}|\d{4}-\d{2}-\d{2}`)
+
+	// Invoice identifiers like "Invoice # INV-1042" or "PO Number: 4500012",
+	// where "PO" is a word of its own rather than part of one like "deposit"
+	invoiceNumberRegex = regexp.MustCompile(`(?i)\binvoice\s*(?:no\.?|number|#)?\s*[:#]?\s*([A-Z0-9][A-Z0-9-]{2,})`)
+	poNumberRegex      = regexp.MustCompile(`(?i)\b(?:p\.?o\b\.?|purchase order)\s*(?:no\.?|number|#)?\s*[:#]?\s*([A-Z0-9][A-Z0-9-]{2,})`)
+
+	// Invoice buyer blocks, labeled "Bill To" or "Sold To", with the name on
+	// the label's line or the next; a "Ship To" beside it is cut off
+	buyerLabelRegex = regexp.MustCompile(`(?i)\b(?:bill(?:ed)?|sold)\s*to\b\s*:?\s*(.*)$`)
+	shipToRegex     = regexp.MustCompile(`(?i)\s*\bship\s*to\b.*$`)
+
+	// Street address lines, starting with a house number
+	addressLineRegex = regexp.MustCompile(`^\d+[A-Za-z]?\s+[A-Za-z]`)
+
+	// Invoice line quantities and unit prices like "2 x 42.50" or "3 @ $1.99"
+	invoiceQtyRegex = regexp.MustCompile(`(\d+(?:\.\d+)?)\s*[xX@×]\s*\$?(\d[\d,]*\.\d{2})\b`)
+
+	// SKU and part numbers, labeled like "SKU 44718" or "Part # AB-220", or
+	// leading the line as "AB-220 Hinge"
+	skuLabelRegex    = regexp.MustCompile(`(?i)\b(?:sku|part\s*(?:no\.?|number|#)?|item\s*(?:no\.?|#))\s*[:#]?\s*([A-Z0-9][A-Z0-9-]{2,})`)
+	leadingCodeRegex = regexp.MustCompile(`^([A-Z0-9][A-Z0-9-]{3,})\s+`)
+
+	// Payment terms like "Net 30" or "Due on receipt"
+	termsRegex = regexp.MustCompile(`(?i)(net\s*\d+|due on receipt|\d+/\d+\s*net\s*\d+)`)
+
+	// Tax and deposit labels: sales tax, VAT and its names elsewhere, GST and
+	// the Canadian provincial taxes, and bottle deposits like California's CRV
+	taxLabelRegex = regexp.MustCompile(`(?i)\b(?:tax\w*|vat|gst|hst|pst|qst|mwst|ust|iva|tva|btw|moms|crv|deposit)\b`)
+
+	// Tax rates like 20%, 7.25 % or 5,5%
+	taxRateRegex = regexp.MustCompile(`(\d+(?:[.,]\d+)?)\s*%`)
+
+	// Labels of tax already in the prices, like "VAT included" or "Total incl. VAT"
+	taxIncludedRegex = regexp.MustCompile(`(?i)\b(?:incl|included|including|inkl\w*)\b`)
+
+	// Tender labels, most specific first, since gift cards and store credit
+	// are often printed as cards or credits too
+	tenderPatterns = []struct {
+		kind string
+		re   *regexp.Regexp
+	}{
+		{receipt.TenderGiftCard, regexp.MustCompile(`(?i)gift\s*(?:card|cert)|\begift\b|\bgc\b`)},
+		{receipt.TenderStoreCredit, regexp.MustCompile(`(?i)store\s*credit|merch(?:andise)?\s*credit|credit\s*(?:voucher|slip)|reward\s*(?:cert\w*|dollars|cash)|account\s*credit|\w's\s+cash\b`)},
+		{receipt.TenderEBT, regexp.MustCompile(`(?i)\bebt\b|\bsnap\b`)},
+		{receipt.TenderCash, regexp.MustCompile(`(?i)\bcash\b`)},
+		{receipt.TenderCard, regexp.MustCompile(`(?i)\b(?:visa|master\s?card|mc|amex|american express|discover|debit|credit|card)\b`)},
+	}
+
+	// Lines that name a tender without paying with it: what is left on a
+	// gift card, and cash back
+	tenderSkipRegex = regexp.MustCompile(`(?i)balance|remaining|\bbal\b|available|cash\s*back`)
+
+	// The change given back from cash
+	changeRegex = regexp.MustCompile(`(?i)\bchange\b`)
+
+	// Amounts with cents, like 20.00 or -14.03, unlike card and auth numbers
+	centsRegex = regexp.MustCompile(`-?\$?\d[\d,]*\.\d{2}\b`)
+
+	// Masked card numbers like ************1234
+	maskedNumberRegex = regexp.MustCompile(`[*xX#•]{2,}[\s-]*\d{4}\b`)
+
+	// What's left of a tax line's name once its rate and base are removed,
+	// as in "VAT 20% on 22.50"
+	taxNameJunkRegex = regexp.MustCompile(`(?i)(?:\s+(?:on|of|at)|[\s:@()-])+$`)
+)
+
+const (
+	// vendorMinConfidence is the OCR confidence required to treat a header line as the vendor.
+	vendorMinConfidence = 90.0
+
+	// handwrittenVendorMinConfidence replaces vendorMinConfidence on handwritten
+	// documents, where Textract rarely scores anything above 90.
+	handwrittenVendorMinConfidence = 50.0
+
+	// handwrittenNote explains unreliable heuristic output on handwritten documents.
+	handwrittenNote = "Document is mostly handwritten; OCR text and extracted values may be unreliable"
 )
 
+// vendorConfidenceThreshold returns the minimum vendor line confidence for a document.
+func vendorConfidenceThreshold(textract tools.LoadTextractOutput) float64 {
+	if textract.Handwritten {
+		return handwrittenVendorMinConfidence
+	}
+	return vendorMinConfidence
+}
+
 // containsPrice checks if a string contains a price-like pattern.
 func containsPrice(s string) bool {
 	return strings.Contains(s, "$") || priceRegex.MatchString(s)
@@ -41,6 +129,139 @@ func extractPrice(s string) float64 {
 	return price
 }
 
+// normalizeNumerals returns textract with the numerals in its lines and
+// table cells rewritten as ASCII digits, as receipt.NormalizeNumerals
+// does, since the patterns here only read ASCII ones. It also returns the
+// fixes made to lines, for the anomalies; textract itself is unchanged.
+func normalizeNumerals(textract tools.LoadTextractOutput) (tools.LoadTextractOutput, []receipt.NumeralFix) {
+	var fixes []receipt.NumeralFix
+	lines := make([]tools.TextractLine, len(textract.Lines))
+	for i, line := range textract.Lines {
+		var lineFixes []receipt.NumeralFix
+		line.Text, lineFixes = receipt.NormalizeNumerals(line.Text)
+		fixes = append(fixes, lineFixes...)
+		lines[i] = line
+	}
+	textract.Lines = lines
+
+	tables := make([]tools.TextractTable, len(textract.Tables))
+	for i, table := range textract.Tables {
+		rows := make([][]string, len(table.Rows))
+		for j, row := range table.Rows {
+			rows[j] = make([]string, len(row))
+			for k, cell := range row {
+				rows[j][k], _ = receipt.NormalizeNumerals(cell)
+			}
+		}
+		table.Rows = rows
+		tables[i] = table
+	}
+	textract.Tables = tables
+	return textract, fixes
+}
+
+// amountField returns which summary amount a lowercased line is labeled
+// with: subtotal, tax for the total tax, tax_line for one of several taxes
+// or deposits, total, or "" for none. A total that includes tax, like
+// "Total incl. VAT", is the total.
+func amountField(lowerText string) string {
+	total := strings.Contains(lowerText, "total")
+	tax := taxLabelRegex.MatchString(lowerText)
+	switch {
+	case strings.Contains(lowerText, "subtotal"):
+		return "subtotal"
+	case tax && total && !taxIncludedRegex.MatchString(lowerText):
+		return "tax"
+	case tax && !total:
+		return "tax_line"
+	case total:
+		return "total"
+	}
+	return ""
+}
+
+// detailedTaxLines returns the tax lines worth keeping next to the total
+// tax. A single line with no rate that isn't included in the prices is
+// just the tax, so it is dropped.
+func detailedTaxLines(lines []receipt.TaxLine) []receipt.TaxLine {
+	if len(lines) == 1 && lines[0].Rate == 0 && !lines[0].Included {
+		return nil
+	}
+	return lines
+}
+
+// parseTaxLine reads a tax or deposit line, such as "VAT 20% on 22.50
+// 4.50": its name, its rate, and its amount, which is the last number once
+// the rate is removed. A number before the amount is the base the rate
+// applies to. It returns false when the line has no amount.
+func parseTaxLine(text string) (receipt.TaxLine, bool) {
+	line := receipt.TaxLine{Included: taxIncludedRegex.MatchString(text)}
+	rest := text
+	if m := taxRateRegex.FindStringSubmatchIndex(text); m != nil {
+		line.Rate, _ = strconv.ParseFloat(strings.ReplaceAll(text[m[2]:m[3]], ",", "."), 64)
+		rest = text[:m[0]] + " " + text[m[1]:]
+	}
+
+	var amounts []float64
+	for _, m := range priceRegex.FindAllString(rest, -1) {
+		if strings.ContainsAny(m, "0123456789") {
+			amounts = append(amounts, extractPrice(m))
+		}
+	}
+	if len(amounts) == 0 {
+		return line, false
+	}
+	line.Amount = amounts[len(amounts)-1]
+	if len(amounts) > 1 {
+		line.Base = amounts[len(amounts)-2]
+	}
+	line.Name = taxNameJunkRegex.ReplaceAllString(strings.Join(strings.Fields(extractItemName(rest)), " "), "")
+	return line, true
+}
+
+// parseTender reads a payment line, such as "VISA ****1234 25.00" or "GIFT
+// CARD 20.00": the tender type, its name as printed, the last four digits
+// of the card, and the amount, which is the last amount with cents on the
+// line. It returns false for lines that aren't tenders or have no amount.
+func parseTender(text string) (receipt.Tender, bool) {
+	if tenderSkipRegex.MatchString(text) {
+		return receipt.Tender{}, false
+	}
+	var tender receipt.Tender
+	for _, p := range tenderPatterns {
+		if p.re.MatchString(text) {
+			tender.Type = p.kind
+			break
+		}
+	}
+	amounts := centsRegex.FindAllString(text, -1)
+	if tender.Type == "" || len(amounts) == 0 {
+		return receipt.Tender{}, false
+	}
+	last := amounts[len(amounts)-1]
+	tender.Amount = extractPrice(last)
+	if strings.HasPrefix(last, "-") {
+		tender.Amount = -tender.Amount
+	}
+	if m := maskedNumberRegex.FindString(text); m != "" {
+		tender.CardLast4 = m[len(m)-4:]
+	}
+	name := maskedNumberRegex.ReplaceAllString(centsRegex.ReplaceAllString(text, ""), "")
+	tender.Name = strings.Trim(strings.Join(strings.Fields(name), " "), " :-$")
+	return tender, true
+}
+
+// giveChange takes the change given back from the last cash tender, so it
+// holds what the cash paid.
+func giveChange(tenders []receipt.Tender, change float64) {
+	for i := len(tenders) - 1; i >= 0; i-- {
+		if tenders[i].Type == receipt.TenderCash {
+			tenders[i].Amount = math.Round((tenders[i].Amount-change)*100) / 100
+			return
+		}
+	}
+}
+
 // extractItemName extracts the item name from a line (removes the price part).
 func extractItemName(s string) string {
 	// Remove price portion
@@ -58,3 +279,12 @@ func extractItemName(s string) string {
 	return name
 }
 
+// extractIdentifier returns the first capture group of re in s, provided it
+// contains at least one digit (so labels like "Invoice Date" don't match).
+func extractIdentifier(re *regexp.Regexp, s string) string {
+	matches := re.FindStringSubmatch(s)
+	if len(matches) < 2 || !strings.ContainsAny(matches[1], "0123456789") {
+		return ""
+	}
+	return matches[1]
+}
@@ -0,0 +1,23 @@
+package server
+
+import "testing"
+
+func TestExtractPONumber(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"PO Number: 4500012", "4500012"},
+		{"P.O. # 88-123", "88-123"},
+		{"Purchase Order 77001", "77001"},
+		// "po" inside a word isn't a PO label, and doesn't hide the real one
+		{"Bottle deposit 2.40\nPO 4500012", "4500012"},
+		{"Report 12345", ""},
+		{"Depot 9000", ""},
+	}
+	for _, tt := range tests {
+		if got := extractIdentifier(poNumberRegex, tt.text); got != tt.want {
+			t.Errorf("extractIdentifier(poNumberRegex, %q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
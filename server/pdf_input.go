@@ -0,0 +1,263 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+	"myprice/tools"
+)
+
+// maxPDFReceipts bounds the receipts one PDF is split into.
+const maxPDFReceipts = 50
+
+// PDFReceipt is one receipt found in a PDF, with its analysis or why it
+// failed.
+type PDFReceipt struct {
+	Part  int    `json:"part"`  // From 1
+	Pages []int  `json:"pages"` // Pages of the PDF it is on
+	Text  string `json:"text"`  // Its OCR lines, as analyzed
+	Error string `json:"error,omitempty"`
+	*AnalyzeResponse
+}
+
+// AnalyzePDFResponse lists the receipts a PDF was split into.
+type AnalyzePDFResponse struct {
+	FilePath string       `json:"file_path"`
+	FileName string       `json:"file_name"`
+	SHA256   string       `json:"sha256"`
+	Pages    int          `json:"pages"`
+	Source   string       `json:"source"` // Where the Textract output came from
+	Receipts []PDFReceipt `json:"receipts"`
+	Count    int          `json:"count"`
+	Failed   int          `json:"failed,omitempty"`
+}
+
+// handleAnalyzePDF analyzes a scanned PDF, uploaded in the multipart field
+// file, that may hold several receipts, such as a batch fed through a
+// document scanner. The whole PDF is read by OCR once, split into receipts
+// where pages and wide whitespace gaps show one ends and the next begins
+// (see receipt.SplitDocuments), and each receipt's lines are analyzed as a
+// text document of their own and stored as their own record. document_type
+// and model are query parameters applying to every receipt. A PDF of more
+// than one page needs Textract's asynchronous API (TEXTRACT_S3_BUCKET).
+func (s *Server) handleAnalyzePDF(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	model := q.Get("model")
+	if !s.checkModel(w, model) {
+		return
+	}
+	docType := receipt.ParseDocumentType(q.Get("document_type"))
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadBytes+1<<20)
+	if err := r.ParseMultipartForm(s.maxUploadBytes); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.uploadTooLarge(w)
+			return
+		}
+		jsonError(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		jsonError(w, "No PDF file provided: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if header.Size > s.maxUploadBytes {
+		s.uploadTooLarge(w)
+		return
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		jsonError(w, "Failed to read file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		jsonError(w, "Unsupported file format: upload a PDF", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var owner string
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		owner = p.Name
+	}
+
+	// Named by content, so the same batch uploaded again reuses its OCR and
+	// analyzes each receipt as a new version
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	pdfPath := filepath.Join(s.uploadDir, "pdf-"+hash[:16]+".pdf")
+	if err := s.storeImage(owner, pdfPath, data); err != nil {
+		s.imageInputError(w, err)
+		return
+	}
+	noteFile(r.Context(), header.Filename)
+	s.archiveOriginal(data, store.Original{Name: header.Filename, ContentType: "application/pdf", Source: "pdf"})
+	log.Printf("Uploaded PDF: %s as %s (%d bytes)", header.Filename, pdfPath, len(data))
+
+	textractPath, source, err := s.findOrRunTextract(r.Context(), pdfPath, pdfPath)
+	if err != nil {
+		jsonError(w, "Textract failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	doc, err := s.loadTextract(textractPath)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	parts := splitPDF(doc.Lines)
+	if len(parts) == 0 {
+		jsonError(w, "No text was found in the PDF", http.StatusUnprocessableEntity)
+		return
+	}
+	if len(parts) > maxPDFReceipts {
+		jsonError(w, fmt.Sprintf("The PDF holds %d receipts; split it into batches of at most %d", len(parts), maxPDFReceipts), http.StatusUnprocessableEntity)
+		return
+	}
+	log.Printf("Split %s into %d receipt(s)", pdfPath, len(parts))
+
+	resp := AnalyzePDFResponse{
+		FilePath: pdfPath,
+		FileName: header.Filename,
+		SHA256:   hash,
+		Pages:    max(doc.PageCount, 1),
+		Source:   source,
+		Receipts: make([]PDFReceipt, len(parts)),
+		Count:    len(parts),
+	}
+
+	// The receipts are analyzed at once, within the LLM's parallelism limit
+	var wg sync.WaitGroup
+	for i, part := range parts {
+		split := &store.Split{Name: header.Filename, SHA256: hash, Part: i + 1, Parts: len(parts), Pages: part.pages}
+		resp.Receipts[i] = PDFReceipt{Part: i + 1, Pages: part.pages, Text: part.text}
+		wg.Add(1)
+		go func(out *PDFReceipt) {
+			defer wg.Done()
+			analyzed, err := s.analyzePDFPart(r, owner, part.text, split, docType, model)
+			out.AnalyzeResponse = analyzed
+			if err != nil {
+				out.Error = err.Error()
+			}
+		}(&resp.Receipts[i])
+	}
+	wg.Wait()
+	if r.Context().Err() != nil {
+		log.Printf("Analysis of %s cancelled: client disconnected", pdfPath)
+		return
+	}
+
+	status := http.StatusOK
+	for _, rc := range resp.Receipts {
+		if rc.Error != "" {
+			resp.Failed++
+		}
+		if rc.Error != "" || rc.AnalyzeResponse != nil && rc.Partial {
+			status = http.StatusMultiStatus
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// analyzePDFPart saves one receipt's text from a PDF, analyzes it, and
+// stores the result as its own record.
+func (s *Server) analyzePDFPart(r *http.Request, owner, text string, split *store.Split, docType receipt.DocumentType, model string) (*AnalyzeResponse, error) {
+	textPath, original, err := s.storeText(text, owner, "pdf")
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, attempt := s.startAttempt(r.Context(), viaAPI, owner, textPath)
+	result, err := s.analyze(ctx, textPath, docType, model)
+	if r.Context().Err() != nil {
+		attempt.finish(nil, "", r.Context().Err())
+		return nil, r.Context().Err()
+	}
+	if err != nil {
+		attempt.finish(nil, "", err)
+		var notReceipt *notReceiptError
+		if errors.As(err, &notReceipt) {
+			return nil, fmt.Errorf("not a receipt or invoice: %s", notReceipt.Reason)
+		}
+		return nil, err
+	}
+
+	rec := result.record(textPath)
+	rec.Owner = owner
+	rec.Original = original
+	rec.Split = split
+	receiptID := s.saveResult(rec)
+	attempt.finish(result, receiptID, nil)
+	if receiptID != "" {
+		s.autoExport(rec)
+	}
+	return &AnalyzeResponse{
+		ImagePath:    textPath,
+		Textract:     result.Textract,
+		LLMOutput:    result.Output,
+		Source:       result.Source,
+		DocumentType: string(result.DocType),
+		Model:        result.Model,
+		Location:     result.Location,
+		PurchaseTime: result.PurchaseTime,
+		Anomalies:    rec.Anomalies,
+		Quality:      rec.Quality,
+		CaptureHints: result.CaptureHints,
+		HookErrors:   rec.HookErrors,
+		ReceiptID:    receiptID,
+		Partial:      result.partial(),
+		Stages:       result.Stages,
+		Usage:        attempt.usage(result),
+	}, nil
+}
+
+// pdfPart is the text of one receipt in a PDF and the pages it is on.
+type pdfPart struct {
+	text  string
+	pages []int
+}
+
+// splitPDF splits the OCR lines of a PDF into its receipts, each written
+// out a printed row to a line.
+func splitPDF(lines []tools.TextractLine) []pdfPart {
+	layout := make([]receipt.LayoutLine, len(lines))
+	for i, line := range lines {
+		layout[i] = receipt.LayoutLine{Text: line.Text, Top: line.Top, Left: line.Left, Height: line.Height, Page: line.Page}
+	}
+
+	var parts []pdfPart
+	for _, indexes := range receipt.SplitDocuments(layout) {
+		own := make([]receipt.LayoutLine, len(indexes))
+		var part pdfPart
+		for i, l := range indexes {
+			own[i] = layout[l]
+			if page := max(layout[l].Page, 1); !slices.Contains(part.pages, page) {
+				part.pages = append(part.pages, page)
+			}
+		}
+		part.text = strings.Join(receipt.RowTexts(own), "\n")
+		parts = append(parts, part)
+	}
+	return parts
+}
@@ -0,0 +1,295 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"myprice/internal/eval"
+	"myprice/internal/exif"
+	"myprice/internal/geo"
+	"myprice/internal/progress"
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+	"myprice/tools"
+)
+
+const (
+	// parserLLM and parserHeuristic identify which parser produced a
+	// result, and parserManual a user's correction of one.
+	parserLLM       = "llm"
+	parserHeuristic = "heuristic"
+	parserManual    = "manual"
+
+	// heuristicVersion identifies the regex parsers; bump it when they change.
+	heuristicVersion = "heuristic-v5"
+)
+
+// notReceiptError is returned by analyze for an upload that clearly isn't
+// a receipt or invoice, instead of a result made up from it.
+type notReceiptError struct {
+	receipt.Content
+}
+
+func (e *notReceiptError) Error() string {
+	return fmt.Sprintf("not a receipt or invoice (%s): %s", e.Type, e.Reason)
+}
+
+// rejectedContent returns what an upload analyze refused as not a receipt
+// appears to be, or "" if err is nil or another failure.
+func rejectedContent(err error) string {
+	var notReceipt *notReceiptError
+	if errors.As(err, &notReceipt) {
+		return notReceipt.Type
+	}
+	return ""
+}
+
+// analysisResult is everything the pipeline produces for one image.
+type analysisResult struct {
+	ImageSHA256   string
+	Textract      tools.LoadTextractOutput
+	TextractPath  string
+	Source        string
+	DocType       receipt.DocumentType
+	Output        map[string]any
+	Parser        string
+	Model         string
+	PromptVersion string
+	Capture       *exif.Metadata
+	Location      *geo.Location
+	PurchaseTime  *receipt.PurchaseTime
+	CardLast4     string
+	CheckNumber   string
+	Fingerprint   string
+	Category      string // Vendor category code
+	CaptureHints  []receipt.CaptureHint
+	Stages        []tools.StageResult
+	Trial         *eval.Pair // Set when the analysis joined an experiment
+}
+
+// stage records how a pipeline stage went.
+func (r *analysisResult) stage(name, status string, err error) {
+	st := tools.StageResult{Stage: name, Status: status}
+	if err != nil {
+		st.Error = err.Error()
+	}
+	r.Stages = append(r.Stages, st)
+}
+
+// setStage records how a stage went, replacing what was recorded for it.
+func (r *analysisResult) setStage(name, status string, err error) {
+	for i := range r.Stages {
+		if r.Stages[i].Stage == name {
+			r.Stages = slices.Delete(r.Stages, i, i+1)
+			break
+		}
+	}
+	r.stage(name, status, err)
+}
+
+// hasStage reports whether a stage's outcome was recorded.
+func (r *analysisResult) hasStage(name string) bool {
+	return slices.ContainsFunc(r.Stages, func(st tools.StageResult) bool { return st.Stage == name })
+}
+
+// timeStage records how long a stage took.
+func (r *analysisResult) timeStage(name string, d time.Duration) {
+	for i := range r.Stages {
+		if r.Stages[i].Stage == name {
+			r.Stages[i].DurationMS = d.Milliseconds()
+		}
+	}
+}
+
+// partial reports whether any stage failed on the way to the result.
+func (r *analysisResult) partial() bool {
+	for _, st := range r.Stages {
+		if st.Status != tools.StageOK {
+			return true
+		}
+	}
+	return false
+}
+
+// ocrError returns why OCR failed, or "" if it didn't.
+func (r *analysisResult) ocrError() string {
+	for _, st := range r.Stages {
+		if st.Stage == tools.StageOCR && st.Status == tools.StageFailed {
+			return st.Error
+		}
+	}
+	return ""
+}
+
+// analyze runs the pipeline's stages on an image: by default downscale,
+// OCR, classify, parse, validate, and enrich. requested selects the schema;
+// DocumentTypeAuto classifies from the OCR text. model selects an allowed
+// LLM model, and "" the production one, in which case the analysis may
+// also run the experiment's candidate. When one of OCR and the LLM fails
+// the other still produces a result, with the failure listed in its
+// Stages; it fails only when neither stage produced anything. An image
+// whose OCR text shows it isn't a receipt or invoice at all fails with a
+// *notReceiptError. A plain text document, saved as a .txt file, skips the
+// image stages and is parsed from its text.
+func (s *Server) analyze(ctx context.Context, imagePath string, requested receipt.DocumentType, model string) (*analysisResult, error) {
+	log.Printf("Analyzing image: %s", imagePath)
+
+	run := &analysisRun{analysisResult: &analysisResult{DocType: requested}, imagePath: imagePath, model: model}
+	if isTextSource(imagePath) {
+		// Text needs no OCR, so it is read whichever stages are on
+		progress.Report(ctx, "Reading plain text")
+		if err := s.readText(imagePath, run.analysisResult); err != nil {
+			return nil, err
+		}
+	} else {
+		ws, err := s.openWorkspace(imagePath)
+		if err != nil {
+			return nil, err
+		}
+		defer ws.Close()
+		run.ws, run.preparedPath = ws, ws.imagePath
+		s.identifyImage(ws, run.analysisResult)
+	}
+
+	for _, st := range s.pipeline.stages() {
+		if err := st.run(s, ctx, run); err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if run.Output == nil {
+		// Only possible when the heuristic stage is off
+		for _, st := range run.Stages {
+			if st.Stage == tools.StageParse && st.Error != "" {
+				return nil, errors.New(st.Error)
+			}
+		}
+		return nil, fmt.Errorf("no parser stage produced a result")
+	}
+	run.timeStage(tools.StageParse, run.parseTime)
+	return run.analysisResult, nil
+}
+
+// recognize runs the stages before parsing: downscale, OCR, and classify,
+// whatever the pipeline's configuration. It returns the partial result and
+// the path of the image to send to the LLM, which lives in ws.
+func (s *Server) recognize(ctx context.Context, ws *workspace, imagePath string, requested receipt.DocumentType) (*analysisResult, string, error) {
+	run := &analysisRun{analysisResult: &analysisResult{DocType: requested}, imagePath: imagePath, ws: ws}
+	s.identifyImage(ws, run.analysisResult)
+	if err := s.preprocessStage(ctx, run); err != nil {
+		return nil, "", err
+	}
+	if err := s.ocrStage(ctx, run); err != nil {
+		return nil, "", err
+	}
+	s.classify(run.analysisResult)
+	return run.analysisResult, run.preparedPath, nil
+}
+
+// identifyImage records an image's hash and the camera's EXIF metadata.
+func (s *Server) identifyImage(ws *workspace, result *analysisResult) {
+	if hash, err := fileSHA256(ws.imagePath); err == nil {
+		result.ImageSHA256 = hash
+	}
+	if capture, err := exif.ReadFile(ws.imagePath); err != nil {
+		log.Printf("Warning: could not read EXIF: %v", err)
+	} else {
+		result.Capture = capture
+	}
+}
+
+// runOCR finds or generates the Textract output for an image and loads it
+// into result.
+func (s *Server) runOCR(ctx context.Context, imagePath, preparedPath string, result *analysisResult) error {
+	textractPath, source, err := s.findOrRunTextract(ctx, imagePath, preparedPath)
+	if err != nil {
+		return fmt.Errorf("Textract failed: %w", err)
+	}
+
+	log.Printf("Using Textract file: %s (source: %s)", textractPath, source)
+
+	textractOutput, err := s.loadTextract(textractPath)
+	if err != nil {
+		return err
+	}
+	result.Textract, result.TextractPath, result.Source = textractOutput, textractPath, source
+	return nil
+}
+
+// loadTextract reads and simplifies a (possibly encrypted) Textract file.
+func (s *Server) loadTextract(textractPath string) (tools.LoadTextractOutput, error) {
+	data, err := s.cipher.ReadFile(textractPath)
+	if err != nil {
+		return tools.LoadTextractOutput{}, fmt.Errorf("Failed to load textract: %w", err)
+	}
+	output, err := tools.ParseTextract(data)
+	if err != nil {
+		return tools.LoadTextractOutput{}, fmt.Errorf("Failed to load textract: %w", err)
+	}
+	output.FilePath = textractPath
+	return output, nil
+}
+
+// enrich resolves chain identity, category, and location for the vendor,
+// normalizes the purchase time, fingerprints the purchase, looks up item
+// codes, prices sized items per 100 g or 100 ml, and advises on retaking
+// a photo read poorly. The photo's capture time and position fill in when
+// the receipt has no date or address.
+func (s *Server) enrich(ctx context.Context, result *analysisResult) {
+	s.enrichProducts(ctx, result.DocType, result.Output)
+	annotateItemSizes(result.DocType, result.Output)
+	result.Location = s.enrichLocation(ctx, result.DocType, result.Output, result.Capture)
+	result.PurchaseTime = s.normalizePurchaseTime(result.DocType, result.Output, result.Location, result.Capture)
+
+	lines := textractLineTexts(result.Textract)
+	result.Category = s.vendorCategory(result.DocType, result.Output, result.Location, lines)
+	result.CardLast4 = receipt.ExtractCardLast4(lines)
+	result.CheckNumber = receipt.ExtractCheckNumber(lines)
+	result.Fingerprint = receipt.Fingerprint(fingerprintParts(
+		result.DocType, result.Output, result.Location, result.PurchaseTime, result.CardLast4, result.CheckNumber))
+	result.CaptureHints = s.captureHints(result)
+}
+
+// record builds the store record for a result.
+func (r *analysisResult) record(imagePath string) *store.Record {
+	return &store.Record{
+		ImagePath:      imagePath,
+		ImageSHA256:    r.ImageSHA256,
+		TextractPath:   r.TextractPath,
+		DocumentType:   string(r.DocType),
+		Source:         r.Source,
+		Parser:         r.Parser,
+		Model:          r.Model,
+		PromptVersion:  r.PromptVersion,
+		OCRConfidence:  r.Textract.MeanConfidence,
+		Version:        1,
+		Location:       r.Location,
+		PurchaseTime:   r.PurchaseTime,
+		Capture:        r.Capture,
+		CardLast4:      r.CardLast4,
+		CheckNumber:    r.CheckNumber,
+		Fingerprint:    r.Fingerprint,
+		VendorCategory: r.Category,
+		Data:           r.Output,
+	}
+}
+
+// currentPromptVersion returns the prompt version a fresh analysis of
+// docType would record.
+func (s *Server) currentPromptVersion(docType receipt.DocumentType) string {
+	switch {
+	case s.claudeAPI == nil:
+		return heuristicVersion
+	case docType == receipt.DocumentTypeInvoice:
+		return invoicePromptVersion
+	default:
+		return receiptPromptVersion
+	}
+}
@@ -0,0 +1,118 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"myprice/internal/crypt"
+	"myprice/internal/product"
+	"myprice/internal/receipt"
+)
+
+// productLookupTimeout bounds how long an analysis waits on product
+// lookups for all of a receipt's items.
+const productLookupTimeout = 10 * time.Second
+
+// newProductDatabase builds the product database from PRODUCT_DB_FILE, a
+// local JSON file consulted first, and PRODUCT_DB, which selects an online
+// database. It returns nil when neither is configured (the default).
+func newProductDatabase(c *crypt.Cipher) product.Database {
+	var chain product.Chain
+
+	if path := os.Getenv("PRODUCT_DB_FILE"); path != "" {
+		db, err := product.OpenFile(path, c)
+		if err != nil {
+			log.Printf("Warning: %v; product file disabled", err)
+		} else {
+			log.Printf("Loaded %d products from %s", db.Len(), path)
+			chain = append(chain, db)
+		}
+	}
+
+	switch strings.ToLower(os.Getenv("PRODUCT_DB")) {
+	case "":
+	case "openfoodfacts":
+		userAgent := os.Getenv("PRODUCT_DB_USER_AGENT")
+		if userAgent == "" {
+			userAgent = "myprice-api/0.1.0"
+		}
+		log.Printf("Looking up item barcodes with Open Food Facts")
+		chain = append(chain, product.NewOpenFoodFactsDatabase(os.Getenv("OPENFOODFACTS_URL"), userAgent))
+	default:
+		log.Printf("Warning: unknown PRODUCT_DB %q, online product lookup disabled", os.Getenv("PRODUCT_DB"))
+	}
+
+	if len(chain) == 0 {
+		return nil
+	}
+	return product.NewCachingDatabase(chain)
+}
+
+// enrichProducts looks up each item's code and attaches the product's
+// name, brand, and size. Receipt items without a code field have one split
+// from the name when it starts or ends with one, as on Textract-only parses
+// of warehouse receipts; invoice items use their SKU. Lookups stop at the
+// first failure other than a miss, so an unreachable database doesn't
+// stall the analysis item by item.
+func (s *Server) enrichProducts(ctx context.Context, docType receipt.DocumentType, output map[string]any) {
+	if s.products == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, productLookupTimeout)
+	defer cancel()
+
+	items, _ := output["items"].([]any)
+	for _, raw := range items {
+		item, ok := raw.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		code, ok := itemCode(docType, item)
+		if !ok {
+			continue
+		}
+		p, err := s.products.Lookup(ctx, code)
+		if errors.Is(err, product.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Warning: product lookup failed: %v", err)
+			return
+		}
+
+		info := map[string]any{"name": p.Name, "provider": p.Provider}
+		if p.Brand != "" {
+			info["brand"] = p.Brand
+		}
+		if p.Size != "" {
+			info["size"] = p.Size
+		}
+		item["product"] = info
+	}
+}
+
+// itemCode returns an item's normalized code, moving a code printed in a
+// receipt item's name into its code field.
+func itemCode(docType receipt.DocumentType, item map[string]any) (string, bool) {
+	if docType == receipt.DocumentTypeInvoice {
+		sku, _ := item["sku"].(string)
+		return product.NormalizeCode(sku)
+	}
+
+	if code, _ := item["code"].(string); code != "" {
+		return product.NormalizeCode(code)
+	}
+	name, _ := item["name"].(string)
+	code, rest, ok := product.SplitCode(name)
+	if !ok {
+		return "", false
+	}
+	item["code"], item["name"] = code, rest
+	return code, true
+}
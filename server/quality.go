@@ -0,0 +1,84 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+)
+
+// defaultQualityThreshold is the quality score below which receipts are
+// queued for review, when QUALITY_THRESHOLD isn't set.
+const defaultQualityThreshold = 70
+
+// qualityThreshold reads QUALITY_THRESHOLD, a score from 0 to 100.
+func qualityThreshold() int {
+	t := envInt("QUALITY_THRESHOLD", defaultQualityThreshold)
+	if t < 0 || t > 100 {
+		log.Printf("Warning: QUALITY_THRESHOLD must be from 0 to 100; using %d", defaultQualityThreshold)
+		return defaultQualityThreshold
+	}
+	return t
+}
+
+// scoreQuality scores a result about to be stored, once its anomalies have
+// been detected. Invoices get nil.
+func scoreQuality(rec *store.Record) *receipt.Quality {
+	if receipt.DocumentType(rec.DocumentType) == receipt.DocumentTypeInvoice || rec.Data == nil {
+		return nil
+	}
+	r, err := receipt.ReceiptFromMap(rec.Data)
+	if err != nil {
+		log.Printf("Warning: quality not scored: %v", err)
+		return nil
+	}
+	q := receipt.ScoreQuality(r, rec.OCRConfidence, rec.Anomalies)
+	return &q
+}
+
+// recordQuality returns the quality score of a stored record, scoring
+// records stored before scores were, and sets it on rec, which must be a
+// copy. It is nil for invoices.
+func recordQuality(rec *store.Record) *receipt.Quality {
+	if rec.Quality == nil {
+		rec.Quality = scoreQuality(rec)
+	}
+	return rec.Quality
+}
+
+// queryMinQuality reads the lowest quality score r asks for: min_quality,
+// from 0 to 100, or the review threshold with trusted=true. It is 0 when r
+// asks for neither, and answers 400 when min_quality is invalid.
+func (s *Server) queryMinQuality(w http.ResponseWriter, r *http.Request) (int, bool) {
+	query := r.URL.Query()
+	if v := query.Get("min_quality"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 100 {
+			jsonError(w, "min_quality must be a score from 0 to 100", http.StatusBadRequest)
+			return 0, false
+		}
+		return n, true
+	}
+	if query.Get("trusted") == "true" {
+		return s.qualityThreshold, true
+	}
+	return 0, true
+}
+
+// withQuality keeps the records scoring at least minQuality. Unscored
+// records, such as invoices, are left out too unless minQuality is 0.
+func withQuality(records []*store.Record, minQuality int) []*store.Record {
+	if minQuality == 0 {
+		return records
+	}
+	kept := make([]*store.Record, 0, len(records))
+	for _, rec := range records {
+		if q := recordQuality(rec); q != nil && q.Score >= minQuality {
+			kept = append(kept, rec)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,157 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"myprice/internal/quota"
+)
+
+// defaultMaxUploadBytes is the largest image accepted when
+// MAX_UPLOAD_BYTES isn't set.
+const defaultMaxUploadBytes = 10 << 20
+
+// QuotaStatus reports a user's upload storage against their quota.
+type QuotaStatus struct {
+	User      string `json:"user"`
+	Used      int64  `json:"used"`
+	Files     int    `json:"files"`
+	Limit     int64  `json:"limit,omitempty"`     // 0 when unlimited
+	Remaining *int64 `json:"remaining,omitempty"` // Omitted when unlimited
+}
+
+// quotaLimits reads USER_QUOTA_BYTES and USER_QUOTAS.
+func quotaLimits() (quota.Limits, error) {
+	limits := quota.Limits{Default: envInt64("USER_QUOTA_BYTES", 0)}
+	users, err := quota.ParseLimits(os.Getenv("USER_QUOTAS"))
+	if err != nil {
+		return limits, err
+	}
+	limits.Users = users
+	return limits, nil
+}
+
+// reserveUpload charges an upload of size bytes to destPath against its
+// owner's quota. It only fails with a *quota.ExceededError: uploads by
+// anonymous callers aren't tracked, and a ledger that can't be written is
+// logged rather than blocking uploads.
+func (s *Server) reserveUpload(owner, destPath string, size int64) error {
+	if s.quotas == nil || owner == "" {
+		return nil
+	}
+	err := s.quotas.Reserve(filepath.Base(destPath), owner, size, s.quotaLimits.Limit(owner))
+	var exceeded *quota.ExceededError
+	if errors.As(err, &exceeded) {
+		log.Printf("Rejected upload of %d bytes by %s: quota of %d bytes, %d used", size, owner, exceeded.Limit, exceeded.Used)
+		return err
+	}
+	if err != nil {
+		log.Printf("Warning: failed to record upload by %s: %v", owner, err)
+	}
+	return nil
+}
+
+// releaseUpload undoes reserveUpload for an upload that wasn't saved.
+func (s *Server) releaseUpload(owner, destPath string) {
+	if s.quotas == nil || owner == "" {
+		return
+	}
+	if err := s.quotas.Release(filepath.Base(destPath), owner); err != nil {
+		log.Printf("Warning: failed to release upload by %s: %v", owner, err)
+	}
+}
+
+// quotaStatus reports usage against a user's quota.
+func (s *Server) quotaStatus(u quota.Usage) QuotaStatus {
+	status := QuotaStatus{User: u.User, Used: u.Used, Files: u.Files, Limit: s.quotaLimits.Limit(u.User)}
+	if status.Limit > 0 {
+		remaining := max(status.Limit-status.Used, 0)
+		status.Remaining = &remaining
+	}
+	return status
+}
+
+// uploadTooLarge writes the error for an image over MAX_UPLOAD_BYTES.
+func (s *Server) uploadTooLarge(w http.ResponseWriter) {
+	jsonError(w, fmt.Sprintf("Image is larger than the %d byte upload limit", s.maxUploadBytes), http.StatusRequestEntityTooLarge)
+}
+
+// quotaError writes the structured error for an upload over quota.
+func quotaError(w http.ResponseWriter, err *quota.ExceededError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error":     true,
+		"code":      "quota_exceeded",
+		"message":   fmt.Sprintf("Upload would exceed your storage quota: %d of %d bytes used, %d requested", err.Used, err.Limit, err.Requested),
+		"used":      err.Used,
+		"limit":     err.Limit,
+		"requested": err.Requested,
+		"remaining": max(err.Limit-err.Used, 0),
+	})
+}
+
+// handleQuota reports the caller's upload storage and limits.
+func (s *Server) handleQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.quotas == nil {
+		jsonError(w, "Quotas are not available", http.StatusServiceUnavailable)
+		return
+	}
+	p, ok := PrincipalFrom(r.Context())
+	if !ok {
+		jsonError(w, "Quotas need API_KEYS to identify users", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"quota":            s.quotaStatus(s.quotas.Usage(p.Name)),
+		"max_upload_bytes": s.maxUploadBytes,
+	})
+}
+
+// handleAdminQuotas reports every user's upload storage.
+func (s *Server) handleAdminQuotas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.quotas == nil {
+		jsonError(w, "Quotas are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Include users who haven't uploaded anything yet
+	usage := s.quotas.All()
+	seen := make(map[string]bool, len(usage))
+	for _, u := range usage {
+		seen[u.User] = true
+	}
+	for _, k := range s.apiKeys {
+		if !seen[k.principal.Name] {
+			usage = append(usage, quota.Usage{User: k.principal.Name})
+		}
+	}
+
+	statuses := make([]QuotaStatus, 0, len(usage))
+	for _, u := range usage {
+		statuses = append(statuses, s.quotaStatus(u))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"users":            statuses,
+		"count":            len(statuses),
+		"default_limit":    s.quotaLimits.Default,
+		"max_upload_bytes": s.maxUploadBytes,
+	})
+}
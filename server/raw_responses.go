@@ -0,0 +1,293 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"myprice/internal/analysislog"
+	"myprice/internal/crypt"
+	"myprice/internal/rawresponse"
+	"myprice/internal/receipt"
+	"myprice/internal/retention"
+	"myprice/internal/store"
+	"myprice/tools"
+)
+
+// defaultRawResponsesMaxAge is how long raw model responses are kept when
+// LLM_RAW_RESPONSES_MAX_AGE isn't set. They hold everything on the
+// receipts, so they aren't kept forever by default.
+const defaultRawResponsesMaxAge = 30 * 24 * time.Hour
+
+// rawResponsesConfig returns the directory raw model responses are kept in
+// and its retention policy, or "" when LLM_RAW_RESPONSES is off.
+func rawResponsesConfig(projectRoot string) (string, retention.Policy) {
+	if v := os.Getenv("LLM_RAW_RESPONSES"); v != "true" && v != "1" {
+		return "", retention.Policy{}
+	}
+	dir := os.Getenv("LLM_RAW_RESPONSES_DIR")
+	if dir == "" {
+		dir = filepath.Join(projectRoot, "llm_responses")
+	}
+	return dir, retention.Policy{
+		MaxAge:   envDuration("LLM_RAW_RESPONSES_MAX_AGE", defaultRawResponsesMaxAge),
+		MaxBytes: envInt64("LLM_RAW_RESPONSES_MAX_BYTES", 0),
+	}
+}
+
+// openRawResponses opens the raw response store in dir, or returns nil
+// when dir is "" or the store can't be opened.
+func openRawResponses(dir string, cipher *crypt.Cipher) *rawresponse.Store {
+	if dir == "" {
+		return nil
+	}
+	responses, err := rawresponse.NewStore(dir, cipher)
+	if err != nil {
+		log.Printf("Warning: could not open raw response store: %v. Raw model responses will not be kept.", err)
+		return nil
+	}
+	log.Printf("Keeping raw model responses in %s", dir)
+	return responses
+}
+
+// responseRecorderKey is the context key for a responseRecorder.
+type responseRecorderKey struct{}
+
+// responseRecorder collects the raw model answers of one analysis.
+type responseRecorder struct {
+	mu        sync.Mutex
+	responses []rawresponse.Response
+}
+
+// recordResponse adds a model answer to the recorder on ctx, if any.
+func recordResponse(ctx context.Context, r rawresponse.Response) {
+	rec, _ := ctx.Value(responseRecorderKey{}).(*responseRecorder)
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.responses = append(rec.responses, r)
+}
+
+// noteParse records what parsing made of the last answer recorded on ctx:
+// the error that kept it from decoding, or its validation problems.
+func noteParse(ctx context.Context, issues []string, err error) {
+	rec, _ := ctx.Value(responseRecorderKey{}).(*responseRecorder)
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.responses) == 0 {
+		return
+	}
+	last := &rec.responses[len(rec.responses)-1]
+	if err != nil {
+		last.DecodeError = err.Error()
+	}
+	last.Issues = issues
+}
+
+// all returns the answers recorded so far.
+func (rec *responseRecorder) all() []rawresponse.Response {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]rawresponse.Response(nil), rec.responses...)
+}
+
+// saveRawResponses keeps the answers of the analysis logged as e, returning
+// how many were kept.
+func (s *Server) saveRawResponses(e analysislog.Entry, responses []rawresponse.Response) int {
+	if s.rawResponses == nil || len(responses) == 0 {
+		return 0
+	}
+	err := s.rawResponses.Save(&rawresponse.Record{
+		ID:            e.ID,
+		Time:          e.Time,
+		ImagePath:     e.ImagePath,
+		ImageSHA256:   e.ImageSHA256,
+		DocumentType:  e.DocumentType,
+		PromptVersion: e.PromptVersion,
+		Outcome:       e.Outcome,
+		Error:         e.Error,
+		ReceiptID:     e.ReceiptID,
+		PreviousID:    e.PreviousID,
+		Responses:     responses,
+	})
+	if err != nil {
+		log.Printf("Warning: failed to save raw model responses: %v", err)
+		return 0
+	}
+	return len(responses)
+}
+
+// ReextractResponse reports parsing an analysis's last kept answer again.
+type ReextractResponse struct {
+	ID        string         `json:"id"`                   // The analysis
+	ReceiptID string         `json:"receipt_id,omitempty"` // The receipt the answer was for, if any
+	NewID     string         `json:"new_id,omitempty"`     // The version stored, unless a dry run
+	Output    map[string]any `json:"output,omitempty"`
+	Issues    []string       `json:"issues,omitempty"` // Validation problems, also in the output's anomalies
+	Changes   []store.Change `json:"changes,omitempty"`
+}
+
+// handleRawResponses returns the raw model answers kept for an analysis
+// log entry.
+func (s *Server) handleRawResponses(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rec, ok := s.loadRawResponses(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
+
+// handleReextract parses the last kept answer of an analysis again with
+// the current JSON extraction and validation, without calling the model.
+// Unless dry_run is set, the result is stored as the next version of the
+// receipt the analysis stored or reprocessed; an analysis that stored
+// nothing, or whose receipt is gone, is always a dry run.
+func (s *Server) handleReextract(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rec, ok := s.loadRawResponses(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	var answer *rawresponse.Response
+	for i := len(rec.Responses) - 1; i >= 0; i-- {
+		if rec.Responses[i].Text != "" {
+			answer = &rec.Responses[i]
+			break
+		}
+	}
+	if answer == nil {
+		jsonError(w, "The analysis has no model answer to parse", http.StatusUnprocessableEntity)
+		return
+	}
+	jsonText := extractJSONText(answer.Text)
+
+	resp := ReextractResponse{ID: rec.ID, ReceiptID: rec.ReceiptID}
+	if resp.ReceiptID == "" {
+		resp.ReceiptID = rec.PreviousID
+	}
+	var old *store.Record
+	if resp.ReceiptID != "" && s.store != nil {
+		var err error
+		old, err = s.store.Get(resp.ReceiptID)
+		if errors.Is(err, store.ErrNotFound) {
+			// Erased, or a version pruned since
+			old = nil
+		} else if err != nil {
+			jsonError(w, "Failed to load receipt: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Analyses that failed early don't know the document type
+	docType := rec.DocumentType
+	if docType == "" && old != nil {
+		docType = old.DocumentType
+	}
+
+	if old == nil || r.URL.Query().Get("dry_run") == "true" {
+		var textract tools.LoadTextractOutput
+		if old != nil && old.TextractPath != "" {
+			textract, _ = s.loadTextract(old.TextractPath)
+		}
+		output, issues, err := decodeAnswer(receipt.ParseDocumentType(docType), jsonText, textract)
+		if err != nil {
+			jsonError(w, "The answer still doesn't parse: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		resp.Output, resp.Issues = output, issues
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	model := answer.Model
+	if model == "" {
+		model = claudeModel
+	}
+	item := BatchItem{
+		RecordID:     old.ID,
+		DocumentType: docType,
+		TextractPath: old.TextractPath,
+		Source:       old.Source,
+		ImageSHA256:  old.ImageSHA256,
+	}
+	res := s.applyAnswer(r.Context(), item, jsonText, model, rec.PromptVersion)
+	s.logReextract(r, rec, model, res)
+	if res.Error != "" {
+		jsonError(w, "Failed to re-extract: "+res.Error, http.StatusUnprocessableEntity)
+		return
+	}
+	resp.NewID, resp.Changes = res.NewID, res.Changes
+	if newRec, err := s.store.Get(res.NewID); err == nil {
+		resp.Output = newRec.Data
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// loadRawResponses loads the answers kept for an analysis, writing the
+// error response if there are none.
+func (s *Server) loadRawResponses(w http.ResponseWriter, id string) (*rawresponse.Record, bool) {
+	if s.rawResponses == nil {
+		jsonError(w, "Raw model responses are not kept; set LLM_RAW_RESPONSES=true", http.StatusNotFound)
+		return nil, false
+	}
+	rec, err := s.rawResponses.Get(id)
+	if errors.Is(err, rawresponse.ErrNotFound) {
+		jsonError(w, "No raw responses kept for this analysis", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		jsonError(w, "Failed to load raw responses: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return rec, true
+}
+
+// logReextract logs a stored re-extraction in the analysis log. No model
+// was called, so it has no stages or tokens.
+func (s *Server) logReextract(r *http.Request, rec *rawresponse.Record, model string, res ReprocessResult) {
+	if s.analysisLog == nil {
+		return
+	}
+	e := analysislog.Entry{
+		Time:          time.Now().UTC(),
+		Via:           viaReextract,
+		ImagePath:     rec.ImagePath,
+		ImageSHA256:   rec.ImageSHA256,
+		DocumentType:  rec.DocumentType,
+		Parser:        parserLLM,
+		Model:         model,
+		PromptVersion: rec.PromptVersion,
+		Outcome:       analysislog.OutcomeOK,
+		Error:         res.Error,
+		ReceiptID:     res.NewID,
+		PreviousID:    res.ID,
+	}
+	if res.Error != "" {
+		e.Outcome = analysislog.OutcomeFailed
+	}
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		e.Actor = p.Name
+	}
+	s.appendAnalysisLog(e)
+}
@@ -0,0 +1,352 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+	"myprice/tools"
+)
+
+// ReceiptListResponse lists stored analysis results.
+type ReceiptListResponse struct {
+	Receipts []*store.Record `json:"receipts"`
+	Count    int             `json:"count"`
+}
+
+// handleReceipts lists stored receipts. The chain, store_number, phone,
+// city, and state query parameters narrow the list to one location, e.g. to
+// compare prices across stores of the same chain, tag to receipts with
+// every tag given, and min_quality or trusted to receipts scoring at least
+// that well.
+func (s *Server) handleReceipts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+	tags, ok := queryTags(w, r)
+	if !ok {
+		return
+	}
+	minQuality, ok := s.queryMinQuality(w, r)
+	if !ok {
+		return
+	}
+
+	records, err := s.store.List()
+	if err != nil {
+		jsonError(w, "Failed to list receipts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("all") != "true" {
+		records = latestVersions(records)
+	}
+	records = withQuality(taggedWith(filterByLocation(records, r.URL.Query()), tags), minQuality)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ReceiptListResponse{
+		Receipts: records,
+		Count:    len(records),
+	})
+}
+
+// handleReceipt returns a single stored receipt. Its ETag names the
+// revision read, for edits to send back in If-Match.
+func (s *Server) handleReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+
+	rec, ok := s.loadRecord(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", receiptETag(rec))
+	json.NewEncoder(w).Encode(rec)
+}
+
+// VersionSummary describes one stored result in a version history.
+type VersionSummary struct {
+	ID            string    `json:"id"`
+	Version       int       `json:"version"`
+	Parser        string    `json:"parser,omitempty"`
+	Model         string    `json:"model,omitempty"`
+	PromptVersion string    `json:"prompt_version,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	Current       bool      `json:"current"`
+}
+
+// VersionListResponse lists every stored result for one source image.
+type VersionListResponse struct {
+	ImageSHA256 string           `json:"image_sha256,omitempty"`
+	Versions    []VersionSummary `json:"versions"`
+}
+
+// DiffResponse is the field-by-field difference between two versions.
+type DiffResponse struct {
+	From    VersionSummary `json:"from"`
+	To      VersionSummary `json:"to"`
+	Changes []store.Change `json:"changes"`
+}
+
+// handleReceiptVersions lists every parse attempt for the receipt's image,
+// oldest first.
+func (s *Server) handleReceiptVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+
+	rec, ok := s.loadRecord(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	versions, err := store.Versions(s.store, rec)
+	if err != nil {
+		jsonError(w, "Failed to load versions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := VersionListResponse{
+		ImageSHA256: rec.ImageSHA256,
+		Versions:    make([]VersionSummary, len(versions)),
+	}
+	for i, v := range versions {
+		resp.Versions[i] = summarizeVersion(v)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleReceiptDiff compares a receipt with another version. The other
+// version is given as ?against=<id> and defaults to the previous version.
+func (s *Server) handleReceiptDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+
+	to, ok := s.loadRecord(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	againstID := r.URL.Query().Get("against")
+	if againstID == "" {
+		againstID = to.PreviousID
+	}
+	if againstID == "" {
+		jsonError(w, "Receipt has no previous version; pass ?against=<id>", http.StatusBadRequest)
+		return
+	}
+
+	from, ok := s.loadRecord(w, againstID)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DiffResponse{
+		From:    summarizeVersion(from),
+		To:      summarizeVersion(to),
+		Changes: store.Diff(from.Data, to.Data),
+	})
+}
+
+// handleCompareReceipts diffs the items of two receipts, given as ?a=<id>
+// and ?b=<id>, as the compare_receipts MCP tool does: shared items with
+// their price differences, and the items on only one.
+func (s *Server) handleCompareReceipts(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) {
+		return
+	}
+	idA, idB := r.URL.Query().Get("a"), r.URL.Query().Get("b")
+	if idA == "" || idB == "" {
+		jsonError(w, "a and b are required", http.StatusBadRequest)
+		return
+	}
+
+	a, ok := s.loadRecord(w, idA)
+	if !ok {
+		return
+	}
+	b, ok := s.loadRecord(w, idB)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tools.CompareRecords(a, b))
+}
+
+// loadRecord fetches a record, writing a 404 or 500 and returning false on failure.
+func (s *Server) loadRecord(w http.ResponseWriter, id string) (*store.Record, bool) {
+	rec, err := s.store.Get(id)
+	if errors.Is(err, store.ErrNotFound) {
+		jsonError(w, "Receipt not found: "+id, http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		jsonError(w, "Failed to load receipt: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return rec, true
+}
+
+// summarizeVersion returns the pipeline metadata of a stored result.
+func summarizeVersion(rec *store.Record) VersionSummary {
+	return VersionSummary{
+		ID:            rec.ID,
+		Version:       max(rec.Version, 1),
+		Parser:        rec.Parser,
+		Model:         rec.Model,
+		PromptVersion: rec.PromptVersion,
+		CreatedAt:     rec.CreatedAt,
+		Current:       rec.SupersededBy == "",
+	}
+}
+
+// handleExport streams the whole receipt store as a JSON Lines archive.
+// Pass ?images=embed to include original images as base64.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+
+	opts := store.ExportOptions{
+		EmbedImages: r.URL.Query().Get("images") == "embed",
+		Cipher:      s.cipher,
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="myprice-export.jsonl"`)
+	result, err := store.Export(w, s.store, opts)
+	if err != nil {
+		// Headers are already sent; all we can do is log and truncate
+		log.Printf("Export failed after %d records: %v", result.Records, err)
+		return
+	}
+	log.Printf("Exported %d records (%d images, %d missing)", result.Records, result.Images, result.MissingImages)
+}
+
+// ImportResponse reports the outcome of an archive import.
+type ImportResponse struct {
+	Success bool `json:"success"`
+	store.ImportResult
+}
+
+// handleImport loads a JSON Lines archive produced by /api/export.
+// Embedded images are written to the upload directory. Pass
+// ?overwrite=true to replace records that already exist.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+
+	opts := store.ImportOptions{
+		ImageDir:  s.uploadDir,
+		Overwrite: r.URL.Query().Get("overwrite") == "true",
+		Cipher:    s.cipher,
+	}
+
+	result, err := store.Import(r.Body, s.store, opts)
+	if err != nil {
+		jsonError(w, "Import failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Imported %d records (%d skipped, %d images)", result.Imported, result.Skipped, result.Images)
+	if s.textIndex != nil && result.Imported > 0 {
+		go s.indexMissing(context.Background())
+	}
+	if s.embeddings != nil && result.Imported > 0 {
+		go s.embedMissing(context.Background())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ImportResponse{
+		Success:      true,
+		ImportResult: result,
+	})
+}
+
+// latestVersions drops records that have been superseded by a reprocessed version.
+func latestVersions(records []*store.Record) []*store.Record {
+	latest := make([]*store.Record, 0, len(records))
+	for _, rec := range records {
+		if rec.SupersededBy == "" {
+			latest = append(latest, rec)
+		}
+	}
+	return latest
+}
+
+// filterByLocation keeps records whose location matches every given filter.
+func filterByLocation(records []*store.Record, query url.Values) []*store.Record {
+	chain, storeNumber := query.Get("chain"), query.Get("store_number")
+	city, state := query.Get("city"), query.Get("state")
+	phone := receipt.PhoneDigits(query.Get("phone"))
+	if chain == "" && storeNumber == "" && phone == "" && city == "" && state == "" {
+		return records
+	}
+
+	matches := func(filter, value string) bool {
+		return filter == "" || strings.EqualFold(filter, value)
+	}
+	// Receipts print store numbers with and without leading zeros
+	storeNumber = strings.TrimLeft(storeNumber, "0")
+
+	filtered := make([]*store.Record, 0, len(records))
+	for _, rec := range records {
+		loc := rec.Location
+		if loc == nil {
+			continue
+		}
+		if matches(chain, loc.Chain) && matches(storeNumber, strings.TrimLeft(loc.StoreNumber, "0")) &&
+			matches(phone, receipt.PhoneDigits(loc.Phone)) && matches(city, loc.City) && matches(state, loc.State) {
+			filtered = append(filtered, rec)
+		}
+	}
+	return filtered
+}
+
+// requireStore writes a 503 and returns false if the store is unavailable.
+func (s *Server) requireStore(w http.ResponseWriter) bool {
+	if s.store == nil {
+		jsonError(w, "Receipt store is not available", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
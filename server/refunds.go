@@ -0,0 +1,60 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+)
+
+// refundWindow is how long before a refund the purchase it returns is
+// looked for. Most stores take returns for 30 to 90 days.
+const refundWindow = 120 * 24 * time.Hour
+
+// refundedPurchase returns the ID of the purchase a refund receipt returns
+// items from: the most recent receipt of the same owner and vendor, dated
+// on or before the refund and within refundWindow of it, that has a
+// returned item at the same price or the refunded total. It returns "" for
+// other receipts and when no purchase matches.
+func (s *Server) refundedPurchase(rec *store.Record) string {
+	if rec.DocumentType != string(receipt.DocumentTypeReceipt) {
+		return ""
+	}
+	refund, err := receipt.ReceiptFromMap(rec.Data)
+	if err != nil || !refund.Refund {
+		return ""
+	}
+	records, err := s.store.List()
+	if err != nil {
+		log.Printf("Warning: failed to look up the purchase refunded by %s: %v", rec.ID, err)
+		return ""
+	}
+
+	date := recordDate(rec)
+	earliest := ""
+	if d, err := time.Parse("2006-01-02", date); err == nil {
+		earliest = d.Add(-refundWindow).Format("2006-01-02")
+	}
+	vendor := recordFingerprintParts(rec).Vendor
+	best, bestDate := "", ""
+	for _, candidate := range records {
+		if candidate.ID == rec.ID || candidate.ID == rec.PreviousID || candidate.SupersededBy != "" ||
+			candidate.Owner != rec.Owner || candidate.DocumentType != rec.DocumentType {
+			continue
+		}
+		candidateDate := recordDate(candidate)
+		if candidateDate > date || candidateDate < earliest || candidateDate <= bestDate {
+			continue
+		}
+		if !receipt.SameVendor(recordFingerprintParts(candidate).Vendor, vendor) {
+			continue
+		}
+		purchase, err := receipt.ReceiptFromMap(candidate.Data)
+		if err != nil || !refund.Returns(purchase) {
+			continue
+		}
+		best, bestDate = candidate.ID, candidateDate
+	}
+	return best
+}
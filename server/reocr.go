@@ -0,0 +1,332 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"myprice/internal/fsutil"
+	"myprice/internal/imageprep"
+	"myprice/internal/progress"
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+	"myprice/tools"
+)
+
+const (
+	// defaultReOCRScale and maxReOCRScale are how many times a region is
+	// enlarged before it is read, by default and at most.
+	defaultReOCRScale = 3
+	maxReOCRScale     = 4
+
+	// reocrMargin widens a region on each side, as a fraction of the page,
+	// so text its edges clip is read whole. Only lines centered in the
+	// region itself are kept.
+	reocrMargin = 0.01
+)
+
+var (
+	// errRegionField is returned for a field to patch the receipt doesn't
+	// have a place for.
+	errRegionField = errors.New("invalid field")
+
+	// errNoRegionImage is returned for a receipt with no image a region
+	// can be cropped from, such as one given as text.
+	errNoRegionImage = errors.New("the receipt has no image to read a region of")
+
+	// errRegionValue is returned when the region doesn't show the field's
+	// value.
+	errRegionValue = errors.New("the field's value was not read in the region")
+)
+
+// handleReOCRRegion reads a region of a stored receipt's image again, such
+// as a total OCR misread, and patches a field with what it shows, without
+// analyzing the whole receipt again. The body is a tools.ReOCRRegionInput
+// without receipt_id. The region is cropped from the original image,
+// enlarged scale times, and read by Textract on its own; the lines found
+// are returned positioned on the page. With field, its value is read from
+// the lines (see receipt.ReadRegionField) and stored as the receipt's next
+// version, as PUT /api/receipts/{id}/data stores a correction, honoring
+// If-Match; dry_run only reads it. Only the receipt's owner or an admin
+// can patch it.
+func (s *Server) handleReOCRRegion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+	var input tools.ReOCRRegionInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		jsonError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkReOCRInput(input); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := r.PathValue("id")
+	if _, ok := s.loadRecord(w, id); !ok {
+		return
+	}
+	cur, err := s.latestRecord(id)
+	if err != nil {
+		jsonError(w, "Failed to load receipt: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !canErase(r, cur.Owner) {
+		jsonError(w, "Only the receipt's owner or an admin can read it again", http.StatusForbidden)
+		return
+	}
+
+	out, data, err := s.reocrRegion(r.Context(), cur, input)
+	if r.Context().Err() != nil {
+		log.Printf("Region OCR of %s cancelled: client disconnected", cur.ID)
+		return
+	}
+	if err != nil {
+		reocrError(w, err)
+		return
+	}
+	if data == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", receiptETag(cur))
+		json.NewEncoder(w).Encode(out)
+		return
+	}
+
+	patch := func(rec *store.Record) error {
+		patched, err := receipt.SetField(rec.Data, input.Field, out.Value)
+		if err == nil {
+			rec.Data = patched
+		}
+		return err
+	}
+	if !ifMatch(r, cur) {
+		s.writeConflict(w, id, patch)
+		return
+	}
+	rec := s.correctedVersion(cur, data)
+	if s.saveResult(rec) == "" {
+		if latest, err := s.latestRecord(id); err == nil && latest.ID != cur.ID {
+			s.writeConflict(w, id, patch)
+			return
+		}
+		jsonError(w, "Failed to save patched receipt", http.StatusInternalServerError)
+		return
+	}
+	out.NewID, out.ETag = rec.ID, receiptETag(rec)
+	log.Printf("Patched %s of %s from a region read again, as %s", input.Field, cur.ID, rec.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", out.ETag)
+	json.NewEncoder(w).Encode(out)
+}
+
+// ReOCRRegion reads a region of a stored receipt's image again for the
+// reocr_region MCP tool, and stores the field it patches as
+// handleReOCRRegion does.
+func (s *Server) ReOCRRegion(ctx context.Context, input tools.ReOCRRegionInput) (*tools.ReOCRRegionOutput, error) {
+	if s.store == nil {
+		return nil, fmt.Errorf("receipt storage is not available")
+	}
+	if err := checkReOCRInput(input); err != nil {
+		return nil, err
+	}
+	cur, err := s.latestRecord(input.ReceiptID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, fmt.Errorf("receipt not found: %s", input.ReceiptID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load receipt: %w", err)
+	}
+
+	out, data, err := s.reocrRegion(ctx, cur, input)
+	if err != nil || data == nil {
+		return out, err
+	}
+	rec := s.correctedVersion(cur, data)
+	if s.saveResult(rec) == "" {
+		return nil, fmt.Errorf("failed to save patched receipt")
+	}
+	out.NewID, out.ETag = rec.ID, receiptETag(rec)
+	progress.Report(ctx, "Saved receipt "+rec.ID)
+	return out, nil
+}
+
+// checkReOCRInput checks the region and scale of a region OCR request.
+func checkReOCRInput(input tools.ReOCRRegionInput) error {
+	if err := input.Region.Validate(); err != nil {
+		return err
+	}
+	if input.Scale < 0 || input.Scale > maxReOCRScale {
+		return fmt.Errorf("scale must be between 1 and %d", maxReOCRScale)
+	}
+	return nil
+}
+
+// reocrError answers a failed region OCR request.
+func reocrError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errRegionField):
+		jsonError(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, os.ErrNotExist):
+		jsonError(w, "The receipt's image is no longer kept", http.StatusNotFound)
+	case errors.Is(err, errNoRegionImage), errors.Is(err, errRegionValue):
+		jsonError(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		jsonError(w, "OCR failed: "+err.Error(), http.StatusBadGateway)
+	}
+}
+
+// reocrRegion reads input's region of cur's image again and, with a field,
+// the field's value from it. It returns what was read and, unless input is
+// a dry run or names no field, cur's data with the field patched.
+func (s *Server) reocrRegion(ctx context.Context, cur *store.Record, input tools.ReOCRRegionInput) (*tools.ReOCRRegionOutput, map[string]any, error) {
+	var current any
+	if input.Field != "" {
+		var err error
+		if current, err = receipt.FieldValue(cur.Data, input.Field); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", errRegionField, err)
+		}
+	}
+
+	progress.Report(ctx, "Reading region again")
+	out, err := s.readRegion(ctx, cur, input.Region, input.Scale)
+	if err != nil {
+		return nil, nil, err
+	}
+	out.ReceiptID, out.DryRun = cur.ID, input.DryRun
+	if input.Field == "" {
+		return out, nil, nil
+	}
+
+	value, err := receipt.ReadRegionField(input.Field, current, strings.Split(out.Text, "\n"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v; OCR read %q", errRegionValue, err, out.Text)
+	}
+	out.Field, out.Previous, out.Value = input.Field, current, value
+	if input.DryRun {
+		return out, nil, nil
+	}
+	data, err := receipt.SetField(cur.Data, input.Field, value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errRegionField, err)
+	}
+	return out, data, nil
+}
+
+// readRegion crops region, widened by reocrMargin, from rec's image,
+// enlarges it scale times (defaultReOCRScale for 0, less when that would
+// pass the image size limit), and reads it with Textract. The crop is named
+// by its content, so reading the same region again reuses its output. It
+// returns the lines centered in region, positioned on the page.
+func (s *Server) readRegion(ctx context.Context, rec *store.Record, region tools.LineRegion, scale int) (*tools.ReOCRRegionOutput, error) {
+	if isTextSource(rec.ImagePath) {
+		return nil, errNoRegionImage
+	}
+	if err := s.restoreOriginal(rec); err != nil {
+		return nil, err
+	}
+	ws, err := s.openWorkspace(rec.ImagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer ws.Close()
+
+	f, err := os.Open(ws.imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image: %w", err)
+	}
+	img, _, err := imageprep.Decode(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNoRegionImage, err)
+	}
+
+	top, left, bottom, right := region.Edges()
+	bounds := img.Bounds()
+	width, height := float64(bounds.Dx()), float64(bounds.Dy())
+	crop := image.Rect(
+		bounds.Min.X+int(math.Floor(max(left-reocrMargin, 0)*width)),
+		bounds.Min.Y+int(math.Floor(max(top-reocrMargin, 0)*height)),
+		bounds.Min.X+int(math.Ceil(math.Min(right+reocrMargin, 1)*width)),
+		bounds.Min.Y+int(math.Ceil(math.Min(bottom+reocrMargin, 1)*height)),
+	).Intersect(bounds)
+	if crop.Empty() {
+		return nil, fmt.Errorf("%w: the region is smaller than a pixel", errNoRegionImage)
+	}
+
+	if scale == 0 {
+		scale = defaultReOCRScale
+	}
+	for scale > 1 && max(crop.Dx(), crop.Dy())*scale > s.imageOpts.MaxDimension {
+		scale--
+	}
+	enlarged := imageprep.Upscale(imageprep.Crop(img, crop), scale)
+	data, err := imageprep.EncodeJPEG(enlarged, s.imageOpts)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	base := strings.TrimSuffix(filepath.Base(rec.ImagePath), filepath.Ext(rec.ImagePath))
+	cropPath := filepath.Join(ws.preparedDir, base+"_region_"+hex.EncodeToString(sum[:6])+".jpg")
+	if err := os.MkdirAll(ws.preparedDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output dir: %w", err)
+	}
+	if err := fsutil.WriteFile(cropPath, data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write region: %w", err)
+	}
+
+	textractPath, source, err := s.findOrRunTextract(ctx, cropPath, cropPath)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := s.loadTextract(textractPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lines are moved from the crop onto the page
+	cropTop, cropLeft := float64(crop.Min.Y-bounds.Min.Y)/height, float64(crop.Min.X-bounds.Min.X)/width
+	cropHeight, cropWidth := float64(crop.Dy())/height, float64(crop.Dx())/width
+	out := &tools.ReOCRRegionOutput{
+		Lines:  []tools.TextractLine{},
+		Scale:  scale,
+		Width:  enlarged.Bounds().Dx(),
+		Height: enlarged.Bounds().Dy(),
+		Source: source,
+	}
+	var layout []receipt.LayoutLine
+	for _, line := range doc.Lines {
+		line.Top, line.Height = cropTop+line.Top*cropHeight, line.Height*cropHeight
+		line.Left, line.Width = cropLeft+line.Left*cropWidth, line.Width*cropWidth
+		line.Page, line.Block = 0, ""
+		middle, center := line.Top+line.Height/2, line.Left+line.Width/2
+		if middle < top || middle > bottom || center < left || center > right {
+			continue
+		}
+		out.Lines = append(out.Lines, line)
+		out.MeanConfidence += line.Confidence
+		layout = append(layout, receipt.LayoutLine{Text: line.Text, Top: line.Top, Left: line.Left, Height: line.Height})
+	}
+	if len(out.Lines) > 0 {
+		out.MeanConfidence /= float64(len(out.Lines))
+	}
+	out.Text = strings.Join(receipt.RowTexts(layout), "\n")
+	log.Printf("Read a region of %s again at %dx: %d line(s)", rec.ID, scale, len(out.Lines))
+	return out, nil
+}
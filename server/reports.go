@@ -0,0 +1,490 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"myprice/internal/report"
+	"myprice/internal/store"
+	shared "myprice/internal/workspace"
+)
+
+// Report schedules
+const (
+	scheduleMonthly   = "monthly"
+	scheduleQuarterly = "quarterly"
+)
+
+// reportFileRegex matches the names of scheduled report files.
+var reportFileRegex = regexp.MustCompile(`^\d{4}-(?:\d{2}|Q[1-4])\.(?:html|pdf)$`)
+
+// reportFormats maps a report format to its content type and renderer.
+var reportFormats = map[string]struct {
+	contentType string
+	render      func(io.Writer, *report.Report) error
+}{
+	"html": {"text/html; charset=utf-8", report.RenderHTML},
+	"pdf":  {"application/pdf", report.RenderPDF},
+}
+
+// reportRecords lists the stored receipts, optionally only those submitted
+// by owner or by the members of ws, those with every one of tags, and those
+// with a quality score of at least minQuality.
+func (s *Server) reportRecords(owner string, ws *shared.Workspace, tags []string, minQuality int) ([]*store.Record, error) {
+	records, err := s.store.List()
+	if err != nil {
+		return nil, err
+	}
+	if ws != nil {
+		records = ownedBy(records, ws.MemberNames()...)
+	}
+	if owner != "" {
+		records = ownedBy(records, owner)
+	}
+	return withQuality(taggedWith(records, tags), minQuality), nil
+}
+
+// buildReport summarizes the stored receipts for period, optionally only
+// those submitted by owner or by the members of ws, with every one of tags,
+// or scoring at least minQuality. Reports are cached until a receipt
+// changes; the one returned may be shared and must not be modified.
+func (s *Server) buildReport(period report.Period, owner string, ws *shared.Workspace, tags []string, minQuality int) (*report.Report, error) {
+	// The stamp is read before the records, so a write in between leaves
+	// the report cached under a stamp that is already stale
+	stamp, err := s.store.Stamp()
+	if err != nil {
+		return nil, err
+	}
+	return s.reportCache.Get(analyticsKey(period, owner, ws, tags, minQuality), stamp, func() (*report.Report, error) {
+		records, err := s.reportRecords(owner, ws, tags, minQuality)
+		if err != nil {
+			return nil, err
+		}
+
+		rep := report.Build(records, period, time.Now())
+		rep.Owner, rep.Tags, rep.MinQuality = owner, tags, minQuality
+		if ws != nil {
+			rep.Workspace = ws.Name
+			rep.Members = report.ByMember(records, period, ws.MemberNames())
+		}
+		return rep, nil
+	})
+}
+
+// buildPatterns breaks down spending in period as buildReport summarizes
+// it, cached the same way.
+func (s *Server) buildPatterns(period report.Period, owner string, ws *shared.Workspace, tags []string, minQuality int) (*report.Patterns, error) {
+	stamp, err := s.store.Stamp()
+	if err != nil {
+		return nil, err
+	}
+	return s.patternsCache.Get(analyticsKey(period, owner, ws, tags, minQuality), stamp, func() (*report.Patterns, error) {
+		records, err := s.reportRecords(owner, ws, tags, minQuality)
+		if err != nil {
+			return nil, err
+		}
+
+		patterns := report.BuildPatterns(records, period, time.Now())
+		patterns.Owner, patterns.Tags, patterns.MinQuality = owner, tags, minQuality
+		if ws != nil {
+			patterns.Workspace = ws.Name
+		}
+		return patterns, nil
+	})
+}
+
+// buildForecast projects spending in month from the receipts buildReport
+// would summarize, cached the same way.
+func (s *Server) buildForecast(month report.Period, owner string, ws *shared.Workspace, tags []string, minQuality int) (*report.Forecast, error) {
+	stamp, err := s.store.Stamp()
+	if err != nil {
+		return nil, err
+	}
+	// History ends with last month, so a new month needs a new forecast
+	key := analyticsKey(month, owner, ws, tags, minQuality) + "\x00" + time.Now().Format("2006-01")
+	return s.forecastCache.Get(key, stamp, func() (*report.Forecast, error) {
+		records, err := s.reportRecords(owner, ws, tags, minQuality)
+		if err != nil {
+			return nil, err
+		}
+
+		forecast := report.BuildForecast(records, month, time.Now())
+		forecast.Owner, forecast.Tags, forecast.MinQuality = owner, tags, minQuality
+		if ws != nil {
+			forecast.Workspace = ws.Name
+		}
+		return forecast, nil
+	})
+}
+
+// analyticsKey identifies a report query. A workspace is keyed by its
+// members too, so one who joins or leaves gets a fresh report.
+func analyticsKey(period report.Period, owner string, ws *shared.Workspace, tags []string, minQuality int) string {
+	parts := []string{period.Name, owner, strings.Join(tags, ","), strconv.Itoa(minQuality)}
+	if ws != nil {
+		parts = append(parts, ws.ID, ws.Name, strings.Join(ws.MemberNames(), ","))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// ownedBy keeps the records submitted by any of owners.
+func ownedBy(records []*store.Record, owners ...string) []*store.Record {
+	kept := make([]*store.Record, 0, len(records))
+	for _, rec := range records {
+		if rec.Owner != "" && slices.Contains(owners, rec.Owner) {
+			kept = append(kept, rec)
+		}
+	}
+	return kept
+}
+
+// handleReports renders a spending report for ?period= (a month such as
+// 2025-11 or a quarter such as 2025-Q4, default last month) as html, pdf,
+// or json (?format=, default html). ?owner= limits it to one API key's
+// receipts, ?workspace= to a workspace's members, ?tag= to receipts with
+// every tag given, and ?min_quality= or ?trusted=true to receipts scoring
+// at least that well.
+func (s *Server) handleReports(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+
+	var ws *shared.Workspace
+	if id := r.URL.Query().Get("workspace"); id != "" {
+		var ok bool
+		if ws, ok = s.loadWorkspace(w, r, id); !ok {
+			return
+		}
+	}
+	s.serveReport(w, r, ws, "html")
+}
+
+// serveReport builds and writes the report requested by r's period,
+// format, and owner parameters, in defaultFormat if none is given.
+func (s *Server) serveReport(w http.ResponseWriter, r *http.Request, ws *shared.Workspace, defaultFormat string) {
+	query := r.URL.Query()
+	period, ok := reportPeriod(w, r)
+	if !ok {
+		return
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = defaultFormat
+	}
+	f, known := reportFormats[format]
+	if format != "json" && !known {
+		jsonError(w, "format must be html, pdf, or json", http.StatusBadRequest)
+		return
+	}
+
+	tags, ok := queryTags(w, r)
+	if !ok {
+		return
+	}
+	minQuality, ok := s.queryMinQuality(w, r)
+	if !ok {
+		return
+	}
+	rep, err := s.buildReport(period, query.Get("owner"), ws, tags, minQuality)
+	if err != nil {
+		jsonError(w, "Failed to list receipts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rep)
+		return
+	}
+
+	// Render fully first, so a failure can still be reported as an error
+	var buf bytes.Buffer
+	if err := f.render(&buf, rep); err != nil {
+		jsonError(w, "Failed to render report: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", f.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="myprice-report-%s.%s"`, period.Name, format))
+	w.Write(buf.Bytes())
+}
+
+// reportPeriod returns the period r asks for with ?period=, a month such
+// as 2025-11 or a quarter such as 2025-Q4, defaulting to last month. It
+// reports an invalid one.
+func reportPeriod(w http.ResponseWriter, r *http.Request) (report.Period, bool) {
+	name := r.URL.Query().Get("period")
+	if name == "" {
+		return report.Previous(false, time.Now()), true
+	}
+	p, err := report.ParsePeriod(name)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return report.Period{}, false
+	}
+	return p, true
+}
+
+// handleReportPatterns breaks down spending in ?period= by hour of day and
+// day of week, as JSON ready to draw as a heatmap. ?owner=, ?workspace=,
+// ?tag=, ?min_quality=, and ?trusted= narrow it as for handleReports.
+func (s *Server) handleReportPatterns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+	period, ok := reportPeriod(w, r)
+	if !ok {
+		return
+	}
+	var ws *shared.Workspace
+	if id := r.URL.Query().Get("workspace"); id != "" {
+		if ws, ok = s.loadWorkspace(w, r, id); !ok {
+			return
+		}
+	}
+
+	tags, ok := queryTags(w, r)
+	if !ok {
+		return
+	}
+	minQuality, ok := s.queryMinQuality(w, r)
+	if !ok {
+		return
+	}
+	patterns, err := s.buildPatterns(period, r.URL.Query().Get("owner"), ws, tags, minQuality)
+	if err != nil {
+		jsonError(w, "Failed to list receipts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(patterns)
+}
+
+// handleForecast projects spending by category for ?month= (default next
+// month, and at most a year ahead) from the complete months before this
+// one, with 80% and 95% intervals. ?owner=, ?workspace=, ?tag=,
+// ?min_quality=, and ?trusted= narrow it as for handleReports.
+func (s *Server) handleForecast(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) {
+		return
+	}
+	now := time.Now()
+	month := report.ForecastMonth(now)
+	if name := r.URL.Query().Get("month"); name != "" {
+		p, err := report.ParsePeriod(name)
+		if err != nil || strings.Contains(p.Name, "-Q") {
+			jsonError(w, "month must be a month such as 2025-11", http.StatusBadRequest)
+			return
+		}
+		thisMonth := now.Format("2006-01")
+		if p.Name < thisMonth || p.Name > now.AddDate(1, 0, 0).Format("2006-01") {
+			jsonError(w, "month must be this month or one of the next 12", http.StatusBadRequest)
+			return
+		}
+		month = p
+	}
+	var ws *shared.Workspace
+	if id := r.URL.Query().Get("workspace"); id != "" {
+		var ok bool
+		if ws, ok = s.loadWorkspace(w, r, id); !ok {
+			return
+		}
+	}
+
+	tags, ok := queryTags(w, r)
+	if !ok {
+		return
+	}
+	minQuality, ok := s.queryMinQuality(w, r)
+	if !ok {
+		return
+	}
+	forecast, err := s.buildForecast(month, r.URL.Query().Get("owner"), ws, tags, minQuality)
+	if err != nil {
+		jsonError(w, "Failed to list receipts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(forecast)
+}
+
+// ReportFile is a report saved by the schedule.
+type ReportFile struct {
+	Name      string    `json:"name"`
+	Period    string    `json:"period"`
+	Format    string    `json:"format"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReportFileListResponse lists saved reports.
+type ReportFileListResponse struct {
+	Reports []ReportFile `json:"reports"`
+	Count   int          `json:"count"`
+}
+
+// handleReportFiles lists the reports saved by the schedule, newest period
+// first.
+func (s *Server) handleReportFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entries, err := os.ReadDir(s.reportsDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		jsonError(w, "Failed to list reports: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	files := make([]ReportFile, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !reportFileRegex.MatchString(name) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		ext := filepath.Ext(name)
+		files = append(files, ReportFile{
+			Name:      name,
+			Period:    strings.TrimSuffix(name, ext),
+			Format:    ext[1:],
+			CreatedAt: info.ModTime().UTC(),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Period != files[j].Period {
+			return files[i].Period > files[j].Period
+		}
+		return files[i].Format < files[j].Format
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ReportFileListResponse{Reports: files, Count: len(files)})
+}
+
+// handleReportFile downloads a saved report.
+func (s *Server) handleReportFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.PathValue("name")
+	if !reportFileRegex.MatchString(name) {
+		jsonError(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	data, err := s.cipher.ReadFile(filepath.Join(s.reportsDir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		jsonError(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Failed to read report: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", reportFormats[filepath.Ext(name)[1:]].contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="myprice-report-%s"`, name))
+	w.Write(data)
+}
+
+// StartReports saves a report for each completed month or quarter, per
+// REPORT_SCHEDULE, checking hourly until ctx is cancelled. Periods already
+// saved are skipped, so restarts don't regenerate them.
+func (s *Server) StartReports(ctx context.Context) {
+	if s.reportSchedule == "" || s.store == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			s.saveScheduledReport(time.Now())
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// saveScheduledReport writes the HTML and PDF reports for the last
+// completed period if they don't exist yet.
+func (s *Server) saveScheduledReport(now time.Time) {
+	period := report.Previous(s.reportSchedule == scheduleQuarterly, now)
+
+	var missing []string
+	for _, format := range []string{"html", "pdf"} {
+		if _, err := os.Stat(filepath.Join(s.reportsDir, period.Name+"."+format)); errors.Is(err, os.ErrNotExist) {
+			missing = append(missing, format)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	rep, err := s.buildReport(period, "", nil, nil, 0)
+	if err != nil {
+		log.Printf("Warning: failed to build %s report: %v", period.Name, err)
+		return
+	}
+	if err := os.MkdirAll(s.reportsDir, 0755); err != nil {
+		log.Printf("Warning: could not create reports dir: %v", err)
+		return
+	}
+	for _, format := range missing {
+		var buf bytes.Buffer
+		if err := reportFormats[format].render(&buf, rep); err != nil {
+			log.Printf("Warning: failed to render %s report: %v", period.Name, err)
+			continue
+		}
+		path := filepath.Join(s.reportsDir, period.Name+"."+format)
+		if err := s.cipher.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			log.Printf("Warning: failed to save report %s: %v", path, err)
+			continue
+		}
+		log.Printf("Saved %s spending report %s", s.reportSchedule, path)
+	}
+}
+
+// reportSchedule reads REPORT_SCHEDULE. Unknown values disable scheduled
+// reports rather than guessing.
+func reportSchedule() string {
+	schedule := strings.ToLower(strings.TrimSpace(os.Getenv("REPORT_SCHEDULE")))
+	switch schedule {
+	case "", scheduleMonthly, scheduleQuarterly:
+		return schedule
+	}
+	log.Printf("Warning: REPORT_SCHEDULE must be %q or %q, got %q; scheduled reports disabled", scheduleMonthly, scheduleQuarterly, schedule)
+	return ""
+}
@@ -0,0 +1,464 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"myprice/internal/crypt"
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+)
+
+const (
+	// defaultRevalidateBatch is the most receipts one revalidation pass
+	// re-runs.
+	defaultRevalidateBatch = 10
+
+	// defaultRevalidateDailyTokens is the model tokens revalidation may
+	// use per UTC day.
+	defaultRevalidateDailyTokens = 200_000
+
+	// defaultRevalidateMinConfidence is the mean OCR confidence below
+	// which a receipt counts as low-confidence.
+	defaultRevalidateMinConfidence = 80
+
+	// maxRevalidateAttempts is how often a receipt whose re-run fails is
+	// tried again before it is left as it is.
+	maxRevalidateAttempts = 3
+
+	// defaultRevalidateMinAge keeps revalidation off receipts analyzed
+	// recently, which their owners may still be reviewing.
+	defaultRevalidateMinAge = 24 * time.Hour
+)
+
+// revalidation re-runs old low-confidence receipts with the current model
+// and prompts while the server is otherwise idle, keeping a new result
+// only when it validates better than the stored one.
+type revalidation struct {
+	interval      time.Duration
+	batch         int
+	dailyTokens   int     // Model tokens allowed per UTC day; 0 means no limit
+	minConfidence float64 // Mean OCR confidence below which a receipt is re-run
+	minAge        time.Duration
+	model         string
+	statePath     string
+
+	mu    sync.Mutex
+	state RevalidationState
+}
+
+// RevalidationState is revalidation's progress, persisted so restarts keep
+// the day's token use and don't re-run receipts already tried.
+type RevalidationState struct {
+	Day       string    `json:"day,omitempty"` // UTC day Tokens counts, "2006-01-02"
+	Tokens    int       `json:"tokens"`        // Model tokens used on Day
+	LastRun   time.Time `json:"last_run,omitempty"`
+	Checked   int       `json:"checked"`   // Receipts re-run
+	Improved  int       `json:"improved"`  // Of those, stored as a new version
+	Unchanged int       `json:"unchanged"` // Of those, kept as they were
+	Failed    int       `json:"failed"`    // Of those, given up on
+	LastError string    `json:"last_error,omitempty"`
+
+	// The model and prompt version each receipt was last re-run with, so
+	// it isn't re-run until one of them changes
+	Tried map[string]string `json:"tried,omitempty"`
+
+	// Failed re-runs of each receipt not yet given up on
+	Failures map[string]int `json:"failures,omitempty"`
+}
+
+// RevalidationStatus reports revalidation's settings and progress.
+type RevalidationStatus struct {
+	Enabled       bool      `json:"enabled"`
+	Interval      string    `json:"interval,omitempty"`
+	Batch         int       `json:"batch,omitempty"`
+	Model         string    `json:"model,omitempty"`
+	MinConfidence float64   `json:"min_confidence,omitempty"`
+	MinAge        string    `json:"min_age,omitempty"`
+	DailyTokens   int       `json:"daily_tokens,omitempty"` // 0 means no limit
+	TokensToday   int       `json:"tokens_today"`
+	LastRun       time.Time `json:"last_run,omitempty"`
+	Checked       int       `json:"checked"`
+	Improved      int       `json:"improved"`
+	Unchanged     int       `json:"unchanged"`
+	Failed        int       `json:"failed"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+// revalidationConfig reads REVALIDATE_INTERVAL, REVALIDATE_BATCH,
+// REVALIDATE_DAILY_TOKENS, REVALIDATE_MIN_CONFIDENCE, REVALIDATE_MIN_AGE,
+// REVALIDATE_MODEL, and REVALIDATE_STATE, and loads the saved progress. It
+// returns nil when REVALIDATE_INTERVAL isn't set: revalidation spends
+// model tokens nobody asked for, so it is opt-in.
+func revalidationConfig(projectRoot string, models []string, cipher *crypt.Cipher) (*revalidation, error) {
+	raw := os.Getenv("REVALIDATE_INTERVAL")
+	if raw == "" {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(raw)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("REVALIDATE_INTERVAL must be a positive duration such as 1h, got %q", raw)
+	}
+
+	r := &revalidation{
+		interval:      interval,
+		batch:         max(envInt("REVALIDATE_BATCH", defaultRevalidateBatch), 1),
+		dailyTokens:   max(envInt("REVALIDATE_DAILY_TOKENS", defaultRevalidateDailyTokens), 0),
+		minConfidence: envFloat("REVALIDATE_MIN_CONFIDENCE", defaultRevalidateMinConfidence),
+		minAge:        max(envDuration("REVALIDATE_MIN_AGE", defaultRevalidateMinAge), 0),
+		model:         claudeModel,
+		statePath:     os.Getenv("REVALIDATE_STATE"),
+	}
+	if m := os.Getenv("REVALIDATE_MODEL"); m != "" {
+		if !slices.Contains(models, m) {
+			return nil, fmt.Errorf("REVALIDATE_MODEL %q must be the production model or listed in LLM_MODELS", m)
+		}
+		r.model = m
+	}
+	if r.statePath == "" {
+		r.statePath = filepath.Join(projectRoot, "revalidation.json")
+	}
+
+	data, err := cipher.ReadFile(r.statePath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read %s: %w", r.statePath, err)
+	default:
+		if err := json.Unmarshal(data, &r.state); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", r.statePath, err)
+		}
+	}
+	if r.state.Tried == nil {
+		r.state.Tried = make(map[string]string)
+	}
+	if r.state.Failures == nil {
+		r.state.Failures = make(map[string]int)
+	}
+	return r, nil
+}
+
+// StartRevalidation runs a revalidation pass every REVALIDATE_INTERVAL
+// until ctx is cancelled. It does nothing unless revalidation is
+// configured and the Claude API is, since the regex parser has nothing
+// newer to offer.
+func (s *Server) StartRevalidation(ctx context.Context) {
+	r := s.revalidation
+	if r == nil || s.store == nil {
+		return
+	}
+	if s.claudeAPI == nil {
+		log.Printf("Warning: REVALIDATE_INTERVAL is set without the Claude API; revalidation disabled")
+		return
+	}
+	log.Printf("Revalidating up to %d low-confidence receipts with %s every %s when idle", r.batch, r.model, r.interval)
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			s.revalidatePass(ctx)
+		}
+	}()
+}
+
+// revalidatePass re-runs up to a batch of low-confidence receipts, oldest
+// first. It stops early when other work arrives, the day's token budget is
+// spent, or an analysis fails, since a provider outage would fail every
+// receipt after it; a failed receipt is tried again on later passes, up to
+// maxRevalidateAttempts times. The budget is checked before each receipt,
+// so the last one may overrun it.
+func (s *Server) revalidatePass(ctx context.Context) {
+	r := s.revalidation
+	if !s.idle() {
+		return
+	}
+	records, err := s.store.List()
+	if err != nil {
+		log.Printf("Warning: revalidation could not list receipts: %v", err)
+		return
+	}
+	candidates := s.revalidationCandidates(records, time.Now())
+
+	r.mu.Lock()
+	r.state.LastRun = time.Now().UTC()
+	r.mu.Unlock()
+	defer s.saveRevalidationState()
+
+	for i, rec := range candidates {
+		if i == r.batch || ctx.Err() != nil || !s.idle() || !r.withinBudget(time.Now()) {
+			return
+		}
+		if err := s.revalidate(ctx, rec); err != nil {
+			log.Printf("Warning: revalidating %s failed: %v", rec.ID, err)
+			return
+		}
+		s.saveRevalidationState()
+	}
+}
+
+// revalidationCandidates returns the latest versions of receipts old
+// enough to revalidate that are low-confidence and weren't parsed, or
+// re-run, with the current model and prompt, oldest first. A receipt is
+// low-confidence when the regex parser stood in for the model, its output
+// fails validation, or its mean OCR confidence is below the threshold.
+func (s *Server) revalidationCandidates(records []*store.Record, now time.Time) []*store.Record {
+	r := s.revalidation
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var candidates []*store.Record
+	for _, rec := range records {
+		if rec.SupersededBy != "" || rec.Parser == parserManual || now.Sub(rec.CreatedAt) < r.minAge {
+			continue
+		}
+		docType := receipt.DocumentType(rec.DocumentType)
+		target := r.model + "/" + s.currentPromptVersion(docType)
+		if r.state.Tried[rec.ID] == target || (rec.Parser == parserLLM && rec.Model+"/"+rec.PromptVersion == target) {
+			continue
+		}
+		lowConfidence := rec.Parser == parserHeuristic ||
+			(rec.OCRConfidence > 0 && rec.OCRConfidence < r.minConfidence) ||
+			len(s.outputIssues(rec.Data, docType)) > 0
+		if lowConfidence {
+			candidates = append(candidates, rec)
+		}
+	}
+	// List is newest first
+	slices.Reverse(candidates)
+	return candidates
+}
+
+// revalidate re-runs one receipt and stores the new result as its next
+// version if it validates better. It returns an error only for failures
+// worth stopping the pass for; a receipt that can't be re-run at all, such
+// as one whose image is gone, is recorded as tried and skipped.
+func (s *Server) revalidate(ctx context.Context, old *store.Record) error {
+	r := s.revalidation
+	docType := receipt.DocumentType(old.DocumentType)
+	target := r.model + "/" + s.currentPromptVersion(docType)
+
+	actx, attempt := s.startAttempt(ctx, viaRevalidate, "", old.ImagePath)
+	attempt.entry.PreviousID = old.ID
+	defer func() {
+		used := attempt.meter.total()
+		r.spend(used.Input+used.Output, time.Now())
+	}()
+
+	// Retention may have removed the image, and only archived ones come back
+	err := s.restoreOriginal(old)
+	if err == nil {
+		if _, statErr := os.Stat(old.ImagePath); statErr != nil {
+			err = fmt.Errorf("image is no longer available: %w", statErr)
+		}
+	}
+	if err != nil {
+		attempt.finish(nil, "", err)
+		r.record(old.ID, target, "", err)
+		return nil
+	}
+
+	result, err := s.analyze(actx, old.ImagePath, docType, r.model)
+	if err == nil && result.Parser != parserLLM {
+		err = errors.New("the model could not parse it")
+	}
+	if err != nil {
+		attempt.finish(nil, "", err)
+		if rejectedContent(err) != "" {
+			// Running it again won't make it a receipt
+			r.record(old.ID, target, "", err)
+			return nil
+		}
+		r.fail(old.ID, target, err)
+		return err
+	}
+
+	before := s.validationScore(old.Parser, old.Data, docType)
+	after := s.validationScore(result.Parser, result.Output, docType)
+	if !after.better(before) {
+		log.Printf("Revalidated %s: no improvement (%d issues before, %d after)", old.ID, before.issues, after.issues)
+		attempt.finish(result, "", nil)
+		r.record(old.ID, target, "", nil)
+		return nil
+	}
+
+	rec := result.record(old.ImagePath)
+	rec.PreviousID = old.ID
+	rec.Owner = old.Owner
+	newID := s.saveResult(rec)
+	attempt.finish(result, newID, nil)
+	if newID == "" {
+		err := errors.New("failed to save new version")
+		r.fail(old.ID, target, err)
+		return err
+	}
+	log.Printf("Revalidated %s as %s: %d validation issues before, %d after", old.ID, newID, before.issues, after.issues)
+	r.record(old.ID, target, newID, nil)
+	return nil
+}
+
+// validationScore is how well a parsed output holds up: its validation
+// issues, whether the regex parser produced it, and the anomalies the
+// model noted.
+type validationScore struct {
+	issues    int
+	heuristic bool
+	anomalies int
+}
+
+// validationScore scores a stored or new output.
+func (s *Server) validationScore(parser string, output map[string]any, docType receipt.DocumentType) validationScore {
+	anomalies, _ := output["anomalies"].([]any)
+	return validationScore{
+		issues:    len(s.outputIssues(output, docType)),
+		heuristic: parser == parserHeuristic,
+		anomalies: len(anomalies),
+	}
+}
+
+// better reports whether v improves on old: fewer validation issues, or as
+// many from the model where the regex parser stood in before, or as many
+// from the same kind of parser with fewer anomalies noted.
+func (v validationScore) better(old validationScore) bool {
+	switch {
+	case v.issues != old.issues:
+		return v.issues < old.issues
+	case v.heuristic != old.heuristic:
+		return !v.heuristic
+	default:
+		return v.anomalies < old.anomalies
+	}
+}
+
+// idle reports whether no analysis is running or waiting: no Textract or
+// model call in flight or queued, and no queued upload waiting to start.
+func (s *Server) idle() bool {
+	t, m := s.textractLimit.Stats(), s.llmLimit.Stats()
+	if t.InFlight+t.Queued+m.InFlight+m.Queued > 0 {
+		return false
+	}
+	return s.analysisQueue == nil || s.analysisQueue.pending() == 0
+}
+
+// withinBudget reports whether tokens are left in the day's budget.
+func (r *revalidation) withinBudget(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rollDay(now)
+	return r.dailyTokens == 0 || r.state.Tokens < r.dailyTokens
+}
+
+// spend counts tokens used against the day's budget.
+func (r *revalidation) spend(tokens int, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rollDay(now)
+	r.state.Tokens += tokens
+}
+
+// rollDay starts a new day's budget once the UTC day changes. The caller
+// holds r.mu.
+func (r *revalidation) rollDay(now time.Time) {
+	if day := now.UTC().Format("2006-01-02"); r.state.Day != day {
+		r.state.Day, r.state.Tokens = day, 0
+	}
+}
+
+// record notes that receipt id was re-run with target, the model and
+// prompt version, and whether it was stored again as newID, kept, or
+// couldn't be re-run because of err.
+func (r *revalidation) record(id, target, newID string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state.Tried[id] = target
+	delete(r.state.Failures, id)
+	r.state.Checked++
+	switch {
+	case err != nil:
+		r.state.Failed++
+		r.state.LastError = fmt.Sprintf("%s: %v", id, err)
+	case newID != "":
+		r.state.Improved++
+		// The new version was parsed with target, so it won't be picked again
+		delete(r.state.Tried, id)
+	default:
+		r.state.Unchanged++
+	}
+}
+
+// fail notes a failed re-run of receipt id, which ended the pass. The
+// receipt is run again on a later pass, until it has failed
+// maxRevalidateAttempts times; then it is recorded as tried with target.
+func (r *revalidation) fail(id, target string, err error) {
+	r.mu.Lock()
+	r.state.Failures[id]++
+	attempts := r.state.Failures[id]
+	r.state.LastError = fmt.Sprintf("%s: %v", id, err)
+	r.mu.Unlock()
+	if attempts >= maxRevalidateAttempts {
+		log.Printf("Warning: giving up revalidating %s after %d attempts: %v", id, attempts, err)
+		r.record(id, target, "", err)
+	}
+}
+
+// saveRevalidationState persists revalidation's progress, logging failures.
+func (s *Server) saveRevalidationState() {
+	r := s.revalidation
+	r.mu.Lock()
+	data, err := json.MarshalIndent(r.state, "", "  ")
+	r.mu.Unlock()
+	if err == nil {
+		err = s.cipher.WriteFile(r.statePath, data, 0644)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to save revalidation state: %v", err)
+	}
+}
+
+// handleAdminRevalidation reports revalidation's settings and progress.
+func (s *Server) handleAdminRevalidation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := RevalidationStatus{}
+	if rv := s.revalidation; rv != nil && s.claudeAPI != nil {
+		rv.mu.Lock()
+		rv.rollDay(time.Now())
+		status = RevalidationStatus{
+			Enabled:       true,
+			Interval:      rv.interval.String(),
+			Batch:         rv.batch,
+			Model:         rv.model,
+			MinConfidence: rv.minConfidence,
+			MinAge:        rv.minAge.String(),
+			DailyTokens:   rv.dailyTokens,
+			TokensToday:   rv.state.Tokens,
+			LastRun:       rv.state.LastRun,
+			Checked:       rv.state.Checked,
+			Improved:      rv.state.Improved,
+			Unchanged:     rv.state.Unchanged,
+			Failed:        rv.state.Failed,
+			LastError:     rv.state.LastError,
+		}
+		rv.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
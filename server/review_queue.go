@@ -0,0 +1,536 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"myprice/internal/crypt"
+	"myprice/internal/eval"
+	"myprice/internal/receipt"
+	"myprice/internal/review"
+	"myprice/internal/store"
+)
+
+const (
+	// defaultReviewClaimTTL is how long a reviewer's claim on a receipt
+	// lasts, when REVIEW_CLAIM_TTL isn't set, before the receipt goes back
+	// to the queue.
+	defaultReviewClaimTTL = 30 * time.Minute
+
+	// defaultReviewQueueLimit and maxReviewQueueLimit bound queue listings.
+	defaultReviewQueueLimit = 50
+	maxReviewQueueLimit     = 1000
+)
+
+// Why a receipt is in the review queue.
+const (
+	reviewReasonQuality  = "quality"  // It scores below the threshold
+	reviewReasonConflict = "conflict" // Both sides of its experiment pair parsed it, differently
+)
+
+// Review statuses.
+const (
+	reviewUnclaimed = "unclaimed"
+	reviewClaimed   = "claimed"
+	reviewResolved  = "resolved"
+)
+
+// reviewConfig opens the review queue's claims and resolutions, in
+// REVIEW_STATE or review.json under projectRoot, with claims lasting
+// REVIEW_CLAIM_TTL. It returns nil when the state can't be opened, and the
+// queue can be listed but not worked.
+func reviewConfig(projectRoot string, cipher *crypt.Cipher) *review.Store {
+	path := os.Getenv("REVIEW_STATE")
+	if path == "" {
+		path = filepath.Join(projectRoot, "review.json")
+	}
+	reviews, err := review.Open(path, envDuration("REVIEW_CLAIM_TTL", defaultReviewClaimTTL), cipher)
+	if err != nil {
+		log.Printf("Warning: could not open review state: %v. Receipts can't be claimed or resolved.", err)
+		return nil
+	}
+	return reviews
+}
+
+// ReviewConflict is where the two parses of an experiment pair disagree.
+type ReviewConflict struct {
+	PairID         string         `json:"pair_id"`
+	Experiment     string         `json:"experiment"`
+	ControlModel   string         `json:"control_model"`
+	CandidateModel string         `json:"candidate_model"`
+	Changes        []store.Change `json:"changes"` // The stored result's values as old, the candidate's as new
+}
+
+// ReviewItem is a receipt in the review queue, with why it is there and
+// who is working on it.
+type ReviewItem struct {
+	review.Entry
+	Status       string           `json:"status"` // "unclaimed", "claimed", or "resolved"
+	Reasons      []string         `json:"reasons"`
+	Owner        string           `json:"owner,omitempty"`
+	DocumentType string           `json:"document_type"`
+	Vendor       string           `json:"vendor"`
+	Date         string           `json:"date"`
+	Total        float64          `json:"total"`
+	Quality      *receipt.Quality `json:"quality,omitempty"`
+	Conflict     *ReviewConflict  `json:"conflict,omitempty"`
+	CreatedAt    time.Time        `json:"created_at"` // When the version was stored
+}
+
+// ReviewDepth counts the receipts waiting in the review queue.
+type ReviewDepth struct {
+	Open      int            `json:"open"` // Unresolved, claimed or not
+	Unclaimed int            `json:"unclaimed"`
+	Claimed   int            `json:"claimed"`
+	ByReason  map[string]int `json:"by_reason"`           // Open receipts by reason; one may have both
+	ByOwner   map[string]int `json:"by_owner,omitempty"`  // Open receipts by the API key that submitted them
+	OldestAt  *time.Time     `json:"oldest_at,omitempty"` // When the longest-waiting open receipt was stored
+}
+
+// ReviewQueueResponse lists receipts in the review queue, lowest quality
+// first.
+type ReviewQueueResponse struct {
+	Items []ReviewItem `json:"items"`
+	Count int          `json:"count"` // Matching items, before limit
+	Depth ReviewDepth  `json:"depth"` // The whole queue, whatever the filters
+}
+
+// ReviewStatsResponse describes the review queue and the work done on it.
+type ReviewStatsResponse struct {
+	Threshold int `json:"threshold"`
+	ReviewDepth
+	ClaimsByReviewer map[string]int `json:"claims_by_reviewer"` // Open receipts each reviewer holds
+	ResolvedToday    int            `json:"resolved_today"`     // Since midnight UTC
+	ResolvedWeek     int            `json:"resolved_week"`      // The last 7 days
+	ByResolution     map[string]int `json:"by_resolution"`      // Over the last 7 days
+}
+
+// ReviewResolveRequest resolves a receipt in the review queue.
+type ReviewResolveRequest struct {
+	Resolution review.Resolution `json:"resolution"` // "accepted" or "rejected"
+	Note       string            `json:"note,omitempty"`
+}
+
+// maxReviewNoteLength bounds a resolution's note, in bytes.
+const maxReviewNoteLength = 2000
+
+// reviewQueue works out the review queue: the current versions scoring
+// below below, or whose experiment pair parsed them differently, with each
+// one's review state, lowest quality first. Versions corrected by hand
+// aren't queued, since a person wrote their data.
+func (s *Server) reviewQueue(below int) ([]ReviewItem, error) {
+	records, err := s.store.List()
+	if err != nil {
+		return nil, err
+	}
+	conflicts, err := s.reviewConflicts()
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]review.Entry
+	if s.reviews != nil {
+		entries = s.reviews.All()
+	}
+
+	items := make([]ReviewItem, 0)
+	for _, rec := range latestVersions(records) {
+		entry, ok := entries[rec.ID]
+		if !ok {
+			entry = review.Entry{ReceiptID: rec.ID}
+		}
+		if item := reviewItem(rec, below, entry, conflicts[rec.ID]); len(item.Reasons) > 0 {
+			items = append(items, item)
+		}
+	}
+
+	// Unscored documents, such as invoices, are only here for a conflict,
+	// and come first like the lowest scores
+	score := func(item ReviewItem) int {
+		if item.Quality == nil {
+			return -1
+		}
+		return item.Quality.Score
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if si, sj := score(items[i]), score(items[j]); si != sj {
+			return si < sj
+		}
+		return items[i].CreatedAt.Before(items[j].CreatedAt)
+	})
+	return items, nil
+}
+
+// reviewItem describes rec in the review queue, with the reasons it needs
+// review at the quality threshold below, if any, and its review state.
+func reviewItem(rec *store.Record, below int, entry review.Entry, conflict *ReviewConflict) ReviewItem {
+	e := expenseFromRecord(rec)
+	item := ReviewItem{
+		Entry:        entry,
+		Status:       reviewStatus(entry),
+		Reasons:      []string{},
+		Owner:        rec.Owner,
+		DocumentType: rec.DocumentType,
+		Vendor:       e.Vendor,
+		Date:         e.Date,
+		Total:        e.Total,
+		Quality:      recordQuality(rec),
+		Conflict:     conflict,
+		CreatedAt:    rec.CreatedAt,
+	}
+	if rec.Parser == parserManual {
+		return item
+	}
+	if item.Quality != nil && item.Quality.Score < below {
+		item.Reasons = append(item.Reasons, reviewReasonQuality)
+	}
+	if item.Conflict != nil {
+		item.Reasons = append(item.Reasons, reviewReasonConflict)
+	}
+	return item
+}
+
+// reviewConflicts returns, by receipt ID, where the latest experiment pair
+// of each stored result disagrees. Pairs where either side failed aren't
+// conflicts: there is only one parse to go by.
+func (s *Server) reviewConflicts() (map[string]*ReviewConflict, error) {
+	conflicts := make(map[string]*ReviewConflict)
+	if s.evals == nil {
+		return conflicts, nil
+	}
+	pairs, _, err := s.evals.Find(eval.Query{})
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, p := range pairs {
+		// Newest first, so a receipt's latest pair decides
+		if p.ReceiptID == "" || seen[p.ReceiptID] {
+			continue
+		}
+		seen[p.ReceiptID] = true
+		if p.Control.Failed() || p.Candidate.Failed() || p.Agree() {
+			continue
+		}
+		conflicts[p.ReceiptID] = &ReviewConflict{
+			PairID:         p.ID,
+			Experiment:     p.Experiment,
+			ControlModel:   p.Control.Model,
+			CandidateModel: p.Candidate.Model,
+			Changes:        p.Changes,
+		}
+	}
+	return conflicts, nil
+}
+
+// reviewStatus says where an entry is in review.
+func reviewStatus(e review.Entry) string {
+	switch {
+	case e.Resolved():
+		return reviewResolved
+	case e.Claimed(time.Now()):
+		return reviewClaimed
+	}
+	return reviewUnclaimed
+}
+
+// reviewDepth counts the open items in the queue.
+func reviewDepth(items []ReviewItem) ReviewDepth {
+	d := ReviewDepth{ByReason: map[string]int{reviewReasonQuality: 0, reviewReasonConflict: 0}}
+	for _, item := range items {
+		if item.Status == reviewResolved {
+			continue
+		}
+		d.Open++
+		if item.Status == reviewClaimed {
+			d.Claimed++
+		} else {
+			d.Unclaimed++
+		}
+		for _, reason := range item.Reasons {
+			d.ByReason[reason]++
+		}
+		if item.Owner != "" {
+			if d.ByOwner == nil {
+				d.ByOwner = make(map[string]int)
+			}
+			d.ByOwner[item.Owner]++
+		}
+		if d.OldestAt == nil || item.CreatedAt.Before(*d.OldestAt) {
+			t := item.CreatedAt
+			d.OldestAt = &t
+		}
+	}
+	return d
+}
+
+// handleReviewQueue lists the receipts waiting for review, lowest quality
+// first: ?status= is open (default; claimed or not), unclaimed, claimed,
+// mine (claimed by the caller), resolved, or all. ?reason= is quality or
+// conflict, ?owner= limits it to one API key's receipts, ?below= sets the
+// quality threshold instead of QUALITY_THRESHOLD, and ?limit= caps the
+// items returned.
+func (s *Server) handleReviewQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+	query := r.URL.Query()
+	below := s.qualityThreshold
+	if v := query.Get("below"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 100 {
+			jsonError(w, "below must be a score from 0 to 100", http.StatusBadRequest)
+			return
+		}
+		below = n
+	}
+	limit := defaultReviewQueueLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			jsonError(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+		if limit > maxReviewQueueLimit {
+			limit = maxReviewQueueLimit
+		}
+	}
+	status := query.Get("status")
+	if status == "" {
+		status = "open"
+	}
+	caller := ""
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		caller = p.Name
+	}
+	keep := map[string]func(ReviewItem) bool{
+		"open":          func(item ReviewItem) bool { return item.Status != reviewResolved },
+		reviewUnclaimed: func(item ReviewItem) bool { return item.Status == reviewUnclaimed },
+		reviewClaimed:   func(item ReviewItem) bool { return item.Status == reviewClaimed },
+		"mine":          func(item ReviewItem) bool { return item.Status == reviewClaimed && item.ClaimedBy == caller },
+		reviewResolved:  func(item ReviewItem) bool { return item.Status == reviewResolved },
+		"all":           func(ReviewItem) bool { return true },
+	}[status]
+	if keep == nil {
+		jsonError(w, "status must be open, unclaimed, claimed, mine, resolved, or all", http.StatusBadRequest)
+		return
+	}
+	reason := query.Get("reason")
+	if reason != "" && reason != reviewReasonQuality && reason != reviewReasonConflict {
+		jsonError(w, "reason must be quality or conflict", http.StatusBadRequest)
+		return
+	}
+	owner := query.Get("owner")
+
+	items, err := s.reviewQueue(below)
+	if err != nil {
+		jsonError(w, "Failed to list the review queue: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := ReviewQueueResponse{Items: make([]ReviewItem, 0), Depth: reviewDepth(items)}
+	for _, item := range items {
+		if !keep(item) || (owner != "" && item.Owner != owner) || (reason != "" && !slices.Contains(item.Reasons, reason)) {
+			continue
+		}
+		resp.Count++
+		if len(resp.Items) < limit {
+			resp.Items = append(resp.Items, item)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleReviewStats reports how deep the review queue is and how fast it
+// is being worked: open receipts by reason and owner, the longest wait,
+// the claims each reviewer holds, and resolutions today and this week.
+func (s *Server) handleReviewStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+	items, err := s.reviewQueue(s.qualityThreshold)
+	if err != nil {
+		jsonError(w, "Failed to list the review queue: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := ReviewStatsResponse{
+		Threshold:        s.qualityThreshold,
+		ReviewDepth:      reviewDepth(items),
+		ClaimsByReviewer: make(map[string]int),
+		ByResolution:     map[string]int{string(review.ResolutionAccepted): 0, string(review.ResolutionRejected): 0},
+	}
+	for _, item := range items {
+		if item.Status == reviewClaimed {
+			resp.ClaimsByReviewer[item.ClaimedBy]++
+		}
+	}
+	if s.reviews != nil {
+		now := time.Now().UTC()
+		today, week := now.Truncate(24*time.Hour), now.AddDate(0, 0, -7)
+		for _, e := range s.reviews.Resolutions() {
+			if e.ResolvedAt.Before(week) {
+				break
+			}
+			resp.ResolvedWeek++
+			resp.ByResolution[string(e.Resolution)]++
+			if !e.ResolvedAt.Before(today) {
+				resp.ResolvedToday++
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleReviewClaim claims a receipt for the caller to review (POST), or
+// renews their claim, and gives it up (DELETE). A claim another reviewer
+// holds can only be released by an admin.
+func (s *Server) handleReviewClaim(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rec, ok := s.loadReviewRecord(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	reviewer, override := reviewerOf(r)
+
+	var entry review.Entry
+	var err error
+	if r.Method == http.MethodPost {
+		entry, err = s.reviews.Claim(rec.ID, reviewer)
+	} else {
+		entry, err = s.reviews.Release(rec.ID, reviewer, override)
+	}
+	if writeReviewError(w, entry, err) {
+		return
+	}
+	s.writeReviewItem(w, rec)
+}
+
+// handleReviewResolve records how the caller resolved a receipt in the
+// review queue, ending their claim. A receipt whose data was wrong is
+// corrected with PUT /api/receipts/{id}/data instead, which any reviewer
+// may do whoever owns the receipt, and which replaces it in the queue.
+func (s *Server) handleReviewResolve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req ReviewResolveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !req.Resolution.Valid() {
+		jsonError(w, "resolution must be accepted or rejected; correct a receipt's data with PUT /api/receipts/{id}/data", http.StatusBadRequest)
+		return
+	}
+	if len(req.Note) > maxReviewNoteLength {
+		jsonError(w, "note must be at most "+strconv.Itoa(maxReviewNoteLength)+" characters", http.StatusBadRequest)
+		return
+	}
+	rec, ok := s.loadReviewRecord(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	reviewer, override := reviewerOf(r)
+
+	entry, err := s.reviews.Resolve(rec.ID, reviewer, req.Resolution, req.Note, override)
+	if writeReviewError(w, entry, err) {
+		return
+	}
+	log.Printf("Review of %s resolved as %s", rec.ID, req.Resolution)
+	s.writeReviewItem(w, rec)
+}
+
+// loadReviewRecord loads the current receipt a review request is about.
+// It answers 409 for a version that has been superseded, naming the one
+// to review instead.
+func (s *Server) loadReviewRecord(w http.ResponseWriter, id string) (*store.Record, bool) {
+	if !s.requireStore(w) {
+		return nil, false
+	}
+	if s.reviews == nil {
+		jsonError(w, "Review state is not available", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	rec, ok := s.loadRecord(w, id)
+	if !ok {
+		return nil, false
+	}
+	if rec.SupersededBy != "" {
+		jsonError(w, "Receipt "+id+" was superseded by "+rec.SupersededBy+"; review that version", http.StatusConflict)
+		return nil, false
+	}
+	return rec, true
+}
+
+// reviewerOf names the caller of a review request, "" without API_KEYS,
+// and reports whether they may override other reviewers' claims.
+func reviewerOf(r *http.Request) (name string, override bool) {
+	p, ok := PrincipalFrom(r.Context())
+	if !ok {
+		return "", true
+	}
+	return p.Name, p.Role >= RoleAdmin
+}
+
+// writeReviewError answers a failed claim, release, or resolution of the
+// receipt whose entry the store returned, and returns true, or returns false
+// when err is nil.
+func writeReviewError(w http.ResponseWriter, e review.Entry, err error) bool {
+	if err == nil {
+		return false
+	}
+	switch {
+	case errors.Is(err, review.ErrClaimed):
+		// The entry is the one that conflicted; a claim without a TTL has
+		// no expiry
+		msg := "Receipt " + e.ReceiptID + " is claimed by " + e.ClaimedBy
+		if e.ClaimExpiresAt != nil {
+			msg += " until " + e.ClaimExpiresAt.Format(time.RFC3339)
+		}
+		jsonError(w, msg, http.StatusConflict)
+	case errors.Is(err, review.ErrResolved), errors.Is(err, review.ErrNotClaimed):
+		jsonError(w, err.Error(), http.StatusConflict)
+	default:
+		jsonError(w, "Failed to save review state: "+err.Error(), http.StatusInternalServerError)
+	}
+	return true
+}
+
+// writeReviewItem answers with a receipt's place in the review queue. A
+// receipt that doesn't need review has no reasons.
+func (s *Server) writeReviewItem(w http.ResponseWriter, rec *store.Record) {
+	conflicts, err := s.reviewConflicts()
+	if err != nil {
+		jsonError(w, "Failed to read experiment pairs: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	item := reviewItem(rec, s.qualityThreshold, s.reviews.Get(rec.ID), conflicts[rec.ID])
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(item)
+}
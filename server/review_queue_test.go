@@ -0,0 +1,43 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"myprice/internal/review"
+)
+
+func TestWriteReviewErrorClaimWithoutTTL(t *testing.T) {
+	reviews, err := review.Open(filepath.Join(t.TempDir(), "review.json"), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reviews.Claim("r1", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := reviews.Claim("r1", "bob")
+
+	w := httptest.NewRecorder()
+	if !writeReviewError(w, entry, err) {
+		t.Fatal("writeReviewError reported no error")
+	}
+	if w.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusConflict)
+	}
+	var body struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Receipt r1 is claimed by alice"; body.Message != want {
+		t.Errorf("message = %q, want %q", body.Message, want)
+	}
+	if strings.Contains(body.Message, "until") {
+		t.Errorf("message %q gives an expiry for a claim without one", body.Message)
+	}
+}
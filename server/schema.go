@@ -0,0 +1,36 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"myprice/internal/receipt"
+)
+
+// handleSchema serves the JSON Schema of a parsed document type, receipt
+// or invoice, generated from the same types the parsers fill in. It is
+// public, so consumers can fetch it without an API key.
+func (s *Server) handleSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	docType := receipt.DocumentType(r.PathValue("type"))
+	if docType != receipt.DocumentTypeReceipt && docType != receipt.DocumentTypeInvoice {
+		jsonError(w, "Unknown document type; use receipt or invoice", http.StatusNotFound)
+		return
+	}
+	schema, err := receipt.Schema(docType)
+	if err != nil {
+		jsonError(w, "Failed to generate schema: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(schema)
+}
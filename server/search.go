@@ -0,0 +1,185 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"myprice/internal/store"
+	"myprice/internal/textindex"
+)
+
+const (
+	// defaultSearchLimit and maxSearchLimit bound search results.
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// SearchResult is a receipt whose OCR text matched a search.
+type SearchResult struct {
+	Receipt *store.Record     `json:"receipt"`
+	Score   int               `json:"score"`
+	Matches []textindex.Match `json:"matches"`
+}
+
+// SearchResponse lists the receipts matching a search, best first.
+type SearchResponse struct {
+	Query   string         `json:"query"`
+	Results []SearchResult `json:"results"`
+	Count   int            `json:"count"`
+	Total   int            `json:"total"` // Matches before the limit
+}
+
+// handleSearch searches the raw OCR text of stored receipts, so text the
+// parsers didn't extract, such as a promo code or cashier name, can still
+// be found. ?q= holds the query and ?tag= limits it to receipts with every
+// tag given; superseded versions are skipped unless ?all=true is given.
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+	if s.textIndex == nil {
+		jsonError(w, "Text search is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+	tags, ok := queryTags(w, r)
+	if !ok {
+		return
+	}
+	limit := defaultSearchLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			jsonError(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxSearchLimit)
+	}
+
+	records, err := s.store.List()
+	if err != nil {
+		jsonError(w, "Failed to list receipts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	all := r.URL.Query().Get("all") == "true"
+	byID := make(map[string]*store.Record, len(records))
+	for _, rec := range records {
+		if (all || rec.SupersededBy == "") && rec.HasTags(tags...) {
+			byID[rec.ID] = rec
+		}
+	}
+
+	hits, err := s.textIndex.Search(query, func(id string) bool { return byID[id] != nil })
+	if errors.Is(err, textindex.ErrEmptyQuery) {
+		jsonError(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Search failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := SearchResponse{Query: query, Results: make([]SearchResult, 0, min(len(hits), limit)), Total: len(hits)}
+	for _, hit := range hits[:min(len(hits), limit)] {
+		resp.Results = append(resp.Results, SearchResult{Receipt: byID[hit.ID], Score: hit.Score, Matches: hit.Matches})
+	}
+	resp.Count = len(resp.Results)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// indexRecord adds a stored record's OCR lines to the text index. A record
+// analyzed without OCR is indexed with no text, so it isn't retried.
+func (s *Server) indexRecord(rec *store.Record) {
+	if s.textIndex == nil {
+		return
+	}
+	doc, err := s.ocrDoc(rec)
+	if err != nil {
+		log.Printf("Warning: failed to index OCR text of %s: %v", rec.ID, err)
+		return
+	}
+	if err := s.textIndex.Put(doc); err != nil {
+		log.Printf("Warning: failed to index OCR text of %s: %v", rec.ID, err)
+	}
+}
+
+// unindexRecords removes erased records from the text index.
+func (s *Server) unindexRecords(ids []string) {
+	if s.textIndex == nil || len(ids) == 0 {
+		return
+	}
+	if err := s.textIndex.Delete(ids...); err != nil {
+		log.Printf("Warning: failed to remove %d receipts from the text index: %v", len(ids), err)
+	}
+}
+
+// ocrDoc loads the OCR lines of a record.
+func (s *Server) ocrDoc(rec *store.Record) (textindex.Doc, error) {
+	doc := textindex.Doc{ID: rec.ID}
+	if rec.TextractPath == "" {
+		return doc, nil
+	}
+	textract, err := s.loadTextract(rec.TextractPath)
+	if err != nil {
+		return doc, err
+	}
+	doc.Lines = textractLineTexts(textract)
+	return doc, nil
+}
+
+// StartTextIndex indexes, in the background, the OCR text of stored
+// receipts that aren't in the text index yet, such as those analyzed
+// before it existed.
+func (s *Server) StartTextIndex(ctx context.Context) {
+	if s.textIndex == nil || s.store == nil {
+		return
+	}
+	go s.indexMissing(ctx)
+}
+
+// indexMissing indexes every stored record missing from the text index.
+// Records whose OCR output is gone are skipped until they are reprocessed.
+func (s *Server) indexMissing(ctx context.Context) {
+	records, err := s.store.List()
+	if err != nil {
+		log.Printf("Warning: failed to list receipts for the text index: %v", err)
+		return
+	}
+
+	var docs []textindex.Doc
+	skipped := 0
+	for _, rec := range records {
+		if ctx.Err() != nil {
+			return
+		}
+		if s.textIndex.Has(rec.ID) {
+			continue
+		}
+		doc, err := s.ocrDoc(rec)
+		if err != nil {
+			skipped++
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	if len(docs) == 0 {
+		return
+	}
+	if err := s.textIndex.Put(docs...); err != nil {
+		log.Printf("Warning: failed to build the text index: %v", err)
+		return
+	}
+	log.Printf("Indexed OCR text of %d receipts (%d without OCR output)", len(docs), skipped)
+}
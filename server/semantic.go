@@ -0,0 +1,314 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"myprice/internal/embed"
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+)
+
+const (
+	// embedTimeout bounds one call to the embedding provider.
+	embedTimeout = 30 * time.Second
+
+	// embedBatchSize is how many receipts are embedded per call when
+	// embedding stored receipts in the background.
+	embedBatchSize = 32
+)
+
+// newEmbedder builds the embedding provider selected by the EMBEDDINGS
+// environment variable, or returns nil when semantic search is disabled
+// (the default).
+func newEmbedder() embed.Embedder {
+	model, baseURL := os.Getenv("EMBEDDINGS_MODEL"), os.Getenv("EMBEDDINGS_URL")
+	switch strings.ToLower(os.Getenv("EMBEDDINGS")) {
+	case "":
+		return nil
+	case "openai":
+		e := embed.NewOpenAIEmbedder(baseURL, strings.TrimSpace(os.Getenv("OPENAI_API_KEY")), model)
+		log.Printf("Embedding receipts for semantic search with %s", e.Model())
+		return e
+	case "ollama":
+		e := embed.NewOllamaEmbedder(baseURL, model)
+		log.Printf("Embedding receipts for semantic search with %s", e.Model())
+		return e
+	default:
+		log.Printf("Warning: unknown EMBEDDINGS %q, semantic search disabled", os.Getenv("EMBEDDINGS"))
+		return nil
+	}
+}
+
+// SemanticSearchResult is a receipt close in meaning to a search.
+type SemanticSearchResult struct {
+	Receipt *store.Record `json:"receipt"`
+	Score   float64       `json:"score"` // Cosine similarity, up to 1
+}
+
+// SemanticSearchResponse lists the receipts closest to a search, best first.
+type SemanticSearchResponse struct {
+	Query   string                 `json:"query"`
+	Results []SemanticSearchResult `json:"results"`
+	Count   int                    `json:"count"`
+	Total   int                    `json:"total"` // Receipts scoring at least min_score, before the limit
+}
+
+// handleSemanticSearch finds receipts by what was bought rather than the
+// words printed, as in "that dinner with sushi in March", by comparing the
+// query's embedding with each receipt's. ?tag=, ?all=, and ?limit= work as
+// for text search, and ?min_score= drops weaker matches.
+func (s *Server) handleSemanticSearch(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) {
+		return
+	}
+	if s.embeddings == nil {
+		jsonError(w, "Semantic search is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		jsonError(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	tags, ok := queryTags(w, r)
+	if !ok {
+		return
+	}
+	limit := defaultSearchLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			jsonError(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxSearchLimit)
+	}
+	minScore := -1.0
+	if v := r.URL.Query().Get("min_score"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < -1 || f > 1 {
+			jsonError(w, "min_score must be a number from -1 to 1", http.StatusBadRequest)
+			return
+		}
+		minScore = f
+	}
+
+	records, err := s.store.List()
+	if err != nil {
+		jsonError(w, "Failed to list receipts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	all := r.URL.Query().Get("all") == "true"
+	byID := make(map[string]*store.Record, len(records))
+	for _, rec := range records {
+		if (all || rec.SupersededBy == "") && rec.HasTags(tags...) {
+			byID[rec.ID] = rec
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), embedTimeout)
+	defer cancel()
+	vectors, err := s.embedder.Embed(ctx, []string{query})
+	if err != nil {
+		jsonError(w, "Failed to embed the query: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	hits := s.embeddings.Search(vectors[0], minScore, func(id string) bool { return byID[id] != nil })
+
+	resp := SemanticSearchResponse{Query: query, Results: make([]SemanticSearchResult, 0, min(len(hits), limit)), Total: len(hits)}
+	for _, hit := range hits[:min(len(hits), limit)] {
+		resp.Results = append(resp.Results, SemanticSearchResult{Receipt: byID[hit.ID], Score: hit.Score})
+	}
+	resp.Count = len(resp.Results)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// embeddingText describes a stored result for embedding: the vendor and
+// its kind of business, where and when the purchase was made, the cart
+// description, and the items. Amounts are left out; they carry no meaning
+// a query would match.
+func embeddingText(rec *store.Record) string {
+	docType := receipt.DocumentType(rec.DocumentType)
+	var lines []string
+	add := func(parts ...string) {
+		if line := strings.Join(strings.Fields(strings.Join(parts, " ")), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	vendor, vendorFull, _ := vendorFields(docType, rec.Data)
+	if docType == receipt.DocumentTypeInvoice {
+		add("Invoice from", vendor)
+	} else if vendorFull != "" && !strings.EqualFold(vendor, vendorFull) {
+		add(vendor, "("+vendorFull+")")
+	} else {
+		add(vendor)
+	}
+	if category, ok := receipt.LookupVendorCategory(rec.VendorCategory); ok {
+		add(category.Label)
+	}
+	if rec.Location != nil && rec.Location.City != "" {
+		add("In", rec.Location.City)
+	}
+	add(purchaseWhen(rec))
+
+	description, _ := rec.Data["cart_description"].(string)
+	add(description)
+
+	nameKey := "name"
+	if docType == receipt.DocumentTypeInvoice {
+		nameKey = "description"
+	}
+	items, _ := rec.Data["items"].([]any)
+	var names []string
+	for _, raw := range items {
+		item, _ := raw.(map[string]any)
+		if name, _ := item[nameKey].(string); strings.TrimSpace(name) != "" {
+			names = append(names, strings.TrimSpace(name))
+		}
+	}
+	if len(names) > 0 {
+		add("Items:", strings.Join(names, ", "))
+	}
+	if categories, _ := rec.Data["item_categories"].([]any); len(categories) > 0 {
+		var kinds []string
+		for _, c := range categories {
+			if kind, _ := c.(string); kind != "" {
+				kinds = append(kinds, kind)
+			}
+		}
+		add("Categories:", strings.Join(kinds, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// purchaseWhen spells out when a purchase was made, as in "Friday, March 14,
+// 2025 at 7:42 PM", so a query naming a month or weekday can match it. It
+// returns "" when the purchase date is unknown.
+func purchaseWhen(rec *store.Record) string {
+	pt := rec.PurchaseTime
+	if pt == nil {
+		return ""
+	}
+	if t, err := time.Parse(time.RFC3339, pt.Timestamp); err == nil && !pt.DateOnly {
+		return t.Format("Monday, January 2, 2006 at 3:04 PM")
+	}
+	if t, err := time.Parse("2006-01-02", pt.LocalDate); err == nil {
+		return t.Format("Monday, January 2, 2006")
+	}
+	return ""
+}
+
+// embeddingSum identifies the text a receipt was embedded from.
+func embeddingSum(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:8])
+}
+
+// embedRecord embeds a newly stored record in the background, so saving
+// doesn't wait on the embedding provider.
+func (s *Server) embedRecord(rec *store.Record) {
+	if s.embeddings == nil {
+		return
+	}
+	id, text := rec.ID, embeddingText(rec)
+	go func() {
+		if err := s.embedTexts(context.Background(), []string{id}, []string{text}); err != nil {
+			log.Printf("Warning: failed to embed %s: %v", id, err)
+		}
+	}()
+}
+
+// embedTexts embeds texts and stores them as the vectors of ids.
+func (s *Server) embedTexts(ctx context.Context, ids, texts []string) error {
+	ctx, cancel := context.WithTimeout(ctx, embedTimeout)
+	defer cancel()
+	values, err := s.embedder.Embed(ctx, texts)
+	if err != nil {
+		return err
+	}
+	vectors := make([]embed.Vector, len(ids))
+	for i, id := range ids {
+		vectors[i] = embed.Vector{ID: id, Sum: embeddingSum(texts[i]), Values: values[i]}
+	}
+	return s.embeddings.Put(vectors...)
+}
+
+// unembedRecords removes erased records from the embedding index.
+func (s *Server) unembedRecords(ids []string) {
+	if s.embeddings == nil || len(ids) == 0 {
+		return
+	}
+	if err := s.embeddings.Delete(ids...); err != nil {
+		log.Printf("Warning: failed to remove %d receipts from the embedding index: %v", len(ids), err)
+	}
+}
+
+// StartEmbeddings embeds, in the background, stored receipts that have no
+// embedding yet or whose description changed since, such as those
+// analyzed before semantic search was enabled or with another model.
+func (s *Server) StartEmbeddings(ctx context.Context) {
+	if s.embeddings == nil || s.store == nil {
+		return
+	}
+	go s.embedMissing(ctx)
+}
+
+// embedMissing embeds every stored record missing from the embedding
+// index, in batches. It stops at the first failure, leaving the rest for
+// the next start.
+func (s *Server) embedMissing(ctx context.Context) {
+	records, err := s.store.List()
+	if err != nil {
+		log.Printf("Warning: failed to list receipts for the embedding index: %v", err)
+		return
+	}
+
+	var ids, texts []string
+	embedded, failed := 0, false
+	flush := func() {
+		if len(ids) == 0 || failed {
+			return
+		}
+		if err := s.embedTexts(ctx, ids, texts); err != nil {
+			log.Printf("Warning: failed to embed receipts: %v", err)
+			failed = true
+			return
+		}
+		embedded += len(ids)
+		ids, texts = ids[:0], texts[:0]
+	}
+	for _, rec := range records {
+		if ctx.Err() != nil {
+			return
+		}
+		if failed {
+			break
+		}
+		text := embeddingText(rec)
+		if s.embeddings.Current(rec.ID, embeddingSum(text)) {
+			continue
+		}
+		ids, texts = append(ids, rec.ID), append(texts, text)
+		if len(ids) == embedBatchSize {
+			flush()
+		}
+	}
+	flush()
+	if embedded > 0 {
+		log.Printf("Embedded %d receipts for semantic search", embedded)
+	}
+}
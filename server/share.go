@@ -0,0 +1,263 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"myprice/internal/receipt"
+	"myprice/internal/signed"
+	"myprice/internal/store"
+)
+
+const (
+	// defaultShareTTL is how long a share link lives unless SHARE_TTL or the
+	// request says otherwise.
+	defaultShareTTL = 7 * 24 * time.Hour
+
+	// maxShareTTL bounds how long a share link may live.
+	maxShareTTL = 90 * 24 * time.Hour
+)
+
+// shareClaims are what a share link grants: a read-only, redacted view of
+// one stored result. They name no user, since anyone holding the link can
+// read them.
+type shareClaims struct {
+	ReceiptID string `json:"rid"`
+	ExpiresAt int64  `json:"exp"` // Unix seconds
+}
+
+// ShareRequest asks for a share link to a receipt.
+type ShareRequest struct {
+	ExpiresIn int `json:"expires_in,omitempty"` // Seconds, up to 90 days; default SHARE_TTL
+}
+
+// ShareResponse is a share link and when it stops working.
+type ShareResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SharedReceipt is the redacted receipt behind a share link.
+type SharedReceipt struct {
+	DocumentType string         `json:"document_type"`
+	Data         map[string]any `json:"data"`
+	ExpiresAt    time.Time      `json:"expires_at"`
+}
+
+// newShareSigner builds the signer for share links from SHARE_SIGNING_KEY.
+// Without one, a random key is used and links stop working when the server
+// restarts.
+func newShareSigner() (*signed.Signer, error) {
+	key := os.Getenv("SHARE_SIGNING_KEY")
+	if key == "" {
+		return signed.NewRandom(), nil
+	}
+	return signed.New([]byte(key))
+}
+
+// handleShareReceipt issues an expiring link to a redacted, read-only view
+// of a stored receipt that works without an API key.
+func (s *Server) handleShareReceipt(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) {
+		return
+	}
+	var req ShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		jsonError(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresIn < 0 {
+		jsonError(w, "expires_in must be positive", http.StatusBadRequest)
+		return
+	}
+	ttl := s.shareTTL
+	if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+		if ttl > maxShareTTL {
+			ttl = maxShareTTL
+		}
+	}
+
+	rec, ok := s.loadRecord(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	// Check now that the result can be redacted, rather than when a friend
+	// opens the link
+	if _, err := receipt.RedactData(rec.Data); err != nil {
+		jsonError(w, "Receipt can't be shared: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	claims := shareClaims{ReceiptID: rec.ID, ExpiresAt: time.Now().Add(ttl).Unix()}
+	token, err := s.shareSigner.Sign(claims)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	expiresAt := time.Unix(claims.ExpiresAt, 0).UTC()
+	log.Printf("Shared receipt %s (expires %s)", rec.ID, expiresAt.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ShareResponse{
+		URL:       s.publicURL(r) + "/api/shared/" + token,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// handleShared renders the redacted receipt behind a share link, as a page
+// or, with ?format=json, as JSON. The token in the path is the only
+// credential.
+func (s *Server) handleShared(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Keep shared pages out of search engines, caches, and referrers
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	var claims shareClaims
+	if err := s.shareSigner.Verify(r.PathValue("token"), &claims); err != nil {
+		jsonError(w, "Invalid share link", http.StatusForbidden)
+		return
+	}
+	expiresAt := time.Unix(claims.ExpiresAt, 0).UTC()
+	if time.Now().After(expiresAt) {
+		jsonError(w, "Share link has expired", http.StatusGone)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+
+	// A deleted receipt takes its links with it
+	rec, err := s.store.Get(claims.ReceiptID)
+	if errors.Is(err, store.ErrNotFound) {
+		jsonError(w, "Shared receipt is no longer available", http.StatusGone)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Failed to load receipt: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := receipt.RedactData(rec.Data)
+	if err != nil {
+		jsonError(w, "Receipt can't be shared: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	shared := SharedReceipt{
+		DocumentType: string(receipt.DetectDocumentType(data)),
+		Data:         data,
+		ExpiresAt:    expiresAt,
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(shared)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := renderShared(w, shared); err != nil {
+		log.Printf("Failed to render shared receipt %s: %v", rec.ID, err)
+	}
+}
+
+// sharedView is what the shared page shows, from either document type.
+type sharedView struct {
+	Vendor    string
+	Address   string
+	Date      string
+	Number    string // Invoice number
+	Items     []sharedItem
+	Subtotal  *float64 // Nil when unknown
+	Tax       *float64
+	TaxLines  []receipt.TaxLine
+	Total     *float64
+	ExpiresAt time.Time
+}
+
+type sharedItem struct {
+	Name  string
+	Qty   string
+	Price float64
+}
+
+// renderShared writes the page for a shared receipt or invoice.
+func renderShared(w io.Writer, shared SharedReceipt) error {
+	view := sharedView{ExpiresAt: shared.ExpiresAt}
+	if receipt.DocumentType(shared.DocumentType) == receipt.DocumentTypeInvoice {
+		inv, err := receipt.InvoiceFromMap(shared.Data)
+		if err != nil {
+			return err
+		}
+		view.Vendor, view.Address, view.Date, view.Number = inv.Vendor.Name, inv.Vendor.Address, inv.InvoiceDate, inv.InvoiceNumber
+		view.Subtotal, view.Tax, view.TaxLines, view.Total = inv.Subtotal, inv.Tax, inv.TaxLines, inv.Total
+		for _, item := range inv.Items {
+			view.Items = append(view.Items, sharedItem{Name: item.Description, Qty: fmt.Sprintf("%g", item.Qty), Price: item.Amount})
+		}
+	} else {
+		rec, err := receipt.ReceiptFromMap(shared.Data)
+		if err != nil {
+			return err
+		}
+		view.Vendor, view.Address, view.Date = rec.Vendor, rec.Address, rec.Date
+		view.Subtotal, view.Tax, view.TaxLines, view.Total = rec.Subtotal, rec.Tax, rec.TaxLines, rec.Total
+		for _, item := range rec.Items {
+			view.Items = append(view.Items, sharedItem{Name: item.Name, Qty: fmt.Sprintf("%d", item.Qty), Price: item.Price})
+		}
+	}
+	return sharedTemplate.Execute(w, view)
+}
+
+var sharedTemplate = template.Must(template.New("shared").Funcs(template.FuncMap{
+	"money": func(v float64) string { return fmt.Sprintf("$%.2f", v) },
+	"amount": func(v *float64) string {
+		if v == nil {
+			return "—"
+		}
+		return fmt.Sprintf("$%.2f", *v)
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex, nofollow">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{if .Vendor}}{{.Vendor}}{{else}}Receipt{{end}}</title>
+<style>
+body { font-family: -apple-system, "Helvetica Neue", Arial, sans-serif; color: #222; max-width: 560px; margin: 2em auto; padding: 0 1em; }
+h1 { margin-bottom: 0.2em; }
+.meta { color: #666; margin-top: 0; }
+table { border-collapse: collapse; width: 100%; margin: 1.5em 0; }
+th, td { text-align: left; padding: 0.35em 0.6em; border-bottom: 1px solid #e3e3e3; }
+td.num, th.num { text-align: right; font-variant-numeric: tabular-nums; }
+tr.total td { font-weight: bold; border-bottom: none; }
+.note { color: #666; font-size: 0.85em; }
+</style>
+</head>
+<body>
+<h1>{{if .Vendor}}{{.Vendor}}{{else}}Receipt{{end}}</h1>
+<p class="meta">{{if .Address}}{{.Address}}<br>{{end}}{{if .Number}}Invoice {{.Number}} &middot; {{end}}{{.Date}}</p>
+<table>
+<tr><th>Item</th><th class="num">Qty</th><th class="num">Price</th></tr>
+{{range .Items}}<tr><td>{{.Name}}</td><td class="num">{{.Qty}}</td><td class="num">{{money .Price}}</td></tr>
+{{end}}<tr><td colspan="2">Subtotal</td><td class="num">{{amount .Subtotal}}</td></tr>
+{{range .TaxLines}}<tr><td colspan="2">{{.Name}}{{if .Rate}} {{.Rate}}%{{end}}{{if .Included}} (included){{end}}</td><td class="num">{{money .Amount}}</td></tr>
+{{else}}<tr><td colspan="2">Tax</td><td class="num">{{amount .Tax}}</td></tr>
+{{end}}<tr class="total"><td colspan="2">Total</td><td class="num">{{amount .Total}}</td></tr>
+</table>
+<p class="note">Shared read-only with personal details removed. This link expires {{.ExpiresAt.Format "January 2, 2006 15:04 MST"}}.</p>
+</body>
+</html>
+`))
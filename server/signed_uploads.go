@@ -0,0 +1,459 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"myprice/internal/imageprep"
+	"myprice/internal/quota"
+	"myprice/internal/receipt"
+	"myprice/internal/signed"
+	"myprice/internal/store"
+)
+
+const (
+	// maxSignedUploadTTL bounds how long a signed upload URL may live.
+	maxSignedUploadTTL = 24 * time.Hour
+
+	// signedUploadRetention is how long an upload's status stays readable
+	// after its URL expires.
+	signedUploadRetention = 24 * time.Hour
+
+	// signedAnalysisTimeout bounds a queued analysis, which has no client
+	// request to cancel it.
+	signedAnalysisTimeout = 10 * time.Minute
+
+	// callbackTimeout bounds each completion callback.
+	callbackTimeout = 10 * time.Second
+)
+
+// Signed upload states
+const (
+	UploadPending   = "pending"   // URL issued, nothing uploaded yet
+	UploadUploaded  = "uploaded"  // Stored; analysis wasn't requested
+	UploadQueued    = "queued"    // Stored and waiting to be analyzed
+	UploadAnalyzing = "analyzing" // Analysis running
+	UploadDone      = "done"      // Analyzed and saved
+	UploadFailed    = "failed"    // Analysis failed
+)
+
+// uploadClaims are the permissions carried by a signed upload URL.
+type uploadClaims struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner,omitempty"`
+	FileName     string `json:"name,omitempty"`
+	Analyze      bool   `json:"analyze,omitempty"`
+	DocumentType string `json:"type,omitempty"`
+	CallbackURL  string `json:"callback,omitempty"`
+	ExpiresAt    int64  `json:"exp"` // Unix seconds
+}
+
+// SignedUploadRequest asks for a signed upload URL.
+type SignedUploadRequest struct {
+	FileName     string `json:"file_name,omitempty"`     // Name to store the image under
+	Analyze      bool   `json:"analyze,omitempty"`       // Analyze the image once it is uploaded
+	DocumentType string `json:"document_type,omitempty"` // "auto" (default), "receipt", or "invoice"
+	CallbackURL  string `json:"callback_url,omitempty"`  // Notified when analysis finishes
+	ExpiresIn    int    `json:"expires_in,omitempty"`    // Seconds, up to SIGNED_UPLOAD_TTL
+}
+
+// SignedUploadResponse is a signed upload URL and how to use it.
+type SignedUploadResponse struct {
+	ID        string    `json:"id"`
+	UploadURL string    `json:"upload_url"` // PUT the image bytes here; GET for status
+	Method    string    `json:"method"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxSize   int64     `json:"max_size"`
+}
+
+// UploadStatus is the progress of an upload made through a signed URL.
+type UploadStatus struct {
+	ID          string    `json:"id"`
+	Status      string    `json:"status"`
+	FileName    string    `json:"file_name,omitempty"`
+	FilePath    string    `json:"file_path,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	ReceiptID   string    `json:"receipt_id,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	ContentType string    `json:"content_type,omitempty"` // What it appears to be, if it failed for not being a receipt
+	ExpiresAt   time.Time `json:"expires_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// signedUploads tracks uploads made through signed URLs. Statuses live in
+// memory; the uploaded files themselves make each URL single-use across
+// restarts.
+type signedUploads struct {
+	mu        sync.Mutex
+	statuses  map[string]UploadStatus
+	receiving map[string]bool // Uploads whose body is being read
+}
+
+// begin claims an upload for one request, reporting false if its URL has
+// been used or another request is uploading to it.
+func (u *signedUploads) begin(id string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if st, ok := u.statuses[id]; (ok && st.Status != UploadPending) || u.receiving[id] {
+		return false
+	}
+	if u.receiving == nil {
+		u.receiving = make(map[string]bool)
+	}
+	u.receiving[id] = true
+	return true
+}
+
+// end releases an upload claimed by begin.
+func (u *signedUploads) end(id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.receiving, id)
+}
+
+func (u *signedUploads) get(id string) (UploadStatus, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	st, ok := u.statuses[id]
+	return st, ok
+}
+
+// set records an upload's status and returns it with UpdatedAt set.
+func (u *signedUploads) set(st UploadStatus) UploadStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.statuses == nil {
+		u.statuses = make(map[string]UploadStatus)
+	}
+	st.UpdatedAt = time.Now().UTC()
+	u.statuses[st.ID] = st
+
+	// Forget uploads whose status nobody can still ask for
+	for id, old := range u.statuses {
+		if time.Since(old.ExpiresAt) > signedUploadRetention {
+			delete(u.statuses, id)
+		}
+	}
+	return st
+}
+
+// newUploadSigner builds the signer for upload URLs from
+// UPLOAD_SIGNING_KEY. Without one, a random key is used and URLs stop
+// working when the server restarts.
+func newUploadSigner() (*signed.Signer, error) {
+	key := os.Getenv("UPLOAD_SIGNING_KEY")
+	if key == "" {
+		return signed.NewRandom(), nil
+	}
+	return signed.New([]byte(key))
+}
+
+// handleSignedUploads issues a signed URL that accepts one image upload
+// without an API key.
+func (s *Server) handleSignedUploads(w http.ResponseWriter, r *http.Request) {
+	var req SignedUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		jsonError(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.CallbackURL != "" {
+		if !req.Analyze {
+			jsonError(w, "callback_url requires analyze", http.StatusBadRequest)
+			return
+		}
+		// Checked like image URLs, and again when the callback is sent, so
+		// it can't be used to reach the server's own network
+		u, err := url.Parse(req.CallbackURL)
+		if err == nil {
+			err = checkImageURL(u)
+		}
+		if errors.Is(err, errBlockedAddress) {
+			jsonError(w, "callback_url must be a public address", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			jsonError(w, "callback_url must be an http or https URL", http.StatusBadRequest)
+			return
+		}
+	}
+	ttl := s.signedUploadTTL
+	if req.ExpiresIn < 0 {
+		jsonError(w, "expires_in must be positive", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresIn > 0 && time.Duration(req.ExpiresIn)*time.Second < ttl {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+
+	claims := uploadClaims{
+		ID:           store.NewID(),
+		FileName:     uploadFileName(req.FileName),
+		Analyze:      req.Analyze,
+		DocumentType: req.DocumentType,
+		CallbackURL:  req.CallbackURL,
+		ExpiresAt:    time.Now().Add(ttl).Unix(),
+	}
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		claims.Owner = p.Name
+	}
+	token, err := s.uploadSigner.Sign(claims)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	expiresAt := time.Unix(claims.ExpiresAt, 0).UTC()
+	s.signedUploads.set(UploadStatus{ID: claims.ID, Status: UploadPending, FileName: claims.FileName, ExpiresAt: expiresAt})
+	log.Printf("Issued signed upload %s for %s (expires %s)", claims.ID, claimsOwner(claims), expiresAt.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(SignedUploadResponse{
+		ID:        claims.ID,
+		UploadURL: s.publicURL(r) + "/api/uploads/signed/" + token,
+		Method:    http.MethodPut,
+		ExpiresAt: expiresAt,
+		MaxSize:   s.maxUploadBytes,
+	})
+}
+
+// handleSignedUpload accepts the image for a signed URL (PUT) or reports
+// its progress (GET). The token in the path is the only credential.
+func (s *Server) handleSignedUpload(w http.ResponseWriter, r *http.Request) {
+	var claims uploadClaims
+	if err := s.uploadSigner.Verify(r.PathValue("token"), &claims); err != nil {
+		jsonError(w, "Invalid upload URL", http.StatusForbidden)
+		return
+	}
+	expiresAt := time.Unix(claims.ExpiresAt, 0).UTC()
+
+	switch r.Method {
+	case http.MethodGet:
+		st, ok := s.signedUploads.get(claims.ID)
+		if !ok {
+			// Issued before a restart: all we know is whether the file arrived
+			st = UploadStatus{ID: claims.ID, Status: UploadPending, FileName: claims.FileName, ExpiresAt: expiresAt}
+			if _, err := os.Stat(s.signedUploadPath(claims)); err == nil {
+				st.Status = UploadUploaded
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	case http.MethodPut, http.MethodPost:
+		s.acceptSignedUpload(w, r, claims, expiresAt)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// acceptSignedUpload stores the request body as the URL's image and
+// queues its analysis when the URL asked for one.
+func (s *Server) acceptSignedUpload(w http.ResponseWriter, r *http.Request, claims uploadClaims, expiresAt time.Time) {
+	if time.Now().After(expiresAt) {
+		jsonError(w, "Upload URL has expired", http.StatusGone)
+		return
+	}
+	destPath := s.signedUploadPath(claims)
+	if !s.signedUploads.begin(claims.ID) {
+		jsonError(w, "Upload URL has already been used", http.StatusConflict)
+		return
+	}
+	defer s.signedUploads.end(claims.ID)
+	if _, err := os.Stat(destPath); err == nil {
+		jsonError(w, "Upload URL has already been used", http.StatusConflict)
+		return
+	}
+
+	// Phones send the photo as the raw body; a multipart "image" field is
+	// accepted too, as for /api/upload
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadBytes+1<<20)
+	var body io.Reader = r.Body
+	var tooLarge *http.MaxBytesError
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(s.maxUploadBytes); err != nil {
+			if errors.As(err, &tooLarge) {
+				s.uploadTooLarge(w)
+				return
+			}
+			jsonError(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		file, _, err := r.FormFile("image")
+		if err != nil {
+			jsonError(w, "No image file provided: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, body); err != nil {
+		if errors.As(err, &tooLarge) {
+			s.uploadTooLarge(w)
+			return
+		}
+		jsonError(w, "Failed to read upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(buf.Len()) > s.maxUploadBytes {
+		s.uploadTooLarge(w)
+		return
+	}
+	if imageprep.Sniff(buf.Bytes()) == "" {
+		jsonError(w, "Unsupported image format: upload JPEG, PNG, GIF, WebP, HEIC, TIFF, or BMP", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if err := s.reserveUpload(claims.Owner, destPath, int64(buf.Len())); err != nil {
+		var exceeded *quota.ExceededError
+		if errors.As(err, &exceeded) {
+			quotaError(w, exceeded)
+			return
+		}
+	}
+	size, err := s.saveUpload(destPath, &buf)
+	if err != nil {
+		s.releaseUpload(claims.Owner, destPath)
+		jsonError(w, "Failed to save file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Uploaded image through signed URL %s: %s (%d bytes)", claims.ID, destPath, size)
+
+	st := UploadStatus{
+		ID:        claims.ID,
+		Status:    UploadUploaded,
+		FileName:  filepath.Base(destPath),
+		FilePath:  destPath,
+		Size:      size,
+		ExpiresAt: expiresAt,
+	}
+	code := http.StatusCreated
+	if claims.Analyze {
+		st.Status = UploadQueued
+		code = http.StatusAccepted
+	}
+	st = s.signedUploads.set(st)
+	if claims.Analyze {
+		go s.analyzeSignedUpload(claims, st)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(st)
+}
+
+// analyzeSignedUpload runs the analysis queued by a signed upload, saves
+// the result for the URL's owner, and notifies its callback.
+func (s *Server) analyzeSignedUpload(claims uploadClaims, st UploadStatus) {
+	ctx, cancel := context.WithTimeout(context.Background(), signedAnalysisTimeout)
+	defer cancel()
+
+	st.Status = UploadAnalyzing
+	s.signedUploads.set(st)
+
+	actx, attempt := s.startAttempt(ctx, viaSignedUpload, claims.Owner, st.FilePath)
+	result, err := s.analyze(actx, st.FilePath, receipt.ParseDocumentType(claims.DocumentType), "")
+	if err == nil {
+		rec := result.record(st.FilePath)
+		rec.Owner = claims.Owner
+		st.ReceiptID = s.saveResult(rec)
+		attempt.finish(result, st.ReceiptID, nil)
+		if st.ReceiptID != "" {
+			s.autoExport(rec)
+		}
+	} else {
+		attempt.finish(nil, "", err)
+	}
+	if err != nil {
+		log.Printf("Warning: analysis of signed upload %s failed: %v", claims.ID, err)
+		st.Status, st.Error, st.ContentType = UploadFailed, err.Error(), rejectedContent(err)
+	} else {
+		st.Status = UploadDone
+	}
+	st = s.signedUploads.set(st)
+
+	if claims.CallbackURL != "" {
+		if err := s.notifyUploadCallback(claims.CallbackURL, st); err != nil {
+			log.Printf("Warning: callback for signed upload %s failed: %v", claims.ID, err)
+		}
+	}
+}
+
+// notifyUploadCallback POSTs an upload's final status to its callback URL.
+// The X-Myprice-Signature header is the hex HMAC-SHA256 of the body under
+// UPLOAD_SIGNING_KEY, so receivers can check where it came from. It is
+// sent like an image download, refusing non-public addresses and redirects
+// to them.
+func (s *Server) notifyUploadCallback(callbackURL string, st UploadStatus) error {
+	body, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), callbackTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Myprice-Signature", s.uploadSigner.Signature(body))
+
+	resp, err := s.fetchClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signedUploadPath is where a signed URL's image is stored. The ID prefix
+// keeps uploads from different URLs apart.
+func (s *Server) signedUploadPath(claims uploadClaims) string {
+	return filepath.Join(s.uploadDir, claims.ID+"-"+claims.FileName)
+}
+
+// publicURL is the scheme and host clients reach the API at: PUBLIC_URL
+// when set, otherwise the request's own host.
+func (s *Server) publicURL(r *http.Request) string {
+	if s.publicBaseURL != "" {
+		return s.publicBaseURL
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// uploadFileName cleans a client-supplied file name for the upload
+// directory.
+func uploadFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" || name == "" {
+		return "upload.jpg"
+	}
+	return name
+}
+
+func claimsOwner(c uploadClaims) string {
+	return ownerName(c.Owner)
+}
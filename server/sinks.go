@@ -0,0 +1,223 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"myprice/internal/crypt"
+	"myprice/internal/ingest"
+	"myprice/internal/signed"
+	"myprice/internal/sink"
+	"myprice/internal/store"
+)
+
+// defaultSinkAttempts is how many times a delivery to a sink is tried.
+const defaultSinkAttempts = 5
+
+// defaultSheetsTab is the sheet results are appended to when a Sheets sink
+// names none.
+const defaultSheetsTab = "Sheet1"
+
+// sinkConfig reads SINKS, a comma-separated list of kind:target
+// destinations each stored result is also sent to, with SINK_ATTEMPTS and
+// SINKS_STATE. It returns nil when SINKS is unset. Webhook bodies are
+// signed with signer.
+func sinkConfig(projectRoot string, cipher *crypt.Cipher, signer *signed.Signer) (*sink.Dispatcher, error) {
+	raw := os.Getenv("SINKS")
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	var sinks []sink.Sink
+	for _, spec := range strings.Split(raw, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		kind, target, _ := strings.Cut(spec, ":")
+		if target == "" {
+			return nil, fmt.Errorf("SINKS: %q needs a target, e.g. webhook:https://example.com/hook", spec)
+		}
+		switch kind {
+		case "webhook":
+			s, err := sink.NewWebhook(target, signer.Signature)
+			if err != nil {
+				return nil, fmt.Errorf("SINKS: %w", err)
+			}
+			sinks = append(sinks, s)
+		case "price_alerts":
+			s, err := sink.NewPriceAlerts(target, signer.Signature)
+			if err != nil {
+				return nil, fmt.Errorf("SINKS: %w", err)
+			}
+			sinks = append(sinks, s)
+		case "budget_alerts":
+			s, err := sink.NewBudgetAlerts(target, signer.Signature)
+			if err != nil {
+				return nil, fmt.Errorf("SINKS: %w", err)
+			}
+			sinks = append(sinks, s)
+		case "file":
+			sinks = append(sinks, sink.NewFile(target, cipher))
+		case "s3":
+			s, err := sink.NewS3(target, awsCLI)
+			if err != nil {
+				return nil, fmt.Errorf("SINKS: %w", err)
+			}
+			sinks = append(sinks, s)
+		case "sheets":
+			s, err := sheetsSink(target)
+			if err != nil {
+				return nil, fmt.Errorf("SINKS: %w", err)
+			}
+			sinks = append(sinks, s)
+		case "store":
+			return nil, fmt.Errorf("SINKS: results are always saved to the receipt store; list only other destinations")
+		default:
+			return nil, fmt.Errorf("SINKS: unknown sink %q (want webhook, price_alerts, budget_alerts, file, s3, or sheets)", kind)
+		}
+	}
+
+	statePath := os.Getenv("SINKS_STATE")
+	if statePath == "" {
+		statePath = filepath.Join(projectRoot, "sinks.json")
+	}
+	attempts := envInt("SINK_ATTEMPTS", defaultSinkAttempts)
+	if attempts <= 0 {
+		attempts = defaultSinkAttempts
+	}
+	return sink.NewDispatcher(sinks, attempts, statePath, cipher)
+}
+
+// sheetsSink appends to the spreadsheet target names, as ID or ID/sheet,
+// with the SHEETS_TOKEN, or SHEETS_REFRESH_TOKEN and SHEETS_CLIENT_ID,
+// credentials.
+func sheetsSink(target string) (*sink.Sheets, error) {
+	id, tab, _ := strings.Cut(target, "/")
+	if tab == "" {
+		tab = defaultSheetsTab
+	}
+	baseURL := os.Getenv("SHEETS_URL")
+	creds := &ingest.Credentials{
+		AccessToken:  os.Getenv("SHEETS_TOKEN"),
+		RefreshToken: os.Getenv("SHEETS_REFRESH_TOKEN"),
+		ClientID:     os.Getenv("SHEETS_CLIENT_ID"),
+		ClientSecret: os.Getenv("SHEETS_CLIENT_SECRET"),
+		TokenURL:     ingest.DefaultDriveTokenURL,
+	}
+	if baseURL != "" {
+		creds.TokenURL = strings.TrimSuffix(baseURL, "/") + "/token"
+	}
+	if !creds.Valid() {
+		return nil, fmt.Errorf("a sheets sink needs SHEETS_TOKEN, or SHEETS_REFRESH_TOKEN and SHEETS_CLIENT_ID")
+	}
+	// Bounded like the Sheets requests, so a stuck token endpoint can't hold
+	// up the sink's deliveries
+	client := &http.Client{Timeout: 30 * time.Second}
+	return sink.NewSheets(id, tab, baseURL, func(ctx context.Context) (string, error) {
+		return creds.Token(ctx, client)
+	}), nil
+}
+
+// StartSinks delivers stored results to the configured sinks until ctx is
+// cancelled, starting with those still queued at the last shutdown.
+func (s *Server) StartSinks(ctx context.Context) {
+	if s.sinks == nil {
+		return
+	}
+	for _, st := range s.sinks.Statuses() {
+		log.Printf("Sending stored results to %s sink %s", st.Kind, st.Target)
+	}
+	s.sinks.Start(ctx, func(id string) (sink.Result, error) {
+		if s.store == nil {
+			return sink.Result{}, fmt.Errorf("receipt store is not available")
+		}
+		rec, err := s.store.Get(id)
+		if err != nil {
+			return sink.Result{}, err
+		}
+		return s.sinkResult(rec), nil
+	})
+}
+
+// deliverResult queues a newly stored result for every sink.
+func (s *Server) deliverResult(rec *store.Record) {
+	if s.sinks == nil {
+		return
+	}
+	s.sinks.Deliver(s.sinkResult(rec))
+}
+
+// sinkResult describes a stored result for sinks. Vendor, date, and total
+// are read the same way as for app exports.
+func (s *Server) sinkResult(rec *store.Record) sink.Result {
+	e := expenseFromRecord(rec)
+	r := sink.Result{
+		ReceiptID:    rec.ID,
+		PreviousID:   rec.PreviousID,
+		Version:      max(rec.Version, 1),
+		Owner:        rec.Owner,
+		DocumentType: rec.DocumentType,
+		ImageSHA256:  rec.ImageSHA256,
+		CreatedAt:    rec.CreatedAt,
+		Vendor:       e.Vendor,
+		Date:         e.Date,
+		Total:        e.Total,
+		Currency:     e.Currency,
+		Data:         rec.Data,
+		Anomalies:    rec.Anomalies,
+		Quality:      rec.Quality,
+	}
+	if s.budgets != nil {
+		r.BudgetAlerts = s.budgets.AlertsFor(rec.ID)
+	}
+	return r
+}
+
+// handleAdminSinks reports each sink's deliveries, queue, and failures.
+func (s *Server) handleAdminSinks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statuses := []sink.Status{}
+	if s.sinks != nil {
+		statuses = s.sinks.Statuses()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"sinks": statuses, "count": len(statuses)})
+}
+
+// handleAdminSinkRetry queues a sink's failed deliveries again.
+func (s *Server) handleAdminSinkRetry(w http.ResponseWriter, r *http.Request) {
+	if s.sinks == nil {
+		jsonError(w, "No sinks are configured", http.StatusNotFound)
+		return
+	}
+	name := r.PathValue("name")
+	found := false
+	for _, st := range s.sinks.Statuses() {
+		found = found || st.Name == name
+	}
+	if !found {
+		jsonError(w, "Sink not found", http.StatusNotFound)
+		return
+	}
+
+	queued, err := s.sinks.Retry(name)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"sink": name, "queued": queued})
+}
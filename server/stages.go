@@ -0,0 +1,475 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"myprice/internal/eval"
+	"myprice/internal/progress"
+	"myprice/internal/receipt"
+	"myprice/tools"
+)
+
+// Built-in pipeline stages, in the order they run by default.
+const (
+	stagePreprocess = "preprocess" // Downscale the image for the providers
+	stageOCR        = "ocr"        // Run or load Textract
+	stageLayout     = "layout"     // Classify the document and turn away non-documents
+	stageHeuristic  = "heuristic"  // Parse with the regex parsers, unless already parsed
+	stageLLM        = "llm"        // Parse with the model, replacing a heuristic parse
+	stageValidate   = "validate"   // Note the problems in a parse the model didn't check
+	stageEnrich     = "enrich"     // Chain, location, purchase time, products, and the rest
+)
+
+// defaultStages is the built-in pipeline. The heuristic parser runs first,
+// so its result stands in when the model fails.
+var defaultStages = []string{stagePreprocess, stageOCR, stageLayout, stageHeuristic, stageLLM, stageValidate, stageEnrich}
+
+// StageFunc is a pipeline stage registered with RegisterStage. It may read
+// and change the analysis; an error fails the analysis.
+type StageFunc func(ctx context.Context, a *Analysis) error
+
+// Analysis is an analysis in progress, as a custom stage sees it.
+type Analysis struct {
+	run *analysisRun
+}
+
+// ImagePath is the image or plain text file being analyzed.
+func (a *Analysis) ImagePath() string {
+	return a.run.imagePath
+}
+
+// DocumentType is "receipt" or "invoice", or "auto" before the layout stage
+// classifies the document.
+func (a *Analysis) DocumentType() string {
+	return string(a.run.DocType)
+}
+
+// Textract is the OCR text, empty before the OCR stage or when it failed.
+// Stages may change it for the stages after them.
+func (a *Analysis) Textract() *tools.LoadTextractOutput {
+	return &a.run.Textract
+}
+
+// Output is the parsed receipt or invoice, as in llm_output, or nil before
+// a parser has run. Stages may change it in place.
+func (a *Analysis) Output() map[string]any {
+	return a.run.Output
+}
+
+// SetOutput replaces the parsed receipt or invoice.
+func (a *Analysis) SetOutput(output map[string]any) {
+	a.run.Output = output
+}
+
+// analysisRun is an analysis as it passes through the stages.
+type analysisRun struct {
+	*analysisResult
+	imagePath    string
+	model        string     // Requested model; "" for production
+	ws           *workspace // nil for plain text
+	preparedPath string     // Image the LLM reads; "" for plain text
+	parseTime    time.Duration
+}
+
+// stage is one step of the pipeline.
+type stage struct {
+	name string
+	run  func(s *Server, ctx context.Context, run *analysisRun) error
+}
+
+// pipeline is the stages analyses run through: the built-in ones and those
+// registered with RegisterStage, in the order PIPELINE_STAGES gives, less
+// those PIPELINE_DISABLE names.
+type pipeline struct {
+	order    []string // From PIPELINE_STAGES; nil for the default order
+	disabled []string // From PIPELINE_DISABLE
+
+	mu       sync.Mutex
+	builtin  map[string]stage
+	custom   map[string]stage
+	after    map[string]string // Where a custom stage goes when PIPELINE_STAGES doesn't place it
+	resolved []stage           // Set on first use, after which stages can't be registered
+}
+
+// newPipeline reads PIPELINE_STAGES and PIPELINE_DISABLE, comma-separated
+// stage names. The stages are checked on first use, once custom stages are
+// registered.
+func newPipeline() *pipeline {
+	return &pipeline{
+		order:    stageList(os.Getenv("PIPELINE_STAGES")),
+		disabled: stageList(os.Getenv("PIPELINE_DISABLE")),
+		custom:   make(map[string]stage),
+		after:    make(map[string]string),
+		builtin: map[string]stage{
+			stagePreprocess: {stagePreprocess, (*Server).preprocessStage},
+			stageOCR:        {stageOCR, (*Server).ocrStage},
+			stageLayout:     {stageLayout, (*Server).layoutStage},
+			stageHeuristic:  {stageHeuristic, (*Server).heuristicStage},
+			stageLLM:        {stageLLM, (*Server).llmStage},
+			stageValidate:   {stageValidate, (*Server).validateStage},
+			stageEnrich:     {stageEnrich, (*Server).enrichStage},
+		},
+	}
+}
+
+// stageList splits a comma-separated list of stage names.
+func stageList(raw string) []string {
+	var names []string
+	for _, name := range strings.Split(raw, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// RegisterStage adds a custom stage to the analysis pipeline. Unless
+// PIPELINE_STAGES places it, it runs right after the stage named after, or
+// first when after is "". Register stages before the server analyzes
+// anything.
+func (s *Server) RegisterStage(name, after string, fn StageFunc) error {
+	p := s.pipeline
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.resolved != nil:
+		return fmt.Errorf("stage %q registered after the pipeline started", name)
+	case name == "" || strings.Contains(name, ","):
+		return fmt.Errorf("invalid stage name %q", name)
+	case p.builtin[name].run != nil || p.custom[name].run != nil:
+		return fmt.Errorf("stage %q already exists", name)
+	case after != "" && p.builtin[after].run == nil && p.custom[after].run == nil:
+		return fmt.Errorf("stage %q is to run after unknown stage %q", name, after)
+	}
+	p.custom[name] = stage{name, func(_ *Server, ctx context.Context, run *analysisRun) error {
+		return fn(ctx, &Analysis{run: run})
+	}}
+	p.after[name] = after
+	return nil
+}
+
+// stages returns the stages to run, in order, resolving them on first use.
+func (p *pipeline) stages() []stage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resolved == nil {
+		names, err := p.resolve()
+		if err != nil {
+			log.Printf("Warning: invalid pipeline configuration: %v; running the default stages", err)
+			names = p.defaultOrder()
+		}
+		p.resolved = make([]stage, 0, len(names))
+		for _, name := range names {
+			if st, ok := p.builtin[name]; ok {
+				p.resolved = append(p.resolved, st)
+			} else {
+				p.resolved = append(p.resolved, p.custom[name])
+			}
+		}
+		log.Printf("Analysis pipeline: %s", strings.Join(names, " → "))
+	}
+	return p.resolved
+}
+
+// defaultOrder returns the built-in stages with each custom stage after
+// the one it was registered to follow. p.mu must be held.
+func (p *pipeline) defaultOrder() []string {
+	var names []string
+	var place func(after string)
+	place = func(after string) {
+		for _, name := range slices.Sorted(maps.Keys(p.after)) {
+			if p.after[name] == after {
+				names = append(names, name)
+				place(name)
+			}
+		}
+	}
+	place("")
+	for _, name := range defaultStages {
+		names = append(names, name)
+		place(name)
+	}
+	return names
+}
+
+// resolve returns the stage names to run, checking the configuration:
+// every name must be a stage, and the built-in stages must keep their
+// order, since each needs what the ones before it produce, except that
+// either parser may run first. p.mu must be held.
+func (p *pipeline) resolve() ([]string, error) {
+	names := p.order
+	if names == nil {
+		names = p.defaultOrder()
+	}
+	for _, name := range append(slices.Clone(names), p.disabled...) {
+		if p.builtin[name].run == nil && p.custom[name].run == nil {
+			return nil, fmt.Errorf("unknown stage %q", name)
+		}
+	}
+
+	var enabled []string
+	for i, name := range names {
+		if slices.Contains(names[:i], name) {
+			return nil, fmt.Errorf("stage %q is listed twice", name)
+		}
+		if !slices.Contains(p.disabled, name) {
+			enabled = append(enabled, name)
+		}
+	}
+	if !slices.Contains(enabled, stageHeuristic) && !slices.Contains(enabled, stageLLM) {
+		return nil, fmt.Errorf("one of the %s and %s stages must run", stageHeuristic, stageLLM)
+	}
+
+	prev := ""
+	for _, name := range enabled {
+		if !slices.Contains(defaultStages, name) {
+			continue
+		}
+		if prev != "" && stageRank(name) < stageRank(prev) {
+			return nil, fmt.Errorf("stage %q must run before %q", name, prev)
+		}
+		prev = name
+	}
+	return enabled, nil
+}
+
+// stageRank orders the built-in stages. The parsers share a rank, since
+// either may run first.
+func stageRank(name string) int {
+	if name == stageLLM {
+		name = stageHeuristic
+	}
+	return slices.Index(defaultStages, name)
+}
+
+// preprocessStage downscales a large image before it goes to the
+// providers. Without it they get the image as uploaded.
+func (s *Server) preprocessStage(ctx context.Context, run *analysisRun) error {
+	if run.ws == nil {
+		return nil
+	}
+	progress.Report(ctx, "Preparing image")
+	run.preparedPath = s.prepareImage(run.ws.imagePath, run.ws.preparedDir)
+	return nil
+}
+
+// ocrStage runs or loads the image's Textract output; plain text was read
+// already. When OCR fails and the LLM is configured, the analysis goes on
+// without OCR text and the LLM reads the image alone. Cancelling ctx
+// aborts a Textract call in progress.
+func (s *Server) ocrStage(ctx context.Context, run *analysisRun) error {
+	if run.ws == nil {
+		return nil
+	}
+	start := time.Now()
+	defer func() { run.timeStage(tools.StageOCR, time.Since(start)) }()
+
+	progress.Report(ctx, "Running OCR")
+	if err := s.runOCR(ctx, run.imagePath, run.preparedPath, run.analysisResult); err != nil {
+		if ctx.Err() != nil || s.claudeAPI == nil {
+			return err
+		}
+		log.Printf("Warning: %v, parsing from the image alone", err)
+		run.Source = "none"
+		run.stage(tools.StageOCR, tools.StageFailed, err)
+		return nil
+	}
+	run.stage(tools.StageOCR, tools.StageOK, nil)
+	return nil
+}
+
+// layoutStage decides which schema to extract when the request left it to
+// the server, and turns away selfies and chat screenshots rather than parse
+// a receipt out of nothing. Without OCR text there is nothing to judge by.
+func (s *Server) layoutStage(ctx context.Context, run *analysisRun) error {
+	s.classify(run.analysisResult)
+	if run.ocrError() != "" {
+		progress.Report(ctx, "OCR failed, calling model on the image alone")
+		return nil
+	}
+	if run.Source == "" {
+		// The OCR stage is off
+		return nil
+	}
+	content := receipt.DetectContent(textractLineTexts(run.Textract), run.ws != nil)
+	if !content.IsDocument() {
+		log.Printf("Rejected %s: not a receipt (%s: %s)", run.imagePath, content.Type, content.Reason)
+		return &notReceiptError{content}
+	}
+	next := "parsing"
+	if s.claudeAPI != nil && s.pipeline.enabled(stageLLM) {
+		next = "calling model"
+	}
+	progress.Report(ctx, fmt.Sprintf("OCR complete (%d lines, %s), %s", len(run.Textract.Lines), run.DocType, next))
+	return nil
+}
+
+// classify settles an automatic document type from the OCR text.
+func (s *Server) classify(result *analysisResult) {
+	if result.DocType == receipt.DocumentTypeAuto {
+		result.DocType = receipt.ClassifyDocument(textractLineTexts(result.Textract))
+		log.Printf("Classified document as: %s", result.DocType)
+	}
+}
+
+// heuristicStage parses the OCR text with the regex parsers, unless the
+// model already parsed the document. Run first, its result stands in if
+// the model fails; run after the model, only when it failed.
+func (s *Server) heuristicStage(ctx context.Context, run *analysisRun) error {
+	if run.Output != nil {
+		return nil
+	}
+	start := time.Now()
+	defer func() { run.parseTime += time.Since(start) }()
+
+	// Without layout nothing chose a schema; receipts are the common case
+	if run.DocType == receipt.DocumentTypeAuto {
+		run.DocType = receipt.DocumentTypeReceipt
+	}
+	if run.DocType == receipt.DocumentTypeInvoice {
+		run.Output = parseTextractToInvoice(run.Textract).Map()
+	} else {
+		run.Output = parseTextractToReceipt(run.Textract).Map()
+	}
+	run.Parser, run.PromptVersion = parserHeuristic, heuristicVersion
+	if !run.hasStage(tools.StageParse) {
+		// A failed model call before this one already recorded the fallback
+		run.stage(tools.StageParse, tools.StageOK, nil)
+	}
+	return nil
+}
+
+// llmStage parses the document with the model, replacing a heuristic parse.
+// A model failure leaves the heuristic result, or the one a later
+// heuristic stage makes, marked as a fallback. It fails when ctx is
+// cancelled, since a fallback result would be stored in place of the one
+// the caller abandoned, and when OCR failed too, since the regex parser
+// would have nothing to read. The experiment's candidate runs alongside.
+func (s *Server) llmStage(ctx context.Context, run *analysisRun) error {
+	if s.claudeAPI == nil {
+		log.Printf("Claude API not configured, using regex parser")
+		return nil
+	}
+	start := time.Now()
+	defer func() { run.parseTime += time.Since(start) }()
+
+	if run.DocType == receipt.DocumentTypeAuto {
+		run.DocType = receipt.DocumentTypeReceipt
+	}
+	control := variant(run.model)
+	var trial chan eval.Run
+	if candidate := s.pickCandidate(run.model); candidate != nil {
+		trial = make(chan eval.Run, 1)
+		go func() { trial <- s.runCandidate(ctx, run.preparedPath, run.analysisResult, *candidate) }()
+	}
+	tokens := meteredTokens(ctx)
+	err := s.parseWithLLM(ctx, run, control)
+	if trial != nil {
+		// Wait even on failure: the candidate reads the prepared image
+		candidateRun := <-trial
+		if err == nil {
+			s.pairTrial(run.analysisResult, eval.Run{
+				Model:         control.Model,
+				PromptVersion: control.versionFor(run.DocType),
+				DurationMS:    time.Since(start).Milliseconds(),
+				Tokens:        tokensSince(ctx, tokens),
+			}, candidateRun)
+		}
+	}
+	return err
+}
+
+// validateStage notes the problems the pipeline's checks find in a parse
+// as anomalies. The model's answers were checked as they came back, and
+// sent back for correction, so only other parses are checked here.
+func (s *Server) validateStage(ctx context.Context, run *analysisRun) error {
+	if run.Output == nil || run.Parser == parserLLM {
+		return nil
+	}
+	if run.DocType == receipt.DocumentTypeInvoice {
+		invoice, err := receipt.InvoiceFromMap(run.Output)
+		if err != nil {
+			return nil
+		}
+		if issues := validateInvoiceOutput(invoice); len(issues) > 0 {
+			invoice.Anomalies = append(invoice.Anomalies, validationAnomalies(issues)...)
+			run.Output = invoice.Map()
+		}
+		return nil
+	}
+	parsed, err := receipt.ReceiptFromMap(run.Output)
+	if err != nil {
+		return nil
+	}
+	if issues := validateReceiptOutput(parsed); len(issues) > 0 {
+		parsed.Anomalies = append(parsed.Anomalies, validationAnomalies(issues)...)
+		run.Output = parsed.Map()
+	}
+	return nil
+}
+
+// enrichStage enriches a parsed result; see enrich.
+func (s *Server) enrichStage(ctx context.Context, run *analysisRun) error {
+	if run.Output == nil {
+		return nil
+	}
+	progress.Report(ctx, "Parsed, resolving location and purchase time")
+	s.enrich(ctx, run.analysisResult)
+	return nil
+}
+
+// enabled reports whether a stage is in the pipeline.
+func (p *pipeline) enabled(name string) bool {
+	return slices.ContainsFunc(p.stages(), func(st stage) bool { return st.name == name })
+}
+
+// parseWithLLM parses run's document with the model and prompt of v; see
+// llmStage.
+func (s *Server) parseWithLLM(ctx context.Context, run *analysisRun, v llmVariant) error {
+	release, err := s.acquire(ctx, s.llmLimit, "model")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	var output map[string]any
+	failure := "LLM parsing failed"
+	if run.DocType == receipt.DocumentTypeInvoice {
+		failure = "LLM invoice parsing failed"
+		log.Printf("Parsing invoice with Claude API...")
+		var invoice *receipt.Invoice
+		if invoice, err = s.claudeAPI.ParseInvoiceWithLLM(ctx, run.preparedPath, run.Textract, v); err == nil {
+			output = invoice.Map()
+		}
+	} else {
+		log.Printf("Parsing receipt with Claude API...")
+		var parsed *receipt.Receipt
+		if parsed, err = s.claudeAPI.ParseReceiptWithLLM(ctx, run.preparedPath, run.Textract, v); err == nil {
+			output = parsed.Map()
+		}
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if err != nil {
+		if ocrErr := run.ocrError(); ocrErr != "" {
+			return fmt.Errorf("%s; %s: %w", ocrErr, failure, err)
+		}
+		log.Printf("%s: %v, falling back to regex parser", failure, err)
+		run.setStage(tools.StageParse, tools.StageFallback, fmt.Errorf("%s: %w", failure, err))
+		return nil
+	}
+	run.setStage(tools.StageParse, tools.StageOK, nil)
+	run.Output = output
+	run.Parser, run.Model, run.PromptVersion = parserLLM, v.Model, v.versionFor(run.DocType)
+	return nil
+}
@@ -0,0 +1,209 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+
+	"myprice/internal/analysislog"
+	"myprice/tools"
+)
+
+// ocrSourceTextract is the OCR source of an attempt that called Textract
+// rather than reusing a cached result.
+const ocrSourceTextract = "aws_textract"
+
+// statsPrices are what model tokens and Textract pages cost, in US dollars.
+// Zero prices leave costs out of the stats.
+type statsPrices struct {
+	InputTokens  float64 // Per million input tokens
+	OutputTokens float64 // Per million output tokens
+	TextractPage float64
+}
+
+// statsPricesFromEnv reads COST_INPUT_TOKENS, COST_OUTPUT_TOKENS, and
+// COST_TEXTRACT_PAGE.
+func statsPricesFromEnv() statsPrices {
+	return statsPrices{
+		InputTokens:  envFloat("COST_INPUT_TOKENS", 0),
+		OutputTokens: envFloat("COST_OUTPUT_TOKENS", 0),
+		TextractPage: envFloat("COST_TEXTRACT_PAGE", 0),
+	}
+}
+
+// set reports whether any price is configured.
+func (p statsPrices) set() bool {
+	return p.InputTokens > 0 || p.OutputTokens > 0 || p.TextractPage > 0
+}
+
+// cost returns what tokens and Textract calls cost, counting each call as
+// one page.
+func (p statsPrices) cost(tokens analysislog.Tokens, textractCalls int) float64 {
+	return (float64(tokens.Input)*p.InputTokens+float64(tokens.Output)*p.OutputTokens)/1e6 +
+		float64(textractCalls)*p.TextractPage
+}
+
+// StageStats counts how one pipeline stage went.
+type StageStats struct {
+	Runs        int     `json:"runs"`
+	Failed      int     `json:"failed"`
+	Fallback    int     `json:"fallback,omitempty"` // Failed, and the regex parser stood in
+	FailureRate float64 `json:"failure_rate"`       // Failed and fallback runs over runs
+}
+
+// PeriodStats aggregates the analysis attempts of one period.
+type PeriodStats struct {
+	Since       time.Time `json:"since"`
+	Attempts    int       `json:"attempts"`
+	Receipts    int       `json:"receipts"` // Results stored
+	OK          int       `json:"ok"`
+	Partial     int       `json:"partial"`
+	Failed      int       `json:"failed"`
+	Cancelled   int       `json:"cancelled"`
+	FailureRate float64   `json:"failure_rate"` // Failed attempts over attempts
+
+	// Failures by stage; attempts that failed before any stage ran, e.g.
+	// on a missing image, count only toward the totals
+	Stages map[string]*StageStats `json:"stages"`
+
+	Tokens        analysislog.Tokens `json:"tokens"`
+	TextractCalls int                `json:"textract_calls"`
+
+	// Per stored receipt, counting the failed attempts too
+	AvgTokensPerReceipt float64  `json:"avg_tokens_per_receipt"`
+	AvgCostPerReceipt   *float64 `json:"avg_cost_per_receipt_usd,omitempty"` // When prices are configured
+	AvgDurationMS       int64    `json:"avg_duration_ms"`                    // Per attempt
+
+	// Mean OCR confidence (0-100) of receipts stored in the period
+	AvgConfidence float64 `json:"avg_confidence,omitempty"`
+}
+
+// StatsResponse aggregates recent analyses for an ops dashboard.
+type StatsResponse struct {
+	Today PeriodStats `json:"today"` // Since midnight UTC
+	Week  PeriodStats `json:"week"`  // The last 7 days
+}
+
+// handleStats returns operational aggregates from the analysis log: how
+// many receipts were processed today and this week, how often each stage
+// failed, and what a receipt cost on average. It is a JSON alternative to a
+// metrics system for small deployments.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.analysisLog == nil {
+		jsonError(w, "Analysis log is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	now := time.Now().UTC()
+	today := now.Truncate(24 * time.Hour)
+	week := now.AddDate(0, 0, -7)
+	entries, _, err := s.analysisLog.Find(analysislog.Query{Since: week})
+	if err != nil {
+		jsonError(w, "Failed to read analysis log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := StatsResponse{
+		Today: periodStats(today, entries, s.statsPrices),
+		Week:  periodStats(week, entries, s.statsPrices),
+	}
+	if s.store != nil {
+		records, err := s.store.List()
+		if err != nil {
+			jsonError(w, "Failed to list receipts: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, p := range []*PeriodStats{&resp.Today, &resp.Week} {
+			var sum float64
+			var n int
+			for _, rec := range records {
+				if rec.OCRConfidence > 0 && !rec.CreatedAt.Before(p.Since) {
+					sum += rec.OCRConfidence
+					n++
+				}
+			}
+			if n > 0 {
+				p.AvgConfidence = math.Round(sum/float64(n)*10) / 10
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// periodStats aggregates the entries made since a time.
+func periodStats(since time.Time, entries []analysislog.Entry, prices statsPrices) PeriodStats {
+	p := PeriodStats{Since: since, Stages: make(map[string]*StageStats)}
+	var durationMS int64
+	for _, e := range entries {
+		if e.Time.Before(since) {
+			continue
+		}
+		p.Attempts++
+		switch e.Outcome {
+		case analysislog.OutcomeOK:
+			p.OK++
+		case analysislog.OutcomePartial:
+			p.Partial++
+		case analysislog.OutcomeFailed:
+			p.Failed++
+		case analysislog.OutcomeCancelled:
+			p.Cancelled++
+		}
+		if e.ReceiptID != "" {
+			p.Receipts++
+		}
+		for _, st := range e.Stages {
+			stage := p.Stages[st.Stage]
+			if stage == nil {
+				stage = &StageStats{}
+				p.Stages[st.Stage] = stage
+			}
+			stage.Runs++
+			switch st.Status {
+			case tools.StageFailed:
+				stage.Failed++
+			case tools.StageFallback:
+				stage.Fallback++
+			}
+		}
+		p.Tokens.Calls += e.Tokens.Calls
+		p.Tokens.Input += e.Tokens.Input
+		p.Tokens.Output += e.Tokens.Output
+		if e.OCRSource == ocrSourceTextract {
+			p.TextractCalls++
+		}
+		durationMS += e.DurationMS
+	}
+
+	for _, stage := range p.Stages {
+		stage.FailureRate = rate(stage.Failed+stage.Fallback, stage.Runs)
+	}
+	p.FailureRate = rate(p.Failed, p.Attempts)
+	if p.Attempts > 0 {
+		p.AvgDurationMS = durationMS / int64(p.Attempts)
+	}
+	if p.Receipts > 0 {
+		p.AvgTokensPerReceipt = math.Round(float64(p.Tokens.Input+p.Tokens.Output)/float64(p.Receipts)*10) / 10
+		if prices.set() {
+			avg := math.Round(prices.cost(p.Tokens, p.TextractCalls)/float64(p.Receipts)*1e4) / 1e4
+			p.AvgCostPerReceipt = &avg
+		}
+	}
+	return p
+}
+
+// rate returns n over total rounded to 4 places, or 0 when total is 0.
+func rate(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(n)/float64(total)*1e4) / 1e4
+}
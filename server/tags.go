@@ -0,0 +1,191 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"myprice/internal/store"
+)
+
+// TagsRequest sets or adds tags on a receipt.
+type TagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+// NotesRequest sets a receipt's notes; empty notes clear them.
+type NotesRequest struct {
+	Notes string `json:"notes"`
+}
+
+// LabelsResponse is a receipt's tags and notes after a change.
+type LabelsResponse struct {
+	ReceiptID string   `json:"receipt_id"`
+	Tags      []string `json:"tags"`
+	Notes     string   `json:"notes"`
+}
+
+// TagCount is a tag and how many current receipts have it.
+type TagCount struct {
+	Tag      string `json:"tag"`
+	Receipts int    `json:"receipts"`
+}
+
+// handleReceiptTags changes a receipt's tags: POST adds the given tags,
+// PUT replaces them all. Tags are lowercased with words joined by hyphens.
+func (s *Server) handleReceiptTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req TagsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodPost && len(req.Tags) == 0 {
+		jsonError(w, "tags is required", http.StatusBadRequest)
+		return
+	}
+
+	s.updateLabels(w, r, func(rec *store.Record) error {
+		tags := req.Tags
+		if r.Method == http.MethodPost {
+			tags = append(slices.Clone(rec.Tags), tags...)
+		}
+		normalized, err := store.NormalizeTags(tags)
+		if err != nil {
+			return err
+		}
+		rec.Tags = normalized
+		return nil
+	})
+}
+
+// handleDeleteReceiptTag removes one tag from a receipt. Removing a tag it
+// doesn't have succeeds.
+func (s *Server) handleDeleteReceiptTag(w http.ResponseWriter, r *http.Request) {
+	tag, err := store.NormalizeTag(r.PathValue("tag"))
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.updateLabels(w, r, func(rec *store.Record) error {
+		rec.Tags = slices.DeleteFunc(rec.Tags, func(t string) bool { return t == tag })
+		return nil
+	})
+}
+
+// handleReceiptNotes sets a receipt's free-text notes.
+func (s *Server) handleReceiptNotes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req NotesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.updateLabels(w, r, func(rec *store.Record) error {
+		notes := strings.TrimSpace(req.Notes)
+		if err := store.ValidateNotes(notes); err != nil {
+			return err
+		}
+		rec.Notes = notes
+		return nil
+	})
+}
+
+// updateLabels applies change to the receipt in the path, as editReceipt
+// does, and responds with its tags and notes.
+func (s *Server) updateLabels(w http.ResponseWriter, r *http.Request, change func(*store.Record) error) {
+	rec, ok := s.editReceipt(w, r, change)
+	if !ok {
+		return
+	}
+
+	tags := rec.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", receiptETag(rec))
+	json.NewEncoder(w).Encode(LabelsResponse{ReceiptID: rec.ID, Tags: tags, Notes: rec.Notes})
+}
+
+// handleTags lists the tags on current receipts, most used first.
+func (s *Server) handleTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+
+	records, err := s.store.List()
+	if err != nil {
+		jsonError(w, "Failed to list receipts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	counts := make(map[string]int)
+	for _, rec := range latestVersions(records) {
+		for _, tag := range rec.Tags {
+			counts[tag]++
+		}
+	}
+	tags := make([]TagCount, 0, len(counts))
+	for tag, n := range counts {
+		tags = append(tags, TagCount{Tag: tag, Receipts: n})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Receipts != tags[j].Receipts {
+			return tags[i].Receipts > tags[j].Receipts
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"tags": tags, "count": len(tags)})
+}
+
+// queryTags reads the tag query parameter, repeated or comma-separated,
+// answering 400 when a tag is invalid.
+func queryTags(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	var tags []string
+	for _, v := range r.URL.Query()["tag"] {
+		for _, tag := range strings.Split(v, ",") {
+			if strings.TrimSpace(tag) != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	if len(tags) == 0 {
+		return nil, true
+	}
+	normalized, err := store.NormalizeTags(tags)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return normalized, true
+}
+
+// taggedWith keeps the records that have every one of tags.
+func taggedWith(records []*store.Record, tags []string) []*store.Record {
+	if len(tags) == 0 {
+		return records
+	}
+	kept := make([]*store.Record, 0, len(records))
+	for _, rec := range records {
+		if rec.HasTags(tags...) {
+			kept = append(kept, rec)
+		}
+	}
+	return kept
+}
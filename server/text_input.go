@@ -0,0 +1,209 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+	"myprice/tools"
+)
+
+// maxTextBytes bounds pasted receipt text. Real receipts are a few KB.
+const maxTextBytes = 256 << 10
+
+var (
+	errNoText      = errors.New("text is required")
+	errTextTooLong = fmt.Errorf("text must be at most %d KB", maxTextBytes>>10)
+	errTextNotUTF8 = errors.New("text must be UTF-8")
+)
+
+// AnalyzeTextRequest is the request body for /api/analyze-text.
+type AnalyzeTextRequest struct {
+	Text         string `json:"text"`                    // Receipt or invoice as plain text, e.g. pasted from an email
+	DocumentType string `json:"document_type,omitempty"` // auto (default), receipt, or invoice
+	Model        string `json:"model,omitempty"`         // One of LLM_MODELS; the default when empty
+}
+
+// handleAnalyzeText analyzes a receipt or invoice given as plain text, such
+// as one copied from an order confirmation email. It takes a JSON
+// AnalyzeTextRequest, or the text itself as a text/plain body with
+// document_type and model as query parameters. There is no image, so the
+// OCR stage is skipped and the LLM reads the text alone.
+func (s *Server) handleAnalyzeText(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Leave room for JSON escaping
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxTextBytes)
+	var req AnalyzeTextRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "text/plain" {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			jsonError(w, errTextTooLong.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		q := r.URL.Query()
+		req = AnalyzeTextRequest{Text: string(data), DocumentType: q.Get("document_type"), Model: q.Get("model")}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			jsonError(w, errTextTooLong.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		jsonError(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.checkModel(w, req.Model) {
+		return
+	}
+
+	var owner string
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		owner = p.Name
+	}
+	textPath, original, err := s.storeText(req.Text, owner, "text")
+	if err != nil {
+		s.textInputError(w, err)
+		return
+	}
+
+	ctx, attempt := s.startAttempt(r.Context(), viaAPI, owner, textPath)
+	result, err := s.analyze(ctx, textPath, receipt.ParseDocumentType(req.DocumentType), req.Model)
+	if r.Context().Err() != nil {
+		log.Printf("Analysis of %s cancelled: client disconnected", textPath)
+		attempt.finish(nil, "", r.Context().Err())
+		return
+	}
+	if err != nil {
+		attempt.finish(nil, "", err)
+		analysisFailed(w, textPath, err)
+		return
+	}
+
+	rec := result.record(textPath)
+	rec.Owner = owner
+	rec.Original = original
+	receiptID := s.saveResult(rec)
+	attempt.finish(result, receiptID, nil)
+	if receiptID != "" {
+		s.autoExport(rec)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if result.partial() {
+		w.WriteHeader(http.StatusMultiStatus)
+	}
+	json.NewEncoder(w).Encode(AnalyzeResponse{
+		ImagePath:    textPath,
+		Textract:     result.Textract,
+		LLMOutput:    result.Output,
+		Source:       result.Source,
+		DocumentType: string(result.DocType),
+		Model:        result.Model,
+		Location:     result.Location,
+		PurchaseTime: result.PurchaseTime,
+		Anomalies:    rec.Anomalies,
+		Quality:      rec.Quality,
+		CaptureHints: result.CaptureHints,
+		HookErrors:   rec.HookErrors,
+		ReceiptID:    receiptID,
+		Partial:      result.partial(),
+		Stages:       result.Stages,
+		Usage:        attempt.usage(result),
+	})
+}
+
+// storeText saves pasted text to the upload dir, charged to owner's quota
+// like an image, and archives it as the receipt's original from source. It
+// returns the text's path and its archive entry, if it was archived. The
+// text is named by content, so pasting the same receipt again analyzes it
+// as a new version.
+func (s *Server) storeText(text, owner, source string) (string, *store.Original, error) {
+	text = strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n"))
+	switch {
+	case text == "":
+		return "", nil, errNoText
+	case len(text) > maxTextBytes:
+		return "", nil, errTextTooLong
+	case !utf8.ValidString(text):
+		return "", nil, errTextNotUTF8
+	}
+
+	data := []byte(text + "\n")
+	id := sha256.Sum256(data)
+	name := fmt.Sprintf("text-%s.txt", hex.EncodeToString(id[:8]))
+	destPath := filepath.Join(s.uploadDir, name)
+	if err := s.storeImage(owner, destPath, data); err != nil {
+		return "", nil, err
+	}
+	original := s.archiveOriginal(data, store.Original{Name: name, ContentType: "text/plain; charset=utf-8", Source: source})
+	return destPath, original, nil
+}
+
+// textInputError reports a failure to accept pasted text.
+func (s *Server) textInputError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNoText), errors.Is(err, errTextNotUTF8):
+		jsonError(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errTextTooLong):
+		jsonError(w, err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		s.imageInputError(w, err)
+	}
+}
+
+// isTextSource reports whether path is plain text rather than an image.
+func isTextSource(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".txt")
+}
+
+// readText stands in for OCR with plain text: each non-empty line becomes
+// an OCR line read with full confidence, spaced evenly down the page, so
+// the LLM prompt and the regex parsers work as they do on a scan.
+func (s *Server) readText(textPath string, result *analysisResult) error {
+	data, err := s.cipher.ReadFile(textPath)
+	if err != nil {
+		return fmt.Errorf("failed to read text: %w", err)
+	}
+	result.Source, result.Textract = "text", textDocument(string(data))
+	sum := sha256.Sum256(data)
+	result.ImageSHA256 = hex.EncodeToString(sum[:])
+	return nil
+}
+
+// textDocument lays text out as the lines of a one-page document.
+func textDocument(text string) tools.LoadTextractOutput {
+	var texts []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			texts = append(texts, line)
+		}
+	}
+	doc := tools.LoadTextractOutput{
+		PageCount:  1,
+		Lines:      make([]tools.TextractLine, len(texts)),
+		TotalLines: len(texts),
+		// Typed text is read exactly
+		MeanConfidence: 100,
+		MinConfidence:  100,
+	}
+	for i, t := range texts {
+		doc.Lines[i] = tools.TextractLine{Text: t, Confidence: 100, Top: float64(i) / float64(len(texts))}
+	}
+	return doc
+}
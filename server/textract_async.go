@@ -0,0 +1,387 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"myprice/internal/redact"
+	"myprice/internal/sns"
+)
+
+const (
+	// textractRegion is where Textract and its S3 bucket are called.
+	textractRegion = "us-east-1"
+
+	// defaultTextractPrefix is the S3 key prefix for staged documents.
+	defaultTextractPrefix = "myprice/textract/"
+
+	// defaultTextractPoll is how often an async Textract job is checked
+	// when no SNS topic is configured.
+	defaultTextractPoll = 5 * time.Second
+
+	// defaultTextractFallbackPoll is how often an async job is checked when
+	// SNS notifications are on, in case one is lost.
+	defaultTextractFallbackPoll = time.Minute
+
+	// earlyNoticeRetention is how long a notification for a job no analysis
+	// is waiting on yet is kept, in case it arrived before the job's start
+	// call returned.
+	earlyNoticeRetention = 10 * time.Minute
+
+	// maxSNSMessage bounds an SNS request body; SNS messages are at most
+	// 256KB.
+	maxSNSMessage = 512 << 10
+)
+
+// asyncTextract runs Textract as asynchronous jobs on documents staged in
+// S3, instead of the synchronous call. With an SNS topic, Textract
+// announces each finished job at /api/webhooks/textract and the waiting
+// analysis picks up the result at once; polling remains as a fallback.
+type asyncTextract struct {
+	bucket   string
+	prefix   string // S3 key prefix for staged documents
+	topicArn string // Empty when notifications are off
+	roleArn  string // Role Textract publishes to the topic as
+	poll     time.Duration
+	verifier *sns.Verifier
+
+	mu      sync.Mutex
+	waiters map[string]chan string  // Job ID to the status it finished with
+	early   map[string]textractNote // Notifications no analysis is waiting on
+}
+
+// textractNote is a job status that arrived before anyone waited on it.
+type textractNote struct {
+	status string
+	at     time.Time
+}
+
+// textractNotice is the message Textract publishes when a job finishes.
+type textractNotice struct {
+	JobID  string `json:"JobId"`
+	Status string `json:"Status"` // SUCCEEDED, FAILED, ERROR, or PARTIAL_SUCCESS
+	API    string `json:"API"`
+	JobTag string `json:"JobTag"`
+}
+
+// newAsyncTextract reads the async Textract settings. It returns nil, for
+// synchronous calls, unless TEXTRACT_S3_BUCKET is set.
+func newAsyncTextract() *asyncTextract {
+	bucket := os.Getenv("TEXTRACT_S3_BUCKET")
+	if bucket == "" {
+		return nil
+	}
+	a := &asyncTextract{
+		bucket:  bucket,
+		prefix:  os.Getenv("TEXTRACT_S3_PREFIX"),
+		waiters: make(map[string]chan string),
+		early:   make(map[string]textractNote),
+	}
+	if a.prefix == "" {
+		a.prefix = defaultTextractPrefix
+	}
+
+	topic, role := os.Getenv("TEXTRACT_SNS_TOPIC_ARN"), os.Getenv("TEXTRACT_SNS_ROLE_ARN")
+	switch {
+	case topic != "" && role != "":
+		a.topicArn, a.roleArn = topic, role
+		a.verifier = sns.NewVerifier(nil)
+		a.poll = envDuration("TEXTRACT_POLL_INTERVAL", defaultTextractFallbackPoll)
+	case topic != "" || role != "":
+		log.Printf("Warning: TEXTRACT_SNS_TOPIC_ARN and TEXTRACT_SNS_ROLE_ARN must be set together; polling async Textract jobs instead")
+		fallthrough
+	default:
+		a.poll = envDuration("TEXTRACT_POLL_INTERVAL", defaultTextractPoll)
+	}
+	if a.poll < time.Second {
+		a.poll = time.Second
+	}
+	return a
+}
+
+// watch returns a channel that receives a job's final status once its
+// notification arrives, and a func to stop watching.
+func (a *asyncTextract) watch(jobID string) (<-chan string, func()) {
+	ch := make(chan string, 1)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.waiters[jobID] = ch
+	if note, ok := a.early[jobID]; ok {
+		delete(a.early, jobID)
+		ch <- note.status
+	}
+	return ch, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(a.waiters, jobID)
+	}
+}
+
+// notify hands a finished job's status to the analysis waiting on it, or
+// keeps it a while for one about to.
+func (a *asyncTextract) notify(jobID, status string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ch, ok := a.waiters[jobID]; ok {
+		select {
+		case ch <- status:
+		default:
+		}
+		return
+	}
+
+	now := time.Now()
+	a.early[jobID] = textractNote{status: status, at: now}
+	for id, note := range a.early {
+		if now.Sub(note.at) > earlyNoticeRetention {
+			delete(a.early, id)
+		}
+	}
+}
+
+// runTextractAsync stages an image in S3, runs a Textract job on it, and
+// writes the job's blocks to outputPath in the synchronous output's shape,
+// so it is loaded and cached the same way. Cancelling ctx stops waiting,
+// and nothing is cached.
+func (s *Server) runTextractAsync(ctx context.Context, imagePath, outputPath string) (string, error) {
+	a := s.textractAsync
+	key, err := a.stage(ctx, imagePath)
+	if err != nil {
+		return "", err
+	}
+	defer a.unstage(key)
+
+	api := "document-text-detection"
+	if s.textractTables {
+		api = "document-analysis"
+	}
+	args := []string{"textract", "start-" + api, "--region", textractRegion,
+		"--document-location", fmt.Sprintf(`{"S3Object":{"Bucket":%q,"Name":%q}}`, a.bucket, key),
+		"--job-tag", "myprice"}
+	if s.textractTables {
+		args = append(args, "--feature-types", "TABLES")
+	}
+	if a.topicArn != "" {
+		args = append(args, "--notification-channel", fmt.Sprintf(`{"SNSTopicArn":%q,"RoleArn":%q}`, a.topicArn, a.roleArn))
+	}
+	out, err := awsCLI(ctx, args...)
+	if err != nil {
+		return "", err
+	}
+	var started struct {
+		JobID string `json:"JobId"`
+	}
+	if err := json.Unmarshal(out, &started); err != nil || started.JobID == "" {
+		return "", fmt.Errorf("textract returned no job ID: %s", out)
+	}
+	log.Printf("Started async Textract job %s on s3://%s/%s", started.JobID, a.bucket, key)
+
+	if err := a.wait(ctx, api, started.JobID); err != nil {
+		return "", err
+	}
+	output, err := a.results(ctx, api, started.JobID)
+	if err != nil {
+		return "", err
+	}
+	if err := s.cipher.WriteFile(outputPath, output, 0644); err != nil {
+		return "", fmt.Errorf("failed to save textract output: %w", err)
+	}
+	log.Printf("Cached async Textract output: %s (%d bytes)", outputPath, len(output))
+	return outputPath, nil
+}
+
+// stage uploads an image to the bucket under a fresh key.
+func (a *asyncTextract) stage(ctx context.Context, imagePath string) (string, error) {
+	var b [8]byte
+	rand.Read(b[:])
+	key := a.prefix + hex.EncodeToString(b[:]) + filepath.Ext(imagePath)
+	if _, err := awsCLI(ctx, "s3", "cp", "--region", textractRegion, "--only-show-errors", imagePath, "s3://"+a.bucket+"/"+key); err != nil {
+		return "", fmt.Errorf("failed to stage document in S3: %w", err)
+	}
+	return key, nil
+}
+
+// unstage removes a staged image. Failures are only logged; a bucket
+// lifecycle rule can sweep up what is left behind.
+func (a *asyncTextract) unstage(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := awsCLI(ctx, "s3", "rm", "--region", textractRegion, "--only-show-errors", "s3://"+a.bucket+"/"+key); err != nil {
+		log.Printf("Warning: failed to remove s3://%s/%s: %v", a.bucket, key, err)
+	}
+}
+
+// wait blocks until a job has finished, on its SNS notification or, failing
+// that, by polling its status.
+func (a *asyncTextract) wait(ctx context.Context, api, jobID string) error {
+	done, stop := a.watch(jobID)
+	defer stop()
+	ticker := time.NewTicker(a.poll)
+	defer ticker.Stop()
+
+	for {
+		var status string
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case status = <-done:
+			log.Printf("Async Textract job %s finished: %s (notified)", jobID, status)
+		case <-ticker.C:
+			out, err := awsCLI(ctx, "textract", "get-"+api, "--region", textractRegion, "--job-id", jobID, "--max-results", "1")
+			if err != nil {
+				return err
+			}
+			var page struct {
+				JobStatus string `json:"JobStatus"`
+			}
+			if err := json.Unmarshal(out, &page); err != nil {
+				return fmt.Errorf("invalid textract job status: %w", err)
+			}
+			if page.JobStatus == "IN_PROGRESS" {
+				continue
+			}
+			status = page.JobStatus
+			log.Printf("Async Textract job %s finished: %s (polled)", jobID, status)
+		}
+
+		switch status {
+		case "SUCCEEDED":
+			return nil
+		case "PARTIAL_SUCCESS":
+			log.Printf("Warning: async Textract job %s only partly succeeded", jobID)
+			return nil
+		default:
+			return fmt.Errorf("textract job %s ended with status %s", jobID, status)
+		}
+	}
+}
+
+// results reads every page of a finished job's blocks and joins them into
+// one document like the synchronous call's output.
+func (a *asyncTextract) results(ctx context.Context, api, jobID string) ([]byte, error) {
+	var doc struct {
+		DocumentMetadata json.RawMessage   `json:"DocumentMetadata,omitempty"`
+		Blocks           []json.RawMessage `json:"Blocks"`
+	}
+	next := ""
+	for {
+		args := []string{"textract", "get-" + api, "--region", textractRegion, "--job-id", jobID}
+		if next != "" {
+			args = append(args, "--next-token", next)
+		}
+		out, err := awsCLI(ctx, args...)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			DocumentMetadata json.RawMessage   `json:"DocumentMetadata"`
+			Blocks           []json.RawMessage `json:"Blocks"`
+			NextToken        string            `json:"NextToken"`
+		}
+		if err := json.Unmarshal(out, &page); err != nil {
+			return nil, fmt.Errorf("invalid textract results: %w", err)
+		}
+		if doc.DocumentMetadata == nil {
+			doc.DocumentMetadata = page.DocumentMetadata
+		}
+		doc.Blocks = append(doc.Blocks, page.Blocks...)
+		if page.NextToken == "" {
+			break
+		}
+		next = page.NextToken
+	}
+	return json.Marshal(doc)
+}
+
+// awsCLI runs an AWS CLI command and returns its output. Cancelling ctx
+// kills the CLI.
+func awsCLI(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "aws", args...)
+	// Don't wait on output pipes held open by children of a killed CLI
+	cmd.WaitDelay = textractWaitDelay
+
+	output, err := cmd.Output()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	if err != nil {
+		// Get stderr for better error messages
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			// The CLI may echo its arguments and credentials in errors
+			return nil, fmt.Errorf("aws %s failed: %s", args[0], redact.String(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("aws %s command failed: %w", args[0], err)
+	}
+	return output, nil
+}
+
+// handleTextractWebhook receives the SNS messages Textract publishes when
+// an async job finishes. It takes no API key: SNS can't send one, so each
+// message's signature is checked instead, and only messages from the
+// configured topic are accepted. Subscription requests for the topic are
+// confirmed automatically.
+func (s *Server) handleTextractWebhook(w http.ResponseWriter, r *http.Request) {
+	a := s.textractAsync
+	if a == nil || a.topicArn == "" {
+		jsonError(w, "Textract notifications are not enabled", http.StatusNotFound)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSNSMessage))
+	if err != nil {
+		jsonError(w, "Failed to read message", http.StatusBadRequest)
+		return
+	}
+	msg, err := sns.Parse(data)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if msg.TopicArn != a.topicArn {
+		jsonError(w, "Unexpected topic", http.StatusForbidden)
+		return
+	}
+	if err := a.verifier.Verify(r.Context(), msg); err != nil {
+		log.Printf("Warning: rejected SNS message %s: %v", msg.MessageID, err)
+		if errors.Is(err, sns.ErrInvalid) {
+			jsonError(w, "Invalid signature", http.StatusForbidden)
+		} else {
+			// SNS retries on a 5xx, by when the certificate may be reachable
+			jsonError(w, "Failed to verify message", http.StatusServiceUnavailable)
+		}
+		return
+	}
+
+	switch msg.Type {
+	case sns.TypeSubscriptionConfirmation:
+		if err := a.verifier.Confirm(r.Context(), msg); err != nil {
+			log.Printf("Warning: failed to confirm SNS subscription to %s: %v", msg.TopicArn, err)
+			jsonError(w, "Failed to confirm subscription", http.StatusBadGateway)
+			return
+		}
+		log.Printf("Confirmed SNS subscription to %s", msg.TopicArn)
+	case sns.TypeUnsubscribeConfirmation:
+		log.Printf("Warning: unsubscribed from %s; async Textract jobs will be polled", msg.TopicArn)
+	case sns.TypeNotification:
+		var notice textractNotice
+		if err := json.Unmarshal([]byte(msg.Message), &notice); err != nil || notice.JobID == "" {
+			jsonError(w, "Not a Textract notification", http.StatusBadRequest)
+			return
+		}
+		a.notify(notice.JobID, notice.Status)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
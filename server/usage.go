@@ -0,0 +1,185 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"myprice/internal/analysislog"
+	"myprice/tools"
+)
+
+// KeyUsage adds up what the analyses made with one API key spent, from the
+// analysis log.
+type KeyUsage struct {
+	Actor    string `json:"actor"` // "" for analyses made without a key, such as revalidation
+	Attempts int    `json:"attempts"`
+	Receipts int    `json:"receipts"` // Results stored
+	tools.Usage
+	LastAt *time.Time `json:"last_at,omitempty"` // The latest analysis
+}
+
+// UsageResponse lists what each API key's analyses spent.
+type UsageResponse struct {
+	Since *time.Time  `json:"since,omitempty"`
+	Until *time.Time  `json:"until,omitempty"`
+	Keys  []KeyUsage  `json:"keys"`
+	Total tools.Usage `json:"total"`
+}
+
+// usage returns what the attempt has spent, with its cost when prices are
+// configured. result is nil when the analysis failed.
+func (a *analysisAttempt) usage(result *analysisResult) *tools.Usage {
+	tokens := a.meter.total()
+	textractCalls := 0
+	if result != nil && result.Source == ocrSourceTextract {
+		textractCalls = 1
+	}
+	return a.s.priceUsage(tokens, textractCalls)
+}
+
+// priceUsage returns tokens and Textract calls as a Usage, priced when
+// prices are configured.
+func (s *Server) priceUsage(tokens analysislog.Tokens, textractCalls int) *tools.Usage {
+	u := &tools.Usage{
+		Calls:         tokens.Calls,
+		InputTokens:   tokens.Input,
+		OutputTokens:  tokens.Output,
+		TextractCalls: textractCalls,
+	}
+	if s.statsPrices.set() {
+		cost := math.Round(s.statsPrices.cost(tokens, textractCalls)*1e6) / 1e6
+		u.CostUSD = &cost
+	}
+	return u
+}
+
+// handleUsage reports what the caller's analyses have spent, optionally
+// between since and until (RFC 3339 or YYYY-MM-DD).
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	p, ok := PrincipalFrom(r.Context())
+	if !ok {
+		jsonError(w, "Usage needs API_KEYS to identify users", http.StatusBadRequest)
+		return
+	}
+	s.writeUsage(w, r, p.Name)
+}
+
+// handleAdminUsage reports what every API key's analyses have spent, most
+// tokens first, optionally between since and until.
+func (s *Server) handleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	s.writeUsage(w, r, "")
+}
+
+// writeUsage answers a usage query, for one actor or for all of them when
+// actor is "".
+func (s *Server) writeUsage(w http.ResponseWriter, r *http.Request, actor string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.analysisLog == nil {
+		jsonError(w, "Analysis log is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	q := analysislog.Query{Actor: actor}
+	resp := UsageResponse{}
+	for name, t := range map[string]**time.Time{"since": &resp.Since, "until": &resp.Until} {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			continue
+		}
+		parsed, err := parseLogTime(v)
+		if err != nil {
+			jsonError(w, name+" must be an RFC 3339 time or YYYY-MM-DD date", http.StatusBadRequest)
+			return
+		}
+		*t = &parsed
+	}
+	if resp.Since != nil {
+		q.Since = *resp.Since
+	}
+	if resp.Until != nil {
+		q.Until = *resp.Until
+	}
+	entries, _, err := s.analysisLog.Find(q)
+	if err != nil {
+		jsonError(w, "Failed to read analysis log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp.Keys = s.usageByActor(entries, actor)
+	var total analysislog.Tokens
+	textractCalls := 0
+	for _, k := range resp.Keys {
+		total.Calls += k.Calls
+		total.Input += k.InputTokens
+		total.Output += k.OutputTokens
+		textractCalls += k.TextractCalls
+	}
+	resp.Total = *s.priceUsage(total, textractCalls)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// usageByActor adds up entries by actor, most tokens first. Configured API
+// keys without analyses are listed too; with actor set, only that key is.
+func (s *Server) usageByActor(entries []analysislog.Entry, actor string) []KeyUsage {
+	type sums struct {
+		usage         KeyUsage
+		tokens        analysislog.Tokens
+		textractCalls int
+	}
+	byActor := make(map[string]*sums)
+	get := func(name string) *sums {
+		if byActor[name] == nil {
+			byActor[name] = &sums{usage: KeyUsage{Actor: name}}
+		}
+		return byActor[name]
+	}
+	if actor != "" {
+		get(actor)
+	} else {
+		for _, k := range s.apiKeys {
+			get(k.principal.Name)
+		}
+	}
+
+	for _, e := range entries {
+		a := get(e.Actor)
+		a.usage.Attempts++
+		if e.ReceiptID != "" {
+			a.usage.Receipts++
+		}
+		a.tokens.Calls += e.Tokens.Calls
+		a.tokens.Input += e.Tokens.Input
+		a.tokens.Output += e.Tokens.Output
+		if e.OCRSource == ocrSourceTextract {
+			a.textractCalls++
+		}
+		if a.usage.LastAt == nil || e.Time.After(*a.usage.LastAt) {
+			t := e.Time
+			a.usage.LastAt = &t
+		}
+	}
+
+	list := make([]KeyUsage, 0, len(byActor))
+	for _, a := range byActor {
+		a.usage.Usage = *s.priceUsage(a.tokens, a.textractCalls)
+		list = append(list, a.usage)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		ti := list[i].InputTokens + list[i].OutputTokens
+		tj := list[j].InputTokens + list[j].OutputTokens
+		if ti != tj {
+			return ti > tj
+		}
+		return list[i].Actor < list[j].Actor
+	})
+	return list
+}
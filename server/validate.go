@@ -0,0 +1,237 @@
+// Package server provides LLM integration for receipt parsing.
+package server
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"time"
+
+	"myprice/internal/receipt"
+)
+
+var (
+	// creditLineRegex matches item names that may carry a negative amount
+	creditLineRegex = regexp.MustCompile(`(?i)discount|coupon|sav(?:ed|ings?)|promo|rebate|refund|credit|return|void|deposit|\boff\b|instant`)
+)
+
+// totalsTolerance is how far totals may disagree before a parse is sent
+// back: the larger of 10 cents and 2%, which absorbs rounding and unlisted
+// discounts but not a dropped item or a misread digit.
+func totalsTolerance(amount float64) float64 {
+	return math.Max(0.10, math.Abs(amount)*0.02)
+}
+
+// validateReceiptOutput checks a parsed receipt against the schema and
+// business rules, returning one message per problem, phrased so the model
+// can fix it.
+func validateReceiptOutput(r *receipt.Receipt) []string {
+	var issues []string
+	if r.Vendor == "" {
+		issues = append(issues, "vendor is empty; give the store or restaurant name")
+	}
+	if r.Date != "" && !validISODate(r.Date) {
+		issues = append(issues, fmt.Sprintf("date %q is not a valid YYYY-MM-DD date", r.Date))
+	}
+	if len(r.Items) == 0 {
+		issues = append(issues, "items is empty; list every purchased line item")
+	}
+
+	// Prices may be per unit or per line, so either sum may match
+	itemSum, lineSum := 0.0, 0.0
+	for i, item := range r.Items {
+		if item.Name == "" {
+			issues = append(issues, fmt.Sprintf("items[%d] has no name", i))
+		}
+		if item.Qty < 0 {
+			issues = append(issues, fmt.Sprintf("items[%d] (%s) has negative qty %d", i, item.Name, item.Qty))
+		}
+		if item.Price < 0 && !r.Refund && !creditLineRegex.MatchString(item.Name) {
+			issues = append(issues, fmt.Sprintf("items[%d] (%s) has negative price %.2f; only discounts and credits may be negative", i, item.Name, item.Price))
+		}
+		itemSum += item.Price
+		lineSum += item.Price * float64(max(item.Qty, 1))
+	}
+
+	feeSum := 0.0
+	for i, fee := range r.Fees {
+		if fee.Amount < 0 {
+			issues = append(issues, fmt.Sprintf("fees[%d] (%s) has negative amount %.2f", i, fee.Name, fee.Amount))
+		}
+		feeSum += fee.Amount
+	}
+
+	amounts := map[string]*float64{"subtotal": r.Subtotal, "tax": r.Tax, "total": r.Total}
+	issues = append(issues, unknownIssues(amounts, r.Unknown)...)
+	subtotal, total := receipt.Value(r.Subtotal), receipt.Value(r.Total)
+	if !r.Refund {
+		issues = append(issues, amountIssues(map[string]float64{
+			"subtotal": subtotal, "tax": receipt.Value(r.Tax), "total": total,
+		})...)
+	}
+	// Refunds have negative totals, so the checks below test for any amount
+	tolerance := totalsTolerance(subtotal)
+	if subtotal != 0 && len(r.Items) > 0 && math.Abs(itemSum-subtotal) > tolerance && math.Abs(lineSum-subtotal) > tolerance {
+		issues = append(issues, fmt.Sprintf("item prices add up to %.2f but subtotal is %.2f; check for missed, duplicated, or misread items", itemSum, subtotal))
+	}
+	issues = append(issues, taxLineIssues(r.TaxLines, r.Tax, r.Refund)...)
+	issues = append(issues, tenderIssues(r.Tenders, r.Total, r.Refund)...)
+	// An unreadable tax leaves nothing to check the total against. Tax
+	// already in the prices is in the subtotal too.
+	if total != 0 && subtotal != 0 && r.Unknown["tax"] != receipt.ReasonUnreadable {
+		_, included := receipt.TaxTotals(r.TaxLines)
+		if sum := subtotal + receipt.Value(r.Tax) - included + feeSum; math.Abs(sum-total) > totalsTolerance(total) {
+			issues = append(issues, fmt.Sprintf("subtotal + tax + fees is %.2f but total is %.2f", sum, total))
+		}
+	}
+	return issues
+}
+
+// validateInvoiceOutput checks a parsed invoice like validateReceiptOutput.
+func validateInvoiceOutput(inv *receipt.Invoice) []string {
+	var issues []string
+	if inv.Vendor.Name == "" {
+		issues = append(issues, "vendor.name is empty; give the issuing company")
+	}
+	if inv.InvoiceDate != "" && !validISODate(inv.InvoiceDate) {
+		issues = append(issues, fmt.Sprintf("invoice_date %q is not a valid YYYY-MM-DD date", inv.InvoiceDate))
+	}
+	if inv.DueDate != "" && !validISODate(inv.DueDate) {
+		issues = append(issues, fmt.Sprintf("due_date %q is not a valid YYYY-MM-DD date", inv.DueDate))
+	}
+	if len(inv.Items) == 0 {
+		issues = append(issues, "items is empty; list every line item")
+	}
+
+	itemSum := 0.0
+	for i, item := range inv.Items {
+		if item.Description == "" {
+			issues = append(issues, fmt.Sprintf("items[%d] has no description", i))
+		}
+		if item.Qty < 0 {
+			issues = append(issues, fmt.Sprintf("items[%d] (%s) has negative qty %g", i, item.Description, item.Qty))
+		}
+		if (item.UnitPrice < 0 || item.Amount < 0) && !creditLineRegex.MatchString(item.Description) {
+			issues = append(issues, fmt.Sprintf("items[%d] (%s) has a negative price; only discounts and credits may be negative", i, item.Description))
+		}
+		itemSum += item.Amount
+	}
+
+	amounts := map[string]*float64{"subtotal": inv.Subtotal, "tax": inv.Tax, "total": inv.Total}
+	issues = append(issues, unknownIssues(amounts, inv.Unknown)...)
+	subtotal, total := receipt.Value(inv.Subtotal), receipt.Value(inv.Total)
+	issues = append(issues, amountIssues(map[string]float64{
+		"subtotal": subtotal, "tax": receipt.Value(inv.Tax), "shipping": inv.Shipping, "total": total, "amount_due": inv.AmountDue,
+	})...)
+	if subtotal > 0 && len(inv.Items) > 0 && math.Abs(itemSum-subtotal) > totalsTolerance(subtotal) {
+		issues = append(issues, fmt.Sprintf("item amounts add up to %.2f but subtotal is %.2f; check for missed, duplicated, or misread items", itemSum, subtotal))
+	}
+	issues = append(issues, taxLineIssues(inv.TaxLines, inv.Tax, false)...)
+	if total > 0 && subtotal > 0 && inv.Unknown["tax"] != receipt.ReasonUnreadable {
+		_, included := receipt.TaxTotals(inv.TaxLines)
+		if sum := subtotal + receipt.Value(inv.Tax) - included + inv.Shipping; math.Abs(sum-total) > totalsTolerance(total) {
+			issues = append(issues, fmt.Sprintf("subtotal + tax + shipping is %.2f but total is %.2f", sum, total))
+		}
+	}
+	return issues
+}
+
+// unknownIssues checks that each null amount, and only a null amount, has
+// a valid reason in the unknown map, in a stable order.
+func unknownIssues(amounts map[string]*float64, unknown map[string]string) []string {
+	var issues []string
+	for _, field := range []string{"subtotal", "tax", "total"} {
+		reason, hasReason := unknown[field]
+		switch {
+		case amounts[field] == nil && !hasReason:
+			issues = append(issues, fmt.Sprintf("%s is null but unknown doesn't say why; set unknown.%s to %q if it isn't printed or %q if it is printed but illegible, or give its value", field, field, receipt.ReasonAbsent, receipt.ReasonUnreadable))
+		case amounts[field] != nil && hasReason:
+			issues = append(issues, fmt.Sprintf("%s is %.2f but unknown.%s says it is %s; drop one of them", field, *amounts[field], field, reason))
+		case hasReason && !receipt.ValidReason(reason):
+			issues = append(issues, fmt.Sprintf("unknown.%s is %q; use %q or %q", field, reason, receipt.ReasonAbsent, receipt.ReasonUnreadable))
+		}
+	}
+	var extra []string
+	for field := range unknown {
+		if _, ok := amounts[field]; !ok {
+			extra = append(extra, field)
+		}
+	}
+	sort.Strings(extra)
+	for _, field := range extra {
+		issues = append(issues, fmt.Sprintf("unknown.%s is not allowed; only subtotal, tax, and total may be null", field))
+	}
+	return issues
+}
+
+// taxLineIssues checks that tax lines add up to the total tax and that
+// each line's amount is its rate of its base, when both are given. Only a
+// refund's tax lines may be negative.
+func taxLineIssues(lines []receipt.TaxLine, tax *float64, refund bool) []string {
+	var issues []string
+	for i, line := range lines {
+		if line.Name == "" {
+			issues = append(issues, fmt.Sprintf("tax_lines[%d] has no name", i))
+		}
+		if line.Amount < 0 && !refund {
+			issues = append(issues, fmt.Sprintf("tax_lines[%d] (%s) has negative amount %.2f", i, line.Name, line.Amount))
+		}
+		if line.Rate < 0 || line.Rate > 100 {
+			issues = append(issues, fmt.Sprintf("tax_lines[%d] (%s) has rate %g; give the rate in percent, e.g. 20 for 20%%", i, line.Name, line.Rate))
+		} else if line.Rate > 0 && line.Base != 0 && math.Abs(line.Base*line.Rate/100-line.Amount) > totalsTolerance(line.Amount) {
+			issues = append(issues, fmt.Sprintf("tax_lines[%d] (%s) is %.2f but %g%% of %.2f is %.2f; check the rate, base, and amount", i, line.Name, line.Amount, line.Rate, line.Base, line.Base*line.Rate/100))
+		}
+	}
+	if sum, _ := receipt.TaxTotals(lines); len(lines) > 0 && tax != nil && math.Abs(sum-*tax) > totalsTolerance(*tax) {
+		issues = append(issues, fmt.Sprintf("tax_lines add up to %.2f but tax is %.2f; tax is the total of all tax lines", sum, *tax))
+	}
+	return issues
+}
+
+// tenderIssues checks each tender's type and sign, and that the tenders
+// add up to the total. Only a refund's tenders may be negative.
+func tenderIssues(tenders []receipt.Tender, total *float64, refund bool) []string {
+	var issues []string
+	sum := 0.0
+	for i, t := range tenders {
+		if !receipt.ValidTenderType(t.Type) {
+			issues = append(issues, fmt.Sprintf("tenders[%d] has type %q; use card, cash, gift_card, store_credit, ebt, or other", i, t.Type))
+		}
+		if t.Amount < 0 && !refund {
+			issues = append(issues, fmt.Sprintf("tenders[%d] (%s) has negative amount %.2f", i, t.Name, t.Amount))
+		}
+		sum += t.Amount
+	}
+	if len(tenders) > 0 && total != nil && math.Abs(sum-*total) > totalsTolerance(*total) {
+		issues = append(issues, fmt.Sprintf("tenders add up to %.2f but total is %.2f; list every tender, with cash less the change", sum, *total))
+	}
+	return issues
+}
+
+// amountIssues flags negative summary amounts, in a stable order.
+func amountIssues(amounts map[string]float64) []string {
+	var issues []string
+	for _, field := range []string{"subtotal", "tax", "shipping", "total", "amount_due"} {
+		if amount, ok := amounts[field]; ok && amount < 0 {
+			issues = append(issues, fmt.Sprintf("%s is negative (%.2f)", field, amount))
+		}
+	}
+	return issues
+}
+
+// validISODate reports whether s is a real YYYY-MM-DD date.
+func validISODate(s string) bool {
+	_, err := time.Parse("2006-01-02", s)
+	return err == nil
+}
+
+// repairPrompt asks the model to correct its previous answer.
+func repairPrompt(issues []string) string {
+	msg := "Your JSON has these problems:\n"
+	for _, issue := range issues {
+		msg += "- " + issue + "\n"
+	}
+	return msg + "\nRe-read the image and OCR text and return the corrected JSON in the same format (JSON only, no markdown). " +
+		"If a problem is really on the receipt, such as totals that don't add up as printed, keep the printed values and explain it in anomalies."
+}
@@ -0,0 +1,261 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"myprice/internal/geo"
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+	"myprice/internal/vendors"
+)
+
+// VendorListResponse lists the user-defined vendors.
+type VendorListResponse struct {
+	Vendors []*vendors.Vendor `json:"vendors"`
+	Count   int               `json:"count"`
+}
+
+// VendorVariant is a vendor name as printed on receipts and the vendor it
+// currently resolves to.
+type VendorVariant struct {
+	Name     string `json:"name"`
+	Vendor   string `json:"vendor,omitempty"` // Empty when unresolved
+	Receipts int    `json:"receipts"`
+}
+
+// VendorVariantListResponse lists printed vendor names.
+type VendorVariantListResponse struct {
+	Variants []VendorVariant `json:"variants"`
+	Count    int             `json:"count"`
+}
+
+// VendorMergeRequest merges spelling variants into one vendor.
+type VendorMergeRequest struct {
+	Vendor   string   `json:"vendor"`
+	Variants []string `json:"variants"`
+}
+
+// VendorUpdateResponse reports an alias change and the stored receipts it
+// re-resolved.
+type VendorUpdateResponse struct {
+	Success         bool            `json:"success"`
+	Vendor          *vendors.Vendor `json:"vendor,omitempty"`
+	ReceiptsUpdated int             `json:"receipts_updated"`
+}
+
+// handleVendors lists the user-defined vendors and their aliases.
+func (s *Server) handleVendors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	list := s.vendors.List()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(VendorListResponse{Vendors: list, Count: len(list)})
+}
+
+// handleVendorVariants lists every vendor name printed on the current
+// receipts with the vendor it resolves to, most receipts first, to show
+// which variants still need merging.
+func (s *Server) handleVendorVariants(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) {
+		return
+	}
+
+	records, err := s.store.List()
+	if err != nil {
+		jsonError(w, "Failed to list receipts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	counts := make(map[string]*VendorVariant)
+	for _, rec := range latestVersions(records) {
+		vendor, _, _ := vendorFields(receipt.DocumentType(rec.DocumentType), rec.Data)
+		name := strings.TrimSpace(vendor)
+		if name == "" {
+			continue
+		}
+		v, ok := counts[name]
+		if !ok {
+			v = &VendorVariant{Name: name, Vendor: s.vendors.Resolve(name)}
+			counts[name] = v
+		}
+		v.Receipts++
+	}
+
+	variants := make([]VendorVariant, 0, len(counts))
+	for _, v := range counts {
+		variants = append(variants, *v)
+	}
+	sort.Slice(variants, func(i, j int) bool {
+		if variants[i].Receipts != variants[j].Receipts {
+			return variants[i].Receipts > variants[j].Receipts
+		}
+		return variants[i].Name < variants[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(VendorVariantListResponse{Variants: variants, Count: len(variants)})
+}
+
+// handleVendorMerge makes one vendor canonical for a set of spelling
+// variants, then re-resolves stored receipts so existing analytics pick up
+// the merge. Future analyses resolve through the aliases as well.
+func (s *Server) handleVendorMerge(w http.ResponseWriter, r *http.Request) {
+	var req VendorMergeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Variants) == 0 {
+		jsonError(w, "variants is required", http.StatusBadRequest)
+		return
+	}
+
+	s.vendorMu.Lock()
+	defer s.vendorMu.Unlock()
+
+	v, err := s.vendors.Merge(req.Vendor, req.Variants)
+	if errors.Is(err, vendors.ErrNoName) {
+		jsonError(w, "vendor is required", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Failed to merge vendors: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Merged %d vendor variants into %s", len(req.Variants), v.Name)
+
+	s.respondVendorUpdate(w, v)
+}
+
+// handleDeleteVendor removes a vendor's aliases; receipts resolved through
+// them fall back to the built-in chains.
+func (s *Server) handleDeleteVendor(w http.ResponseWriter, r *http.Request) {
+	s.vendorMu.Lock()
+	defer s.vendorMu.Unlock()
+
+	err := s.vendors.Delete(r.PathValue("name"))
+	if errors.Is(err, vendors.ErrNotFound) {
+		jsonError(w, "Vendor not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Failed to delete vendor: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Deleted vendor aliases for %s", r.PathValue("name"))
+
+	s.respondVendorUpdate(w, nil)
+}
+
+// handleDeleteVendorAlias removes one alias from a vendor.
+func (s *Server) handleDeleteVendorAlias(w http.ResponseWriter, r *http.Request) {
+	s.vendorMu.Lock()
+	defer s.vendorMu.Unlock()
+
+	err := s.vendors.RemoveAlias(r.PathValue("name"), r.PathValue("alias"))
+	if errors.Is(err, vendors.ErrNotFound) {
+		jsonError(w, "Vendor or alias not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Failed to remove alias: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Removed vendor alias %q from %s", r.PathValue("alias"), r.PathValue("name"))
+
+	s.respondVendorUpdate(w, nil)
+}
+
+// respondVendorUpdate re-resolves stored receipts after an alias change and
+// writes the response. The aliases are already saved, so a failure here is
+// reported but can be fixed by repeating the request.
+func (s *Server) respondVendorUpdate(w http.ResponseWriter, v *vendors.Vendor) {
+	updated, err := s.applyVendorAliases()
+	if err != nil {
+		jsonError(w, "Aliases saved, but updating stored receipts failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if updated > 0 {
+		log.Printf("Re-resolved the vendor of %d stored receipts", updated)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(VendorUpdateResponse{Success: true, Vendor: v, ReceiptsUpdated: updated})
+}
+
+// applyVendorAliases re-resolves the chain of every stored record, all
+// versions included, and saves those that changed. Fingerprints are
+// recomputed so duplicate detection sees the merged vendor, and vendor
+// categories so the merged vendor is coded as its canonical name suggests.
+// The caller holds s.vendorMu.
+func (s *Server) applyVendorAliases() (int, error) {
+	if s.store == nil {
+		return 0, nil
+	}
+	records, err := s.store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, rec := range records {
+		for attempt := 1; ; attempt++ {
+			if !s.recodeVendor(rec) {
+				break
+			}
+			err := s.store.Update(rec)
+			if errors.Is(err, store.ErrConflict) && attempt < maxEditAttempts {
+				// Edited meanwhile; recode what was saved instead
+				if rec, err = s.store.Get(rec.ID); err == nil {
+					continue
+				}
+			}
+			if errors.Is(err, store.ErrNotFound) {
+				break // Erased meanwhile
+			}
+			if err != nil {
+				return updated, err
+			}
+			updated++
+			break
+		}
+	}
+	return updated, nil
+}
+
+// recodeVendor re-resolves rec's chain, fingerprint, and vendor category,
+// reporting whether its chain changed.
+func (s *Server) recodeVendor(rec *store.Record) bool {
+	chain, _ := s.resolveChain(receipt.DocumentType(rec.DocumentType), rec.Data)
+	current := ""
+	if rec.Location != nil {
+		current = rec.Location.Chain
+	}
+	if chain == current {
+		return false
+	}
+
+	if rec.Location == nil {
+		rec.Location = &geo.Location{}
+	}
+	rec.Location.Chain = chain
+	if *rec.Location == (geo.Location{}) {
+		rec.Location = nil
+	}
+	if rec.Fingerprint != "" {
+		rec.Fingerprint = receipt.Fingerprint(recordFingerprintParts(rec))
+	}
+	if code := s.vendorCategory(receipt.DocumentType(rec.DocumentType), rec.Data, rec.Location, nil); code != "" {
+		rec.VendorCategory = code
+	}
+	return true
+}
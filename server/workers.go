@@ -0,0 +1,58 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"myprice/internal/limit"
+	"myprice/internal/progress"
+)
+
+// defaultMaxParallel is the default limit on concurrent Textract calls and,
+// separately, on concurrent LLM calls.
+const defaultMaxParallel = 4
+
+// acquire waits for a slot on l, telling the caller when it has to queue
+// for the provider.
+func (s *Server) acquire(ctx context.Context, l *limit.Limiter, provider string) (func(), error) {
+	if l.Full() {
+		log.Printf("Waiting for a %s slot", provider)
+		progress.Report(ctx, "Waiting for a "+provider+" slot")
+	}
+	return l.Acquire(ctx)
+}
+
+// createBatch submits a message batch under the LLM limit, so a large
+// submission doesn't run alongside a full set of synchronous calls.
+func (s *Server) createBatch(ctx context.Context, requests []batchRequest) (*MessageBatch, error) {
+	release, err := s.acquire(ctx, s.llmLimit, "model")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return s.claudeAPI.CreateBatch(ctx, requests)
+}
+
+// WorkersResponse reports the provider concurrency limits and their queues.
+type WorkersResponse struct {
+	Textract limit.Stats `json:"textract"`
+	LLM      limit.Stats `json:"llm"`
+}
+
+// handleAdminWorkers returns concurrency and queueing metrics for the
+// Textract and LLM limits.
+func (s *Server) handleAdminWorkers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(WorkersResponse{
+		Textract: s.textractLimit.Stats(),
+		LLM:      s.llmLimit.Stats(),
+	})
+}
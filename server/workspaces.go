@@ -0,0 +1,333 @@
+// Package server provides HTTP API endpoints for the receipt analysis tools.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	shared "myprice/internal/workspace"
+)
+
+// maxWorkspaceName bounds workspace names.
+const maxWorkspaceName = 100
+
+// WorkspaceListResponse lists workspaces.
+type WorkspaceListResponse struct {
+	Workspaces []*shared.Workspace `json:"workspaces"`
+	Count      int                 `json:"count"`
+}
+
+// InvitationListResponse lists the caller's pending invitations.
+type InvitationListResponse struct {
+	Invitations []shared.Pending `json:"invitations"`
+	Count       int              `json:"count"`
+}
+
+// handleWorkspaces lists the caller's workspaces (every workspace, for
+// admins) on GET and creates one owned by the caller on POST.
+func (s *Server) handleWorkspaces(w http.ResponseWriter, r *http.Request) {
+	if !s.requireWorkspaces(w) {
+		return
+	}
+	caller, ok := workspaceCaller(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		list := make([]*shared.Workspace, 0)
+		for _, ws := range s.workspaces.List() {
+			if _, member := ws.Member(caller.Name); member || caller.Role >= RoleAdmin {
+				list = append(list, ws)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(WorkspaceListResponse{Workspaces: list, Count: len(list)})
+
+	case http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimSpace(req.Name)
+		if name == "" || len(name) > maxWorkspaceName {
+			jsonError(w, "name is required (at most 100 characters)", http.StatusBadRequest)
+			return
+		}
+
+		ws, err := s.workspaces.Create(name, caller.Name)
+		if err != nil {
+			jsonError(w, "Failed to create workspace: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s created workspace %s (%s)", caller.Name, ws.ID, ws.Name)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(ws)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleWorkspace returns a workspace with its members and pending
+// invitations on GET, and deletes it on DELETE (owners and admins only).
+// Deleting a workspace leaves its members' receipts in place.
+func (s *Server) handleWorkspace(w http.ResponseWriter, r *http.Request) {
+	ws, ok := s.loadWorkspace(w, r, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ws)
+
+	case http.MethodDelete:
+		caller, _ := PrincipalFrom(r.Context())
+		if !ws.IsOwner(caller.Name) && caller.Role < RoleAdmin {
+			jsonError(w, "Only a workspace owner or an admin can delete it", http.StatusForbidden)
+			return
+		}
+		if err := s.workspaces.Delete(ws.ID); err != nil {
+			jsonError(w, "Failed to delete workspace: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s deleted workspace %s (%s)", caller.Name, ws.ID, ws.Name)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"success": true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleWorkspaceInvite invites a user, by API key name, to join a
+// workspace. Only owners and admins may invite.
+func (s *Server) handleWorkspaceInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ws, ok := s.loadWorkspace(w, r, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	caller, _ := PrincipalFrom(r.Context())
+	if !ws.IsOwner(caller.Name) && caller.Role < RoleAdmin {
+		jsonError(w, "Only a workspace owner or an admin can invite members", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		User string `json:"user"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.knownUser(req.User) {
+		jsonError(w, "user must be the name of a configured API key", http.StatusBadRequest)
+		return
+	}
+
+	inv, err := s.workspaces.Invite(ws.ID, req.User, caller.Name)
+	switch {
+	case errors.Is(err, shared.ErrAlreadyMember), errors.Is(err, shared.ErrAlreadyInvited):
+		jsonError(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, shared.ErrNotFound):
+		jsonError(w, "Workspace not found", http.StatusNotFound)
+		return
+	case err != nil:
+		jsonError(w, "Failed to invite user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("%s invited %s to workspace %s", caller.Name, req.User, ws.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(inv)
+}
+
+// handleWorkspaceMember removes a member or cancels their invitation.
+// Owners and admins may remove anyone; members may remove themselves to
+// leave.
+func (s *Server) handleWorkspaceMember(w http.ResponseWriter, r *http.Request) {
+	ws, ok := s.loadWorkspace(w, r, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	caller, _ := PrincipalFrom(r.Context())
+	name := r.PathValue("name")
+	if name != caller.Name && !ws.IsOwner(caller.Name) && caller.Role < RoleAdmin {
+		jsonError(w, "Only a workspace owner or an admin can remove other members", http.StatusForbidden)
+		return
+	}
+
+	err := s.workspaces.RemoveMember(ws.ID, name)
+	switch {
+	case errors.Is(err, shared.ErrNotMember):
+		jsonError(w, "Member not found", http.StatusNotFound)
+		return
+	case errors.Is(err, shared.ErrLastOwner):
+		jsonError(w, "The last owner can't leave while other members remain", http.StatusConflict)
+		return
+	case err != nil:
+		jsonError(w, "Failed to remove member: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("%s removed %s from workspace %s", caller.Name, name, ws.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"success": true})
+}
+
+// handleWorkspaceAnalytics returns the workspace's spending report, with
+// each member's share, for ?period= as json (default), html, or pdf.
+func (s *Server) handleWorkspaceAnalytics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireStore(w) {
+		return
+	}
+	ws, ok := s.loadWorkspace(w, r, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	s.serveReport(w, r, ws, "json")
+}
+
+// handleInvitations lists the caller's pending invitations.
+func (s *Server) handleInvitations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireWorkspaces(w) {
+		return
+	}
+	caller, ok := workspaceCaller(w, r)
+	if !ok {
+		return
+	}
+
+	pending := s.workspaces.Invitations(caller.Name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(InvitationListResponse{Invitations: pending, Count: len(pending)})
+}
+
+// handleAcceptInvitation joins the workspace the caller was invited to.
+func (s *Server) handleAcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	s.respondToInvitation(w, r, true)
+}
+
+// handleDeclineInvitation discards the caller's invitation.
+func (s *Server) handleDeclineInvitation(w http.ResponseWriter, r *http.Request) {
+	s.respondToInvitation(w, r, false)
+}
+
+func (s *Server) respondToInvitation(w http.ResponseWriter, r *http.Request, accept bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireWorkspaces(w) {
+		return
+	}
+	caller, ok := workspaceCaller(w, r)
+	if !ok {
+		return
+	}
+
+	ws, err := s.workspaces.Respond(r.PathValue("id"), caller.Name, accept)
+	if errors.Is(err, shared.ErrInvitation) {
+		jsonError(w, "Invitation not found or expired", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Failed to respond to invitation: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !accept {
+		log.Printf("%s declined an invitation to workspace %s", caller.Name, ws.ID)
+		json.NewEncoder(w).Encode(map[string]any{"success": true})
+		return
+	}
+	log.Printf("%s joined workspace %s", caller.Name, ws.ID)
+	json.NewEncoder(w).Encode(ws)
+}
+
+// loadWorkspace fetches a workspace the caller belongs to, writing an error
+// and returning false otherwise. Admins may load any workspace. Other
+// callers get 404 for workspaces they aren't in, so IDs can't be probed.
+func (s *Server) loadWorkspace(w http.ResponseWriter, r *http.Request, id string) (*shared.Workspace, bool) {
+	if !s.requireWorkspaces(w) {
+		return nil, false
+	}
+	caller, ok := workspaceCaller(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	ws, err := s.workspaces.Get(id)
+	if errors.Is(err, shared.ErrNotFound) {
+		jsonError(w, "Workspace not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		jsonError(w, "Failed to load workspace: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if _, member := ws.Member(caller.Name); !member && caller.Role < RoleAdmin {
+		jsonError(w, "Workspace not found", http.StatusNotFound)
+		return nil, false
+	}
+	return ws, true
+}
+
+// workspaceCaller returns the authenticated caller. Membership is tied to
+// API key names, so workspaces need authentication enabled.
+func workspaceCaller(w http.ResponseWriter, r *http.Request) (Principal, bool) {
+	p, ok := PrincipalFrom(r.Context())
+	if !ok {
+		jsonError(w, "Workspaces require API_KEYS so members can be identified", http.StatusBadRequest)
+		return Principal{}, false
+	}
+	return p, true
+}
+
+// knownUser reports whether name is a configured API key.
+func (s *Server) knownUser(name string) bool {
+	for _, k := range s.apiKeys {
+		if k.principal.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// requireWorkspaces writes a 503 and returns false if the workspace store
+// is unavailable.
+func (s *Server) requireWorkspaces(w http.ResponseWriter) bool {
+	if s.workspaces == nil {
+		jsonError(w, "Workspace store is not available", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+// Package tools provides MCP tool implementations for receipt processing.
+package tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+
+	"myprice/internal/exif"
+	"myprice/internal/geo"
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+)
+
+// AnalyzeImageInput defines the input parameters for the analyze_image tool.
+type AnalyzeImageInput struct {
+	Path         string `json:"path" jsonschema:"Path to the receipt or invoice image"`
+	DocumentType string `json:"document_type,omitempty" jsonschema:"auto (default), receipt, or invoice"`
+}
+
+// Pipeline stages reported in StageResult.Stage.
+const (
+	StageOCR   = "ocr"
+	StageParse = "parse"
+)
+
+// Stage outcomes reported in StageResult.Status.
+const (
+	StageOK       = "ok"
+	StageFailed   = "failed"
+	StageFallback = "fallback" // Failed, and the regex parser stood in
+)
+
+// StageResult reports how one pipeline stage went.
+type StageResult struct {
+	Stage  string `json:"stage"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	DurationMS int64 `json:"duration_ms,omitempty"`
+}
+
+// Usage is what an analysis spent: its model calls and their tokens, and
+// whether it paid for Textract rather than reusing a cached result.
+type Usage struct {
+	Calls         int      `json:"calls"` // Model calls, counting repair turns
+	InputTokens   int      `json:"input_tokens"`
+	OutputTokens  int      `json:"output_tokens"`
+	TextractCalls int      `json:"textract_calls"`
+	CostUSD       *float64 `json:"cost_usd,omitempty"` // Estimated, when prices are configured
+}
+
+// AnalyzeImageOutput is the stored result of a full analysis.
+type AnalyzeImageOutput struct {
+	ReceiptID    string                `json:"receipt_id,omitempty"` // Empty if the store is unavailable
+	DocumentType string                `json:"document_type"`
+	Source       string                `json:"source"` // Where the textract came from
+	Parser       string                `json:"parser"` // "llm" or "heuristic"
+	Data         map[string]any        `json:"data"`
+	Location     *geo.Location         `json:"location,omitempty"`
+	PurchaseTime *receipt.PurchaseTime `json:"purchase_time,omitempty"`
+	Capture      *exif.Metadata        `json:"capture,omitempty"`
+	Anomalies    []receipt.Anomaly     `json:"anomalies,omitempty"`     // Found by the anomaly detectors
+	Quality      *receipt.Quality      `json:"quality,omitempty"`       // How far the result can be trusted
+	CaptureHints []receipt.CaptureHint `json:"capture_hints,omitempty"` // How to retake a photo read poorly
+	HookErrors   []store.HookError     `json:"hook_errors,omitempty"`   // Hooks whose changes were discarded
+	Partial      bool                  `json:"partial,omitempty"`       // Some stage failed; see Stages
+	Stages       []StageResult         `json:"stages"`
+	Usage        *Usage                `json:"usage,omitempty"`
+}
+
+// Analyzer runs the full receipt pipeline on an image and stores the result.
+type Analyzer interface {
+	Analyze(ctx context.Context, imagePath, documentType string) (*AnalyzeImageOutput, error)
+	// AnalyzeURL downloads an image into the upload directory and analyzes it.
+	AnalyzeURL(ctx context.Context, imageURL, documentType string) (*AnalyzeImageOutput, error)
+	// AnalyzeText saves plain text into the upload directory and analyzes
+	// it without OCR.
+	AnalyzeText(ctx context.Context, text, documentType string) (*AnalyzeImageOutput, error)
+	// ReOCRRegion reads a region of a stored receipt's image again and
+	// patches a field with what it shows.
+	ReOCRRegion(ctx context.Context, input ReOCRRegionInput) (*ReOCRRegionOutput, error)
+}
+
+// ImageAnalysis answers analyze_image, analyze_url, analyze_text, and
+// reocr_region with an Analyzer.
+type ImageAnalysis struct {
+	analyzer Analyzer
+}
+
+// NewImageAnalysis creates the analyze_image, analyze_url, analyze_text, and
+// reocr_region handlers.
+func NewImageAnalysis(a Analyzer) *ImageAnalysis {
+	return &ImageAnalysis{analyzer: a}
+}
+
+// AnalyzeImageTool returns the MCP tool definition for analyze_image.
+func AnalyzeImageTool() *mcp.Tool {
+	return &mcp.Tool{
+		Name:         "analyze_image",
+		Description:  "Run the full analysis pipeline on an image: downscale, OCR, classify, parse with the model, and resolve location and purchase time. The result is stored like an HTTP API analysis. Takes several seconds; send a progress token to receive stage updates.",
+		OutputSchema: outputSchemaWithData[AnalyzeImageOutput](),
+	}
+}
+
+// Handle processes the analyze_image tool call, reporting each pipeline
+// stage as a progress notification when the client asked for them.
+func (a *ImageAnalysis) Handle(ctx context.Context, req *mcp.CallToolRequest, input AnalyzeImageInput) (*mcp.CallToolResult, AnalyzeImageOutput, error) {
+	if input.Path == "" {
+		return nil, AnalyzeImageOutput{}, fmt.Errorf("path is required")
+	}
+	switch input.DocumentType {
+	case "", string(receipt.DocumentTypeAuto), string(receipt.DocumentTypeReceipt), string(receipt.DocumentTypeInvoice):
+	default:
+		return nil, AnalyzeImageOutput{}, fmt.Errorf("document_type must be \"auto\", \"receipt\", or \"invoice\"")
+	}
+
+	output, err := a.analyzer.Analyze(withProgressNotifications(ctx, req), input.Path, input.DocumentType)
+	if err != nil {
+		return nil, AnalyzeImageOutput{}, err
+	}
+	return nil, *output, nil
+}
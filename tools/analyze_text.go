@@ -0,0 +1,45 @@
+// Package tools provides MCP tool implementations for receipt processing.
+package tools
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+
+	"myprice/internal/receipt"
+)
+
+// AnalyzeTextInput defines the input parameters for the analyze_text tool.
+type AnalyzeTextInput struct {
+	Text         string `json:"text" jsonschema:"The receipt or invoice as plain text, such as an order confirmation email pasted from the clipboard"`
+	DocumentType string `json:"document_type,omitempty" jsonschema:"auto (default), receipt, or invoice"`
+}
+
+// AnalyzeTextTool returns the MCP tool definition for analyze_text.
+func AnalyzeTextTool() *mcp.Tool {
+	return &mcp.Tool{
+		Name:         "analyze_text",
+		Description:  "Analyze a receipt or invoice given as plain text, such as an emailed order confirmation, with no image. OCR is skipped: the text is classified, parsed with the model, and enriched as analyze_image does, and the result is stored.",
+		OutputSchema: outputSchemaWithData[AnalyzeImageOutput](),
+	}
+}
+
+// HandleText processes the analyze_text tool call like Handle.
+func (a *ImageAnalysis) HandleText(ctx context.Context, req *mcp.CallToolRequest, input AnalyzeTextInput) (*mcp.CallToolResult, AnalyzeImageOutput, error) {
+	if strings.TrimSpace(input.Text) == "" {
+		return nil, AnalyzeImageOutput{}, fmt.Errorf("text is required")
+	}
+	switch input.DocumentType {
+	case "", string(receipt.DocumentTypeAuto), string(receipt.DocumentTypeReceipt), string(receipt.DocumentTypeInvoice):
+	default:
+		return nil, AnalyzeImageOutput{}, fmt.Errorf("document_type must be \"auto\", \"receipt\", or \"invoice\"")
+	}
+
+	output, err := a.analyzer.AnalyzeText(withProgressNotifications(ctx, req), input.Text, input.DocumentType)
+	if err != nil {
+		return nil, AnalyzeImageOutput{}, err
+	}
+	return nil, *output, nil
+}
@@ -0,0 +1,44 @@
+// Package tools provides MCP tool implementations for receipt processing.
+package tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+
+	"myprice/internal/receipt"
+)
+
+// AnalyzeURLInput defines the input parameters for the analyze_url tool.
+type AnalyzeURLInput struct {
+	URL          string `json:"url" jsonschema:"http or https URL of the receipt or invoice image"`
+	DocumentType string `json:"document_type,omitempty" jsonschema:"auto (default), receipt, or invoice"`
+}
+
+// AnalyzeURLTool returns the MCP tool definition for analyze_url.
+func AnalyzeURLTool() *mcp.Tool {
+	return &mcp.Tool{
+		Name:         "analyze_url",
+		Description:  "Download an image from a public http or https URL, such as an email attachment or storage link, and run the full analysis pipeline on it as analyze_image does. The image is kept in the upload directory and the result is stored.",
+		OutputSchema: outputSchemaWithData[AnalyzeImageOutput](),
+	}
+}
+
+// HandleURL processes the analyze_url tool call like Handle.
+func (a *ImageAnalysis) HandleURL(ctx context.Context, req *mcp.CallToolRequest, input AnalyzeURLInput) (*mcp.CallToolResult, AnalyzeImageOutput, error) {
+	if input.URL == "" {
+		return nil, AnalyzeImageOutput{}, fmt.Errorf("url is required")
+	}
+	switch input.DocumentType {
+	case "", string(receipt.DocumentTypeAuto), string(receipt.DocumentTypeReceipt), string(receipt.DocumentTypeInvoice):
+	default:
+		return nil, AnalyzeImageOutput{}, fmt.Errorf("document_type must be \"auto\", \"receipt\", or \"invoice\"")
+	}
+
+	output, err := a.analyzer.AnalyzeURL(withProgressNotifications(ctx, req), input.URL, input.DocumentType)
+	if err != nil {
+		return nil, AnalyzeImageOutput{}, err
+	}
+	return nil, *output, nil
+}
@@ -0,0 +1,161 @@
+// Package tools provides MCP tool implementations for receipt processing.
+package tools
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+
+	"myprice/internal/receipt"
+)
+
+// Who answered a clarification.
+const (
+	AnsweredByUser  = "user"  // Through elicitation
+	AnsweredByModel = "model" // Through sampling
+)
+
+// maxSamplingLines bounds how much of the receipt is sent with a sampling
+// request.
+const maxSamplingLines = 150
+
+// Clarification is an ambiguous receipt field and, if the client resolved
+// it, the answer.
+type Clarification struct {
+	receipt.Question
+	Answer     string `json:"answer,omitempty"`
+	AnsweredBy string `json:"answered_by,omitempty"`
+}
+
+// clarify asks the connected client to resolve each question: the user via
+// elicitation when the client supports it, otherwise the client's model via
+// sampling. Questions the client can't or won't answer are returned without
+// an answer, so the caller can decide for itself.
+func clarify(ctx context.Context, ss *mcp.ServerSession, lines []string, questions []receipt.Question) []Clarification {
+	clarifications := make([]Clarification, len(questions))
+	var caps *mcp.ClientCapabilities
+	if ss != nil && ss.InitializeParams() != nil {
+		caps = ss.InitializeParams().Capabilities
+	}
+
+	for i, q := range questions {
+		clarifications[i].Question = q
+		if caps == nil {
+			continue
+		}
+
+		var answer string
+		var err error
+		switch {
+		case caps.Elicitation != nil:
+			answer, err = elicitAnswer(ctx, ss, q)
+			clarifications[i].AnsweredBy = AnsweredByUser
+		case caps.Sampling != nil:
+			answer, err = sampleAnswer(ctx, ss, lines, q)
+			clarifications[i].AnsweredBy = AnsweredByModel
+		}
+		if err != nil {
+			log.Printf("Warning: failed to clarify receipt %s: %v", q.Field, err)
+		}
+		if answer == "" {
+			clarifications[i].AnsweredBy = ""
+			continue
+		}
+		clarifications[i].Answer = answer
+	}
+	return clarifications
+}
+
+// elicitAnswer asks the user through a one-field form. Declined or
+// cancelled forms return no answer.
+func elicitAnswer(ctx context.Context, ss *mcp.ServerSession, q receipt.Question) (string, error) {
+	res, err := ss.Elicit(ctx, &mcp.ElicitParams{
+		Message:         q.Message,
+		RequestedSchema: questionSchema(q),
+	})
+	if err != nil {
+		return "", err
+	}
+	if res.Action != "accept" {
+		return "", nil
+	}
+	switch v := res.Content["value"].(type) {
+	case string:
+		return validAnswer(q, v), nil
+	case float64:
+		return validAnswer(q, strconv.FormatFloat(v, 'f', 2, 64)), nil
+	}
+	return "", nil
+}
+
+// questionSchema is the elicitation form for a question: a choice between
+// the candidates, or a number when the value is unreadable.
+func questionSchema(q receipt.Question) map[string]any {
+	value := map[string]any{"title": strings.ToUpper(q.Field[:1]) + q.Field[1:]}
+	switch {
+	case len(q.Candidates) > 0:
+		value["type"] = "string"
+		value["enum"] = q.Candidates
+	case q.Field == receipt.QuestionTotal:
+		value["type"] = "number"
+		value["minimum"] = 0
+	default:
+		value["type"] = "string"
+	}
+	return map[string]any{
+		"type":       "object",
+		"properties": map[string]any{"value": value},
+		"required":   []string{"value"},
+	}
+}
+
+// sampleAnswer asks the client's model to pick an answer from the OCR text.
+// Replies that aren't a valid answer are discarded.
+func sampleAnswer(ctx context.Context, ss *mcp.ServerSession, lines []string, q receipt.Question) (string, error) {
+	instruction := "Reply with the amount only, e.g. 12.34."
+	if len(q.Candidates) > 0 {
+		instruction = "Reply with exactly one of: " + strings.Join(q.Candidates, ", ") + "."
+	}
+	if len(lines) > maxSamplingLines {
+		lines = lines[:maxSamplingLines]
+	}
+	prompt := fmt.Sprintf("Receipt OCR text:\n\n%s\n\n%s %s", strings.Join(lines, "\n"), q.Message, instruction)
+
+	res, err := ss.CreateMessage(ctx, &mcp.CreateMessageParams{
+		SystemPrompt: "You resolve ambiguous fields on scanned receipts. If the text doesn't settle the question, reply \"unknown\".",
+		Messages:     []*mcp.SamplingMessage{{Role: "user", Content: &mcp.TextContent{Text: prompt}}},
+		MaxTokens:    20,
+	})
+	if err != nil {
+		return "", err
+	}
+	text, ok := res.Content.(*mcp.TextContent)
+	if !ok {
+		return "", nil
+	}
+	return validAnswer(q, text.Text), nil
+}
+
+// validAnswer normalizes an answer, returning "" if it isn't one of the
+// candidates or, for an unreadable total, a non-negative amount.
+func validAnswer(q receipt.Question, answer string) string {
+	answer = strings.TrimSuffix(strings.TrimSpace(answer), ".")
+	if len(q.Candidates) > 0 {
+		if slices.Contains(q.Candidates, answer) {
+			return answer
+		}
+		return ""
+	}
+	if q.Field == receipt.QuestionTotal {
+		if !receipt.IsPrice(answer) {
+			return ""
+		}
+		return fmt.Sprintf("%.2f", receipt.NormalizePrice(answer))
+	}
+	return answer
+}
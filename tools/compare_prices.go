@@ -0,0 +1,151 @@
+// Package tools provides MCP tool implementations for receipt processing.
+package tools
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+
+	"myprice/internal/geo"
+	"myprice/internal/pricing"
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+)
+
+// ComparePricesInput defines the input for the compare_prices tool.
+type ComparePricesInput struct {
+	Item    string `json:"item" jsonschema:"Case-insensitive substring of the line item name, or of the product name or brand looked up from its code, e.g. milk"`
+	Vendor  string `json:"vendor,omitempty" jsonschema:"Case-insensitive substring of the vendor or chain name, to limit the comparison"`
+	Store   string `json:"store,omitempty" jsonschema:"Store number, phone number, or case-insensitive substring of the store's address, to limit the comparison to one location, e.g. 2389 or Main St"`
+	ByStore bool   `json:"by_store,omitempty" jsonschema:"Compare each store location separately instead of each chain as a whole"`
+	From    string `json:"from,omitempty" jsonschema:"Earliest purchase date, YYYY-MM-DD"`
+	To      string `json:"to,omitempty" jsonschema:"Latest purchase date, YYYY-MM-DD (inclusive)"`
+}
+
+// ComparePricesOutput is the item's price history across vendors.
+type ComparePricesOutput struct {
+	Item string `json:"item"`
+	pricing.Comparison
+}
+
+// ComparePricesTool returns the MCP tool definition for compare_prices.
+func ComparePricesTool() *mcp.Tool {
+	return &mcp.Tool{
+		Name:        "compare_prices",
+		Description: "Compare what an item has cost across vendors, from line items on stored receipts. Returns each vendor's latest, lowest, highest, and mean unit price with its trend, the cheapest purchase observed, and the overall price trend. With by_store, each location of a chain (e.g. Kroger #123 and Kroger on 5th St) is compared separately. When every matching item has a known package size, prices are compared per 100 g or 100 ml (see basis) so different package sizes are comparable.",
+	}
+}
+
+// HandleComparePrices processes the compare_prices tool call. Unit prices
+// are line amounts divided by quantity, normalized by package size where
+// known; receipts whose vendor, store, or date fall outside the filters are
+// skipped. With ByStore, each of a chain's locations is compared on its own,
+// since chains price differently by location. Comparisons are cached until
+// the store changes.
+func (q *ReceiptQuerier) HandleComparePrices(ctx context.Context, req *mcp.CallToolRequest, input ComparePricesInput) (*mcp.CallToolResult, ComparePricesOutput, error) {
+	item := strings.ToLower(strings.TrimSpace(input.Item))
+	if item == "" {
+		return nil, ComparePricesOutput{}, fmt.Errorf("item is required")
+	}
+	from, err := parseQueryDate("from", input.From)
+	if err != nil {
+		return nil, ComparePricesOutput{}, err
+	}
+	to, err := parseQueryDate("to", input.To)
+	if err != nil {
+		return nil, ComparePricesOutput{}, err
+	}
+
+	vendor := strings.ToLower(strings.TrimSpace(input.Vendor))
+	location := strings.ToLower(strings.TrimSpace(input.Store))
+	stamp, err := q.stamp()
+	if err != nil {
+		return nil, ComparePricesOutput{}, err
+	}
+	key := strings.Join([]string{item, vendor, location, strconv.FormatBool(input.ByStore), from, to}, "\x00")
+	comparison, err := q.comparisons.Get(key, stamp, func() (pricing.Comparison, error) {
+		records, err := q.latest()
+		if err != nil {
+			return pricing.Comparison{}, err
+		}
+		return comparePrices(records, item, vendor, location, input.ByStore, from, to), nil
+	})
+	if err != nil {
+		return nil, ComparePricesOutput{}, err
+	}
+
+	return nil, ComparePricesOutput{Item: input.Item, Comparison: comparison}, nil
+}
+
+// comparePrices compares the unit prices of item across the vendors of
+// records, or their stores with byStore, keeping the receipts from vendor
+// and store between from and to. Filters are lowercased, and empty ones
+// keep every receipt.
+func comparePrices(records []*store.Record, item, vendor, location string, byStore bool, from, to string) pricing.Comparison {
+	var observations []pricing.Observation
+	for _, rec := range records {
+		summary := summarizeRecord(rec)
+		if vendor != "" && !strings.Contains(strings.ToLower(summary.Vendor+" "+summary.Chain), vendor) {
+			continue
+		}
+		if (from != "" && summary.Date < from) || (to != "" && summary.Date > to) {
+			continue
+		}
+		if location != "" && !matchesStore(rec.Location, location) {
+			continue
+		}
+
+		// Group store locations under their chain when it is known
+		name := summary.Chain
+		if name == "" {
+			name = summary.Vendor
+		}
+		storeName := ""
+		if byStore {
+			storeName = summary.Store
+		}
+		for _, it := range recordItems(rec) {
+			// Discounts and returns aren't prices paid
+			if it.Price <= 0 || !it.matches(item) {
+				continue
+			}
+			observations = append(observations, pricing.Observation{
+				ReceiptID: rec.ID,
+				Vendor:    name,
+				Store:     storeName,
+				Item:      it.Name,
+				Date:      summary.Date,
+				Qty:       it.Qty,
+				UnitPrice: roundCents(pricing.UnitPrice(it.Qty, it.Price)),
+
+				NormalizedPrice: it.NormalizedPrice,
+				NormalizedUnit:  it.NormalizedUnit,
+			})
+		}
+	}
+	return pricing.Compare(observations)
+}
+
+// matchesStore reports whether a receipt's location has store, lowercased,
+// in its store number, printed or geocoded address, or phone number.
+// Store numbers match without leading zeros, and phone numbers by digits.
+func matchesStore(loc *geo.Location, store string) bool {
+	if loc == nil {
+		return false
+	}
+	if number := strings.TrimLeft(strings.TrimPrefix(store, "#"), "0"); number != "" && number == strings.TrimLeft(loc.StoreNumber, "0") {
+		return true
+	}
+	if digits := receipt.PhoneDigits(store); len(digits) >= 7 && strings.Contains(receipt.PhoneDigits(loc.Phone), digits) {
+		return true
+	}
+	for _, address := range []string{loc.Address, loc.Query, loc.FormattedAddress} {
+		if strings.Contains(strings.ToLower(strings.Join(strings.Fields(address), " ")), store) {
+			return true
+		}
+	}
+	return false
+}
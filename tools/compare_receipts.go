@@ -0,0 +1,89 @@
+// Package tools provides MCP tool implementations for receipt processing.
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+
+	"myprice/internal/pricing"
+	"myprice/internal/store"
+)
+
+// CompareReceiptsInput defines the input for the compare_receipts tool.
+type CompareReceiptsInput struct {
+	A string `json:"a" jsonschema:"ID of the first receipt, e.g. last week's or the usual store's"`
+	B string `json:"b" jsonschema:"ID of the receipt to compare it with"`
+}
+
+// CompareReceiptsOutput is the item-by-item difference between two
+// receipts: items on both with their price differences, and items on only
+// one.
+type CompareReceiptsOutput struct {
+	A ReceiptSummary `json:"a"`
+	B ReceiptSummary `json:"b"`
+	pricing.ReceiptDiff
+}
+
+// CompareReceiptsTool returns the MCP tool definition for compare_receipts.
+func CompareReceiptsTool() *mcp.Tool {
+	return &mcp.Tool{
+		Name:        "compare_receipts",
+		Description: "Compare two stored receipts item by item, e.g. the same shopping list at two stores or in two weeks. Items are matched by code, looked-up product, or name (ignoring case, word order, plurals, and common abbreviations such as ORG for organic, then by names sharing most words). Returns the shared items with each receipt's unit price and the difference (per 100 g or 100 ml when both have a package size), the items on only one receipt, and what the shared items cost at each receipt's prices in the first receipt's quantities.",
+	}
+}
+
+// HandleCompareReceipts processes the compare_receipts tool call.
+func (q *ReceiptQuerier) HandleCompareReceipts(ctx context.Context, req *mcp.CallToolRequest, input CompareReceiptsInput) (*mcp.CallToolResult, CompareReceiptsOutput, error) {
+	idA, idB := strings.TrimSpace(input.A), strings.TrimSpace(input.B)
+	if idA == "" || idB == "" {
+		return nil, CompareReceiptsOutput{}, fmt.Errorf("a and b are required")
+	}
+	s, err := store.Open(q.dir, q.cipher)
+	if err != nil {
+		return nil, CompareReceiptsOutput{}, fmt.Errorf("failed to open receipt store: %w", err)
+	}
+	var records [2]*store.Record
+	for i, id := range []string{idA, idB} {
+		records[i], err = s.Get(id)
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, CompareReceiptsOutput{}, fmt.Errorf("receipt not found: %s", id)
+		}
+		if err != nil {
+			return nil, CompareReceiptsOutput{}, fmt.Errorf("failed to load receipt %s: %w", id, err)
+		}
+	}
+	return nil, CompareRecords(records[0], records[1]), nil
+}
+
+// CompareRecords diffs the items of two stored receipts or invoices, for
+// compare_receipts and the HTTP API.
+func CompareRecords(a, b *store.Record) CompareReceiptsOutput {
+	return CompareReceiptsOutput{
+		A:           summarizeRecord(a),
+		B:           summarizeRecord(b),
+		ReceiptDiff: pricing.DiffReceipts(comparedLines(a), comparedLines(b)),
+	}
+}
+
+// comparedLines returns a record's line items for pricing.DiffReceipts.
+func comparedLines(rec *store.Record) []pricing.Line {
+	items := recordItems(rec)
+	lines := make([]pricing.Line, len(items))
+	for i, it := range items {
+		lines[i] = pricing.Line{
+			Name:    it.Name,
+			Code:    it.Code,
+			Product: it.Product,
+			Qty:     it.Qty,
+			Price:   it.Price,
+
+			NormalizedPrice: it.NormalizedPrice,
+			NormalizedUnit:  it.NormalizedUnit,
+		}
+	}
+	return lines
+}
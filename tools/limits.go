@@ -0,0 +1,65 @@
+package tools
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"myprice/internal/crypt"
+)
+
+// PayloadLimits bound how much load_image and load_textract return in one
+// result. Several MCP clients fail on messages of a few megabytes, and a
+// large photo's base64 or a long receipt's lines can pass that.
+type PayloadLimits struct {
+	// MaxImageBytes is the largest image load_image returns. Larger images
+	// are downscaled to a JPEG within it. 0 means no limit.
+	MaxImageBytes int64
+	// MaxLines is the most lines one load_textract result returns. The rest
+	// come in later pages, fetched with the result's next_cursor. 0 means
+	// no limit.
+	MaxLines int
+}
+
+// DefaultPayloadLimits keeps an image result near 3MB, the image being sent
+// both as image content and as base64 in the structured output, and a
+// lines result well under 1MB even with words.
+func DefaultPayloadLimits() PayloadLimits {
+	return PayloadLimits{
+		MaxImageBytes: 1_000_000,
+		MaxLines:      300,
+	}
+}
+
+// PayloadLimitsFromEnv returns the default limits with MCP_MAX_IMAGE_BYTES
+// and MCP_MAX_TEXTRACT_LINES applied.
+func PayloadLimitsFromEnv() (PayloadLimits, error) {
+	limits := DefaultPayloadLimits()
+	if v := os.Getenv("MCP_MAX_IMAGE_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return PayloadLimits{}, fmt.Errorf("MCP_MAX_IMAGE_BYTES must be a byte count, got %q", v)
+		}
+		limits.MaxImageBytes = n
+	}
+	if v := os.Getenv("MCP_MAX_TEXTRACT_LINES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return PayloadLimits{}, fmt.Errorf("MCP_MAX_TEXTRACT_LINES must be a line count, got %q", v)
+		}
+		limits.MaxLines = n
+	}
+	return limits, nil
+}
+
+// Loader handles the load_image and load_textract tools within its limits.
+type Loader struct {
+	limits PayloadLimits
+	cipher *crypt.Cipher
+}
+
+// NewLoader creates a Loader that keeps results within limits. c decrypts
+// encrypted uploads and OCR output, and may be nil.
+func NewLoader(limits PayloadLimits, c *crypt.Cipher) *Loader {
+	return &Loader{limits: limits, cipher: c}
+}
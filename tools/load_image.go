@@ -2,14 +2,16 @@
 package tools
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"fmt"
 	"mime"
-	"os"
 	"path/filepath"
 	"strings"
 
+	"myprice/internal/imageprep"
+
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
 
@@ -24,33 +26,56 @@ type LoadImageOutput struct {
 	MimeType   string `json:"mime_type"`
 	FilePath   string `json:"file_path"`
 	SizeBytes  int64  `json:"size_bytes"`
+	// Set when the file was converted to JPEG, e.g. "tiff" or "bmp"
+	ConvertedFrom string `json:"converted_from,omitempty"`
+	// Size of the file, when it was over the size limit and a downscaled
+	// JPEG was returned instead
+	OriginalSizeBytes int64 `json:"original_size_bytes,omitempty"`
 }
 
 // LoadImageTool returns the MCP tool definition for load_image.
 func LoadImageTool() *mcp.Tool {
 	return &mcp.Tool{
 		Name:        "load_image",
-		Description: "Load an image file and return its base64-encoded bytes along with MIME type. Useful for visual inspection of receipts.",
+		Description: "Load an image file and return its base64-encoded bytes along with MIME type. Useful for visual inspection of receipts. TIFF and BMP files are converted to JPEG; the pages of a multi-page TIFF are stacked into one image. Images over the server's size limit are downscaled to a JPEG within it, and original_size_bytes gives the size of the file.",
 	}
 }
 
 // HandleLoadImage processes the load_image tool call.
 // The handler returns both a CallToolResult (with image content) and the structured output.
-func HandleLoadImage(ctx context.Context, req *mcp.CallToolRequest, input LoadImageInput) (*mcp.CallToolResult, LoadImageOutput, error) {
+func (l *Loader) HandleLoadImage(ctx context.Context, req *mcp.CallToolRequest, input LoadImageInput) (*mcp.CallToolResult, LoadImageOutput, error) {
 	if input.Path == "" {
 		return nil, LoadImageOutput{}, fmt.Errorf("path is required")
 	}
 
-	// Read the file
-	data, err := os.ReadFile(input.Path)
+	// Read the file once; the tool result must carry the bytes, so this is
+	// the only full copy we make before encoding
+	data, err := l.cipher.ReadFile(input.Path)
 	if err != nil {
 		return nil, LoadImageOutput{}, fmt.Errorf("failed to read image: %w", err)
 	}
 
-	// Get file info for size
-	info, err := os.Stat(input.Path)
-	if err != nil {
-		return nil, LoadImageOutput{}, fmt.Errorf("failed to stat file: %w", err)
+	opts := imageprep.DefaultOptions()
+	if l.limits.MaxImageBytes > 0 {
+		opts.MaxBytes = min(opts.MaxBytes, l.limits.MaxImageBytes)
+	}
+
+	// Clients can't display scanner formats, so send a JPEG instead
+	var convertedFrom string
+	var originalSize int64
+	if format := imageprep.Sniff(data); imageprep.NeedsConversion(format) {
+		data, err = imageprep.ToJPEG(bytes.NewReader(data), opts)
+		if err != nil {
+			return nil, LoadImageOutput{}, fmt.Errorf("failed to convert %s image: %w", format, err)
+		}
+		convertedFrom = format
+	} else if l.limits.MaxImageBytes > 0 && int64(len(data)) > l.limits.MaxImageBytes {
+		// Too large for one message in some clients; send a smaller JPEG
+		originalSize = int64(len(data))
+		data, err = imageprep.ToJPEG(bytes.NewReader(data), opts)
+		if err != nil {
+			return nil, LoadImageOutput{}, fmt.Errorf("image is %d bytes, over the %d byte limit, and could not be downscaled: %w", originalSize, l.limits.MaxImageBytes, err)
+		}
 	}
 
 	// Determine MIME type from extension
@@ -69,19 +94,29 @@ func HandleLoadImage(ctx context.Context, req *mcp.CallToolRequest, input LoadIm
 			mimeType = "image/webp"
 		case ".heic", ".heif":
 			mimeType = "image/heic"
+		case ".tif", ".tiff":
+			mimeType = "image/tiff"
+		case ".bmp":
+			mimeType = "image/bmp"
 		default:
 			mimeType = "application/octet-stream"
 		}
 	}
 
+	if convertedFrom != "" || originalSize != 0 {
+		mimeType = "image/jpeg"
+	}
+
 	// Encode to base64
 	base64Data := base64.StdEncoding.EncodeToString(data)
 
 	output := LoadImageOutput{
-		Base64Data: base64Data,
-		MimeType:   mimeType,
-		FilePath:   input.Path,
-		SizeBytes:  info.Size(),
+		Base64Data:        base64Data,
+		MimeType:          mimeType,
+		FilePath:          input.Path,
+		SizeBytes:         int64(len(data)),
+		ConvertedFrom:     convertedFrom,
+		OriginalSizeBytes: originalSize,
 	}
 
 	// Return the image as content for the LLM to see
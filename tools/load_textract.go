@@ -5,25 +5,35 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"os"
+	"slices"
 	"sort"
 
 	"github.com/modelcontextprotocol/go-sdk/mcp"
+
+	"myprice/internal/receipt"
 )
 
 // TextractBlock represents a single block from AWS Textract output.
 type TextractBlock struct {
-	BlockType     string          `json:"BlockType"`
-	Confidence    float64         `json:"Confidence,omitempty"`
-	Text          string          `json:"Text,omitempty"`
-	ID            string          `json:"Id"`
-	Geometry      *BlockGeometry  `json:"Geometry,omitempty"`
-	Relationships []Relationship  `json:"Relationships,omitempty"`
+	BlockType     string         `json:"BlockType"`
+	Confidence    float64        `json:"Confidence,omitempty"`
+	Text          string         `json:"Text,omitempty"`
+	TextType      string         `json:"TextType,omitempty"` // PRINTED or HANDWRITING (WORD blocks only)
+	ID            string         `json:"Id"`
+	Page          int            `json:"Page,omitempty"` // Page of a multi-page document, from 1
+	Geometry      *BlockGeometry `json:"Geometry,omitempty"`
+	Relationships []Relationship `json:"Relationships,omitempty"`
+
+	// CELL blocks from AnalyzeDocument with the TABLES feature
+	RowIndex    int      `json:"RowIndex,omitempty"`
+	ColumnIndex int      `json:"ColumnIndex,omitempty"`
+	EntityTypes []string `json:"EntityTypes,omitempty"` // e.g. COLUMN_HEADER
 }
 
 // BlockGeometry contains position information for a block.
 type BlockGeometry struct {
 	BoundingBox *BoundingBox `json:"BoundingBox,omitempty"`
+	Polygon     []Point      `json:"Polygon,omitempty"` // Corners clockwise from the top left
 }
 
 // BoundingBox defines the rectangular area of a block.
@@ -34,6 +44,12 @@ type BoundingBox struct {
 	Top    float64 `json:"Top"`
 }
 
+// Point is a position on the page, as fractions of its width and height.
+type Point struct {
+	X float64 `json:"X"`
+	Y float64 `json:"Y"`
+}
+
 // Relationship defines connections between blocks.
 type Relationship struct {
 	Type string   `json:"Type"`
@@ -50,81 +66,333 @@ type TextractDocument struct {
 
 // TextractLine represents a line of text with confidence and position.
 type TextractLine struct {
+	Text        string             `json:"text"`
+	Confidence  float64            `json:"confidence"`
+	Top         float64            `json:"top"`
+	Left        float64            `json:"left"`
+	Width       float64            `json:"width,omitempty"`
+	Height      float64            `json:"height,omitempty"`
+	Handwritten bool               `json:"handwritten,omitempty"`
+	Page        int                `json:"page,omitempty"`  // Page of a multi-page document, from 1
+	Block       receipt.BlockLabel `json:"block,omitempty"` // Part of the document the line is in
+}
+
+// HandwrittenThreshold is the fraction of handwritten lines at or above
+// which the whole document is treated as handwritten.
+const HandwrittenThreshold = 0.5
+
+// DefaultLowConfidence is the line confidence below which lines are listed
+// as low-confidence when the caller doesn't choose a threshold.
+const DefaultLowConfidence = 80.0
+
+// LowConfidenceLine is a line whose OCR confidence is below the threshold.
+type LowConfidenceLine struct {
+	Line       int     `json:"line"` // Index in lines
 	Text       string  `json:"text"`
 	Confidence float64 `json:"confidence"`
-	Top        float64 `json:"top"`
-	Left       float64 `json:"left"`
 }
 
 // LoadTextractInput defines the input parameters for load_textract tool.
 type LoadTextractInput struct {
-	Path string `json:"path" doc:"Path to the Textract JSON output file"`
+	Path          string  `json:"path" doc:"Path to the Textract JSON output file"`
+	Words         bool    `json:"words,omitempty" doc:"Include every word with its confidence and position"`
+	RowTolerance  float64 `json:"row_tolerance,omitempty" doc:"Rebuild lines from the words, joining words whose deskewed vertical centers are within this many word heights (e.g. 0.5); 0 keeps Textract's lines"`
+	MinConfidence float64 `json:"min_confidence,omitempty" doc:"Drop lines (and words) with confidence below this (0-100)"`
+	LowConfidence float64 `json:"low_confidence,omitempty" doc:"List lines with confidence below this (0-100) in low_confidence_lines; default 80"`
+	Cursor        string  `json:"cursor,omitempty" doc:"next_cursor of an earlier result, to get the lines after it; the other inputs must be the same"`
+
+	// Selecting lines, for when only part of the document is needed
+	Offset int                `json:"offset,omitempty" doc:"Skip this many of the selected lines; instead of cursor"`
+	Limit  int                `json:"limit,omitempty" doc:"Return at most this many lines; the server's page size still applies"`
+	Region *LineRegion        `json:"region,omitempty" doc:"Only lines within this box on the page"`
+	Match  string             `json:"match,omitempty" doc:"Only lines matching this case-insensitive regular expression, e.g. total|tax"`
+	Block  receipt.BlockLabel `json:"block,omitempty" doc:"Only lines in this block: header, items, totals, payment, or footer"`
 }
 
 // LoadTextractOutput is the simplified output for the LLM.
 type LoadTextractOutput struct {
-	PageCount  int            `json:"page_count"`
-	Lines      []TextractLine `json:"lines"`
-	TotalLines int            `json:"total_lines"`
-	FilePath   string         `json:"file_path"`
+	PageCount        int            `json:"page_count"`
+	Lines            []TextractLine `json:"lines"`
+	TotalLines       int            `json:"total_lines"`
+	HandwrittenLines int            `json:"handwritten_lines"`
+	Handwritten      bool           `json:"handwritten"`
+	FilePath         string         `json:"file_path"`
+	// Runs of lines in the header, item table, totals, payment, and footer
+	Blocks []receipt.Block `json:"blocks,omitempty"`
+	// Ambiguous total or date, with the client's answer when it gave one
+	Ambiguities []Clarification `json:"ambiguities,omitempty"`
+	// Every word, by line then left to right, when asked for
+	Words []TextractWord `json:"words,omitempty"`
+	// Tolerance the lines were rebuilt from the words with; 0 for Textract's lines
+	RowTolerance float64 `json:"row_tolerance,omitempty"`
+	// Tables found by AnalyzeDocument, when the file came from it with TABLES
+	Tables []TextractTable `json:"tables,omitempty"`
+	// Confidence of every line Textract read, before min_confidence dropped any
+	MeanConfidence float64 `json:"mean_confidence"`
+	MinConfidence  float64 `json:"min_confidence"`
+	// Lines dropped for being below min_confidence
+	FilteredLines int `json:"filtered_lines,omitempty"`
+	// Kept lines below the low-confidence threshold
+	LowConfidenceLines []LowConfidenceLine `json:"low_confidence_lines,omitempty"`
+	// Position of the first of lines among the selected lines (the whole
+	// document's, without filters), when it isn't the first
+	Offset int `json:"offset,omitempty"`
+	// Pass as cursor to get the next page of lines; empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Lines the region, match, and block filters selected, and the index
+	// in the whole document of each of lines, when a filter is set
+	MatchedLines int   `json:"matched_lines,omitempty"`
+	LineIndexes  []int `json:"line_indexes,omitempty"`
 }
 
 // LoadTextractTool returns the MCP tool definition for load_textract.
 func LoadTextractTool() *mcp.Tool {
 	return &mcp.Tool{
 		Name:        "load_textract",
-		Description: "Load and parse an AWS Textract JSON output file. Returns extracted text lines with confidence scores and positions, sorted by vertical position (top to bottom).",
+		Description: "Load and parse an AWS Textract JSON output file. Returns extracted text lines with confidence scores, positions, and handwriting flags, sorted by vertical position (top to bottom). Each line is labeled with the block it is in (header, items, totals, payment, or footer), and blocks lists the runs of lines in each. Files from AnalyzeDocument with the TABLES feature also get the tables, with the item, quantity, and price column of each. mean_confidence and min_confidence summarize how well the image read, and low_confidence_lines lists the lines below low_confidence (default 80), so a caller can ask for a better photo before spending a model call; min_confidence drops lines below it. Set words to also get every word with its confidence and position, and row_tolerance to rebuild the lines from the words when Textract merges or splits item and price columns on a skewed receipt. When the total or purchase date is ambiguous, the user (via elicitation) or the client's model (via sampling) is asked to resolve it, and the questions and answers are returned in ambiguities. Long documents are returned a page of lines at a time: when next_cursor is set, call again with it as cursor for the lines after them. Later pages carry only their own lines, words, and low-confidence lines, with offset giving the position of the first; line indexes always count from the start of the document. To save tokens, ask for only part of the document: block (e.g. totals or items), region (a box on the page, as fractions from the top left), and match (a case-insensitive regular expression) select lines, line_indexes gives each selected line's index in the document, and offset and limit take a slice of the selection.",
 	}
 }
 
 // HandleLoadTextract processes the load_textract tool call.
-func HandleLoadTextract(ctx context.Context, req *mcp.CallToolRequest, input LoadTextractInput) (*mcp.CallToolResult, LoadTextractOutput, error) {
+func (l *Loader) HandleLoadTextract(ctx context.Context, req *mcp.CallToolRequest, input LoadTextractInput) (*mcp.CallToolResult, LoadTextractOutput, error) {
 	if input.Path == "" {
 		return nil, LoadTextractOutput{}, fmt.Errorf("path is required")
 	}
 
 	// Read the file
-	data, err := os.ReadFile(input.Path)
+	data, err := l.cipher.ReadFile(input.Path)
 	if err != nil {
 		return nil, LoadTextractOutput{}, fmt.Errorf("failed to read Textract file: %w", err)
 	}
 
-	// Parse the Textract JSON
+	if input.RowTolerance < 0 {
+		return nil, LoadTextractOutput{}, fmt.Errorf("row_tolerance must not be negative")
+	}
+	if input.MinConfidence < 0 || input.MinConfidence > 100 || input.LowConfidence < 0 || input.LowConfidence > 100 {
+		return nil, LoadTextractOutput{}, fmt.Errorf("min_confidence and low_confidence must be between 0 and 100")
+	}
+
+	filter, err := newLineFilter(input)
+	if err != nil {
+		return nil, LoadTextractOutput{}, err
+	}
+	if input.Offset < 0 || input.Limit < 0 {
+		return nil, LoadTextractOutput{}, fmt.Errorf("offset and limit must not be negative")
+	}
+	if input.Cursor != "" && input.Offset != 0 {
+		return nil, LoadTextractOutput{}, fmt.Errorf("give cursor or offset, not both")
+	}
+	offset := input.Offset
+	if input.Cursor != "" {
+		if offset, err = decodeLinesCursor(input.Cursor, input); err != nil {
+			return nil, LoadTextractOutput{}, err
+		}
+	}
+	limit := l.limits.MaxLines
+	if input.Limit > 0 && (limit == 0 || input.Limit < limit) {
+		limit = input.Limit
+	}
+
+	output, err := ParseTextractWith(data, TextractOptions{
+		Words:         input.Words,
+		RowTolerance:  input.RowTolerance,
+		MinConfidence: input.MinConfidence,
+		LowConfidence: input.LowConfidence,
+	})
+	if err != nil {
+		return nil, LoadTextractOutput{}, err
+	}
+	output.FilePath = input.Path
+
+	// The client is asked about ambiguities once, with the first page
+	if input.Cursor == "" && input.Offset == 0 {
+		texts := make([]string, len(output.Lines))
+		for i, line := range output.Lines {
+			texts[i] = line.Text
+		}
+		if questions := receipt.FindAmbiguities(texts); len(questions) > 0 {
+			output.Ambiguities = clarify(ctx, req.Session, texts, questions)
+		}
+	}
+
+	end, selected, err := selectLines(&output, filter, offset, limit)
+	if err != nil {
+		return nil, LoadTextractOutput{}, err
+	}
+	if end < selected {
+		output.NextCursor = encodeLinesCursor(end, input)
+	}
+	return nil, output, nil
+}
+
+// ParseTextract simplifies raw Textract JSON into sorted text lines.
+func ParseTextract(data []byte) (LoadTextractOutput, error) {
+	return ParseTextractWith(data, TextractOptions{})
+}
+
+// ParseTextractWith simplifies raw Textract JSON into sorted text lines,
+// rebuilt from words and with the words included as opts asks.
+func ParseTextractWith(data []byte, opts TextractOptions) (LoadTextractOutput, error) {
 	var doc TextractDocument
 	if err := json.Unmarshal(data, &doc); err != nil {
-		return nil, LoadTextractOutput{}, fmt.Errorf("failed to parse Textract JSON: %w", err)
+		return LoadTextractOutput{}, fmt.Errorf("failed to parse Textract JSON: %w", err)
 	}
 
-	// Extract LINE blocks
-	lines := make([]TextractLine, 0)
+	// Index WORD blocks so lines can inherit their handwriting type
+	handwrittenWords := make(map[string]bool)
 	for _, block := range doc.Blocks {
-		if block.BlockType == "LINE" && block.Text != "" {
-			line := TextractLine{
-				Text:       block.Text,
-				Confidence: block.Confidence,
+		if block.BlockType == "WORD" {
+			handwrittenWords[block.ID] = block.TextType == "HANDWRITING"
+		}
+	}
+	words, wordIndex := textractWords(doc)
+
+	// Extract LINE blocks, or rebuild them from the words
+	var lines []wordLine
+	if opts.RowTolerance > 0 {
+		lines = rebuildLines(words, estimateSkew(doc), opts.RowTolerance)
+	} else {
+		for _, block := range doc.Blocks {
+			if block.BlockType == "LINE" && block.Text != "" {
+				line := wordLine{TextractLine: TextractLine{
+					Text:        block.Text,
+					Confidence:  block.Confidence,
+					Handwritten: isHandwrittenLine(block, handwrittenWords),
+				}}
+				if doc.DocumentMetadata.Pages > 1 {
+					line.Page = block.Page
+				}
+				if block.Geometry != nil && block.Geometry.BoundingBox != nil {
+					line.Top = block.Geometry.BoundingBox.Top
+					line.Left = block.Geometry.BoundingBox.Left
+					line.Width = block.Geometry.BoundingBox.Width
+					line.Height = block.Geometry.BoundingBox.Height
+				}
+				for _, rel := range block.Relationships {
+					if rel.Type != "CHILD" {
+						continue
+					}
+					for _, id := range rel.IDs {
+						if i, ok := wordIndex[id]; ok {
+							line.words = append(line.words, i)
+						}
+					}
+				}
+				lines = append(lines, line)
 			}
-			if block.Geometry != nil && block.Geometry.BoundingBox != nil {
-				line.Top = block.Geometry.BoundingBox.Top
-				line.Left = block.Geometry.BoundingBox.Left
+		}
+	}
+
+	// Summarize confidence over every line, then drop those below the minimum
+	meanConf, minConf := confidenceStats(lines)
+	filtered := 0
+	if opts.MinConfidence > 0 {
+		kept := lines[:0]
+		for _, line := range lines {
+			if line.Confidence >= opts.MinConfidence {
+				kept = append(kept, line)
 			}
-			lines = append(lines, line)
 		}
+		filtered = len(lines) - len(kept)
+		lines = kept
 	}
 
-	// Sort lines by vertical position (top to bottom), then by left position
-	sort.Slice(lines, func(i, j int) bool {
+	// Sort lines by page, then by vertical position (top to bottom), then by
+	// left position
+	sort.SliceStable(lines, func(i, j int) bool {
+		if lines[i].Page != lines[j].Page {
+			return lines[i].Page < lines[j].Page
+		}
 		if lines[i].Top != lines[j].Top {
 			return lines[i].Top < lines[j].Top
 		}
 		return lines[i].Left < lines[j].Left
 	})
 
+	// Group the lines into the blocks a receipt is printed in
+	layout := make([]receipt.LayoutLine, len(lines))
+	for i, line := range lines {
+		layout[i] = receipt.LayoutLine{Text: line.Text, Top: line.Top, Left: line.Left, Height: line.Height, Page: line.Page}
+	}
+	labels := receipt.SegmentLayout(layout)
+
+	lowConfidence := opts.LowConfidence
+	if lowConfidence == 0 {
+		lowConfidence = DefaultLowConfidence
+	}
+	simplified := make([]TextractLine, len(lines))
+	var lowLines []LowConfidenceLine
+	handwrittenLines := 0
+	for i, line := range lines {
+		simplified[i] = line.TextractLine
+		simplified[i].Block = labels[i]
+		if line.Handwritten {
+			handwrittenLines++
+		}
+		if line.Confidence < lowConfidence {
+			lowLines = append(lowLines, LowConfidenceLine{Line: i, Text: line.Text, Confidence: line.Confidence})
+		}
+		for _, w := range line.words {
+			words[w].Line = i
+		}
+	}
+
 	output := LoadTextractOutput{
-		PageCount:  doc.DocumentMetadata.Pages,
-		Lines:      lines,
-		TotalLines: len(lines),
-		FilePath:   input.Path,
+		PageCount:        doc.DocumentMetadata.Pages,
+		Lines:            simplified,
+		TotalLines:       len(simplified),
+		HandwrittenLines: handwrittenLines,
+		Handwritten:      len(simplified) > 0 && float64(handwrittenLines)/float64(len(simplified)) >= HandwrittenThreshold,
+		Blocks:           receipt.GroupBlocks(labels),
+		Tables:           textractTables(doc, words, wordIndex),
+
+		MeanConfidence:     meanConf,
+		MinConfidence:      minConf,
+		FilteredLines:      filtered,
+		LowConfidenceLines: lowLines,
+	}
+	if opts.Words {
+		output.Words = sortWords(words)
+		if opts.MinConfidence > 0 {
+			output.Words = slices.DeleteFunc(output.Words, func(w TextractWord) bool { return w.Confidence < opts.MinConfidence })
+		}
 	}
+	output.RowTolerance = opts.RowTolerance
 
-	return nil, output, nil
+	return output, nil
+}
+
+// confidenceStats returns the mean and lowest confidence of lines, or zeros
+// for none.
+func confidenceStats(lines []wordLine) (mean, lowest float64) {
+	if len(lines) == 0 {
+		return 0, 0
+	}
+	lowest = lines[0].Confidence
+	for _, line := range lines {
+		mean += line.Confidence
+		lowest = min(lowest, line.Confidence)
+	}
+	return mean / float64(len(lines)), lowest
+}
+
+// isHandwrittenLine reports whether most of a LINE block's child words are handwritten.
+func isHandwrittenLine(block TextractBlock, handwrittenWords map[string]bool) bool {
+	total, handwritten := 0, 0
+	for _, rel := range block.Relationships {
+		if rel.Type != "CHILD" {
+			continue
+		}
+		for _, id := range rel.IDs {
+			isHandwritten, ok := handwrittenWords[id]
+			if !ok {
+				continue
+			}
+			total++
+			if isHandwritten {
+				handwritten++
+			}
+		}
+	}
+	return total > 0 && handwritten*2 > total
 }
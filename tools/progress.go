@@ -0,0 +1,38 @@
+// Package tools provides MCP tool implementations for receipt processing.
+package tools
+
+import (
+	"context"
+	"log"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+
+	"myprice/internal/progress"
+)
+
+// withProgressNotifications returns a context whose progress reports are
+// sent to the client as progress notifications. Calls without a progress
+// token get ctx back unchanged, since the client isn't listening.
+func withProgressNotifications(ctx context.Context, req *mcp.CallToolRequest) context.Context {
+	if req == nil || req.Session == nil || req.Params == nil {
+		return ctx
+	}
+	token := req.Params.GetProgressToken()
+	if token == nil {
+		return ctx
+	}
+
+	var step float64
+	notifyCtx := ctx
+	return progress.With(ctx, func(message string) {
+		step++
+		err := req.Session.NotifyProgress(notifyCtx, &mcp.ProgressNotificationParams{
+			ProgressToken: token,
+			Progress:      step,
+			Message:       message,
+		})
+		if err != nil {
+			log.Printf("Warning: failed to send progress: %v", err)
+		}
+	})
+}
@@ -0,0 +1,357 @@
+// Package tools provides MCP tool implementations for receipt processing.
+package tools
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+
+	"myprice/internal/crypt"
+	"myprice/internal/memo"
+	"myprice/internal/pricing"
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+	"myprice/internal/units"
+)
+
+const (
+	// defaultQueryLimit and maxQueryLimit bound how many receipts are returned.
+	defaultQueryLimit = 50
+	maxQueryLimit     = 200
+
+	// The HTTP API's defaults for ANALYTICS_CACHE_TTL and
+	// ANALYTICS_CACHE_ENTRIES
+	defaultAnalyticsCacheTTL     = 10 * time.Minute
+	defaultAnalyticsCacheEntries = 256
+)
+
+// QueryReceiptsInput defines the filters for the query_receipts tool. All
+// filters are optional and combined with AND.
+type QueryReceiptsInput struct {
+	Vendor       string   `json:"vendor,omitempty" jsonschema:"Case-insensitive substring of the vendor or chain name"`
+	From         string   `json:"from,omitempty" jsonschema:"Earliest purchase date, YYYY-MM-DD"`
+	To           string   `json:"to,omitempty" jsonschema:"Latest purchase date, YYYY-MM-DD (inclusive)"`
+	Item         string   `json:"item,omitempty" jsonschema:"Case-insensitive substring of a line item name, or of the product name or brand looked up from its code; only receipts with a matching item are returned"`
+	MinTotal     *float64 `json:"min_total,omitempty" jsonschema:"Smallest receipt total"`
+	MaxTotal     *float64 `json:"max_total,omitempty" jsonschema:"Largest receipt total"`
+	DocumentType string   `json:"document_type,omitempty" jsonschema:"Either receipt or invoice"`
+	Tags         []string `json:"tags,omitempty" jsonschema:"Only receipts with every one of these user-defined tags, e.g. [\"reimbursable\"]"`
+	Limit        int      `json:"limit,omitempty" jsonschema:"Maximum receipts to return (default 50, max 200)"`
+}
+
+// QueryReceiptsOutput reports matching receipts and their totals.
+type QueryReceiptsOutput struct {
+	Matched    int              `json:"matched"`     // Receipts matching the filters
+	Returned   int              `json:"returned"`    // Receipts included below, newest first
+	TotalSpent float64          `json:"total_spent"` // Sum of matching receipts' totals
+	ItemSpent  float64          `json:"item_spent"`  // Sum of matching line items, when item is given
+	Receipts   []ReceiptSummary `json:"receipts"`
+}
+
+// ReceiptSummary is one stored receipt as returned by query_receipts.
+type ReceiptSummary struct {
+	ID       string        `json:"id"`
+	Vendor   string        `json:"vendor"`
+	Chain    string        `json:"chain,omitempty"`
+	Store    string        `json:"store,omitempty"` // Store number, street, or phone telling the chain's stores apart
+	City     string        `json:"city,omitempty"`
+	Date     string        `json:"date"`
+	Total    float64       `json:"total"`
+	Currency string        `json:"currency,omitempty"`
+	Refund   bool          `json:"refund,omitempty"`    // A return; its total is negative
+	RefundOf string        `json:"refund_of,omitempty"` // The purchase it returns items from, when known
+	Tags     []string      `json:"tags,omitempty"`
+	Notes    string        `json:"notes,omitempty"`
+	Items    []ItemSummary `json:"items,omitempty"` // Matching items only, when item is given
+}
+
+// ItemSummary is one line item.
+type ItemSummary struct {
+	Name            string  `json:"name"`
+	Code            string  `json:"code,omitempty"`    // UPC, store item number, or invoice SKU
+	Product         string  `json:"product,omitempty"` // Product name looked up from the code
+	Brand           string  `json:"brand,omitempty"`
+	Qty             float64 `json:"qty,omitempty"`
+	Price           float64 `json:"price"`
+	Size            string  `json:"size,omitempty"`             // Package size, e.g. "20 oz"
+	NormalizedPrice float64 `json:"normalized_price,omitempty"` // Price per NormalizedUnit
+	NormalizedUnit  string  `json:"normalized_unit,omitempty"`  // "100g" or "100ml"
+}
+
+// ReceiptQuerier answers query_receipts from the receipt store written by
+// the HTTP API.
+type ReceiptQuerier struct {
+	dir    string
+	cipher *crypt.Cipher
+
+	// Kept until the store's stamp changes, as the HTTP API keeps reports
+	records     *memo.Cache[[]*store.Record]
+	comparisons *memo.Cache[pricing.Comparison]
+}
+
+// NewReceiptQuerier creates a querier for the store in dir, or the
+// Postgres database STORE_BACKEND selects. c decrypts the store when
+// at-rest encryption is enabled, and may be nil. Receipts and price
+// comparisons are cached for ANALYTICS_CACHE_TTL, up to
+// ANALYTICS_CACHE_ENTRIES comparisons, as the HTTP API caches analytics.
+func NewReceiptQuerier(dir string, c *crypt.Cipher) *ReceiptQuerier {
+	ttl, entries := analyticsCacheFromEnv()
+	return &ReceiptQuerier{
+		dir:         dir,
+		cipher:      c,
+		records:     memo.New[[]*store.Record](ttl, 1),
+		comparisons: memo.New[pricing.Comparison](ttl, entries),
+	}
+}
+
+// analyticsCacheFromEnv reads ANALYTICS_CACHE_TTL and
+// ANALYTICS_CACHE_ENTRIES, keeping the defaults for values that don't
+// parse.
+func analyticsCacheFromEnv() (time.Duration, int) {
+	ttl, entries := defaultAnalyticsCacheTTL, defaultAnalyticsCacheEntries
+	if v := os.Getenv("ANALYTICS_CACHE_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			ttl = d
+		} else {
+			log.Printf("Warning: invalid ANALYTICS_CACHE_TTL=%q, using default %s", v, ttl)
+		}
+	}
+	if v := os.Getenv("ANALYTICS_CACHE_ENTRIES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			entries = n
+		} else {
+			log.Printf("Warning: invalid ANALYTICS_CACHE_ENTRIES=%q, using default %d", v, entries)
+		}
+	}
+	return ttl, entries
+}
+
+// QueryReceiptsTool returns the MCP tool definition for query_receipts.
+func QueryReceiptsTool() *mcp.Tool {
+	return &mcp.Tool{
+		Name:        "query_receipts",
+		Description: "Search stored receipts by vendor, purchase date range, line item, total, and the tags users put on them, such as reimbursable or warranty. Returns matching receipts with totals, plus the amount spent on matching items, e.g. to answer \"how much did I spend on coffee last month\".",
+	}
+}
+
+// Handle processes the query_receipts tool call.
+func (q *ReceiptQuerier) Handle(ctx context.Context, req *mcp.CallToolRequest, input QueryReceiptsInput) (*mcp.CallToolResult, QueryReceiptsOutput, error) {
+	from, err := parseQueryDate("from", input.From)
+	if err != nil {
+		return nil, QueryReceiptsOutput{}, err
+	}
+	to, err := parseQueryDate("to", input.To)
+	if err != nil {
+		return nil, QueryReceiptsOutput{}, err
+	}
+	if input.DocumentType != "" && input.DocumentType != string(receipt.DocumentTypeReceipt) && input.DocumentType != string(receipt.DocumentTypeInvoice) {
+		return nil, QueryReceiptsOutput{}, fmt.Errorf("document_type must be \"receipt\" or \"invoice\"")
+	}
+	tags, err := store.NormalizeTags(input.Tags)
+	if err != nil {
+		return nil, QueryReceiptsOutput{}, err
+	}
+	limit := input.Limit
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	}
+	limit = min(limit, maxQueryLimit)
+
+	records, err := q.latest()
+	if err != nil {
+		return nil, QueryReceiptsOutput{}, err
+	}
+
+	vendor := strings.ToLower(strings.TrimSpace(input.Vendor))
+	item := strings.ToLower(strings.TrimSpace(input.Item))
+
+	output := QueryReceiptsOutput{Receipts: make([]ReceiptSummary, 0)}
+	var matches []ReceiptSummary
+	for _, rec := range records {
+		if (input.DocumentType != "" && rec.DocumentType != input.DocumentType) || !rec.HasTags(tags...) {
+			continue
+		}
+
+		summary := summarizeRecord(rec)
+		if vendor != "" && !strings.Contains(strings.ToLower(summary.Vendor+" "+summary.Chain), vendor) {
+			continue
+		}
+		if (from != "" && summary.Date < from) || (to != "" && summary.Date > to) {
+			continue
+		}
+		if (input.MinTotal != nil && summary.Total < *input.MinTotal) || (input.MaxTotal != nil && summary.Total > *input.MaxTotal) {
+			continue
+		}
+
+		if item != "" {
+			for _, it := range recordItems(rec) {
+				if it.matches(item) {
+					summary.Items = append(summary.Items, it)
+					output.ItemSpent += it.Price
+				}
+			}
+			if len(summary.Items) == 0 {
+				continue
+			}
+		}
+
+		output.TotalSpent += summary.Total
+		matches = append(matches, summary)
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Date > matches[j].Date })
+	output.Matched = len(matches)
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	output.Receipts = append(output.Receipts, matches...)
+	output.Returned = len(output.Receipts)
+	output.TotalSpent = roundCents(output.TotalSpent)
+	output.ItemSpent = roundCents(output.ItemSpent)
+
+	return nil, output, nil
+}
+
+// latest reads the store and returns the latest version of each receipt.
+// The records are kept until the store's stamp changes, so receipts the
+// HTTP API saved since they were read are included. They are shared
+// between calls and must not be modified.
+func (q *ReceiptQuerier) latest() ([]*store.Record, error) {
+	stamp, err := q.stamp()
+	if err != nil {
+		return nil, err
+	}
+	return q.records.Get("", stamp, func() ([]*store.Record, error) {
+		s, err := store.Open(q.dir, q.cipher)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open receipt store: %w", err)
+		}
+		records, err := s.List()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list receipts: %w", err)
+		}
+		latest := records[:0]
+		for _, rec := range records {
+			if rec.SupersededBy == "" {
+				latest = append(latest, rec)
+			}
+		}
+		return latest, nil
+	})
+}
+
+// stamp returns the store's stamp, which what is cached from it is kept
+// under. It is read before the records, so a write in between leaves a
+// result cached under a stamp that is already stale.
+func (q *ReceiptQuerier) stamp() (string, error) {
+	stamp, err := store.OpenStamp(q.dir, q.cipher)
+	if err != nil {
+		return "", fmt.Errorf("failed to open receipt store: %w", err)
+	}
+	return stamp, nil
+}
+
+// parseQueryDate validates a YYYY-MM-DD filter.
+func parseQueryDate(name, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if _, err := time.Parse("2006-01-02", value); err != nil {
+		return "", fmt.Errorf("%s must be a date in YYYY-MM-DD format", name)
+	}
+	return value, nil
+}
+
+// summarizeRecord pulls the vendor, date, and total out of a stored record.
+// The date is the normalized purchase date, or the analysis date if the
+// receipt had none.
+func summarizeRecord(rec *store.Record) ReceiptSummary {
+	summary := ReceiptSummary{ID: rec.ID, Date: rec.CreatedAt.Format("2006-01-02")}
+	if rec.PurchaseTime != nil && rec.PurchaseTime.LocalDate != "" {
+		summary.Date = rec.PurchaseTime.LocalDate
+	}
+	if rec.Location != nil {
+		summary.Chain, summary.City = rec.Location.Chain, rec.Location.City
+		summary.Store = rec.Location.Store()
+	}
+
+	if rec.DocumentType == string(receipt.DocumentTypeInvoice) {
+		party, _ := rec.Data["vendor"].(map[string]any)
+		summary.Vendor, _ = party["name"].(string)
+		summary.Currency, _ = rec.Data["currency"].(string)
+	} else {
+		summary.Vendor, _ = rec.Data["vendor"].(string)
+		if summary.Vendor == "" {
+			summary.Vendor, _ = rec.Data["vendor_full"].(string)
+		}
+	}
+	summary.Total, _ = rec.Data["total"].(float64)
+	summary.Refund, _ = rec.Data["refund"].(bool)
+	summary.RefundOf = rec.RefundOf
+	summary.Tags, summary.Notes = rec.Tags, rec.Notes
+	return summary
+}
+
+// recordItems returns a record's line items. Invoice items use their
+// description and line amount. Records analyzed before sizes were stored
+// have them read from the item name or looked-up product.
+func recordItems(rec *store.Record) []ItemSummary {
+	raw, _ := rec.Data["items"].([]any)
+	items := make([]ItemSummary, 0, len(raw))
+	for _, r := range raw {
+		m, ok := r.(map[string]any)
+		if !ok {
+			continue
+		}
+		var it ItemSummary
+		it.Qty, _ = m["qty"].(float64)
+		if rec.DocumentType == string(receipt.DocumentTypeInvoice) {
+			it.Name, _ = m["description"].(string)
+			it.Code, _ = m["sku"].(string)
+			it.Price, _ = m["amount"].(float64)
+		} else {
+			it.Name, _ = m["name"].(string)
+			it.Code, _ = m["code"].(string)
+			it.Price, _ = m["price"].(float64)
+		}
+		if p, ok := m["product"].(map[string]any); ok {
+			it.Product, _ = p["name"].(string)
+			it.Brand, _ = p["brand"].(string)
+		}
+		it.Size, _ = m["size"].(string)
+		it.NormalizedPrice, _ = m["normalized_price"].(float64)
+		it.NormalizedUnit, _ = m["normalized_unit"].(string)
+		if it.NormalizedUnit == "" && it.Price > 0 {
+			size, ok := units.ParseSize(it.Name)
+			if p, isProduct := m["product"].(map[string]any); !ok && isProduct {
+				listed, _ := p["size"].(string)
+				size, ok = units.ParseSize(listed)
+			}
+			if ok {
+				it.Size = size.String()
+				it.NormalizedPrice, it.NormalizedUnit = units.PricePer100(it.Price, it.Qty, size)
+			}
+		}
+		items = append(items, it)
+	}
+	return items
+}
+
+// matches reports whether the item's printed name, looked-up product name,
+// or brand contains query, which is lowercase.
+func (it ItemSummary) matches(query string) bool {
+	return strings.Contains(strings.ToLower(it.Name+"\n"+it.Product+"\n"+it.Brand), query)
+}
+
+// roundCents rounds a sum of prices to whole cents.
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,188 @@
+// Package tools provides MCP tool implementations for receipt processing.
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+
+	"myprice/internal/crypt"
+	"myprice/internal/receipt"
+	"myprice/internal/store"
+)
+
+// Where read_output found the data.
+const (
+	OutputSourceFile  = "file"
+	OutputSourceStore = "store"
+)
+
+// ReadOutputInput defines the input parameters for the read_output tool.
+// Exactly one of Path and ReceiptID is given.
+type ReadOutputInput struct {
+	Path         string `json:"path,omitempty" jsonschema:"JSON file written by write_output, or a JSON Lines file written in append mode"`
+	ReceiptID    string `json:"receipt_id,omitempty" jsonschema:"ID of a stored receipt, as returned by analyze_image or query_receipts"`
+	Line         int    `json:"line,omitempty" jsonschema:"Line of a JSON Lines file to read, 1-based (default: the last complete record)"`
+	DocumentType string `json:"document_type,omitempty" jsonschema:"auto (default), receipt, or invoice"`
+}
+
+// ReadOutputOutput is a previously written result checked against the
+// receipt or invoice schema.
+type ReadOutputOutput struct {
+	Source        string         `json:"source"` // "file" or "store"
+	FilePath      string         `json:"file_path,omitempty"`
+	Line          int            `json:"line,omitempty"` // Line read from a JSON Lines file
+	ReceiptID     string         `json:"receipt_id,omitempty"`
+	SupersededBy  string         `json:"superseded_by,omitempty"` // Newer version of a stored receipt
+	DocumentType  string         `json:"document_type"`
+	Data          map[string]any `json:"data"` // As the schema reads it
+	Valid         bool           `json:"valid"`
+	Issues        []string       `json:"issues,omitempty"`         // Schema and business rule problems
+	DroppedFields []string       `json:"dropped_fields,omitempty"` // Top-level fields the schema doesn't have
+}
+
+// ValidatedOutput is parsed output as the receipt or invoice schema reads it.
+type ValidatedOutput struct {
+	DocumentType string
+	Data         map[string]any
+	Issues       []string
+}
+
+// Validator checks parsed output against the schemas the pipeline produces.
+type Validator interface {
+	// ValidateOutput decodes data as documentType, detecting it for "auto"
+	// or "", and applies the pipeline's checks. It fails when data doesn't
+	// fit the schema's types at all.
+	ValidateOutput(data map[string]any, documentType string) (*ValidatedOutput, error)
+}
+
+// OutputReader answers read_output from output files and the receipt store
+// written by the HTTP API.
+type OutputReader struct {
+	dir       string
+	cipher    *crypt.Cipher
+	validator Validator
+}
+
+// NewOutputReader creates a reader for files and the store in dir. c
+// decrypts encrypted files, and may be nil.
+func NewOutputReader(dir string, c *crypt.Cipher, v Validator) *OutputReader {
+	return &OutputReader{dir: dir, cipher: c, validator: v}
+}
+
+// ReadOutputTool returns the MCP tool definition for read_output.
+func ReadOutputTool() *mcp.Tool {
+	return &mcp.Tool{
+		Name:         "read_output",
+		Description:  "Read a receipt or invoice written earlier, from a write_output file or a stored receipt ID, and check it against the output schema. Use this to resume from prior results instead of analyzing the image again.",
+		OutputSchema: outputSchemaWithData[ReadOutputOutput](),
+	}
+}
+
+// HandleReadOutput processes the read_output tool call.
+func (r *OutputReader) HandleReadOutput(ctx context.Context, req *mcp.CallToolRequest, input ReadOutputInput) (*mcp.CallToolResult, ReadOutputOutput, error) {
+	if (input.Path == "") == (input.ReceiptID == "") {
+		return nil, ReadOutputOutput{}, fmt.Errorf("give exactly one of path and receipt_id")
+	}
+	switch input.DocumentType {
+	case "", string(receipt.DocumentTypeAuto), string(receipt.DocumentTypeReceipt), string(receipt.DocumentTypeInvoice):
+	default:
+		return nil, ReadOutputOutput{}, fmt.Errorf("document_type must be \"auto\", \"receipt\", or \"invoice\"")
+	}
+	if input.Line < 0 {
+		return nil, ReadOutputOutput{}, fmt.Errorf("line must be positive")
+	}
+
+	output := ReadOutputOutput{}
+	var data map[string]any
+	docType := input.DocumentType
+	if input.Path != "" {
+		var err error
+		if data, output.Line, err = r.readFile(input.Path, input.Line); err != nil {
+			return nil, ReadOutputOutput{}, err
+		}
+		output.Source, output.FilePath = OutputSourceFile, input.Path
+	} else {
+		s, err := store.Open(r.dir, r.cipher)
+		if err != nil {
+			return nil, ReadOutputOutput{}, fmt.Errorf("failed to open receipt store: %w", err)
+		}
+		rec, err := s.Get(input.ReceiptID)
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, ReadOutputOutput{}, fmt.Errorf("receipt %s not found", input.ReceiptID)
+		}
+		if err != nil {
+			return nil, ReadOutputOutput{}, err
+		}
+		data = rec.Data
+		if docType == "" || docType == string(receipt.DocumentTypeAuto) {
+			docType = rec.DocumentType
+		}
+		output.Source, output.ReceiptID, output.SupersededBy = OutputSourceStore, rec.ID, rec.SupersededBy
+	}
+
+	validated, err := r.validator.ValidateOutput(data, docType)
+	if err != nil {
+		return nil, ReadOutputOutput{}, err
+	}
+	output.DocumentType = validated.DocumentType
+	output.Data = validated.Data
+	output.Issues = validated.Issues
+	output.Valid = len(validated.Issues) == 0
+	for field := range data {
+		if _, ok := validated.Data[field]; !ok {
+			output.DroppedFields = append(output.DroppedFields, field)
+		}
+	}
+	sort.Strings(output.DroppedFields)
+
+	return nil, output, nil
+}
+
+// readFile reads the JSON object in path. In a JSON Lines file it reads the
+// given line, or the last complete record when line is 0, and reports the
+// line read.
+func (r *OutputReader) readFile(path string, line int) (map[string]any, int, error) {
+	content, err := r.cipher.ReadFile(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	var data map[string]any
+	if json.Valid(content) {
+		if line > 1 {
+			return nil, 0, fmt.Errorf("%s holds one JSON document, not JSON Lines", path)
+		}
+		if err := json.Unmarshal(content, &data); err != nil || data == nil {
+			return nil, 0, fmt.Errorf("%s is not a JSON object", path)
+		}
+		return data, 0, nil
+	}
+
+	// JSON Lines: a last line cut short by a crash is skipped
+	lines := bytes.Split(content, []byte("\n"))
+	if line > 0 {
+		if line > len(lines) || !json.Valid(lines[line-1]) || len(bytes.TrimSpace(lines[line-1])) == 0 {
+			return nil, 0, fmt.Errorf("line %d of %s is not a JSON record", line, path)
+		}
+	} else {
+		for n := len(lines); n > 0; n-- {
+			if len(bytes.TrimSpace(lines[n-1])) > 0 && json.Valid(lines[n-1]) {
+				line = n
+				break
+			}
+		}
+		if line == 0 {
+			return nil, 0, fmt.Errorf("%s holds no complete JSON record", path)
+		}
+	}
+	if err := json.Unmarshal(lines[line-1], &data); err != nil || data == nil {
+		return nil, 0, fmt.Errorf("line %d of %s is not a JSON object", line, path)
+	}
+	return data, line, nil
+}
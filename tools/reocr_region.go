@@ -0,0 +1,63 @@
+// Package tools provides MCP tool implementations for receipt processing.
+package tools
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// ReOCRRegionInput defines the input parameters for the reocr_region tool.
+type ReOCRRegionInput struct {
+	ReceiptID string     `json:"receipt_id" jsonschema:"ID of the stored receipt whose image to read again"`
+	Region    LineRegion `json:"region" jsonschema:"Box around the unreadable part, in fractions of the page from its top left corner, as load_textract's lines give their positions"`
+	Field     string     `json:"field,omitempty" jsonschema:"Field to patch with what the region shows, e.g. total, date, or items[2].price; omit to only read the region"`
+	Scale     int        `json:"scale,omitempty" jsonschema:"Times to enlarge the crop before OCR, 1 to 4 (default 3)"`
+	DryRun    bool       `json:"dry_run,omitempty" jsonschema:"Read the field's new value without storing it"`
+}
+
+// ReOCRRegionOutput is what OCR read in a region of a receipt's image, and
+// the field patched with it.
+type ReOCRRegionOutput struct {
+	ReceiptID      string         `json:"receipt_id"`       // The version whose image was read
+	NewID          string         `json:"new_id,omitempty"` // The version storing the patched field
+	ETag           string         `json:"etag,omitempty"`   // Of the version now current, for the next edit
+	Field          string         `json:"field,omitempty"`
+	Previous       any            `json:"previous,omitempty"` // The field's value before
+	Value          any            `json:"value,omitempty"`    // Read from the region
+	Text           string         `json:"text"`               // The region's printed rows, one to a line
+	Lines          []TextractLine `json:"lines"`              // Positioned on the page, not the crop
+	MeanConfidence float64        `json:"mean_confidence"`
+	Scale          int            `json:"scale"`
+	Width          int            `json:"width"` // Of the enlarged crop OCR read, in pixels
+	Height         int            `json:"height"`
+	Source         string         `json:"source"` // "aws_textract", or "cached" for a region read before
+	DryRun         bool           `json:"dry_run,omitempty"`
+}
+
+// ReOCRRegionTool returns the MCP tool definition for reocr_region.
+func ReOCRRegionTool() *mcp.Tool {
+	return &mcp.Tool{
+		Name:        "reocr_region",
+		Description: "Read one region of a stored receipt's image again, such as a total OCR misread or missed, without analyzing the whole receipt again. The region is cropped from the original image, enlarged, and read by OCR on its own. With a field, its value is read from the region's text (an amount from the row labeled with the field's name, or the only row with one; a date; a time; or the text) and stored as the receipt's next version, as a correction by hand is.",
+	}
+}
+
+// HandleReOCR processes the reocr_region tool call.
+func (a *ImageAnalysis) HandleReOCR(ctx context.Context, req *mcp.CallToolRequest, input ReOCRRegionInput) (*mcp.CallToolResult, ReOCRRegionOutput, error) {
+	input.ReceiptID = strings.TrimSpace(input.ReceiptID)
+	if input.ReceiptID == "" {
+		return nil, ReOCRRegionOutput{}, fmt.Errorf("receipt_id is required")
+	}
+	if err := input.Region.Validate(); err != nil {
+		return nil, ReOCRRegionOutput{}, err
+	}
+
+	output, err := a.analyzer.ReOCRRegion(withProgressNotifications(ctx, req), input)
+	if err != nil {
+		return nil, ReOCRRegionOutput{}, err
+	}
+	return nil, *output, nil
+}
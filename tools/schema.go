@@ -0,0 +1,41 @@
+// Package tools provides MCP tool implementations for receipt processing.
+package tools
+
+import (
+	"log"
+
+	"github.com/google/jsonschema-go/jsonschema"
+
+	"myprice/internal/receipt"
+)
+
+// outputSchemaWithData infers the output schema of T, like AddTool does,
+// and describes its data property with the published receipt and invoice
+// schemas, so clients can validate results and generate types for them. It
+// returns nil, which lets AddTool infer a generic schema, if generation
+// fails.
+func outputSchemaWithData[T any]() any {
+	s, err := jsonschema.For[T](nil)
+	if err != nil {
+		log.Printf("Warning: failed to generate output schema: %v", err)
+		return nil
+	}
+
+	// Data is null when nothing could be parsed
+	anyOf := []*jsonschema.Schema{{Type: "null"}}
+	for _, docType := range []receipt.DocumentType{receipt.DocumentTypeReceipt, receipt.DocumentTypeInvoice} {
+		docSchema, err := receipt.Schema(docType)
+		if err != nil {
+			log.Printf("Warning: failed to generate %s schema: %v", docType, err)
+			return nil
+		}
+		docSchema = docSchema.CloneSchemas()
+		docSchema.Schema = "" // Only the root may declare the dialect
+		anyOf = append(anyOf, docSchema)
+	}
+	s.Properties["data"] = &jsonschema.Schema{
+		Description: "The parsed receipt or invoice",
+		AnyOf:       anyOf,
+	}
+	return s
+}
@@ -0,0 +1,186 @@
+package tools
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+
+	"myprice/internal/receipt"
+)
+
+// LineRegion is a box on the page, as fractions of its width and height
+// from the top left corner. A zero Bottom or Right reaches the page's edge.
+type LineRegion struct {
+	Top    float64 `json:"top" doc:"Top edge, 0-1 from the top of the page"`
+	Left   float64 `json:"left" doc:"Left edge, 0-1 from the left of the page"`
+	Bottom float64 `json:"bottom,omitempty" doc:"Bottom edge; 0 or 1 for the bottom of the page"`
+	Right  float64 `json:"right,omitempty" doc:"Right edge; 0 or 1 for the right of the page"`
+}
+
+// Edges returns the region's edges, with zero Bottom and Right at the page's.
+func (r LineRegion) Edges() (top, left, bottom, right float64) {
+	bottom, right = r.Bottom, r.Right
+	if bottom == 0 {
+		bottom = 1
+	}
+	if right == 0 {
+		right = 1
+	}
+	return r.Top, r.Left, bottom, right
+}
+
+// Validate checks that the region's edges are on the page and enclose some
+// of it.
+func (r LineRegion) Validate() error {
+	top, left, bottom, right := r.Edges()
+	if min(top, left, bottom, right) < 0 || max(top, left, bottom, right) > 1 || top >= bottom || left >= right {
+		return fmt.Errorf("region must have edges between 0 and 1, with top above bottom and left of right")
+	}
+	return nil
+}
+
+// contains reports whether line is in the region: its vertical middle and
+// its left edge are. Only the left edge counts, so a price at the right of
+// the page is in a region covering the right half, and its item name isn't.
+func (r LineRegion) contains(line TextractLine) bool {
+	top, left, bottom, right := r.Edges()
+	middle := line.Top + line.Height/2
+	return middle >= top && middle <= bottom && line.Left >= left && line.Left <= right
+}
+
+// lineBlocks are the blocks lines can be selected by.
+var lineBlocks = []receipt.BlockLabel{receipt.BlockHeader, receipt.BlockItems, receipt.BlockTotals, receipt.BlockPayment, receipt.BlockFooter}
+
+// lineFilter selects the lines load_textract returns.
+type lineFilter struct {
+	region *LineRegion
+	match  *regexp.Regexp
+	block  receipt.BlockLabel
+}
+
+// newLineFilter checks and compiles input's region, match, and block.
+func newLineFilter(input LoadTextractInput) (lineFilter, error) {
+	f := lineFilter{region: input.Region, block: input.Block}
+	if r := input.Region; r != nil {
+		if err := r.Validate(); err != nil {
+			return lineFilter{}, err
+		}
+	}
+	if input.Match != "" {
+		re, err := regexp.Compile("(?i)" + input.Match)
+		if err != nil {
+			return lineFilter{}, fmt.Errorf("invalid match: %w", err)
+		}
+		f.match = re
+	}
+	if f.block != "" && !slices.Contains(lineBlocks, f.block) {
+		return lineFilter{}, fmt.Errorf("block must be header, items, totals, payment, or footer")
+	}
+	return f, nil
+}
+
+// active reports whether the filter leaves out any lines.
+func (f lineFilter) active() bool {
+	return f.region != nil || f.match != nil || f.block != ""
+}
+
+// keep reports whether the filter selects line.
+func (f lineFilter) keep(line TextractLine) bool {
+	return (f.region == nil || f.region.contains(line)) &&
+		(f.match == nil || f.match.MatchString(line.Text)) &&
+		(f.block == "" || line.Block == f.block)
+}
+
+// selectLines cuts output down to the lines f selects, and of those the
+// page of at most limit starting at offset, with the words and
+// low-confidence lines of the page's lines. It returns the position after
+// the page's last line and how many lines f selected. Tables and words in
+// no line come only with the first page of the whole document. Blocks are
+// kept whole, since they are short and index the whole document. A limit
+// of 0 keeps every selected line.
+func selectLines(output *LoadTextractOutput, f lineFilter, offset, limit int) (end, selected int, err error) {
+	var indexes []int
+	for i, line := range output.Lines {
+		if f.keep(line) {
+			indexes = append(indexes, i)
+		}
+	}
+	if offset > len(indexes) {
+		return 0, 0, fmt.Errorf("offset %d is past the %d selected lines", offset, len(indexes))
+	}
+	end = len(indexes)
+	if limit > 0 {
+		end = min(end, offset+limit)
+	}
+	if !f.active() && offset == 0 && end == len(indexes) {
+		return end, len(indexes), nil
+	}
+
+	page := indexes[offset:end]
+	inPage := make(map[int]bool, len(page))
+	lines := make([]TextractLine, len(page))
+	for j, i := range page {
+		lines[j] = output.Lines[i]
+		inPage[i] = true
+	}
+	first := offset == 0 && !f.active()
+
+	output.Lines = lines
+	output.Offset = offset
+	output.Words = slices.DeleteFunc(output.Words, func(w TextractWord) bool { return !inPage[w.Line] && !(w.Line < 0 && first) })
+	output.LowConfidenceLines = slices.DeleteFunc(output.LowConfidenceLines, func(l LowConfidenceLine) bool { return !inPage[l.Line] })
+	if !first {
+		output.Tables = nil
+	}
+	if f.active() {
+		output.MatchedLines = len(indexes)
+		output.LineIndexes = slices.Clone(page)
+	}
+	return end, len(indexes), nil
+}
+
+// linesCursor is what a load_textract continuation token holds: where the
+// next page starts among the selected lines, and a digest of the inputs it
+// was issued for, so a cursor can't be used with different options that
+// select or number lines differently.
+type linesCursor struct {
+	Offset int    `json:"o"`
+	Inputs string `json:"i"`
+}
+
+// linesCursorInputs digests the inputs that decide which lines there are.
+func linesCursorInputs(input LoadTextractInput) string {
+	var region LineRegion
+	if input.Region != nil {
+		region = *input.Region
+	}
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s\x00%t\x00%g\x00%g\x00%g\x00%v\x00%s\x00%s",
+		input.Path, input.Words, input.RowTolerance, input.MinConfidence, input.LowConfidence, region, input.Match, input.Block))
+	return hex.EncodeToString(sum[:8])
+}
+
+// encodeLinesCursor returns the cursor for the page starting at offset.
+func encodeLinesCursor(offset int, input LoadTextractInput) string {
+	data, _ := json.Marshal(linesCursor{Offset: offset, Inputs: linesCursorInputs(input)})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeLinesCursor returns the offset a cursor resumes at.
+func decodeLinesCursor(cursor string, input LoadTextractInput) (int, error) {
+	var c linesCursor
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil || c.Offset < 0 {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	if c.Inputs != linesCursorInputs(input) {
+		return 0, fmt.Errorf("cursor was issued for different inputs; repeat the call's other inputs with it")
+	}
+	return c.Offset, nil
+}
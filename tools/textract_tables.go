@@ -0,0 +1,324 @@
+// Package tools provides MCP tool implementations for receipt processing.
+package tools
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"myprice/internal/receipt"
+)
+
+// TextractTable is one table found by Textract's AnalyzeDocument TABLES
+// feature, with the columns holding each item's name, quantity, and price.
+type TextractTable struct {
+	Rows       [][]string   `json:"rows"`
+	HeaderRows int          `json:"header_rows,omitempty"` // Leading rows of column headings
+	Columns    TableColumns `json:"columns"`
+	Confidence float64      `json:"confidence"`
+	Top        float64      `json:"top"`
+	Left       float64      `json:"left"`
+}
+
+// TableColumns are the indexes of a table's item, item number, quantity,
+// and price columns, or -1 for one that wasn't found.
+type TableColumns struct {
+	Item  int `json:"item"`
+	Code  int `json:"code"`
+	Qty   int `json:"qty"`
+	Price int `json:"price"`
+}
+
+// minColumnShare is the fraction of a column's filled cells that must hold
+// prices (or quantities) for it to be taken as the price (or quantity)
+// column when the table has no headings.
+const minColumnShare = 0.5
+
+var (
+	// Column headings. An item's price is what it cost in total, so an
+	// extended amount beats a unit price. Item numbers are headed like
+	// "Item #", "SKU", or "Part No".
+	descriptionHeading = regexp.MustCompile(`(?i)^(description|desc|product|article|name)\b`)
+	itemHeading        = regexp.MustCompile(`(?i)^(item|sku|part)\b`)
+	qtyHeading         = regexp.MustCompile(`(?i)^(qty|quantity|units?|count|pcs|ordered|shipped)\b`)
+	amountHeading      = regexp.MustCompile(`(?i)^(amount|amt|ext|extended|total|line total)\b`)
+	unitHeading        = regexp.MustCompile(`(?i)^(price|each|unit price|rate)\b`)
+
+	// Rows in an item table that aren't items
+	tableSummaryRow = regexp.MustCompile(`(?i)\b(sub\s*total|total|tax|balance|change|tender|discount total)\b`)
+)
+
+// textractTables returns the TABLE blocks of doc with their cells' text.
+// words indexes doc's WORD blocks by ID.
+func textractTables(doc TextractDocument, words []TextractWord, wordIndex map[string]int) []TextractTable {
+	blocks := make(map[string]TextractBlock)
+	for _, block := range doc.Blocks {
+		if block.BlockType == "CELL" {
+			blocks[block.ID] = block
+		}
+	}
+
+	var tables []TextractTable
+	for _, block := range doc.Blocks {
+		if block.BlockType != "TABLE" {
+			continue
+		}
+		var cells []TextractBlock
+		for _, id := range childIDs(block) {
+			if cell, ok := blocks[id]; ok && cell.RowIndex > 0 && cell.ColumnIndex > 0 {
+				cells = append(cells, cell)
+			}
+		}
+		if len(cells) == 0 {
+			continue
+		}
+
+		rowCount, colCount := 0, 0
+		for _, cell := range cells {
+			rowCount, colCount = max(rowCount, cell.RowIndex), max(colCount, cell.ColumnIndex)
+		}
+		table := TextractTable{Rows: make([][]string, rowCount), Confidence: block.Confidence}
+		for i := range table.Rows {
+			table.Rows[i] = make([]string, colCount)
+		}
+		header := make([]bool, rowCount)
+		for _, cell := range cells {
+			var texts []string
+			for _, id := range childIDs(cell) {
+				if i, ok := wordIndex[id]; ok {
+					texts = append(texts, words[i].Text)
+				}
+			}
+			// A spanning cell's text goes in its first row and column
+			table.Rows[cell.RowIndex-1][cell.ColumnIndex-1] = strings.Join(texts, " ")
+			for _, entity := range cell.EntityTypes {
+				if entity == "COLUMN_HEADER" {
+					header[cell.RowIndex-1] = true
+				}
+			}
+		}
+		if block.Geometry != nil && block.Geometry.BoundingBox != nil {
+			table.Top, table.Left = block.Geometry.BoundingBox.Top, block.Geometry.BoundingBox.Left
+		}
+		for table.HeaderRows < rowCount && header[table.HeaderRows] {
+			table.HeaderRows++
+		}
+		table.Columns = mapColumns(&table)
+		tables = append(tables, table)
+	}
+	return tables
+}
+
+// childIDs returns the IDs block names as its children.
+func childIDs(block TextractBlock) []string {
+	var ids []string
+	for _, rel := range block.Relationships {
+		if rel.Type == "CHILD" {
+			ids = append(ids, rel.IDs...)
+		}
+	}
+	return ids
+}
+
+// mapColumns finds the item, quantity, and price columns of table, from its
+// headings when it has them and otherwise from what the cells hold. A first
+// row of headings that Textract didn't mark is counted in HeaderRows.
+func mapColumns(table *TextractTable) TableColumns {
+	cols := TableColumns{Item: -1, Code: -1, Qty: -1, Price: -1}
+	if len(table.Rows) == 0 {
+		return cols
+	}
+
+	// Headings, from the rows Textract marked or else the first row.
+	// Descriptions beat item numbers, and extended amounts beat unit prices.
+	headingRows := table.HeaderRows
+	if headingRows == 0 {
+		headingRows = 1
+	}
+	itemNumber, unitPrice := -1, -1
+	for _, row := range table.Rows[:headingRows] {
+		for c, text := range row {
+			text = strings.TrimSpace(text)
+			// Unit prices before quantities, so "Unit Price" isn't taken for units
+			switch {
+			case descriptionHeading.MatchString(text):
+				if cols.Item < 0 {
+					cols.Item = c
+				}
+			case itemHeading.MatchString(text):
+				if itemNumber < 0 {
+					itemNumber = c
+				}
+			case amountHeading.MatchString(text):
+				if cols.Price < 0 {
+					cols.Price = c
+				}
+			case unitHeading.MatchString(text):
+				if unitPrice < 0 {
+					unitPrice = c
+				}
+			case qtyHeading.MatchString(text):
+				if cols.Qty < 0 {
+					cols.Qty = c
+				}
+			}
+		}
+	}
+	if cols.Item < 0 {
+		cols.Item = itemNumber
+	} else {
+		cols.Code = itemNumber
+	}
+	if cols.Price < 0 {
+		cols.Price = unitPrice
+	}
+	if cols.Item >= 0 || cols.Price >= 0 {
+		table.HeaderRows = headingRows
+	} else if table.HeaderRows == 0 {
+		headingRows = 0
+	}
+
+	// Fill in what the headings didn't name from the cells
+	body := table.Rows[headingRows:]
+	colCount := len(table.Rows[0])
+	if cols.Price < 0 {
+		for c := colCount - 1; c >= 0; c-- {
+			if c != cols.Item && c != cols.Code && c != cols.Qty && columnShare(body, c, isTablePrice) >= minColumnShare {
+				cols.Price = c
+				break
+			}
+		}
+	}
+	if cols.Qty < 0 {
+		for c := 0; c < colCount; c++ {
+			if c != cols.Item && c != cols.Code && c != cols.Price && columnShare(body, c, isTableQty) >= minColumnShare {
+				cols.Qty = c
+				break
+			}
+		}
+	}
+	if cols.Item < 0 {
+		most := 0
+		for c := 0; c < colCount; c++ {
+			if c == cols.Code || c == cols.Qty || c == cols.Price {
+				continue
+			}
+			if n := columnLetters(body, c); n > most {
+				cols.Item, most = c, n
+			}
+		}
+	}
+	return cols
+}
+
+// columnShare returns the fraction of the filled cells in column c of rows
+// that match.
+func columnShare(rows [][]string, c int, match func(string) bool) float64 {
+	filled, matched := 0, 0
+	for _, row := range rows {
+		if c >= len(row) || strings.TrimSpace(row[c]) == "" {
+			continue
+		}
+		filled++
+		if match(row[c]) {
+			matched++
+		}
+	}
+	if filled == 0 {
+		return 0
+	}
+	return float64(matched) / float64(filled)
+}
+
+// columnLetters counts the letters in column c of rows.
+func columnLetters(rows [][]string, c int) int {
+	n := 0
+	for _, row := range rows {
+		if c < len(row) {
+			for _, r := range row[c] {
+				if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') {
+					n++
+				}
+			}
+		}
+	}
+	return n
+}
+
+// tablePrice returns the amount in a price cell, ignoring the tax flags
+// ("T", "F", "N") receipts print after it, and whether it held one.
+func tablePrice(s string) (float64, bool) {
+	fields := strings.Fields(s)
+	for len(fields) > 1 && len(fields[len(fields)-1]) == 1 {
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) != 1 {
+		return 0, false
+	}
+	text := fields[0]
+	negative := strings.HasPrefix(text, "-") || strings.HasSuffix(text, "-")
+	text = strings.Trim(text, "-")
+	if !receipt.IsPrice(text) || !strings.Contains(text, ".") {
+		return 0, false
+	}
+	price := receipt.NormalizePrice(text)
+	if negative {
+		price = -price
+	}
+	return price, true
+}
+
+// isTablePrice reports whether s is a price cell.
+func isTablePrice(s string) bool {
+	_, ok := tablePrice(s)
+	return ok
+}
+
+// tableQty returns the quantity in a cell, and whether it held one.
+// Fractional quantities, such as weights, count as one item.
+func tableQty(s string) (int, bool) {
+	qty, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || qty <= 0 || qty >= 1000 {
+		return 0, false
+	}
+	if qty != math.Trunc(qty) {
+		return 1, true
+	}
+	return int(qty), true
+}
+
+// isTableQty reports whether s is a quantity cell.
+func isTableQty(s string) bool {
+	_, ok := tableQty(s)
+	return ok
+}
+
+// Items returns the rows of t below its headings that have an item name and
+// a price, skipping subtotal, tax, and total rows. It returns nil when t has
+// no item or price column.
+func (t TextractTable) Items() []receipt.Item {
+	if t.Columns.Item < 0 || t.Columns.Price < 0 {
+		return nil
+	}
+	var items []receipt.Item
+	for _, row := range t.Rows[t.HeaderRows:] {
+		name := receipt.NormalizeItemName(row[t.Columns.Item])
+		price, ok := tablePrice(row[t.Columns.Price])
+		if name == "" || !ok || tableSummaryRow.MatchString(name) {
+			continue
+		}
+		qty := 1
+		if t.Columns.Qty >= 0 {
+			if n, ok := tableQty(row[t.Columns.Qty]); ok {
+				qty = n
+			}
+		}
+		item := receipt.Item{Name: name, Qty: qty, Price: price}
+		if t.Columns.Code >= 0 {
+			item.Code = strings.TrimSpace(row[t.Columns.Code])
+		}
+		items = append(items, item)
+	}
+	return items
+}
@@ -0,0 +1,183 @@
+// Package tools provides MCP tool implementations for receipt processing.
+package tools
+
+import (
+	"sort"
+	"strings"
+)
+
+// TextractWord is one WORD block with its confidence and position.
+type TextractWord struct {
+	Text        string  `json:"text"`
+	Confidence  float64 `json:"confidence"`
+	Top         float64 `json:"top"`
+	Left        float64 `json:"left"`
+	Width       float64 `json:"width"`
+	Height      float64 `json:"height"`
+	Handwritten bool    `json:"handwritten,omitempty"`
+	Line        int     `json:"line"` // Index in lines of the line holding the word, or -1
+}
+
+// TextractOptions controls how Textract output is simplified.
+type TextractOptions struct {
+	// Words includes every WORD block in the output.
+	Words bool
+
+	// RowTolerance, when above 0, replaces Textract's lines with rows
+	// rebuilt from the words: a word joins a row when its vertical center,
+	// corrected for the page's skew, is within RowTolerance times the median
+	// word height of the row's.
+	RowTolerance float64
+
+	// MinConfidence, when above 0, drops lines and words with confidence
+	// below it.
+	MinConfidence float64
+
+	// LowConfidence is the confidence below which lines are listed in
+	// LowConfidenceLines; 0 means DefaultLowConfidence.
+	LowConfidence float64
+}
+
+// minSkewLineWidth is the narrowest LINE block, as a fraction of the page
+// width, whose slope counts toward the skew estimate.
+const minSkewLineWidth = 0.15
+
+// wordLine is a line with the indexes of its words.
+type wordLine struct {
+	TextractLine
+	words []int
+}
+
+// textractWords returns the WORD blocks of doc, in document order, and
+// their indexes by block ID.
+func textractWords(doc TextractDocument) ([]TextractWord, map[string]int) {
+	var words []TextractWord
+	index := make(map[string]int)
+	for _, block := range doc.Blocks {
+		if block.BlockType != "WORD" || block.Text == "" {
+			continue
+		}
+		w := TextractWord{
+			Text:        block.Text,
+			Confidence:  block.Confidence,
+			Handwritten: block.TextType == "HANDWRITING",
+			Line:        -1,
+		}
+		if block.Geometry != nil && block.Geometry.BoundingBox != nil {
+			box := block.Geometry.BoundingBox
+			w.Top, w.Left, w.Width, w.Height = box.Top, box.Left, box.Width, box.Height
+		}
+		index[block.ID] = len(words)
+		words = append(words, w)
+	}
+	return words, index
+}
+
+// estimateSkew returns how far the page's text rises or falls per unit of
+// width: the median slope of the top edges of Textract's wider lines.
+func estimateSkew(doc TextractDocument) float64 {
+	var slopes []float64
+	for _, block := range doc.Blocks {
+		if block.BlockType != "LINE" || block.Geometry == nil || len(block.Geometry.Polygon) < 2 {
+			continue
+		}
+		topLeft, topRight := block.Geometry.Polygon[0], block.Geometry.Polygon[1]
+		if dx := topRight.X - topLeft.X; dx >= minSkewLineWidth {
+			slopes = append(slopes, (topRight.Y-topLeft.Y)/dx)
+		}
+	}
+	return median(slopes)
+}
+
+// rebuildLines groups words into rows. skew is the page's slope, removed
+// from each word's position before comparing, so a price at the right edge
+// of a tilted receipt stays with its item on the left.
+func rebuildLines(words []TextractWord, skew, tolerance float64) []wordLine {
+	heights := make([]float64, 0, len(words))
+	for _, w := range words {
+		if w.Height > 0 {
+			heights = append(heights, w.Height)
+		}
+	}
+	maxDistance := tolerance * median(heights)
+
+	// Order the words by deskewed vertical center
+	center := make([]float64, len(words))
+	order := make([]int, len(words))
+	for i, w := range words {
+		center[i] = w.Top + w.Height/2 - skew*(w.Left+w.Width/2)
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return center[order[a]] < center[order[b]] })
+
+	var rows [][]int
+	var rowCenter float64
+	for _, i := range order {
+		if n := len(rows); n > 0 && words[i].Height > 0 && center[i]-rowCenter <= maxDistance {
+			rows[n-1] = append(rows[n-1], i)
+			rowCenter += (center[i] - rowCenter) / float64(len(rows[n-1]))
+			continue
+		}
+		rows = append(rows, []int{i})
+		rowCenter = center[i]
+	}
+
+	lines := make([]wordLine, 0, len(rows))
+	for _, row := range rows {
+		sort.SliceStable(row, func(a, b int) bool { return words[row[a]].Left < words[row[b]].Left })
+		texts := make([]string, len(row))
+		var confidence float64
+		handwritten := 0
+		top, left, bottom, right := words[row[0]].Top, words[row[0]].Left, 0.0, 0.0
+		for j, i := range row {
+			w := words[i]
+			texts[j] = w.Text
+			confidence += w.Confidence
+			if w.Handwritten {
+				handwritten++
+			}
+			top, left, bottom, right = min(top, w.Top), min(left, w.Left), max(bottom, w.Top+w.Height), max(right, w.Left+w.Width)
+		}
+		lines = append(lines, wordLine{
+			TextractLine: TextractLine{
+				Text:        strings.Join(texts, " "),
+				Confidence:  confidence / float64(len(row)),
+				Top:         top,
+				Left:        left,
+				Width:       max(right-left, 0),
+				Height:      max(bottom-top, 0),
+				Handwritten: handwritten*2 > len(row),
+			},
+			words: row,
+		})
+	}
+	return lines
+}
+
+// sortWords orders words by the line holding them, then left to right.
+// Words outside every line come last.
+func sortWords(words []TextractWord) []TextractWord {
+	sorted := append([]TextractWord(nil), words...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Line != b.Line {
+			return a.Line >= 0 && (b.Line < 0 || a.Line < b.Line)
+		}
+		return a.Left < b.Left
+	})
+	return sorted
+}
+
+// median returns the middle of values, or 0 for none.
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
@@ -2,19 +2,41 @@
 package tools
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 
 	"github.com/modelcontextprotocol/go-sdk/mcp"
+
+	"myprice/internal/fsutil"
+	"myprice/internal/pathtmpl"
+)
+
+// Write modes.
+const (
+	WriteModeReplace = "write"  // Write the file as a whole
+	WriteModeAppend  = "append" // Add one JSON Lines record to the file
 )
 
+// maxWriteAttempts bounds retries when a suffixed name is taken between
+// choosing it and creating it.
+const maxWriteAttempts = 10
+
 // WriteOutputInput defines the input parameters for write_output tool.
 type WriteOutputInput struct {
-	Path string `json:"path" doc:"Path where the JSON output should be written"`
-	Data any    `json:"data" doc:"The structured data to write as JSON"`
+	Path        string `json:"path" doc:"Path where the JSON output should be written; with template, the base directory (default: current directory)"`
+	Data        any    `json:"data" doc:"The structured data to write as JSON"`
+	Template    string `json:"template,omitempty" doc:"Name the file from the data, e.g. {vendor}/{date}_{total}.json. Placeholders: vendor, date, year, month, day, total, number, type, id"`
+	OnConflict  string `json:"on_conflict,omitempty" doc:"What to do when the file exists: overwrite (default), error, or suffix (add _2, _3, ...)"`
+	NoOverwrite bool   `json:"no_overwrite,omitempty" doc:"Never replace an existing file; without on_conflict, writing to an existing file fails"`
+	Mode        string `json:"mode,omitempty" doc:"write (default) replaces the file; append adds data as one line of a JSON Lines file"`
 }
 
 // WriteOutputOutput defines the result of a write operation.
@@ -22,19 +44,20 @@ type WriteOutputOutput struct {
 	Success      bool   `json:"success"`
 	FilePath     string `json:"file_path"`
 	BytesWritten int    `json:"bytes_written"`
+	Appended     bool   `json:"appended,omitempty"`
 }
 
 // WriteOutputTool returns the MCP tool definition for write_output.
 func WriteOutputTool() *mcp.Tool {
 	return &mcp.Tool{
 		Name:        "write_output",
-		Description: "Write structured JSON data to a file. Use this to save the final parsed receipt data or intermediate results.",
+		Description: "Write structured JSON data to a file. Use this to save the final parsed receipt data or intermediate results. With a template such as {vendor}/{date}_{total}.json, the file is named from the data under path. Files are replaced atomically, so readers never see partial JSON; mode append accumulates records in a JSON Lines file.",
 	}
 }
 
 // HandleWriteOutput processes the write_output tool call.
 func HandleWriteOutput(ctx context.Context, req *mcp.CallToolRequest, input WriteOutputInput) (*mcp.CallToolResult, WriteOutputOutput, error) {
-	if input.Path == "" {
+	if input.Path == "" && input.Template == "" {
 		return nil, WriteOutputOutput{}, fmt.Errorf("path is required")
 	}
 
@@ -42,30 +65,152 @@ func HandleWriteOutput(ctx context.Context, req *mcp.CallToolRequest, input Writ
 		return nil, WriteOutputOutput{}, fmt.Errorf("data is required")
 	}
 
+	mode := input.Mode
+	if mode == "" {
+		mode = WriteModeReplace
+	}
+	if mode != WriteModeReplace && mode != WriteModeAppend {
+		return nil, WriteOutputOutput{}, fmt.Errorf("unknown mode %q (want write or append)", input.Mode)
+	}
+	if mode == WriteModeAppend && (input.OnConflict != "" || input.NoOverwrite) {
+		return nil, WriteOutputOutput{}, fmt.Errorf("on_conflict and no_overwrite don't apply to append mode, which never replaces data")
+	}
+
+	defaultPolicy := pathtmpl.PolicyOverwrite
+	if input.NoOverwrite {
+		defaultPolicy = pathtmpl.PolicyError
+	}
+	policy, err := pathtmpl.ParsePolicy(input.OnConflict, defaultPolicy)
+	if err != nil {
+		return nil, WriteOutputOutput{}, err
+	}
+	if input.NoOverwrite && policy == pathtmpl.PolicyOverwrite {
+		return nil, WriteOutputOutput{}, fmt.Errorf("no_overwrite conflicts with on_conflict overwrite")
+	}
+
+	// Serialize the data with pretty printing, or as one line for JSON Lines
+	var jsonData []byte
+	if mode == WriteModeAppend {
+		jsonData, err = json.Marshal(input.Data)
+	} else {
+		jsonData, err = json.MarshalIndent(input.Data, "", "  ")
+	}
+	if err != nil {
+		return nil, WriteOutputOutput{}, fmt.Errorf("failed to serialize data: %w", err)
+	}
+
+	path := input.Path
+	if input.Template != "" {
+		if path, err = templatePath(input.Path, input.Template, jsonData); err != nil {
+			return nil, WriteOutputOutput{}, err
+		}
+	}
+
 	// Ensure the directory exists
-	dir := filepath.Dir(input.Path)
+	dir := filepath.Dir(path)
 	if dir != "" && dir != "." {
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			return nil, WriteOutputOutput{}, fmt.Errorf("failed to create directory: %w", err)
 		}
 	}
 
-	// Serialize the data with pretty printing
-	jsonData, err := json.MarshalIndent(input.Data, "", "  ")
+	// Write to file
+	output := WriteOutputOutput{Success: true}
+	if mode == WriteModeAppend {
+		output.BytesWritten, err = appendJSONLine(path, jsonData)
+		output.Appended = true
+	} else {
+		path, err = writeJSONFile(path, jsonData, policy)
+		output.BytesWritten = len(jsonData)
+	}
 	if err != nil {
-		return nil, WriteOutputOutput{}, fmt.Errorf("failed to serialize data: %w", err)
+		return nil, WriteOutputOutput{}, err
 	}
+	output.FilePath = path
 
-	// Write to file
-	if err := os.WriteFile(input.Path, jsonData, 0644); err != nil {
-		return nil, WriteOutputOutput{}, fmt.Errorf("failed to write file: %w", err)
+	return nil, output, nil
+}
+
+// writeJSONFile writes data to path through a synced temp file renamed into
+// place, so a crash leaves either the old file or the new one, never a
+// truncated one. Under the error and suffix policies the file is created
+// exclusively, so a concurrent writer can't be overwritten either. It
+// returns the path written.
+func writeJSONFile(path string, data []byte, policy pathtmpl.Policy) (string, error) {
+	if policy == pathtmpl.PolicyOverwrite {
+		if err := fsutil.WriteFile(path, data, 0644); err != nil {
+			return "", fmt.Errorf("failed to write file: %w", err)
+		}
+		return path, nil
 	}
 
-	output := WriteOutputOutput{
-		Success:      true,
-		FilePath:     input.Path,
-		BytesWritten: len(jsonData),
+	for range maxWriteAttempts {
+		target, err := pathtmpl.Resolve(path, policy)
+		if err != nil {
+			return "", err
+		}
+		err = fsutil.WriteNew(target, data, 0644)
+		if err == nil {
+			return target, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", fmt.Errorf("failed to write file: %w", err)
+		}
+		if policy == pathtmpl.PolicyError {
+			return "", fmt.Errorf("%w: %s", pathtmpl.ErrExists, target)
+		}
 	}
+	return "", fmt.Errorf("failed to write file: %s kept being taken by other writers", path)
+}
 
-	return nil, output, nil
+// appendJSONLine appends data as one line of a JSON Lines file and syncs it.
+// A last line cut short by a crash is ended first, so the new record starts
+// on its own line and readers can skip the broken one. It returns the number
+// of bytes written.
+func appendJSONLine(path string, data []byte) (int, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	line := append(bytes.TrimSpace(data), '\n')
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err != nil && err != io.EOF {
+			return 0, fmt.Errorf("failed to read file: %w", err)
+		}
+		if last[0] != '\n' {
+			line = append([]byte{'\n'}, line...)
+		}
+	}
+
+	if _, err := f.Write(line); err != nil {
+		return 0, fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync file: %w", err)
+	}
+	return len(line), nil
+}
+
+// templatePath names the output for jsonData under baseDir. Data that isn't
+// a JSON object fills every placeholder but {id} with "unknown".
+func templatePath(baseDir, template string, jsonData []byte) (string, error) {
+	tmpl, err := pathtmpl.Parse(template)
+	if err != nil {
+		return "", err
+	}
+	var data map[string]any
+	json.Unmarshal(jsonData, &data)
+
+	fields := pathtmpl.FromData(data)
+	id := make([]byte, 4)
+	rand.Read(id)
+	fields[pathtmpl.ID] = hex.EncodeToString(id)
+
+	if baseDir == "" {
+		baseDir = "."
+	}
+	return filepath.Join(baseDir, tmpl.Render(fields)), nil
 }